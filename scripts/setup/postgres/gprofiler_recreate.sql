@@ -125,9 +125,13 @@ CREATE TABLE ProfilerTokens (
     "token" text NOT NULL,
     disabled timestamp NULL,
     ts timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+    external_id text NULL,
+    description text NULL,
     CONSTRAINT profilertokens_token_key UNIQUE (token)
 );
 
+CREATE UNIQUE INDEX profilertokens_external_id_idx ON ProfilerTokens (external_id) WHERE external_id IS NOT NULL AND disabled IS NULL;
+
 
 CREATE TABLE Services (
     ID bigserial PRIMARY KEY,
@@ -139,10 +143,16 @@ CREATE TABLE Services (
     is_cluster bool NOT NULL DEFAULT false,
     env_type envtype NULL,
     profiler_sample_threshold float8 NULL,
+    archived_at timestamp NULL,
+    purge_after timestamp NULL,
+    purged_at timestamp NULL,
+    external_id text NULL,
     CONSTRAINT "unique service" UNIQUE (name)
 );
 
 CREATE INDEX services_hidden_idx ON services USING btree (hidden);
+CREATE INDEX services_purge_after_idx ON Services (purge_after) WHERE archived_at IS NOT NULL AND purged_at IS NULL;
+CREATE UNIQUE INDEX services_external_id_idx ON Services (external_id) WHERE external_id IS NOT NULL;
 
 
 CREATE TABLE TokenAssociations (
@@ -187,6 +197,55 @@ CREATE TABLE ProfilerFilters
     ts timestamp DEFAULT CURRENT_TIMESTAMP
 );
 
+-- FrameAnnotations table for notes, JIRA links and ownership attached to flamegraph frames
+CREATE TABLE FrameAnnotations (
+    ID bigserial PRIMARY KEY,
+    service_id bigint NOT NULL,
+    frame_path text[] NOT NULL,
+    include_subtree boolean NOT NULL DEFAULT TRUE,
+    annotation_type text NOT NULL CHECK (annotation_type IN ('note', 'jira', 'owner')),
+    content text NOT NULL,
+    link text,
+    author text,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_frame_annotation_service
+        FOREIGN KEY (service_id)
+        REFERENCES Services(ID)
+        ON DELETE CASCADE
+);
+
+CREATE INDEX idx_frame_annotations_service ON FrameAnnotations(service_id);
+
+-- FrameOwnership table mapping frame name prefixes (packages, namespaces) of a service to owning teams
+CREATE TABLE FrameOwnership (
+    ID bigserial PRIMARY KEY,
+    service_id bigint NOT NULL,
+    prefix text NOT NULL,
+    team text NOT NULL,
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_frame_ownership_prefix UNIQUE (service_id, prefix),
+    CONSTRAINT fk_frame_ownership_service
+        FOREIGN KEY (service_id)
+        REFERENCES Services(ID)
+        ON DELETE CASCADE
+);
+
+-- QueryTemplates table of named service sets, filters and formats invoked by automation and runbooks
+CREATE TABLE QueryTemplates (
+    ID bigserial PRIMARY KEY,
+    name text NOT NULL,
+    description text,
+    service_names text[] NOT NULL,
+    filter_content jsonb,
+    format text NOT NULL DEFAULT 'flamegraph' CHECK (format IN ('flamegraph', 'collapsed_file')),
+    lookback_seconds integer NOT NULL DEFAULT 3600 CHECK (lookback_seconds > 0),
+    stacks_count integer,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_query_template_name UNIQUE (name)
+);
+
 CREATE TABLE ProfilerProcesses (
     ID bigserial PRIMARY KEY,
     instance_run bigint NOT NULL CONSTRAINT "profiler_process must belong to a valid instance_run" REFERENCES InstanceRuns,
@@ -244,6 +303,7 @@ CREATE TABLE AdhocFlamegraphMetadata (
     end_time timestamp NOT NULL,
     file_size bigint,
     created_at timestamp DEFAULT CURRENT_TIMESTAMP,
+    content_key text NULL,
     CONSTRAINT fk_adhoc_flamegraph_service 
         FOREIGN KEY (service_id) 
         REFERENCES Services(ID) 
@@ -253,6 +313,50 @@ CREATE TABLE AdhocFlamegraphMetadata (
 CREATE INDEX idx_adhoc_metadata_service_time ON AdhocFlamegraphMetadata(service_id, start_time DESC);
 CREATE INDEX idx_adhoc_metadata_s3_key ON AdhocFlamegraphMetadata(s3_key);
 CREATE INDEX idx_adhoc_metadata_hostname ON AdhocFlamegraphMetadata(hostname);
+CREATE INDEX idx_adhoc_metadata_content_key ON AdhocFlamegraphMetadata(content_key) WHERE content_key IS NOT NULL;
+
+-- ServiceTechnologyTags table for technologies detected by the indexer from frame names
+CREATE TABLE ServiceTechnologyTags (
+    ID bigserial PRIMARY KEY,
+    service_id bigint NOT NULL,
+    tag text NOT NULL,
+    first_seen timestamp NOT NULL,
+    last_seen timestamp NOT NULL,
+    CONSTRAINT unique_service_technology_tag UNIQUE (service_id, tag),
+    CONSTRAINT fk_service_technology_tag_service
+        FOREIGN KEY (service_id)
+        REFERENCES Services(ID)
+        ON DELETE CASCADE
+);
+
+CREATE INDEX idx_service_technology_tags_tag ON ServiceTechnologyTags(tag);
+
+-- ServiceQuotas table of the limits set on the services through the admin API
+CREATE TABLE ServiceQuotas (
+    ID bigserial PRIMARY KEY,
+    service_id bigint NOT NULL,
+    max_hosts integer CHECK (max_hosts > 0),
+    max_profiles_per_hour integer CHECK (max_profiles_per_hour > 0),
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_service_quota UNIQUE (service_id),
+    CONSTRAINT fk_service_quota_service
+        FOREIGN KEY (service_id)
+        REFERENCES Services(ID)
+        ON DELETE CASCADE
+);
+
+-- ServiceRetentionOverrides table of the per service retention set through the admin API
+CREATE TABLE ServiceRetentionOverrides (
+    ID bigserial PRIMARY KEY,
+    service_id bigint NOT NULL,
+    retention_days integer NOT NULL CHECK (retention_days > 0),
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_service_retention_override UNIQUE (service_id),
+    CONSTRAINT fk_service_retention_override_service
+        FOREIGN KEY (service_id)
+        REFERENCES Services(ID)
+        ON DELETE CASCADE
+);
 
 CREATE TABLE MinesweeperFrames (
     ID bigserial PRIMARY KEY,
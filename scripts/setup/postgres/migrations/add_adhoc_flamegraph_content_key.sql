@@ -0,0 +1,29 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+
+-- Deduplicated adhoc flamegraphs.
+--
+-- With -flamegraph-dedup the indexer stores identical flamegraph HTML files
+-- of a service once, in a content addressed object named after the SHA-256
+-- of the content. content_key is that object, s3_key keeps identifying the
+-- flamegraph. Rows without content_key have their HTML stored at s3_key.
+
+ALTER TABLE AdhocFlamegraphMetadata
+ADD COLUMN IF NOT EXISTS content_key text NULL;
+
+CREATE INDEX IF NOT EXISTS idx_adhoc_metadata_content_key ON AdhocFlamegraphMetadata(content_key)
+    WHERE content_key IS NOT NULL;
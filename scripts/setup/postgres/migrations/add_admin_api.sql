@@ -0,0 +1,60 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+-- Admin API for automation (Terraform providers, provisioning scripts).
+--
+-- Services and profiler tokens managed through the admin API are addressed
+-- by an external id chosen by the caller, so that repeated calls converge on
+-- the same rows. A revoked token keeps its external id, the id can be reused
+-- by a new token. Quotas and retention overrides are per service settings.
+
+ALTER TABLE Services
+ADD COLUMN IF NOT EXISTS external_id text NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS services_external_id_idx ON Services (external_id)
+    WHERE external_id IS NOT NULL;
+
+ALTER TABLE ProfilerTokens
+ADD COLUMN IF NOT EXISTS external_id text NULL,
+ADD COLUMN IF NOT EXISTS description text NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS profilertokens_external_id_idx ON ProfilerTokens (external_id)
+    WHERE external_id IS NOT NULL AND disabled IS NULL;
+
+CREATE TABLE IF NOT EXISTS ServiceQuotas (
+    ID bigserial PRIMARY KEY,
+    service_id bigint NOT NULL,
+    max_hosts integer CHECK (max_hosts > 0),
+    max_profiles_per_hour integer CHECK (max_profiles_per_hour > 0),
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_service_quota UNIQUE (service_id),
+    CONSTRAINT fk_service_quota_service
+        FOREIGN KEY (service_id)
+        REFERENCES Services(ID)
+        ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS ServiceRetentionOverrides (
+    ID bigserial PRIMARY KEY,
+    service_id bigint NOT NULL,
+    retention_days integer NOT NULL CHECK (retention_days > 0),
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_service_retention_override UNIQUE (service_id),
+    CONSTRAINT fk_service_retention_override_service
+        FOREIGN KEY (service_id)
+        REFERENCES Services(ID)
+        ON DELETE CASCADE
+);
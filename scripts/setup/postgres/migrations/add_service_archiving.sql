@@ -0,0 +1,31 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+
+-- Soft deletion of services.
+--
+-- An archived service is hidden (listings and queries ignore it) and can be
+-- restored until purge_after. Past that date the indexer purge job deletes
+-- its profiling data from ClickHouse and sets purged_at, the service can no
+-- longer be restored.
+
+ALTER TABLE Services
+ADD COLUMN IF NOT EXISTS archived_at timestamp NULL,
+ADD COLUMN IF NOT EXISTS purge_after timestamp NULL,
+ADD COLUMN IF NOT EXISTS purged_at timestamp NULL;
+
+CREATE INDEX IF NOT EXISTS services_purge_after_idx ON Services (purge_after)
+    WHERE archived_at IS NOT NULL AND purged_at IS NULL;
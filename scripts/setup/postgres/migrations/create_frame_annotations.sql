@@ -0,0 +1,43 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+-- Annotations (notes, JIRA links, ownership) attached to flamegraph frames.
+--
+-- A frame is identified by its path of frame names from the root of the
+-- flamegraph. An annotation with include_subtree set applies to every frame
+-- under that path as well. Annotations are managed under /api/annotations and
+-- returned with /api/flamegraph responses when withAnnotations is set.
+
+CREATE TABLE IF NOT EXISTS FrameAnnotations (
+    ID bigserial PRIMARY KEY,
+    service_id bigint NOT NULL,
+    frame_path text[] NOT NULL,
+    include_subtree boolean NOT NULL DEFAULT TRUE,
+    annotation_type text NOT NULL CHECK (annotation_type IN ('note', 'jira', 'owner')),
+    content text NOT NULL,
+    link text,
+    author text,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT fk_frame_annotation_service
+        FOREIGN KEY (service_id)
+        REFERENCES Services(ID)
+        ON DELETE CASCADE
+);
+
+-- Index for listing the annotations of a service
+CREATE INDEX IF NOT EXISTS idx_frame_annotations_service
+ON FrameAnnotations(service_id);
@@ -0,0 +1,35 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+-- Ownership of frames by teams, per service.
+--
+-- Every frame whose name starts with a prefix (e.g. "com/acme/payments/" or
+-- "acme::search::") is owned by the mapped team, the longest matching prefix
+-- wins. Mappings are uploaded under /api/ownership/service/{service_name} and
+-- used to attribute the CPU of the service to its owning teams.
+
+CREATE TABLE IF NOT EXISTS FrameOwnership (
+    ID bigserial PRIMARY KEY,
+    service_id bigint NOT NULL,
+    prefix text NOT NULL,
+    team text NOT NULL,
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_frame_ownership_prefix UNIQUE (service_id, prefix),
+    CONSTRAINT fk_frame_ownership_service
+        FOREIGN KEY (service_id)
+        REFERENCES Services(ID)
+        ON DELETE CASCADE
+);
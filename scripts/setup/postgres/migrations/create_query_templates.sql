@@ -0,0 +1,37 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+
+-- Named query templates, defined by admins.
+--
+-- A template captures a set of services, an RQL filter and an output format
+-- so that automation and runbooks can fetch the same flamegraphs by name,
+-- e.g. GET /api/query_templates/checkout-hot-paths/run. Any part of the
+-- template can be overridden by the query parameters of the run request.
+
+CREATE TABLE IF NOT EXISTS QueryTemplates (
+    ID bigserial PRIMARY KEY,
+    name text NOT NULL,
+    description text,
+    service_names text[] NOT NULL,
+    filter_content jsonb,
+    format text NOT NULL DEFAULT 'flamegraph' CHECK (format IN ('flamegraph', 'collapsed_file')),
+    lookback_seconds integer NOT NULL DEFAULT 3600 CHECK (lookback_seconds > 0),
+    stacks_count integer,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_query_template_name UNIQUE (name)
+);
@@ -0,0 +1,39 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+-- Technologies (Kafka client, gRPC, RocksDB, OpenSSL...) detected per service.
+--
+-- The indexer matches frame names of every ingested profile against known
+-- signatures and upserts the detected tags, refreshing last_seen at most once
+-- per -service-tagging-refresh-interval. Tags are listed by the webapp under
+-- /api/services/technologies and can be used to target optimization rules.
+
+CREATE TABLE IF NOT EXISTS ServiceTechnologyTags (
+    ID bigserial PRIMARY KEY,
+    service_id bigint NOT NULL,
+    tag text NOT NULL,
+    first_seen timestamp NOT NULL,
+    last_seen timestamp NOT NULL,
+    CONSTRAINT unique_service_technology_tag UNIQUE (service_id, tag),
+    CONSTRAINT fk_service_technology_tag_service
+        FOREIGN KEY (service_id)
+        REFERENCES Services(ID)
+        ON DELETE CASCADE
+);
+
+-- Index for listing the services using a technology
+CREATE INDEX IF NOT EXISTS idx_service_technology_tags_tag
+ON ServiceTechnologyTags(tag);
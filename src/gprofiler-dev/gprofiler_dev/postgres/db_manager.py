@@ -557,6 +557,147 @@ class DBManager(metaclass=Singleton):
         values = {"filter_id": filter_id}
         self.db.execute(SQLQueries.DELETE_FILTER, values, has_value=False)
 
+    def get_frame_annotations(self, service_id: int) -> List[Dict]:
+        values = {"service_id": service_id}
+        return self.db.execute(
+            SQLQueries.GET_FRAME_ANNOTATIONS_BY_SERVICE_ID, values, one_value=False, return_dict=True, fetch_all=True
+        )
+
+    def add_frame_annotation(self, service_id: int, annotation: Dict[str, Any]) -> int:
+        values = {"service_id": service_id, **annotation}
+        return self.db.execute(SQLQueries.INSERT_FRAME_ANNOTATION, values)
+
+    def update_frame_annotation(self, annotation_id: int, annotation: Dict[str, Any]) -> Optional[int]:
+        values = {"annotation_id": annotation_id, **annotation}
+        return self.db.execute(SQLQueries.UPDATE_FRAME_ANNOTATION, values)
+
+    def delete_frame_annotation(self, annotation_id: int):
+        values = {"annotation_id": annotation_id}
+        self.db.execute(SQLQueries.DELETE_FRAME_ANNOTATION, values, has_value=False)
+
+    def get_frame_ownership(self, service_id: int) -> List[Dict]:
+        values = {"service_id": service_id}
+        return self.db.execute(
+            SQLQueries.GET_FRAME_OWNERSHIP_BY_SERVICE_ID, values, one_value=False, return_dict=True, fetch_all=True
+        )
+
+    def replace_frame_ownership(self, service_id: int, mappings: List[Tuple[str, str]]):
+        """
+        Replace the (prefix, team) ownership mapping of a service, in a single transaction.
+        """
+        with self.db.transaction() as cursor:
+            cursor.execute(SQLQueries.DELETE_FRAME_OWNERSHIP_BY_SERVICE_ID, {"service_id": service_id})
+            if mappings:
+                psycopg2.extras.execute_values(
+                    cursor,
+                    SQLQueries.INSERT_FRAME_OWNERSHIP,
+                    [(service_id, prefix, team) for prefix, team in mappings],
+                )
+
+    def get_services_with_frame_ownership(self) -> List[str]:
+        rows = self.db.execute(
+            SQLQueries.GET_SERVICES_WITH_FRAME_OWNERSHIP, one_value=False, return_dict=False, fetch_all=True
+        )
+        return [row[0] for row in rows or []]
+
+    def get_query_templates(self) -> List[Dict]:
+        return self.db.execute(SQLQueries.GET_QUERY_TEMPLATES, one_value=False, return_dict=True, fetch_all=True)
+
+    def get_query_template(self, name: str) -> Optional[Dict]:
+        values = {"name": name}
+        return self.db.execute(SQLQueries.GET_QUERY_TEMPLATE_BY_NAME, values, one_value=False, return_dict=True)
+
+    def upsert_query_template(self, template: Dict[str, Any]) -> int:
+        """
+        Create the template, or replace the template of the same name.
+        """
+        rql_filter = template.get("filter")
+        values = {**template, "filter_content": json.dumps(rql_filter) if rql_filter else None}
+        return self.db.execute(SQLQueries.UPSERT_QUERY_TEMPLATE, values)
+
+    def delete_query_template(self, name: str) -> Optional[int]:
+        values = {"name": name}
+        return self.db.execute(SQLQueries.DELETE_QUERY_TEMPLATE, values)
+
+    def get_archived_services(self) -> List[Dict]:
+        return self.db.execute(SQLQueries.GET_ARCHIVED_SERVICES, one_value=False, return_dict=True, fetch_all=True)
+
+    def archive_service(self, service_name: str, retention_days: int) -> Optional[Dict]:
+        """
+        Hide the service until it is restored, its profiling data is purged after retention_days.
+        None is returned when there is no such service, or when it is already archived.
+        """
+        values = {"service_name": service_name, "retention_days": retention_days}
+        return self.db.execute(SQLQueries.ARCHIVE_SERVICE, values, one_value=False, return_dict=True)
+
+    def restore_service(self, service_name: str) -> Optional[int]:
+        """
+        Unhide an archived service, as long as its restore window is not over.
+        """
+        values = {"service_name": service_name}
+        return self.db.execute(SQLQueries.RESTORE_SERVICE, values)
+
+    def get_admin_services(self) -> List[Dict]:
+        return self.db.execute(SQLQueries.GET_ADMIN_SERVICES, one_value=False, return_dict=True, fetch_all=True)
+
+    def get_admin_service(self, external_id: str) -> Optional[Dict]:
+        values = {"external_id": external_id}
+        return self.db.execute(SQLQueries.GET_ADMIN_SERVICE, values, one_value=False, return_dict=True)
+
+    def upsert_admin_service(self, external_id: str, service_name: str, env_type: Optional[str]) -> Optional[Dict]:
+        """
+        Create the service, or adopt the existing service of the same name when it has no external id yet.
+        None is returned when the name belongs to a service of another external id.
+        """
+        values = {"external_id": external_id, "name": service_name, "env_type": env_type}
+        return self.db.execute(SQLQueries.UPSERT_ADMIN_SERVICE, values, one_value=False, return_dict=True)
+
+    def get_admin_api_keys(self) -> List[Dict]:
+        return self.db.execute(SQLQueries.GET_ADMIN_API_KEYS, one_value=False, return_dict=True, fetch_all=True)
+
+    def get_admin_api_key(self, external_id: str) -> Optional[Dict]:
+        values = {"external_id": external_id}
+        return self.db.execute(SQLQueries.GET_ADMIN_API_KEY, values, one_value=False, return_dict=True)
+
+    def upsert_admin_api_key(self, external_id: str, description: Optional[str]) -> Dict:
+        """
+        Create a profiler token for the external id, or update the description of its active token.
+        """
+        values = {"external_id": external_id, "token": generate_token(32), "description": description}
+        return self.db.execute(SQLQueries.UPSERT_ADMIN_API_KEY, values, one_value=False, return_dict=True)
+
+    def revoke_admin_api_key(self, external_id: str) -> Optional[int]:
+        values = {"external_id": external_id}
+        return self.db.execute(SQLQueries.REVOKE_ADMIN_API_KEY, values)
+
+    def get_service_quota(self, service_id: int) -> Optional[Dict]:
+        values = {"service_id": service_id}
+        return self.db.execute(SQLQueries.GET_SERVICE_QUOTA, values, one_value=False, return_dict=True)
+
+    def upsert_service_quota(
+        self, service_id: int, max_hosts: Optional[int], max_profiles_per_hour: Optional[int]
+    ) -> Dict:
+        values = {"service_id": service_id, "max_hosts": max_hosts, "max_profiles_per_hour": max_profiles_per_hour}
+        return self.db.execute(SQLQueries.UPSERT_SERVICE_QUOTA, values, one_value=False, return_dict=True)
+
+    def delete_service_quota(self, service_id: int) -> Optional[int]:
+        values = {"service_id": service_id}
+        return self.db.execute(SQLQueries.DELETE_SERVICE_QUOTA, values)
+
+    def get_service_retention_override(self, service_id: int) -> Optional[Dict]:
+        values = {"service_id": service_id}
+        return self.db.execute(SQLQueries.GET_SERVICE_RETENTION_OVERRIDE, values, one_value=False, return_dict=True)
+
+    def upsert_service_retention_override(self, service_id: int, retention_days: int) -> Dict:
+        values = {"service_id": service_id, "retention_days": retention_days}
+        return self.db.execute(
+            SQLQueries.UPSERT_SERVICE_RETENTION_OVERRIDE, values, one_value=False, return_dict=True
+        )
+
+    def delete_service_retention_override(self, service_id: int) -> Optional[int]:
+        values = {"service_id": service_id}
+        return self.db.execute(SQLQueries.DELETE_SERVICE_RETENTION_OVERRIDE, values)
+
     def get_profiler_token(self) -> str:
         results = self.db.execute(
             SQLQueries.SELECT_PROFILER_TOKEN,
@@ -2712,6 +2853,59 @@ class DBManager(metaclass=Singleton):
 
         return combined_config
 
+    def get_service_technology_tags(
+        self, service_name: Optional[str] = None, tag: Optional[str] = None
+    ) -> List[Dict[str, Any]]:
+        """
+        Retrieve the technologies detected by the indexer in the profiles of the services.
+
+        Args:
+            service_name: Optional service to list the tags of
+            tag: Optional tag to list the services of
+
+        Returns:
+            List of dictionaries containing service_name, tag, first_seen and last_seen
+        """
+        conditions = ["TRUE"]
+        params: List[Any] = []
+
+        if service_name:
+            conditions.append("Services.name = %s")
+            params.append(service_name)
+
+        if tag:
+            conditions.append("ServiceTechnologyTags.tag = %s")
+            params.append(tag)
+
+        where_clause = " AND ".join(conditions)
+
+        query = f"""
+            SELECT
+                Services.name,
+                ServiceTechnologyTags.tag,
+                ServiceTechnologyTags.first_seen,
+                ServiceTechnologyTags.last_seen
+            FROM ServiceTechnologyTags
+            JOIN Services ON Services.ID = ServiceTechnologyTags.service_id
+            WHERE {where_clause}
+            ORDER BY Services.name, ServiceTechnologyTags.tag
+        """
+
+        results = self.db.execute(query, tuple(params), one_value=False, fetch_all=True)
+
+        if not results:
+            return []
+
+        return [
+            {
+                "service_name": row[0],
+                "tag": row[1],
+                "first_seen": row[2],
+                "last_seen": row[3],
+            }
+            for row in results
+        ]
+
     def get_adhoc_flamegraphs_metadata(
         self,
         service_id: int,
@@ -2729,7 +2923,7 @@ class DBManager(metaclass=Singleton):
             hostname_filters: Optional list of hostnames to filter by
             
         Returns:
-            List of metadata dictionaries containing s3_key, hostname, perf_events, and start_time
+            List of metadata dictionaries containing s3_key, hostname, perf_events, start_time and content_key
         """
         conditions = ["service_id = %s"]
         params: List[Any] = [service_id]
@@ -2755,7 +2949,8 @@ class DBManager(metaclass=Singleton):
                 hostname,
                 perf_events,
                 start_time,
-                file_size
+                file_size,
+                content_key
             FROM AdhocFlamegraphMetadata
             WHERE {where_clause}
             ORDER BY start_time DESC
@@ -2773,6 +2968,15 @@ class DBManager(metaclass=Singleton):
                 "perf_events": row[2] if row[2] else [],
                 "start_time": row[3].isoformat() if row[3] else None,
                 "file_size": row[4] if len(row) > 4 else None,
+                "content_key": row[5] if len(row) > 5 else None,
             }
             for row in results
         ]
+
+    def get_adhoc_flamegraph_content_key(self, s3_key: str) -> Optional[str]:
+        """
+        Return the content addressed object holding a deduplicated adhoc flamegraph, None when its HTML is
+        stored at s3_key.
+        """
+        query = "SELECT content_key FROM AdhocFlamegraphMetadata WHERE s3_key = %s"
+        return self.db.execute(query, (s3_key,), one_value=True)
@@ -226,10 +226,245 @@ class SQLQueries:
         WHERE ProfilerFilters.service = %(service_id)s
     """
     )
+    INSERT_FRAME_ANNOTATION = dedent(
+        """
+        INSERT INTO FrameAnnotations(service_id, frame_path, include_subtree, annotation_type, content, link, author)
+        VALUES (
+            %(service_id)s, %(frame_path)s, %(include_subtree)s, %(annotation_type)s, %(content)s, %(link)s,
+            %(author)s
+        )
+        RETURNING ID;
+    """
+    )
+    UPDATE_FRAME_ANNOTATION = dedent(
+        """
+        UPDATE FrameAnnotations
+        SET frame_path = %(frame_path)s, include_subtree = %(include_subtree)s,
+            annotation_type = %(annotation_type)s, content = %(content)s, link = %(link)s, author = %(author)s,
+            updated_at = CURRENT_TIMESTAMP
+        WHERE FrameAnnotations.ID = %(annotation_id)s
+        RETURNING ID;
+    """
+    )
+    DELETE_FRAME_ANNOTATION = dedent(
+        """
+        DELETE FROM FrameAnnotations
+        WHERE FrameAnnotations.ID = %(annotation_id)s;
+    """
+    )
+    GET_FRAME_ANNOTATIONS_BY_SERVICE_ID = dedent(
+        """
+        SELECT id, frame_path, include_subtree, annotation_type, content, link, author, created_at, updated_at
+        FROM FrameAnnotations
+        WHERE FrameAnnotations.service_id = %(service_id)s
+        ORDER BY frame_path, id
+    """
+    )
+    GET_FRAME_OWNERSHIP_BY_SERVICE_ID = dedent(
+        """
+        SELECT prefix, team, updated_at FROM FrameOwnership
+        WHERE FrameOwnership.service_id = %(service_id)s
+        ORDER BY prefix
+    """
+    )
+    DELETE_FRAME_OWNERSHIP_BY_SERVICE_ID = dedent(
+        """
+        DELETE FROM FrameOwnership
+        WHERE FrameOwnership.service_id = %(service_id)s;
+    """
+    )
+    INSERT_FRAME_OWNERSHIP = dedent(
+        """
+        INSERT INTO FrameOwnership(service_id, prefix, team)
+        VALUES %s;
+    """
+    )
+    GET_SERVICES_WITH_FRAME_OWNERSHIP = dedent(
+        """
+        SELECT DISTINCT Services.name
+        FROM FrameOwnership
+        JOIN Services ON Services.ID = FrameOwnership.service_id
+        ORDER BY Services.name
+    """
+    )
+    GET_QUERY_TEMPLATES = dedent(
+        """
+        SELECT name, description, service_names, filter_content, format, lookback_seconds, stacks_count,
+            created_at, updated_at
+        FROM QueryTemplates
+        ORDER BY name
+    """
+    )
+    GET_QUERY_TEMPLATE_BY_NAME = dedent(
+        """
+        SELECT name, description, service_names, filter_content, format, lookback_seconds, stacks_count,
+            created_at, updated_at
+        FROM QueryTemplates
+        WHERE QueryTemplates.name = %(name)s
+    """
+    )
+    UPSERT_QUERY_TEMPLATE = dedent(
+        """
+        INSERT INTO QueryTemplates(name, description, service_names, filter_content, format, lookback_seconds,
+            stacks_count)
+        VALUES (
+            %(name)s, %(description)s, %(service_names)s, %(filter_content)s, %(format)s, %(lookback_seconds)s,
+            %(stacks_count)s
+        )
+        ON CONFLICT (name) DO UPDATE
+        SET description = EXCLUDED.description, service_names = EXCLUDED.service_names,
+            filter_content = EXCLUDED.filter_content, format = EXCLUDED.format,
+            lookback_seconds = EXCLUDED.lookback_seconds, stacks_count = EXCLUDED.stacks_count,
+            updated_at = CURRENT_TIMESTAMP
+        RETURNING ID;
+    """
+    )
+    DELETE_QUERY_TEMPLATE = dedent(
+        """
+        DELETE FROM QueryTemplates
+        WHERE QueryTemplates.name = %(name)s
+        RETURNING ID;
+    """
+    )
+    GET_ARCHIVED_SERVICES = dedent(
+        """
+        SELECT name AS service_name, archived_at, purge_after, purged_at
+        FROM Services
+        WHERE archived_at IS NOT NULL AND cluster_id IS NULL
+        ORDER BY archived_at DESC
+    """
+    )
+    ARCHIVE_SERVICE = dedent(
+        """
+        UPDATE Services
+        SET hidden = true, archived_at = CURRENT_TIMESTAMP,
+            purge_after = CURRENT_TIMESTAMP + %(retention_days)s * INTERVAL '1 days'
+        WHERE name = %(service_name)s AND cluster_id IS NULL AND archived_at IS NULL
+        RETURNING name AS service_name, archived_at, purge_after, purged_at;
+    """
+    )
+    RESTORE_SERVICE = dedent(
+        """
+        UPDATE Services
+        SET hidden = false, archived_at = NULL, purge_after = NULL
+        WHERE name = %(service_name)s AND cluster_id IS NULL AND archived_at IS NOT NULL AND purged_at IS NULL
+            AND purge_after > CURRENT_TIMESTAMP
+        RETURNING ID;
+    """
+    )
+    GET_ADMIN_SERVICES = dedent(
+        """
+        SELECT Services.external_id, Services.ID AS service_id, Services.name, Services.env_type,
+            Services.ts AS created_at, Services.archived_at, Services.purge_after
+        FROM Services
+        WHERE Services.external_id IS NOT NULL
+        ORDER BY Services.external_id
+    """
+    )
+    GET_ADMIN_SERVICE = dedent(
+        """
+        SELECT Services.external_id, Services.ID AS service_id, Services.name, Services.env_type,
+            Services.ts AS created_at, Services.archived_at, Services.purge_after
+        FROM Services
+        WHERE Services.external_id = %(external_id)s
+    """
+    )
+    UPSERT_ADMIN_SERVICE = dedent(
+        """
+        INSERT INTO Services(name, env_type, external_id)
+        VALUES (%(name)s, %(env_type)s, %(external_id)s)
+        ON CONFLICT ON CONSTRAINT "unique service" DO UPDATE
+        SET external_id = EXCLUDED.external_id, env_type = COALESCE(EXCLUDED.env_type, Services.env_type)
+        WHERE Services.cluster_id IS NULL
+            AND (Services.external_id IS NULL OR Services.external_id = EXCLUDED.external_id)
+        RETURNING Services.external_id, Services.ID AS service_id, Services.name, Services.env_type,
+            Services.ts AS created_at, Services.archived_at, Services.purge_after,
+            (xmax = 0) AS created;
+    """
+    )
+    GET_ADMIN_API_KEYS = dedent(
+        """
+        SELECT external_id, token AS api_key, description, ts AS created_at
+        FROM ProfilerTokens
+        WHERE external_id IS NOT NULL AND disabled IS NULL
+        ORDER BY external_id
+    """
+    )
+    GET_ADMIN_API_KEY = dedent(
+        """
+        SELECT external_id, token AS api_key, description, ts AS created_at
+        FROM ProfilerTokens
+        WHERE external_id = %(external_id)s AND disabled IS NULL
+    """
+    )
+    UPSERT_ADMIN_API_KEY = dedent(
+        """
+        INSERT INTO ProfilerTokens(token, external_id, description)
+        VALUES (%(token)s, %(external_id)s, %(description)s)
+        ON CONFLICT (external_id) WHERE external_id IS NOT NULL AND disabled IS NULL DO UPDATE
+        SET description = EXCLUDED.description
+        RETURNING external_id, token AS api_key, description, ts AS created_at, (xmax = 0) AS created;
+    """
+    )
+    REVOKE_ADMIN_API_KEY = dedent(
+        """
+        UPDATE ProfilerTokens
+        SET disabled = CURRENT_TIMESTAMP
+        WHERE external_id = %(external_id)s AND disabled IS NULL
+        RETURNING ID;
+    """
+    )
+    GET_SERVICE_QUOTA = dedent(
+        """
+        SELECT max_hosts, max_profiles_per_hour, updated_at
+        FROM ServiceQuotas
+        WHERE service_id = %(service_id)s
+    """
+    )
+    UPSERT_SERVICE_QUOTA = dedent(
+        """
+        INSERT INTO ServiceQuotas(service_id, max_hosts, max_profiles_per_hour)
+        VALUES (%(service_id)s, %(max_hosts)s, %(max_profiles_per_hour)s)
+        ON CONFLICT (service_id) DO UPDATE
+        SET max_hosts = EXCLUDED.max_hosts, max_profiles_per_hour = EXCLUDED.max_profiles_per_hour,
+            updated_at = CURRENT_TIMESTAMP
+        RETURNING max_hosts, max_profiles_per_hour, updated_at;
+    """
+    )
+    DELETE_SERVICE_QUOTA = dedent(
+        """
+        DELETE FROM ServiceQuotas
+        WHERE service_id = %(service_id)s
+        RETURNING ID;
+    """
+    )
+    GET_SERVICE_RETENTION_OVERRIDE = dedent(
+        """
+        SELECT retention_days, updated_at
+        FROM ServiceRetentionOverrides
+        WHERE service_id = %(service_id)s
+    """
+    )
+    UPSERT_SERVICE_RETENTION_OVERRIDE = dedent(
+        """
+        INSERT INTO ServiceRetentionOverrides(service_id, retention_days)
+        VALUES (%(service_id)s, %(retention_days)s)
+        ON CONFLICT (service_id) DO UPDATE
+        SET retention_days = EXCLUDED.retention_days, updated_at = CURRENT_TIMESTAMP
+        RETURNING retention_days, updated_at;
+    """
+    )
+    DELETE_SERVICE_RETENTION_OVERRIDE = dedent(
+        """
+        DELETE FROM ServiceRetentionOverrides
+        WHERE service_id = %(service_id)s
+        RETURNING ID;
+    """
+    )
     SELECT_PROFILER_TOKEN = dedent(
         """
         SELECT token FROM ProfilerTokens
-        WHERE ProfilerTokens.disabled IS NULL
+        WHERE ProfilerTokens.disabled IS NULL AND ProfilerTokens.external_id IS NULL
     """
     )
     SELECT_PROFILER_TOKEN_ID = dedent(
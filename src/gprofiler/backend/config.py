@@ -40,6 +40,20 @@ REST_CERTIFICATE_PATH = os.getenv("REST_CERTIFICATE_PATH", REST_VERIFY_TLS)
 REST_USERNAME = os.getenv("REST_USERNAME", "")
 REST_PASSWORD = os.getenv("REST_PASSWORD", "")
 
+# Token required (in the GPROFILER-ADMIN-TOKEN header) to create, replace or delete query templates,
+# templates are read-only when it is not set
+QUERY_TEMPLATES_ADMIN_TOKEN = os.getenv("QUERY_TEMPLATES_ADMIN_TOKEN", "")
+
+# Token required (in the GPROFILER-ADMIN-TOKEN header) to archive or restore services, nobody can when it is not set.
+# Archived services can be restored for SERVICES_ARCHIVE_RETENTION_DAYS days (by default), then the indexer
+# purges their profiling data.
+SERVICES_ADMIN_TOKEN = os.getenv("SERVICES_ADMIN_TOKEN", "")
+SERVICES_ARCHIVE_RETENTION_DAYS = int(os.getenv("SERVICES_ARCHIVE_RETENTION_DAYS", 30))
+
+# Token required (in the GPROFILER-ADMIN-TOKEN header) by the admin API used by automation to manage services,
+# API keys, quotas and retention overrides. The admin API is disabled when it is not set.
+ADMIN_API_TOKEN = os.getenv("ADMIN_API_TOKEN", "")
+
 SLACK_BOT_TOKEN = os.getenv("SLACK_BOT_TOKEN")
 
 # Default Slack channels - can be overridden via SLACK_CHANNELS environment variable
@@ -0,0 +1,86 @@
+#
+# Copyright (C) 2023 Intel Corporation
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+#
+
+from datetime import datetime
+from enum import Enum
+from typing import Optional
+
+from backend.models import CamelModel
+from pydantic import Field, root_validator
+
+# external ids are chosen by the automation managing the resources, e.g. the id of a team or of a Terraform resource
+EXTERNAL_ID_PATTERN = r"^[A-Za-z0-9][A-Za-z0-9_.:-]{0,127}$"
+
+
+class ServiceEnvType(str, Enum):
+    INSTANCES = "instances"
+    K8S = "k8s"
+    CONTAINERS = "containers"
+    ECS = "ecs"
+
+
+class AdminServiceSpec(CamelModel):
+    # same characters as the service names sent by the agents
+    name: str = Field(..., regex=r"^[A-Za-z0-9][A-Za-z0-9_.-]*$", max_length=255)
+    env_type: Optional[ServiceEnvType] = None
+
+
+class AdminService(CamelModel):
+    external_id: str
+    service_id: int
+    name: str
+    env_type: Optional[str]
+    created_at: datetime
+    archived_at: Optional[datetime]
+    purge_after: Optional[datetime]
+
+
+class AdminApiKeySpec(CamelModel):
+    description: Optional[str] = Field(None, max_length=1024)
+
+
+class AdminApiKey(CamelModel):
+    external_id: str
+    # the full key is only returned once, when it is created, the prefix tells the keys apart
+    api_key: Optional[str]
+    api_key_prefix: str
+    description: Optional[str]
+    created_at: datetime
+
+
+class ServiceQuotaSpec(CamelModel):
+    max_hosts: Optional[int] = Field(None, gt=0)
+    max_profiles_per_hour: Optional[int] = Field(None, gt=0)
+
+    @root_validator(skip_on_failure=True)
+    def check_any_limit(cls, values):
+        if values.get("max_hosts") is None and values.get("max_profiles_per_hour") is None:
+            raise ValueError("at least one of maxHosts and maxProfilesPerHour is required")
+        return values
+
+
+class ServiceQuota(ServiceQuotaSpec):
+    external_id: str
+    updated_at: datetime
+
+
+class ServiceRetentionOverrideSpec(CamelModel):
+    retention_days: int = Field(..., gt=0)
+
+
+class ServiceRetentionOverride(ServiceRetentionOverrideSpec):
+    external_id: str
+    updated_at: datetime
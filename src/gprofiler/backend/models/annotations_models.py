@@ -0,0 +1,44 @@
+#
+# Copyright (C) 2023 Intel Corporation
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+#
+
+from datetime import datetime
+from enum import Enum
+from typing import List, Optional
+
+from backend.models import CamelModel
+from pydantic import Field
+
+
+class AnnotationType(str, Enum):
+    NOTE = "note"
+    JIRA = "jira"
+    OWNER = "owner"
+
+
+class FrameAnnotation(CamelModel):
+    # frame names from the root of the flamegraph (excluding "root") down to the annotated frame
+    frame_path: List[str] = Field(..., min_items=1)
+    include_subtree: bool = True
+    annotation_type: AnnotationType
+    content: str = Field(..., min_length=1)
+    link: Optional[str] = None
+    author: Optional[str] = None
+
+
+class GetFrameAnnotation(FrameAnnotation):
+    id: int
+    created_at: datetime
+    updated_at: datetime
@@ -47,6 +47,12 @@ class FilterTag(CamelModel):
     samples: Optional[str]
 
 
+class FilterCardinality(CamelModel):
+    dimension: str
+    distinct: int
+    enumerable: bool
+
+
 class RQLFilter(CamelModel):
     filter: Dict[RQLLogicOperators, List[Dict[FilterTypes, Dict[RQLCompareOperators, str]]]]
 
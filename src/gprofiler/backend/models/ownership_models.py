@@ -0,0 +1,60 @@
+#
+# Copyright (C) 2023 Intel Corporation
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+#
+
+from datetime import datetime
+from typing import List
+
+from backend.models import CamelModel
+from backend.models.common import ServiceName
+from pydantic import Field, validator
+
+
+class FrameOwner(CamelModel):
+    # frames whose name starts with the prefix (e.g. "com/acme/payments/") are owned by the team
+    prefix: str = Field(..., min_length=1)
+    team: str = Field(..., min_length=1)
+
+
+class GetFrameOwner(FrameOwner):
+    updated_at: datetime
+
+
+class FrameOwnership(CamelModel):
+    mappings: List[FrameOwner]
+
+    @validator("mappings")
+    def validate_unique_prefixes(cls, mappings: List[FrameOwner]) -> List[FrameOwner]:
+        prefixes = [mapping.prefix for mapping in mappings]
+        duplicates = sorted({prefix for prefix in prefixes if prefixes.count(prefix) > 1})
+        if duplicates:
+            raise ValueError(f"duplicate prefixes: {', '.join(duplicates)}")
+        return mappings
+
+
+class TeamCpuShare(CamelModel):
+    team: str
+    samples: int
+    cpu_share: float
+
+
+class ServiceCpuShare(CamelModel):
+    service_name: ServiceName
+    samples: int
+    cpu_share: float
+
+
+class TeamLeaderboardEntry(TeamCpuShare):
+    services: List[ServiceCpuShare]
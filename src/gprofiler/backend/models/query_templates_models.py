@@ -0,0 +1,59 @@
+#
+# Copyright (C) 2023 Intel Corporation
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+#
+
+
+from datetime import datetime
+from enum import Enum
+from typing import Any, List, Optional
+
+from backend.models import CamelModel
+from backend.models.filters_models import RQLFilter
+from pydantic import Field
+
+
+class QueryTemplateFormat(str, Enum):
+    FLAMEGRAPH = "flamegraph"
+    COLLAPSED_FILE = "collapsed_file"
+
+
+class QueryTemplate(CamelModel):
+    description: Optional[str] = None
+    service_names: List[str] = Field(..., min_items=1)
+    filter: Optional[RQLFilter] = None
+    format: QueryTemplateFormat = QueryTemplateFormat.FLAMEGRAPH
+    # the time range of a run ends now and spans lookback_seconds, unless passed by the run request
+    lookback_seconds: int = Field(3600, gt=0)
+    stacks_count: Optional[int] = Field(None, gt=0)
+
+
+class GetQueryTemplate(QueryTemplate):
+    name: str
+    created_at: datetime
+    updated_at: datetime
+
+
+class QueryTemplateServiceResult(CamelModel):
+    service_name: str
+    # the flamegraph, or the collapsed file text, None when the service has no data in the time range
+    data: Optional[Any] = None
+
+
+class QueryTemplateRun(CamelModel):
+    name: str
+    format: QueryTemplateFormat
+    start_time: datetime
+    end_time: datetime
+    results: List[QueryTemplateServiceResult]
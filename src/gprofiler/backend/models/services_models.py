@@ -27,3 +27,17 @@ class Service(CamelModel):
     name: ServiceName
     env_type: Optional[str]
     service_id: int
+
+
+class ServiceTechnologyTag(CamelModel):
+    service_name: ServiceName
+    tag: str
+    first_seen: datetime
+    last_seen: datetime
+
+
+class ArchivedService(CamelModel):
+    service_name: ServiceName
+    archived_at: datetime
+    purge_after: datetime
+    purged_at: Optional[datetime]
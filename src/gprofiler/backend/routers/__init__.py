@@ -15,6 +15,8 @@
 #
 
 from backend.routers import (
+    admin_routes,
+    annotations_routes,
     api_key_routes,
     filters_routes,
     flamegraph_routes,
@@ -23,8 +25,10 @@ from backend.routers import (
     metrics_routes,
     minesweeper_routes,
     overview_routes,
+    ownership_routes,
     perfspect_routes,
     profiles_routes,
+    query_templates_routes,
     services_routes,
 )
 from fastapi import APIRouter
@@ -39,6 +43,10 @@ router.include_router(api_key_routes.router, prefix="/api_key", tags=["auth"])
 router.include_router(profiles_routes.router, prefix="/v2/profiles", tags=["agent"])
 router.include_router(services_routes.router, prefix="/services", tags=["app"])
 router.include_router(filters_routes.router, prefix="/v1/filters", tags=["filters"])
+router.include_router(annotations_routes.router, prefix="/annotations", tags=["annotations"])
+router.include_router(ownership_routes.router, prefix="/ownership", tags=["ownership"])
+router.include_router(query_templates_routes.router, prefix="/query_templates", tags=["query templates"])
 router.include_router(overview_routes.router, prefix="/overview", tags=["overview"])
 router.include_router(minesweeper_routes.router, prefix="/snapshots", tags=["snapshots"])
 router.include_router(perfspect_routes.router, prefix="/perfspect", tags=["perfspect"])
+router.include_router(admin_routes.router, prefix="/admin", tags=["admin"])
@@ -0,0 +1,228 @@
+#
+# Copyright (C) 2023 Intel Corporation
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+#
+
+import hmac
+from logging import getLogger
+from typing import Dict, List, Optional
+
+from backend.config import ADMIN_API_TOKEN, SERVICES_ARCHIVE_RETENTION_DAYS
+from backend.models.admin_models import (
+    EXTERNAL_ID_PATTERN,
+    AdminApiKey,
+    AdminApiKeySpec,
+    AdminService,
+    AdminServiceSpec,
+    ServiceQuota,
+    ServiceQuotaSpec,
+    ServiceRetentionOverride,
+    ServiceRetentionOverrideSpec,
+)
+from fastapi import APIRouter, Depends, Header, HTTPException, Path
+from fastapi.responses import Response
+from gprofiler_dev.api_key import get_service_by_api_key
+from gprofiler_dev.postgres.db_manager import DBManager
+
+logger = getLogger(__name__)
+
+
+def verify_admin_token(gprofiler_admin_token: Optional[str] = Header(None)):
+    if not ADMIN_API_TOKEN:
+        raise HTTPException(status_code=403, detail="The admin API is disabled, ADMIN_API_TOKEN is not set")
+    if gprofiler_admin_token is None or not hmac.compare_digest(gprofiler_admin_token, ADMIN_API_TOKEN):
+        raise HTTPException(status_code=403, detail="Invalid admin token")
+
+
+router = APIRouter(dependencies=[Depends(verify_admin_token)])
+
+ExternalId = Path(..., regex=EXTERNAL_ID_PATTERN)
+
+API_KEY_PREFIX_LENGTH = 6
+
+
+def _get_service(db_manager: DBManager, external_id: str) -> Dict:
+    service = db_manager.get_admin_service(external_id)
+    if service is None:
+        raise HTTPException(status_code=404, detail=f"Service {external_id} not found")
+    return service
+
+
+@router.get("/services", response_model=List[AdminService])
+def get_services():
+    """
+    Services managed through the admin API, the archived ones included.
+    """
+    return DBManager().get_admin_services()
+
+
+@router.get("/services/{external_id}", response_model=AdminService)
+def get_service(external_id: str = ExternalId):
+    return _get_service(DBManager(), external_id)
+
+
+@router.put("/services/{external_id}", response_model=AdminService, responses={201: {"model": AdminService}})
+def put_service(spec: AdminServiceSpec, response: Response, external_id: str = ExternalId):
+    """
+    Create the service. The service of the same name is adopted when it has no external id yet (e.g. created by
+    the agents), and restored when it is archived. Service names can't be changed.
+    """
+    db_manager = DBManager()
+    existing = db_manager.get_admin_service(external_id)
+    if existing is not None and existing["name"] != spec.name:
+        raise HTTPException(
+            status_code=409, detail=f"Service {external_id} is named {existing['name']}, service names can't be changed"
+        )
+    env_type = spec.env_type.value if spec.env_type else None
+    service = db_manager.upsert_admin_service(external_id, spec.name, env_type)
+    if service is None:
+        raise HTTPException(status_code=409, detail=f"Service {spec.name} is managed under another external id")
+    if service.pop("created"):
+        response.status_code = 201
+        logger.info(f"service {spec.name} created for {external_id}")
+    if service["archived_at"] is not None:
+        if db_manager.restore_service(spec.name) is None:
+            raise HTTPException(status_code=409, detail=f"Service {spec.name} was purged, it can't be restored")
+        logger.info(f"service {spec.name} restored for {external_id}")
+        service = db_manager.get_admin_service(external_id)
+    return service
+
+
+@router.delete("/services/{external_id}", status_code=204)
+def delete_service(external_id: str = ExternalId):
+    """
+    Archive the service, its profiling data is purged once the default restore window is over. Deleting an
+    unknown or already archived service succeeds.
+    """
+    db_manager = DBManager()
+    service = db_manager.get_admin_service(external_id)
+    if service is not None and service["archived_at"] is None:
+        db_manager.archive_service(service["name"], SERVICES_ARCHIVE_RETENTION_DAYS)
+        logger.info(f"service {service['name']} archived for {external_id}")
+    return Response(status_code=204)
+
+
+@router.get("/services/{external_id}/quota", response_model=ServiceQuota)
+def get_service_quota(external_id: str = ExternalId):
+    db_manager = DBManager()
+    quota = db_manager.get_service_quota(_get_service(db_manager, external_id)["service_id"])
+    if quota is None:
+        raise HTTPException(status_code=404, detail=f"Service {external_id} has no quota")
+    return ServiceQuota(external_id=external_id, **quota)
+
+
+@router.put("/services/{external_id}/quota", response_model=ServiceQuota)
+def put_service_quota(spec: ServiceQuotaSpec, external_id: str = ExternalId):
+    """
+    Set the quota of the service, the limits left out are unlimited. Quotas are recorded for the platform
+    teams' own tooling, Performance Studio itself does not apply them.
+    """
+    db_manager = DBManager()
+    service_id = _get_service(db_manager, external_id)["service_id"]
+    quota = db_manager.upsert_service_quota(service_id, spec.max_hosts, spec.max_profiles_per_hour)
+    return ServiceQuota(external_id=external_id, **quota)
+
+
+@router.delete("/services/{external_id}/quota", status_code=204)
+def delete_service_quota(external_id: str = ExternalId):
+    db_manager = DBManager()
+    service = db_manager.get_admin_service(external_id)
+    if service is not None:
+        db_manager.delete_service_quota(service["service_id"])
+    return Response(status_code=204)
+
+
+@router.get("/services/{external_id}/retention", response_model=ServiceRetentionOverride)
+def get_service_retention(external_id: str = ExternalId):
+    db_manager = DBManager()
+    retention = db_manager.get_service_retention_override(_get_service(db_manager, external_id)["service_id"])
+    if retention is None:
+        raise HTTPException(status_code=404, detail=f"Service {external_id} has no retention override")
+    return ServiceRetentionOverride(external_id=external_id, **retention)
+
+
+@router.put("/services/{external_id}/retention", response_model=ServiceRetentionOverride)
+def put_service_retention(spec: ServiceRetentionOverrideSpec, external_id: str = ExternalId):
+    """
+    Override the retention of the profiling data of the service. Overrides are recorded for the platform
+    teams' own tooling, Performance Studio itself does not apply them.
+    """
+    db_manager = DBManager()
+    service_id = _get_service(db_manager, external_id)["service_id"]
+    retention = db_manager.upsert_service_retention_override(service_id, spec.retention_days)
+    return ServiceRetentionOverride(external_id=external_id, **retention)
+
+
+@router.delete("/services/{external_id}/retention", status_code=204)
+def delete_service_retention(external_id: str = ExternalId):
+    db_manager = DBManager()
+    service = db_manager.get_admin_service(external_id)
+    if service is not None:
+        db_manager.delete_service_retention_override(service["service_id"])
+    return Response(status_code=204)
+
+
+def mask_api_key(api_key: Dict, reveal: bool = False) -> Dict:
+    """
+    Replace the key by its prefix, the full key is only revealed in the response creating it.
+    """
+    masked = dict(api_key)
+    token = masked.pop("api_key")
+    masked["api_key_prefix"] = token[:API_KEY_PREFIX_LENGTH]
+    if reveal:
+        masked["api_key"] = token
+    return masked
+
+
+@router.get("/api_keys", response_model=List[AdminApiKey])
+def get_api_keys():
+    """
+    Active API keys managed through the admin API, masked. The API key of the UI is not listed.
+    """
+    return [mask_api_key(api_key) for api_key in DBManager().get_admin_api_keys()]
+
+
+@router.get("/api_keys/{external_id}", response_model=AdminApiKey)
+def get_api_key(external_id: str = ExternalId):
+    api_key = DBManager().get_admin_api_key(external_id)
+    if api_key is None:
+        raise HTTPException(status_code=404, detail=f"API key {external_id} not found")
+    return mask_api_key(api_key)
+
+
+@router.put("/api_keys/{external_id}", response_model=AdminApiKey, responses={201: {"model": AdminApiKey}})
+def put_api_key(spec: AdminApiKeySpec, response: Response, external_id: str = ExternalId):
+    """
+    Create an API key for the agents, or update the description of the active key of the external id.
+    The key itself never changes, revoke it and put it again to rotate it. The full key is only returned
+    when it is created.
+    """
+    api_key = DBManager().upsert_admin_api_key(external_id, spec.description)
+    created = api_key.pop("created")
+    if created:
+        response.status_code = 201
+        logger.info(f"API key created for {external_id}")
+    return mask_api_key(api_key, reveal=created)
+
+
+@router.delete("/api_keys/{external_id}", status_code=204)
+def delete_api_key(external_id: str = ExternalId):
+    """
+    Revoke the active API key of the external id. The keys are cached by every webapp instance, a revoked key
+    may be accepted by the other instances for up to a day.
+    """
+    if DBManager().revoke_admin_api_key(external_id) is not None:
+        get_service_by_api_key.cache.clear()
+        logger.info(f"API key of {external_id} revoked")
+    return Response(status_code=204)
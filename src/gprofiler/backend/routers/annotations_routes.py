@@ -0,0 +1,61 @@
+#
+# Copyright (C) 2023 Intel Corporation
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+#
+
+from logging import getLogger
+from typing import List
+
+from backend.models.annotations_models import FrameAnnotation, GetFrameAnnotation
+from fastapi import APIRouter, HTTPException
+from gprofiler_dev.postgres.db_manager import DBManager
+
+logger = getLogger(__name__)
+router = APIRouter()
+
+
+def _get_service_id(db_manager: DBManager, service_name: str) -> int:
+    service_id = db_manager.get_service(service_name)
+    if service_id is None:
+        raise HTTPException(status_code=404, detail=f"Service {service_name} not found")
+    return service_id
+
+
+@router.get("/service/{service_name}", response_model=List[GetFrameAnnotation])
+def get_annotations_for_service(service_name: str):
+    db_manager = DBManager()
+    service_id = _get_service_id(db_manager, service_name)
+    return db_manager.get_frame_annotations(service_id)
+
+
+@router.post("/service/{service_name}", response_model=int, status_code=201)
+def add_annotation(service_name: str, annotation: FrameAnnotation):
+    db_manager = DBManager()
+    service_id = _get_service_id(db_manager, service_name)
+    return db_manager.add_frame_annotation(service_id, annotation.dict())
+
+
+@router.put("/{annotation_id}", response_model=int)
+def edit_annotation(annotation_id: int, annotation: FrameAnnotation):
+    db_manager = DBManager()
+    updated_id = db_manager.update_frame_annotation(annotation_id, annotation.dict())
+    if updated_id is None:
+        raise HTTPException(status_code=404, detail=f"Annotation {annotation_id} not found")
+    return updated_id
+
+
+@router.delete("/{annotation_id}", status_code=204, responses={204: {"description": "Good request, just has no data"}})
+def delete_annotation(annotation_id: int):
+    db_manager = DBManager()
+    db_manager.delete_frame_annotation(annotation_id)
@@ -17,7 +17,14 @@
 from logging import getLogger
 from typing import List
 
-from backend.models.filters_models import FilterTag, FilterTypes, GetRQLFilter, PutRQLFilter, RQLFilter
+from backend.models.filters_models import (
+    FilterCardinality,
+    FilterTag,
+    FilterTypes,
+    GetRQLFilter,
+    PutRQLFilter,
+    RQLFilter,
+)
 from backend.models.flamegraph_models import FGParamsBaseModel
 from backend.utils.filters_utils import get_filter_tag_names
 from backend.utils.request_utils import flamegraph_base_request_params, get_query_response
@@ -67,3 +74,8 @@ def get_filter_type_values(
     fg_params: FGParamsBaseModel = Depends(flamegraph_base_request_params),
 ):
     return get_query_response(fg_params, lookup_for=filter_type.value)
+
+
+@router.get("/cardinality", response_model=List[FilterCardinality])
+def get_filters_cardinality(fg_params: FGParamsBaseModel = Depends(flamegraph_base_request_params)):
+    return get_query_response(fg_params, lookup_for="cardinality")
@@ -14,18 +14,22 @@
 # limitations under the License.
 #
 
+import json
 from datetime import datetime
 from io import BytesIO
 from logging import getLogger
 
+from backend.models.annotations_models import GetFrameAnnotation
 from backend.models.filters_models import RQLFilter
 from backend.models.flamegraph_models import FGDateTimeDataRange, FGParamsBaseModel, FGParamsModel, FlameGraph
-from backend.utils.flamegraph_utils import get_file_name, get_svg_file
+from backend.utils.flamegraph_utils import attach_annotations, get_file_name, get_svg_file
 from backend.utils.json_param import json_param
 from backend.utils.request_utils import flamegraph_request_params, get_flamegraph_response, get_query_response
 from dateutil.relativedelta import relativedelta
 from fastapi import APIRouter, Depends, Query
-from fastapi.responses import StreamingResponse
+from fastapi.encoders import jsonable_encoder
+from fastapi.responses import JSONResponse, StreamingResponse
+from gprofiler_dev.postgres.db_manager import DBManager
 
 logger = getLogger(__name__)
 router = APIRouter()
@@ -57,8 +61,17 @@ def get_datetime_with_data(
     response_model=FlameGraph,
     responses={200: {"content": {"text/plain": {}}}, 204: {"description": "Good request, just has no data"}},
 )
-def get_flamegraph(fg_params: FGParamsModel = Depends(flamegraph_request_params)):
+def get_flamegraph(
+    fg_params: FGParamsModel = Depends(flamegraph_request_params),
+    with_annotations: bool = Query(False, alias="withAnnotations"),
+):
     response = get_flamegraph_response(fg_params)
+    if with_annotations:
+        db_manager = DBManager()
+        service_id = db_manager.get_service(fg_params.service_name)
+        annotations = [GetFrameAnnotation(**annotation) for annotation in db_manager.get_frame_annotations(service_id)]
+        flamegraph = attach_annotations(json.loads(response.content), annotations)
+        return JSONResponse(jsonable_encoder(flamegraph))
     json_file = BytesIO(response.content)
     return StreamingResponse(json_file, media_type="text/plain")
 
@@ -1123,6 +1123,8 @@ def get_adhoc_flamegraphs(
         
         # Convert metadata to FlamegraphFile objects
         flamegraph_files = []
+        # deduplicated flamegraphs are stored in a content addressed object shared by their rows
+        object_keys = {}
         for metadata in metadata_list:
             s3_key = metadata["s3_key"]
             filename = s3_key.split('/')[-1]
@@ -1135,16 +1137,17 @@ def get_adhoc_flamegraphs(
                 s3_path=s3_key,
                 perf_events=metadata.get("perf_events")
             ))
+            object_keys[s3_key] = metadata.get("content_key") or s3_key
 
         # Mark entries whose S3 file no longer exists.
         # All head_object calls are issued in parallel (one thread per key)
         # so the total latency is ~one S3 round-trip regardless of list size.
         if flamegraph_files:
             s3_dal = S3ProfileDal(logger)
-            all_s3_paths = [f.s3_path for f in flamegraph_files]
+            all_s3_paths = list(set(object_keys.values()))
             existing_keys = s3_dal.check_keys_exist(all_s3_paths)
             for f in flamegraph_files:
-                f.removed = f.s3_path not in existing_keys
+                f.removed = object_keys[f.s3_path] not in existing_keys
 
         return flamegraph_files
         
@@ -1167,6 +1170,8 @@ def get_adhoc_flamegraph_content(
         
         # Build full S3 path for flamegraph HTML files
         s3_path = f"products/{service_name}/stacks/flamegraph/{filename}"
+        # deduplicated flamegraphs are stored in a content addressed object
+        s3_path = DBManager().get_adhoc_flamegraph_content_key(s3_path) or s3_path
         
         # Fetch file content from S3 (flamegraph HTML files are not gzipped)
         try:
@@ -0,0 +1,127 @@
+#
+# Copyright (C) 2023 Intel Corporation
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+#
+
+from datetime import datetime
+from logging import getLogger
+from typing import Dict, List
+
+from backend.config import STACKS_COUNT_DEFAULT
+from backend.models.flamegraph_models import FGParamsBaseModel, FGParamsModel
+from backend.models.ownership_models import FrameOwnership, GetFrameOwner, TeamCpuShare, TeamLeaderboardEntry
+from backend.utils.ownership_utils import attribute_samples_to_teams, get_teams_cpu_share
+from backend.utils.request_utils import flamegraph_base_request_params, get_flamegraph_response
+from fastapi import APIRouter, Depends, HTTPException, Query
+from fastapi.responses import Response
+from gprofiler_dev.postgres.db_manager import DBManager
+
+logger = getLogger(__name__)
+router = APIRouter()
+
+
+def _get_service_id(db_manager: DBManager, service_name: str) -> int:
+    service_id = db_manager.get_service(service_name)
+    if service_id is None:
+        raise HTTPException(status_code=404, detail=f"Service {service_name} not found")
+    return service_id
+
+
+def _get_team_samples(db_manager: DBManager, service_id: int, base_fg_params: FGParamsBaseModel) -> Dict[str, int]:
+    mappings = {row["prefix"]: row["team"] for row in db_manager.get_frame_ownership(service_id)}
+    fg_params = FGParamsModel(enrichment=[], stacks_count=STACKS_COUNT_DEFAULT, **base_fg_params.dict())
+    try:
+        flamegraph = get_flamegraph_response(fg_params).json()
+    except HTTPException as e:
+        if e.status_code == 204:
+            return {}
+        raise
+    return attribute_samples_to_teams(flamegraph, mappings)
+
+
+@router.get("/service/{service_name}", response_model=List[GetFrameOwner])
+def get_ownership_for_service(service_name: str):
+    db_manager = DBManager()
+    service_id = _get_service_id(db_manager, service_name)
+    return db_manager.get_frame_ownership(service_id)
+
+
+@router.put("/service/{service_name}", status_code=204, responses={204: {"description": "Mapping replaced"}})
+def upload_ownership_for_service(service_name: str, ownership: FrameOwnership):
+    """
+    Replace the frame prefix to team mapping of the service, the longest matching prefix of a frame wins.
+    """
+    db_manager = DBManager()
+    service_id = _get_service_id(db_manager, service_name)
+    db_manager.replace_frame_ownership(service_id, [(mapping.prefix, mapping.team) for mapping in ownership.mappings])
+    return Response(status_code=204)
+
+
+@router.get(
+    "/teams",
+    response_model=List[TeamCpuShare],
+    responses={204: {"description": "Good request, just has no data"}},
+)
+def get_teams_cpu_share_for_service(base_fg_params: FGParamsBaseModel = Depends(flamegraph_base_request_params)):
+    """
+    CPU share of the teams owning the frames of a service, samples of frames without an owner are attributed
+    to the owner of their closest owned caller, or to "unowned".
+    """
+    db_manager = DBManager()
+    service_id = _get_service_id(db_manager, base_fg_params.service_name)
+    team_samples = _get_team_samples(db_manager, service_id, base_fg_params)
+    if not team_samples:
+        return Response(status_code=204)
+    return get_teams_cpu_share(team_samples)
+
+
+@router.get(
+    "/leaderboard",
+    response_model=List[TeamLeaderboardEntry],
+    responses={204: {"description": "Good request, just has no data"}},
+)
+def get_teams_leaderboard(
+    start_time: datetime = Query(..., alias="startTime"),
+    end_time: datetime = Query(..., alias="endTime"),
+    limit: int = Query(20, ge=1, le=1000),
+):
+    """
+    Teams ranked by the CPU samples they own across all the services having an ownership mapping.
+    """
+    db_manager = DBManager()
+    per_service: Dict[str, Dict[str, int]] = {}
+    for service_name in db_manager.get_services_with_frame_ownership():
+        service_id = _get_service_id(db_manager, service_name)
+        base_fg_params = FGParamsBaseModel(service_name=service_name, start_time=start_time, end_time=end_time)
+        team_samples = _get_team_samples(db_manager, service_id, base_fg_params)
+        if team_samples:
+            per_service[service_name] = team_samples
+    if not per_service:
+        return Response(status_code=204)
+
+    total = sum(sum(team_samples.values()) for team_samples in per_service.values())
+    teams: Dict[str, Dict] = {}
+    for service_name, team_samples in per_service.items():
+        service_total = sum(team_samples.values())
+        for team, samples in team_samples.items():
+            entry = teams.setdefault(team, {"team": team, "samples": 0, "services": []})
+            entry["samples"] += samples
+            entry["services"].append(
+                {"service_name": service_name, "samples": samples, "cpu_share": samples / service_total}
+            )
+    leaderboard = sorted(teams.values(), key=lambda entry: entry["samples"], reverse=True)[:limit]
+    for entry in leaderboard:
+        entry["cpu_share"] = entry["samples"] / total
+        entry["services"].sort(key=lambda service: service["samples"], reverse=True)
+    return leaderboard
@@ -0,0 +1,140 @@
+#
+# Copyright (C) 2023 Intel Corporation
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+#
+
+
+import hmac
+from datetime import datetime, timedelta
+from logging import getLogger
+from typing import List, Optional
+
+from backend.config import QUERY_TEMPLATES_ADMIN_TOKEN, STACKS_COUNT_DEFAULT
+from backend.models.filters_models import RQLFilter
+from backend.models.flamegraph_models import FGParamsModel
+from backend.models.query_templates_models import (
+    GetQueryTemplate,
+    QueryTemplate,
+    QueryTemplateFormat,
+    QueryTemplateRun,
+    QueryTemplateServiceResult,
+)
+from backend.utils.json_param import json_param
+from backend.utils.request_utils import get_flamegraph_response
+from fastapi import APIRouter, Depends, Header, HTTPException, Query
+from fastapi.responses import Response
+from gprofiler_dev.postgres.db_manager import DBManager
+
+logger = getLogger(__name__)
+router = APIRouter()
+
+
+def verify_admin_token(gprofiler_admin_token: Optional[str] = Header(None)):
+    if not QUERY_TEMPLATES_ADMIN_TOKEN:
+        raise HTTPException(
+            status_code=403, detail="Query templates are read-only, QUERY_TEMPLATES_ADMIN_TOKEN is not set"
+        )
+    if gprofiler_admin_token is None or not hmac.compare_digest(gprofiler_admin_token, QUERY_TEMPLATES_ADMIN_TOKEN):
+        raise HTTPException(status_code=403, detail="Query templates can only be changed by admins")
+
+
+def _get_template(db_manager: DBManager, name: str) -> GetQueryTemplate:
+    template = db_manager.get_query_template(name)
+    if template is None:
+        raise HTTPException(status_code=404, detail=f"Query template {name} not found")
+    return GetQueryTemplate(filter=template.pop("filter_content"), **template)
+
+
+@router.get("", response_model=List[GetQueryTemplate])
+def get_query_templates():
+    db_manager = DBManager()
+    return [
+        GetQueryTemplate(filter=template.pop("filter_content"), **template)
+        for template in db_manager.get_query_templates()
+    ]
+
+
+@router.get("/{name}", response_model=GetQueryTemplate)
+def get_query_template(name: str):
+    return _get_template(DBManager(), name)
+
+
+@router.put("/{name}", status_code=204, dependencies=[Depends(verify_admin_token)])
+def put_query_template(name: str, template: QueryTemplate):
+    """
+    Create the query template, or replace the template of the same name.
+    """
+    db_manager = DBManager()
+    unknown = [service for service in template.service_names if db_manager.get_service(service) is None]
+    if unknown:
+        raise HTTPException(status_code=404, detail=f"Services {', '.join(unknown)} not found")
+    db_manager.upsert_query_template({"name": name, **template.dict()})
+    return Response(status_code=204)
+
+
+@router.delete("/{name}", status_code=204, dependencies=[Depends(verify_admin_token)])
+def delete_query_template(name: str):
+    db_manager = DBManager()
+    if db_manager.delete_query_template(name) is None:
+        raise HTTPException(status_code=404, detail=f"Query template {name} not found")
+    return Response(status_code=204)
+
+
+@router.get(
+    "/{name}/run",
+    response_model=QueryTemplateRun,
+    responses={204: {"description": "Good request, just has no data"}},
+)
+def run_query_template(
+    name: str,
+    service_names: Optional[List[str]] = Query(None, alias="serviceName"),
+    start_time: Optional[datetime] = Query(None, alias="startTime"),
+    end_time: Optional[datetime] = Query(None, alias="endTime"),
+    fg_filter: RQLFilter = json_param("filter", RQLFilter, description="RQL format filter", default=None),
+    output_format: Optional[QueryTemplateFormat] = Query(None, alias="format"),
+    stacks_count: Optional[int] = Query(None, alias="stacksCount", gt=0),
+):
+    """
+    Run the query template against each of its services, the query parameters override the template.
+    """
+    template = _get_template(DBManager(), name)
+    end_time = end_time or datetime.utcnow()
+    start_time = start_time or end_time - timedelta(seconds=template.lookback_seconds)
+    if start_time >= end_time:
+        raise HTTPException(status_code=400, detail="startTime must be before endTime")
+    output_format = output_format or template.format
+    stacks_count = stacks_count or template.stacks_count or STACKS_COUNT_DEFAULT
+
+    results = []
+    for service_name in service_names or template.service_names:
+        fg_params = FGParamsModel(
+            service_name=service_name,
+            start_time=start_time,
+            end_time=end_time,
+            filter=fg_filter or template.filter,
+            enrichment=[],
+            stacks_count=stacks_count,
+        )
+        try:
+            response = get_flamegraph_response(fg_params, file_type=output_format.value)
+        except HTTPException as e:
+            if e.status_code != 204:
+                raise
+            results.append(QueryTemplateServiceResult(service_name=service_name))
+            continue
+        data = response.json() if output_format == QueryTemplateFormat.FLAMEGRAPH else response.text
+        results.append(QueryTemplateServiceResult(service_name=service_name, data=data))
+    if all(result.data is None for result in results):
+        return Response(status_code=204)
+    return QueryTemplateRun(name=name, format=output_format, start_time=start_time, end_time=end_time, results=results)
@@ -14,11 +14,13 @@
 # limitations under the License.
 #
 
+import hmac
 from logging import getLogger
-from typing import List
+from typing import List, Optional
 
-from backend.models.services_models import Service
-from fastapi import APIRouter
+from backend.config import SERVICES_ADMIN_TOKEN, SERVICES_ARCHIVE_RETENTION_DAYS
+from backend.models.services_models import ArchivedService, Service, ServiceTechnologyTag
+from fastapi import APIRouter, Depends, Header, HTTPException, Query
 from fastapi.responses import Response
 from gprofiler_dev.postgres.db_manager import DBManager
 
@@ -26,6 +28,15 @@ logger = getLogger(__name__)
 router = APIRouter()
 
 
+def verify_admin_token(gprofiler_admin_token: Optional[str] = Header(None)):
+    if not SERVICES_ADMIN_TOKEN:
+        raise HTTPException(
+            status_code=403, detail="Services cannot be archived or restored, SERVICES_ADMIN_TOKEN is not set"
+        )
+    if gprofiler_admin_token is None or not hmac.compare_digest(gprofiler_admin_token, SERVICES_ADMIN_TOKEN):
+        raise HTTPException(status_code=403, detail="Services can only be archived or restored by admins")
+
+
 @router.get("", response_model=List[Service], responses={204: {"description": "Good request, just has no data"}})
 def get_services():
     db_manager = DBManager()
@@ -33,3 +44,78 @@ def get_services():
     if not services_list:
         return Response(status_code=204)
     return services_list
+
+
+@router.get(
+    "/archived",
+    response_model=List[ArchivedService],
+    responses={204: {"description": "Good request, just has no data"}},
+)
+def get_archived_services():
+    """
+    Archived services, the purged ones included, the most recently archived first.
+    """
+    db_manager = DBManager()
+    services = db_manager.get_archived_services()
+    if not services:
+        return Response(status_code=204)
+    return services
+
+
+@router.post("/{service_name}/archive", response_model=ArchivedService, dependencies=[Depends(verify_admin_token)])
+def archive_service(
+    service_name: str,
+    retention_days: int = Query(
+        SERVICES_ARCHIVE_RETENTION_DAYS, ge=1, description="Days the service can be restored before its data is purged"
+    ),
+):
+    """
+    Hide the service from the listings and block the queries of its profiling data. The data is kept until
+    the restore window is over, the indexer purges it then.
+    """
+    db_manager = DBManager()
+    archived = db_manager.archive_service(service_name, retention_days)
+    if archived is None:
+        raise HTTPException(status_code=404, detail=f"Service {service_name} not found or already archived")
+    logger.info(f"service {service_name} archived, purge after {archived['purge_after']}")
+    return archived
+
+
+@router.post("/{service_name}/restore", dependencies=[Depends(verify_admin_token)])
+def restore_service(service_name: str):
+    db_manager = DBManager()
+    if db_manager.restore_service(service_name) is None:
+        raise HTTPException(
+            status_code=404, detail=f"Service {service_name} is not archived, or its restore window is over"
+        )
+    logger.info(f"service {service_name} restored")
+    return {"service_name": service_name, "restored": True}
+
+
+@router.get(
+    "/technologies",
+    response_model=List[ServiceTechnologyTag],
+    responses={204: {"description": "Good request, just has no data"}},
+)
+def get_services_technologies(tag: Optional[str] = Query(None, description="List only the services using this tag")):
+    """
+    Technologies (Kafka client, gRPC, RocksDB, OpenSSL...) detected by the indexer in the profiles of the services.
+    """
+    db_manager = DBManager()
+    tags = db_manager.get_service_technology_tags(tag=tag)
+    if not tags:
+        return Response(status_code=204)
+    return tags
+
+
+@router.get(
+    "/{service_name}/technologies",
+    response_model=List[ServiceTechnologyTag],
+    responses={204: {"description": "Good request, just has no data"}},
+)
+def get_service_technologies(service_name: str):
+    db_manager = DBManager()
+    tags = db_manager.get_service_technology_tags(service_name=service_name)
+    if not tags:
+        return Response(status_code=204)
+    return tags
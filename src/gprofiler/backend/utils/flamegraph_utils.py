@@ -18,9 +18,10 @@ import subprocess
 import tempfile
 from datetime import datetime
 from io import BytesIO
-from typing import Optional
+from typing import Dict, List, Optional
 
 from backend.config import FLAMEGRAPH_PATH
+from backend.models.annotations_models import GetFrameAnnotation
 from backend.models.filters_models import RQLFilter
 
 TIME_RANGE_MAP = {
@@ -56,3 +57,26 @@ def get_file_name(
         filter_str = f"_{rql_filter.get_formatted_filter()}"
     file_name = f"{service_name}_{file_time_range_name}{filter_str}.{suffix}"
     return file_name
+
+
+def _frame_names(frame: Dict) -> List[str]:
+    name = frame.get("name", "")
+    suffix = frame.get("suffix")
+    return [name, name + suffix] if suffix else [name]
+
+
+def attach_annotations(flamegraph: Dict, annotations: List[GetFrameAnnotation]) -> Dict:
+    """
+    Add the annotations to the flamegraph, and the ids of the annotations matching a frame path to that frame
+    (under "annotationIds"). Annotations whose path is not part of this flamegraph are returned as well.
+    """
+    for annotation in annotations:
+        frame = flamegraph
+        for name in annotation.frame_path:
+            frame = next((child for child in frame.get("children") or [] if name in _frame_names(child)), None)
+            if frame is None:
+                break
+        if frame is not None:
+            frame.setdefault("annotationIds", []).append(annotation.id)
+    flamegraph["annotations"] = [annotation.dict(by_alias=True) for annotation in annotations]
+    return flamegraph
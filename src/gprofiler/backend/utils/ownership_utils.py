@@ -0,0 +1,58 @@
+#
+# Copyright (C) 2023 Intel Corporation
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+#
+
+from typing import Dict, List, Optional, Tuple
+
+UNOWNED_TEAM = "unowned"
+
+
+def match_owner(frame_name: str, prefixes: List[Tuple[str, str]]) -> Optional[str]:
+    """
+    Return the team of the first matching prefix, prefixes must be sorted from the longest one.
+    """
+    for prefix, team in prefixes:
+        if frame_name.startswith(prefix):
+            return team
+    return None
+
+
+def attribute_samples_to_teams(flamegraph: Dict, mappings: Dict[str, str]) -> Dict[str, int]:
+    """
+    Attribute the self samples of every frame of the flamegraph to the team owning the frame, or the closest
+    owned ancestor of the frame. Samples without any owned frame in their stack are attributed to UNOWNED_TEAM.
+    """
+    prefixes = sorted(mappings.items(), key=lambda item: len(item[0]), reverse=True)
+    samples: Dict[str, int] = {}
+    stack = [(child, None) for child in flamegraph.get("children") or []]
+    while stack:
+        frame, owner = stack.pop()
+        owner = match_owner(frame.get("name", ""), prefixes) or owner
+        children = frame.get("children") or []
+        self_samples = frame.get("value", 0) - sum(child.get("value", 0) for child in children)
+        if self_samples > 0:
+            team = owner or UNOWNED_TEAM
+            samples[team] = samples.get(team, 0) + self_samples
+        stack.extend((child, owner) for child in children)
+    return samples
+
+
+def get_teams_cpu_share(team_samples: Dict[str, int]) -> List[Dict]:
+    total = sum(team_samples.values())
+    shares = [
+        {"team": team, "samples": samples, "cpu_share": samples / total if total else 0.0}
+        for team, samples in team_samples.items()
+    ]
+    return sorted(shares, key=lambda share: share["samples"], reverse=True)
@@ -16,6 +16,7 @@
      */
 }
 
+import _ from 'lodash';
 import { useContext } from 'react';
 
 import { SelectorsContext } from '../../states';
@@ -28,6 +29,16 @@ const useGetFilterValueOptions = () => {
     const { selectedService, timeSelection } = useContext(SelectorsContext);
     const params = { ...getStartEndDateTimeFromSelection(timeSelection), serviceName: selectedService };
 
+    // dimensions with too many values are not listed, the cardinality is fetched first to check them
+    const { data: cardinality, loading: cardinalityLoading } = useFetchWithRequest(
+        { url: DATA_URLS.GET_FILTERS_CARDINALITY(params) },
+        { refreshDeps: [selectedService, timeSelection] }
+    );
+    const tooManyValues = _.fromPairs(
+        (cardinality || []).filter((item) => !item.enumerable).map((item) => [item.dimension, item.distinct])
+    );
+    const isListable = (filterType) => !cardinalityLoading && !_.has(tooManyValues, filterType);
+
     const {
         data: containerEnvOptions,
         loading: containerEnvLoading,
@@ -36,7 +47,7 @@ const useGetFilterValueOptions = () => {
         {
             url: DATA_URLS.GET_FILTER_OPTIONS_VALUE(FILTER_TYPES.ContainerEnvName.value, params),
         },
-        { refreshDeps: [selectedService, timeSelection] }
+        { refreshDeps: [selectedService, timeSelection], ready: isListable(FILTER_TYPES.ContainerEnvName.value) }
     );
 
     const {
@@ -47,7 +58,7 @@ const useGetFilterValueOptions = () => {
         {
             url: DATA_URLS.GET_FILTER_OPTIONS_VALUE(FILTER_TYPES.ContainerName.value, params),
         },
-        { refreshDeps: [selectedService, timeSelection] }
+        { refreshDeps: [selectedService, timeSelection], ready: isListable(FILTER_TYPES.ContainerName.value) }
     );
 
     const {
@@ -58,7 +69,7 @@ const useGetFilterValueOptions = () => {
         {
             url: DATA_URLS.GET_FILTER_OPTIONS_VALUE(FILTER_TYPES.HostName.value, params),
         },
-        { refreshDeps: [selectedService, timeSelection] }
+        { refreshDeps: [selectedService, timeSelection], ready: isListable(FILTER_TYPES.HostName.value) }
     );
 
     return {
@@ -74,10 +85,11 @@ const useGetFilterValueOptions = () => {
         hostNameOptions,
         hostNameOptionsError,
         valueOptionsLoading: {
-            [FILTER_TYPES.ContainerEnvName.value]: containerEnvLoading,
-            [FILTER_TYPES.ContainerName.value]: containerOptionsLoading,
-            [FILTER_TYPES.HostName.value]: hostNameOptionsLoading,
+            [FILTER_TYPES.ContainerEnvName.value]: cardinalityLoading || containerEnvLoading,
+            [FILTER_TYPES.ContainerName.value]: cardinalityLoading || containerOptionsLoading,
+            [FILTER_TYPES.HostName.value]: cardinalityLoading || hostNameOptionsLoading,
         },
+        tooManyValues,
     };
 };
 
@@ -53,6 +53,7 @@ export const DATA_URLS = {
     FILTERS: `${API_PREFIX}${FILETERS_PREFIX}`,
     GET_FILTER_OPTIONS_VALUE: (filterType, params) =>
         `${API_PREFIX}${FILETERS_PREFIX}/tags/${filterType}?${stringify(params)}`,
+    GET_FILTERS_CARDINALITY: (params) => `${API_PREFIX}${FILETERS_PREFIX}/cardinality?${stringify(params)}`,
     GET_FILTERS_FOR_SERVICE: (selectedService) => `${API_PREFIX}${FILETERS_PREFIX}/service/${selectedService}`,
     SNAPSHOT: `${API_PREFIX}/snapshots`,
 };
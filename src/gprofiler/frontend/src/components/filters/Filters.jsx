@@ -51,7 +51,7 @@ const Filters = ({ onClose }) => {
 
     const handleChangeTab = useCallback((e, newTab) => setTab(newTab), [setTab]);
 
-    const { valueOptions, valueOptionsLoading } = useGetFilterValueOptions();
+    const { valueOptions, valueOptionsLoading, tooManyValues } = useGetFilterValueOptions();
 
     return (
         <Flexbox column sx={{ p: 5 }} spacing={4}>
@@ -83,6 +83,7 @@ const Filters = ({ onClose }) => {
                     postCreateCallback={postCreateCallback}
                     valueOptions={valueOptions}
                     valueOptionsLoading={valueOptionsLoading}
+                    tooManyValues={tooManyValues}
                 />
             )}
             {tab === FILTER_MENU_TABS.saved && (
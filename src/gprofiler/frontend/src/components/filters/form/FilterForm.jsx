@@ -34,7 +34,7 @@ import useHoverState from '../useHoverState';
 import { shouldShowFilterTypeOptions } from '../utils';
 import FilterFormActions from './FilterFormActions';
 
-const FilterForm = ({ postCreateCallback, onClose, valueOptions, valueOptionsLoading }) => {
+const FilterForm = ({ postCreateCallback, onClose, valueOptions, valueOptionsLoading, tooManyValues = {} }) => {
     const { filter, dispatchFilterTags } = useContext(FilterTagsContext);
     const { hoveredItemId, onMouseEnter, onMouseLeave } = useHoverState();
 
@@ -138,6 +138,11 @@ const FilterForm = ({ postCreateCallback, onClose, valueOptions, valueOptionsLoa
                                 options={valueOptions[type]}
                                 disabled={valueOptionsLoading[type] || _.isEmpty(valueOptions[type])}
                                 loading={valueOptionsLoading[type]}
+                                emptyText={
+                                    _.has(tooManyValues, type)
+                                        ? `too many values (${tooManyValues[type].toLocaleString()})`
+                                        : undefined
+                                }
                                 onChange={onFilterValueChange(index)}
                             />
                         </FormControl>
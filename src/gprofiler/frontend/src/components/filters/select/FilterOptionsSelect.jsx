@@ -151,7 +151,7 @@ const StyledPopper = styled(Popper)({
     },
 });
 
-const FilterOptionsSelect = ({ disabled = false, loading, value, onChange, options }) => {
+const FilterOptionsSelect = ({ disabled = false, loading, value, onChange, options, emptyText = 'no options' }) => {
     const [inputValue, setInputValue] = useState(value);
 
     useEffect(() => {
@@ -191,7 +191,7 @@ const FilterOptionsSelect = ({ disabled = false, loading, value, onChange, optio
                     ref={params.InputProps.ref}
                     inputProps={params.inputProps}
                     endAdornment={loading ? <CircularProgress size={20} sx={{ mr: 4 }} /> : null}
-                    placeholder={loading ? 'loading' : value ? value : _.isEmpty(options) ? 'no options' : 'Value'}
+                    placeholder={loading ? 'loading' : value ? value : _.isEmpty(options) ? emptyText : 'Value'}
                 />
             )}
         />
@@ -0,0 +1,358 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package client is a Go client of the REST API of flamedb, for the tools that would otherwise build the
+// HTTP requests themselves. The params are the ones of restflamedb/common, as bound by the server.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"restflamedb/common"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout = time.Minute
+	defaultRetries = 3
+	defaultBackoff = time.Second
+)
+
+// ErrNoContent is returned when the server answers 204, for queries without data or failing on ClickHouse
+var ErrNoContent = errors.New("no content")
+
+// StatusError is returned for the responses with an unexpected status, Message is the error of the body if any
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, e.Message)
+}
+
+// retryable reports whether a request failing with this status may succeed when sent again
+func retryable(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+type Client struct {
+	baseURL    string
+	username   string
+	password   string
+	httpClient *http.Client
+	retries    int
+	backoff    time.Duration
+}
+
+type Option func(*Client)
+
+// WithBasicAuth sets the credentials of the requests, see the -credentials flag of the server
+func WithBasicAuth(username string, password string) Option {
+	return func(c *Client) {
+		c.username, c.password = username, password
+	}
+}
+
+// WithHTTPClient replaces the default HTTP client, e.g. for custom TLS settings
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetries sets how many times a request failing with a connection error or a 429, 502, 503 or 504 status
+// is retried, and the delay before the first retry, doubled on each retry
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries, c.backoff = retries, backoff
+	}
+}
+
+// New returns a client of the server at baseURL, e.g. "https://flamedb-rest:4433"
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		retries:    defaultRetries,
+		backoff:    defaultBackoff,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, query url.Values,
+	body []byte) (*http.Request, error) {
+	rawURL := c.baseURL + path
+	if len(query) > 0 {
+		rawURL += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return req, nil
+}
+
+// do sends the request, with retries, and decodes the JSON response into result
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body []byte,
+	result any) error {
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(c.backoff << (attempt - 1)):
+			}
+		}
+		var req *http.Request
+		if req, err = c.newRequest(ctx, method, path, query, body); err != nil {
+			return err
+		}
+		var retry bool
+		if retry, err = c.send(req, result); err == nil || !retry || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) send(req *http.Request, result any) (bool, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return false, ErrNoContent
+	case resp.StatusCode != http.StatusOK:
+		statusErr := &StatusError{StatusCode: resp.StatusCode}
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &body) == nil {
+			statusErr.Message = body.Error
+		}
+		return retryable(resp.StatusCode), statusErr
+	}
+	return false, json.Unmarshal(data, result)
+}
+
+func (c *Client) get(ctx context.Context, path string, params any, result any) error {
+	query, err := encodeParams(params)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodGet, path, query, nil, result)
+}
+
+// Frame is a frame of a flame graph, its value includes the values of its children
+type Frame struct {
+	Name        string  `json:"name"`
+	Suffix      string  `json:"suffix,omitempty"`
+	Value       int     `json:"value"`
+	Children    []Frame `json:"children"`
+	Language    string  `json:"language,omitempty"`
+	SpecialType string  `json:"specialType,omitempty"`
+}
+
+type FlameGraph struct {
+	Name        string            `json:"name"`
+	Value       int               `json:"value"`
+	Children    []Frame           `json:"children"`
+	Percentiles map[string]string `json:"percentiles"`
+	Hosts       []string          `json:"hosts,omitempty"`
+	OlapTime    float64           `json:"olap_time"`
+	ExecTime    float64           `json:"exec_time"`
+}
+
+// Flamegraph returns the flame graph of a service, the format of the params is always "flamegraph"
+// and the detail always full
+func (c *Client) Flamegraph(ctx context.Context, params common.FlameGraphParams) (FlameGraph, error) {
+	params.Format = "flamegraph"
+	params.Detail = ""
+	var graph FlameGraph
+	err := c.get(ctx, "/api/v1/flamegraph", params, &graph)
+	return graph, err
+}
+
+// LiteFrame is a frame of a lite flame graph, names and values only
+type LiteFrame struct {
+	Name     string      `json:"n"`
+	Value    int         `json:"v"`
+	Children []LiteFrame `json:"c,omitempty"`
+}
+
+type LiteFlameGraph struct {
+	Name     string      `json:"n"`
+	Value    int         `json:"v"`
+	Children []LiteFrame `json:"c"`
+	// Truncated is set when the lightest or deepest frames were left out to fit the size budget of the server
+	Truncated bool    `json:"truncated"`
+	ExecTime  float64 `json:"exec_time"`
+}
+
+// LiteFlamegraph returns the lite flame graph of a service, for slow links
+func (c *Client) LiteFlamegraph(ctx context.Context, params common.FlameGraphParams) (LiteFlameGraph, error) {
+	params.Format = "flamegraph"
+	params.Detail = "lite"
+	var graph LiteFlameGraph
+	err := c.get(ctx, "/api/v1/flamegraph", params, &graph)
+	return graph, err
+}
+
+type result[T any] struct {
+	Result T `json:"result"`
+}
+
+// Query runs a meta query, the result depends on params.LookupFor and is returned as is
+func (c *Client) Query(ctx context.Context, params common.QueryParams) (json.RawMessage, error) {
+	var response result[json.RawMessage]
+	err := c.get(ctx, "/api/v1/query", params, &response)
+	return response.Result, err
+}
+
+// FilterValues returns the values of a filter dimension and their samples, params.LookupFor is the dimension
+// (e.g. "container" or "hostname")
+func (c *Client) FilterValues(ctx context.Context, params common.QueryParams) ([]common.FilterData, error) {
+	var response result[[]common.FilterData]
+	err := c.get(ctx, "/api/v1/query", params, &response)
+	return response.Result, err
+}
+
+// Samples returns the samples of the service over time
+func (c *Client) Samples(ctx context.Context, params common.QueryParams) ([]common.Sample, error) {
+	params.LookupFor = "samples"
+	var response result[[]common.Sample]
+	err := c.get(ctx, "/api/v1/query", params, &response)
+	return response.Result, err
+}
+
+type Service struct {
+	ServiceId  uint32 `json:"service_id"`
+	Deployment string `json:"deployment"`
+}
+
+func (c *Client) Services(ctx context.Context, params common.ServicesParams) ([]Service, error) {
+	var response result[[]Service]
+	err := c.get(ctx, "/api/v1/services", params, &response)
+	return response.Result, err
+}
+
+func (c *Client) MetricsSummary(ctx context.Context, params common.MetricsSummaryParams) (common.MetricsSummary,
+	error) {
+	var response result[common.MetricsSummary]
+	err := c.get(ctx, "/api/v1/metrics/summary", params, &response)
+	return response.Result, err
+}
+
+// MetricsGraph returns the metrics summary of every params.Interval bucket
+func (c *Client) MetricsGraph(ctx context.Context, params common.MetricsSummaryParams) ([]common.MetricsSummary,
+	error) {
+	var response result[[]common.MetricsSummary]
+	err := c.get(ctx, "/api/v1/metrics/graph", params, &response)
+	return response.Result, err
+}
+
+func (c *Client) MetricsCpuTrend(ctx context.Context, params common.MetricsCpuTrendParams) (common.MetricsCpuTrend,
+	error) {
+	var response result[common.MetricsCpuTrend]
+	err := c.get(ctx, "/api/v1/metrics/cpu_trend", params, &response)
+	return response.Result, err
+}
+
+// MetricsServicesListSummary returns the metrics summary of several services, it is the only POST endpoint
+// of the client, the services are sent in the body
+func (c *Client) MetricsServicesListSummary(ctx context.Context,
+	params common.MetricsServicesListSummaryParams) ([]common.MetricsServicesListSummary, error) {
+	query, err := encodeParams(params)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(struct {
+		ServicesList []int `json:"services_ids"`
+		ClientsList  []int `json:"clients_ids"`
+	}{params.ServicesList, params.ClientsList})
+	if err != nil {
+		return nil, err
+	}
+	var response result[[]common.MetricsServicesListSummary]
+	err = c.do(ctx, http.MethodPost, "/api/v1/metrics/services_list_summary", query, body, &response)
+	return response.Result, err
+}
+
+// TopMovers returns the functions whose CPU share changed the most since the previous period
+func (c *Client) TopMovers(ctx context.Context, params common.TopMoversParams) ([]common.TopMover, error) {
+	var response result[[]common.TopMover]
+	err := c.get(ctx, "/api/v1/top_movers", params, &response)
+	return response.Result, err
+}
+
+// CanaryComparison returns the frames of the canary hosts deviating from the rest of the fleet
+func (c *Client) CanaryComparison(ctx context.Context,
+	params common.CanaryComparisonParams) ([]common.CanaryFrame, error) {
+	var response result[[]common.CanaryFrame]
+	err := c.get(ctx, "/api/v1/canary_comparison", params, &response)
+	return response.Result, err
+}
+
+// QualityScore returns the profiling quality score of a service
+func (c *Client) QualityScore(ctx context.Context, params common.QualityScoreParams) (common.QualityScore, error) {
+	var response result[common.QualityScore]
+	err := c.get(ctx, "/api/v1/quality_score", params, &response)
+	return response.Result, err
+}
+
+// ServiceMatrix returns the key indicators of several services and their week over week deltas
+func (c *Client) ServiceMatrix(ctx context.Context,
+	params common.ServiceMatrixParams) ([]common.ServiceIndicators, error) {
+	var response result[[]common.ServiceIndicators]
+	err := c.get(ctx, "/api/v1/service_matrix", params, &response)
+	return response.Result, err
+}
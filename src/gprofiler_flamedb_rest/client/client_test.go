@@ -0,0 +1,117 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"restflamedb/common"
+	"testing"
+	"time"
+)
+
+func TestEncodeParams(t *testing.T) {
+	params := common.FlameGraphParams{ServiceId: 7, Format: "flamegraph", Pinned: true}
+	params.StartDateTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	params.ContainerName = []string{"api", "web-*"}
+	params.ExcludeHostName = []string{"noisy-1"}
+	params.Insights = map[string]string{"gc": "true"}
+	values, err := encodeParams(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"service":          {"7"},
+		"format":           {"flamegraph"},
+		"pinned":           {"true"},
+		"start_datetime":   {"2024-01-02T03:04:05"},
+		"container":        {"api", "web-*"},
+		"exclude_hostname": {"noisy-1"},
+		"insights[gc]":     {"true"},
+	}
+	if !reflect.DeepEqual(map[string][]string(values), expected) {
+		t.Errorf("unexpected values %v", values)
+	}
+	if _, err = encodeParams("service=1"); err == nil {
+		t.Error("params other than structs should be rejected")
+	}
+}
+
+func TestClient(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		if user, password, ok := r.BasicAuth(); !ok || user != "tool" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/flamegraph":
+			if requests == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if r.URL.Query().Get("service") != "1" || r.URL.Query().Get("format") != "flamegraph" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "unexpected query"}`))
+				return
+			}
+			w.Write([]byte(`{"name": "root", "value": 3, "children": [{"name": "main", "value": 3,
+				"children": []}], "exec_time": 0.1}`))
+		case "/api/v1/query":
+			w.Write([]byte(`{"result": [{"name": "api", "samples": 10}]}`))
+		case "/api/v1/metrics/summary":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "unknown endpoint"}`))
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	c := New(server.URL+"/", WithBasicAuth("tool", "secret"), WithRetries(2, time.Millisecond))
+
+	graph, err := c.Flamegraph(ctx, common.FlameGraphParams{ServiceId: 1, Format: "collapsed_file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || graph.Value != 3 || len(graph.Children) != 1 || graph.Children[0].Name != "main" {
+		t.Errorf("unexpected flame graph %+v after %d request(s)", graph, requests)
+	}
+	values, err := c.FilterValues(ctx, common.QueryParams{ServiceId: 1, LookupFor: "container"})
+	if err != nil || len(values) != 1 || values[0].Name != "api" || values[0].Samples != 10 {
+		t.Errorf("unexpected filter values %+v %v", values, err)
+	}
+	if _, err = c.MetricsSummary(ctx, common.MetricsSummaryParams{ServiceId: 1}); !errors.Is(err, ErrNoContent) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	requests = 0
+	_, err = c.TopMovers(ctx, common.TopMoversParams{ServiceId: 1})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest ||
+		statusErr.Message != "unknown endpoint" || requests != 1 {
+		t.Errorf("unexpected error %v after %d request(s)", err, requests)
+	}
+	if _, err = New(server.URL).Services(ctx, common.ServicesParams{}); !errors.As(err, &statusErr) ||
+		statusErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unexpected error without credentials %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultTimeFormat is the format of the time parameters of the REST API
+const defaultTimeFormat = "2006-01-02T15:04:05"
+
+// encodeParams encodes the params structs of restflamedb/common as query values, following their form tags.
+// Zero values are left out so that the server applies the defaults of the tags.
+func encodeParams(params any) (url.Values, error) {
+	values := url.Values{}
+	value := reflect.ValueOf(params)
+	if value.Kind() == reflect.Pointer {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("params must be a struct, got %s", value.Kind())
+	}
+	return values, encodeStruct(values, value)
+}
+
+func encodeStruct(values url.Values, value reflect.Value) error {
+	valueType := value.Type()
+	for idx := 0; idx < valueType.NumField(); idx++ {
+		field := valueType.Field(idx)
+		fieldValue := value.Field(idx)
+		if field.Anonymous && fieldValue.Kind() == reflect.Struct {
+			if err := encodeStruct(values, fieldValue); err != nil {
+				return err
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("form"), ",")
+		if name == "" || name == "-" || !field.IsExported() || fieldValue.IsZero() {
+			continue
+		}
+		if err := encodeValue(values, name, field, fieldValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeValue(values url.Values, name string, field reflect.StructField, value reflect.Value) error {
+	if timestamp, ok := value.Interface().(time.Time); ok {
+		format := field.Tag.Get("time_format")
+		if format == "" {
+			format = defaultTimeFormat
+		}
+		values.Add(name, timestamp.UTC().Format(format))
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.String:
+		values.Add(name, value.String())
+	case reflect.Bool:
+		values.Add(name, strconv.FormatBool(value.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		values.Add(name, strconv.FormatInt(value.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		values.Add(name, strconv.FormatUint(value.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		values.Add(name, strconv.FormatFloat(value.Float(), 'f', -1, 64))
+	case reflect.Slice:
+		for idx := 0; idx < value.Len(); idx++ {
+			if err := encodeValue(values, name, field, value.Index(idx)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := value.MapRange()
+		for iter.Next() {
+			values.Add(fmt.Sprintf("%s[%v]", name, iter.Key().Interface()), fmt.Sprint(iter.Value().Interface()))
+		}
+	default:
+		return fmt.Errorf("unsupported type %s of parameter %s", value.Kind(), name)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/ianlancetaylor/demangle"
+)
+
+var (
+	// runtimeSuffixRegex matches the runtime suffix of the frames added by the profilers, e.g. "_[k]"
+	runtimeSuffixRegex = regexp.MustCompile(`_\[\w+\](_\[s\])?$`)
+	// mangledSymbolRegex matches the C++ (Itanium) and Rust (legacy and v0) symbols within a frame, with their
+	// clone suffixes (".cold", ".isra.0")
+	mangledSymbolRegex = regexp.MustCompile(`\b(_Z[\w.$]+|_R[\w]+)`)
+	// goEscapeRegex matches the characters the Go linker escapes in the last element of the package paths
+	goEscapeRegex = regexp.MustCompile(`%(2[eE]|25|22)`)
+)
+
+var goEscapes = map[string]string{"%2e": ".", "%2E": ".", "%25": "%", "%22": "\""}
+
+// goTypeFuncs are the prefixes of the equality and hash functions the Go compiler generates for the types,
+// before (type..) and after (type:.) Go 1.20
+var goTypeFuncs = []struct {
+	prefix string
+	name   string
+}{
+	{"type:.eq.", "eq"},
+	{"type..eq.", "eq"},
+	{"type:.hash.", "hash"},
+	{"type..hash.", "hash"},
+}
+
+func demangleSymbol(symbol string) string {
+	demangled, err := demangle.ToString(symbol)
+	if err != nil {
+		return symbol
+	}
+	return demangled
+}
+
+func demangleGoSymbol(name string) string {
+	for _, typeFunc := range goTypeFuncs {
+		if strings.HasPrefix(name, typeFunc.prefix) {
+			return typeFunc.name + "(" + strings.TrimPrefix(name, typeFunc.prefix) + ")"
+		}
+	}
+	for _, prefix := range []string{"go:itab.", "go.itab."} {
+		if strings.HasPrefix(name, prefix) {
+			types := strings.TrimPrefix(name, prefix)
+			if idx := strings.LastIndex(types, ","); idx > 0 {
+				return "itab(" + types[:idx] + ", " + types[idx+1:] + ")"
+			}
+		}
+	}
+	if strings.Contains(name, "%") {
+		name = goEscapeRegex.ReplaceAllStringFunc(name, func(escape string) string {
+			return goEscapes[escape]
+		})
+	}
+	return name
+}
+
+// DemangleFrame returns the readable name of the C++, Rust and Go symbols of a frame, the runtime suffix
+// is kept as is. Names that are not mangled, or cannot be demangled, are returned unchanged.
+// The indexer and the REST service demangle with copies of the same file, TestDemangleInSync of the REST db
+// package fails when they differ.
+func DemangleFrame(name string) string {
+	suffix := runtimeSuffixRegex.FindString(name)
+	symbol := strings.TrimSuffix(name, suffix)
+	if strings.Contains(symbol, "_Z") || strings.Contains(symbol, "_R") {
+		symbol = mangledSymbolRegex.ReplaceAllStringFunc(symbol, demangleSymbol)
+	}
+	return demangleGoSymbol(symbol) + suffix
+}
@@ -5,6 +5,7 @@ go 1.24.0
 require (
 	github.com/OneOfOne/xxhash v1.2.8
 	github.com/gin-gonic/gin v1.10.0
+	github.com/ianlancetaylor/demangle v0.0.0-20250417193237-f615e6bd150b
 )
 
 require (
@@ -0,0 +1,97 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// EncryptedHostNamePrefix marks the hostnames encrypted by the indexer
+const EncryptedHostNamePrefix = "enc:"
+
+const minHostNameKeyLength = 16
+
+// HostNameCipher implements the deterministic hostname encryption of the indexer (AES-GCM with a nonce
+// derived from the hostname), both check the vectors of testdata/hostname_cipher_vectors.json of the indexer.
+// Encrypting the hostname filters gives the values stored in ClickHouse, so filtering works without decrypting
+// the stored hostnames.
+type HostNameCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+func deriveHostNameKey(key string, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// NewHostNameCipher returns nil when key is empty, a nil cipher leaves the hostnames as they are
+func NewHostNameCipher(key string) (*HostNameCipher, error) {
+	if key == "" {
+		return nil, nil
+	}
+	if len(key) < minHostNameKeyLength {
+		return nil, fmt.Errorf("hostname encryption key must be at least %d characters long", minHostNameKeyLength)
+	}
+	block, err := aes.NewCipher(deriveHostNameKey(key, "hostname-encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &HostNameCipher{aead: aead, nonceKey: deriveHostNameKey(key, "hostname-nonce")}, nil
+}
+
+// Encrypt leaves the already encrypted hostnames as they are, so the encrypted values returned to the
+// callers not allowed to read hostnames can be used as filters
+func (hc *HostNameCipher) Encrypt(hostname string) string {
+	if hc == nil || hostname == "" || strings.HasPrefix(hostname, EncryptedHostNamePrefix) {
+		return hostname
+	}
+	mac := hmac.New(sha256.New, hc.nonceKey)
+	mac.Write([]byte(hostname))
+	nonce := mac.Sum(nil)[:hc.aead.NonceSize()]
+	sealed := hc.aead.Seal(nonce, nonce, []byte(hostname), nil)
+	return EncryptedHostNamePrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// Decrypt returns the hostnames it cannot decrypt (stored in clear or with another key) as they are
+func (hc *HostNameCipher) Decrypt(value string) string {
+	encoded, ok := strings.CutPrefix(value, EncryptedHostNamePrefix)
+	if hc == nil || !ok {
+		return value
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	nonceSize := hc.aead.NonceSize()
+	if err != nil || len(sealed) < nonceSize {
+		return value
+	}
+	hostname, err := hc.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return value
+	}
+	return string(hostname)
+}
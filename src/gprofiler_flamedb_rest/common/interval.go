@@ -0,0 +1,132 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// 30s, 5m, 1h, 1d or the ClickHouse form: 30 second, 5 minutes, ...
+	shortIntervalRegexp = regexp.MustCompile(`^(\d+)\s*([smhd])$`)
+	longIntervalRegexp  = regexp.MustCompile(`^(\d+)\s+(second|minute|hour|day)s?$`)
+
+	intervalUnits = map[string]time.Duration{
+		"s": time.Second, "second": time.Second,
+		"m": time.Minute, "minute": time.Minute,
+		"h": time.Hour, "hour": time.Hour,
+		"d": 24 * time.Hour, "day": 24 * time.Hour,
+	}
+
+	// coarserIntervals are the intervals a time series is coarsened to when it has too many points
+	coarserIntervals = []time.Duration{
+		time.Second, 5 * time.Second, 15 * time.Second, 30 * time.Second,
+		time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+		time.Hour, 2 * time.Hour, 6 * time.Hour, 12 * time.Hour,
+		24 * time.Hour, 7 * 24 * time.Hour,
+	}
+)
+
+// ParseInterval parses a time series interval of whole seconds
+func ParseInterval(value string) (time.Duration, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	match := shortIntervalRegexp.FindStringSubmatch(value)
+	if match == nil {
+		match = longIntervalRegexp.FindStringSubmatch(value)
+	}
+	if match == nil {
+		return 0, fmt.Errorf("invalid interval %q, expected e.g. 30s, 5m, 1h or 1d", value)
+	}
+	count, err := strconv.Atoi(match[1])
+	if err != nil || count <= 0 {
+		return 0, fmt.Errorf("invalid interval %q, expected a positive count", value)
+	}
+	return time.Duration(count) * intervalUnits[match[2]], nil
+}
+
+// FormatInterval formats an interval as a ClickHouse INTERVAL literal, in the largest unit dividing it
+func FormatInterval(interval time.Duration) string {
+	for _, unit := range []struct {
+		name     string
+		duration time.Duration
+	}{{"day", 24 * time.Hour}, {"hour", time.Hour}, {"minute", time.Minute}} {
+		if interval%unit.duration == 0 {
+			return fmt.Sprintf("%d %s", interval/unit.duration, unit.name)
+		}
+	}
+	return fmt.Sprintf("%d second", interval/time.Second)
+}
+
+func intervalPoints(start time.Time, end time.Time, interval time.Duration) int {
+	return int((end.Sub(start) + interval - 1) / interval)
+}
+
+// NormalizeInterval validates a requested interval and coarsens it when the time range would have more than
+// maxPoints points. It returns the ClickHouse interval and a note describing the coarsening, if any.
+func NormalizeInterval(start time.Time, end time.Time, value string, maxPoints int) (string, string, error) {
+	interval, err := ParseInterval(value)
+	if err != nil {
+		return "", "", err
+	}
+	points := intervalPoints(start, end, interval)
+	if maxPoints <= 0 || points <= maxPoints {
+		return FormatInterval(interval), "", nil
+	}
+	coarsened := 0 * time.Second
+	for _, candidate := range coarserIntervals {
+		if candidate > interval && intervalPoints(start, end, candidate) <= maxPoints {
+			coarsened = candidate
+			break
+		}
+	}
+	if coarsened == 0 {
+		// whole days, the coarsest bucketing of the rollups
+		day := 24 * time.Hour
+		coarsened = (end.Sub(start)/time.Duration(maxPoints) + day - 1) / day * day
+	}
+	note := fmt.Sprintf("interval %s coarsened to %s, it yields %d points, the maximum is %d", value,
+		FormatInterval(coarsened), points, maxPoints)
+	return FormatInterval(coarsened), note, nil
+}
+
+// budgetResolutions are the resolutions a time series is bucketed by when it is requested by point budget,
+// the finest first. Raw buckets are the timestamps of the stored records.
+var budgetResolutions = []struct {
+	name     string
+	interval time.Duration
+}{
+	{"raw", time.Second},
+	{"minute", time.Minute},
+	{"hour", time.Hour},
+	{"day", 24 * time.Hour},
+}
+
+// BudgetInterval returns the finest resolution whose time series has at most maxPoints points, and its
+// ClickHouse interval. Day is returned when even the day buckets exceed the budget.
+func BudgetInterval(start time.Time, end time.Time, maxPoints int) (string, string) {
+	for _, resolution := range budgetResolutions {
+		if intervalPoints(start, end, resolution.interval) <= maxPoints {
+			return resolution.name, FormatInterval(resolution.interval)
+		}
+	}
+	coarsest := budgetResolutions[len(budgetResolutions)-1]
+	return coarsest.name, FormatInterval(coarsest.interval)
+}
@@ -111,3 +111,8 @@ func MapGetWithDefault[K comparable, V any](m map[K]V, key K, defaultValue V) V
 	}
 	return defaultValue
 }
+
+// IsWildcard reports whether a filter value is a pattern, "*" matching any characters and "?" a single one
+func IsWildcard(value string) bool {
+	return strings.ContainsAny(value, "*?")
+}
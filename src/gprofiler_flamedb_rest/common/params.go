@@ -23,6 +23,26 @@ import (
 type TimeParams struct {
 	StartDateTime time.Time `form:"start_datetime" time_format:"2006-01-02T15:04:05" time_utc:"1"`
 	EndDateTime   time.Time `form:"end_datetime" time_format:"2006-01-02T15:04:05" time_utc:"1"`
+	// Timezone is the IANA time zone days start in when bucketing by day, UTC by default
+	Timezone string `form:"timezone" binding:"omitempty,timezone"`
+}
+
+// PointBudgetParams lets the server choose the resolution of a time series requested without an interval,
+// the finest one that stays under MaxPoints points. With an interval, MaxPoints lowers the coarsening limit.
+type PointBudgetParams struct {
+	MaxPoints int `form:"max_points" binding:"omitempty,min=1"`
+}
+
+// Location returns the time zone of the day buckets
+func (params *TimeParams) Location() *time.Location {
+	if params.Timezone == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(params.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
 }
 
 func (params *TimeParams) CheckTimeRange() {
@@ -39,6 +59,20 @@ type AllFiltersParams struct {
 	HostName      []string `form:"hostname"`
 	InstanceType  []string `form:"instance_type"`
 	K8SObject     []string `form:"k8s_obj"`
+	AppVersion    []string `form:"app_version"`
+	Endpoint      []string `form:"endpoint"`
+	JobName       []string `form:"job_name"`
+	// exclusion lists, "hostname!=web-1" is an alias of "exclude_hostname=web-1"
+	ExcludeContainerName []string `form:"exclude_container"`
+	ExcludeHostName      []string `form:"exclude_hostname"`
+	ExcludeInstanceType  []string `form:"exclude_instance_type"`
+	ExcludeK8SObject     []string `form:"exclude_k8s_obj"`
+	ExcludeAppVersion    []string `form:"exclude_app_version"`
+	ExcludeEndpoint      []string `form:"exclude_endpoint"`
+	ExcludeJobName       []string `form:"exclude_job_name"`
+	// Sidecars includes the containers classified as sidecars by the indexer (default), excludes them or keeps
+	// them only
+	Sidecars string `form:"sidecars" binding:"omitempty,oneof=include exclude only"`
 }
 
 type FiltersParams struct {
@@ -46,6 +80,9 @@ type FiltersParams struct {
 	HostName      string `rql:"column=HostName,filter"`
 	InstanceType  string `rql:"column=InstanceType,filter"`
 	K8SObject     string `rql:"column=ContainerEnvName,filter"`
+	AppVersion    string `rql:"column=AppVersion,filter"`
+	Endpoint      string `rql:"column=Endpoint,filter"`
+	JobName       string `rql:"column=JobName,filter"`
 }
 
 type MetricsFiltersParams struct {
@@ -64,17 +101,237 @@ type FlameGraphParams struct {
 	Format     string            `form:"format,default=flamegraph" binding:"oneof=flamegraph collapsed_file"`
 	Enrichment []string          `form:"enrichment"`
 	Insights   map[string]string `form:"insights"`
+	// GroupBy=module returns the flame graph of the modules of the frames, as set by the module rules
+	GroupBy string `form:"group_by" binding:"omitempty,oneof=module"`
+	// Only the hosts whose sample count is in this percentile band of the hosts of the range are included,
+	// e.g. from 95 to 100 for the 5% busiest hosts
+	HostPercentileFrom int `form:"host_percentile_from,default=0" binding:"min=0,max=100"`
+	HostPercentileTo   int `form:"host_percentile_to,default=100" binding:"min=0,max=100"`
+	// Pinned reads the raw stacks of the pinned time windows only, see the admin pins endpoint
+	Pinned bool `form:"pinned,default=false"`
+	// Detail=lite returns the names and values of the frames only, under short keys and cut to a size budget,
+	// for slow links
+	Detail string `form:"detail,default=full" binding:"oneof=full lite"`
+	// RawNames returns the frame names as stored, they are demangled otherwise when -demangle-frames is set
+	RawNames bool `form:"raw_names,default=false"`
+	// Inlined=collapse folds the frames marked as inlined by the profilers into their caller, they are kept as
+	// separate frames by default. Expand is rejected, the stored stacks carry no debug info to expand inlines from.
+	Inlined string `form:"inlined,default=keep" binding:"oneof=keep expand collapse"`
+}
+
+// MetricsFilters are the filters of the metrics params, the metrics table has no container or application columns
+func (params MetricsSummaryParams) MetricsFilters() AllFiltersParams {
+	return AllFiltersParams{HostName: params.HostName, InstanceType: params.InstanceType,
+		ExcludeHostName: params.ExcludeHostName, ExcludeInstanceType: params.ExcludeInstanceType}
+}
+
+func (params MetricsCpuTrendParams) MetricsFilters() AllFiltersParams {
+	return AllFiltersParams{HostName: params.HostName, InstanceType: params.InstanceType,
+		ExcludeHostName: params.ExcludeHostName, ExcludeInstanceType: params.ExcludeInstanceType}
+}
+
+func (params MetricsLastHTMLParams) MetricsFilters() AllFiltersParams {
+	return AllFiltersParams{HostName: params.HostName, InstanceType: params.InstanceType,
+		ExcludeHostName: params.ExcludeHostName, ExcludeInstanceType: params.ExcludeInstanceType}
+}
+
+// HostPercentileBand reports whether the flame graph is restricted to a percentile band of the hosts
+func (params FlameGraphParams) HostPercentileBand() bool {
+	return params.HostPercentileFrom > 0 || params.HostPercentileTo < 100
 }
 
 type QueryParams struct {
 	TimeParams
+	PointBudgetParams
 	AllFiltersParams
 	ServiceId    int    `form:"service" binding:"required"`
 	FunctionName string `form:"function_name"`
 	Filter       string `form:"filter"`
 	Resolution   string `form:"resolution,default=hour" binding:"oneof=none hour day raw"`
 	Interval     string `form:"interval"`
-	LookupFor    string `form:"lookup_for" binding:"required,oneof=ContainerName container HostName hostname InstanceType instance_type ContainerEnvName k8s_obj time time_range instance_type_count samples samples_count_by_function"`
+	// WithAnomalies adds the metric anomalies of the time range to the time and time_range lookups
+	WithAnomalies bool   `form:"with_anomalies,default=false"`
+	LookupFor     string `form:"lookup_for" binding:"required,oneof=ContainerName container HostName hostname InstanceType instance_type ContainerEnvName k8s_obj AppVersion app_version Endpoint endpoint JobName job_name time time_range instance_type_count samples samples_count_by_function cardinality"`
+}
+
+type CpuAttributionParams struct {
+	TimeParams
+	PointBudgetParams
+	AllFiltersParams
+	ServiceId int    `form:"service" binding:"required"`
+	Filter    string `form:"filter"`
+	GroupBy   string `form:"group_by,default=endpoint" binding:"oneof=endpoint job_name app_version"`
+	Interval  string `form:"interval"`
+	Limit     int    `form:"limit,default=10" binding:"numeric,min=1,max=100"`
+}
+
+type SymbolQualityParams struct {
+	TimeParams
+	PointBudgetParams
+	ServiceId int      `form:"service"`
+	HostName  []string `form:"hostname"`
+	Interval  string   `form:"interval"`
+	OrderBy   string   `form:"order_by,default=unresolved_samples" binding:"oneof=unresolved_samples unresolved_ratio"`
+	Limit     int      `form:"limit,default=20" binding:"numeric,min=1,max=500"`
+}
+
+type QualityScoreParams struct {
+	TimeParams
+	PointBudgetParams
+	ServiceId int    `form:"service" binding:"required"`
+	Interval  string `form:"interval"`
+}
+
+type AnomaliesParams struct {
+	TimeParams
+	PointBudgetParams
+	ServiceId int      `form:"service"`
+	Kind      string   `form:"kind" binding:"omitempty,oneof=weight_exceeds_parent missing_parent timestamp_clamped timestamp_rejected late_arrival"`
+	HostName  []string `form:"hostname"`
+	Interval  string   `form:"interval"`
+}
+
+type FrameHistoryParams struct {
+	TimeParams
+	ServiceId    int    `form:"service" binding:"required"`
+	FunctionName string `form:"function_name" binding:"required"`
+	Match        string `form:"match,default=exact" binding:"oneof=exact prefix contains"`
+	Limit        int    `form:"limit,default=20" binding:"numeric,min=1,max=100"`
+}
+
+// CheckTimeRange defaults to the last year, the retention of the daily rollup the history is read from
+func (params *FrameHistoryParams) CheckTimeRange() {
+	if params.EndDateTime == ZeroTime {
+		params.EndDateTime = time.Now().UTC()
+	}
+	if params.StartDateTime == ZeroTime {
+		params.StartDateTime = params.EndDateTime.AddDate(-1, 0, 0)
+	}
+}
+
+type TopMoversParams struct {
+	TimeParams
+	ServiceId  int    `form:"service" binding:"required"`
+	Direction  string `form:"direction,default=all" binding:"oneof=all up down"`
+	MinSamples int    `form:"min_samples,default=100" binding:"numeric,min=0"`
+	Limit      int    `form:"limit,default=20" binding:"numeric,min=1,max=500"`
+}
+
+// RecommendationsParams select the optimization recommendations of a service, a recommendation is made when
+// the functions it is about are in at least MinShare of the samples of the service
+type RecommendationsParams struct {
+	TimeParams
+	ServiceId int     `form:"service" binding:"required"`
+	MinShare  float64 `form:"min_share,default=0.05" binding:"min=0,max=1"`
+}
+
+// CanaryComparisonParams selects the canary hosts either by hostname or by a tag their hostnames contain,
+// the other hosts of the service are the fleet they are compared to
+type CanaryComparisonParams struct {
+	TimeParams
+	ServiceId int `form:"service" binding:"required"`
+	// HostName is named after the filters of the other params so that the canary hostnames get encrypted
+	HostName   []string `form:"canary_host"`
+	HostTag    string   `form:"canary_tag"`
+	Direction  string   `form:"direction,default=all" binding:"oneof=all up down"`
+	MinSamples int      `form:"min_samples,default=100" binding:"numeric,min=0"`
+	Limit      int      `form:"limit,default=20" binding:"numeric,min=1,max=500"`
+}
+
+type ColocationParams struct {
+	TimeParams
+	ServiceId      int `form:"service" binding:"required"`
+	MinSharedHosts int `form:"min_shared_hosts,default=1" binding:"numeric,min=1"`
+	Limit          int `form:"limit,default=20" binding:"numeric,min=1,max=500"`
+}
+
+// NoisyNeighborsParams correlates the neighbors with the host CPU of the service, or with the samples of one
+// of its containers when ContainerName is set
+type NoisyNeighborsParams struct {
+	TimeParams
+	ServiceId     int    `form:"service" binding:"required"`
+	ContainerName string `form:"container"`
+	Interval      string `form:"interval"`
+	MinSamples    int    `form:"min_samples,default=100" binding:"numeric,min=0"`
+	Limit         int    `form:"limit,default=20" binding:"numeric,min=1,max=500"`
+}
+
+type ExportSamplesParams struct {
+	TimeParams
+	ServiceId int    `form:"service" binding:"required"`
+	Cursor    string `form:"cursor"`
+	Limit     int    `form:"limit,default=100000" binding:"numeric,min=1,max=1000000"`
+	Format    string `form:"format,default=ndjson" binding:"oneof=ndjson"`
+}
+
+type IntegrityAuditParams struct {
+	TimeParams
+	ServiceId int `form:"service"`
+	Limit     int `form:"limit,default=20" binding:"numeric,min=1,max=500"`
+}
+
+// CheckTimeRange defaults to the last hour, the audit reads the raw stacks table
+func (params *IntegrityAuditParams) CheckTimeRange() {
+	if params.EndDateTime == ZeroTime {
+		params.EndDateTime = time.Now().UTC().Add(-BackRewindTime)
+	}
+	if params.StartDateTime == ZeroTime {
+		params.StartDateTime = params.EndDateTime.Add(-time.Hour)
+	}
+}
+
+type AuditLogParams struct {
+	TimeParams
+	User      string `form:"user"`
+	ServiceId int    `form:"service"`
+	Limit     int    `form:"limit,default=100" binding:"numeric,min=1,max=1000"`
+}
+
+// CheckTimeRange defaults to the last day, up to now as the audit log is written as requests are served
+func (params *AuditLogParams) CheckTimeRange() {
+	if params.EndDateTime == ZeroTime {
+		params.EndDateTime = time.Now().UTC()
+	}
+	if params.StartDateTime == ZeroTime {
+		params.StartDateTime = params.EndDateTime.Add(-time.Hour * 24)
+	}
+}
+
+type OnboardingReportParams struct {
+	TimeParams
+	Uploads int `form:"uploads,default=10" binding:"numeric,min=1,max=100"`
+}
+
+// DashboardSnapshotParams are the snapshot specific params, the flame graph and metrics summary of the
+// snapshot are read from the same query string as their own endpoints
+type DashboardSnapshotParams struct {
+	ServiceId    int  `form:"service" binding:"required"`
+	TopFunctions int  `form:"top_functions,default=50" binding:"numeric,min=1,max=1000"`
+	HTML         bool `form:"html,default=false"`
+}
+
+type TailParams struct {
+	AllFiltersParams
+	ServiceId    int `form:"service" binding:"required"`
+	Top          int `form:"top,default=10" binding:"numeric,min=1,max=100"`
+	PollInterval int `form:"poll_interval,default=5" binding:"numeric,min=1,max=60"`
+}
+
+// PinParams pins the raw stacks of a service time window, the window is [start, end)
+type PinParams struct {
+	ServiceId     int       `json:"service" binding:"required"`
+	StartDateTime time.Time `json:"start_datetime" binding:"required"`
+	EndDateTime   time.Time `json:"end_datetime" binding:"required"`
+	Reason        string    `json:"reason"`
+}
+
+type PinsParams struct {
+	ServiceId int `form:"service"`
+}
+
+type TableSuffixParams struct {
+	Suffix string `json:"suffix"`
+	Force  bool   `json:"force"`
 }
 
 type ClientParams struct {
@@ -96,13 +353,16 @@ type SessionsCountParams struct {
 
 type MetricsSummaryParams struct {
 	TimeParams
-	ServiceId    int      `form:"service" binding:"required"`
-	Filter       string   `form:"filter"`
-	Percentile   int      `form:"percentile,default=90" binding:"numeric,min=0,max=100"`
-	HostName     []string `form:"hostname"`
-	InstanceType []string `form:"instance_type"`
-	Interval     string   `form:"interval"`
-	GroupBy      string   `form:"group_by,default=none" binding:"oneof=none instance_type`
+	PointBudgetParams
+	ServiceId           int      `form:"service" binding:"required"`
+	Filter              string   `form:"filter"`
+	Percentile          int      `form:"percentile,default=90" binding:"numeric,min=0,max=100"`
+	HostName            []string `form:"hostname"`
+	InstanceType        []string `form:"instance_type"`
+	ExcludeHostName     []string `form:"exclude_hostname"`
+	ExcludeInstanceType []string `form:"exclude_instance_type"`
+	Interval            string   `form:"interval"`
+	GroupBy             string   `form:"group_by,default=none" binding:"oneof=none instance_type"`
 }
 
 type MetricsCpuTrendParams struct {
@@ -113,6 +373,8 @@ type MetricsCpuTrendParams struct {
 	Filter                string    `form:"filter"`
 	HostName              []string  `form:"hostname"`
 	InstanceType          []string  `form:"instance_type"`
+	ExcludeHostName       []string  `form:"exclude_hostname"`
+	ExcludeInstanceType   []string  `form:"exclude_instance_type"`
 }
 
 type MetricsServicesListSummaryParams struct {
@@ -132,6 +394,285 @@ type SamplesCountByFunction struct {
 	Percentage float64   `json:"cpu_percentage"`
 }
 
+type CpuAttributionPoint struct {
+	Time     time.Time `json:"time"`
+	Samples  int       `json:"samples"`
+	CpuShare float64   `json:"cpu_share"`
+}
+
+type CpuAttribution struct {
+	Name     string                `json:"name"`
+	Samples  int                   `json:"samples"`
+	CpuShare float64               `json:"cpu_share"`
+	Series   []CpuAttributionPoint `json:"series"`
+}
+
+type SymbolQualityPoint struct {
+	Time                  time.Time `json:"time"`
+	UnresolvedFrameRatio  float64   `json:"unresolved_frame_ratio"`
+	UnresolvedSampleRatio float64   `json:"unresolved_sample_ratio"`
+	UnresolvedLeafSamples uint64    `json:"unresolved_leaf_samples"`
+}
+
+type SymbolQuality struct {
+	ServiceId             int                  `json:"service_id"`
+	Uploads               int                  `json:"uploads"`
+	Hosts                 int                  `json:"hosts"`
+	TotalFrames           uint64               `json:"total_frames"`
+	UnknownFrames         uint64               `json:"unknown_frames"`
+	AddressOnlyFrames     uint64               `json:"address_only_frames"`
+	UnresolvedFrameRatio  float64              `json:"unresolved_frame_ratio"`
+	TotalSamples          uint64               `json:"total_samples"`
+	UnresolvedLeafSamples uint64               `json:"unresolved_leaf_samples"`
+	UnresolvedSampleRatio float64              `json:"unresolved_sample_ratio"`
+	Trend                 []SymbolQualityPoint `json:"trend"`
+}
+
+// QualityComponents are the profiling health indicators of a service, the score is their average on a
+// 0 to 100 scale, the indicators without data are left out
+type QualityComponents struct {
+	Score float64 `json:"score"`
+	// SampleDensity is the number of samples per host and minute
+	SampleDensity float64 `json:"sample_density"`
+	// GapRatio is the share of the host minutes without profile
+	GapRatio          float64 `json:"gap_ratio"`
+	UnknownFrameRatio float64 `json:"unknown_frame_ratio"`
+	TruncationRate    float64 `json:"truncation_rate"`
+}
+
+type QualityScorePoint struct {
+	Time time.Time `json:"time"`
+	QualityComponents
+}
+
+type QualityScore struct {
+	ServiceId int `json:"service_id"`
+	QualityComponents
+	Series []QualityScorePoint `json:"series"`
+}
+
+// ExportSample is a raw stacks record as written by the indexer
+type ExportSample struct {
+	Timestamp          time.Time `json:"timestamp"`
+	ServiceId          int       `json:"service_id"`
+	InstanceType       string    `json:"instance_type"`
+	ContainerEnvName   string    `json:"container_env_name"`
+	HostName           string    `json:"hostname"`
+	ContainerName      string    `json:"container_name"`
+	NumSamples         uint64    `json:"num_samples"`
+	CallStackHash      uint64    `json:"call_stack_hash"`
+	CallStackName      string    `json:"call_stack_name"`
+	CallStackParent    uint64    `json:"call_stack_parent"`
+	InsertionTimestamp time.Time `json:"insertion_timestamp"`
+	AppVersion         string    `json:"app_version"`
+	Endpoint           string    `json:"endpoint"`
+	JobName            string    `json:"job_name"`
+}
+
+type AnomalyPoint struct {
+	Time  time.Time `json:"time"`
+	Count uint64    `json:"count"`
+}
+
+type AnomalySummary struct {
+	ServiceId int            `json:"service_id"`
+	Kind      string         `json:"kind"`
+	Count     uint64         `json:"count"`
+	Files     uint64         `json:"files"`
+	LastSeen  time.Time      `json:"last_seen"`
+	Example   string         `json:"example"`
+	Series    []AnomalyPoint `json:"series"`
+}
+
+// MetricAnomaly is a window where a metric of the service deviated from its level over the time range,
+// Value is the most deviating bucket average and Baseline the average over the time range
+type MetricAnomaly struct {
+	Metric   string    `json:"metric"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Value    float64   `json:"value"`
+	Baseline float64   `json:"baseline"`
+	ZScore   float64   `json:"z_score"`
+}
+
+type FrameVersionHistory struct {
+	AppVersion string    `json:"app_version"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	DaysSeen   int       `json:"days_seen"`
+	Samples    uint64    `json:"samples"`
+}
+
+type FrameHistory struct {
+	Name            string                `json:"name"`
+	FirstSeen       time.Time             `json:"first_seen"`
+	LastSeen        time.Time             `json:"last_seen"`
+	DaysSeen        int                   `json:"days_seen"`
+	Samples         uint64                `json:"samples"`
+	FirstAppVersion string                `json:"first_app_version"`
+	Versions        []FrameVersionHistory `json:"versions"`
+}
+
+type TopMover struct {
+	Name            string  `json:"name"`
+	CurrentSamples  uint64  `json:"current_samples"`
+	PreviousSamples uint64  `json:"previous_samples"`
+	CurrentShare    float64 `json:"current_share"`
+	PreviousShare   float64 `json:"previous_share"`
+	ShareDelta      float64 `json:"share_delta"`
+}
+
+type Recommendation struct {
+	Category string `json:"category"`
+	// Share is the share of the samples of the service in the hottest matching function, the matching
+	// functions often call each other so their shares are not added up
+	Share          float64  `json:"share"`
+	Samples        uint64   `json:"samples"`
+	Functions      []string `json:"functions"`
+	Recommendation string   `json:"recommendation"`
+}
+
+type CanaryFrame struct {
+	Name          string  `json:"name"`
+	CanarySamples uint64  `json:"canary_samples"`
+	FleetSamples  uint64  `json:"fleet_samples"`
+	CanaryShare   float64 `json:"canary_share"`
+	FleetShare    float64 `json:"fleet_share"`
+	ShareDelta    float64 `json:"share_delta"`
+}
+
+// ColocatedService is a service profiled on hosts of the requested service, the samples are counted on the
+// shared hosts only and CPUShare is the share of the colocated service among the samples of both
+type ColocatedService struct {
+	ServiceId      int     `json:"service_id"`
+	SharedHosts    int     `json:"shared_hosts"`
+	Samples        uint64  `json:"samples"`
+	ServiceSamples uint64  `json:"service_samples"`
+	CPUShare       float64 `json:"cpu_share"`
+}
+
+type Colocation struct {
+	ServiceId int `json:"service_id"`
+	Hosts     int `json:"hosts"`
+	// SharedHosts are the hosts of the service shared with at least one other service
+	SharedHosts int                `json:"shared_hosts"`
+	Services    []ColocatedService `json:"services"`
+}
+
+// NoisyNeighbor is a container profiled on the hosts of the target, Correlation is the Pearson correlation of its
+// samples with the target series and SpikeLift the ratio of its average samples during the target spikes to its
+// average samples the rest of the time
+type NoisyNeighbor struct {
+	ServiceId     int     `json:"service_id"`
+	ContainerName string  `json:"container_name"`
+	Samples       uint64  `json:"samples"`
+	Correlation   float64 `json:"correlation"`
+	SpikeLift     float64 `json:"spike_lift"`
+}
+
+type NoisyNeighbors struct {
+	ServiceId     int    `json:"service_id"`
+	ContainerName string `json:"container_name,omitempty"`
+	// Target is the series the neighbors are correlated with, "cpu" or "samples"
+	Target       string          `json:"target"`
+	Buckets      int             `json:"buckets"`
+	SpikeBuckets int             `json:"spike_buckets"`
+	Neighbors    []NoisyNeighbor `json:"neighbors"`
+}
+
+type TopFunction struct {
+	Name         string  `json:"name"`
+	SelfSamples  int     `json:"self_samples"`
+	TotalSamples int     `json:"total_samples"`
+	SelfShare    float64 `json:"self_share"`
+	TotalShare   float64 `json:"total_share"`
+}
+
+type Pin struct {
+	ServiceId     int       `json:"service_id"`
+	StartDateTime time.Time `json:"start_datetime"`
+	EndDateTime   time.Time `json:"end_datetime"`
+	Reason        string    `json:"reason"`
+	CreatedBy     string    `json:"created_by"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type IntegritySlice struct {
+	ServiceId    int       `json:"service_id"`
+	Time         time.Time `json:"time"`
+	Frames       uint64    `json:"frames"`
+	OrphanFrames uint64    `json:"orphan_frames"`
+	OrphanRate   float64   `json:"orphan_rate"`
+}
+
+type IntegrityService struct {
+	ServiceId         int     `json:"service_id"`
+	Slices            int     `json:"slices"`
+	SlicesWithOrphans int     `json:"slices_with_orphans"`
+	Frames            uint64  `json:"frames"`
+	OrphanFrames      uint64  `json:"orphan_frames"`
+	OrphanRate        float64 `json:"orphan_rate"`
+}
+
+// AuditEntry records a request served to a basic auth user, the service and time range are the
+// requested ones, empty when the endpoint has none
+type AuditEntry struct {
+	Time          time.Time `json:"time"`
+	User          string    `json:"user"`
+	ClientIP      string    `json:"client_ip"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	Query         string    `json:"query,omitempty"`
+	ServiceId     int       `json:"service_id,omitempty"`
+	StartDateTime string    `json:"start_datetime,omitempty"`
+	EndDateTime   string    `json:"end_datetime,omitempty"`
+	Status        int       `json:"status"`
+}
+
+type IntegrityReport struct {
+	StartTime    time.Time          `json:"start_time"`
+	EndTime      time.Time          `json:"end_time"`
+	Frames       uint64             `json:"frames"`
+	OrphanFrames uint64             `json:"orphan_frames"`
+	OrphanRate   float64            `json:"orphan_rate"`
+	Services     []IntegrityService `json:"services"`
+	WorstSlices  []IntegritySlice   `json:"worst_slices"`
+}
+
+type TailMinute struct {
+	Time         time.Time    `json:"time"`
+	TotalSamples int          `json:"total_samples"`
+	Hosts        int          `json:"hosts"`
+	TopFrames    []FilterData `json:"top_frames"`
+}
+
+type OnboardingUpload struct {
+	HostName        string    `json:"hostname"`
+	Time            time.Time `json:"time"`
+	Frames          int       `json:"frames"`
+	UnknownFrames   int       `json:"unknown_frames"`
+	UnknownFraction float64   `json:"unknown_fraction"`
+	Samples         int       `json:"samples"`
+	Containers      int       `json:"containers"`
+}
+
+type OnboardingContainers struct {
+	Total                 int      `json:"total"`
+	UnnamedFraction       float64  `json:"unnamed_fraction"`
+	WithK8sObjectFraction float64  `json:"with_k8s_object_fraction"`
+	IdLikeNames           []string `json:"id_like_names"`
+}
+
+type OnboardingReport struct {
+	ServiceId            int                  `json:"service_id"`
+	Uploads              []OnboardingUpload   `json:"uploads"`
+	AvgFramesPerProfile  float64              `json:"avg_frames_per_profile"`
+	UnknownFrameFraction float64              `json:"unknown_frame_fraction"`
+	Runtimes             map[string]float64   `json:"runtimes"`
+	Containers           OnboardingContainers `json:"containers"`
+	Warnings             []string             `json:"warnings"`
+}
+
 type MetricsSummary struct {
 	AvgCpu           float64    `json:"avg_cpu"`
 	MaxCpu           float64    `json:"max_cpu"`
@@ -159,6 +700,14 @@ type FilterData struct {
 	Samples int    `json:"samples,omitempty"`
 }
 
+// DimensionCardinality is the number of distinct values of a filter dimension, Enumerable is false when there
+// are too many of them to be listed
+type DimensionCardinality struct {
+	Dimension  string `json:"dimension"`
+	Distinct   uint64 `json:"distinct"`
+	Enumerable bool   `json:"enumerable"`
+}
+
 type InstanceTypeCount struct {
 	InstanceType  string `json:"instance_type"`
 	InstanceCount int    `json:"instance_count"`
@@ -175,3 +724,42 @@ type MetricsLastHTMLParams struct {
 	ServiceId int    `form:"service" binding:"required"`
 	Filter    string `form:"filter"`
 }
+
+// ArtifactParams selects the bucket of the artifact, the artifacts of the services bound to a residency
+// region are stored in the bucket of the region
+type ArtifactParams struct {
+	ServiceId int `form:"service" binding:"numeric,min=0"`
+}
+
+// ShareLinkParams is the query string of the /api/v1/flamegraph view to share, and the lifetime of the link
+// in seconds, the default one when 0
+type ShareLinkParams struct {
+	Query     string `json:"query" binding:"required"`
+	ExpiresIn int    `json:"expires_in" binding:"min=0"`
+}
+
+type ShareLink struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ServiceMatrixParams lists the services of an overview, their indicators are compared with the same time
+// range a week earlier
+type ServiceMatrixParams struct {
+	TimeParams
+	ServiceIds []int `form:"service" binding:"required,min=1,max=50,dive,min=1"`
+}
+
+// ServiceIndicators are the key indicators of a service in the service matrix. AvgCpuDelta is in percentage
+// points, SamplesDelta is the relative change of the samples, nil without samples a week earlier.
+type ServiceIndicators struct {
+	ServiceId      int          `json:"service_id"`
+	AvgCpu         float64      `json:"avg_cpu"`
+	WeekAgoAvgCpu  float64      `json:"week_ago_avg_cpu"`
+	AvgCpuDelta    float64      `json:"avg_cpu_delta"`
+	Samples        int          `json:"samples"`
+	WeekAgoSamples int          `json:"week_ago_samples"`
+	SamplesDelta   *float64     `json:"samples_delta"`
+	TopFunction    *TopFunction `json:"top_function"`
+}
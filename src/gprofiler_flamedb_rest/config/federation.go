@@ -0,0 +1,61 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Region is a regional REST instance queries can be federated to
+type Region struct {
+	Name string
+	// URL is the base URL of the instance, the requests carry the credentials of the caller
+	URL string
+}
+
+// ParseFederationRegions parses a comma separated list of name=url regions
+func ParseFederationRegions(spec string) ([]Region, error) {
+	regions := make([]Region, 0)
+	names := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, rawURL, found := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid federation region %q, expected name=url", item)
+		}
+		parsed, err := url.Parse(strings.TrimSpace(rawURL))
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid url of federation region %s", name)
+		}
+		if parsed.User != nil {
+			return nil, fmt.Errorf("credentials in the url of federation region %s, the credentials of the "+
+				"callers are forwarded", name)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate federation region %s", name)
+		}
+		names[name] = true
+		regions = append(regions, Region{Name: name, URL: strings.TrimSuffix(parsed.String(), "/")})
+	}
+	return regions, nil
+}
@@ -0,0 +1,68 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ModuleRule maps the frames matching a glob pattern (e.g. "com.pinterest.ads.*") to a module
+type ModuleRule struct {
+	Pattern string `json:"pattern"`
+	Module  string `json:"module"`
+}
+
+// ModuleRules are evaluated in order, the first matching rule wins. Frames matching no rule belong to
+// DefaultModule, "other" when empty.
+type ModuleRules struct {
+	DefaultModule string       `json:"default_module"`
+	Rules         []ModuleRule `json:"rules"`
+}
+
+// ParseModuleRules parses and validates the JSON module rules file
+func ParseModuleRules(data []byte) (ModuleRules, error) {
+	var rules ModuleRules
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		return ModuleRules{}, fmt.Errorf("invalid module rules file: %w", err)
+	}
+	for idx, rule := range rules.Rules {
+		if rule.Pattern == "" || rule.Module == "" {
+			return ModuleRules{}, fmt.Errorf("module rule %d must have a pattern and a module", idx)
+		}
+	}
+	if rules.DefaultModule == "" {
+		rules.DefaultModule = "other"
+	}
+	return rules, nil
+}
+
+// LoadModuleRules returns no rule when path is empty
+func LoadModuleRules(path string) (ModuleRules, error) {
+	if path == "" {
+		return ModuleRules{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ModuleRules{}, err
+	}
+	return ParseModuleRules(data)
+}
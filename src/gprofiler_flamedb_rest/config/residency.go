@@ -0,0 +1,76 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ResidencyRegion binds services to the ClickHouse cluster their data is stored in, the file is shared
+// with the indexer, which writes the records of these services to the cluster
+type ResidencyRegion struct {
+	Name           string `json:"name"`
+	ClickHouseAddr string `json:"clickhouse_addr"`
+	// S3Bucket holds the artifacts of the services of the region
+	S3Bucket   string `json:"s3_bucket"`
+	ServiceIds []int  `json:"service_ids"`
+}
+
+// ParseResidencyRegions parses and validates the JSON residency file
+func ParseResidencyRegions(data []byte) ([]ResidencyRegion, error) {
+	var file struct {
+		Regions []ResidencyRegion `json:"regions"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid residency file: %w", err)
+	}
+	names := make(map[string]bool)
+	services := make(map[int]string)
+	for _, region := range file.Regions {
+		if region.Name == "" || region.ClickHouseAddr == "" {
+			return nil, fmt.Errorf("residency regions must have a name and a clickhouse_addr")
+		}
+		if names[region.Name] {
+			return nil, fmt.Errorf("duplicate residency region %s", region.Name)
+		}
+		names[region.Name] = true
+		for _, serviceId := range region.ServiceIds {
+			if other, ok := services[serviceId]; ok {
+				return nil, fmt.Errorf("service %d is bound to both %s and %s", serviceId, other, region.Name)
+			}
+			services[serviceId] = region.Name
+		}
+	}
+	return file.Regions, nil
+}
+
+// LoadResidencyRegions returns no region when path is empty
+func LoadResidencyRegions(path string) ([]ResidencyRegion, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseResidencyRegions(data)
+}
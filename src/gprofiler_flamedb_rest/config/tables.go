@@ -0,0 +1,146 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	tableSuffixMutex  sync.RWMutex
+	tableSuffixRegexp = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+)
+
+// TableSuffix returns the schema version suffix appended to every ClickHouse table name
+func TableSuffix() string {
+	tableSuffixMutex.RLock()
+	defer tableSuffixMutex.RUnlock()
+	return ClickHouseTableSuffix
+}
+
+// SetTableSuffix switches the queries over to the tables of another schema version
+func SetTableSuffix(suffix string) error {
+	if err := ValidateTableSuffix(suffix); err != nil {
+		return err
+	}
+	tableSuffixMutex.Lock()
+	defer tableSuffixMutex.Unlock()
+	ClickHouseTableSuffix = suffix
+	return nil
+}
+
+// ErrTableSuffixNotPersisted is returned by PersistTableSuffix without a TableSuffixFile, a switch would be lost
+// on restart and only apply to one replica
+var ErrTableSuffixNotPersisted = errors.New("the table suffix is only switched at runtime with a table suffix file")
+
+// LoadTableSuffixFile switches to the suffix of TableSuffixFile, when it exists. It returns whether the suffix
+// changed.
+func LoadTableSuffixFile() (bool, error) {
+	if TableSuffixFile == "" {
+		return false, nil
+	}
+	content, err := os.ReadFile(TableSuffixFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	suffix := strings.TrimSpace(string(content))
+	if suffix == TableSuffix() {
+		return false, nil
+	}
+	return true, SetTableSuffix(suffix)
+}
+
+// PersistTableSuffix writes the suffix to TableSuffixFile and switches to it. The other replicas sharing the
+// file switch on their next LoadTableSuffixFile.
+func PersistTableSuffix(suffix string) error {
+	if err := ValidateTableSuffix(suffix); err != nil {
+		return err
+	}
+	if TableSuffixFile == "" {
+		return ErrTableSuffixNotPersisted
+	}
+	// written aside and renamed, so that a replica never reads a partial suffix
+	tmp, err := os.CreateTemp(filepath.Dir(TableSuffixFile), filepath.Base(TableSuffixFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.WriteString(suffix + "\n"); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), TableSuffixFile); err != nil {
+		return err
+	}
+	return SetTableSuffix(suffix)
+}
+
+func ValidateTableSuffix(suffix string) error {
+	if !tableSuffixRegexp.MatchString(suffix) {
+		return fmt.Errorf("invalid table suffix %q", suffix)
+	}
+	return nil
+}
+
+// StacksTableWithSuffix returns the stacks table name of the given rollup ("" for raw stacks, "1min", "1hour_all"...)
+func StacksTableWithSuffix(rollup string, suffix string) string {
+	if rollup == "" {
+		return ClickHouseStacksTable + suffix
+	}
+	return fmt.Sprintf("%s_%s%s", ClickHouseStacksTable, rollup, suffix)
+}
+
+func StacksTable(rollup string) string {
+	return StacksTableWithSuffix(rollup, TableSuffix())
+}
+
+func MetricsTable() string {
+	return ClickHouseMetricsTable + TableSuffix()
+}
+
+func SymbolQualityTable() string {
+	return ClickHouseSymbolQualityTable + TableSuffix()
+}
+
+func AnomaliesTable() string {
+	return ClickHouseAnomaliesTable + TableSuffix()
+}
+
+func PinnedStacksTable() string {
+	return ClickHouseStacksPinnedTable + TableSuffix()
+}
+
+func PinsTable() string {
+	return ClickHousePinsTable + TableSuffix()
+}
+
+func SidecarsTable() string {
+	return ClickHouseSidecarsTable + TableSuffix()
+}
@@ -16,18 +16,134 @@
 
 package config
 
+import "fmt"
+
 var (
 	ClickHouseAddr         = "localhost:9000"
 	ClickHouseStacksTable  = "flamedb.samples"
 	ClickHouseMetricsTable = "flamedb.metrics"
+	ClickHouseTableSuffix  = ""
 	UseTLS                 = true
 	CertFilePath           = ""
 	KeyFilePath            = ""
 	Credentials            = "user:password"
+
+	// TableSuffixFile persists the table suffix switched at runtime, it overrides ClickHouseTableSuffix once
+	// written and is reloaded every TableSuffixReloadInterval seconds
+	TableSuffixFile           = ""
+	TableSuffixReloadInterval = 30
+	// AdminUsers are the comma separated basic auth users allowed on the admin endpoints, nobody when empty
+	AdminUsers = ""
 	
 	// Data retention periods (in days)
 	RawRetentionDays     = 7   // Raw data retention period
 	MinuteRetentionDays  = 30  // Minute aggregation retention period
 	HourlyRetentionDays  = 90  // Hourly aggregation retention period
 	DailyRetentionDays   = 365 // Daily aggregation retention period
+
+	// Self profiling, posted to the pprof ingestion endpoint of an indexer under the service of the given name
+	SelfProfilingEnabled      = false
+	SelfProfilingServiceName  = "gprofiler-internal"
+	SelfProfilingIndexerURL   = ""
+	SelfProfilingIndexerToken = ""
+	SelfProfilingInterval     = 300 // seconds between profiling sessions
+	SelfProfilingDuration     = 30  // seconds
+
+	// Per profile file symbolization statistics and data quality anomalies written by the indexer
+	ClickHouseSymbolQualityTable = "flamedb.symbol_quality"
+	ClickHouseAnomaliesTable     = "flamedb.anomalies"
+
+	// Raw stacks of the pinned service time windows, kept beyond the retention of the stacks table
+	ClickHouseStacksPinnedTable = "flamedb.samples_pinned"
+	ClickHousePinsTable         = "flamedb.pins"
+
+	// Containers classified as sidecars by the indexer
+	ClickHouseSidecarsTable = "flamedb.sidecar_containers"
+
+	// Periodic audit of the stacks parent pointers, disabled when the interval is 0
+	IntegrityAuditInterval = 0    // seconds between audits
+	IntegrityAuditLookback = 3600 // seconds of raw stacks checked by every audit
+
+	// The tail reads the samples inserted up to TailSettleDelay seconds ago, once the indexer has flushed them,
+	// and at most TailMaxLateness seconds older than their insertion
+	TailSettleDelay = 45
+	TailMaxLateness = 3600
+
+	// Regional REST instances the federated endpoints fan out to, as name=url,name=url
+	FederationRegions = ""
+	FederationTimeout = 60 // seconds
+
+	// Time series requested with a finer interval are coarsened to stay below this number of points
+	MaxTimeSeriesPoints = 2000
+
+	// The detail=lite flame graphs keep the heaviest frames of at most LiteFlameGraphMaxDepth levels fitting
+	// in about LiteFlameGraphMaxBytes of JSON, 0 to disable either limit
+	LiteFlameGraphMaxBytes = 256 * 1024
+	LiteFlameGraphMaxDepth = 64
+
+	// Demangle the C++, Rust and Go symbols of the flame graph frames, unless the request asks for the raw names
+	DemangleFrames = true
+
+	// Metric anomalies are the buckets deviating from the average of the time range by this many standard
+	// deviations, 0 to disable them
+	MetricAnomalyThreshold = 3
+
+	// Samples per host and minute of a service profiled at full density, for the quality score
+	QualityTargetSamplesPerMinute = 600
+
+	// Filter dimensions with more distinct values than this are reported as not enumerable by the cardinality
+	// lookup, 0 to disable the guard
+	MaxEnumerableValues = 10000
+
+	// Serve the GraphQL endpoint on /api/v1/graphql
+	GraphQLEnabled = false
+
+	// Key of the hostnames encrypted by the indexer, and the comma separated basic auth users allowed to
+	// read them decrypted, the other users get the encrypted hostnames
+	HostNameEncryptionKey = ""
+	HostNameReaders       = ""
+
+	// JSON lines file every request is recorded to, empty disables the audit log
+	AuditLogFile = ""
+
+	// JSON file binding service ids to the ClickHouse cluster of their data residency region, shared with
+	// the indexer
+	ResidencyFile = ""
+
+	// JSON file of the rules mapping frames to modules, for the group_by=module flame graphs
+	ModuleRulesFile = ""
+
+	// Key signing the share links of flame graph views, empty disables them. Links expire after
+	// ShareLinkDefaultTTL hours unless their creator asks for another lifetime, up to ShareLinkMaxTTL hours.
+	ShareLinkKey        = ""
+	ShareLinkDefaultTTL = 24
+	ShareLinkMaxTTL     = 168
+
+	// S3 bucket of the HTML artifacts written by the indexer, empty disables the artifacts endpoint
+	ArtifactsBucket = ""
+	AWSRegion       = ""
+	// AWSEndpoint overrides the S3 endpoint, e.g. for localstack
+	AWSEndpoint = ""
+)
+
+// Set at build time with -ldflags "-X restflamedb/config.Version=... -X restflamedb/config.GitSHA=..."
+var (
+	Version   = "dev"
+	GitSHA    = "unknown"
+	BuildTime = "unknown"
 )
+
+// ValidateSelfProfiling rejects the self profiling settings the profiler cannot run with
+func ValidateSelfProfiling() error {
+	if !SelfProfilingEnabled {
+		return nil
+	}
+	if SelfProfilingInterval <= 0 || SelfProfilingDuration <= 0 {
+		return fmt.Errorf("-self-profiling-interval (%d) and -self-profiling-duration (%d) must be positive",
+			SelfProfilingInterval, SelfProfilingDuration)
+	}
+	if SelfProfilingIndexerURL == "" || SelfProfilingServiceName == "" {
+		return fmt.Errorf("-self-profiling-indexer-url and -self-profiling-service-name are required")
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"restflamedb/common"
+	"restflamedb/config"
+	"sort"
+	"strings"
+	"time"
+)
+
+type anomalyKey struct {
+	serviceId int
+	kind      string
+}
+
+// FetchAnomalies returns the data quality anomalies counted by the indexer per service and kind, over time
+func (c *ClickHouseClient) FetchAnomalies(ctx context.Context,
+	params common.AnomaliesParams) ([]common.AnomalySummary, error) {
+	conditions := []string{fmt.Sprintf("(Timestamp BETWEEN '%s' AND '%s')",
+		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime))}
+	if params.ServiceId > 0 {
+		conditions = append(conditions, fmt.Sprintf("ServiceId = %d", params.ServiceId))
+	}
+	if params.Kind != "" {
+		conditions = append(conditions, fmt.Sprintf("Kind = %s", sqlStringList([]string{params.Kind})))
+	}
+	if len(params.HostName) > 0 {
+		conditions = append(conditions, fmt.Sprintf("HostName IN (%s)", sqlStringList(params.HostName)))
+	}
+	interval := getInterval(params.StartDateTime, params.EndDateTime, params.Interval)
+
+	query := fmt.Sprintf(`
+		SELECT %s AS Datetime, ServiceId, Kind, sum(Count),
+		uniqExact(HostName, Timestamp), max(Timestamp), any(Example)
+		FROM %s
+		WHERE %s
+		GROUP BY Datetime, ServiceId, Kind
+		ORDER BY Datetime`, startOfInterval(interval, params.Location()), config.AnomaliesTable(), strings.Join(conditions, " AND "))
+	rows, err := c.client.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byKey := make(map[anomalyKey]*common.AnomalySummary)
+	for rows.Next() {
+		var timestamp, lastSeen time.Time
+		var serviceId int
+		var kind, example string
+		var count, files uint64
+		if err = rows.Scan(&timestamp, &serviceId, &kind, &count, &files, &lastSeen, &example); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		key := anomalyKey{serviceId: serviceId, kind: kind}
+		summary, exists := byKey[key]
+		if !exists {
+			summary = &common.AnomalySummary{ServiceId: serviceId, Kind: kind, Example: example,
+				Series: make([]common.AnomalyPoint, 0)}
+			byKey[key] = summary
+		}
+		summary.Count += count
+		summary.Files += files
+		if lastSeen.After(summary.LastSeen) {
+			summary.LastSeen = lastSeen
+		}
+		summary.Series = append(summary.Series, common.AnomalyPoint{Time: timestamp, Count: count})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]common.AnomalySummary, 0, len(byKey))
+	for _, summary := range byKey {
+		result = append(result, *summary)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Count > result[j].Count
+	})
+	return result, nil
+}
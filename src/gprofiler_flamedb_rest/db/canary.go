@@ -0,0 +1,84 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"restflamedb/common"
+	"restflamedb/config"
+	"time"
+)
+
+// canaryRollup picks the stacks table fine enough for the window, among the ones keeping the hostnames
+func canaryRollup(start time.Time, end time.Time) string {
+	duration := end.Sub(start)
+	switch {
+	case duration < 6*time.Hour:
+		return ""
+	case duration <= 7*24*time.Hour:
+		return "1hour"
+	}
+	return "1day"
+}
+
+// canaryCondition matches the rows of the canary hosts. A tag matches the hostnames containing it, so it
+// never matches encrypted hostnames.
+func canaryCondition(params common.CanaryComparisonParams) string {
+	if len(params.HostName) > 0 {
+		return fmt.Sprintf("HostName IN (%s)", sqlStringList(params.HostName))
+	}
+	return fmt.Sprintf("position(HostName, %s) > 0", sqlStringList([]string{params.HostTag}))
+}
+
+// FetchCanaryComparison returns the functions whose CPU share differs the most between the canary hosts and
+// the rest of the fleet over [start, end). The shares are relative to all samples of each group of hosts.
+func (c *ClickHouseClient) FetchCanaryComparison(ctx context.Context,
+	params common.CanaryComparisonParams) ([]common.CanaryFrame, error) {
+	canary := canaryCondition(params)
+	cmp := Comparison{
+		Table:     config.StacksTable(canaryRollup(params.StartDateTime, params.EndDateTime)),
+		ServiceId: params.ServiceId,
+		A: ComparisonWindow{
+			Start:     params.StartDateTime,
+			End:       params.EndDateTime,
+			Condition: fmt.Sprintf("NOT (%s)", canary),
+		},
+		B: ComparisonWindow{Start: params.StartDateTime, End: params.EndDateTime, Condition: canary},
+	}
+	shares, err := c.FetchFrameShares(ctx, cmp, FrameShareOptions{
+		MinSamples: params.MinSamples,
+		Direction:  params.Direction,
+		Limit:      params.Limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]common.CanaryFrame, 0, len(shares))
+	for _, share := range shares {
+		result = append(result, common.CanaryFrame{
+			Name:          share.Name,
+			CanarySamples: share.SamplesB,
+			FleetSamples:  share.SamplesA,
+			CanaryShare:   share.ShareB,
+			FleetShare:    share.ShareA,
+			ShareDelta:    share.ShareDelta,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,69 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"restflamedb/common"
+	"restflamedb/config"
+	"strings"
+)
+
+// cardinalityDimensions are the filter dimensions of the cardinality lookup, named as their lookups
+var cardinalityDimensions = []string{"HostName", "ContainerName", "ContainerEnvName", "InstanceType"}
+
+// newDimensionCardinalities pairs the distinct counts with cardinalityDimensions, a dimension is enumerable
+// when it has at most maxEnumerable values (0 for no limit)
+func newDimensionCardinalities(distinct []uint64, maxEnumerable int) []common.DimensionCardinality {
+	result := make([]common.DimensionCardinality, 0, len(distinct))
+	for idx, count := range distinct {
+		result = append(result, common.DimensionCardinality{
+			Dimension:  cardinalityDimensions[idx],
+			Distinct:   count,
+			Enumerable: maxEnumerable <= 0 || count <= uint64(maxEnumerable),
+		})
+	}
+	return result
+}
+
+// FetchCardinality counts the distinct values of every filter dimension in a single query, so that clients can
+// check a dimension is small enough before listing its values. The counts are approximate (uniq).
+func (c *ClickHouseClient) FetchCardinality(ctx context.Context, params common.QueryParams,
+	filterQuery string) ([]common.DimensionCardinality, error) {
+	_, conditions := BuildConditions(params.AllFiltersParams, filterQuery)
+	columns := make([]string, 0, len(cardinalityDimensions))
+	for _, dimension := range cardinalityDimensions {
+		columns = append(columns, fmt.Sprintf("uniqIf(%s, %s != '')", dimension, dimension))
+	}
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM %s
+		WHERE ServiceId == %d AND (Timestamp BETWEEN '%s' AND '%s') %s`,
+		strings.Join(columns, ", "), config.StacksTable("1min"), params.ServiceId,
+		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime), conditions)
+
+	distinct := make([]uint64, len(cardinalityDimensions))
+	targets := make([]any, len(distinct))
+	for idx := range distinct {
+		targets[idx] = &distinct[idx]
+	}
+	if err := c.client.QueryRowContext(ctx, query).Scan(targets...); err != nil {
+		return nil, err
+	}
+	return newDimensionCardinalities(distinct, config.MaxEnumerableValues), nil
+}
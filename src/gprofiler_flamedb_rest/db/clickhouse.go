@@ -200,7 +200,21 @@ func getInterval(startTime time.Time, endTime time.Time, interval string) string
 	return interval
 }
 
-func GetTimeRanges(start time.Time, end time.Time, resolution string) map[string][]TimeRange {
+// startOfInterval is the bucket expression of the Timestamp column, day buckets start at midnight of location
+func startOfInterval(interval string, location *time.Location) string {
+	if location == nil || location == time.UTC {
+		return fmt.Sprintf("toStartOfInterval(Timestamp, INTERVAL '%s')", interval)
+	}
+	if interval == "24 hour" || interval == "1 day" {
+		return fmt.Sprintf("toStartOfDay(Timestamp, '%s')", location)
+	}
+	return fmt.Sprintf("toStartOfInterval(Timestamp, INTERVAL '%s', '%s')", interval, location)
+}
+
+// GetTimeRanges splits a time range over the raw table and the rollups. The daily rollup holds UTC days, outside
+// UTC the day resolution is served by the hourly rollup while it is retained so that days start at local midnight.
+func GetTimeRanges(start time.Time, end time.Time, resolution string,
+	location *time.Location) map[string][]TimeRange {
 	result := map[string][]TimeRange{
 		"raw":             make([]TimeRange, 0),
 		"1hour":           make([]TimeRange, 0),
@@ -224,9 +238,15 @@ func GetTimeRanges(start time.Time, end time.Time, resolution string) map[string
 	
 	// For very old data (>90 days), use daily aggregation with day boundaries
 	if now.Sub(start) >= dailyThreshold {
-		result["1day_historical"] = append(result["1day_historical"], makeTimeRange(makeStartOfDay(start), makeEndOfDay(end)))
+		// a UTC day of the rollup is counted in the local day its midnight falls in
+		result["1day_historical"] = append(result["1day_historical"], makeTimeRange(
+			makeStartOfDay(start.In(location)).UTC(), makeEndOfDay(end.In(location)).UTC()))
 		return result
 	}
+
+	if resolution == "day" && location != time.UTC && now.Sub(start) < hourlyRetentionInterval {
+		resolution = "hour"
+	}
 	
 	// For 7-90 day old data, raw is expired but hourly is available
 	if now.Sub(start) >= rawRetentionInterval && now.Sub(start) < hourlyRetentionInterval {
@@ -280,37 +300,64 @@ func GetTimeRanges(start time.Time, end time.Time, resolution string) map[string
 	return result
 }
 
-func BuildConditions(ContainerName []string, HostName []string, InstanceType []string, K8SObject []string,
-	filterQuery string) (string, string) {
+// BuildConditions returns the conditions of the filters, ANDed with the RQL filter query when set, and the
+// prefix of the rollup tables able to serve them ("_all" without any filter)
+func BuildConditions(filters common.AllFiltersParams, filterQuery string) (string, string) {
+	conditions := filterQuery
+	tablePrefix := "_all"
 	if filterQuery != "" {
-		return "", filterQuery
+		tablePrefix = ""
 	}
-	var conditions string
-	tablePrefix := "_all"
 
-	if len(ContainerName) > 0 {
-		containerNamesHash := make([]string, 0)
-		for _, singleContainerName := range ContainerName {
-			containerNamesHash = append(containerNamesHash, fmt.Sprint(common.GetHash32AsInt(singleContainerName)))
+	hashCondition := func(column string) func(values []string) string {
+		return func(values []string) string {
+			hashes := make([]string, 0, len(values))
+			for _, value := range values {
+				hashes = append(hashes, fmt.Sprint(common.GetHash32AsInt(value)))
+			}
+			return fmt.Sprintf("%sHash IN (%s)", column, strings.Join(hashes, ","))
 		}
-		conditions += fmt.Sprintf(" AND (ContainerNameHash IN (%s))", strings.Join(containerNamesHash, ","))
-		tablePrefix = ""
 	}
-	if len(HostName) > 0 {
-		hostNamesHash := make([]string, 0)
-		for _, singleHostName := range HostName {
-			hostNamesHash = append(hostNamesHash, fmt.Sprint(common.GetHash32AsInt(singleHostName)))
+	inCondition := func(column string) func(values []string) string {
+		return func(values []string) string {
+			return fmt.Sprintf("%s IN (%s)", column, sqlStringList(values))
 		}
-		conditions += fmt.Sprintf(" AND (HostNameHash IN (%s))", strings.Join(hostNamesHash, ","))
-		tablePrefix = ""
 	}
-	if len(InstanceType) > 0 {
-		tablePrefix = ""
-		conditions += fmt.Sprintf(" AND (InstanceType IN ('%s'))", strings.Join(InstanceType, "','"))
+
+	// wildcard values ("web-*") are matched on the column itself, see valuesCondition
+	dimensions := []struct {
+		column         string
+		values         []string
+		excluded       []string
+		exactCondition func(values []string) string
+	}{
+		{"ContainerName", filters.ContainerName, filters.ExcludeContainerName, hashCondition("ContainerName")},
+		{"HostName", filters.HostName, filters.ExcludeHostName, hashCondition("HostName")},
+		{"InstanceType", filters.InstanceType, filters.ExcludeInstanceType, inCondition("InstanceType")},
+		{"ContainerEnvName", filters.K8SObject, filters.ExcludeK8SObject, inCondition("ContainerEnvName")},
+		// application metadata columns only exist in the per-host rollups, not in the *_all ones
+		{"AppVersion", filters.AppVersion, filters.ExcludeAppVersion, inCondition("AppVersion")},
+		{"Endpoint", filters.Endpoint, filters.ExcludeEndpoint, inCondition("Endpoint")},
+		{"JobName", filters.JobName, filters.ExcludeJobName, inCondition("JobName")},
 	}
-	if len(K8SObject) > 0 {
+	// sidecars are classified by container name, whatever their service
+	switch filters.Sidecars {
+	case "exclude":
+		conditions += fmt.Sprintf(" AND ContainerName NOT IN (SELECT ContainerName FROM %s)", config.SidecarsTable())
 		tablePrefix = ""
-		conditions += fmt.Sprintf(" AND (ContainerEnvName IN ('%s'))", strings.Join(K8SObject, "','"))
+	case "only":
+		conditions += fmt.Sprintf(" AND ContainerName IN (SELECT ContainerName FROM %s)", config.SidecarsTable())
+		tablePrefix = ""
+	}
+	for _, dimension := range dimensions {
+		if condition := valuesCondition(dimension.column, dimension.values, dimension.exactCondition); condition != "" {
+			conditions += fmt.Sprintf(" AND (%s)", condition)
+			tablePrefix = ""
+		}
+		if condition := valuesCondition(dimension.column, dimension.excluded, dimension.exactCondition); condition != "" {
+			conditions += fmt.Sprintf(" AND NOT (%s)", condition)
+			tablePrefix = ""
+		}
 	}
 	return tablePrefix, conditions
 }
@@ -336,12 +383,15 @@ func NewClickHouseClient(addr string) *ClickHouseClient {
 
 func getTableName(table string, tablePrefix string) string {
 	if table == "raw" {
-		return config.ClickHouseStacksTable
+		return config.StacksTable("")
 	}
 	if table == "1day_historical" {
-		return fmt.Sprintf("%s_1day", config.ClickHouseStacksTable)
+		return config.StacksTable("1day")
 	}
-	return fmt.Sprintf("%s_%s%s", config.ClickHouseStacksTable, table, tablePrefix)
+	if table == "pinned" {
+		return config.PinnedStacksTable()
+	}
+	return config.StacksTable(table + tablePrefix)
 }
 
 func scanFrames(rows *sql.Rows, frames map[uint64]Frame, collapsed bool) (int, int, error) {
@@ -378,15 +428,27 @@ func scanFrames(rows *sql.Rows, frames map[uint64]Frame, collapsed bool) (int, i
 }
 
 func (c *ClickHouseClient) GetTopFrames(ctx context.Context, params common.FlameGraphParams,
-	filterQuery string) (Graph, error) {
+	filterQuery string) (*Graph, error) {
 	var wg sync.WaitGroup
 	var mutex sync.Mutex
 	queryErrors := make([]error, 0)
 
 	graph := NewGraph(params)
-	allTimeRanges := GetTimeRanges(params.StartDateTime, params.EndDateTime, params.Resolution)
-	tablePrefix, conditions := BuildConditions(params.ContainerName, params.HostName, params.InstanceType,
-		params.K8SObject, filterQuery)
+	allTimeRanges := GetTimeRanges(params.StartDateTime, params.EndDateTime, params.Resolution, params.Location())
+	tablePrefix, conditions := BuildConditions(params.AllFiltersParams, filterQuery)
+	if params.HostPercentileBand() {
+		hosts, err := c.fetchHostSamples(ctx, params, conditions)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch the hosts samples: %w", err)
+		}
+		graph.Hosts = hostsInPercentileBand(hosts, params.HostPercentileFrom, params.HostPercentileTo)
+		// only the per host tables have the hostnames
+		tablePrefix = ""
+		conditions += hostsCondition(graph.Hosts)
+	}
+	if params.Pinned {
+		allTimeRanges = map[string][]TimeRange{"pinned": {makeTimeRange(params.StartDateTime, params.EndDateTime)}}
+	}
 
 	for table, timeRanges := range allTimeRanges {
 		log.Printf("🔍 Service %d: Querying table type '%s' with %d time ranges", params.ServiceId, table, len(timeRanges))
@@ -433,27 +495,27 @@ func (c *ClickHouseClient) GetTopFrames(ctx context.Context, params common.Flame
 
 	for _, elemErr := range queryErrors {
 		if elemErr != nil {
-			return Graph{}, fmt.Errorf("unable fetch flamegraph from DB")
+			return nil, fmt.Errorf("unable fetch flamegraph from DB")
 		}
 	}
 
 	_, err := graph.prepareFrames(params.StacksNum)
 
 	if err != nil {
-		return Graph{}, err
+		return nil, err
 	}
 
-	return graph, nil
+	return &graph, nil
 }
 
 func (c *ClickHouseClient) FetchInstanceTypeCount(ctx context.Context, params common.QueryParams,
 	filterQuery string) []common.InstanceTypeCount {
 	var selectQuery string
 	result := make([]common.InstanceTypeCount, 0)
-	_, conditions := BuildConditions(params.ContainerName, params.HostName, params.InstanceType, params.K8SObject, filterQuery)
+	_, conditions := BuildConditions(params.AllFiltersParams, filterQuery)
 	selectQuery = `
 		SELECT InstanceType, COUNT(DISTINCT HostName) as InstanceCount
-		FROM flamedb.samples_1min where ServiceId = '%d'  AND (Timestamp BETWEEN '%s'  AND '%s' )
+		FROM ` + config.StacksTable("1min") + ` where ServiceId = '%d'  AND (Timestamp BETWEEN '%s'  AND '%s' )
 		%s GROUP BY InstanceType  ORDER BY InstanceCount DESC`
 
 	query := fmt.Sprintf(selectQuery, params.ServiceId, common.FormatTime(params.StartDateTime),
@@ -483,9 +545,9 @@ func (c *ClickHouseClient) FetchFieldValueSample(ctx context.Context, field stri
 	filterQuery string) []common.FilterData {
 	var selectQuery string
 	result := make([]common.FilterData, 0)
-	_, conditions := BuildConditions(params.ContainerName, params.HostName, params.InstanceType, params.K8SObject, filterQuery)
+	_, conditions := BuildConditions(params.AllFiltersParams, filterQuery)
 	selectQuery = `
-		SELECT %s, SUM(NumSamples) as samples from flamedb.samples_1min WHERE ServiceId == '%d' AND
+		SELECT %s, SUM(NumSamples) as samples from ` + config.StacksTable("1min") + ` WHERE ServiceId == '%d' AND
 		(Timestamp BETWEEN '%s' AND '%s') %s GROUP BY %s ORDER BY samples DESC;`
 	query := fmt.Sprintf(selectQuery, field, params.ServiceId, common.FormatTime(params.StartDateTime),
 		common.FormatTime(params.EndDateTime), conditions, field)
@@ -514,9 +576,9 @@ func (c *ClickHouseClient) FetchFieldValueSample(ctx context.Context, field stri
 func (c *ClickHouseClient) FetchFieldValues(ctx context.Context, field string, params common.QueryParams,
 	filterQuery string) []common.FilterData {
 	result := make([]common.FilterData, 0)
-	_, conditions := BuildConditions(params.ContainerName, params.HostName, params.InstanceType, params.K8SObject, filterQuery)
+	_, conditions := BuildConditions(params.AllFiltersParams, filterQuery)
 	query := fmt.Sprintf(`
-				SELECT %s from flamedb.samples_1min WHERE ServiceId == '%d' AND
+				SELECT %s from ` + config.StacksTable("1min") + ` WHERE ServiceId == '%d' AND
 				(Timestamp BETWEEN '%s' AND '%s') %s GROUP BY %s;
 			`, field, params.ServiceId, common.FormatTime(params.StartDateTime),
 		common.FormatTime(params.EndDateTime), conditions, field)
@@ -543,16 +605,16 @@ func (c *ClickHouseClient) FetchFieldValues(ctx context.Context, field string, p
 
 func (c *ClickHouseClient) FetchSampleCount(ctx context.Context, params common.QueryParams,
 	filterQuery string) []common.Sample {
-	_, conditions := BuildConditions(params.ContainerName, params.HostName, params.InstanceType, params.K8SObject, filterQuery)
+	_, conditions := BuildConditions(params.AllFiltersParams, filterQuery)
 	interval := getInterval(params.StartDateTime, params.EndDateTime, params.Interval)
 	result := make([]common.Sample, 0)
 	query := fmt.Sprintf(`
-			SELECT toStartOfInterval(Timestamp, INTERVAL '%s') as Datetime, SUM(NumSamples)
-                 FROM flamedb.samples_1min
+			SELECT %s as Datetime, SUM(NumSamples)
+                 FROM ` + config.StacksTable("1min") + `
                  WHERE ServiceId == '%d' AND (Timestamp BETWEEN '%s' AND '%s') %s
                  GROUP BY Datetime
                  ORDER BY Datetime DESC;
-	`, interval, params.ServiceId, common.FormatTime(params.StartDateTime),
+	`, startOfInterval(interval, params.Location()), params.ServiceId, common.FormatTime(params.StartDateTime),
 		common.FormatTime(params.EndDateTime), conditions)
 	rows, err := c.client.Query(query)
 	if err == nil {
@@ -576,22 +638,23 @@ func (c *ClickHouseClient) FetchSampleCount(ctx context.Context, params common.Q
 
 func (c *ClickHouseClient) FetchSampleCountByFunction(ctx context.Context, params common.QueryParams,
 	filterQuery string) []common.SamplesCountByFunction {
-	_, conditions := BuildConditions(params.ContainerName, params.HostName, params.InstanceType, params.K8SObject, filterQuery)
+	_, conditions := BuildConditions(params.AllFiltersParams, filterQuery)
 	interval := getInterval(params.StartDateTime, params.EndDateTime, "")
 	if interval == "15 second" || interval == "30 second" {
 		interval = "1 minute"
 	}
+	bucket := startOfInterval(interval, params.Location())
 	result := make([]common.SamplesCountByFunction, 0)
 	query := fmt.Sprintf(`
 		WITH all_samples as(
-			SELECT toStartOfInterval(Timestamp, INTERVAL '%s') AS Datetime, SUM(NumSamples) AS sum_cpu
-			FROM flamedb.samples_1min
+			SELECT %s AS Datetime, SUM(NumSamples) AS sum_cpu
+			FROM ` + config.StacksTable("1min") + `
 			WHERE ServiceId == '%d' AND (Timestamp BETWEEN '%s' AND '%s') %s
 			GROUP BY Datetime
 			ORDER BY Datetime DESC
 		), function_samples AS (
-			SELECT toStartOfInterval(Timestamp, INTERVAL '%s') AS Datetime, SUM(NumSamples) AS sum_cpu
-			FROM  flamedb.samples
+			SELECT %s AS Datetime, SUM(NumSamples) AS sum_cpu
+			FROM ` + config.StacksTable("") + `
 			WHERE ServiceId == '%d' AND (Timestamp BETWEEN '%s' AND '%s') AND (CallStackName = '%s') %s
 			GROUP BY Datetime
 			ORDER BY Datetime DESC
@@ -600,8 +663,8 @@ func (c *ClickHouseClient) FetchSampleCountByFunction(ctx context.Context, param
 		SELECT (function_samples.sum_cpu/all_samples.sum_cpu) AS Samples , all_samples.Datetime AS Datetime
 		FROM all_samples
 		LEFT JOIN function_samples ON function_samples.Datetime = all_samples.Datetime;
-	`, interval, params.ServiceId, common.FormatTime(params.StartDateTime),
-		common.FormatTime(params.EndDateTime), conditions, interval, params.ServiceId, common.FormatTime(params.StartDateTime),
+	`, bucket, params.ServiceId, common.FormatTime(params.StartDateTime),
+		common.FormatTime(params.EndDateTime), conditions, bucket, params.ServiceId, common.FormatTime(params.StartDateTime),
 		common.FormatTime(params.EndDateTime), params.FunctionName, conditions)
 
 	rows, err := c.client.Query(query)
@@ -641,7 +704,7 @@ func (c *ClickHouseClient) FetchSampleCountByFunction(ctx context.Context, param
 func (c *ClickHouseClient) FetchTimes(ctx context.Context, params common.QueryParams, filterQuery string) []string {
 	var interval string
 	result := make([]string, 0)
-	_, conditions := BuildConditions(params.ContainerName, params.HostName, params.InstanceType, params.K8SObject, filterQuery)
+	_, conditions := BuildConditions(params.AllFiltersParams, filterQuery)
 
 	switch params.Resolution {
 	case "raw":
@@ -654,11 +717,11 @@ func (c *ClickHouseClient) FetchTimes(ctx context.Context, params common.QueryPa
 		interval = getInterval(params.StartDateTime, params.EndDateTime, "")
 	}
 	query := fmt.Sprintf(`
-			SELECT toStartOfInterval(Timestamp, INTERVAL '%s') as Datetime
-			from flamedb.samples_1min WHERE ServiceId == '%d' AND
+			SELECT %s as Datetime
+			from ` + config.StacksTable("1min") + ` WHERE ServiceId == '%d' AND
 			(Timestamp BETWEEN '%s' AND '%s') %s
 			GROUP BY Datetime
-			ORDER BY Datetime DESC;`, interval, params.ServiceId,
+			ORDER BY Datetime DESC;`, startOfInterval(interval, params.Location()), params.ServiceId,
 		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime), conditions)
 	rows, err := c.client.Query(query)
 	if err == nil {
@@ -681,11 +744,11 @@ func (c *ClickHouseClient) FetchTimes(ctx context.Context, params common.QueryPa
 
 func (c *ClickHouseClient) FetchTimeRange(ctx context.Context, params common.QueryParams, filterQuery string) []string {
 	result := make([]string, 0)
-	_, conditions := BuildConditions(params.ContainerName, params.HostName, params.InstanceType, params.K8SObject, filterQuery)
+	_, conditions := BuildConditions(params.AllFiltersParams, filterQuery)
 
 	query := fmt.Sprintf(`
 			SELECT min(Timestamp), max(Timestamp)
-			from flamedb.samples_1min WHERE
+			from ` + config.StacksTable("1min") + ` WHERE
 			ServiceId == '%d' AND
 			(Timestamp BETWEEN '%s' AND '%s') %s;`, params.ServiceId,
 		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime), conditions)
@@ -715,8 +778,7 @@ func (c *ClickHouseClient) FetchTimeRange(ctx context.Context, params common.Que
 
 func (c *ClickHouseClient) FetchMetricsSummary(ctx context.Context, params common.MetricsSummaryParams,
 	filterQuery string) (common.MetricsSummary, error) {
-	defaultEmptyList := make([]string, 0)
-	_, conditions := BuildConditions(defaultEmptyList, params.HostName, params.InstanceType, defaultEmptyList, filterQuery)
+	_, conditions := BuildConditions(params.MetricsFilters(), filterQuery)
 
 	percentile := float64(params.Percentile) / 100.0
 	query := fmt.Sprintf(`
@@ -728,7 +790,7 @@ func (c *ClickHouseClient) FetchMetricsSummary(ctx context.Context, params commo
 			groupArray(CPUAverageUsedPercent) as CPUArray
 		FROM %s
 		WHERE ServiceId = %d AND (Timestamp BETWEEN '%s' AND '%s') %s
-		GROUP BY HostName)`, percentile, config.ClickHouseMetricsTable, params.ServiceId,
+		GROUP BY HostName)`, percentile, config.MetricsTable(), params.ServiceId,
 		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime), conditions)
 	rows, err := c.client.Query(query)
 	if err == nil {
@@ -795,9 +857,9 @@ func (c *ClickHouseClient) FetchMetricsServicesListSummary(ctx context.Context,
 	SELECT arrayAvg(flatten(groupArray(CPUArray))), max(MaxCPU), ServiceId,
 		   avg(MaxMemory), max(MaxMemory), quantile(%f)(MaxMemory), count()
 	FROM GroupedMetrics
-	GROUP BY ServiceId`, config.ClickHouseMetricsTable, formattedServicesList,
+	GROUP BY ServiceId`, config.MetricsTable(), formattedServicesList,
 		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime),
-		config.ClickHouseMetricsTable, formattedServicesList, percentile)
+		config.MetricsTable(), formattedServicesList, percentile)
 	rows, err := c.client.Query(query)
 
 	var results []common.MetricsServicesListSummary
@@ -846,8 +908,7 @@ func (c *ClickHouseClient) FetchMetricsServicesListSummary(ctx context.Context,
 
 func (c *ClickHouseClient) FetchMetricsGraph(ctx context.Context, params common.MetricsSummaryParams,
 	filterQuery string) ([]common.MetricsSummary, error) {
-	defaultEmptyList := make([]string, 0)
-	_, conditions := BuildConditions(defaultEmptyList, params.HostName, params.InstanceType, defaultEmptyList, filterQuery)
+	_, conditions := BuildConditions(params.MetricsFilters(), filterQuery)
 
 	result := make([]common.MetricsSummary, 0)
 	interval := getInterval(params.StartDateTime, params.EndDateTime, params.Interval)
@@ -861,16 +922,16 @@ func (c *ClickHouseClient) FetchMetricsGraph(ctx context.Context, params common.
 	query := fmt.Sprintf(`
 		SELECT Datetime %s, arrayAvg(flatten(groupArray(CPUArray))), MAX(MaxCPU),
 			AVG(MaxMemory), MAX(MaxMemory), quantile(%f)(MaxMemory) FROM
-		(SELECT toStartOfInterval(Timestamp, INTERVAL '%s') as
+		(SELECT %s as
 			Datetime %s,
 			HostName,
 			MAX(MemoryAverageUsedPercent) AS MaxMemory,
 			MAX(CPUAverageUsedPercent) as MaxCPU,
 			groupArray(CPUAverageUsedPercent) as CPUArray
 		FROM %s
-		WHERE ServiceId = %d AND (Datetime BETWEEN '%s' AND '%s') %s
+		WHERE ServiceId = %d AND (Datetime BETWEEN toDateTime('%s', 'UTC') AND toDateTime('%s', 'UTC')) %s
 		GROUP BY Datetime %s, HostName) GROUP BY Datetime %s ORDER BY Datetime DESC;
-	`, groupBy, percentile, interval, groupBy, config.ClickHouseMetricsTable, params.ServiceId,
+	`, groupBy, percentile, startOfInterval(interval, params.Location()), groupBy, config.MetricsTable(), params.ServiceId,
 		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime), conditions, groupBy, groupBy)
 	rows, err := c.client.Query(query)
 	if err == nil {
@@ -917,52 +978,41 @@ func (c *ClickHouseClient) FetchMetricsGraph(ctx context.Context, params common.
 
 func (c *ClickHouseClient) FetchMetricsCpuTrend(ctx context.Context, params common.MetricsCpuTrendParams,
 	filterQuery string) (common.MetricsCpuTrend, error) {
-	defaultEmptyList := make([]string, 0)
 	finalResult := common.MetricsCpuTrend{}
-	_, conditions := BuildConditions(defaultEmptyList, params.HostName, params.InstanceType, defaultEmptyList, filterQuery)
-
+	_, conditions := BuildConditions(params.MetricsFilters(), filterQuery)
+
+	// the compared period is the baseline, the current one is returned first
+	cmp := Comparison{
+		Table:      config.MetricsTable(),
+		ServiceId:  params.ServiceId,
+		A:          ComparisonWindow{Start: params.ComparedStartDateTime, End: params.ComparedEndDateTime},
+		B:          ComparisonWindow{Start: params.StartDateTime, End: params.EndDateTime},
+		Conditions: conditions,
+		Closed:     true,
+	}
 	query := fmt.Sprintf(`
-		WITH CURRENT_CONSUMPTION AS (
+		WITH %s
+			SELECT avg_cpu, max_cpu, avg_memory, max_memory
+			FROM (
+				SELECT *, 1 AS SortOrder FROM WindowB
+				UNION ALL
+				SELECT *, 2 AS SortOrder FROM WindowA)
+			order by SortOrder`, cmp.WindowCTEs(func(where string) string {
+		return fmt.Sprintf(`
 			SELECT
 				arrayAvg(flatten(groupArray(CPUArray))) AS avg_cpu,
 				MAX(MaxCPU) AS max_cpu,
 				AVG(MaxMemory) AS avg_memory,
-				MAX(MaxMemory) AS max_memory,
-				1 SortOrder
+				MAX(MaxMemory) AS max_memory
 			FROM
 				(SELECT
 				MAX(MemoryAverageUsedPercent) AS MaxMemory,
 				MAX(CPUAverageUsedPercent) as MaxCPU,
 				groupArray(CPUAverageUsedPercent) as CPUArray
 				FROM %s
-				WHERE ServiceId = %d AND (Timestamp BETWEEN '%s' AND '%s') %s
-				GROUP BY HostName)
-		),
-		PREVIOUS_CONSUMPTION AS (
-			SELECT
-				arrayAvg(flatten(groupArray(CPUArray))) AS avg_cpu,
-				MAX(MaxCPU) AS max_cpu,
-				AVG(MaxMemory) AS avg_memory,
-				MAX(MaxMemory) AS max_memory,
-				2 SortOrder
-			FROM
-			(SELECT
-				MAX(MemoryAverageUsedPercent) AS MaxMemory,
-				MAX(CPUAverageUsedPercent) as MaxCPU,
-				groupArray(CPUAverageUsedPercent) as CPUArray
-			FROM %s
-			WHERE ServiceId = %d AND (Timestamp BETWEEN '%s' AND '%s') %s
-			GROUP BY HostName)
-		)
-			SELECT avg_cpu, max_cpu, avg_memory, max_memory
-			FROM (
-				SELECT * FROM CURRENT_CONSUMPTION
-				UNION ALL
-				SELECT * FROM PREVIOUS_CONSUMPTION)
-			order by SortOrder`, config.ClickHouseMetricsTable, params.ServiceId,
-		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime), conditions,
-		config.ClickHouseMetricsTable, params.ServiceId,
-		common.FormatTime(params.ComparedStartDateTime), common.FormatTime(params.ComparedEndDateTime), conditions)
+				WHERE %s
+				GROUP BY HostName)`, cmp.Table, where)
+	}))
 
 	first := true
 	rows, err := c.client.Query(query)
@@ -1019,7 +1069,7 @@ func (c *ClickHouseClient) FetchServices(ctx context.Context, params common.Serv
 		groupByExpr = "GROUP BY (ServiceId,ContainerEnvName)"
 	}
 	query := fmt.Sprintf(`
-		SELECT %s from flamedb.samples_1min WHERE (Timestamp BETWEEN '%s' AND '%s') %s;
+		SELECT %s from ` + config.StacksTable("1min") + ` WHERE (Timestamp BETWEEN '%s' AND '%s') %s;
 	`, expr, common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime), groupByExpr)
 	rows, err := c.client.Query(query)
 	result := make([]SrvResp, 0)
@@ -1049,10 +1099,10 @@ func (c *ClickHouseClient) FetchServices(ctx context.Context, params common.Serv
 
 func (c *ClickHouseClient) FetchSessionsCount(ctx context.Context, params common.SessionsCountParams,
 	filterQuery string) (int, error) {
-	_, conditions := BuildConditions(params.ContainerName, params.HostName, params.InstanceType, params.K8SObject, filterQuery)
+	_, conditions := BuildConditions(params.AllFiltersParams, filterQuery)
 
 	query := fmt.Sprintf(`
-		SELECT uniq(HostName,Timestamp) FROM flamedb.samples_1min WHERE ServiceId = %d AND
+		SELECT uniq(HostName,Timestamp) FROM ` + config.StacksTable("1min") + ` WHERE ServiceId = %d AND
 		                                                                (Timestamp BETWEEN '%s' AND '%s') %s;
 	`, params.ServiceId, common.FormatTime(params.StartDateTime),
 		common.FormatTime(params.EndDateTime), conditions)
@@ -1076,9 +1126,9 @@ func (c *ClickHouseClient) FetchSessionsCount(ctx context.Context, params common
 
 func (c *ClickHouseClient) FetchLastHTML(ctx context.Context, params common.MetricsLastHTMLParams,
 	filterQuery string) (string, error) {
-	_, conditions := BuildConditions(params.ContainerName, params.HostName, params.InstanceType, params.K8SObject, filterQuery)
+	_, conditions := BuildConditions(params.MetricsFilters(), filterQuery)
 	query := fmt.Sprintf(`
-			SELECT argMax(HTMLPath,Timestamp) FROM flamedb.metrics WHERE ServiceId = %d AND
+			SELECT argMax(HTMLPath,Timestamp) FROM ` + config.MetricsTable() + ` WHERE ServiceId = %d AND
 			                                                                (Timestamp BETWEEN '%s' AND '%s') %s;
 		`, params.ServiceId, common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime), conditions)
 	rows, err := c.client.Query(query)
@@ -1098,3 +1148,199 @@ func (c *ClickHouseClient) FetchLastHTML(ctx context.Context, params common.Metr
 	}
 	return "", nil
 }
+
+var cpuAttributionColumns = map[string]string{
+	"endpoint":    "Endpoint",
+	"job_name":    "JobName",
+	"app_version": "AppVersion",
+}
+
+// FetchCpuAttribution returns the CPU share of the top application endpoints (or job names / app versions)
+// over time, the share is relative to all samples of the service in the same interval
+func (c *ClickHouseClient) FetchCpuAttribution(ctx context.Context, params common.CpuAttributionParams,
+	filterQuery string) ([]common.CpuAttribution, error) {
+	column, ok := cpuAttributionColumns[params.GroupBy]
+	if !ok {
+		return nil, fmt.Errorf("unsupported group by %s", params.GroupBy)
+	}
+	_, conditions := BuildConditions(params.AllFiltersParams, filterQuery)
+	bucket := startOfInterval(getInterval(params.StartDateTime, params.EndDateTime, params.Interval),
+		params.Location())
+	startTime := common.FormatTime(params.StartDateTime)
+	endTime := common.FormatTime(params.EndDateTime)
+
+	totals := make(map[time.Time]int)
+	query := fmt.Sprintf(`
+		SELECT %s AS Datetime, SUM(NumSamples)
+		FROM ` + config.StacksTable("1min") + `
+		WHERE ServiceId == '%d' AND (Timestamp BETWEEN '%s' AND '%s') %s
+		GROUP BY Datetime`, bucket, params.ServiceId, startTime, endTime, conditions)
+	rows, err := c.client.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var timestamp time.Time
+		var samples int
+		if err = rows.Scan(&timestamp, &samples); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		totals[timestamp] = samples
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	query = fmt.Sprintf(`
+		SELECT %s AS Datetime, %s AS Name, SUM(NumSamples)
+		FROM ` + config.StacksTable("1min") + `
+		WHERE ServiceId == '%d' AND (Timestamp BETWEEN '%s' AND '%s') %s AND Name IN (
+			SELECT %s FROM ` + config.StacksTable("1min") + `
+			WHERE ServiceId == '%d' AND (Timestamp BETWEEN '%s' AND '%s') AND %s != '' %s
+			GROUP BY %s
+			ORDER BY SUM(NumSamples) DESC
+			LIMIT %d)
+		GROUP BY Datetime, Name
+		ORDER BY Datetime`, bucket, column, params.ServiceId, startTime, endTime, conditions,
+		column, params.ServiceId, startTime, endTime, column, conditions, column, params.Limit)
+	rows, err = c.client.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := make([]cpuAttributionPoint, 0)
+	for rows.Next() {
+		var point cpuAttributionPoint
+		if err = rows.Scan(&point.time, &point.name, &point.samples); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		points = append(points, point)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return attributeCpu(totals, points), nil
+}
+
+type cpuAttributionPoint struct {
+	time    time.Time
+	name    string
+	samples int
+}
+
+// attributeCpu groups the points by name, the shares are relative to the totals of the service per interval
+// and overall. The names with the most samples come first.
+func attributeCpu(totals map[time.Time]int, points []cpuAttributionPoint) []common.CpuAttribution {
+	var overallTotal int
+	for _, total := range totals {
+		overallTotal += total
+	}
+	byName := make(map[string]*common.CpuAttribution)
+	for _, point := range points {
+		attribution, exists := byName[point.name]
+		if !exists {
+			attribution = &common.CpuAttribution{Name: point.name, Series: make([]common.CpuAttributionPoint, 0)}
+			byName[point.name] = attribution
+		}
+		seriesPoint := common.CpuAttributionPoint{Time: point.time, Samples: point.samples}
+		if total := totals[point.time]; total > 0 {
+			seriesPoint.CpuShare = float64(point.samples) / float64(total)
+		}
+		attribution.Series = append(attribution.Series, seriesPoint)
+		attribution.Samples += point.samples
+	}
+
+	result := make([]common.CpuAttribution, 0, len(byName))
+	for _, attribution := range byName {
+		if overallTotal > 0 {
+			attribution.CpuShare = float64(attribution.Samples) / float64(overallTotal)
+		}
+		result = append(result, *attribution)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Samples != result[j].Samples {
+			return result[i].Samples > result[j].Samples
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// tailQueries returns the queries of the per minute totals and top frames of the samples inserted within
+// [since, until). The windows of consecutive polls are contiguous, so that every row is read once.
+func tailQueries(params common.TailParams, since time.Time, until time.Time) (string, string) {
+	_, conditions := BuildConditions(params.AllFiltersParams, "")
+	// InsertionTimestamp is not in the sorting key, the Timestamp bound lets ClickHouse prune partitions.
+	// Samples older than config.TailMaxLateness when inserted are not tailed.
+	window := fmt.Sprintf("InsertionTimestamp >= '%s' AND InsertionTimestamp < '%s' "+
+		"AND Timestamp >= (toDateTime('%s') - INTERVAL %d SECOND)", common.FormatTime(since),
+		common.FormatTime(until), common.FormatTime(since), config.TailMaxLateness)
+	totals := fmt.Sprintf(`
+		SELECT toStartOfMinute(Timestamp) AS Minute, sum(NumSamples), uniq(HostName)
+		FROM %s
+		WHERE ServiceId = %d AND CallStackParent = 0 AND %s %s
+		GROUP BY Minute
+		ORDER BY Minute`, config.StacksTable(""), params.ServiceId, window, conditions)
+	topFrames := fmt.Sprintf(`
+		SELECT toStartOfMinute(Timestamp) AS Minute, CallStackName, sum(NumSamples) AS Samples
+		FROM %s
+		WHERE ServiceId = %d AND CallStackParent != 0 AND %s %s
+		GROUP BY Minute, CallStackName
+		ORDER BY Minute, Samples DESC
+		LIMIT %d BY Minute`, config.StacksTable(""), params.ServiceId, window, conditions, params.Top)
+	return totals, topFrames
+}
+
+// FetchTailMinutes returns per minute totals and top frames of the samples inserted within [since, until)
+func (c *ClickHouseClient) FetchTailMinutes(ctx context.Context, params common.TailParams,
+	since time.Time, until time.Time) ([]common.TailMinute, error) {
+	query, topFramesQuery := tailQueries(params, since, until)
+	rows, err := c.client.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	minutes := make(map[time.Time]*common.TailMinute)
+	result := make([]common.TailMinute, 0)
+	for rows.Next() {
+		var minute time.Time
+		var samples, hosts int
+		if err = rows.Scan(&minute, &samples, &hosts); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		result = append(result, common.TailMinute{Time: minute, TotalSamples: samples, Hosts: hosts,
+			TopFrames: make([]common.FilterData, 0)})
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil || len(result) == 0 {
+		return result, err
+	}
+	for idx := range result {
+		minutes[result[idx].Time] = &result[idx]
+	}
+
+	rows, err = c.client.QueryContext(ctx, topFramesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var minute time.Time
+		var name string
+		var samples int
+		if err = rows.Scan(&minute, &name, &samples); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		if tailMinute, ok := minutes[minute]; ok {
+			tailMinute.TopFrames = append(tailMinute.TopFrames, common.FilterData{Name: name, Samples: samples})
+		}
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,127 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"restflamedb/common"
+	"restflamedb/config"
+	"sort"
+)
+
+// hostSamples are the root samples of a service on a host
+type hostSamples struct {
+	serviceId int
+	hostName  string
+	samples   uint64
+}
+
+// colocation aggregates the samples of the services on the hosts of serviceId, per service sharing them.
+// The services sharing fewer than minSharedHosts hosts are left out, the other ones are ordered by CPU share.
+func colocation(serviceId int, rows []hostSamples, minSharedHosts int, limit int) common.Colocation {
+	own := make(map[string]uint64)
+	for _, row := range rows {
+		if row.serviceId == serviceId {
+			own[row.hostName] += row.samples
+		}
+	}
+	shared := make(map[string]bool)
+	byService := make(map[int]*common.ColocatedService)
+	for _, row := range rows {
+		if row.serviceId == serviceId {
+			continue
+		}
+		if _, ok := own[row.hostName]; !ok {
+			continue
+		}
+		service, ok := byService[row.serviceId]
+		if !ok {
+			service = &common.ColocatedService{ServiceId: row.serviceId}
+			byService[row.serviceId] = service
+		}
+		service.SharedHosts += 1
+		service.Samples += row.samples
+		service.ServiceSamples += own[row.hostName]
+		shared[row.hostName] = true
+	}
+
+	result := common.Colocation{
+		ServiceId:   serviceId,
+		Hosts:       len(own),
+		SharedHosts: len(shared),
+		Services:    make([]common.ColocatedService, 0, len(byService)),
+	}
+	for _, service := range byService {
+		if service.SharedHosts < minSharedHosts {
+			continue
+		}
+		if total := service.Samples + service.ServiceSamples; total > 0 {
+			service.CPUShare = float64(service.Samples) / float64(total)
+		}
+		result.Services = append(result.Services, *service)
+	}
+	sort.Slice(result.Services, func(i, j int) bool {
+		if result.Services[i].CPUShare != result.Services[j].CPUShare {
+			return result.Services[i].CPUShare > result.Services[j].CPUShare
+		}
+		return result.Services[i].ServiceId < result.Services[j].ServiceId
+	})
+	if len(result.Services) > limit {
+		result.Services = result.Services[:limit]
+	}
+	return result
+}
+
+// FetchColocation infers which services share the hosts of a service over [start, end) and how much CPU they
+// consume on them, from their root samples. Only the services of the same ClickHouse cluster are found.
+func (c *ClickHouseClient) FetchColocation(ctx context.Context,
+	params common.ColocationParams) (common.Colocation, error) {
+	table := config.StacksTable(canaryRollup(params.StartDateTime, params.EndDateTime))
+	query := fmt.Sprintf(`
+		SELECT ServiceId, HostName, sum(NumSamples)
+		FROM %[1]s
+		WHERE Timestamp >= '%[2]s' AND Timestamp < '%[3]s' AND CallStackParent = 0 AND HostName IN (
+			SELECT DISTINCT HostName
+			FROM %[1]s
+			WHERE ServiceId = %[4]d AND Timestamp >= '%[2]s' AND Timestamp < '%[3]s' AND CallStackParent = 0
+		)
+		GROUP BY ServiceId, HostName`, table, common.FormatTime(params.StartDateTime),
+		common.FormatTime(params.EndDateTime), params.ServiceId)
+	rows, err := c.client.QueryContext(ctx, query)
+	if err != nil {
+		return common.Colocation{}, err
+	}
+	defer rows.Close()
+
+	samples := make([]hostSamples, 0)
+	for rows.Next() {
+		var row hostSamples
+		var serviceId uint32
+		if err = rows.Scan(&serviceId, &row.hostName, &row.samples); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		row.serviceId = int(serviceId)
+		samples = append(samples, row)
+	}
+	if err = rows.Err(); err != nil {
+		return common.Colocation{}, err
+	}
+	return colocation(params.ServiceId, samples, params.MinSharedHosts, params.Limit), nil
+}
@@ -47,3 +47,14 @@ type SrvResp struct {
 func joinIntSlice(data []int, separator string) string {
 	return strings.Trim(strings.Join(strings.Fields(fmt.Sprint(data)), separator), "[]")
 }
+
+// sqlStringList renders values as a comma separated list of quoted ClickHouse string literals
+func sqlStringList(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, value := range values {
+		value = strings.ReplaceAll(value, "\\", "\\\\")
+		value = strings.ReplaceAll(value, "'", "\\'")
+		quoted = append(quoted, "'"+value+"'")
+	}
+	return strings.Join(quoted, ",")
+}
@@ -17,7 +17,20 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"restflamedb/common"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGetTruncatedNameAndSuffix(t *testing.T) {
@@ -59,3 +72,882 @@ func TestGetTruncatedNameAndSuffix(t *testing.T) {
 		}
 	}
 }
+
+func TestExportCursor(t *testing.T) {
+	cursor := ExportCursor{
+		Timestamp:     1700000000,
+		HostName:      "host-'1'",
+		ContainerName: "container",
+		CallStackHash: 18446744073709551615,
+		Endpoint:      "/api/users",
+	}
+	decoded, err := DecodeExportCursor(cursor.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != cursor {
+		t.Errorf("%+v != %+v", decoded, cursor)
+	}
+	if _, err = DecodeExportCursor("not a cursor"); err == nil {
+		t.Error("expected an error for an invalid cursor")
+	}
+}
+
+func TestExportPagination(t *testing.T) {
+	timestamp := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	sample := func(hash uint64, name string) common.ExportSample {
+		return common.ExportSample{Timestamp: timestamp, HostName: "host", CallStackHash: hash,
+			CallStackName: name, NumSamples: 1, InsertionTimestamp: timestamp}
+	}
+	// sorted by the export sort key, the first key has two records differing by their name only and the next
+	// one three identical records
+	records := []common.ExportSample{sample(1, "a"), sample(1, "b"), sample(2, "c"), sample(2, "c"),
+		sample(2, "c"), sample(3, "d")}
+	// page reads the records following the cursor the way exportQuery does: the records of its key or above,
+	// but the Ties first ones of its key
+	page := func(cursor *ExportCursor, limit int) []common.ExportSample {
+		start, skip := 0, 0
+		if cursor != nil {
+			key := *cursor
+			key.Ties = 0
+			for start < len(records) && NewExportCursor(records[start]) != key {
+				start++
+			}
+			skip = cursor.Ties
+		}
+		start += skip
+		end := start + limit
+		if end > len(records) {
+			end = len(records)
+		}
+		return records[start:end]
+	}
+
+	exported := make([]common.ExportSample, 0)
+	var cursor *ExportCursor
+	for pages := 0; pages < 10; pages++ {
+		rows := page(cursor, 2)
+		for _, row := range rows {
+			exported = append(exported, row)
+			cursor = cursor.advance(row)
+		}
+		if len(rows) < 2 {
+			break
+		}
+		// the cursor goes through the encoding of the next page header
+		decoded, err := DecodeExportCursor(cursor.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor = &decoded
+	}
+	if !reflect.DeepEqual(exported, records) {
+		t.Errorf("records skipped or exported twice across the pages: %+v", exported)
+	}
+
+	query := exportQuery(common.ExportSamplesParams{ServiceId: 1, Limit: 2}, cursor)
+	if !strings.Contains(query, exportSortKey+" >= (toDateTime(1709294400, 'UTC'), 'host'") ||
+		!strings.Contains(query, "LIMIT 1, 2") {
+		t.Errorf("unexpected export query %s", query)
+	}
+	if query = exportQuery(common.ExportSamplesParams{ServiceId: 1, Limit: 2}, nil); !strings.Contains(query,
+		"LIMIT 0, 2") || strings.Contains(query, ">=") {
+		t.Errorf("unexpected first page query %s", query)
+	}
+}
+
+func TestMergeFrameVersions(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2023, 3, d, 0, 0, 0, 0, time.UTC)
+	}
+	versions := []common.FrameVersionHistory{
+		{AppVersion: "v2", FirstSeen: day(10), LastSeen: day(12), DaysSeen: 3, Samples: 30},
+		{AppVersion: "v1", FirstSeen: day(3), LastSeen: day(10), DaysSeen: 2, Samples: 5},
+	}
+	days := map[time.Time]bool{day(3): true, day(10): true, day(11): true, day(12): true}
+
+	history := mergeFrameVersions("compress", versions, days)
+	if history.FirstAppVersion != "v1" || !history.FirstSeen.Equal(day(3)) || !history.LastSeen.Equal(day(12)) {
+		t.Errorf("unexpected first/last seen: %+v", history)
+	}
+	if history.DaysSeen != 4 || history.Samples != 35 {
+		t.Errorf("unexpected days seen/samples: %+v", history)
+	}
+	if history.Versions[0].AppVersion != "v1" || history.Versions[1].AppVersion != "v2" {
+		t.Errorf("versions are not sorted by first seen: %+v", history.Versions)
+	}
+}
+
+func TestTopMoversRollup(t *testing.T) {
+	end := time.Date(2023, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		duration time.Duration
+		output   string
+	}{
+		{duration: time.Hour, output: ""},
+		{duration: 24 * time.Hour, output: "1hour_all"},
+		{duration: 7 * 24 * time.Hour, output: "1hour_all"},
+		{duration: 30 * 24 * time.Hour, output: "1day"},
+	}
+	for _, test := range tests {
+		if rollup := topMoversRollup(end.Add(-test.duration), end); rollup != test.output {
+			t.Errorf("topMoversRollup(%v) = %q, want %q", test.duration, rollup, test.output)
+		}
+	}
+	if start := PreviousPeriodStart(end.Add(-time.Hour), end); !start.Equal(end.Add(-2 * time.Hour)) {
+		t.Errorf("PreviousPeriodStart() = %v", start)
+	}
+}
+
+func TestRecommend(t *testing.T) {
+	frames := []frameSamples{
+		{name: "main", samples: 1000},
+		{name: "encoding/json.Marshal", samples: 300},
+		{name: "encoding/json.(*encodeState).marshal", samples: 280},
+		{name: "runtime.mallocgc", samples: 120},
+		{name: "runtime.gcBgMarkWorker", samples: 150},
+		{name: "regexp.(*Regexp).doExecute", samples: 10},
+		{name: "dumps (/usr/lib/python3.11/json/__init__.py)", samples: 40},
+	}
+	result := recommend(frames, 1000, 0.05)
+	if len(result) != 2 {
+		t.Fatalf("unexpected recommendations %+v", result)
+	}
+	serialization := result[0]
+	if serialization.Category != "serialization" || serialization.Samples != 300 || serialization.Share != 0.3 ||
+		!reflect.DeepEqual(serialization.Functions, []string{"encoding/json.Marshal",
+			"encoding/json.(*encodeState).marshal", "dumps (/usr/lib/python3.11/json/__init__.py)"}) {
+		t.Errorf("unexpected serialization recommendation %+v", serialization)
+	}
+	gc := result[1]
+	if gc.Category != "garbage_collection" || gc.Samples != 150 ||
+		!reflect.DeepEqual(gc.Functions, []string{"runtime.gcBgMarkWorker", "runtime.mallocgc"}) {
+		t.Errorf("unexpected garbage collection recommendation %+v", gc)
+	}
+	if result = recommend(frames, 1000, 0.5); len(result) != 0 {
+		t.Errorf("recommendations under the minimum share %+v", result)
+	}
+	if result = recommend(frames, 0, 0); len(result) != 0 {
+		t.Errorf("recommendations without samples %+v", result)
+	}
+	query := recommendationsQuery(common.RecommendationsParams{
+		TimeParams: common.TimeParams{
+			StartDateTime: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			EndDateTime:   time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC),
+		},
+		ServiceId: 7,
+	})
+	if !strings.Contains(query, "FROM flamedb.samples_1hour_all WHERE ServiceId = 7 AND "+
+		"Timestamp >= '2024-03-01T00:00:00' AND Timestamp < '2024-03-02T00:00:00' AND CallStackParent = 0") ||
+		!strings.Contains(query, "LIMIT 1000") {
+		t.Errorf("unexpected query %s", query)
+	}
+}
+
+func TestStartOfInterval(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip("time zone database unavailable")
+	}
+	tests := []struct {
+		interval string
+		location *time.Location
+		output   string
+	}{
+		{interval: "24 hour", location: time.UTC, output: "toStartOfInterval(Timestamp, INTERVAL '24 hour')"},
+		{interval: "24 hour", location: kolkata, output: "toStartOfDay(Timestamp, 'Asia/Kolkata')"},
+		{interval: "15 minute", location: kolkata,
+			output: "toStartOfInterval(Timestamp, INTERVAL '15 minute', 'Asia/Kolkata')"},
+	}
+	for _, test := range tests {
+		if output := startOfInterval(test.interval, test.location); output != test.output {
+			t.Errorf("startOfInterval(%q, %v) = %q, want %q", test.interval, test.location, output, test.output)
+		}
+	}
+}
+
+func TestGetTimeRangesTimezone(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip("time zone database unavailable")
+	}
+	end := time.Now().UTC().Add(-time.Hour)
+	start := end.Add(-48 * time.Hour)
+	if ranges := GetTimeRanges(start, end, "day", time.UTC); len(ranges["1day"]) != 1 || len(ranges["1hour"]) != 0 {
+		t.Errorf("UTC days are not read from the daily rollup: %+v", ranges)
+	}
+	if ranges := GetTimeRanges(start, end, "day", kolkata); len(ranges["1hour"]) != 1 || len(ranges["1day"]) != 0 {
+		t.Errorf("local days are not read from the hourly rollup: %+v", ranges)
+	}
+
+	// past the hourly retention, the range is aligned on local days
+	start = time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	ranges := GetTimeRanges(start, start.Add(24*time.Hour), "day", kolkata)
+	if len(ranges["1day_historical"]) != 1 {
+		t.Fatalf("unexpected time ranges %+v", ranges)
+	}
+	historical := ranges["1day_historical"][0]
+	if historical.Start != "2020-03-09T18:30:00" || !strings.HasPrefix(historical.End, "2020-03-11T18:29:59") {
+		t.Errorf("unexpected local day range %+v", historical)
+	}
+}
+
+func TestDetectMetricAnomalies(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	values := []float64{10, 11, 10, 9, 10, 95, 97, 10, 11, 10, 9, 10}
+	times := make([]time.Time, len(values))
+	for idx := range values {
+		times[idx] = start.Add(time.Duration(idx) * time.Hour)
+	}
+	anomalies := detectMetricAnomalies("cpu", times, values, time.Hour, 2)
+	if len(anomalies) != 1 {
+		t.Fatalf("expected a single window, got %+v", anomalies)
+	}
+	anomaly := anomalies[0]
+	if !anomaly.Start.Equal(times[5]) || !anomaly.End.Equal(times[7]) || anomaly.Value != 97 || anomaly.ZScore < 2 {
+		t.Errorf("unexpected anomaly %+v", anomaly)
+	}
+
+	// a gap in the buckets splits the windows
+	gapped := append([]time.Time{}, times...)
+	for idx := 6; idx < len(gapped); idx++ {
+		gapped[idx] = gapped[idx].Add(time.Hour)
+	}
+	if anomalies = detectMetricAnomalies("cpu", gapped, values, time.Hour, 2); len(anomalies) != 2 {
+		t.Errorf("expected two windows, got %+v", anomalies)
+	}
+
+	flat := []float64{5, 5, 5, 5, 5, 5, 5}
+	if anomalies = detectMetricAnomalies("memory", times[:len(flat)], flat, time.Hour, 2); len(anomalies) != 0 {
+		t.Errorf("unexpected anomalies of a flat series %+v", anomalies)
+	}
+	if anomalies = detectMetricAnomalies("cpu", times[:3], values[4:7], time.Hour, 1); len(anomalies) != 0 {
+		t.Errorf("unexpected anomalies of a short series %+v", anomalies)
+	}
+}
+
+func TestHostsInPercentileBand(t *testing.T) {
+	hosts := make([]common.FilterData, 0)
+	for idx := 1; idx <= 20; idx++ {
+		hosts = append(hosts, common.FilterData{Name: fmt.Sprintf("host-%02d", idx), Samples: idx * 10})
+	}
+	tests := []struct {
+		from, to int
+		expected string
+	}{
+		{95, 100, "host-20"},
+		{90, 100, "host-20,host-19"},
+		{0, 10, "host-02,host-01"},
+		{50, 60, "host-12,host-11"},
+		{99, 100, "host-20"},
+	}
+	for _, test := range tests {
+		band := strings.Join(hostsInPercentileBand(hosts, test.from, test.to), ",")
+		if band != test.expected {
+			t.Errorf("hostsInPercentileBand(%d, %d) = %s, want %s", test.from, test.to, band, test.expected)
+		}
+	}
+	if band := hostsInPercentileBand(nil, 95, 100); len(band) != 0 {
+		t.Errorf("unexpected band %v", band)
+	}
+	if condition := hostsCondition(nil); condition != " AND 0" {
+		t.Errorf("unexpected condition %s", condition)
+	}
+}
+
+func TestCanaryCondition(t *testing.T) {
+	hosts := common.CanaryComparisonParams{HostName: []string{"canary-1", "it's"}}
+	if condition := canaryCondition(hosts); condition != `HostName IN ('canary-1','it\'s')` {
+		t.Errorf("unexpected hosts condition %s", condition)
+	}
+	tag := common.CanaryComparisonParams{HostTag: "canary"}
+	if condition := canaryCondition(tag); condition != "position(HostName, 'canary') > 0" {
+		t.Errorf("unexpected tag condition %s", condition)
+	}
+	end := time.Date(2023, 3, 10, 12, 0, 0, 0, time.UTC)
+	if rollup := canaryRollup(end.Add(-24*time.Hour), end); rollup != "1hour" {
+		t.Errorf("canaryRollup(24h) = %q, want 1hour", rollup)
+	}
+}
+
+func TestUnpinnedWindows(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2023, 3, 10, hour, 0, 0, 0, time.UTC)
+	}
+	pins := []common.Pin{
+		{StartDateTime: at(6), EndDateTime: at(8)},
+		{StartDateTime: at(2), EndDateTime: at(4)},
+		{StartDateTime: at(12), EndDateTime: at(14)},
+	}
+	windows := unpinnedWindows(at(3), at(10), pins)
+	expected := []pinWindow{{start: at(4), end: at(6)}, {start: at(8), end: at(10)}}
+	if fmt.Sprint(windows) != fmt.Sprint(expected) {
+		t.Errorf("unexpected windows %v, want %v", windows, expected)
+	}
+	if windows = unpinnedWindows(at(6), at(7), pins); len(windows) != 0 {
+		t.Errorf("pinned window is not covered: %v", windows)
+	}
+	if windows = unpinnedWindows(at(0), at(1), nil); len(windows) != 1 || !windows[0].end.Equal(at(1)) {
+		t.Errorf("unexpected windows without pins %v", windows)
+	}
+}
+
+func TestPinWindowQueries(t *testing.T) {
+	window := pinWindow{
+		start: time.Date(2023, 3, 10, 4, 0, 0, 0, time.UTC),
+		end:   time.Date(2023, 3, 10, 6, 0, 0, 0, time.UTC),
+	}
+	queries := newPinWindowQueries(7, window)
+	if !strings.HasPrefix(queries.leftovers, "SELECT count() FROM flamedb.samples_pinned") ||
+		!strings.HasPrefix(queries.clear, "ALTER TABLE flamedb.samples_pinned DELETE") ||
+		!strings.HasPrefix(queries.copy, "INSERT INTO flamedb.samples_pinned") {
+		t.Fatalf("unexpected queries %+v", queries)
+	}
+	condition := "ServiceId = 7 AND Timestamp >= '2023-03-10T04:00:00' AND Timestamp < '2023-03-10T06:00:00'"
+	for _, query := range []string{queries.leftovers, queries.clear, queries.copy} {
+		if !strings.Contains(query, condition) {
+			t.Errorf("query %q does not match the window", query)
+		}
+	}
+}
+
+// fakePinsDB serves the queries of PinTimeWindow, it records the pins and the copied windows
+type fakePinsDB struct {
+	mutex  sync.Mutex
+	pins   []common.Pin
+	copies []pinWindow
+}
+
+var copiedWindowRegexp = regexp.MustCompile(`Timestamp >= '([^']+)' AND Timestamp < '([^']+)'`)
+
+func (db *fakePinsDB) Connect(context.Context) (driver.Conn, error) { return fakePinsConn{db}, nil }
+func (db *fakePinsDB) Driver() driver.Driver                       { return nil }
+
+type fakePinsConn struct{ db *fakePinsDB }
+
+func (c fakePinsConn) Prepare(query string) (driver.Stmt, error) { return fakePinsStmt{c.db, query}, nil }
+func (c fakePinsConn) Close() error                              { return nil }
+func (c fakePinsConn) Begin() (driver.Tx, error)                 { return fakePinsTx{}, nil }
+
+type fakePinsTx struct{}
+
+func (fakePinsTx) Commit() error   { return nil }
+func (fakePinsTx) Rollback() error { return nil }
+
+type fakePinsStmt struct {
+	db    *fakePinsDB
+	query string
+}
+
+func (s fakePinsStmt) Close() error  { return nil }
+func (s fakePinsStmt) NumInput() int { return -1 }
+
+func (s fakePinsStmt) Exec(args []driver.Value) (driver.Result, error) {
+	query := strings.TrimSpace(s.query)
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO flamedb.samples_pinned"):
+		bounds := copiedWindowRegexp.FindStringSubmatch(query)
+		start, _ := time.Parse(common.TimeFormat, bounds[1])
+		end, _ := time.Parse(common.TimeFormat, bounds[2])
+		// leaves time to the other pins to fetch the pins meanwhile
+		time.Sleep(10 * time.Millisecond)
+		s.db.mutex.Lock()
+		s.db.copies = append(s.db.copies, pinWindow{start: start, end: end})
+		s.db.mutex.Unlock()
+	case strings.HasPrefix(query, "INSERT INTO"):
+		s.db.mutex.Lock()
+		s.db.pins = append(s.db.pins, common.Pin{ServiceId: int(args[0].(int64)), StartDateTime: args[1].(time.Time),
+			EndDateTime: args[2].(time.Time)})
+		s.db.mutex.Unlock()
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakePinsStmt) Query([]driver.Value) (driver.Rows, error) {
+	if strings.Contains(s.query, "count()") {
+		return &fakePinsRows{columns: []string{"count()"}, values: [][]driver.Value{{int64(0)}}}, nil
+	}
+	s.db.mutex.Lock()
+	defer s.db.mutex.Unlock()
+	rows := &fakePinsRows{columns: []string{"ServiceId", "StartTime", "EndTime", "Reason", "CreatedBy", "CreatedAt"}}
+	for _, pin := range s.db.pins {
+		rows.values = append(rows.values, []driver.Value{int64(pin.ServiceId), pin.StartDateTime, pin.EndDateTime,
+			"", "", time.Time{}})
+	}
+	return rows, nil
+}
+
+type fakePinsRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakePinsRows) Columns() []string { return r.columns }
+func (r *fakePinsRows) Close() error      { return nil }
+
+func (r *fakePinsRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestConcurrentPins(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2023, 3, 10, hour, 0, 0, 0, time.UTC)
+	}
+	db := &fakePinsDB{}
+	client := &ClickHouseClient{client: sql.OpenDB(db)}
+	defer client.client.Close()
+
+	var wg sync.WaitGroup
+	for _, hours := range [][2]int{{0, 2}, {1, 3}, {2, 4}, {0, 4}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pin := common.Pin{ServiceId: 7, StartDateTime: at(hours[0]), EndDateTime: at(hours[1])}
+			if err := client.PinTimeWindow(context.Background(), pin); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(db.pins) != 4 {
+		t.Errorf("%d pins recorded", len(db.pins))
+	}
+	sort.Slice(db.copies, func(i, j int) bool {
+		return db.copies[i].start.Before(db.copies[j].start)
+	})
+	current := at(0)
+	for _, window := range db.copies {
+		if !window.start.Equal(current) {
+			t.Fatalf("overlapping or missing copies %v", db.copies)
+		}
+		current = window.end
+	}
+	if !current.Equal(at(4)) {
+		t.Errorf("copies %v do not cover the pins", db.copies)
+	}
+}
+
+func TestQualityScore(t *testing.T) {
+	start := time.Date(2023, 3, 10, 10, 30, 0, 0, time.UTC)
+	end := start.Add(90 * time.Minute)
+	first, second := start.Truncate(time.Hour), start.Truncate(time.Hour).Add(time.Hour)
+	if minutes := bucketMinutes(first, time.Hour, start, end); minutes != 30 {
+		t.Errorf("unexpected minutes of the first bucket %v", minutes)
+	}
+	buckets := map[time.Time]*qualityInputs{
+		// 2 hosts profiled 30 minutes out of 30 at half the target density, no symbol quality
+		first: {samples: 18000, hostMinutes: 60, expectedHostMinutes: 60},
+		// 2 hosts profiled 30 minutes out of 60 at the target density
+		second: {samples: 18000, hostMinutes: 30, expectedHostMinutes: 120, frames: 100, unresolvedFrames: 10,
+			symbolSamples: 1000, truncatedSamples: 100},
+	}
+	score := qualityScore(7, buckets, 600)
+	if len(score.Series) != 2 || !score.Series[0].Time.Equal(first) {
+		t.Fatalf("unexpected series %+v", score.Series)
+	}
+	if point := score.Series[0]; point.Score != 75 || point.GapRatio != 0 || point.SampleDensity != 300 {
+		t.Errorf("unexpected first point %+v", point)
+	}
+	if point := score.Series[1]; point.GapRatio != 0.75 || point.UnknownFrameRatio != 0.1 ||
+		point.TruncationRate != 0.1 || point.Score != 100*(1+0.25+0.9+0.9)/4 {
+		t.Errorf("unexpected second point %+v", point)
+	}
+	if score.SampleDensity != 400 || score.GapRatio != 0.5 || score.ServiceId != 7 {
+		t.Errorf("unexpected total %+v", score.QualityComponents)
+	}
+}
+
+func TestDimensionCardinalities(t *testing.T) {
+	result := newDimensionCardinalities([]uint64{2_000_000, 120, 3, 10}, 10000)
+	if len(result) != len(cardinalityDimensions) {
+		t.Fatalf("unexpected cardinalities %+v", result)
+	}
+	if result[0].Dimension != "HostName" || result[0].Enumerable {
+		t.Errorf("hostnames should not be enumerable: %+v", result[0])
+	}
+	if !result[1].Enumerable || result[1].Distinct != 120 {
+		t.Errorf("containers should be enumerable: %+v", result[1])
+	}
+	if unlimited := newDimensionCardinalities([]uint64{2_000_000, 0, 0, 0}, 0); !unlimited[0].Enumerable {
+		t.Errorf("every dimension should be enumerable without a limit: %+v", unlimited[0])
+	}
+}
+
+func TestWildcardConditions(t *testing.T) {
+	_, conditions := BuildConditions(common.AllFiltersParams{
+		HostName:     []string{"web-*"},
+		InstanceType: []string{"m5.large", "c5.*"},
+		K8SObject:    []string{"api-?_v*"},
+	}, "")
+	expected := " AND (startsWith(HostName, 'web-'))" +
+		" AND (InstanceType IN ('m5.large') OR startsWith(InstanceType, 'c5.'))" +
+		` AND (ContainerEnvName LIKE 'api-_\\_v%')`
+	if conditions != expected {
+		t.Errorf("unexpected conditions %s", conditions)
+	}
+	tablePrefix, conditions := BuildConditions(common.AllFiltersParams{ContainerName: []string{"db"}}, "")
+	if tablePrefix != "" || conditions != fmt.Sprintf(" AND (ContainerNameHash IN (%d))", common.GetHash32AsInt("db")) {
+		t.Errorf("unexpected exact conditions %q %s", tablePrefix, conditions)
+	}
+}
+
+func TestExclusionConditions(t *testing.T) {
+	tablePrefix, conditions := BuildConditions(common.AllFiltersParams{
+		ContainerName:        []string{"app"},
+		ExcludeContainerName: []string{"istio-*"},
+		ExcludeHostName:      []string{"noisy-1"},
+	}, "")
+	expected := fmt.Sprintf(" AND (ContainerNameHash IN (%d)) AND NOT (startsWith(ContainerName, 'istio-'))"+
+		" AND NOT (HostNameHash IN (%d))", common.GetHash32AsInt("app"), common.GetHash32AsInt("noisy-1"))
+	if tablePrefix != "" || conditions != expected {
+		t.Errorf("unexpected conditions %q %s", tablePrefix, conditions)
+	}
+	metrics := common.MetricsSummaryParams{ExcludeInstanceType: []string{"t3.micro"}}
+	if _, conditions = BuildConditions(metrics.MetricsFilters(), ""); conditions != " AND NOT (InstanceType IN ('t3.micro'))" {
+		t.Errorf("unexpected metrics conditions %s", conditions)
+	}
+}
+
+func TestFilterQueryConditions(t *testing.T) {
+	tablePrefix, conditions := BuildConditions(common.AllFiltersParams{
+		InstanceType: []string{"m5.large", "c5.xlarge"},
+		JobName:      []string{"ingest", "compact"},
+	}, "AND HostName IN ('web-1', 'web-2')")
+	expected := "AND HostName IN ('web-1', 'web-2') AND (InstanceType IN ('m5.large','c5.xlarge'))" +
+		" AND (JobName IN ('ingest','compact'))"
+	if tablePrefix != "" || conditions != expected {
+		t.Errorf("unexpected conditions %q %s", tablePrefix, conditions)
+	}
+	if tablePrefix, conditions = BuildConditions(common.AllFiltersParams{}, "AND JobName = 'ingest'"); tablePrefix != "" ||
+		conditions != "AND JobName = 'ingest'" {
+		t.Errorf("unexpected filter query conditions %q %s", tablePrefix, conditions)
+	}
+}
+
+func TestComparison(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cmp := Comparison{
+		Table:      "flamedb.samples",
+		ServiceId:  7,
+		A:          ComparisonWindow{Start: start.Add(-time.Hour), End: start, Condition: "NOT (HostName = 'canary')"},
+		B:          ComparisonWindow{Start: start, End: start.Add(time.Hour)},
+		Conditions: "AND JobName = 'ingest'",
+	}
+	windowA := "(Timestamp >= '2024-03-01T11:00:00' AND Timestamp < '2024-03-01T12:00:00' AND (NOT (HostName = 'canary')))"
+	windowB := "(Timestamp >= '2024-03-01T12:00:00' AND Timestamp < '2024-03-01T13:00:00')"
+	if where := cmp.where(); where != fmt.Sprintf("ServiceId = 7 AND (%s OR %s) AND JobName = 'ingest'", windowA,
+		windowB) {
+		t.Errorf("unexpected WHERE clause %s", where)
+	}
+
+	ctes := cmp.WindowCTEs(func(where string) string { return "SELECT 1 WHERE " + where })
+	expected := fmt.Sprintf("WindowA AS (SELECT 1 WHERE ServiceId = 7 AND %s AND JobName = 'ingest'),\n\t\t"+
+		"WindowB AS (SELECT 1 WHERE ServiceId = 7 AND %s AND JobName = 'ingest')", windowA, windowB)
+	if ctes != expected {
+		t.Errorf("unexpected window CTEs %s", ctes)
+	}
+
+	query := cmp.frameSharesQuery(FrameShareOptions{MinSamples: 10, Direction: "up", Limit: 5})
+	for _, part := range []string{
+		fmt.Sprintf("sumIf(NumSamples, %s) AS SamplesA", windowA),
+		fmt.Sprintf("sumIf(NumSamples, %s) AS SamplesB", windowB),
+		"ShareB - ShareA AS ShareDelta",
+		"SamplesA + SamplesB >= 10 AND ShareDelta > 0",
+		"LIMIT 5",
+	} {
+		if !strings.Contains(query, part) {
+			t.Errorf("frame shares query lacks %q: %s", part, query)
+		}
+	}
+
+	cmp.ServiceIds = []int{7, 8}
+	if where := cmp.where(); !strings.HasPrefix(where, "ServiceId IN (7,8) AND") {
+		t.Errorf("unexpected WHERE clause of several services %s", where)
+	}
+	query = cmp.serviceAggregatesQuery("sum", "NumSamples")
+	if !strings.Contains(query, fmt.Sprintf("SELECT ServiceId, sumIf(NumSamples, %s), sumIf(NumSamples, %s)", windowA,
+		windowB)) || !strings.Contains(query, "GROUP BY ServiceId") {
+		t.Errorf("unexpected service aggregates query %s", query)
+	}
+
+	cmp.Closed = true
+	if condition := cmp.B.condition(cmp.Closed); condition !=
+		"(Timestamp BETWEEN '2024-03-01T12:00:00' AND '2024-03-01T13:00:00')" {
+		t.Errorf("unexpected closed window condition %s", condition)
+	}
+}
+
+func TestSidecarConditions(t *testing.T) {
+	tablePrefix, conditions := BuildConditions(common.AllFiltersParams{Sidecars: "exclude"}, "")
+	if tablePrefix != "" || conditions != " AND ContainerName NOT IN (SELECT ContainerName FROM flamedb.sidecar_containers)" {
+		t.Errorf("unexpected conditions %q %s", tablePrefix, conditions)
+	}
+	if tablePrefix, conditions = BuildConditions(common.AllFiltersParams{Sidecars: "include"}, ""); tablePrefix != "_all" ||
+		conditions != "" {
+		t.Errorf("sidecars filtered by default: %q %s", tablePrefix, conditions)
+	}
+}
+
+func TestColocation(t *testing.T) {
+	rows := []hostSamples{
+		{serviceId: 1, hostName: "a", samples: 100},
+		{serviceId: 1, hostName: "b", samples: 300},
+		{serviceId: 1, hostName: "c", samples: 50},
+		{serviceId: 2, hostName: "a", samples: 100},
+		{serviceId: 2, hostName: "b", samples: 100},
+		{serviceId: 3, hostName: "c", samples: 150},
+		// not a host of service 1
+		{serviceId: 3, hostName: "d", samples: 1000},
+	}
+	result := colocation(1, rows, 1, 10)
+	if result.Hosts != 3 || result.SharedHosts != 3 || len(result.Services) != 2 {
+		t.Fatalf("unexpected colocation %+v", result)
+	}
+	if service := result.Services[0]; service.ServiceId != 3 || service.Samples != 150 || service.ServiceSamples != 50 ||
+		service.CPUShare != 0.75 {
+		t.Errorf("unexpected first service %+v", service)
+	}
+	if service := result.Services[1]; service.ServiceId != 2 || service.SharedHosts != 2 || service.CPUShare != 1.0/3 {
+		t.Errorf("unexpected second service %+v", service)
+	}
+	if result = colocation(1, rows, 2, 10); len(result.Services) != 1 || result.Services[0].ServiceId != 2 {
+		t.Errorf("unexpected colocation with 2 shared hosts %+v", result.Services)
+	}
+}
+
+func TestNoisyNeighbors(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	times := make([]time.Time, 6)
+	for idx := range times {
+		times[idx] = start.Add(time.Duration(idx) * time.Minute)
+	}
+	target := []float64{10, 10, 80, 10, 10, 80}
+	noisy := neighborKey{serviceId: 2, containerName: "batch"}
+	quiet := neighborKey{serviceId: 3, containerName: "web"}
+	neighbors := map[neighborKey]map[time.Time]uint64{
+		noisy: {times[2]: 500, times[5]: 500, times[0]: 100},
+		quiet: {times[0]: 100, times[1]: 100, times[2]: 100, times[3]: 100, times[4]: 100, times[5]: 100},
+		// below min samples
+		{serviceId: 4, containerName: "cron"}: {times[2]: 10},
+	}
+	result, spikes := noisyNeighbors(times, target, neighbors, 50, 10)
+	if spikes != 2 || len(result) != 2 {
+		t.Fatalf("unexpected neighbors %+v, %d spike(s)", result, spikes)
+	}
+	if result[0].ServiceId != 2 || result[0].Samples != 1100 || result[0].Correlation < 0.9 || result[0].SpikeLift != 20 {
+		t.Errorf("unexpected noisy neighbor %+v", result[0])
+	}
+	if result[1].ServiceId != 3 || result[1].Correlation != 0 || result[1].SpikeLift != 1 {
+		t.Errorf("unexpected quiet neighbor %+v", result[1])
+	}
+}
+
+func TestServiceIndicators(t *testing.T) {
+	indicators := serviceIndicators(1, serviceTotals{avgCpu: 42.5, weekAgoAvgCpu: 40, samples: 1500,
+		weekAgoSamples: 1000})
+	if indicators.ServiceId != 1 || indicators.AvgCpuDelta != 2.5 || indicators.SamplesDelta == nil ||
+		*indicators.SamplesDelta != 0.5 {
+		t.Errorf("unexpected indicators %+v", indicators)
+	}
+	if indicators = serviceIndicators(2, serviceTotals{avgCpu: 10, samples: 100}); indicators.SamplesDelta != nil ||
+		indicators.AvgCpuDelta != 10 {
+		t.Errorf("unexpected indicators of a new service %+v", indicators)
+	}
+
+	start := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	samplesQuery, cpuQuery := serviceIndicatorsQueries([]int{1, 2}, start, start.Add(time.Hour))
+	current := "(Timestamp >= '2024-01-10T00:00:00' AND Timestamp < '2024-01-10T01:00:00')"
+	weekAgo := "(Timestamp >= '2024-01-03T00:00:00' AND Timestamp < '2024-01-03T01:00:00')"
+	for _, query := range []string{samplesQuery, cpuQuery} {
+		if !strings.Contains(query, "ServiceId IN (1,2) AND ("+weekAgo+" OR "+current+")") {
+			t.Errorf("the query must only read both windows: %v", query)
+		}
+	}
+	query := topFunctionsQuery([]int{1, 2}, start, start.Add(time.Hour))
+	if !strings.Contains(query, "ServiceId IN (1,2) AND "+current) || strings.Contains(query, weekAgo) {
+		t.Errorf("the top functions query must only read the current window: %v", query)
+	}
+}
+
+func TestBuildLiteFlameGraph(t *testing.T) {
+	frames := []ResponseFrame{
+		{Name: "A", Value: 10, Children: []ResponseFrame{
+			{Name: "B", Value: 6, Children: []ResponseFrame{{Name: "D", Value: 6}}},
+			{Name: "C", Value: 4},
+		}},
+		{Name: "E", Value: 1},
+	}
+	lite, truncated := BuildLiteFlameGraph(frames, 0, 0)
+	if truncated || len(lite) != 2 || len(lite[0].Children) != 2 || lite[0].Children[1].Name != "C" {
+		t.Fatalf("unexpected full lite graph %+v (truncated %v)", lite, truncated)
+	}
+	lite, truncated = BuildLiteFlameGraph(frames, 2, 0)
+	if !truncated || len(lite[0].Children[0].Children) != 0 {
+		t.Errorf("frames deeper than 2 levels kept %+v", lite)
+	}
+	// A, B and D are the heaviest frames, 24, 23 and 23 bytes
+	lite, truncated = BuildLiteFlameGraph(frames, 0, 70)
+	expected := "[{A 10 [{B 6 [{D 6 []}]}]}]"
+	if !truncated || fmt.Sprint(lite) != expected {
+		t.Errorf("unexpected lite graph %v, expected %v", lite, expected)
+	}
+}
+
+func TestDemangleFrame(t *testing.T) {
+	tests := map[string]string{
+		"_ZNSt6vectorIiSaIiEE9push_backERKi":     "std::vector<int, std::allocator<int> >::push_back(int const&)",
+		"_ZN4core3fmt5write17h0123456789abcdefE": "core::fmt::write",
+		"_RNvCs15kBYyAo9fc_7mycrate4main":        "mycrate::main",
+		"_ZN3foo3barEv.cold":                     "foo::bar() [clone .cold]",
+		"_Z3fooi_[k]":                            "foo(int)_[k]",
+		"_ZN3foo3barEv@plt":                      "foo::bar()@plt",
+		"type:.eq.main.point":                    "eq(main.point)",
+		"go:itab.*os.File,io.Writer":             "itab(*os.File, io.Writer)",
+		"example.com/my%2elib.Run":               "example.com/my.lib.Run",
+		"_Zbogus":                                "_Zbogus",
+		"my_Z3fooi":                              "my_Z3fooi",
+		"java/lang/Thread.run_[j]":               "java/lang/Thread.run_[j]",
+	}
+	for name, expected := range tests {
+		if demangled := common.DemangleFrame(name); demangled != expected {
+			t.Errorf("DemangleFrame(%q) = %q, expected %q", name, demangled, expected)
+		}
+	}
+}
+
+// TestDemangleInSync checks the demangling of the REST service is the one of the indexer, which demangles the
+// frames at ingestion with -demangle-frames
+func TestDemangleInSync(t *testing.T) {
+	body := func(path string) string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := string(data)
+		idx := strings.Index(source, "\npackage ")
+		if idx < 0 {
+			t.Fatalf("no package clause in %s", path)
+		}
+		return source[idx+strings.Index(source[idx+1:], "\n")+1:]
+	}
+	if body("../common/demangle.go") != body("../../gprofiler_indexer/demangle.go") {
+		t.Error("common/demangle.go differs from demangle.go of the indexer, apply the changes to both")
+	}
+}
+
+func TestCpuAttribution(t *testing.T) {
+	first := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+	totals := map[time.Time]int{first: 100, second: 300}
+	result := attributeCpu(totals, []cpuAttributionPoint{
+		{time: first, name: "/search", samples: 50},
+		{time: first, name: "/home", samples: 25},
+		{time: second, name: "/search", samples: 150},
+		{time: second, name: "/home", samples: 125},
+		{time: second.Add(time.Hour), name: "/login", samples: 10},
+	})
+	if len(result) != 3 || result[0].Name != "/search" || result[1].Name != "/home" || result[2].Name != "/login" {
+		t.Fatalf("unexpected attributions %+v", result)
+	}
+	if result[0].Samples != 200 || result[0].CpuShare != 0.5 {
+		t.Errorf("unexpected /search attribution %+v", result[0])
+	}
+	if len(result[1].Series) != 2 || result[1].Series[0].CpuShare != 0.25 ||
+		result[1].Series[1].CpuShare != 125.0/300 {
+		t.Errorf("unexpected /home series %+v", result[1].Series)
+	}
+	// an interval without a total has no share rather than a division by zero
+	if result[2].Series[0].CpuShare != 0 {
+		t.Errorf("unexpected /login series %+v", result[2].Series)
+	}
+
+	if _, err := (&ClickHouseClient{}).FetchCpuAttribution(nil, common.CpuAttributionParams{GroupBy: "HostName"},
+		""); err == nil {
+		t.Error("group by HostName accepted")
+	}
+}
+
+func TestTailQueries(t *testing.T) {
+	first := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	second := first.Add(5 * time.Second)
+	params := common.TailParams{ServiceId: 7, Top: 3}
+	totals, topFrames := tailQueries(params, first, second)
+	// the window of a poll starts where the previous one ended, a row inserted on the boundary second is
+	// read by the later window only
+	window := "InsertionTimestamp >= '2024-03-01T12:00:00' AND InsertionTimestamp < '2024-03-01T12:00:05'"
+	for _, query := range []string{totals, topFrames} {
+		if !strings.Contains(query, window) || !strings.Contains(query, "ServiceId = 7") {
+			t.Errorf("unexpected tail window in %s", query)
+		}
+		if !strings.Contains(query, "INTERVAL 3600 SECOND") {
+			t.Errorf("lateness bound missing from %s", query)
+		}
+	}
+	next, _ := tailQueries(params, second, second.Add(5*time.Second))
+	if !strings.Contains(next, "InsertionTimestamp >= '2024-03-01T12:00:05'") {
+		t.Errorf("next window does not start at the end of the previous one: %s", next)
+	}
+	if !strings.Contains(topFrames, "LIMIT 3 BY Minute") {
+		t.Errorf("unexpected top frames query %s", topFrames)
+	}
+}
+
+func TestRuntimeShares(t *testing.T) {
+	// one hot Java frame outweighs three cold kernel frames
+	shares := runtimeShares([]onboardingFrame{
+		{name: "com/app/Main.run_[j]", samples: 900},
+		{name: "do_syscall_64_[k]", samples: 40},
+		{name: "tcp_sendmsg_[k]", samples: 30},
+		{name: "ksys_write_[k]", samples: 30},
+	})
+	if len(shares) != 2 || shares[Java] != 0.9 || shares[Kernel] != 0.1 {
+		t.Errorf("unexpected runtime shares %v", shares)
+	}
+	if shares = runtimeShares([]onboardingFrame{{name: "main_[k]", samples: 0}}); len(shares) != 0 {
+		t.Errorf("unexpected shares of frames without samples %v", shares)
+	}
+}
+
+func TestParentIntegrity(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	params := common.IntegrityAuditParams{TimeParams: common.TimeParams{StartDateTime: start,
+		EndDateTime: start.Add(time.Hour)}, ServiceId: 5, Limit: 2}
+	query := integrityQuery(params)
+	// a parent must be a record of the same service and timestamp, and is looked up on every shard
+	if !strings.Contains(query, "(ServiceId, Timestamp, CallStackParent) GLOBAL NOT IN (\n\t\t\tSELECT ServiceId, "+
+		"Timestamp, CallStackHash") || !strings.Contains(query, "CallStackParent != 0 AND") {
+		t.Errorf("unexpected orphan condition in %s", query)
+	}
+	if strings.Count(query, "AND ServiceId = 5") != 2 {
+		t.Errorf("parents not looked up within the audited service: %s", query)
+	}
+
+	report := common.IntegrityReport{}
+	summarizeIntegrity(&report, []common.IntegritySlice{
+		{ServiceId: 1, Time: start, Frames: 100, OrphanFrames: 0},
+		{ServiceId: 1, Time: start.Add(time.Minute), Frames: 100, OrphanFrames: 10},
+		{ServiceId: 2, Time: start, Frames: 50, OrphanFrames: 25},
+		{ServiceId: 3, Time: start, Frames: 10, OrphanFrames: 1},
+	}, params.Limit)
+	if report.Frames != 260 || report.OrphanFrames != 36 || report.OrphanRate != 36.0/260 {
+		t.Errorf("unexpected totals %+v", report)
+	}
+	if len(report.Services) != 3 || report.Services[0].ServiceId != 2 || report.Services[0].OrphanRate != 0.5 ||
+		report.Services[1].ServiceId != 3 || report.Services[2].ServiceId != 1 {
+		t.Fatalf("services not sorted by orphan rate %+v", report.Services)
+	}
+	if service := report.Services[2]; service.Slices != 2 || service.SlicesWithOrphans != 1 ||
+		service.OrphanFrames != 10 {
+		t.Errorf("unexpected service summary %+v", service)
+	}
+	if len(report.WorstSlices) != 2 || report.WorstSlices[0].ServiceId != 2 ||
+		report.WorstSlices[0].OrphanRate != 0.5 || report.WorstSlices[1].OrphanFrames != 10 {
+		t.Errorf("unexpected worst slices %+v", report.WorstSlices)
+	}
+}
@@ -0,0 +1,175 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"restflamedb/common"
+	"time"
+)
+
+// ComparisonWindow is a side of a comparison, the rows of [Start, End) matching Condition if set. Two windows
+// of the same time range are told apart by their conditions (e.g. the canary hosts and the rest of the fleet).
+type ComparisonWindow struct {
+	Start     time.Time
+	End       time.Time
+	Condition string
+}
+
+func (window ComparisonWindow) condition(closed bool) string {
+	start := common.FormatTime(window.Start)
+	end := common.FormatTime(window.End)
+	condition := fmt.Sprintf("Timestamp >= '%s' AND Timestamp < '%s'", start, end)
+	if closed {
+		condition = fmt.Sprintf("Timestamp BETWEEN '%s' AND '%s'", start, end)
+	}
+	if window.Condition != "" {
+		condition += fmt.Sprintf(" AND (%s)", window.Condition)
+	}
+	return "(" + condition + ")"
+}
+
+// Comparison runs the same query on two windows of the rows of a service (or services) in a table, A being the
+// baseline and B the window compared to it. Every comparison endpoint builds its queries from it, so that the
+// windows are selected and their weights normalized the same way.
+type Comparison struct {
+	Table     string
+	ServiceId int
+	// ServiceIds compares several services at once instead of ServiceId, e.g. for the service matrix
+	ServiceIds []int
+	A          ComparisonWindow
+	B          ComparisonWindow
+	// Conditions are ANDed to the conditions of both windows, e.g. the filters of BuildConditions
+	Conditions string
+	// Closed windows include their end, as the metrics endpoints do
+	Closed bool
+}
+
+func (cmp Comparison) services() string {
+	if len(cmp.ServiceIds) > 0 {
+		return fmt.Sprintf("ServiceId IN (%s)", joinIntSlice(cmp.ServiceIds, ","))
+	}
+	return fmt.Sprintf("ServiceId = %d", cmp.ServiceId)
+}
+
+// where is the WHERE clause of the rows of either window
+func (cmp Comparison) where() string {
+	return fmt.Sprintf("%s AND (%s OR %s) %s", cmp.services(), cmp.A.condition(cmp.Closed),
+		cmp.B.condition(cmp.Closed), cmp.Conditions)
+}
+
+// windowWhere is the WHERE clause of the rows of a window
+func (cmp Comparison) windowWhere(window ComparisonWindow) string {
+	return fmt.Sprintf("%s AND %s %s", cmp.services(), window.condition(cmp.Closed), cmp.Conditions)
+}
+
+// serviceAggregatesQuery returns the aggregate function of column over window A and over window B, per service
+// (e.g. sum and NumSamples), the rows of both windows being read in a single scan
+func (cmp Comparison) serviceAggregatesQuery(function string, column string) string {
+	return fmt.Sprintf(`
+		SELECT ServiceId, %[2]sIf(%[3]s, %[4]s), %[2]sIf(%[3]s, %[5]s)
+		FROM %[1]s
+		WHERE %[6]s
+		GROUP BY ServiceId`, cmp.Table, function, column, cmp.A.condition(cmp.Closed), cmp.B.condition(cmp.Closed),
+		cmp.where())
+}
+
+// WindowCTEs returns the WindowA and WindowB common table expressions, the same query built by query from the
+// WHERE clause of each window
+func (cmp Comparison) WindowCTEs(query func(where string) string) string {
+	return fmt.Sprintf("WindowA AS (%s),\n\t\tWindowB AS (%s)", query(cmp.windowWhere(cmp.A)),
+		query(cmp.windowWhere(cmp.B)))
+}
+
+// FrameShareOptions select the frames of a frame share comparison
+type FrameShareOptions struct {
+	// MinSamples is the minimum number of samples of a frame in both windows
+	MinSamples int
+	// Direction keeps the frames whose share grows in B (up), shrinks (down) or both (all)
+	Direction string
+	Limit     int
+}
+
+// FrameShare is the share of the samples of a window a function is in, in both windows
+type FrameShare struct {
+	Name       string
+	SamplesA   uint64
+	SamplesB   uint64
+	ShareA     float64
+	ShareB     float64
+	ShareDelta float64
+}
+
+// frameSharesQuery returns the functions whose share changes the most from A to B, ordered by the absolute
+// change. The weights are normalized by the samples of the root frames of each window, so that windows of
+// different durations or host counts compare. Both windows are read in a single scan.
+func (cmp Comparison) frameSharesQuery(options FrameShareOptions) string {
+	var directionCondition string
+	switch options.Direction {
+	case "up":
+		directionCondition = "AND ShareDelta > 0"
+	case "down":
+		directionCondition = "AND ShareDelta < 0"
+	}
+	windowA := cmp.A.condition(cmp.Closed)
+	windowB := cmp.B.condition(cmp.Closed)
+	return fmt.Sprintf(`
+		WITH (
+			SELECT tuple(sumIf(NumSamples, %[2]s), sumIf(NumSamples, %[3]s))
+			FROM %[1]s
+			WHERE %[4]s AND CallStackParent = 0
+		) AS Totals
+		SELECT CallStackName, SamplesA, SamplesB,
+			SamplesA / Totals.1 AS ShareA, SamplesB / Totals.2 AS ShareB,
+			ShareB - ShareA AS ShareDelta
+		FROM (
+			SELECT CallStackName,
+				sumIf(NumSamples, %[2]s) AS SamplesA,
+				sumIf(NumSamples, %[3]s) AS SamplesB
+			FROM %[1]s
+			WHERE %[4]s
+			GROUP BY CallStackName
+		)
+		WHERE Totals.1 > 0 AND Totals.2 > 0 AND SamplesA + SamplesB >= %[5]d %[6]s
+		ORDER BY abs(ShareDelta) DESC
+		LIMIT %[7]d`, cmp.Table, windowA, windowB, cmp.where(), options.MinSamples, directionCondition,
+		options.Limit)
+}
+
+// FetchFrameShares returns the functions whose share changes the most from window A to window B
+func (c *ClickHouseClient) FetchFrameShares(ctx context.Context, cmp Comparison,
+	options FrameShareOptions) ([]FrameShare, error) {
+	rows, err := c.client.QueryContext(ctx, cmp.frameSharesQuery(options))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]FrameShare, 0, options.Limit)
+	for rows.Next() {
+		var share FrameShare
+		if err = rows.Scan(&share.Name, &share.SamplesA, &share.SamplesB, &share.ShareA, &share.ShareB,
+			&share.ShareDelta); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		result = append(result, share)
+	}
+	return result, rows.Err()
+}
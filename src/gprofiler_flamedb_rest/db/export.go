@@ -0,0 +1,160 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"restflamedb/common"
+	"restflamedb/config"
+)
+
+// ExportCursor is the sort key of the last exported record, the next page starts right after it. Every
+// column is part of the key, Ties counts the identical records exported up to the cursor.
+type ExportCursor struct {
+	Timestamp          int64  `json:"t"`
+	HostName           string `json:"h"`
+	ContainerName      string `json:"c"`
+	CallStackHash      uint64 `json:"s"`
+	AppVersion         string `json:"v"`
+	Endpoint           string `json:"e"`
+	JobName            string `json:"j"`
+	CallStackParent    uint64 `json:"p"`
+	CallStackName      string `json:"n"`
+	NumSamples         uint64 `json:"ns"`
+	InstanceType       string `json:"it"`
+	ContainerEnvName   string `json:"ce"`
+	InsertionTimestamp int64  `json:"i"`
+	Ties               int    `json:"d,omitempty"`
+}
+
+func NewExportCursor(sample common.ExportSample) ExportCursor {
+	return ExportCursor{
+		Timestamp:          sample.Timestamp.Unix(),
+		HostName:           sample.HostName,
+		ContainerName:      sample.ContainerName,
+		CallStackHash:      sample.CallStackHash,
+		AppVersion:         sample.AppVersion,
+		Endpoint:           sample.Endpoint,
+		JobName:            sample.JobName,
+		CallStackParent:    sample.CallStackParent,
+		CallStackName:      sample.CallStackName,
+		NumSamples:         sample.NumSamples,
+		InstanceType:       sample.InstanceType,
+		ContainerEnvName:   sample.ContainerEnvName,
+		InsertionTimestamp: sample.InsertionTimestamp.Unix(),
+	}
+}
+
+// advance returns the cursor of the sample exported after the one of the cursor
+func (cursor *ExportCursor) advance(sample common.ExportSample) *ExportCursor {
+	next := NewExportCursor(sample)
+	ties := 0
+	if cursor != nil {
+		key := *cursor
+		key.Ties = 0
+		if key == next {
+			ties = cursor.Ties
+		}
+	}
+	next.Ties = ties + 1
+	return &next
+}
+
+func (cursor ExportCursor) Encode() string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func DecodeExportCursor(encoded string) (ExportCursor, error) {
+	var cursor ExportCursor
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil {
+		err = json.Unmarshal(raw, &cursor)
+	}
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor: %w", err)
+	}
+	return cursor, nil
+}
+
+const exportSortKey = "(Timestamp, HostName, ContainerName, CallStackHash, AppVersion, Endpoint, JobName, " +
+	"CallStackParent, CallStackName, NumSamples, InstanceType, ContainerEnvName, InsertionTimestamp)"
+
+// exportQuery reads the page of records following the cursor: the records of its key not exported yet, then the
+// next keys
+func exportQuery(params common.ExportSamplesParams, cursor *ExportCursor) string {
+	condition := ""
+	offset := 0
+	if cursor != nil {
+		condition = fmt.Sprintf("AND %s >= (toDateTime(%d, 'UTC'), %s, %s, %d, %s, %s, %s, %d, %s, %d, %s, %s, "+
+			"toDateTime(%d, 'UTC'))", exportSortKey, cursor.Timestamp, sqlStringList([]string{cursor.HostName}),
+			sqlStringList([]string{cursor.ContainerName}), cursor.CallStackHash,
+			sqlStringList([]string{cursor.AppVersion}), sqlStringList([]string{cursor.Endpoint}),
+			sqlStringList([]string{cursor.JobName}), cursor.CallStackParent,
+			sqlStringList([]string{cursor.CallStackName}), cursor.NumSamples,
+			sqlStringList([]string{cursor.InstanceType}), sqlStringList([]string{cursor.ContainerEnvName}),
+			cursor.InsertionTimestamp)
+		offset = cursor.Ties
+	}
+	return fmt.Sprintf(`
+		SELECT Timestamp, ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName, NumSamples,
+		CallStackHash, CallStackName, CallStackParent, InsertionTimestamp, AppVersion, Endpoint, JobName
+		FROM %s
+		WHERE ServiceId = %d AND (Timestamp BETWEEN '%s' AND '%s') %s
+		ORDER BY %s
+		LIMIT %d, %d`, config.StacksTable(""), params.ServiceId, common.FormatTime(params.StartDateTime),
+		common.FormatTime(params.EndDateTime), condition, exportSortKey, offset, params.Limit)
+}
+
+// ExportSamples reads a page of raw stacks records of a service, ordered by their sort key, and passes
+// them one by one to write. The cursor of the next page is returned when the page is full.
+func (c *ClickHouseClient) ExportSamples(ctx context.Context, params common.ExportSamplesParams,
+	cursor *ExportCursor, write func(common.ExportSample) error) (*ExportCursor, error) {
+	rows, err := c.client.QueryContext(ctx, exportQuery(params, cursor))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exported := 0
+	for rows.Next() {
+		sample := common.ExportSample{}
+		err = rows.Scan(&sample.Timestamp, &sample.ServiceId, &sample.InstanceType, &sample.ContainerEnvName,
+			&sample.HostName, &sample.ContainerName, &sample.NumSamples, &sample.CallStackHash,
+			&sample.CallStackName, &sample.CallStackParent, &sample.InsertionTimestamp, &sample.AppVersion,
+			&sample.Endpoint, &sample.JobName)
+		if err != nil {
+			return nil, err
+		}
+		sample.Timestamp = sample.Timestamp.UTC()
+		if err = write(sample); err != nil {
+			return nil, err
+		}
+		cursor = cursor.advance(sample)
+		exported += 1
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if exported < params.Limit {
+		return nil, nil
+	}
+	return cursor, nil
+}
@@ -0,0 +1,121 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"restflamedb/common"
+	"restflamedb/config"
+	"sort"
+	"time"
+)
+
+// frameNameCondition returns the condition matching the frame names of a history query
+func frameNameCondition(functionName string, match string) string {
+	quoted := sqlStringList([]string{functionName})
+	switch match {
+	case "prefix":
+		return fmt.Sprintf("startsWith(CallStackName, %s)", quoted)
+	case "contains":
+		return fmt.Sprintf("position(CallStackName, %s) > 0", quoted)
+	}
+	return fmt.Sprintf("CallStackName = %s", quoted)
+}
+
+// mergeFrameVersions builds the history of a frame from the history of each app version it appeared in
+func mergeFrameVersions(name string, versions []common.FrameVersionHistory, days map[time.Time]bool) common.FrameHistory {
+	sort.Slice(versions, func(i, j int) bool {
+		if !versions[i].FirstSeen.Equal(versions[j].FirstSeen) {
+			return versions[i].FirstSeen.Before(versions[j].FirstSeen)
+		}
+		return versions[i].AppVersion < versions[j].AppVersion
+	})
+	history := common.FrameHistory{Name: name, DaysSeen: len(days), Versions: versions}
+	for idx, version := range versions {
+		if idx == 0 {
+			history.FirstSeen = version.FirstSeen
+			history.FirstAppVersion = version.AppVersion
+		}
+		if version.LastSeen.After(history.LastSeen) {
+			history.LastSeen = version.LastSeen
+		}
+		history.Samples += version.Samples
+	}
+	return history
+}
+
+// FetchFrameHistory returns when the matching frames first and last appeared in the profiles of a service,
+// overall and per app version. It reads the daily rollup, so times are precise to the day.
+func (c *ClickHouseClient) FetchFrameHistory(ctx context.Context,
+	params common.FrameHistoryParams) ([]common.FrameHistory, error) {
+	table := config.StacksTable("1day")
+	startTime := common.FormatTime(params.StartDateTime)
+	endTime := common.FormatTime(params.EndDateTime)
+	nameCondition := frameNameCondition(params.FunctionName, params.Match)
+
+	query := fmt.Sprintf(`
+		SELECT CallStackName, AppVersion, min(Timestamp), max(Timestamp), groupUniqArray(Timestamp), sum(NumSamples)
+		FROM %s
+		WHERE ServiceId = %d AND (Timestamp BETWEEN '%s' AND '%s') AND CallStackName IN (
+			SELECT CallStackName FROM %s
+			WHERE ServiceId = %d AND (Timestamp BETWEEN '%s' AND '%s') AND %s
+			GROUP BY CallStackName
+			ORDER BY sum(NumSamples) DESC
+			LIMIT %d)
+		GROUP BY CallStackName, AppVersion`, table, params.ServiceId, startTime, endTime,
+		table, params.ServiceId, startTime, endTime, nameCondition, params.Limit)
+	rows, err := c.client.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[string][]common.FrameVersionHistory)
+	days := make(map[string]map[time.Time]bool)
+	for rows.Next() {
+		var name string
+		var version common.FrameVersionHistory
+		var versionDays []time.Time
+		if err = rows.Scan(&name, &version.AppVersion, &version.FirstSeen, &version.LastSeen, &versionDays,
+			&version.Samples); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		version.DaysSeen = len(versionDays)
+		versions[name] = append(versions[name], version)
+		if _, exists := days[name]; !exists {
+			days[name] = make(map[time.Time]bool)
+		}
+		for _, day := range versionDays {
+			days[name][day] = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]common.FrameHistory, 0, len(versions))
+	for name, frameVersions := range versions {
+		result = append(result, mergeFrameVersions(name, frameVersions, days[name]))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Samples > result[j].Samples
+	})
+	return result, nil
+}
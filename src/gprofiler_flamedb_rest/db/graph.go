@@ -21,6 +21,7 @@ import (
 	"github.com/montanaflynn/stats"
 	"log"
 	"restflamedb/common"
+	"restflamedb/config"
 	"sort"
 	"strconv"
 	"sync"
@@ -31,7 +32,11 @@ type Graph struct {
 	percentiles    map[string]string
 	rootFrames     []uint64
 	EnrichWithLang bool
-	mu             sync.Mutex
+	// Demangle replaces the mangled frame names by their readable names
+	Demangle bool
+	// Hosts are the hosts of the percentile band the graph is restricted to, if any
+	Hosts []string
+	mu    sync.Mutex
 }
 
 type ResponseFrame struct {
@@ -54,6 +59,7 @@ func NewGraph(params common.FlameGraphParams) Graph {
 	return Graph{
 		Frames:         make(map[uint64]Frame),
 		EnrichWithLang: enrichLang,
+		Demangle:       config.DemangleFrames && !params.RawNames,
 	}
 }
 
@@ -108,6 +114,14 @@ func (graph *Graph) prepareFrames(limitFrames int) (int, error) {
 		glitchesFound += graph.processFrame(frame)
 	}
 
+	// before the language identification, the demangled C++ and Rust names are told apart by their namespaces
+	if graph.Demangle {
+		for hash, frame := range graph.Frames {
+			frame.Name = common.DemangleFrame(frame.Name)
+			graph.Frames[hash] = frame
+		}
+	}
+
 	if graph.EnrichWithLang {
 		for hash := range graph.Frames {
 			lang := ""
@@ -0,0 +1,86 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"restflamedb/common"
+	"restflamedb/config"
+	"sort"
+	"strings"
+)
+
+// fetchHostSamples returns the sample count of every host of the service in the time range, the samples of
+// a host are the samples of its root frames
+func (c *ClickHouseClient) fetchHostSamples(ctx context.Context, params common.FlameGraphParams,
+	conditions string) ([]common.FilterData, error) {
+	query := fmt.Sprintf(`
+		SELECT HostName, sum(NumSamples) FROM %s
+		WHERE ServiceId == '%d' AND (Timestamp BETWEEN '%s' AND '%s') AND CallStackParent = 0 %s
+		GROUP BY HostName`, config.StacksTable("1min"), params.ServiceId, common.FormatTime(params.StartDateTime),
+		common.FormatTime(params.EndDateTime), conditions)
+	rows, err := c.client.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hosts := make([]common.FilterData, 0)
+	for rows.Next() {
+		var host common.FilterData
+		var samples uint64
+		if err := rows.Scan(&host.Name, &samples); err != nil {
+			return nil, err
+		}
+		host.Samples = int(samples)
+		hosts = append(hosts, host)
+	}
+	return hosts, rows.Err()
+}
+
+// hostsInPercentileBand returns the hosts whose percentile rank by sample count is in (from, to], the rank
+// of the busiest host is 100. The hosts are returned busiest first.
+func hostsInPercentileBand(hosts []common.FilterData, from int, to int) []string {
+	sorted := append([]common.FilterData(nil), hosts...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Samples != sorted[j].Samples {
+			return sorted[i].Samples < sorted[j].Samples
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	band := make([]string, 0)
+	for idx := len(sorted) - 1; idx >= 0; idx-- {
+		// rank*len compared to the bounds*len to stay in integers
+		rank := (idx + 1) * 100
+		if rank > from*len(sorted) && rank <= to*len(sorted) {
+			band = append(band, sorted[idx].Name)
+		}
+	}
+	return band
+}
+
+// hostsCondition restricts a query to the hosts, to no row when there is no host
+func hostsCondition(hosts []string) string {
+	if len(hosts) == 0 {
+		return " AND 0"
+	}
+	hashes := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		hashes = append(hashes, fmt.Sprint(common.GetHash32AsInt(host)))
+	}
+	return fmt.Sprintf(" AND (HostNameHash IN (%s))", strings.Join(hashes, ","))
+}
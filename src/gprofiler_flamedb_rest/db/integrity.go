@@ -0,0 +1,161 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"restflamedb/common"
+	"restflamedb/config"
+	"sort"
+	"time"
+)
+
+// AuditParentIntegrity checks that the parent hash of every raw stacks record refers to a record of the same
+// (service, timestamp) slice. Orphan records are dropped from flame graphs along with their whole subtree.
+func (c *ClickHouseClient) AuditParentIntegrity(ctx context.Context,
+	params common.IntegrityAuditParams) (common.IntegrityReport, error) {
+	report := common.IntegrityReport{
+		StartTime:   params.StartDateTime,
+		EndTime:     params.EndDateTime,
+		Services:    make([]common.IntegrityService, 0),
+		WorstSlices: make([]common.IntegritySlice, 0),
+	}
+	rows, err := c.client.QueryContext(ctx, integrityQuery(params))
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	slices := make([]common.IntegritySlice, 0)
+	for rows.Next() {
+		slice := common.IntegritySlice{}
+		if err = rows.Scan(&slice.ServiceId, &slice.Time, &slice.Frames, &slice.OrphanFrames); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		slices = append(slices, slice)
+	}
+	if err = rows.Err(); err != nil {
+		return report, err
+	}
+	summarizeIntegrity(&report, slices, params.Limit)
+	return report, nil
+}
+
+// integrityQuery counts the records and the orphan records, whose parent hash is not the hash of a record of
+// the same service and timestamp, of every (service, timestamp) slice
+func integrityQuery(params common.IntegrityAuditParams) string {
+	table := config.StacksTable("")
+	condition := fmt.Sprintf("(Timestamp BETWEEN '%s' AND '%s')", common.FormatTime(params.StartDateTime),
+		common.FormatTime(params.EndDateTime))
+	if params.ServiceId > 0 {
+		condition += fmt.Sprintf(" AND ServiceId = %d", params.ServiceId)
+	}
+
+	// GLOBAL: samples are sharded by CallStackHash, a parent may live on another shard
+	return fmt.Sprintf(`
+		SELECT ServiceId, Timestamp, count(),
+		countIf(CallStackParent != 0 AND (ServiceId, Timestamp, CallStackParent) GLOBAL NOT IN (
+			SELECT ServiceId, Timestamp, CallStackHash FROM %s WHERE %s))
+		FROM %s
+		WHERE %s
+		GROUP BY ServiceId, Timestamp`, table, condition, table, condition)
+}
+
+// summarizeIntegrity adds up the slices per service, the services are sorted by orphan rate and the limit
+// slices with the most orphan records are kept
+func summarizeIntegrity(report *common.IntegrityReport, slices []common.IntegritySlice, limit int) {
+	byService := make(map[int]*common.IntegrityService)
+	withOrphans := make([]common.IntegritySlice, 0)
+	for _, slice := range slices {
+		service, exists := byService[slice.ServiceId]
+		if !exists {
+			service = &common.IntegrityService{ServiceId: slice.ServiceId}
+			byService[slice.ServiceId] = service
+		}
+		service.Slices += 1
+		service.Frames += slice.Frames
+		service.OrphanFrames += slice.OrphanFrames
+		report.Frames += slice.Frames
+		report.OrphanFrames += slice.OrphanFrames
+		if slice.OrphanFrames > 0 {
+			service.SlicesWithOrphans += 1
+			slice.OrphanRate = float64(slice.OrphanFrames) / float64(slice.Frames)
+			withOrphans = append(withOrphans, slice)
+		}
+	}
+
+	if report.Frames > 0 {
+		report.OrphanRate = float64(report.OrphanFrames) / float64(report.Frames)
+	}
+	for _, service := range byService {
+		if service.Frames > 0 {
+			service.OrphanRate = float64(service.OrphanFrames) / float64(service.Frames)
+		}
+		report.Services = append(report.Services, *service)
+	}
+	sort.Slice(report.Services, func(i, j int) bool {
+		if report.Services[i].OrphanRate != report.Services[j].OrphanRate {
+			return report.Services[i].OrphanRate > report.Services[j].OrphanRate
+		}
+		return report.Services[i].ServiceId < report.Services[j].ServiceId
+	})
+	sort.SliceStable(withOrphans, func(i, j int) bool {
+		return withOrphans[i].OrphanFrames > withOrphans[j].OrphanFrames
+	})
+	if len(withOrphans) > limit {
+		withOrphans = withOrphans[:limit]
+	}
+	report.WorstSlices = withOrphans
+}
+
+// RunIntegrityAudit periodically audits the parent pointers of the last config.IntegrityAuditLookback
+// seconds and logs the services with orphan records, until ctx is done
+func (c *ClickHouseClient) RunIntegrityAudit(ctx context.Context) {
+	interval := time.Duration(config.IntegrityAuditInterval) * time.Second
+	lookback := time.Duration(config.IntegrityAuditLookback) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			endTime := time.Now().UTC().Add(-common.BackRewindTime)
+			params := common.IntegrityAuditParams{
+				TimeParams: common.TimeParams{StartDateTime: endTime.Add(-lookback), EndDateTime: endTime},
+				Limit:      1,
+			}
+			report, err := c.AuditParentIntegrity(ctx, params)
+			if err != nil {
+				log.Printf("integrity audit failed: %v", err)
+				continue
+			}
+			log.Printf("integrity audit: %d orphan record(s) out of %d (%.4f%%)", report.OrphanFrames,
+				report.Frames, report.OrphanRate*100)
+			for _, service := range report.Services {
+				if service.OrphanFrames > 0 {
+					log.Printf("integrity audit: service %d has %d orphan record(s) in %d of %d slice(s) (%.4f%%)",
+						service.ServiceId, service.OrphanFrames, service.SlicesWithOrphans, service.Slices,
+						service.OrphanRate*100)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"container/heap"
+	"encoding/json"
+	"strconv"
+)
+
+// liteFrameOverhead is the size of the JSON of a lite frame without its name and value: {"n":,"v":,"c":[]},
+const liteFrameOverhead = 19
+
+// LiteFrame is a frame of the lite flame graphs, names and values only under short keys
+type LiteFrame struct {
+	Name     string      `json:"n"`
+	Value    int         `json:"v"`
+	Children []LiteFrame `json:"c,omitempty"`
+}
+
+type liteCandidate struct {
+	frame *ResponseFrame
+	depth int
+}
+
+// liteCandidates is a max heap of frames by value
+type liteCandidates []liteCandidate
+
+func (lc liteCandidates) Len() int           { return len(lc) }
+func (lc liteCandidates) Less(i, j int) bool { return lc[i].frame.Value > lc[j].frame.Value }
+func (lc liteCandidates) Swap(i, j int)      { lc[i], lc[j] = lc[j], lc[i] }
+func (lc *liteCandidates) Push(x any)        { *lc = append(*lc, x.(liteCandidate)) }
+func (lc *liteCandidates) Pop() any {
+	old := *lc
+	last := old[len(old)-1]
+	*lc = old[:len(old)-1]
+	return last
+}
+
+func liteFrameSize(frame *ResponseFrame) int {
+	name, _ := json.Marshal(frame.Name)
+	return liteFrameOverhead + len(name) + len(strconv.Itoa(frame.Value))
+}
+
+// BuildLiteFlameGraph keeps the frames of at most maxDepth levels whose JSON fits in about maxBytes, the
+// heaviest frames first so that a cut graph still shows where most of the samples are. A frame is only
+// kept with its parent. Zero or negative limits disable them. The second value reports that frames were left out.
+func BuildLiteFlameGraph(frames []ResponseFrame, maxDepth int, maxBytes int) ([]LiteFrame, bool) {
+	kept := make(map[*ResponseFrame]bool)
+	truncated := false
+	size := 0
+	candidates := make(liteCandidates, 0, len(frames))
+	for idx := range frames {
+		candidates = append(candidates, liteCandidate{frame: &frames[idx], depth: 1})
+	}
+	heap.Init(&candidates)
+	for candidates.Len() > 0 {
+		candidate := heap.Pop(&candidates).(liteCandidate)
+		if maxDepth > 0 && candidate.depth > maxDepth {
+			truncated = true
+			continue
+		}
+		frameSize := liteFrameSize(candidate.frame)
+		if maxBytes > 0 && size+frameSize > maxBytes {
+			// the remaining frames are lighter, but may still be smaller
+			truncated = true
+			continue
+		}
+		size += frameSize
+		kept[candidate.frame] = true
+		for idx := range candidate.frame.Children {
+			heap.Push(&candidates, liteCandidate{frame: &candidate.frame.Children[idx], depth: candidate.depth + 1})
+		}
+	}
+	return liteFrames(frames, kept), truncated
+}
+
+// liteFrames converts the kept frames, in the order of the flame graph
+func liteFrames(frames []ResponseFrame, kept map[*ResponseFrame]bool) []LiteFrame {
+	result := make([]LiteFrame, 0)
+	for idx := range frames {
+		frame := &frames[idx]
+		if !kept[frame] {
+			continue
+		}
+		result = append(result, LiteFrame{
+			Name:     frame.Name,
+			Value:    frame.Value,
+			Children: liteFrames(frame.Children, kept),
+		})
+	}
+	return result
+}
@@ -0,0 +1,126 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"restflamedb/common"
+	"restflamedb/config"
+	"sort"
+	"time"
+)
+
+// minAnomalyPoints is the number of buckets below which the deviation of a time range is meaningless
+const minAnomalyPoints = 6
+
+// detectMetricAnomalies flags the buckets of a series whose value is at least threshold standard deviations away
+// from the mean of the series, consecutive flagged buckets are merged into a single window
+func detectMetricAnomalies(metric string, times []time.Time, values []float64, interval time.Duration,
+	threshold float64) []common.MetricAnomaly {
+	anomalies := make([]common.MetricAnomaly, 0)
+	if len(values) < minAnomalyPoints || threshold <= 0 {
+		return anomalies
+	}
+	var sum, squares float64
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / float64(len(values))
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+	stddev := math.Sqrt(squares / float64(len(values)))
+	if stddev == 0 {
+		return anomalies
+	}
+
+	var current *common.MetricAnomaly
+	for idx, value := range values {
+		zScore := (value - mean) / stddev
+		if math.Abs(zScore) < threshold {
+			current = nil
+			continue
+		}
+		if current != nil && !times[idx].After(current.End) {
+			current.End = times[idx].Add(interval)
+			if math.Abs(zScore) > math.Abs(current.ZScore) {
+				current.Value, current.ZScore = value, zScore
+			}
+			continue
+		}
+		anomalies = append(anomalies, common.MetricAnomaly{
+			Metric:   metric,
+			Start:    times[idx],
+			End:      times[idx].Add(interval),
+			Value:    value,
+			Baseline: mean,
+			ZScore:   zScore,
+		})
+		current = &anomalies[len(anomalies)-1]
+	}
+	return anomalies
+}
+
+// FetchMetricAnomalies returns the windows of the time range where the average CPU or memory usage of the service
+// deviated from its average over the time range by at least config.MetricAnomalyThreshold standard deviations
+func (c *ClickHouseClient) FetchMetricAnomalies(ctx context.Context,
+	params common.QueryParams) ([]common.MetricAnomaly, error) {
+	interval := getInterval(params.StartDateTime, params.EndDateTime, params.Interval)
+	intervalDuration, err := common.ParseInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`
+		SELECT %s AS Datetime, avg(CPUAverageUsedPercent), avg(MemoryAverageUsedPercent)
+		FROM %s
+		WHERE ServiceId = %d AND (Timestamp BETWEEN toDateTime('%s', 'UTC') AND toDateTime('%s', 'UTC'))
+		GROUP BY Datetime
+		ORDER BY Datetime`, startOfInterval(interval, params.Location()), config.MetricsTable(), params.ServiceId,
+		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime))
+	rows, err := c.client.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	times := make([]time.Time, 0)
+	cpu := make([]float64, 0)
+	memory := make([]float64, 0)
+	for rows.Next() {
+		var timestamp time.Time
+		var avgCpu, avgMemory float64
+		if err = rows.Scan(&timestamp, &avgCpu, &avgMemory); err != nil {
+			return nil, err
+		}
+		times = append(times, timestamp)
+		cpu = append(cpu, avgCpu)
+		memory = append(memory, avgMemory)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	threshold := float64(config.MetricAnomalyThreshold)
+	anomalies := detectMetricAnomalies("cpu", times, cpu, intervalDuration, threshold)
+	anomalies = append(anomalies, detectMetricAnomalies("memory", times, memory, intervalDuration, threshold)...)
+	sort.SliceStable(anomalies, func(i, j int) bool {
+		return anomalies[i].Start.Before(anomalies[j].Start)
+	})
+	return anomalies, nil
+}
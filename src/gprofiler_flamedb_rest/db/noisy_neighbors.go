@@ -0,0 +1,221 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"restflamedb/common"
+	"restflamedb/config"
+	"sort"
+	"time"
+)
+
+// noisyNeighborSpikeZScore is the number of standard deviations above its mean a target bucket is a spike at
+const noisyNeighborSpikeZScore = 1
+
+type neighborKey struct {
+	serviceId     int
+	containerName string
+}
+
+// pearson returns the correlation of two series of the same length, 0 when either is constant
+func pearson(x []float64, y []float64) float64 {
+	if len(x) == 0 {
+		return 0
+	}
+	var meanX, meanY float64
+	for idx := range x {
+		meanX += x[idx]
+		meanY += y[idx]
+	}
+	meanX /= float64(len(x))
+	meanY /= float64(len(y))
+	var covariance, varianceX, varianceY float64
+	for idx := range x {
+		covariance += (x[idx] - meanX) * (y[idx] - meanY)
+		varianceX += (x[idx] - meanX) * (x[idx] - meanX)
+		varianceY += (y[idx] - meanY) * (y[idx] - meanY)
+	}
+	if varianceX == 0 || varianceY == 0 {
+		return 0
+	}
+	return covariance / math.Sqrt(varianceX*varianceY)
+}
+
+// spikeBuckets flags the buckets at least noisyNeighborSpikeZScore standard deviations above the mean
+func spikeBuckets(values []float64) []bool {
+	spikes := make([]bool, len(values))
+	if len(values) == 0 {
+		return spikes
+	}
+	var sum, squares float64
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / float64(len(values))
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+	stddev := math.Sqrt(squares / float64(len(values)))
+	for idx, value := range values {
+		spikes[idx] = stddev > 0 && (value-mean)/stddev >= noisyNeighborSpikeZScore
+	}
+	return spikes
+}
+
+// noisyNeighbors correlates the neighbor series with the target series, the buckets of the target are the time axis
+// and a neighbor missing from a bucket counts 0 samples there
+func noisyNeighbors(times []time.Time, target []float64, neighbors map[neighborKey]map[time.Time]uint64,
+	minSamples int, limit int) ([]common.NoisyNeighbor, int) {
+	spikes := spikeBuckets(target)
+	spikeCount := 0
+	for _, spike := range spikes {
+		if spike {
+			spikeCount += 1
+		}
+	}
+
+	result := make([]common.NoisyNeighbor, 0, len(neighbors))
+	for key, samplesByTime := range neighbors {
+		neighbor := common.NoisyNeighbor{ServiceId: key.serviceId, ContainerName: key.containerName}
+		series := make([]float64, len(times))
+		var spikeSum, otherSum float64
+		for idx, timestamp := range times {
+			samples := samplesByTime[timestamp]
+			neighbor.Samples += samples
+			series[idx] = float64(samples)
+			if spikes[idx] {
+				spikeSum += float64(samples)
+			} else {
+				otherSum += float64(samples)
+			}
+		}
+		if neighbor.Samples < uint64(minSamples) {
+			continue
+		}
+		neighbor.Correlation = pearson(target, series)
+		if spikeCount > 0 && spikeCount < len(times) && otherSum > 0 {
+			neighbor.SpikeLift = (spikeSum / float64(spikeCount)) / (otherSum / float64(len(times)-spikeCount))
+		}
+		result = append(result, neighbor)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Correlation != result[j].Correlation {
+			return result[i].Correlation > result[j].Correlation
+		}
+		return result[i].Samples > result[j].Samples
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, spikeCount
+}
+
+// FetchNoisyNeighbors correlates the samples of the containers sharing the hosts of a service with the host CPU of
+// the service (metrics table), or with the samples of one of its containers. The neighbors are the containers of
+// the other services, and the other containers of the service when a container is the target.
+func (c *ClickHouseClient) FetchNoisyNeighbors(ctx context.Context,
+	params common.NoisyNeighborsParams) (common.NoisyNeighbors, error) {
+	result := common.NoisyNeighbors{ServiceId: params.ServiceId, ContainerName: params.ContainerName}
+	interval := getInterval(params.StartDateTime, params.EndDateTime, params.Interval)
+	bucket := startOfInterval(interval, params.Location())
+	samplesTable := config.StacksTable("1min")
+	start, end := common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime)
+
+	targetCondition := fmt.Sprintf("ServiceId = %d", params.ServiceId)
+	neighborCondition := fmt.Sprintf("ServiceId != %d", params.ServiceId)
+	var targetQuery string
+	if params.ContainerName == "" {
+		result.Target = "cpu"
+		targetQuery = fmt.Sprintf(`
+			SELECT %s AS Datetime, avg(CPUAverageUsedPercent)
+			FROM %s
+			WHERE %s AND (Timestamp BETWEEN '%s' AND '%s')
+			GROUP BY Datetime
+			ORDER BY Datetime`, bucket, config.MetricsTable(), targetCondition, start, end)
+	} else {
+		result.Target = "samples"
+		targetCondition += fmt.Sprintf(" AND ContainerName = %s", sqlStringList([]string{params.ContainerName}))
+		neighborCondition = fmt.Sprintf("NOT (%s)", targetCondition)
+		targetQuery = fmt.Sprintf(`
+			SELECT %s AS Datetime, toFloat64(sum(NumSamples))
+			FROM %s
+			WHERE %s AND (Timestamp BETWEEN '%s' AND '%s')
+			GROUP BY Datetime
+			ORDER BY Datetime`, bucket, samplesTable, targetCondition, start, end)
+	}
+
+	rows, err := c.client.QueryContext(ctx, targetQuery)
+	if err != nil {
+		return result, err
+	}
+	times := make([]time.Time, 0)
+	target := make([]float64, 0)
+	for rows.Next() {
+		var timestamp time.Time
+		var value float64
+		if err = rows.Scan(&timestamp, &value); err != nil {
+			rows.Close()
+			return result, err
+		}
+		times = append(times, timestamp)
+		target = append(target, value)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+
+	rows, err = c.client.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %[1]s AS Datetime, ServiceId, ContainerName, sum(NumSamples)
+		FROM %[2]s
+		WHERE %[3]s AND (Timestamp BETWEEN '%[5]s' AND '%[6]s') AND HostName IN (
+			SELECT DISTINCT HostName
+			FROM %[2]s
+			WHERE %[4]s AND (Timestamp BETWEEN '%[5]s' AND '%[6]s')
+		)
+		GROUP BY Datetime, ServiceId, ContainerName`, bucket, samplesTable, neighborCondition, targetCondition,
+		start, end))
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	neighbors := make(map[neighborKey]map[time.Time]uint64)
+	for rows.Next() {
+		var timestamp time.Time
+		var serviceId uint32
+		var containerName string
+		var samples uint64
+		if err = rows.Scan(&timestamp, &serviceId, &containerName, &samples); err != nil {
+			return result, err
+		}
+		key := neighborKey{serviceId: int(serviceId), containerName: containerName}
+		if neighbors[key] == nil {
+			neighbors[key] = make(map[time.Time]uint64)
+		}
+		neighbors[key][timestamp] += samples
+	}
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+
+	result.Buckets = len(times)
+	result.Neighbors, result.SpikeBuckets = noisyNeighbors(times, target, neighbors, params.MinSamples, params.Limit)
+	return result, nil
+}
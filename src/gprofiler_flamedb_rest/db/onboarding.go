@@ -0,0 +1,226 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"restflamedb/common"
+	"restflamedb/config"
+	"strings"
+)
+
+const (
+	onboardingMaxFrames            = 5000
+	onboardingUnknownWarnThreshold = 0.2
+	onboardingUnnamedWarnThreshold = 0.5
+)
+
+// container names that are ids (docker ids, bare pod uids) rather than meaningful names
+var idLikeContainerRegexp = regexp.MustCompile(`^(?:[0-9a-f]{12,64}|[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})$`)
+
+// FetchOnboardingReport summarizes the last uploads of a service to validate a new agent integration
+func (c *ClickHouseClient) FetchOnboardingReport(ctx context.Context, serviceId int,
+	params common.OnboardingReportParams) (common.OnboardingReport, error) {
+	report := common.OnboardingReport{
+		ServiceId: serviceId,
+		Uploads:   make([]common.OnboardingUpload, 0),
+		Runtimes:  make(map[string]float64),
+		Containers: common.OnboardingContainers{
+			IdLikeNames: make([]string, 0),
+		},
+		Warnings: make([]string, 0),
+	}
+	table := config.StacksTable("")
+	timeCondition := fmt.Sprintf("ServiceId = %d AND (Timestamp BETWEEN '%s' AND '%s')", serviceId,
+		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime))
+
+	query := fmt.Sprintf(`
+		SELECT HostName, Timestamp, count(), countIf(CallStackName LIKE '%%[unknown]%%'),
+		sumIf(NumSamples, CallStackParent = 0), uniqExact(ContainerName)
+		FROM %s
+		WHERE %s
+		GROUP BY HostName, Timestamp
+		ORDER BY Timestamp DESC
+		LIMIT %d`, table, timeCondition, params.Uploads)
+	rows, err := c.client.QueryContext(ctx, query)
+	if err != nil {
+		return report, err
+	}
+	var allFrames, unknownFrames int
+	for rows.Next() {
+		upload := common.OnboardingUpload{}
+		err = rows.Scan(&upload.HostName, &upload.Time, &upload.Frames, &upload.UnknownFrames, &upload.Samples,
+			&upload.Containers)
+		if err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		if upload.Frames > 0 {
+			upload.UnknownFraction = float64(upload.UnknownFrames) / float64(upload.Frames)
+		}
+		allFrames += upload.Frames
+		unknownFrames += upload.UnknownFrames
+		report.Uploads = append(report.Uploads, upload)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return report, err
+	}
+	if len(report.Uploads) == 0 {
+		report.Warnings = append(report.Warnings, "no uploads in the requested time range")
+		return report, nil
+	}
+	report.AvgFramesPerProfile = float64(allFrames) / float64(len(report.Uploads))
+	if allFrames > 0 {
+		report.UnknownFrameFraction = float64(unknownFrames) / float64(allFrames)
+	}
+	if report.UnknownFrameFraction > onboardingUnknownWarnThreshold {
+		report.Warnings = append(report.Warnings, fmt.Sprintf(
+			"%.0f%% of the frames are [unknown], check that debug symbols are available",
+			report.UnknownFrameFraction*100))
+	}
+
+	uploadKeys := make([]string, 0, len(report.Uploads))
+	for _, upload := range report.Uploads {
+		uploadKeys = append(uploadKeys, fmt.Sprintf("(%s, '%s')", sqlStringList([]string{upload.HostName}),
+			common.FormatTime(upload.Time)))
+	}
+	uploadsCondition := fmt.Sprintf("%s AND (HostName, Timestamp) IN (%s)", timeCondition,
+		strings.Join(uploadKeys, ","))
+
+	if err = c.fetchOnboardingRuntimes(ctx, table, uploadsCondition, &report); err != nil {
+		return report, err
+	}
+	if err = c.fetchOnboardingContainers(ctx, table, uploadsCondition, &report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+func (c *ClickHouseClient) fetchOnboardingRuntimes(ctx context.Context, table string, conditions string,
+	report *common.OnboardingReport) error {
+	query := fmt.Sprintf(`
+		SELECT CallStackName, sum(NumSamples) AS Samples
+		FROM %s
+		WHERE %s AND CallStackParent != 0
+		GROUP BY CallStackName
+		ORDER BY Samples DESC
+		LIMIT %d`, table, conditions, onboardingMaxFrames)
+	rows, err := c.client.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	frames := make([]onboardingFrame, 0)
+	for rows.Next() {
+		var frame onboardingFrame
+		if err = rows.Scan(&frame.name, &frame.samples); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		frames = append(frames, frame)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	report.Runtimes = runtimeShares(frames)
+	return nil
+}
+
+type onboardingFrame struct {
+	name    string
+	samples int
+}
+
+// runtimeShares returns the fraction of the samples of the frames per runtime, a handful of hot frames
+// outweigh many cold ones
+func runtimeShares(frames []onboardingFrame) map[string]float64 {
+	shares := make(map[string]float64)
+	samples := make(map[string]int)
+	total := 0
+	for _, frame := range frames {
+		lang, _ := identFrameLangAndSpecialType(frame.name)
+		samples[lang] += frame.samples
+		total += frame.samples
+	}
+	if total == 0 {
+		return shares
+	}
+	for lang, langSamples := range samples {
+		shares[lang] = float64(langSamples) / float64(total)
+	}
+	return shares
+}
+
+func (c *ClickHouseClient) fetchOnboardingContainers(ctx context.Context, table string, conditions string,
+	report *common.OnboardingReport) error {
+	query := fmt.Sprintf(`
+		SELECT ContainerName, ContainerEnvName, sum(NumSamples)
+		FROM %s
+		WHERE %s AND CallStackParent = 0
+		GROUP BY ContainerName, ContainerEnvName`, table, conditions)
+	rows, err := c.client.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var allSamples, unnamedSamples, k8sSamples int
+	containers := make(map[string]bool)
+	for rows.Next() {
+		var containerName, k8sObject string
+		var samples int
+		if err = rows.Scan(&containerName, &k8sObject, &samples); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		allSamples += samples
+		if containerName == "" {
+			unnamedSamples += samples
+		} else {
+			containers[containerName] = true
+		}
+		if k8sObject != "" {
+			k8sSamples += samples
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	report.Containers.Total = len(containers)
+	for containerName := range containers {
+		if idLikeContainerRegexp.MatchString(containerName) {
+			report.Containers.IdLikeNames = append(report.Containers.IdLikeNames, containerName)
+		}
+	}
+	if allSamples > 0 {
+		report.Containers.UnnamedFraction = float64(unnamedSamples) / float64(allSamples)
+		report.Containers.WithK8sObjectFraction = float64(k8sSamples) / float64(allSamples)
+	}
+	if report.Containers.UnnamedFraction > onboardingUnnamedWarnThreshold {
+		report.Warnings = append(report.Warnings, "most samples have no container name")
+	}
+	if len(report.Containers.IdLikeNames) > 0 {
+		report.Warnings = append(report.Warnings,
+			"some container names are ids, check that the agent can resolve container names")
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"restflamedb/common"
+	"restflamedb/config"
+	"sort"
+	"sync"
+	"time"
+)
+
+// pinnedStacksColumns are the columns copied to the pinned stacks table, the materialized ones are computed again
+const pinnedStacksColumns = `Timestamp, ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName,
+	NumSamples, CallStackHash, CallStackName, CallStackParent, InsertionTimestamp, ErrNumSamples,
+	AppVersion, Endpoint, JobName`
+
+// pinLocks serialize the pins of each service: overlapping pins running together would both find their common
+// window unpinned and copy its stacks twice. Pins created through several REST replicas are not serialized.
+var (
+	pinLocksMutex sync.Mutex
+	pinLocks      = make(map[int]*sync.Mutex)
+)
+
+func pinLock(serviceId int) *sync.Mutex {
+	pinLocksMutex.Lock()
+	defer pinLocksMutex.Unlock()
+	lock, ok := pinLocks[serviceId]
+	if !ok {
+		lock = &sync.Mutex{}
+		pinLocks[serviceId] = lock
+	}
+	return lock
+}
+
+type pinWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// unpinnedWindows returns the parts of [start, end) not covered by the pins yet, so that overlapping pins never
+// copy the same stacks twice
+func unpinnedWindows(start time.Time, end time.Time, pins []common.Pin) []pinWindow {
+	sorted := make([]common.Pin, len(pins))
+	copy(sorted, pins)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].StartDateTime.Before(sorted[j].StartDateTime)
+	})
+	windows := make([]pinWindow, 0)
+	current := start
+	for _, pin := range sorted {
+		if !pin.EndDateTime.After(current) {
+			continue
+		}
+		if !pin.StartDateTime.Before(end) {
+			break
+		}
+		if pin.StartDateTime.After(current) {
+			windows = append(windows, pinWindow{start: current, end: pin.StartDateTime})
+		}
+		current = pin.EndDateTime
+	}
+	if current.Before(end) {
+		windows = append(windows, pinWindow{start: current, end: end})
+	}
+	return windows
+}
+
+// pinWindowQueries copy the raw stacks of an unpinned window. No pin covers the window, so the stacks found there
+// were left over by a pin that failed halfway, they are cleared first so that a retry does not copy them twice.
+type pinWindowQueries struct {
+	leftovers string
+	clear     string
+	copy      string
+}
+
+func newPinWindowQueries(serviceId int, window pinWindow) pinWindowQueries {
+	condition := fmt.Sprintf("ServiceId = %d AND Timestamp >= '%s' AND Timestamp < '%s'", serviceId,
+		common.FormatTime(window.start), common.FormatTime(window.end))
+	return pinWindowQueries{
+		leftovers: fmt.Sprintf("SELECT count() FROM %s WHERE %s", config.PinnedStacksTable(), condition),
+		clear: fmt.Sprintf("ALTER TABLE %s DELETE WHERE %s SETTINGS mutations_sync = 2", config.PinnedStacksTable(),
+			condition),
+		copy: fmt.Sprintf("INSERT INTO %[1]s (%[3]s) SELECT %[3]s FROM %[2]s WHERE %[4]s", config.PinnedStacksTable(),
+			config.StacksTable(""), pinnedStacksColumns, condition),
+	}
+}
+
+// FetchPins returns the pinned time windows of a service, of every service when serviceId is 0
+func (c *ClickHouseClient) FetchPins(ctx context.Context, serviceId int) ([]common.Pin, error) {
+	var condition string
+	if serviceId != 0 {
+		condition = fmt.Sprintf("WHERE ServiceId = %d", serviceId)
+	}
+	rows, err := c.client.QueryContext(ctx, fmt.Sprintf(`
+		SELECT ServiceId, StartTime, EndTime, Reason, CreatedBy, CreatedAt
+		FROM %s %s
+		ORDER BY ServiceId, StartTime`, config.PinsTable(), condition))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]common.Pin, 0)
+	for rows.Next() {
+		var pin common.Pin
+		var serviceId uint32
+		if err = rows.Scan(&serviceId, &pin.StartDateTime, &pin.EndDateTime, &pin.Reason, &pin.CreatedBy,
+			&pin.CreatedAt); err != nil {
+			return nil, err
+		}
+		pin.ServiceId = int(serviceId)
+		result = append(result, pin)
+	}
+	return result, rows.Err()
+}
+
+// PinTimeWindow copies the raw stacks of the pin window to the pinned stacks table, which has no TTL, and
+// records the pin. The stacks are copied before the pin is recorded and the partial copies of a failed pin are
+// cleared, so a failed pin can be retried as is. The pins of the service are fetched once its previous pins
+// are recorded, so only the windows they do not cover are copied.
+func (c *ClickHouseClient) PinTimeWindow(ctx context.Context, pin common.Pin) error {
+	lock := pinLock(pin.ServiceId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	pins, err := c.FetchPins(ctx, pin.ServiceId)
+	if err != nil {
+		return err
+	}
+	for _, window := range unpinnedWindows(pin.StartDateTime, pin.EndDateTime, pins) {
+		queries := newPinWindowQueries(pin.ServiceId, window)
+		var leftovers uint64
+		if err = c.client.QueryRowContext(ctx, queries.leftovers).Scan(&leftovers); err != nil {
+			return err
+		}
+		if leftovers > 0 {
+			if _, err = c.client.ExecContext(ctx, queries.clear); err != nil {
+				return err
+			}
+		}
+		if _, err = c.client.ExecContext(ctx, queries.copy); err != nil {
+			return err
+		}
+	}
+
+	tx, err := c.client.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf(`
+		INSERT INTO %s (ServiceId, StartTime, EndTime, Reason, CreatedBy, CreatedAt)
+		VALUES (?, ?, ?, ?, ?, ?)`, config.PinsTable()))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	if _, err = stmt.Exec(uint32(pin.ServiceId), pin.StartDateTime, pin.EndDateTime, pin.Reason, pin.CreatedBy,
+		pin.CreatedAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,132 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"restflamedb/config"
+	"time"
+)
+
+const (
+	PreflightPass = "PASS"
+	PreflightFail = "FAIL"
+	PreflightWarn = "WARN"
+	PreflightSkip = "SKIP"
+
+	preflightTimeout = 10 * time.Second
+)
+
+type PreflightResult struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+// queriedTables returns every table the REST queries read from for the given schema version suffix
+func queriedTables(suffix string) []string {
+	tables := []string{config.StacksTableWithSuffix("", suffix), config.ClickHouseMetricsTable + suffix}
+	for _, rollup := range []string{"1min", "1hour", "1hour_all", "1day", "1day_all"} {
+		tables = append(tables, config.StacksTableWithSuffix(rollup, suffix))
+	}
+	return tables
+}
+
+// RunPreflight checks ClickHouse connectivity, table existence and read permissions
+func RunPreflight(addr string) []PreflightResult {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+
+	conn, err := sql.Open("clickhouse", "tcp://"+addr)
+	if err == nil {
+		defer conn.Close()
+		err = conn.PingContext(ctx)
+	}
+	if err != nil {
+		return []PreflightResult{
+			{Name: "clickhouse connectivity", Status: PreflightFail,
+				Detail: fmt.Sprintf("%v (check -clickhouse-addr %s and credentials)", err, addr)},
+			{Name: "clickhouse tables", Status: PreflightSkip, Detail: "no connection"},
+		}
+	}
+
+	results := []PreflightResult{{Name: "clickhouse connectivity", Status: PreflightPass}}
+	for _, table := range queriedTables(config.TableSuffix()) {
+		name := fmt.Sprintf("clickhouse table %s", table)
+		var exists uint8
+		if err = conn.QueryRowContext(ctx, fmt.Sprintf("EXISTS TABLE %s", table)).Scan(&exists); err != nil {
+			results = append(results, PreflightResult{Name: name, Status: PreflightFail, Detail: err.Error()})
+			continue
+		}
+		if exists == 0 {
+			results = append(results, PreflightResult{Name: name, Status: PreflightFail,
+				Detail: "table does not exist (load the schema from the indexer sql directory)"})
+			continue
+		}
+		results = append(results, PreflightResult{Name: name, Status: PreflightPass})
+
+		name = fmt.Sprintf("clickhouse select permission on %s", table)
+		var granted uint8
+		if err = conn.QueryRowContext(ctx, fmt.Sprintf("CHECK GRANT SELECT ON %s", table)).Scan(&granted); err != nil {
+			// CHECK GRANT is not supported by older ClickHouse versions
+			results = append(results, PreflightResult{Name: name, Status: PreflightWarn,
+				Detail: fmt.Sprintf("unable to verify: %v", err)})
+			continue
+		}
+		if granted == 0 {
+			results = append(results, PreflightResult{Name: name, Status: PreflightFail,
+				Detail: fmt.Sprintf("SELECT is not granted (GRANT SELECT ON %s)", table)})
+			continue
+		}
+		results = append(results, PreflightResult{Name: name, Status: PreflightPass})
+	}
+	return results
+}
+
+// PrintPreflightReport writes a pass/fail line per check and returns false if any check failed
+func PrintPreflightReport(w io.Writer, results []PreflightResult) bool {
+	passed := true
+	for _, result := range results {
+		if result.Status == PreflightFail {
+			passed = false
+		}
+		if result.Detail != "" {
+			fmt.Fprintf(w, "[%s] %s: %s\n", result.Status, result.Name, result.Detail)
+		} else {
+			fmt.Fprintf(w, "[%s] %s\n", result.Status, result.Name)
+		}
+	}
+	return passed
+}
+
+// MissingTables returns the queried tables that do not exist for the given schema version suffix
+func (c *ClickHouseClient) MissingTables(ctx context.Context, suffix string) ([]string, error) {
+	missing := make([]string, 0)
+	for _, table := range queriedTables(suffix) {
+		var exists uint8
+		if err := c.client.QueryRowContext(ctx, fmt.Sprintf("EXISTS TABLE %s", table)).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if exists == 0 {
+			missing = append(missing, table)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,201 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"restflamedb/common"
+	"restflamedb/config"
+	"sort"
+	"time"
+)
+
+// qualityInputs are the counters of a time bucket the quality indicators are computed from
+type qualityInputs struct {
+	samples             uint64
+	hostMinutes         uint64
+	expectedHostMinutes float64
+	frames              uint64
+	unresolvedFrames    uint64
+	symbolSamples       uint64
+	truncatedSamples    uint64
+}
+
+func (qi *qualityInputs) add(other qualityInputs) {
+	qi.samples += other.samples
+	qi.hostMinutes += other.hostMinutes
+	qi.expectedHostMinutes += other.expectedHostMinutes
+	qi.frames += other.frames
+	qi.unresolvedFrames += other.unresolvedFrames
+	qi.symbolSamples += other.symbolSamples
+	qi.truncatedSamples += other.truncatedSamples
+}
+
+// components computes the indicators and their score, the density is scored against targetDensity samples
+// per host minute. Unknown frames include the address only frames.
+func (qi qualityInputs) components(targetDensity float64) common.QualityComponents {
+	var result common.QualityComponents
+	scores := make([]float64, 0, 4)
+	if qi.hostMinutes > 0 {
+		result.SampleDensity = float64(qi.samples) / float64(qi.hostMinutes)
+		scores = append(scores, min(1, result.SampleDensity/targetDensity))
+	}
+	if qi.expectedHostMinutes > 0 {
+		result.GapRatio = max(0, 1-float64(qi.hostMinutes)/qi.expectedHostMinutes)
+		scores = append(scores, 1-result.GapRatio)
+	}
+	if qi.frames > 0 {
+		result.UnknownFrameRatio = float64(qi.unresolvedFrames) / float64(qi.frames)
+		scores = append(scores, 1-result.UnknownFrameRatio)
+	}
+	if qi.symbolSamples > 0 {
+		result.TruncationRate = float64(qi.truncatedSamples) / float64(qi.symbolSamples)
+		scores = append(scores, 1-result.TruncationRate)
+	}
+	if len(scores) > 0 {
+		var sum float64
+		for _, score := range scores {
+			sum += score
+		}
+		result.Score = 100 * sum / float64(len(scores))
+	}
+	return result
+}
+
+// qualityInterval returns the bucket interval of the quality series, at least a minute as the host minutes
+// are counted from the minute rollup
+func qualityInterval(params common.QualityScoreParams) (string, time.Duration) {
+	interval := getInterval(params.StartDateTime, params.EndDateTime, params.Interval)
+	duration, err := common.ParseInterval(interval)
+	if err != nil || duration < time.Minute {
+		return "1 minute", time.Minute
+	}
+	return interval, duration
+}
+
+// bucketMinutes returns the minutes of the bucket starting at bucketStart within [start, end)
+func bucketMinutes(bucketStart time.Time, interval time.Duration, start time.Time, end time.Time) float64 {
+	from := bucketStart
+	if start.After(from) {
+		from = start
+	}
+	to := bucketStart.Add(interval)
+	if end.Before(to) {
+		to = end
+	}
+	return max(0, to.Sub(from).Minutes())
+}
+
+// FetchQualityScore scores the profiling health of a service over the time range and every interval of it:
+// sample density, gaps between the profiles of the hosts, unknown frames and truncated stacks
+func (c *ClickHouseClient) FetchQualityScore(ctx context.Context,
+	params common.QualityScoreParams) (common.QualityScore, error) {
+	interval, duration := qualityInterval(params)
+	bucket := startOfInterval(interval, params.Location())
+	where := fmt.Sprintf("ServiceId = %d AND Timestamp >= '%s' AND Timestamp < '%s'", params.ServiceId,
+		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime))
+	buckets := make(map[time.Time]*qualityInputs)
+	inputs := func(timestamp time.Time) *qualityInputs {
+		if _, ok := buckets[timestamp]; !ok {
+			buckets[timestamp] = &qualityInputs{}
+		}
+		return buckets[timestamp]
+	}
+
+	rows, err := c.client.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %s AS Datetime, sum(NumSamples), uniqExact(HostName, Timestamp), uniqExact(HostName)
+		FROM %s
+		WHERE %s
+		GROUP BY Datetime`, bucket, config.StacksTable("1min"), where))
+	if err != nil {
+		return common.QualityScore{}, err
+	}
+	for rows.Next() {
+		var timestamp time.Time
+		var samples, hostMinutes, hosts uint64
+		if err = rows.Scan(&timestamp, &samples, &hostMinutes, &hosts); err != nil {
+			rows.Close()
+			return common.QualityScore{}, err
+		}
+		bucketInputs := inputs(timestamp)
+		bucketInputs.samples = samples
+		bucketInputs.hostMinutes = hostMinutes
+		bucketInputs.expectedHostMinutes = float64(hosts) *
+			bucketMinutes(timestamp, duration, params.StartDateTime, params.EndDateTime)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return common.QualityScore{}, err
+	}
+
+	// the symbol quality statistics are optional, the indexer may not write them
+	rows, err = c.client.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %s AS Datetime, sum(TotalFrames), sum(UnknownFrames) + sum(AddressOnlyFrames), sum(TotalSamples),
+		sum(TruncatedSamples)
+		FROM %s
+		WHERE %s
+		GROUP BY Datetime`, bucket, config.SymbolQualityTable(), where))
+	if err != nil {
+		log.Printf("quality score of service %d without symbol quality: %v", params.ServiceId, err)
+	} else {
+		for rows.Next() {
+			var timestamp time.Time
+			var frames, unresolvedFrames, samples, truncatedSamples uint64
+			if err = rows.Scan(&timestamp, &frames, &unresolvedFrames, &samples, &truncatedSamples); err != nil {
+				log.Printf("error scan result: %v", err)
+				continue
+			}
+			bucketInputs := inputs(timestamp)
+			bucketInputs.frames = frames
+			bucketInputs.unresolvedFrames = unresolvedFrames
+			bucketInputs.symbolSamples = samples
+			bucketInputs.truncatedSamples = truncatedSamples
+		}
+		if err = rows.Err(); err != nil {
+			log.Printf("quality score of service %d without symbol quality: %v", params.ServiceId, err)
+		}
+		rows.Close()
+	}
+
+	return qualityScore(params.ServiceId, buckets, float64(config.QualityTargetSamplesPerMinute)), nil
+}
+
+// qualityScore scores every bucket and the whole time range, the counters of the buckets are summed up
+// rather than the scores averaged
+func qualityScore(serviceId int, buckets map[time.Time]*qualityInputs, targetDensity float64) common.QualityScore {
+	times := make([]time.Time, 0, len(buckets))
+	for timestamp := range buckets {
+		times = append(times, timestamp)
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+	result := common.QualityScore{ServiceId: serviceId, Series: make([]common.QualityScorePoint, 0, len(times))}
+	var total qualityInputs
+	for _, timestamp := range times {
+		total.add(*buckets[timestamp])
+		result.Series = append(result.Series, common.QualityScorePoint{
+			Time:              timestamp,
+			QualityComponents: buckets[timestamp].components(targetDensity),
+		})
+	}
+	result.QualityComponents = total.components(targetDensity)
+	return result
+}
@@ -0,0 +1,175 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"restflamedb/common"
+	"restflamedb/config"
+	"sort"
+)
+
+// recommendationFrames is the number of hottest functions the recommendation rules are matched against
+const recommendationFrames = 1000
+
+// recommendationFunctions is the number of matching functions returned with a recommendation
+const recommendationFunctions = 5
+
+// recommendationRule flags the functions matching pattern, whatever the runtime they run in
+type recommendationRule struct {
+	category       string
+	pattern        *regexp.Regexp
+	recommendation string
+}
+
+var recommendationRules = []recommendationRule{
+	{
+		category: "garbage_collection",
+		pattern: regexp.MustCompile(`^runtime\.(gcBgMarkWorker|gcDrain|mallocgc|scanobject)$|GCTaskThread|` +
+			`^G1 |gc_collect|_PyObject_GC|gcmodule`),
+		recommendation: "Allocate less on the hot paths (reuse buffers and objects) or tune the garbage collector, " +
+			"e.g. GOGC or the JVM heap size",
+	},
+	{
+		category:       "memory_copy",
+		pattern:        regexp.MustCompile(`^(__)?mem(cpy|move)(_\w+)?$|^runtime\.memmove$`),
+		recommendation: "Avoid copying large buffers, pass them by reference or reuse them",
+	},
+	{
+		category:       "compression",
+		pattern:        regexp.MustCompile(`(?i)zlib|deflate|inflate|gzip|zstd|snappy|lz4`),
+		recommendation: "Use a faster compression level or algorithm, or compress less data",
+	},
+	{
+		category: "serialization",
+		pattern: regexp.MustCompile(`(?i)encoding/json|/json/|jackson|protobuf|proto\.(marshal|unmarshal)|` +
+			`pickle|yaml`),
+		recommendation: "Serialize less often (e.g. cache the encoded payloads) or use a faster serializer",
+	},
+	{
+		category:       "regular_expressions",
+		pattern:        regexp.MustCompile(`^regexp\.|java[./]util[./]regex|/re\.py|sre_compile|sre_parse|_sre\.`),
+		recommendation: "Compile the regular expressions once, or replace them with plain string operations",
+	},
+	{
+		category: "lock_contention",
+		pattern: regexp.MustCompile(`futex_wait|__lll_lock_wait|pthread_mutex_lock|sync\.\(\*Mutex\)\.lockSlow|` +
+			`^runtime\.lock2$|LockSupport\.park|native_queued_spin_lock_slowpath`),
+		recommendation: "Reduce the contention on the locks, e.g. shard the state they protect or hold them shorter",
+	},
+	{
+		category:       "logging",
+		pattern:        regexp.MustCompile(`(?i)log4j|logback|/logging/|go\.uber\.org/zap|logrus`),
+		recommendation: "Lower the log level of the hot paths, or log asynchronously",
+	},
+	{
+		category:       "exceptions",
+		pattern:        regexp.MustCompile(`fillInStackTrace|__cxa_throw|_Unwind_RaiseException`),
+		recommendation: "Avoid throwing exceptions on the hot paths, they are expensive to build and unwind",
+	},
+}
+
+// frameSamples is the inclusive number of samples of a function
+type frameSamples struct {
+	name    string
+	samples uint64
+}
+
+// recommend matches the rules against the functions, a rule is reported when its hottest matching function is
+// in at least minShare of the total samples
+func recommend(frames []frameSamples, total uint64, minShare float64) []common.Recommendation {
+	result := make([]common.Recommendation, 0)
+	if total == 0 {
+		return result
+	}
+	sorted := make([]frameSamples, len(frames))
+	copy(sorted, frames)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].samples > sorted[j].samples
+	})
+	for _, rule := range recommendationRules {
+		recommendation := common.Recommendation{
+			Category:       rule.category,
+			Functions:      make([]string, 0, recommendationFunctions),
+			Recommendation: rule.recommendation,
+		}
+		for _, frame := range sorted {
+			if !rule.pattern.MatchString(frame.name) {
+				continue
+			}
+			if len(recommendation.Functions) == 0 {
+				recommendation.Samples = frame.samples
+				recommendation.Share = float64(frame.samples) / float64(total)
+			}
+			if len(recommendation.Functions) < recommendationFunctions {
+				recommendation.Functions = append(recommendation.Functions, frame.name)
+			}
+		}
+		if len(recommendation.Functions) > 0 && recommendation.Share >= minShare {
+			result = append(result, recommendation)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Share > result[j].Share
+	})
+	return result
+}
+
+// recommendationsQuery returns the inclusive samples of the hottest functions of the service along with the
+// samples of its root frames
+func recommendationsQuery(params common.RecommendationsParams) string {
+	table := config.StacksTable(topMoversRollup(params.StartDateTime, params.EndDateTime))
+	where := fmt.Sprintf("ServiceId = %d AND Timestamp >= '%s' AND Timestamp < '%s'", params.ServiceId,
+		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime))
+	return fmt.Sprintf(`
+		WITH (
+			SELECT sum(NumSamples) FROM %[1]s WHERE %[2]s AND CallStackParent = 0
+		) AS Total
+		SELECT CallStackName, sum(NumSamples) AS Samples, Total
+		FROM %[1]s
+		WHERE %[2]s
+		GROUP BY CallStackName
+		ORDER BY Samples DESC
+		LIMIT %[3]d`, table, where, recommendationFrames)
+}
+
+// FetchRecommendations returns the optimization recommendations of the service, made from rules matching the
+// names of its hottest functions (e.g. garbage collection, serialization or lock contention)
+func (c *ClickHouseClient) FetchRecommendations(ctx context.Context,
+	params common.RecommendationsParams) ([]common.Recommendation, error) {
+	rows, err := c.client.QueryContext(ctx, recommendationsQuery(params))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	frames := make([]frameSamples, 0, recommendationFrames)
+	var total uint64
+	for rows.Next() {
+		var frame frameSamples
+		if err = rows.Scan(&frame.name, &frame.samples, &total); err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return recommend(frames, total, params.MinShare), nil
+}
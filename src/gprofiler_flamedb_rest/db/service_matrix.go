@@ -0,0 +1,191 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"restflamedb/common"
+	"restflamedb/config"
+	"time"
+)
+
+// WeekOverWeekOffset is the shift of the time range the indicators of the service matrix are compared with
+const WeekOverWeekOffset = 7 * 24 * time.Hour
+
+type serviceTotals struct {
+	avgCpu         float64
+	weekAgoAvgCpu  float64
+	samples        int
+	weekAgoSamples int
+}
+
+func serviceIndicators(serviceId int, totals serviceTotals) common.ServiceIndicators {
+	indicators := common.ServiceIndicators{
+		ServiceId:      serviceId,
+		AvgCpu:         totals.avgCpu,
+		WeekAgoAvgCpu:  totals.weekAgoAvgCpu,
+		AvgCpuDelta:    totals.avgCpu - totals.weekAgoAvgCpu,
+		Samples:        totals.samples,
+		WeekAgoSamples: totals.weekAgoSamples,
+	}
+	if totals.weekAgoSamples > 0 {
+		delta := float64(totals.samples-totals.weekAgoSamples) / float64(totals.weekAgoSamples)
+		indicators.SamplesDelta = &delta
+	}
+	return indicators
+}
+
+// weekOverWeekComparison compares the rows of the services over [start, end), window B, with the rows of the same
+// range a week earlier, window A
+func weekOverWeekComparison(table string, serviceIds []int, start time.Time, end time.Time) Comparison {
+	return Comparison{
+		Table:      table,
+		ServiceIds: serviceIds,
+		A:          ComparisonWindow{Start: start.Add(-WeekOverWeekOffset), End: end.Add(-WeekOverWeekOffset)},
+		B:          ComparisonWindow{Start: start, End: end},
+	}
+}
+
+// serviceIndicatorsQueries return the root samples and the average host CPU of the services a week earlier and
+// over [start, end), only the rows of the two windows are read, not the week between them
+func serviceIndicatorsQueries(serviceIds []int, start time.Time, end time.Time) (string, string) {
+	samples := weekOverWeekComparison(config.StacksTable(topMoversRollup(start, end)), serviceIds, start, end)
+	samples.Conditions = "AND CallStackParent = 0"
+	cpu := weekOverWeekComparison(config.MetricsTable(), serviceIds, start, end)
+	return samples.serviceAggregatesQuery("sum", "NumSamples"), cpu.serviceAggregatesQuery("avg", "CPUAverageUsedPercent")
+}
+
+// FetchServiceIndicators returns the average host CPU and the root samples of the services over [start, end)
+// and over the same range a week earlier, with two queries whatever the number of services. The services
+// are returned in the given order, the ones without data with zero indicators.
+func (c *ClickHouseClient) FetchServiceIndicators(ctx context.Context, serviceIds []int, start time.Time,
+	end time.Time) ([]common.ServiceIndicators, error) {
+	totals := make(map[int]*serviceTotals, len(serviceIds))
+	for _, serviceId := range serviceIds {
+		totals[serviceId] = &serviceTotals{}
+	}
+	samplesQuery, cpuQuery := serviceIndicatorsQueries(serviceIds, start, end)
+
+	rows, err := c.client.QueryContext(ctx, samplesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var serviceId uint32
+		var samples, weekAgoSamples uint64
+		if err = rows.Scan(&serviceId, &weekAgoSamples, &samples); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		if service, ok := totals[int(serviceId)]; ok {
+			service.samples, service.weekAgoSamples = int(samples), int(weekAgoSamples)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	metricsRows, err := c.client.QueryContext(ctx, cpuQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer metricsRows.Close()
+	for metricsRows.Next() {
+		var serviceId uint32
+		var avgCpu, weekAgoAvgCpu float64
+		if err = metricsRows.Scan(&serviceId, &weekAgoAvgCpu, &avgCpu); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		if service, ok := totals[int(serviceId)]; ok {
+			service.avgCpu, service.weekAgoAvgCpu = convertNumToZeroIfNotValid(avgCpu),
+				convertNumToZeroIfNotValid(weekAgoAvgCpu)
+		}
+	}
+	if err = metricsRows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]common.ServiceIndicators, 0, len(serviceIds))
+	for _, serviceId := range serviceIds {
+		result = append(result, serviceIndicators(serviceId, *totals[serviceId]))
+	}
+	return result, nil
+}
+
+// topFunctionsQuery returns the function with the most self samples of each service. The self samples of a frame
+// are its samples minus the samples of its children, its total samples are not counted again for the direct
+// recursive calls of the function.
+func topFunctionsQuery(serviceIds []int, start time.Time, end time.Time) string {
+	cmp := weekOverWeekComparison(config.StacksTable(topMoversRollup(start, end)), serviceIds, start, end)
+	return fmt.Sprintf(`
+		WITH Frames AS (
+			SELECT ServiceId, CallStackHash, any(CallStackParent) AS Parent, any(CallStackName) AS Name,
+				sum(NumSamples) AS Samples
+			FROM %[1]s
+			WHERE %[2]s
+			GROUP BY ServiceId, CallStackHash
+		), Children AS (
+			SELECT ServiceId, CallStackParent AS CallStackHash, sum(NumSamples) AS ChildrenSamples
+			FROM %[1]s
+			WHERE %[2]s AND CallStackParent != 0
+			GROUP BY ServiceId, CallStackParent
+		)
+		SELECT ServiceId, argMax(Name, SelfSamples), max(SelfSamples), argMax(TotalSamples, SelfSamples)
+		FROM (
+			SELECT ServiceId, Name,
+				sum(if(Samples > ChildrenSamples, Samples - ChildrenSamples, 0)) AS SelfSamples,
+				sumIf(Samples, ParentName != Name) AS TotalSamples
+			FROM Frames
+			LEFT JOIN Children USING (ServiceId, CallStackHash)
+			LEFT JOIN (SELECT ServiceId, CallStackHash AS Parent, Name AS ParentName FROM Frames) AS Parents
+				USING (ServiceId, Parent)
+			GROUP BY ServiceId, Name
+		)
+		GROUP BY ServiceId`, cmp.Table, cmp.windowWhere(cmp.B))
+}
+
+// FetchTopFunctions returns the function with the most self samples of each service over [start, end), in a
+// single query whatever the number of services. The shares are left to the caller, which knows the root samples.
+func (c *ClickHouseClient) FetchTopFunctions(ctx context.Context, serviceIds []int, start time.Time,
+	end time.Time) (map[int]common.TopFunction, error) {
+	rows, err := c.client.QueryContext(ctx, topFunctionsQuery(serviceIds, start, end))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int]common.TopFunction, len(serviceIds))
+	for rows.Next() {
+		var serviceId uint32
+		var function common.TopFunction
+		var selfSamples, totalSamples uint64
+		if err = rows.Scan(&serviceId, &function.Name, &selfSamples, &totalSamples); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		if selfSamples == 0 {
+			continue
+		}
+		function.SelfSamples, function.TotalSamples = int(selfSamples), int(totalSamples)
+		result[int(serviceId)] = function
+	}
+	return result, rows.Err()
+}
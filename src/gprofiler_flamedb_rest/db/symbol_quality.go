@@ -0,0 +1,133 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"restflamedb/common"
+	"restflamedb/config"
+	"strings"
+	"time"
+)
+
+var symbolQualityOrderBy = map[string]string{
+	"unresolved_samples": "UnresolvedLeafSamples DESC",
+	"unresolved_ratio":   "UnresolvedLeafSamples / greatest(TotalSamples, 1) DESC",
+}
+
+// FetchSymbolQuality ranks services by their unresolved ([unknown] or address only) frames and samples,
+// along with the trend of every ranked service, to prioritize symbolization and debug info deployment
+func (c *ClickHouseClient) FetchSymbolQuality(ctx context.Context,
+	params common.SymbolQualityParams) ([]common.SymbolQuality, error) {
+	orderBy, ok := symbolQualityOrderBy[params.OrderBy]
+	if !ok {
+		return nil, fmt.Errorf("unsupported order by %s", params.OrderBy)
+	}
+	conditions := []string{fmt.Sprintf("(Timestamp BETWEEN '%s' AND '%s')",
+		common.FormatTime(params.StartDateTime), common.FormatTime(params.EndDateTime))}
+	if params.ServiceId > 0 {
+		conditions = append(conditions, fmt.Sprintf("ServiceId = %d", params.ServiceId))
+	}
+	if len(params.HostName) > 0 {
+		conditions = append(conditions, fmt.Sprintf("HostName IN (%s)", sqlStringList(params.HostName)))
+	}
+	where := strings.Join(conditions, " AND ")
+	table := config.SymbolQualityTable()
+
+	query := fmt.Sprintf(`
+		SELECT ServiceId, count() AS Uploads, uniqExact(HostName), sum(TotalFrames), sum(UnknownFrames),
+		sum(AddressOnlyFrames), sum(TotalSamples) AS TotalSamples, sum(UnresolvedLeafSamples) AS UnresolvedLeafSamples
+		FROM %s
+		WHERE %s
+		GROUP BY ServiceId
+		ORDER BY %s
+		LIMIT %d`, table, where, orderBy, params.Limit)
+	rows, err := c.client.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]common.SymbolQuality, 0)
+	byService := make(map[int]int)
+	serviceIds := make([]string, 0)
+	for rows.Next() {
+		quality := common.SymbolQuality{Trend: make([]common.SymbolQualityPoint, 0)}
+		err = rows.Scan(&quality.ServiceId, &quality.Uploads, &quality.Hosts, &quality.TotalFrames,
+			&quality.UnknownFrames, &quality.AddressOnlyFrames, &quality.TotalSamples, &quality.UnresolvedLeafSamples)
+		if err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		if quality.TotalFrames > 0 {
+			quality.UnresolvedFrameRatio = float64(quality.UnknownFrames+quality.AddressOnlyFrames) /
+				float64(quality.TotalFrames)
+		}
+		if quality.TotalSamples > 0 {
+			quality.UnresolvedSampleRatio = float64(quality.UnresolvedLeafSamples) / float64(quality.TotalSamples)
+		}
+		byService[quality.ServiceId] = len(result)
+		serviceIds = append(serviceIds, fmt.Sprint(quality.ServiceId))
+		result = append(result, quality)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil || len(result) == 0 {
+		return result, err
+	}
+
+	interval := getInterval(params.StartDateTime, params.EndDateTime, params.Interval)
+	query = fmt.Sprintf(`
+		SELECT %s AS Datetime, ServiceId, sum(TotalFrames),
+		sum(UnknownFrames) + sum(AddressOnlyFrames), sum(TotalSamples), sum(UnresolvedLeafSamples)
+		FROM %s
+		WHERE %s AND ServiceId IN (%s)
+		GROUP BY Datetime, ServiceId
+		ORDER BY Datetime`, startOfInterval(interval, params.Location()), table, where, strings.Join(serviceIds, ","))
+	rows, err = c.client.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var timestamp time.Time
+		var serviceId int
+		var frames, unresolvedFrames, samples uint64
+		point := common.SymbolQualityPoint{}
+		if err = rows.Scan(&timestamp, &serviceId, &frames, &unresolvedFrames, &samples,
+			&point.UnresolvedLeafSamples); err != nil {
+			log.Printf("error scan result: %v", err)
+			continue
+		}
+		point.Time = timestamp
+		if frames > 0 {
+			point.UnresolvedFrameRatio = float64(unresolvedFrames) / float64(frames)
+		}
+		if samples > 0 {
+			point.UnresolvedSampleRatio = float64(point.UnresolvedLeafSamples) / float64(samples)
+		}
+		idx, exists := byService[serviceId]
+		if !exists {
+			continue
+		}
+		result[idx].Trend = append(result[idx].Trend, point)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
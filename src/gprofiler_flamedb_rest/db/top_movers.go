@@ -0,0 +1,77 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"context"
+	"restflamedb/common"
+	"restflamedb/config"
+	"time"
+)
+
+// PreviousPeriodStart returns the start of the period of the same length immediately preceding [start, end)
+func PreviousPeriodStart(start time.Time, end time.Time) time.Time {
+	return start.Add(-end.Sub(start))
+}
+
+// topMoversRollup picks the stacks table fine enough for the compared periods. The periods are split on the
+// timestamps of the rollup, so the share of a period is approximate when it does not start on a full hour/day.
+func topMoversRollup(start time.Time, end time.Time) string {
+	duration := end.Sub(start)
+	switch {
+	case duration < 6*time.Hour:
+		return ""
+	case duration <= 7*24*time.Hour:
+		return "1hour_all"
+	}
+	return "1day"
+}
+
+// FetchTopMovers returns the functions whose CPU share changed the most between [start, end) and the preceding
+// period of the same length. The shares are relative to all samples of the service in each period.
+func (c *ClickHouseClient) FetchTopMovers(ctx context.Context, params common.TopMoversParams) ([]common.TopMover, error) {
+	cmp := Comparison{
+		Table:     config.StacksTable(topMoversRollup(params.StartDateTime, params.EndDateTime)),
+		ServiceId: params.ServiceId,
+		A: ComparisonWindow{
+			Start: PreviousPeriodStart(params.StartDateTime, params.EndDateTime),
+			End:   params.StartDateTime,
+		},
+		B: ComparisonWindow{Start: params.StartDateTime, End: params.EndDateTime},
+	}
+	shares, err := c.FetchFrameShares(ctx, cmp, FrameShareOptions{
+		MinSamples: params.MinSamples,
+		Direction:  params.Direction,
+		Limit:      params.Limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]common.TopMover, 0, len(shares))
+	for _, share := range shares {
+		result = append(result, common.TopMover{
+			Name:            share.Name,
+			CurrentSamples:  share.SamplesB,
+			PreviousSamples: share.SamplesA,
+			CurrentShare:    share.ShareB,
+			PreviousShare:   share.ShareA,
+			ShareDelta:      share.ShareDelta,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,68 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package db
+
+import (
+	"fmt"
+	"restflamedb/common"
+	"strings"
+)
+
+// likeEscaper escapes the LIKE special characters of a value, before the wildcards are translated
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// splitWildcards separates the exact filter values from the wildcard patterns
+func splitWildcards(values []string) ([]string, []string) {
+	exact := make([]string, 0, len(values))
+	patterns := make([]string, 0)
+	for _, value := range values {
+		if common.IsWildcard(value) {
+			patterns = append(patterns, value)
+		} else {
+			exact = append(exact, value)
+		}
+	}
+	return exact, patterns
+}
+
+// wildcardCondition matches column against a pattern, a prefix pattern ("web-*") is translated to startsWith,
+// which uses the primary key when the column is part of it, the other ones to LIKE
+func wildcardCondition(column string, pattern string) string {
+	prefix, isPrefix := strings.CutSuffix(pattern, "*")
+	if isPrefix && !common.IsWildcard(prefix) {
+		return fmt.Sprintf("startsWith(%s, %s)", column, sqlStringList([]string{prefix}))
+	}
+	like := strings.NewReplacer("*", "%", "?", "_").Replace(likeEscaper.Replace(pattern))
+	return fmt.Sprintf("%s LIKE %s", column, sqlStringList([]string{like}))
+}
+
+// valuesCondition matches column against filter values, the exact ones with the condition built by exactCondition
+// and the patterns with wildcardCondition. An empty string is returned when there are no values.
+func valuesCondition(column string, values []string, exactCondition func(exact []string) string) string {
+	exact, patterns := splitWildcards(values)
+	alternatives := make([]string, 0, len(patterns)+1)
+	if len(exact) > 0 {
+		alternatives = append(alternatives, exactCondition(exact))
+	}
+	for _, pattern := range patterns {
+		alternatives = append(alternatives, wildcardCondition(column, pattern))
+	}
+	if len(alternatives) == 0 {
+		return ""
+	}
+	return strings.Join(alternatives, " OR ")
+}
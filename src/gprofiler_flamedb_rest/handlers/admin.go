@@ -0,0 +1,50 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"net/http"
+	"restflamedb/config"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isListedUser reports whether the basic auth user of the request is in the comma separated users
+func isListedUser(c *gin.Context, users string) bool {
+	user := c.GetString(gin.AuthUserKey)
+	if user == "" {
+		return false
+	}
+	for _, listed := range strings.Split(users, ",") {
+		if strings.TrimSpace(listed) == user {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireAdmin rejects the requests of the basic auth users not listed in config.AdminUsers
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isListedUser(c, config.AdminUsers) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
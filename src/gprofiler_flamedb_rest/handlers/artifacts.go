@@ -0,0 +1,195 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"restflamedb/common"
+	"restflamedb/config"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// ArtifactsPath is the prefix of the artifacts endpoint, the rest of the path is the object key
+const ArtifactsPath = "/api/v1/artifacts/"
+
+var ErrArtifactNotFound = errors.New("artifact not found")
+
+// ArtifactObject is an opened artifact, its Body must be closed
+type ArtifactObject struct {
+	Body            io.ReadCloser
+	ContentType     string
+	ContentEncoding string
+	ETag            string
+	LastModified    time.Time
+}
+
+// ArtifactStore opens the stored artifacts, it returns ErrArtifactNotFound for missing objects
+type ArtifactStore interface {
+	Open(ctx context.Context, bucket string, key string) (ArtifactObject, error)
+}
+
+// S3ArtifactStore reads the artifacts from S3, with the same session settings as the indexer
+type S3ArtifactStore struct {
+	client *s3.S3
+}
+
+func NewS3ArtifactStore(region string, endpoint string) (*S3ArtifactStore, error) {
+	sessionOptions := session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if endpoint != "" {
+		sessionOptions.Config = aws.Config{
+			Region:           aws.String(region),
+			Endpoint:         aws.String(endpoint),
+			S3ForcePathStyle: aws.Bool(true),
+		}
+	}
+	sess, err := session.NewSessionWithOptions(sessionOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &S3ArtifactStore{client: s3.New(sess)}, nil
+}
+
+func (s *S3ArtifactStore) Open(ctx context.Context, bucket string, key string) (ArtifactObject, error) {
+	output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && (awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound") {
+			return ArtifactObject{}, ErrArtifactNotFound
+		}
+		return ArtifactObject{}, err
+	}
+	return ArtifactObject{
+		Body:            output.Body,
+		ContentType:     aws.StringValue(output.ContentType),
+		ContentEncoding: aws.StringValue(output.ContentEncoding),
+		ETag:            aws.StringValue(output.ETag),
+		LastModified:    aws.TimeValue(output.LastModified),
+	}, nil
+}
+
+// Artifacts serves the HTML artifacts written by the indexer, so that the reports are reachable with the
+// credentials of the API instead of a direct access to the bucket
+type Artifacts struct {
+	store  ArtifactStore
+	bucket string
+	// buckets are the buckets of the services bound to a residency region
+	buckets map[int]string
+}
+
+func NewArtifacts(store ArtifactStore, bucket string, regions []config.ResidencyRegion) *Artifacts {
+	artifacts := &Artifacts{store: store, bucket: bucket, buckets: make(map[int]string)}
+	for _, region := range regions {
+		if region.S3Bucket == "" {
+			continue
+		}
+		for _, serviceId := range region.ServiceIds {
+			artifacts.buckets[serviceId] = region.S3Bucket
+		}
+	}
+	return artifacts
+}
+
+func (a *Artifacts) bucketOf(serviceId int) string {
+	if bucket, ok := a.buckets[serviceId]; ok {
+		return bucket
+	}
+	return a.bucket
+}
+
+// validArtifactKey only accepts the HTML objects of the products prefix the indexer writes to
+func validArtifactKey(key string) bool {
+	if !strings.HasPrefix(key, "products/") || !strings.HasSuffix(key, ".html") {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// GetArtifact streams a stored HTML artifact, e.g. the path returned by /api/v1/metrics/lasthtml.
+// The artifacts hold the hostnames in clear, when hostname encryption is enabled only the users of
+// config.HostNameReaders may read them.
+func (h Handlers) GetArtifact(c *gin.Context) {
+	params, _, err := parseParams(common.ArtifactParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if !validArtifactKey(key) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid artifact key"})
+		return
+	}
+	if HostNames != nil && !isHostNameReader(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "artifacts are restricted to the hostname readers"})
+		return
+	}
+
+	object, err := h.Artifacts.store.Open(c.Request.Context(), h.Artifacts.bucketOf(params.ServiceId), key)
+	if errors.Is(err, ErrArtifactNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "unable to read the artifact"})
+		return
+	}
+	defer object.Body.Close()
+
+	header := c.Writer.Header()
+	contentType := object.ContentType
+	if contentType == "" || contentType == "binary/octet-stream" || contentType == "application/octet-stream" {
+		contentType = "text/html; charset=utf-8"
+	}
+	header.Set("Content-Type", contentType)
+	if object.ContentEncoding != "" {
+		header.Set("Content-Encoding", object.ContentEncoding)
+	}
+	if object.ETag != "" {
+		header.Set("ETag", object.ETag)
+	}
+	if !object.LastModified.IsZero() {
+		header.Set("Last-Modified", object.LastModified.UTC().Format(http.TimeFormat))
+	}
+	header.Set("Cache-Control", "private, max-age=300")
+	header.Set("X-Content-Type-Options", "nosniff")
+	// the reports run their own scripts, they must not reach the API with the credentials of the origin
+	header.Set("Content-Security-Policy", "sandbox allow-scripts allow-popups")
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, object.Body); err != nil {
+		log.Printf("unable to stream artifact %s: %v", key, err)
+	}
+}
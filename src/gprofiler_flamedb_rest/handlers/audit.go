@@ -0,0 +1,219 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"restflamedb/common"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	auditLogMaxLineSize = 1024 * 1024
+	// auditLogMaxReadSize caps the tail of the file read by a query, older entries are only found in
+	// the rotated files
+	auditLogMaxReadSize = 64 * 1024 * 1024
+	redactedHostName    = "REDACTED"
+)
+
+// auditHostNameParams are the query parameters holding hostnames, their values are never written
+// to the audit log
+var auditHostNameParams = []string{"hostname", "hostname!", "exclude_hostname", "canary_host"}
+
+// AuditLog appends an entry per request to a JSON lines file. The file is only ever appended to,
+// rotating and archiving it is left to the deployment.
+type AuditLog struct {
+	path        string
+	maxReadSize int64
+	mutex       sync.Mutex
+	file        *os.File
+}
+
+func NewAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, maxReadSize: auditLogMaxReadSize, file: file}, nil
+}
+
+func (al *AuditLog) Write(entry common.AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	_, err = al.file.Write(append(line, '\n'))
+	return err
+}
+
+// newAuditEntry records the requested service and time range, the service is either the service query
+// parameter or the id of the path (e.g. /api/v1/services/:id/onboarding-report)
+func newAuditEntry(c *gin.Context, start time.Time) common.AuditEntry {
+	entry := common.AuditEntry{
+		Time:          start.UTC(),
+		User:          c.GetString(gin.AuthUserKey),
+		ClientIP:      c.ClientIP(),
+		Method:        c.Request.Method,
+		Path:          c.Request.URL.Path,
+		Query:         redactAuditQuery(c.Request.URL.RawQuery),
+		StartDateTime: c.Query("start_datetime"),
+		EndDateTime:   c.Query("end_datetime"),
+		Status:        c.Writer.Status(),
+	}
+	service := c.Query("service")
+	if service == "" {
+		service = c.Param("id")
+	}
+	entry.ServiceId, _ = strconv.Atoi(service)
+	return entry
+}
+
+// redactAuditQuery replaces the hostnames of the query parameters and of the RQL filter, a query
+// that cannot be parsed is redacted as a whole
+func redactAuditQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return redactedHostName
+	}
+	for _, param := range auditHostNameParams {
+		for idx := range values[param] {
+			values[param][idx] = redactedHostName
+		}
+	}
+	for idx, rawFilter := range values["filter"] {
+		values["filter"][idx] = redactAuditFilter(rawFilter)
+	}
+	return values.Encode()
+}
+
+func redactAuditFilter(rawFilter string) string {
+	var filter any
+	decoder := json.NewDecoder(bytes.NewReader([]byte(rawFilter)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&filter); err != nil {
+		return redactedHostName
+	}
+	redacted, err := json.Marshal(mapFilterHostNames(filter, false, func(string) string {
+		return redactedHostName
+	}))
+	if err != nil {
+		return redactedHostName
+	}
+	return string(redacted)
+}
+
+// Middleware records the requests once served, it must be used after the auth middleware
+func (al *AuditLog) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		if err := al.Write(newAuditEntry(c, start)); err != nil {
+			log.Printf("unable to write audit log entry: %v", err)
+		}
+	}
+}
+
+// Query returns the last entries matching the params, the most recent first. Only the last maxReadSize
+// bytes of the file are read.
+func (al *AuditLog) Query(params common.AuditLogParams) ([]common.AuditEntry, error) {
+	file, err := os.Open(al.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - al.maxReadSize
+	if offset < 0 {
+		offset = 0
+	}
+	// the entry the tail starts in is skipped, the byte before the tail tells whether it starts at a
+	// line boundary
+	partial := offset > 0
+	if partial {
+		offset--
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	entries := make([]common.AuditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), auditLogMaxLineSize)
+	if partial && !scanner.Scan() {
+		return entries, scanner.Err()
+	}
+	for scanner.Scan() {
+		var entry common.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if entry.Time.Before(params.StartDateTime) || entry.Time.After(params.EndDateTime) ||
+			(params.User != "" && entry.User != params.User) ||
+			(params.ServiceId != 0 && entry.ServiceId != params.ServiceId) {
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) > params.Limit {
+			entries = entries[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// GetAuditLog lists who queried which service and time range
+func (h Handlers) GetAuditLog(c *gin.Context) {
+	params, _, err := parseParams(common.AuditLogParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	entries, err := h.AuditLog.Query(params)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to read audit log"})
+		return
+	}
+	response := AuditLogResponse{
+		Result: entries,
+	}
+	response.SetExecTime(c.GetTime("requestStartTime"))
+	c.JSON(http.StatusOK, response)
+}
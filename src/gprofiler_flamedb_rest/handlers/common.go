@@ -20,9 +20,15 @@ import (
 	"fmt"
 	"github.com/a8m/rql"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"log"
 	"net/http"
+	"net/url"
 	"reflect"
+	"regexp"
+	"restflamedb/common"
+	"restflamedb/config"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -36,22 +42,47 @@ func StartTime() gin.HandlerFunc {
 }
 
 func parseParams[T any](params T, parser *rql.Parser, c *gin.Context) (T, string, error) {
-	var query string
-	var err error
-	if err = c.ShouldBindQuery(&params); err != nil {
+	params, query, choice, err := bindParams(params, parser, c.Request.URL.Query())
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return params, query, err
 	}
+	if choice.Note != "" {
+		c.Set(IntervalNoteKey, choice.Note)
+	}
+	if choice.Resolution != "" {
+		c.Set(ResolutionKey, choice.Resolution)
+	}
+	return params, query, nil
+}
+
+// bindParams binds and validates the params from form values, it returns the RQL query built from the filter
+// and the outcome of the interval normalization
+func bindParams[T any](params T, parser *rql.Parser, values url.Values) (T, string, intervalChoice, error) {
+	var query string
+	var err error
+	values = exclusionAliases(values)
+	if err = binding.MapFormWithTag(&params, values, "form"); err != nil {
+		return params, query, intervalChoice{}, err
+	}
+	if err = binding.Validator.ValidateStruct(&params); err != nil {
+		return params, query, intervalChoice{}, err
+	}
 
 	metaValue := reflect.ValueOf(&params).Elem()
+	if err = encryptHostNameParams(metaValue); err != nil {
+		return params, query, intervalChoice{}, err
+	}
 	filter := metaValue.FieldByName("Filter")
 	if filter.IsValid() {
 		rawFilterData := []byte(filter.String())
 		if len(rawFilterData) > 0 && parser != nil { // filter parameter was passed
+			if rawFilterData, err = encryptHostNameFilter(rawFilterData); err != nil {
+				return params, query, intervalChoice{}, err
+			}
 			query, err = buildQuery(parser, rawFilterData)
 			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return params, query, err
+				return params, query, intervalChoice{}, err
 			}
 		}
 	}
@@ -61,21 +92,183 @@ func parseParams[T any](params T, parser *rql.Parser, c *gin.Context) (T, string
 		fn.Call(nil)
 	}
 
-	return params, query, nil
+	choice, err := normalizeInterval(metaValue)
+	return params, query, choice, err
+}
+
+// exclusionAliases maps the "key!=value" parameters, parsed as the "key!" key, to "exclude_key"
+func exclusionAliases(values url.Values) url.Values {
+	aliased := make(url.Values, len(values))
+	for key, keyValues := range values {
+		if name, ok := strings.CutSuffix(key, "!"); ok {
+			key = "exclude_" + name
+		}
+		aliased[key] = append(aliased[key], keyValues...)
+	}
+	return aliased
+}
+
+// IntervalNoteKey is the context key of the note set when the requested interval was coarsened
+const IntervalNoteKey = "intervalNote"
+
+// ResolutionKey is the context key of the resolution chosen from the max_points budget
+const ResolutionKey = "resolution"
+
+// intervalChoice is the outcome of the interval normalization, returned with the time series
+type intervalChoice struct {
+	// Note describes the coarsening of the requested interval, if any
+	Note string
+	// Resolution is the resolution chosen from the max_points budget (raw, minute, hour or day), if any
+	Resolution string
+}
+
+// normalizeInterval validates the Interval field of the params, when set, and coarsens it so that
+// the time series does not exceed config.MaxTimeSeriesPoints points, nor the MaxPoints budget of the request.
+// Without an interval, the interval of the resolution fitting the MaxPoints budget is set.
+func normalizeInterval(metaValue reflect.Value) (intervalChoice, error) {
+	interval := metaValue.FieldByName("Interval")
+	if !interval.IsValid() || interval.Kind() != reflect.String {
+		return intervalChoice{}, nil
+	}
+	budget := 0
+	if maxPointsField := metaValue.FieldByName("MaxPoints"); maxPointsField.IsValid() {
+		budget = int(maxPointsField.Int())
+	}
+	maxPoints := config.MaxTimeSeriesPoints
+	if budget > 0 && (maxPoints <= 0 || budget < maxPoints) {
+		maxPoints = budget
+	}
+	start, _ := metaValue.FieldByName("StartDateTime").Interface().(time.Time)
+	end, _ := metaValue.FieldByName("EndDateTime").Interface().(time.Time)
+	if interval.String() == "" {
+		if budget == 0 {
+			return intervalChoice{}, nil
+		}
+		resolution, budgetInterval := common.BudgetInterval(start, end, maxPoints)
+		interval.SetString(budgetInterval)
+		return intervalChoice{Resolution: resolution}, nil
+	}
+	normalized, note, err := common.NormalizeInterval(start, end, interval.String(), maxPoints)
+	if err != nil {
+		return intervalChoice{}, err
+	}
+	interval.SetString(normalized)
+	return intervalChoice{Note: note}, nil
+}
+
+var (
+	// innerGroupRegex matches the innermost parenthesized groups of an RQL expression
+	innerGroupRegex = regexp.MustCompile(`\(([^()]*)\)`)
+	// placeholderTermRegex matches a comparison of a column with a placeholder, e.g. "HostName = ?"
+	placeholderTermRegex = regexp.MustCompile(`^(\w+) (=|<>) \?$`)
+)
+
+// inClauses rewrites the disjunctions of equalities of a single column, as RQL builds them from "$or" filters,
+// into IN clauses and the conjunctions of its inequalities into NOT IN clauses. The placeholders are kept in order.
+func inClauses(expression string) string {
+	return innerGroupRegex.ReplaceAllStringFunc(expression, func(group string) string {
+		inner := group[1 : len(group)-1]
+		for _, clause := range []struct{ sep, op, in string }{{" OR ", "=", "IN"}, {" AND ", "<>", "NOT IN"}} {
+			terms := strings.Split(inner, clause.sep)
+			if len(terms) < 2 {
+				continue
+			}
+			column := ""
+			for _, term := range terms {
+				match := placeholderTermRegex.FindStringSubmatch(term)
+				if match == nil || match[2] != clause.op || (column != "" && match[1] != column) {
+					column = ""
+					break
+				}
+				column = match[1]
+			}
+			if column != "" {
+				placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(terms)), ", ")
+				return fmt.Sprintf("%s %s (%s)", column, clause.in, placeholders)
+			}
+		}
+		return group
+	})
+}
+
+// sortedFilterKeys returns the keys of an RQL filter object, the fields sorted by name before the operators
+func sortedFilterKeys(filter map[string]interface{}) []string {
+	keys := make([]string, 0, len(filter))
+	for key := range filter {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		iOperator, jOperator := strings.HasPrefix(keys[i], "$"), strings.HasPrefix(keys[j], "$")
+		if iOperator != jOperator {
+			return jOperator
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// canonicalFilter rewrites the objects of several keys of an RQL filter, and the fields of several operators,
+// into "$and" arrays of single key objects in the order of sortedFilterKeys
+func canonicalFilter(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		terms := make([]interface{}, len(v))
+		for idx, term := range v {
+			terms[idx] = canonicalFilter(term)
+		}
+		return terms
+	case map[string]interface{}:
+		terms := make([]interface{}, 0, len(v))
+		for _, key := range sortedFilterKeys(v) {
+			operators, isField := v[key].(map[string]interface{})
+			if strings.HasPrefix(key, "$") || !isField || len(operators) < 2 {
+				terms = append(terms, map[string]interface{}{key: canonicalFilter(v[key])})
+				continue
+			}
+			for _, operator := range sortedFilterKeys(operators) {
+				terms = append(terms, map[string]interface{}{key: map[string]interface{}{operator: operators[operator]}})
+			}
+		}
+		if len(terms) == 1 {
+			return terms[0]
+		}
+		return map[string]interface{}{"$and": terms}
+	}
+	return value
+}
+
+// parseFilter parses an RQL query in a deterministic order, RQL iterates over the keys of the filter objects
+// in the random order of the Go maps. The top level conditions are parsed one at a time.
+func parseFilter(parser *rql.Parser, rawFilterData []byte) (string, []interface{}, error) {
+	// the query is parsed as a whole first for its validation errors
+	if _, err := parser.Parse(rawFilterData); err != nil {
+		return "", nil, err
+	}
+	query := &rql.Query{}
+	if err := query.UnmarshalJSON(rawFilterData); err != nil {
+		return "", nil, err
+	}
+	expressions := make([]string, 0, len(query.Filter))
+	args := make([]interface{}, 0)
+	for _, key := range sortedFilterKeys(query.Filter) {
+		filter := canonicalFilter(map[string]interface{}{key: query.Filter[key]}).(map[string]interface{})
+		filters, err := parser.ParseQuery(&rql.Query{Filter: filter})
+		if err != nil {
+			return "", nil, err
+		}
+		expressions = append(expressions, filters.FilterExp)
+		args = append(args, filters.FilterArgs...)
+	}
+	return strings.Join(expressions, " AND "), args, nil
 }
 
 func buildQuery(parser *rql.Parser, rawFilterData []byte) (string, error) {
 	var query string
-	var expressions []string
-	var args []interface{}
-	filters, err := parser.Parse(rawFilterData)
+	filterExp, args, err := parseFilter(parser, rawFilterData)
 	if err != nil {
 		return "", err
 	}
-	if filters != nil {
-		expressions = strings.Split(filters.FilterExp, "?")
-		args = filters.FilterArgs
-	}
+	expressions := strings.Split(inClauses(filterExp), "?")
 	for idx, expr := range expressions {
 		v := ""
 		if idx < len(args) {
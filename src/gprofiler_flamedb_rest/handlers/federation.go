@@ -0,0 +1,298 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"restflamedb/common"
+	"restflamedb/config"
+	"restflamedb/db"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Federation fans queries out to the regional REST instances and merges their results.
+// Service ids are passed through as is, regions are expected to share them. The requests to the regions carry
+// the credentials of the caller, so that the regions apply its permissions and audit its queries.
+type Federation struct {
+	regions []config.Region
+	client  *http.Client
+}
+
+func NewFederation(regions []config.Region, timeout time.Duration) *Federation {
+	return &Federation{
+		regions: regions,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+type regionReply struct {
+	region   string
+	body     []byte
+	execTime float64
+	err      error
+}
+
+func (f *Federation) fanOut(ctx context.Context, authorization string, path string,
+	query url.Values) []regionReply {
+	replies := make([]regionReply, len(f.regions))
+	var wg sync.WaitGroup
+	for idx, region := range f.regions {
+		wg.Add(1)
+		go func(idx int, region config.Region) {
+			defer wg.Done()
+			start := time.Now()
+			body, err := f.get(ctx, region.URL+path+"?"+query.Encode(), authorization)
+			replies[idx] = regionReply{
+				region:   region.Name,
+				body:     body,
+				execTime: float64(time.Since(start)) / float64(time.Second),
+				err:      err,
+			}
+		}(idx, region)
+	}
+	wg.Wait()
+	return replies
+}
+
+func (f *Federation) get(ctx context.Context, rawURL string, authorization string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return body, nil
+}
+
+type RegionContribution struct {
+	Region   string          `json:"region"`
+	Value    int             `json:"value,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	ExecTime float64         `json:"exec_time"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func newRegionContribution(reply regionReply) RegionContribution {
+	contribution := RegionContribution{Region: reply.region, ExecTime: reply.execTime}
+	if reply.err != nil {
+		contribution.Error = reply.err.Error()
+	}
+	return contribution
+}
+
+// mergeFrames merges frames of the same name and suffix, summing their values recursively
+func mergeFrames(frames []db.ResponseFrame, other []db.ResponseFrame) []db.ResponseFrame {
+	type frameKey struct {
+		name   string
+		suffix string
+	}
+	index := make(map[frameKey]int, len(frames))
+	for idx, frame := range frames {
+		index[frameKey{frame.Name, frame.Suffix}] = idx
+	}
+	for _, frame := range other {
+		key := frameKey{frame.Name, frame.Suffix}
+		if idx, ok := index[key]; ok {
+			frames[idx].Value += frame.Value
+			frames[idx].Children = mergeFrames(frames[idx].Children, frame.Children)
+			continue
+		}
+		index[key] = len(frames)
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// GetFederatedFlamegraph builds a flame graph of every configured region, merged into a single one
+func (h Handlers) GetFederatedFlamegraph(c *gin.Context) {
+	query := c.Request.URL.Query()
+	query.Set("format", "flamegraph")
+	// the regions are merged by name and suffix, which the lite graphs leave out
+	query.Set("detail", "full")
+	replies := h.Federation.fanOut(c.Request.Context(), c.GetHeader("Authorization"), "/api/v1/flamegraph",
+		query)
+
+	result := FederatedFlameGraphResponse{
+		Name:     "root",
+		Children: make([]db.ResponseFrame, 0),
+		Regions:  make([]RegionContribution, 0, len(replies)),
+	}
+	for _, reply := range replies {
+		contribution := newRegionContribution(reply)
+		if reply.err == nil && reply.body != nil {
+			var graph FlameGraphResponse
+			if err := json.Unmarshal(reply.body, &graph); err != nil {
+				contribution.Error = err.Error()
+			} else {
+				contribution.Value = graph.Value
+				result.Value += graph.Value
+				result.Children = mergeFrames(result.Children, graph.Children)
+			}
+		}
+		result.Regions = append(result.Regions, contribution)
+	}
+	result.SetExecTime(c.GetTime("requestStartTime"))
+	c.JSON(http.StatusOK, result)
+}
+
+// mergeMetaResults merges the query results of the regions for the lookups that can be merged,
+// nil is returned for the other ones (e.g. percentages)
+func mergeMetaResults(lookupFor string, results []json.RawMessage) (any, error) {
+	switch lookupFor {
+	case "ContainerName", "container", "HostName", "hostname", "InstanceType", "instance_type",
+		"ContainerEnvName", "k8s_obj", "AppVersion", "app_version", "Endpoint", "endpoint", "JobName", "job_name":
+		samples := make(map[string]int)
+		for _, raw := range results {
+			var values []common.FilterData
+			if err := json.Unmarshal(raw, &values); err != nil {
+				return nil, err
+			}
+			for _, value := range values {
+				samples[value.Name] += value.Samples
+			}
+		}
+		merged := make([]common.FilterData, 0, len(samples))
+		for name, count := range samples {
+			merged = append(merged, common.FilterData{Name: name, Samples: count})
+		}
+		sort.Slice(merged, func(i, j int) bool {
+			if merged[i].Samples != merged[j].Samples {
+				return merged[i].Samples > merged[j].Samples
+			}
+			return merged[i].Name < merged[j].Name
+		})
+		return merged, nil
+	case "instance_type_count":
+		counts := make(map[string]int)
+		for _, raw := range results {
+			var values []common.InstanceTypeCount
+			if err := json.Unmarshal(raw, &values); err != nil {
+				return nil, err
+			}
+			for _, value := range values {
+				counts[value.InstanceType] += value.InstanceCount
+			}
+		}
+		merged := make([]common.InstanceTypeCount, 0, len(counts))
+		for instanceType, count := range counts {
+			merged = append(merged, common.InstanceTypeCount{InstanceType: instanceType, InstanceCount: count})
+		}
+		sort.Slice(merged, func(i, j int) bool {
+			return merged[i].InstanceType < merged[j].InstanceType
+		})
+		return merged, nil
+	case "samples":
+		byTime := make(map[time.Time]int)
+		for _, raw := range results {
+			var values []common.Sample
+			if err := json.Unmarshal(raw, &values); err != nil {
+				return nil, err
+			}
+			for _, value := range values {
+				byTime[value.Time] += value.Samples
+			}
+		}
+		merged := make([]common.Sample, 0, len(byTime))
+		for timestamp, count := range byTime {
+			merged = append(merged, common.Sample{Time: timestamp, Samples: count})
+		}
+		sort.Slice(merged, func(i, j int) bool {
+			return merged[i].Time.Before(merged[j].Time)
+		})
+		return merged, nil
+	case "time", "time_range":
+		// UTC timestamps, sorting them as strings sorts them by time
+		unique := make(map[string]bool)
+		for _, raw := range results {
+			var values []string
+			if err := json.Unmarshal(raw, &values); err != nil {
+				return nil, err
+			}
+			for _, value := range values {
+				unique[value] = true
+			}
+		}
+		merged := make([]string, 0, len(unique))
+		for value := range unique {
+			merged = append(merged, value)
+		}
+		sort.Strings(merged)
+		if lookupFor == "time_range" && len(merged) > 2 {
+			merged = []string{merged[0], merged[len(merged)-1]}
+		}
+		return merged, nil
+	}
+	return nil, nil
+}
+
+// QueryFederatedMeta runs a meta query on every configured region, the results are merged when possible
+// and always returned per region as well
+func (h Handlers) QueryFederatedMeta(c *gin.Context) {
+	query := c.Request.URL.Query()
+	replies := h.Federation.fanOut(c.Request.Context(), c.GetHeader("Authorization"), "/api/v1/query", query)
+
+	response := FederatedQueryResponse{Regions: make([]RegionContribution, 0, len(replies))}
+	results := make([]json.RawMessage, 0, len(replies))
+	for _, reply := range replies {
+		contribution := newRegionContribution(reply)
+		if reply.err == nil && reply.body != nil {
+			var body struct {
+				Result json.RawMessage `json:"result"`
+			}
+			if err := json.Unmarshal(reply.body, &body); err != nil {
+				contribution.Error = err.Error()
+			} else if len(body.Result) > 0 && string(body.Result) != "null" {
+				contribution.Result = body.Result
+				results = append(results, body.Result)
+			}
+		}
+		response.Regions = append(response.Regions, contribution)
+	}
+	merged, err := mergeMetaResults(query.Get("lookup_for"), results)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("unable to merge region results: %v", err)})
+		return
+	}
+	response.Result = merged
+	response.SetExecTime(c.GetTime("requestStartTime"))
+	c.JSON(http.StatusOK, response)
+}
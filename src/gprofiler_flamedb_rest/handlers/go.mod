@@ -10,8 +10,11 @@ replace restflamedb/common => ../common
 
 require (
 	github.com/a8m/rql v1.4.0
+	github.com/aws/aws-sdk-go v1.55.6
 	github.com/gin-gonic/gin v1.10.0
+	github.com/graphql-go/graphql v0.8.1
 	restflamedb/common v0.0.0-00010101000000-000000000000
+	restflamedb/config v0.0.0-00010101000000-000000000000
 	restflamedb/db v0.0.0-00010101000000-000000000000
 )
 
@@ -28,6 +31,8 @@ require (
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/go-playground/validator/v10 v10.26.0 // indirect
 	github.com/goccy/go-json v0.10.5 // indirect
+	github.com/ianlancetaylor/demangle v0.0.0-20250417193237-f615e6bd150b // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/josharian/intern v1.0.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
@@ -48,5 +53,4 @@ require (
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	google.golang.org/protobuf v1.36.6 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
-	restflamedb/config v0.0.0-00010101000000-000000000000 // indirect
 )
@@ -0,0 +1,378 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"restflamedb/common"
+	"restflamedb/db"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// The GraphQL endpoint is served by graphql-go from a schema derived from the REST endpoints: the arguments of
+// a root field are the query parameters of the matching REST endpoint and its fields are the keys of the JSON
+// response, e.g.
+//
+//	{ flamegraph(service: 7, start_datetime: "2024-01-01T00:00:00") { value children { name value } } }
+//
+// Lists are repeated query parameters and RQL filters are JSON strings, as in the REST endpoints. The schema has
+// no mutations.
+
+// gqlResolver fetches the value of a root field from the query parameters of the matching REST endpoint
+type gqlResolver func(ctx context.Context, values url.Values) (any, error)
+
+// gqlRootField is a root field of the schema, params and result are values of the types of the query parameters
+// and of the response of the REST endpoint
+type gqlRootField struct {
+	params  any
+	result  any
+	resolve gqlResolver
+}
+
+// gqlLong serializes the 64 bits integers (e.g. sample counts), the GraphQL Int is 32 bits
+var gqlLong = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "Long",
+	Description: "A 64 bits integer",
+	Serialize: func(value any) any {
+		if number, ok := value.(float64); ok {
+			return int64(number)
+		}
+		return value
+	},
+})
+
+// gqlJSON serializes the values without a fixed set of fields (e.g. the percentiles of a flame graph) as is
+var gqlJSON = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "Any JSON value",
+	Serialize: func(value any) any {
+		return value
+	},
+})
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// gqlSchemaBuilder maps the Go types to GraphQL types, the objects are kept by type as they can be recursive
+// (e.g. the frames of a flame graph)
+type gqlSchemaBuilder struct {
+	objects map[reflect.Type]*graphql.Object
+}
+
+func gqlTypeName(t reflect.Type) string {
+	name := []rune(strings.TrimPrefix(t.Name(), "gql"))
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+func (b *gqlSchemaBuilder) output(t reflect.Type) graphql.Output {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.output(t.Elem())
+	case reflect.Slice, reflect.Array:
+		return graphql.NewList(b.output(t.Elem()))
+	case reflect.Bool:
+		return graphql.Boolean
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return graphql.Int
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return gqlLong
+	case reflect.Float32, reflect.Float64:
+		return graphql.Float
+	case reflect.String:
+		return graphql.String
+	case reflect.Struct:
+		if t == timeType {
+			return graphql.String
+		}
+		return b.object(t)
+	}
+	return gqlJSON
+}
+
+func (b *gqlSchemaBuilder) object(t reflect.Type) *graphql.Object {
+	if object, ok := b.objects[t]; ok {
+		return object
+	}
+	object := graphql.NewObject(graphql.ObjectConfig{
+		Name: gqlTypeName(t),
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			fields := make(graphql.Fields)
+			b.addFields(fields, t)
+			return fields
+		}),
+	})
+	b.objects[t] = object
+	return object
+}
+
+// addFields adds the JSON keys of a struct, the fields of embedded structs are inlined as encoding/json does
+func (b *gqlSchemaBuilder) addFields(fields graphql.Fields, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			b.addFields(fields, field.Type)
+			continue
+		}
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = &graphql.Field{Type: b.output(field.Type)}
+	}
+}
+
+func gqlInput(t reflect.Type) graphql.Input {
+	switch t.Kind() {
+	case reflect.Slice:
+		if item := gqlInput(t.Elem()); item != nil {
+			return graphql.NewList(item)
+		}
+	case reflect.Bool:
+		return graphql.Boolean
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return graphql.Int
+	case reflect.Float32, reflect.Float64:
+		return graphql.Float
+	case reflect.String:
+		return graphql.String
+	case reflect.Struct:
+		if t == timeType {
+			return graphql.String
+		}
+	}
+	return nil
+}
+
+// addArguments adds the query parameters of a params struct (its form tags), the required ones are non null
+func addArguments(arguments graphql.FieldConfigArgument, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addArguments(arguments, field.Type)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("form"), ",")[0]
+		input := gqlInput(field.Type)
+		if name == "" || name == "-" || input == nil {
+			continue
+		}
+		if strings.Contains(field.Tag.Get("binding"), "required") {
+			input = graphql.NewNonNull(input)
+		}
+		arguments[name] = &graphql.ArgumentConfig{Type: input}
+	}
+}
+
+// argumentValues converts the arguments to the query parameters of the REST endpoints, lists are repeated
+// parameters
+func argumentValues(arguments map[string]any) url.Values {
+	values := make(url.Values)
+	var add func(name string, value any)
+	add = func(name string, value any) {
+		switch v := value.(type) {
+		case nil:
+		case []any:
+			for _, item := range v {
+				add(name, item)
+			}
+		case float64:
+			values.Add(name, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			values.Add(name, fmt.Sprint(v))
+		}
+	}
+	for name, value := range arguments {
+		add(name, value)
+	}
+	return values
+}
+
+// newGraphQLSchema builds the schema of the root fields, they are resolved to the JSON representation of their
+// result so that the fields are the keys returned by the REST endpoints
+func newGraphQLSchema(rootFields map[string]gqlRootField) (graphql.Schema, error) {
+	builder := gqlSchemaBuilder{objects: make(map[reflect.Type]*graphql.Object)}
+	fields := make(graphql.Fields)
+	for name, rootField := range rootFields {
+		arguments := make(graphql.FieldConfigArgument)
+		addArguments(arguments, reflect.TypeOf(rootField.params))
+		resolve := rootField.resolve
+		fields[name] = &graphql.Field{
+			Type: builder.output(reflect.TypeOf(rootField.result)),
+			Args: arguments,
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				result, err := resolve(p.Context, argumentValues(p.Args))
+				if err != nil {
+					return nil, err
+				}
+				encoded, err := json.Marshal(result)
+				if err != nil {
+					return nil, err
+				}
+				var decoded any
+				err = json.Unmarshal(encoded, &decoded)
+				return decoded, err
+			},
+		}
+	}
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: fields}),
+	})
+}
+
+type GraphQLRequest struct {
+	Query         string         `json:"query" form:"query"`
+	OperationName string         `json:"operationName" form:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// executeGraphQL runs the request, a failed field is null and reported in the errors
+func executeGraphQL(ctx context.Context, rootFields map[string]gqlRootField, request GraphQLRequest) *graphql.Result {
+	schema, err := newGraphQLSchema(rootFields)
+	if err != nil {
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+	}
+	return graphql.Do(graphql.Params{
+		Schema:         schema,
+		RequestString:  request.Query,
+		VariableValues: request.Variables,
+		OperationName:  request.OperationName,
+		Context:        ctx,
+	})
+}
+
+// gqlFlameGraph is the flame graph of the GraphQL endpoint
+type gqlFlameGraph struct {
+	Name        string             `json:"name"`
+	Value       int                `json:"value"`
+	Children    []db.ResponseFrame `json:"children"`
+	Percentiles map[string]string  `json:"percentiles"`
+}
+
+func (h Handlers) graphQLRootFields() map[string]gqlRootField {
+	return map[string]gqlRootField{
+		"services": {
+			params: common.ServicesParams{},
+			result: []db.SrvResp{},
+			resolve: func(ctx context.Context, values url.Values) (any, error) {
+				params, _, _, err := bindParams(common.ServicesParams{}, nil, values)
+				if err != nil {
+					return nil, err
+				}
+				return h.fetchServices(ctx, params), nil
+			},
+		},
+		"flamegraph": {
+			params: common.FlameGraphParams{},
+			result: gqlFlameGraph{},
+			resolve: func(ctx context.Context, values url.Values) (any, error) {
+				values.Set("format", "flamegraph")
+				params, query, _, err := bindParams(common.FlameGraphParams{}, QueryParser, values)
+				if err != nil {
+					return nil, err
+				}
+				graph, err := h.chClient(params.ServiceId).GetTopFrames(ctx, params, query)
+				if err != nil {
+					return nil, err
+				}
+				total, final := graph.BuildFlameGraph()
+				return gqlFlameGraph{
+					Name:        "root",
+					Value:       total,
+					Children:    final,
+					Percentiles: graph.GetPercentiles(),
+				}, nil
+			},
+		},
+		"metricsSummary": {
+			params: common.MetricsSummaryParams{},
+			result: common.MetricsSummary{},
+			resolve: func(ctx context.Context, values url.Values) (any, error) {
+				params, query, _, err := bindParams(common.MetricsSummaryParams{}, MetricsQueryParser, values)
+				if err != nil {
+					return nil, err
+				}
+				return h.chClient(params.ServiceId).FetchMetricsSummary(ctx, params, query)
+			},
+		},
+		"metricsGraph": {
+			params: common.MetricsSummaryParams{},
+			result: []common.MetricsSummary{},
+			resolve: func(ctx context.Context, values url.Values) (any, error) {
+				params, query, _, err := bindParams(common.MetricsSummaryParams{}, MetricsQueryParser, values)
+				if err != nil {
+					return nil, err
+				}
+				return h.chClient(params.ServiceId).FetchMetricsGraph(ctx, params, query)
+			},
+		},
+		"recommendations": {
+			params: common.RecommendationsParams{},
+			result: []common.Recommendation{},
+			resolve: func(ctx context.Context, values url.Values) (any, error) {
+				params, _, _, err := bindParams(common.RecommendationsParams{}, nil, values)
+				if err != nil {
+					return nil, err
+				}
+				return h.chClient(params.ServiceId).FetchRecommendations(ctx, params)
+			},
+		},
+	}
+}
+
+// GraphQL serves queries over the services, flame graphs, metrics and recommendations, either as a POST JSON
+// body or with the query parameters of a GET request
+func (h Handlers) GraphQL(c *gin.Context) {
+	var request GraphQLRequest
+	var err error
+	if c.Request.Method == http.MethodPost {
+		err = c.ShouldBindJSON(&request)
+	} else {
+		err = c.ShouldBindQuery(&request)
+		if variables := c.Query("variables"); err == nil && variables != "" {
+			err = json.Unmarshal([]byte(variables), &request.Variables)
+		}
+	}
+	if err != nil || request.Query == "" {
+		if err == nil {
+			err = fmt.Errorf("missing query")
+		}
+		c.JSON(http.StatusBadRequest, graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+	result := executeGraphQL(c.Request.Context(), h.graphQLRootFields(), request)
+	if result.Data == nil {
+		c.JSON(http.StatusBadRequest, result)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -17,15 +17,20 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/a8m/rql"
 
 	"restflamedb/common"
+	"restflamedb/config"
 	"restflamedb/db"
 
 	"github.com/gin-gonic/gin"
@@ -33,6 +38,16 @@ import (
 
 type Handlers struct {
 	ChClient *db.ClickHouseClient
+	// Federation is nil unless federation regions are configured
+	Federation *Federation
+	// AuditLog is nil unless an audit log file is configured
+	AuditLog *AuditLog
+	// Residency is nil unless a residency file is configured
+	Residency *Residency
+	// Artifacts is nil unless an artifacts bucket is configured
+	Artifacts *Artifacts
+	// ShareLinks is nil unless a share link key is configured
+	ShareLinks *ShareLinks
 }
 
 var QueryParser = rql.MustNewParser(rql.Config{
@@ -52,9 +67,30 @@ func (h Handlers) GetFlamegraph(c *gin.Context) {
 	if err != nil {
 		return
 	}
+	if params.GroupBy == "module" && (Modules == nil || params.Format != "flamegraph") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group_by=module needs module rules and the flamegraph format"})
+		return
+	}
+	if params.Inlined == "expand" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "inlined=expand is not supported, the stored stacks carry no " +
+			"debug info to expand the inlined functions from"})
+		return
+	}
+	if params.Inlined == "collapse" && params.Format != "flamegraph" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "inlined=collapse needs the flamegraph format"})
+		return
+	}
+	if params.Detail == "lite" && params.Format != "flamegraph" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "detail=lite needs the flamegraph format"})
+		return
+	}
+	if params.HostPercentileFrom >= params.HostPercentileTo {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "host_percentile_from must be lower than host_percentile_to"})
+		return
+	}
 
 	start := c.GetTime("requestStartTime")
-	graph, err := h.ChClient.GetTopFrames(c.Request.Context(), params, query)
+	graph, err := h.chClient(params.ServiceId).GetTopFrames(c.Request.Context(), params, query)
 	if err != nil {
 		c.String(http.StatusInternalServerError, err.Error())
 		return
@@ -63,13 +99,27 @@ func (h Handlers) GetFlamegraph(c *gin.Context) {
 	runtimes := make(map[string]float64)
 
 	if graph.EnrichWithLang {
-		runtimes = db.CalcRuntimesDistribution(&graph)
+		runtimes = db.CalcRuntimesDistribution(graph)
 	}
 
 	switch params.Format {
 	case "flamegraph":
 		total, final := graph.BuildFlameGraph()
 		percentiles := graph.GetPercentiles()
+		if params.Inlined == "collapse" {
+			final = CollapseInlinedFrames(final)
+		}
+		if params.GroupBy == "module" {
+			final = Modules.GroupFrames(final)
+		}
+		if params.Detail == "lite" {
+			children, truncated := db.BuildLiteFlameGraph(final, config.LiteFlameGraphMaxDepth,
+				config.LiteFlameGraphMaxBytes)
+			result := LiteFlameGraphResponse{Name: "root", Value: total, Children: children, Truncated: truncated}
+			result.SetExecTime(start)
+			c.JSON(http.StatusOK, result)
+			return
+		}
 
 		result := FlameGraphResponse{
 			Name:        "root",
@@ -78,6 +128,13 @@ func (h Handlers) GetFlamegraph(c *gin.Context) {
 			OlapTime:    olapTime,
 			Percentiles: percentiles,
 		}
+		if params.HostPercentileBand() {
+			readHostName := hostNameReader(c)
+			result.Hosts = make([]string, 0, len(graph.Hosts))
+			for _, host := range graph.Hosts {
+				result.Hosts = append(result.Hosts, readHostName(host))
+			}
+		}
 		result.SetExecTime(start)
 
 		c.JSON(http.StatusOK, result)
@@ -125,40 +182,73 @@ func (h Handlers) QueryMeta(c *gin.Context) {
 		"HostName":         "HostName",
 		"InstanceType":     "InstanceType",
 		"ContainerEnvName": "ContainerEnvName",
+		"app_version":      "AppVersion",
+		"endpoint":         "Endpoint",
+		"job_name":         "JobName",
+		"AppVersion":       "AppVersion",
+		"Endpoint":         "Endpoint",
+		"JobName":          "JobName",
 	}
 
 	ctx := c.Request.Context()
 	switch params.LookupFor {
 	case "HostName", "hostname", "InstanceType", "instance_type":
+		values := h.chClient(params.ServiceId).FetchFieldValues(ctx, mapping[params.LookupFor], params, query)
+		if mapping[params.LookupFor] == "HostName" {
+			readHostName := hostNameReader(c)
+			for idx := range values {
+				values[idx].Name = readHostName(values[idx].Name)
+			}
+		}
 		response = &FieldValueSampleResponse{
-			Result: h.ChClient.FetchFieldValues(ctx, mapping[params.LookupFor], params, query),
+			Result: values,
 		}
-	case "ContainerEnvName", "k8s_obj", "ContainerName", "container":
+	case "ContainerEnvName", "k8s_obj", "ContainerName", "container", "AppVersion", "app_version",
+		"Endpoint", "endpoint", "JobName", "job_name":
 		response = &FieldValueSampleResponse{
-			Result: h.ChClient.FetchFieldValueSample(ctx, mapping[params.LookupFor], params, query),
+			Result: h.chClient(params.ServiceId).FetchFieldValueSample(ctx, mapping[params.LookupFor], params, query),
+		}
+
+	case "cardinality":
+		cardinality, err := h.chClient(params.ServiceId).FetchCardinality(ctx, params, query)
+		if err != nil {
+			log.Printf("unable to fetch cardinality: %v", err)
+			c.Status(http.StatusNoContent)
+			return
 		}
+		response = &CardinalityResponse{Result: cardinality}
 
 	case "instance_type_count":
 		response = &InstanceTypeCountResponse{
-			Result: h.ChClient.FetchInstanceTypeCount(ctx, params, query),
+			Result: h.chClient(params.ServiceId).FetchInstanceTypeCount(ctx, params, query),
 		}
 
-	case "time":
-		response = &QueryResponse{
-			Result: h.ChClient.FetchTimes(ctx, params, query),
+	case "time", "time_range":
+		timesResponse := &TimesResponse{}
+		if params.LookupFor == "time" {
+			timesResponse.Result = h.chClient(params.ServiceId).FetchTimes(ctx, params, query)
+		} else {
+			timesResponse.Result = h.chClient(params.ServiceId).FetchTimeRange(ctx, params, query)
 		}
-	case "time_range":
-		response = &QueryResponse{
-			Result: h.ChClient.FetchTimeRange(ctx, params, query),
+		if params.WithAnomalies && config.MetricAnomalyThreshold > 0 {
+			anomalies, err := h.chClient(params.ServiceId).FetchMetricAnomalies(ctx, params)
+			if err != nil {
+				log.Printf("unable to fetch metric anomalies: %v", err)
+			}
+			timesResponse.Anomalies = anomalies
 		}
+		response = timesResponse
 	case "samples":
-		response = &SampleCountResponse{
-			Result: h.ChClient.FetchSampleCount(ctx, params, query),
+		samplesResponse := &SampleCountResponse{
+			Result: h.chClient(params.ServiceId).FetchSampleCount(ctx, params, query),
 		}
+		samplesResponse.Note = c.GetString(IntervalNoteKey)
+		samplesResponse.Resolution = c.GetString(ResolutionKey)
+		response = samplesResponse
 	case "samples_count_by_function":
 		if len(params.FunctionName) > 0 {
 			response = &SampleCountByFunctionResponse{
-				Result: h.ChClient.FetchSampleCountByFunction(ctx, params, query),
+				Result: h.chClient(params.ServiceId).FetchSampleCountByFunction(ctx, params, query),
 			}
 		} else {
 			c.JSON(http.StatusBadRequest, "missing function name")
@@ -180,7 +270,7 @@ func (h Handlers) QueryServices(c *gin.Context) {
 
 	ctx := c.Request.Context()
 	response := ServiceResponse{
-		Result: h.ChClient.FetchServices(ctx, params),
+		Result: h.fetchServices(ctx, params),
 	}
 	response.SetExecTime(c.GetTime("requestStartTime"))
 	c.JSON(http.StatusOK, response)
@@ -193,7 +283,7 @@ func (h Handlers) QuerySessionsCount(c *gin.Context) {
 	}
 	ctx := c.Request.Context()
 	response := SessionsResponse{}
-	result, err := h.ChClient.FetchSessionsCount(ctx, params, query)
+	result, err := h.chClient(params.ServiceId).FetchSessionsCount(ctx, params, query)
 	response.SetExecTime(c.GetTime("requestStartTime"))
 	if err == nil {
 		response.Result = result
@@ -210,7 +300,7 @@ func (h Handlers) GetMetricsSummary(c *gin.Context) {
 	}
 	ctx := c.Request.Context()
 
-	if fetchResponse, err := h.ChClient.FetchMetricsSummary(ctx, params, query); err != nil {
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchMetricsSummary(ctx, params, query); err != nil {
 		log.Print(err)
 		c.Status(http.StatusNoContent)
 		return
@@ -236,7 +326,7 @@ func (h Handlers) GetMetricsServicesListSummary(c *gin.Context) {
 	}
 	ctx := c.Request.Context()
 
-	if fetchResponse, err := h.ChClient.FetchMetricsServicesListSummary(ctx, body); err != nil {
+	if fetchResponse, err := h.fetchMetricsServicesListSummary(ctx, body); err != nil {
 		log.Print(err)
 		c.Status(http.StatusNoContent)
 		return
@@ -257,7 +347,7 @@ func (h Handlers) GetMetricsGraph(c *gin.Context) {
 	}
 	ctx := c.Request.Context()
 
-	if fetchResponse, err := h.ChClient.FetchMetricsGraph(ctx, params, query); err != nil {
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchMetricsGraph(ctx, params, query); err != nil {
 		log.Print(err)
 		c.Status(http.StatusNoContent)
 		return
@@ -265,6 +355,8 @@ func (h Handlers) GetMetricsGraph(c *gin.Context) {
 		response := MetricsGraphResponse{
 			Result: fetchResponse,
 		}
+		response.Note = c.GetString(IntervalNoteKey)
+		response.Resolution = c.GetString(ResolutionKey)
 		response.SetExecTime(c.GetTime("requestStartTime"))
 		c.JSON(http.StatusOK, response)
 	}
@@ -277,7 +369,7 @@ func (h Handlers) GetMetricsCpuTrends(c *gin.Context) {
 	}
 	ctx := c.Request.Context()
 
-	if fetchResponse, err := h.ChClient.FetchMetricsCpuTrend(ctx, params, query); err != nil {
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchMetricsCpuTrend(ctx, params, query); err != nil {
 		log.Print(err)
 		c.Status(http.StatusNoContent)
 		return
@@ -290,6 +382,393 @@ func (h Handlers) GetMetricsCpuTrends(c *gin.Context) {
 	}
 }
 
+func GetVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, VersionResponse{
+		Service:   common.ServiceName,
+		Version:   config.Version,
+		GitSHA:    config.GitSHA,
+		BuildTime: config.BuildTime,
+		GoVersion: runtime.Version(),
+	})
+}
+
+func (h Handlers) GetOnboardingReport(c *gin.Context) {
+	serviceId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid service id"})
+		return
+	}
+	params, _, err := parseParams(common.OnboardingReportParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	report, err := h.chClient(serviceId).FetchOnboardingReport(c.Request.Context(), serviceId, params)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to build onboarding report"})
+		return
+	}
+	readHostName := hostNameReader(c)
+	for idx := range report.Uploads {
+		report.Uploads[idx].HostName = readHostName(report.Uploads[idx].HostName)
+	}
+	response := OnboardingReportResponse{
+		Result: report,
+	}
+	response.SetExecTime(c.GetTime("requestStartTime"))
+	c.JSON(http.StatusOK, response)
+}
+
+// GetIntegrityAudit reports stacks records whose parent is missing from their (service, timestamp) slice
+func (h Handlers) GetIntegrityAudit(c *gin.Context) {
+	params, _, err := parseParams(common.IntegrityAuditParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	report, err := h.ChClient.AuditParentIntegrity(c.Request.Context(), params)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to audit parent integrity"})
+		return
+	}
+	response := IntegrityAuditResponse{
+		Result: report,
+	}
+	response.SetExecTime(c.GetTime("requestStartTime"))
+	c.JSON(http.StatusOK, response)
+}
+
+const (
+	exportCursorTrailer = "X-Next-Cursor"
+	exportFlushEvery    = 1000
+)
+
+// ExportSamples streams a page of raw stacks records of a service as NDJSON. The cursor of the next page
+// is sent in the X-Next-Cursor trailer, it is empty on the last page.
+func (h Handlers) ExportSamples(c *gin.Context) {
+	params, _, err := parseParams(common.ExportSamplesParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	var cursor *db.ExportCursor
+	if params.Cursor != "" {
+		decoded, err := db.DecodeExportCursor(params.Cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		cursor = &decoded
+	}
+
+	c.Header("Trailer", exportCursorTrailer)
+	encoder := json.NewEncoder(c.Writer)
+	readHostName := hostNameReader(c)
+	exported := 0
+	next, err := h.chClient(params.ServiceId).ExportSamples(c.Request.Context(), params, cursor, func(sample common.ExportSample) error {
+		if exported == 0 {
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Status(http.StatusOK)
+		}
+		exported += 1
+		if exported%exportFlushEvery == 0 {
+			c.Writer.Flush()
+		}
+		sample.HostName = readHostName(sample.HostName)
+		return encoder.Encode(sample)
+	})
+	if err != nil {
+		log.Printf("export of service %d failed after %d record(s): %v", params.ServiceId, exported, err)
+		if exported == 0 {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to export samples"})
+		} else {
+			// the status is already sent, a missing trailer tells the client the page is incomplete
+			c.Abort()
+		}
+		return
+	}
+	if exported == 0 {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		c.Writer.WriteHeaderNow()
+	}
+	nextCursor := ""
+	if next != nil {
+		nextCursor = next.Encode()
+	}
+	c.Writer.Header().Set(exportCursorTrailer, nextCursor)
+}
+
+// tailCursor is the end of the next tail window, the rows inserted before it are flushed by the indexer
+func tailCursor(now time.Time, settleDelay time.Duration) time.Time {
+	return now.UTC().Add(-settleDelay).Truncate(time.Second)
+}
+
+// TailSamples streams (SSE) per minute totals and top frames of newly inserted samples of a service
+func (h Handlers) TailSamples(c *gin.Context) {
+	params, _, err := parseParams(common.TailParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	ctx := c.Request.Context()
+	settleDelay := time.Duration(config.TailSettleDelay) * time.Second
+	since := tailCursor(time.Now(), settleDelay).Add(-time.Minute)
+	ticker := time.NewTicker(time.Duration(params.PollInterval) * time.Second)
+	defer ticker.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		until := tailCursor(time.Now(), settleDelay)
+		minutes, fetchErr := h.chClient(params.ServiceId).FetchTailMinutes(ctx, params, since, until)
+		if fetchErr != nil {
+			log.Printf("tail of service %d failed: %v", params.ServiceId, fetchErr)
+			c.SSEvent("error", gin.H{"error": "unable to fetch samples"})
+		} else {
+			since = until
+			for _, minute := range minutes {
+				c.SSEvent("samples", minute)
+			}
+			if len(minutes) == 0 {
+				c.SSEvent("heartbeat", gin.H{"since": since})
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			return true
+		}
+	})
+}
+
+func (h Handlers) GetTableSuffix(c *gin.Context) {
+	c.JSON(http.StatusOK, TableSuffixResponse{Suffix: config.TableSuffix()})
+}
+
+// SwitchTableSuffix switches all queries over to the tables of another schema version and persists the switch,
+// unless forced the switch is refused while any of the new tables is missing
+func (h Handlers) SwitchTableSuffix(c *gin.Context) {
+	body := common.TableSuffixParams{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := config.ValidateTableSuffix(body.Suffix); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !body.Force {
+		missing, err := h.ChClient.MissingTables(c.Request.Context(), body.Suffix)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(missing) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "missing tables", "tables": missing})
+			return
+		}
+	}
+	previous := config.TableSuffix()
+	if err := config.PersistTableSuffix(body.Suffix); errors.Is(err, config.ErrTableSuffixNotPersisted) {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("switched table suffix from %q to %q", previous, body.Suffix)
+	c.JSON(http.StatusOK, TableSuffixResponse{Suffix: body.Suffix})
+}
+
+func (h Handlers) GetCpuAttribution(c *gin.Context) {
+	params, query, err := parseParams(common.CpuAttributionParams{}, QueryParser, c)
+	if err != nil {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchCpuAttribution(ctx, params, query); err != nil {
+		log.Print(err)
+		c.Status(http.StatusNoContent)
+		return
+	} else {
+		response := CpuAttributionResponse{
+			Result: fetchResponse,
+		}
+		response.Note = c.GetString(IntervalNoteKey)
+		response.Resolution = c.GetString(ResolutionKey)
+		response.SetExecTime(c.GetTime("requestStartTime"))
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func (h Handlers) GetSymbolQuality(c *gin.Context) {
+	params, _, err := parseParams(common.SymbolQualityParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchSymbolQuality(ctx, params); err != nil {
+		log.Print(err)
+		c.Status(http.StatusNoContent)
+		return
+	} else {
+		response := SymbolQualityResponse{
+			Result: fetchResponse,
+		}
+		response.Note = c.GetString(IntervalNoteKey)
+		response.Resolution = c.GetString(ResolutionKey)
+		response.SetExecTime(c.GetTime("requestStartTime"))
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func (h Handlers) GetAnomalies(c *gin.Context) {
+	params, _, err := parseParams(common.AnomaliesParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchAnomalies(ctx, params); err != nil {
+		log.Print(err)
+		c.Status(http.StatusNoContent)
+		return
+	} else {
+		response := AnomaliesResponse{
+			Result: fetchResponse,
+		}
+		response.Note = c.GetString(IntervalNoteKey)
+		response.Resolution = c.GetString(ResolutionKey)
+		response.SetExecTime(c.GetTime("requestStartTime"))
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func (h Handlers) GetFrameHistory(c *gin.Context) {
+	params, _, err := parseParams(common.FrameHistoryParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchFrameHistory(ctx, params); err != nil {
+		log.Print(err)
+		c.Status(http.StatusNoContent)
+		return
+	} else {
+		response := FrameHistoryResponse{
+			Result: fetchResponse,
+		}
+		response.SetExecTime(c.GetTime("requestStartTime"))
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func (h Handlers) GetTopMovers(c *gin.Context) {
+	params, _, err := parseParams(common.TopMoversParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchTopMovers(ctx, params); err != nil {
+		log.Print(err)
+		c.Status(http.StatusNoContent)
+		return
+	} else {
+		response := TopMoversResponse{
+			Result:         fetchResponse,
+			PreviousPeriod: []time.Time{db.PreviousPeriodStart(params.StartDateTime, params.EndDateTime), params.StartDateTime},
+		}
+		response.SetExecTime(c.GetTime("requestStartTime"))
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func (h Handlers) GetRecommendations(c *gin.Context) {
+	params, _, err := parseParams(common.RecommendationsParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchRecommendations(ctx, params); err != nil {
+		log.Print(err)
+		c.Status(http.StatusNoContent)
+		return
+	} else {
+		response := RecommendationsResponse{Result: fetchResponse}
+		response.SetExecTime(c.GetTime("requestStartTime"))
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func (h Handlers) GetCanaryComparison(c *gin.Context) {
+	params, _, err := parseParams(common.CanaryComparisonParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	if (len(params.HostName) == 0) == (params.HostTag == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "either canary_host or canary_tag is required"})
+		return
+	}
+	ctx := c.Request.Context()
+
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchCanaryComparison(ctx, params); err != nil {
+		log.Print(err)
+		c.Status(http.StatusNoContent)
+		return
+	} else {
+		response := CanaryComparisonResponse{
+			Result: fetchResponse,
+		}
+		response.SetExecTime(c.GetTime("requestStartTime"))
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func (h Handlers) GetColocation(c *gin.Context) {
+	params, _, err := parseParams(common.ColocationParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchColocation(ctx, params); err != nil {
+		log.Print(err)
+		c.Status(http.StatusNoContent)
+		return
+	} else {
+		response := ColocationResponse{
+			Result: fetchResponse,
+		}
+		response.SetExecTime(c.GetTime("requestStartTime"))
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func (h Handlers) GetNoisyNeighbors(c *gin.Context) {
+	params, _, err := parseParams(common.NoisyNeighborsParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchNoisyNeighbors(ctx, params); err != nil {
+		log.Print(err)
+		c.Status(http.StatusNoContent)
+		return
+	} else {
+		response := NoisyNeighborsResponse{
+			Result: fetchResponse,
+		}
+		response.SetExecTime(c.GetTime("requestStartTime"))
+		c.JSON(http.StatusOK, response)
+	}
+}
+
 func (h Handlers) GetLastHTML(c *gin.Context) {
 	params, query, err := parseParams(common.MetricsLastHTMLParams{}, MetricsQueryParser, c)
 	if err != nil {
@@ -297,7 +776,7 @@ func (h Handlers) GetLastHTML(c *gin.Context) {
 	}
 	fmt.Println(params, query)
 	ctx := c.Request.Context()
-	htmlPath, err := h.ChClient.FetchLastHTML(ctx, params, query)
+	htmlPath, err := h.chClient(params.ServiceId).FetchLastHTML(ctx, params, query)
 	if err != nil {
 		return
 	}
@@ -307,3 +786,72 @@ func (h Handlers) GetLastHTML(c *gin.Context) {
 	response.SetExecTime(c.GetTime("requestStartTime"))
 	c.JSON(http.StatusOK, response)
 }
+
+// PinTimeWindow keeps the raw stacks of a service time window beyond the retention of the stacks table,
+// for postmortems. The pinned stacks are read with pinned=true on the flamegraph endpoint.
+func (h Handlers) PinTimeWindow(c *gin.Context) {
+	body := common.PinParams{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !body.StartDateTime.Before(body.EndDateTime) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start_datetime must be before end_datetime"})
+		return
+	}
+	pin := common.Pin{
+		ServiceId:     body.ServiceId,
+		StartDateTime: body.StartDateTime.UTC(),
+		EndDateTime:   body.EndDateTime.UTC(),
+		Reason:        body.Reason,
+		CreatedBy:     c.GetString(gin.AuthUserKey),
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err := h.chClient(pin.ServiceId).PinTimeWindow(c.Request.Context(), pin); err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to pin time window"})
+		return
+	}
+	log.Printf("pinned service %d from %s to %s", pin.ServiceId, pin.StartDateTime, pin.EndDateTime)
+	c.JSON(http.StatusOK, pin)
+}
+
+func (h Handlers) GetPins(c *gin.Context) {
+	params, _, err := parseParams(common.PinsParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	pins, err := h.chClient(params.ServiceId).FetchPins(c.Request.Context(), params.ServiceId)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to fetch pins"})
+		return
+	}
+	response := PinsResponse{
+		Result: pins,
+	}
+	response.SetExecTime(c.GetTime("requestStartTime"))
+	c.JSON(http.StatusOK, response)
+}
+
+func (h Handlers) GetQualityScore(c *gin.Context) {
+	params, _, err := parseParams(common.QualityScoreParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if fetchResponse, err := h.chClient(params.ServiceId).FetchQualityScore(ctx, params); err != nil {
+		log.Print(err)
+		c.Status(http.StatusNoContent)
+		return
+	} else {
+		response := QualityScoreResponse{
+			Result: fetchResponse,
+		}
+		response.Note = c.GetString(IntervalNoteKey)
+		response.Resolution = c.GetString(ResolutionKey)
+		response.SetExecTime(c.GetTime("requestStartTime"))
+		c.JSON(http.StatusOK, response)
+	}
+}
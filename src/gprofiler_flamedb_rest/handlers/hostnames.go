@@ -0,0 +1,108 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"restflamedb/common"
+	"restflamedb/config"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HostNames encrypts the hostname filters and decrypts the hostnames returned to config.HostNameReaders,
+// it is nil unless hostname encryption is configured
+var HostNames *common.HostNameCipher
+
+// hostNameReader returns the function applied to the hostnames of a response, they are decrypted only
+// for the basic auth users listed in config.HostNameReaders
+func hostNameReader(c *gin.Context) func(string) string {
+	if HostNames != nil && isHostNameReader(c) {
+		return HostNames.Decrypt
+	}
+	return func(hostname string) string {
+		return hostname
+	}
+}
+
+// isHostNameReader reports whether the basic auth user of the request is listed in config.HostNameReaders
+func isHostNameReader(c *gin.Context) bool {
+	return isListedUser(c, config.HostNameReaders)
+}
+
+// errHostNamePattern rejects the hostname patterns when the hostnames are encrypted: a pattern never matches an
+// encrypted hostname, so an included pattern would match nothing and an excluded one would exclude nothing
+var errHostNamePattern = errors.New("hostname patterns can not match the encrypted hostnames, use full hostnames")
+
+// encryptHostNameParams encrypts the hostname query parameters of the params, if any
+func encryptHostNameParams(metaValue reflect.Value) error {
+	if HostNames == nil {
+		return nil
+	}
+	for _, field := range []string{"HostName", "ExcludeHostName"} {
+		hostNames := metaValue.FieldByName(field)
+		if !hostNames.IsValid() || hostNames.Kind() != reflect.Slice || hostNames.Type().Elem().Kind() != reflect.String {
+			continue
+		}
+		for idx := 0; idx < hostNames.Len(); idx++ {
+			hostName := hostNames.Index(idx).String()
+			if common.IsWildcard(hostName) {
+				return errHostNamePattern
+			}
+			hostNames.Index(idx).SetString(HostNames.Encrypt(hostName))
+		}
+	}
+	return nil
+}
+
+// encryptHostNameFilter encrypts the hostnames of a RQL filter. Only the equality operators match
+// encrypted hostnames, $like patterns never do.
+func encryptHostNameFilter(rawFilterData []byte) ([]byte, error) {
+	if HostNames == nil {
+		return rawFilterData, nil
+	}
+	var filter any
+	decoder := json.NewDecoder(bytes.NewReader(rawFilterData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&filter); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mapFilterHostNames(filter, false, HostNames.Encrypt))
+}
+
+// mapFilterHostNames applies mapping to the hostnames of a decoded RQL filter
+func mapFilterHostNames(value any, hostName bool, mapping func(string) string) any {
+	switch typed := value.(type) {
+	case map[string]any:
+		for key, child := range typed {
+			typed[key] = mapFilterHostNames(child, hostName || strings.EqualFold(key, "hostname"), mapping)
+		}
+	case []any:
+		for idx, child := range typed {
+			typed[idx] = mapFilterHostNames(child, hostName, mapping)
+		}
+	case string:
+		if hostName {
+			return mapping(typed)
+		}
+	}
+	return value
+}
@@ -0,0 +1,54 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"regexp"
+	"restflamedb/db"
+	"strings"
+)
+
+// inlinedSuffixRegex matches the frames the profilers mark as inlined into their caller (JIT inlining of the JVM)
+var inlinedSuffixRegex = regexp.MustCompile(`_\[i\](_\[s\])?$`)
+
+func isInlinedFrame(frame db.ResponseFrame) bool {
+	return strings.HasPrefix(frame.Suffix, "_[i]") || inlinedSuffixRegex.MatchString(frame.Name)
+}
+
+// CollapseInlinedFrames folds the inlined frames into the frame they were inlined into, as pprof does
+// without -inline: their children become children of their caller and the siblings of the same name are merged.
+// The samples of an inlined frame itself stay in its caller. Root frames are kept as they have no caller.
+func CollapseInlinedFrames(frames []db.ResponseFrame) []db.ResponseFrame {
+	collapsed := make([]db.ResponseFrame, 0, len(frames))
+	for _, frame := range frames {
+		frame.Children = collapseInlinedFrames(frame.Children, make([]db.ResponseFrame, 0))
+		collapsed = append(collapsed, frame)
+	}
+	return collapsed
+}
+
+func collapseInlinedFrames(frames []db.ResponseFrame, collapsed []db.ResponseFrame) []db.ResponseFrame {
+	for _, frame := range frames {
+		if isInlinedFrame(frame) {
+			collapsed = collapseInlinedFrames(frame.Children, collapsed)
+			continue
+		}
+		frame.Children = collapseInlinedFrames(frame.Children, make([]db.ResponseFrame, 0))
+		collapsed = mergeFrames(collapsed, []db.ResponseFrame{frame})
+	}
+	return collapsed
+}
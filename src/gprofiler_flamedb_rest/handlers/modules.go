@@ -0,0 +1,87 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"regexp"
+	"restflamedb/config"
+	"restflamedb/db"
+	"strings"
+)
+
+// Modules groups the frames of the flame graphs requested with group_by=module, it is nil unless module
+// rules are configured
+var Modules *ModuleGrouper
+
+type moduleRule struct {
+	pattern *regexp.Regexp
+	module  string
+}
+
+// ModuleGrouper maps frames to modules with the configured rules
+type ModuleGrouper struct {
+	rules         []moduleRule
+	defaultModule string
+}
+
+// globRegexp matches the whole frame name, "*" matches any sequence of characters, "/" and "." included
+func globRegexp(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+}
+
+func NewModuleGrouper(rules config.ModuleRules) *ModuleGrouper {
+	grouper := &ModuleGrouper{defaultModule: rules.DefaultModule}
+	for _, rule := range rules.Rules {
+		grouper.rules = append(grouper.rules, moduleRule{pattern: globRegexp(rule.Pattern), module: rule.Module})
+	}
+	return grouper
+}
+
+// Module returns the module of the first rule matching the frame
+func (mg *ModuleGrouper) Module(frame string) string {
+	for _, rule := range mg.rules {
+		if rule.pattern.MatchString(frame) {
+			return rule.module
+		}
+	}
+	return mg.defaultModule
+}
+
+// GroupFrames returns the module level tree of frames: frames are renamed to their module, a frame of the
+// module of its parent is merged into it and the siblings of the same module are merged together
+func (mg *ModuleGrouper) GroupFrames(frames []db.ResponseFrame) []db.ResponseFrame {
+	return mg.groupFrames(frames, "", make([]db.ResponseFrame, 0))
+}
+
+func (mg *ModuleGrouper) groupFrames(frames []db.ResponseFrame, parentModule string,
+	grouped []db.ResponseFrame) []db.ResponseFrame {
+	for _, frame := range frames {
+		module := mg.Module(frame.Name)
+		if module == parentModule {
+			// the samples of the frame itself stay in the parent, its children become children of the parent
+			grouped = mg.groupFrames(frame.Children, parentModule, grouped)
+			continue
+		}
+		node := db.ResponseFrame{
+			Name:     module,
+			Value:    frame.Value,
+			Children: mg.groupFrames(frame.Children, module, make([]db.ResponseFrame, 0)),
+		}
+		grouped = mergeFrames(grouped, []db.ResponseFrame{node})
+	}
+	return grouped
+}
@@ -0,0 +1,111 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"context"
+	"restflamedb/common"
+	"restflamedb/config"
+	"restflamedb/db"
+)
+
+// Residency routes the queries of the services bound to a residency region to the ClickHouse cluster
+// of the region, the other services are queried on the default cluster
+type Residency struct {
+	byService map[int]*db.ClickHouseClient
+	// clients are the clients of the regions, in the order of the residency file
+	clients []*db.ClickHouseClient
+}
+
+func NewResidency(regions []config.ResidencyRegion, connect func(addr string) *db.ClickHouseClient) *Residency {
+	residency := &Residency{byService: make(map[int]*db.ClickHouseClient)}
+	for _, region := range regions {
+		client := connect(region.ClickHouseAddr)
+		residency.clients = append(residency.clients, client)
+		for _, serviceId := range region.ServiceIds {
+			residency.byService[serviceId] = client
+		}
+	}
+	return residency
+}
+
+// chClient returns the client of the cluster storing the service. Queries spanning several services
+// (e.g. symbol quality of all the services) and the admin endpoints only use the default cluster.
+func (h Handlers) chClient(serviceId int) *db.ClickHouseClient {
+	if h.Residency != nil {
+		if client, ok := h.Residency.byService[serviceId]; ok {
+			return client
+		}
+	}
+	return h.ChClient
+}
+
+// chClients returns the default client followed by the clients of the regions
+func (h Handlers) chClients() []*db.ClickHouseClient {
+	clients := []*db.ClickHouseClient{h.ChClient}
+	if h.Residency != nil {
+		clients = append(clients, h.Residency.clients...)
+	}
+	return clients
+}
+
+// fetchServices lists the services of every cluster, a service is only taken from the cluster it is bound to
+// so that the records written before it was bound to a region are not listed twice
+func (h Handlers) fetchServices(ctx context.Context, params common.ServicesParams) []db.SrvResp {
+	clients := h.chClients()
+	if len(clients) == 1 {
+		return h.ChClient.FetchServices(ctx, params)
+	}
+	result := make([]db.SrvResp, 0)
+	for _, client := range clients {
+		for _, service := range client.FetchServices(ctx, params) {
+			if h.chClient(int(service.ServiceId)) == client {
+				result = append(result, service)
+			}
+		}
+	}
+	return result
+}
+
+// fetchMetricsServicesListSummary queries the services of every cluster on their own cluster
+func (h Handlers) fetchMetricsServicesListSummary(ctx context.Context,
+	params common.MetricsServicesListSummaryParams) ([]common.MetricsServicesListSummary, error) {
+	clients := h.chClients()
+	if len(clients) == 1 {
+		return h.ChClient.FetchMetricsServicesListSummary(ctx, params)
+	}
+	servicesByClient := make(map[*db.ClickHouseClient][]int)
+	for _, serviceId := range params.ServicesList {
+		client := h.chClient(serviceId)
+		servicesByClient[client] = append(servicesByClient[client], serviceId)
+	}
+	result := make([]common.MetricsServicesListSummary, 0)
+	for _, client := range clients {
+		services, ok := servicesByClient[client]
+		if !ok {
+			continue
+		}
+		clientParams := params
+		clientParams.ServicesList = services
+		summaries, err := client.FetchMetricsServicesListSummary(ctx, clientParams)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, summaries...)
+	}
+	return result, nil
+}
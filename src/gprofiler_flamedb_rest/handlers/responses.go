@@ -28,17 +28,38 @@ type ExecTimeInterface interface {
 
 type ExecTimeResponse struct {
 	ExecTime float64 `json:"exec_time"`
+	Note     string  `json:"note,omitempty"`
+	// Resolution is the resolution of the time series chosen from the max_points budget of the request
+	Resolution string `json:"resolution,omitempty"`
 }
 
 func (et *ExecTimeResponse) SetExecTime(start time.Time) {
 	et.ExecTime = float64(time.Since(start)) / float64(time.Second)
 }
 
+type VersionResponse struct {
+	Service   string `json:"service"`
+	Version   string `json:"version"`
+	GitSHA    string `json:"git_sha"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+type TableSuffixResponse struct {
+	Suffix string `json:"suffix"`
+}
+
 type QueryResponse struct {
 	Result []string `json:"result"`
 	ExecTimeResponse
 }
 
+type TimesResponse struct {
+	Result    []string               `json:"result"`
+	Anomalies []common.MetricAnomaly `json:"anomalies,omitempty"`
+	ExecTimeResponse
+}
+
 type AnyResponse struct {
 	Result any `json:"result"`
 	ExecTimeResponse
@@ -79,6 +100,11 @@ type InstanceTypeCountResponse struct {
 	ExecTimeResponse
 }
 
+type CardinalityResponse struct {
+	Result []common.DimensionCardinality `json:"result"`
+	ExecTimeResponse
+}
+
 type FieldValueSampleResponse struct {
 	Result []common.FilterData `json:"result"`
 	ExecTimeResponse
@@ -94,11 +120,106 @@ type MetricsCpuResponse struct {
 	ExecTimeResponse
 }
 
+type CpuAttributionResponse struct {
+	Result []common.CpuAttribution `json:"result"`
+	ExecTimeResponse
+}
+
+type SymbolQualityResponse struct {
+	Result []common.SymbolQuality `json:"result"`
+	ExecTimeResponse
+}
+
+type FrameHistoryResponse struct {
+	Result []common.FrameHistory `json:"result"`
+	ExecTimeResponse
+}
+
+type TopMoversResponse struct {
+	Result         []common.TopMover `json:"result"`
+	PreviousPeriod []time.Time       `json:"previous_period"`
+	ExecTimeResponse
+}
+
+type RecommendationsResponse struct {
+	Result []common.Recommendation `json:"result"`
+	ExecTimeResponse
+}
+
+type ColocationResponse struct {
+	Result common.Colocation `json:"result"`
+	ExecTimeResponse
+}
+
+type NoisyNeighborsResponse struct {
+	Result common.NoisyNeighbors `json:"result"`
+	ExecTimeResponse
+}
+
+type CanaryComparisonResponse struct {
+	Result []common.CanaryFrame `json:"result"`
+	ExecTimeResponse
+}
+
+type PinsResponse struct {
+	Result []common.Pin `json:"result"`
+	ExecTimeResponse
+}
+
+type ServiceMatrixResponse struct {
+	Result []common.ServiceIndicators `json:"result"`
+	ExecTimeResponse
+}
+
+type ShareLinkResponse struct {
+	Result common.ShareLink `json:"result"`
+	ExecTimeResponse
+}
+
+type QualityScoreResponse struct {
+	Result common.QualityScore `json:"result"`
+	ExecTimeResponse
+}
+
+type AnomaliesResponse struct {
+	Result []common.AnomalySummary `json:"result"`
+	ExecTimeResponse
+}
+
+type AuditLogResponse struct {
+	Result []common.AuditEntry `json:"result"`
+	ExecTimeResponse
+}
+
+type IntegrityAuditResponse struct {
+	Result common.IntegrityReport `json:"result"`
+	ExecTimeResponse
+}
+
+type OnboardingReportResponse struct {
+	Result common.OnboardingReport `json:"result"`
+	ExecTimeResponse
+}
+
 type MetricsHTMLResponse struct {
 	Result string `json:"result"`
 	ExecTimeResponse
 }
 
+type FederatedFlameGraphResponse struct {
+	Name     string               `json:"name"`
+	Value    int                  `json:"value"`
+	Children []db.ResponseFrame   `json:"children"`
+	Regions  []RegionContribution `json:"regions"`
+	ExecTimeResponse
+}
+
+type FederatedQueryResponse struct {
+	Result  any                  `json:"result"`
+	Regions []RegionContribution `json:"regions"`
+	ExecTimeResponse
+}
+
 type FlameGraphResponse struct {
 	Name     string             `json:"name"`
 	Value    int                `json:"value"`
@@ -106,4 +227,15 @@ type FlameGraphResponse struct {
 	ExecTimeResponse
 	OlapTime    float64           `json:"olap_time"`
 	Percentiles map[string]string `json:"percentiles"`
+	// Hosts are the hosts of the requested percentile band, busiest first
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// LiteFlameGraphResponse is the detail=lite flame graph, Truncated is set when frames were left out
+type LiteFlameGraphResponse struct {
+	Name      string         `json:"n"`
+	Value     int            `json:"v"`
+	Children  []db.LiteFrame `json:"c"`
+	Truncated bool           `json:"truncated"`
+	ExecTimeResponse
 }
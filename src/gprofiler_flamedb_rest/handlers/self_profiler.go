@@ -0,0 +1,123 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"restflamedb/common"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SelfProfiler periodically collects CPU profiles of the REST service itself and posts them to the pprof
+// ingestion endpoint of an indexer, which writes them like any other profile under the given service name
+type SelfProfiler struct {
+	url      string
+	token    string
+	service  string
+	hostname string
+	interval time.Duration
+	duration time.Duration
+	client   *http.Client
+}
+
+func NewSelfProfiler(indexerURL string, token string, service string, interval time.Duration,
+	duration time.Duration) *SelfProfiler {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = common.ServiceName
+	}
+	if duration > interval {
+		duration = interval
+	}
+	return &SelfProfiler{
+		url:      strings.TrimSuffix(indexerURL, "/") + "/ingest/pprof",
+		token:    token,
+		service:  service,
+		hostname: hostname,
+		interval: interval,
+		duration: duration,
+		client:   &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Run profiles the service every interval until ctx is done
+func (sp *SelfProfiler) Run(ctx context.Context) {
+	ticker := time.NewTicker(sp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sp.collect(ctx); err != nil {
+				log.Printf("self profiling failed: %v", err)
+			}
+		}
+	}
+}
+
+func (sp *SelfProfiler) collect(ctx context.Context) error {
+	var buf bytes.Buffer
+	timestamp := time.Now().UTC()
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(sp.duration):
+	}
+	pprof.StopCPUProfile()
+	return sp.send(ctx, buf.Bytes(), timestamp)
+}
+
+// send posts a gzipped pprof profile as runtime/pprof writes them
+func (sp *SelfProfiler) send(ctx context.Context, profile []byte, timestamp time.Time) error {
+	query := url.Values{
+		"service":   {sp.service},
+		"hostname":  {sp.hostname},
+		"process":   {common.ServiceName},
+		"timestamp": {strconv.FormatInt(timestamp.Unix(), 10)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sp.url+"?"+query.Encode(), bytes.NewReader(profile))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if sp.token != "" {
+		req.Header.Set("Authorization", "Bearer "+sp.token)
+	}
+	resp, err := sp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"restflamedb/common"
+	"restflamedb/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withShares returns the function with its shares of the root samples of the service
+func withShares(function common.TopFunction, samples int) *common.TopFunction {
+	if samples > 0 {
+		function.SelfShare = float64(function.SelfSamples) * 100 / float64(samples)
+		function.TotalShare = float64(function.TotalSamples) * 100 / float64(samples)
+	}
+	return &function
+}
+
+// GetServiceMatrix returns the key indicators of a list of services, for the organization overviews: average
+// host CPU, root samples and their week over week deltas, and top function by self samples
+func (h Handlers) GetServiceMatrix(c *gin.Context) {
+	params, _, err := parseParams(common.ServiceMatrixParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	ctx := c.Request.Context()
+
+	servicesByClient := make(map[*db.ClickHouseClient][]int)
+	for _, serviceId := range params.ServiceIds {
+		client := h.chClient(serviceId)
+		servicesByClient[client] = append(servicesByClient[client], serviceId)
+	}
+	indicators := make(map[int]common.ServiceIndicators, len(params.ServiceIds))
+	for client, serviceIds := range servicesByClient {
+		clientIndicators, err := client.FetchServiceIndicators(ctx, serviceIds, params.StartDateTime,
+			params.EndDateTime)
+		if err != nil {
+			log.Print(err)
+			c.Status(http.StatusNoContent)
+			return
+		}
+		withSamples := make([]int, 0, len(clientIndicators))
+		for _, service := range clientIndicators {
+			indicators[service.ServiceId] = service
+			if service.Samples > 0 {
+				withSamples = append(withSamples, service.ServiceId)
+			}
+		}
+		if len(withSamples) == 0 {
+			continue
+		}
+		functions, err := client.FetchTopFunctions(ctx, withSamples, params.StartDateTime, params.EndDateTime)
+		if err != nil {
+			log.Printf("unable to find the top functions of services %v: %v", withSamples, err)
+			continue
+		}
+		for serviceId, function := range functions {
+			service := indicators[serviceId]
+			service.TopFunction = withShares(function, service.Samples)
+			indicators[serviceId] = service
+		}
+	}
+
+	result := make([]common.ServiceIndicators, 0, len(params.ServiceIds))
+	for _, serviceId := range params.ServiceIds {
+		result = append(result, indicators[serviceId])
+	}
+
+	response := ServiceMatrixResponse{Result: result}
+	response.SetExecTime(c.GetTime("requestStartTime"))
+	c.JSON(http.StatusOK, response)
+}
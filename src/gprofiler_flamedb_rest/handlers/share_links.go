@@ -0,0 +1,166 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"restflamedb/common"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SharedFlamegraphPath serves the shared flame graph views, it is registered before the auth middleware
+const SharedFlamegraphPath = "/api/v1/shared/flamegraph"
+
+const minShareLinkKeyLength = 16
+
+var (
+	ErrInvalidShareToken = errors.New("invalid share token")
+	ErrExpiredShareToken = errors.New("expired share token")
+)
+
+// shareClaims are the signed content of a share token, the query string of the shared flame graph view
+type shareClaims struct {
+	Query   string `json:"q"`
+	Expires int64  `json:"exp"`
+	Issuer  string `json:"iss"`
+}
+
+// ShareLinks signs the flame graph queries shared with users without credentials. A token is the base64 JSON
+// claims followed by their HMAC-SHA256, it grants a read-only access to a single query until it expires.
+type ShareLinks struct {
+	key        []byte
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+}
+
+// NewShareLinks returns nil when key is empty
+func NewShareLinks(key string, defaultTTL time.Duration, maxTTL time.Duration) (*ShareLinks, error) {
+	if key == "" {
+		return nil, nil
+	}
+	if len(key) < minShareLinkKeyLength {
+		return nil, fmt.Errorf("share link key must be at least %d characters long", minShareLinkKeyLength)
+	}
+	if defaultTTL <= 0 || defaultTTL > maxTTL {
+		return nil, fmt.Errorf("share link default lifetime must be positive and at most %v", maxTTL)
+	}
+	return &ShareLinks{key: []byte(key), defaultTTL: defaultTTL, maxTTL: maxTTL}, nil
+}
+
+func (s *ShareLinks) mac(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *ShareLinks) sign(claims shareClaims) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + s.mac(payload), nil
+}
+
+func (s *ShareLinks) verify(token string, now time.Time) (shareClaims, error) {
+	var claims shareClaims
+	payload, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(s.mac(payload))) {
+		return claims, ErrInvalidShareToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return claims, ErrInvalidShareToken
+	}
+	if err = json.Unmarshal(data, &claims); err != nil {
+		return claims, ErrInvalidShareToken
+	}
+	if now.Unix() >= claims.Expires {
+		return claims, ErrExpiredShareToken
+	}
+	return claims, nil
+}
+
+// CreateShareLink signs a flame graph query for the users without credentials. The query is validated
+// as the /api/v1/flamegraph endpoint would, with the hostnames of its filters as given by the creator.
+func (h Handlers) CreateShareLink(c *gin.Context) {
+	body := common.ShareLinkParams{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ttl := h.ShareLinks.defaultTTL
+	if body.ExpiresIn > 0 {
+		ttl = time.Duration(body.ExpiresIn) * time.Second
+	}
+	if ttl > h.ShareLinks.maxTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in must be at most %d seconds",
+			int(h.ShareLinks.maxTTL.Seconds()))})
+		return
+	}
+	values, err := url.ParseQuery(strings.TrimPrefix(body.Query, "?"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, _, _, err = bindParams(common.FlameGraphParams{}, QueryParser, values); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl).UTC().Truncate(time.Second)
+	token, err := h.ShareLinks.sign(shareClaims{
+		Query:   values.Encode(),
+		Expires: expiresAt.Unix(),
+		Issuer:  c.GetString(gin.AuthUserKey),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	response := ShareLinkResponse{Result: common.ShareLink{
+		Token:     token,
+		URL:       SharedFlamegraphPath + "?token=" + url.QueryEscape(token),
+		ExpiresAt: expiresAt,
+	}}
+	response.SetExecTime(c.GetTime("requestStartTime"))
+	c.JSON(http.StatusOK, response)
+}
+
+// GetSharedFlamegraph serves the flame graph query of a share token. The hostnames are returned as stored,
+// whatever the hostname permissions of the creator.
+func (h Handlers) GetSharedFlamegraph(c *gin.Context) {
+	claims, err := h.ShareLinks.verify(c.Request.URL.Query().Get("token"), time.Now())
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	// recorded by the audit log as the user, the token itself is not
+	c.Set(gin.AuthUserKey, "share:"+claims.Issuer)
+	c.Request.URL.RawQuery = claims.Query
+	h.GetFlamegraph(c)
+}
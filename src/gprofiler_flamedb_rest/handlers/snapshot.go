@@ -0,0 +1,214 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"restflamedb/common"
+	"restflamedb/db"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DashboardSnapshot is the state of the dashboard of a service, bundled for incident reviews
+type DashboardSnapshot struct {
+	ServiceId      int                   `json:"service_id"`
+	StartDateTime  time.Time             `json:"start_datetime"`
+	EndDateTime    time.Time             `json:"end_datetime"`
+	CreatedAt      time.Time             `json:"created_at"`
+	Flamegraph     FlameGraphResponse    `json:"-"`
+	MetricsSummary common.MetricsSummary `json:"-"`
+	TopFunctions   []common.TopFunction  `json:"-"`
+}
+
+var snapshotTemplate = template.Must(template.New("snapshot").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Service {{.ServiceId}} snapshot</title></head>
+<body>
+<h1>Service {{.ServiceId}}</h1>
+<p>{{.StartDateTime.Format "2006-01-02T15:04:05Z"}} to {{.EndDateTime.Format "2006-01-02T15:04:05Z"}},
+{{.Flamegraph.Value}} samples, snapshot taken {{.CreatedAt.Format "2006-01-02T15:04:05Z"}}</p>
+<h2>Metrics</h2>
+<table>
+<tr><th>Average CPU</th><td>{{printf "%.2f" .MetricsSummary.AvgCpu}}%</td></tr>
+<tr><th>Max CPU</th><td>{{printf "%.2f" .MetricsSummary.MaxCpu}}%</td></tr>
+<tr><th>Average memory</th><td>{{printf "%.2f" .MetricsSummary.AvgMemory}}%</td></tr>
+<tr><th>Max memory</th><td>{{printf "%.2f" .MetricsSummary.MaxMemory}}%</td></tr>
+<tr><th>Hosts</th><td>{{.MetricsSummary.UniqHostnames}}</td></tr>
+</table>
+<h2>Top functions</h2>
+<table>
+<tr><th>Function</th><th>Self</th><th>Total</th></tr>
+{{range .TopFunctions}}<tr><td>{{.Name}}</td><td>{{printf "%.2f" .SelfShare}}%</td><td>{{printf "%.2f" .TotalShare}}%</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// topFunctions returns the functions with the most self samples. The total samples of a function are
+// counted once per stack, recursive calls included.
+func topFunctions(frames []db.ResponseFrame, total int, limit int) []common.TopFunction {
+	self := make(map[string]int)
+	totals := make(map[string]int)
+	onStack := make(map[string]int)
+	var walk func(frames []db.ResponseFrame)
+	walk = func(frames []db.ResponseFrame) {
+		for _, frame := range frames {
+			if onStack[frame.Name] == 0 {
+				totals[frame.Name] += frame.Value
+			}
+			onStack[frame.Name] += 1
+			childrenValue := 0
+			for _, child := range frame.Children {
+				childrenValue += child.Value
+			}
+			if frame.Value > childrenValue {
+				self[frame.Name] += frame.Value - childrenValue
+			}
+			walk(frame.Children)
+			onStack[frame.Name] -= 1
+		}
+	}
+	walk(frames)
+
+	result := make([]common.TopFunction, 0, len(self))
+	for name, samples := range self {
+		function := common.TopFunction{Name: name, SelfSamples: samples, TotalSamples: totals[name]}
+		if total > 0 {
+			function.SelfShare = float64(samples) * 100 / float64(total)
+			function.TotalShare = float64(totals[name]) * 100 / float64(total)
+		}
+		result = append(result, function)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].SelfSamples != result[j].SelfSamples {
+			return result[i].SelfSamples > result[j].SelfSamples
+		}
+		return result[i].Name < result[j].Name
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+// Archive bundles the snapshot in a zip archive of JSON files, with a static HTML summary when withHTML is set
+func (ds DashboardSnapshot) Archive(withHTML bool) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	files := []struct {
+		name    string
+		content any
+	}{
+		{"snapshot.json", ds},
+		{"flamegraph.json", ds.Flamegraph},
+		{"metrics_summary.json", ds.MetricsSummary},
+		{"top_functions.json", ds.TopFunctions},
+	}
+	for _, file := range files {
+		writer, err := archive.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.NewEncoder(writer).Encode(file.content); err != nil {
+			return nil, err
+		}
+	}
+	if withHTML {
+		writer, err := archive.Create("index.html")
+		if err != nil {
+			return nil, err
+		}
+		if err = snapshotTemplate.Execute(writer, ds); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GetDashboardSnapshot returns the flame graph, metrics summary and top functions of a service as a zip archive
+func (h Handlers) GetDashboardSnapshot(c *gin.Context) {
+	params, _, err := parseParams(common.DashboardSnapshotParams{}, nil, c)
+	if err != nil {
+		return
+	}
+	values := c.Request.URL.Query()
+	values.Set("format", "flamegraph")
+	flamegraphParams, flamegraphQuery, _, err := bindParams(common.FlameGraphParams{}, QueryParser, values)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	metricsParams, metricsQuery, _, err := bindParams(common.MetricsSummaryParams{}, MetricsQueryParser, values)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	chClient := h.chClient(params.ServiceId)
+	graph, err := chClient.GetTopFrames(ctx, flamegraphParams, flamegraphQuery)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to build flamegraph"})
+		return
+	}
+	metricsSummary, err := chClient.FetchMetricsSummary(ctx, metricsParams, metricsQuery)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to fetch metrics summary"})
+		return
+	}
+
+	total, frames := graph.BuildFlameGraph()
+	snapshot := DashboardSnapshot{
+		ServiceId:     params.ServiceId,
+		StartDateTime: flamegraphParams.StartDateTime,
+		EndDateTime:   flamegraphParams.EndDateTime,
+		CreatedAt:     time.Now().UTC(),
+		Flamegraph: FlameGraphResponse{
+			Name:        "root",
+			Value:       total,
+			Children:    frames,
+			Percentiles: graph.GetPercentiles(),
+		},
+		MetricsSummary: metricsSummary,
+		TopFunctions:   topFunctions(frames, total, params.TopFunctions),
+	}
+	snapshot.Flamegraph.SetExecTime(c.GetTime("requestStartTime"))
+	archive, err := snapshot.Archive(params.HTML)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to build snapshot archive"})
+		return
+	}
+	filename := fmt.Sprintf("service-%d-%s.zip", params.ServiceId,
+		flamegraphParams.StartDateTime.Format("20060102T150405"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(http.StatusOK, "application/zip", archive)
+}
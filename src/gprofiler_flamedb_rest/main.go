@@ -17,12 +17,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
 	"restflamedb/common"
 	"restflamedb/config"
 	"restflamedb/db"
 	"restflamedb/handlers"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/gzip"
@@ -30,6 +33,7 @@ import (
 )
 
 func main() {
+	var check bool
 	flag.StringVar(&config.ClickHouseAddr, "clickhouse-addr",
 		common.LookupEnvOrDefault("CLICKHOUSE_ADDR", config.ClickHouseAddr),
 		"ClickHouse address like 127.0.0.1:9000")
@@ -63,25 +67,251 @@ func main() {
 	flag.IntVar(&config.DailyRetentionDays, "daily-retention-days",
 		common.LookupEnvOrDefault("DAILY_RETENTION_DAYS", config.DailyRetentionDays),
 		"Daily aggregation retention period in days")
+	flag.BoolVar(&config.SelfProfilingEnabled, "self-profiling-enabled",
+		common.LookupEnvOrDefault("SELF_PROFILING_ENABLED", config.SelfProfilingEnabled),
+		"Periodically profile the service itself (default false)")
+	flag.StringVar(&config.SelfProfilingServiceName, "self-profiling-service-name",
+		common.LookupEnvOrDefault("SELF_PROFILING_SERVICE_NAME", config.SelfProfilingServiceName),
+		"Service name to store self profiles under (default gprofiler-internal)")
+	flag.StringVar(&config.SelfProfilingIndexerURL, "self-profiling-indexer-url",
+		common.LookupEnvOrDefault("SELF_PROFILING_INDEXER_URL", config.SelfProfilingIndexerURL),
+		"Admin server URL of the indexer ingesting the self profiles, e.g. http://indexer:8090 (default empty)")
+	flag.StringVar(&config.SelfProfilingIndexerToken, "self-profiling-indexer-token",
+		common.LookupEnvOrDefault("SELF_PROFILING_INDEXER_TOKEN", config.SelfProfilingIndexerToken),
+		"Ingest token of the indexer ingesting the self profiles (default empty)")
+	flag.IntVar(&config.SelfProfilingInterval, "self-profiling-interval",
+		common.LookupEnvOrDefault("SELF_PROFILING_INTERVAL", config.SelfProfilingInterval),
+		"Seconds between self profiling sessions")
+	flag.IntVar(&config.SelfProfilingDuration, "self-profiling-duration",
+		common.LookupEnvOrDefault("SELF_PROFILING_DURATION", config.SelfProfilingDuration),
+		"Duration of a self profiling session in seconds")
+	flag.StringVar(&config.ClickHouseTableSuffix, "clickhouse-table-suffix",
+		common.LookupEnvOrDefault("CLICKHOUSE_TABLE_SUFFIX", config.ClickHouseTableSuffix),
+		"Schema version suffix of the ClickHouse tables (default empty)")
+	flag.StringVar(&config.TableSuffixFile, "table-suffix-file",
+		common.LookupEnvOrDefault("TABLE_SUFFIX_FILE", config.TableSuffixFile),
+		"File persisting the table suffix switched on /api/v1/admin/table_suffix, shared by the replicas "+
+			"(default empty, the suffix is not switched at runtime)")
+	flag.IntVar(&config.TableSuffixReloadInterval, "table-suffix-reload-interval",
+		common.LookupEnvOrDefault("TABLE_SUFFIX_RELOAD_INTERVAL", config.TableSuffixReloadInterval),
+		"Seconds between reloads of the table suffix file")
+	flag.StringVar(&config.AdminUsers, "admin-users",
+		common.LookupEnvOrDefault("ADMIN_USERS", config.AdminUsers),
+		"Comma separated basic auth users allowed on the /api/v1/admin endpoints (default empty)")
+	flag.StringVar(&config.ClickHouseSymbolQualityTable, "clickhouse-symbol-quality-table",
+		common.LookupEnvOrDefault("CLICKHOUSE_SYMBOL_QUALITY_TABLE", config.ClickHouseSymbolQualityTable),
+		"ClickHouse symbol quality table (default flamedb.symbol_quality)")
+	flag.StringVar(&config.ClickHouseAnomaliesTable, "clickhouse-anomalies-table",
+		common.LookupEnvOrDefault("CLICKHOUSE_ANOMALIES_TABLE", config.ClickHouseAnomaliesTable),
+		"ClickHouse data quality anomalies table (default flamedb.anomalies)")
+	flag.StringVar(&config.ClickHouseStacksPinnedTable, "clickhouse-stacks-pinned-table",
+		common.LookupEnvOrDefault("CLICKHOUSE_STACKS_PINNED_TABLE", config.ClickHouseStacksPinnedTable),
+		"ClickHouse table of the raw stacks of the pinned time windows (default flamedb.samples_pinned)")
+	flag.StringVar(&config.ClickHousePinsTable, "clickhouse-pins-table",
+		common.LookupEnvOrDefault("CLICKHOUSE_PINS_TABLE", config.ClickHousePinsTable),
+		"ClickHouse table of the pinned time windows (default flamedb.pins)")
+	flag.StringVar(&config.ClickHouseSidecarsTable, "clickhouse-sidecars-table",
+		common.LookupEnvOrDefault("CLICKHOUSE_SIDECARS_TABLE", config.ClickHouseSidecarsTable),
+		"ClickHouse table of the containers classified as sidecars (default flamedb.sidecar_containers)")
+	flag.IntVar(&config.IntegrityAuditInterval, "integrity-audit-interval",
+		common.LookupEnvOrDefault("INTEGRITY_AUDIT_INTERVAL", config.IntegrityAuditInterval),
+		"Seconds between audits of the stacks parent pointers, 0 to disable")
+	flag.IntVar(&config.IntegrityAuditLookback, "integrity-audit-lookback",
+		common.LookupEnvOrDefault("INTEGRITY_AUDIT_LOOKBACK", config.IntegrityAuditLookback),
+		"Seconds of raw stacks checked by every integrity audit")
+	flag.IntVar(&config.TailSettleDelay, "tail-settle-delay",
+		common.LookupEnvOrDefault("TAIL_SETTLE_DELAY", config.TailSettleDelay),
+		"Seconds after their insertion the samples are tailed, above the stacks flush timeout of the indexer")
+	flag.IntVar(&config.TailMaxLateness, "tail-max-lateness",
+		common.LookupEnvOrDefault("TAIL_MAX_LATENESS", config.TailMaxLateness),
+		"Seconds between the timestamp and the insertion of the latest samples tailed, older ones are left out")
+	flag.StringVar(&config.FederationRegions, "federation-regions",
+		common.LookupEnvOrDefault("FEDERATION_REGIONS", config.FederationRegions),
+		"Regional REST instances federated queries fan out to, as name=url,name=url (default empty)")
+	flag.IntVar(&config.FederationTimeout, "federation-timeout",
+		common.LookupEnvOrDefault("FEDERATION_TIMEOUT", config.FederationTimeout),
+		"Timeout in seconds of a federated query to a region")
+	flag.IntVar(&config.MaxTimeSeriesPoints, "max-time-series-points",
+		common.LookupEnvOrDefault("MAX_TIME_SERIES_POINTS", config.MaxTimeSeriesPoints),
+		"Maximum number of points of a time series, finer intervals are coarsened, 0 to disable")
+	flag.IntVar(&config.LiteFlameGraphMaxBytes, "lite-flamegraph-max-bytes",
+		common.LookupEnvOrDefault("LITE_FLAMEGRAPH_MAX_BYTES", config.LiteFlameGraphMaxBytes),
+		"Approximate maximum size of a detail=lite flame graph, the lightest frames are left out, 0 to disable")
+	flag.IntVar(&config.LiteFlameGraphMaxDepth, "lite-flamegraph-max-depth",
+		common.LookupEnvOrDefault("LITE_FLAMEGRAPH_MAX_DEPTH", config.LiteFlameGraphMaxDepth),
+		"Maximum depth of a detail=lite flame graph, 0 to disable")
+	flag.BoolVar(&config.DemangleFrames, "demangle-frames",
+		common.LookupEnvOrDefault("DEMANGLE_FRAMES", config.DemangleFrames),
+		"Demangle the C++, Rust and Go symbols of the flame graph frames, unless raw_names=true is requested")
+	flag.IntVar(&config.MetricAnomalyThreshold, "metric-anomaly-threshold",
+		common.LookupEnvOrDefault("METRIC_ANOMALY_THRESHOLD", config.MetricAnomalyThreshold),
+		"Standard deviations from the average of the time range flagging a metric anomaly, 0 to disable")
+	flag.IntVar(&config.QualityTargetSamplesPerMinute, "quality-target-samples-per-minute",
+		common.LookupEnvOrDefault("QUALITY_TARGET_SAMPLES_PER_MINUTE", config.QualityTargetSamplesPerMinute),
+		"Samples per host and minute of a service profiled at full density, for the quality score")
+	flag.IntVar(&config.MaxEnumerableValues, "max-enumerable-values",
+		common.LookupEnvOrDefault("MAX_ENUMERABLE_VALUES", config.MaxEnumerableValues),
+		"Distinct values above which a filter dimension is reported as not enumerable, 0 to disable")
+	flag.BoolVar(&config.GraphQLEnabled, "graphql-enabled",
+		common.LookupEnvOrDefault("GRAPHQL_ENABLED", config.GraphQLEnabled),
+		"Serve the GraphQL endpoint on /api/v1/graphql")
+	flag.StringVar(&config.HostNameEncryptionKey, "hostname-encryption-key",
+		common.LookupEnvOrDefault("HOSTNAME_ENCRYPTION_KEY", config.HostNameEncryptionKey),
+		"Key of the hostnames encrypted by the indexer (default empty)")
+	flag.StringVar(&config.HostNameReaders, "hostname-readers",
+		common.LookupEnvOrDefault("HOSTNAME_READERS", config.HostNameReaders),
+		"Comma separated basic auth users allowed to read the decrypted hostnames (default empty)")
+	flag.StringVar(&config.AuditLogFile, "audit-log-file",
+		common.LookupEnvOrDefault("AUDIT_LOG_FILE", config.AuditLogFile),
+		"File recording who queried which service and time range, as JSON lines (default empty, disabled)")
+	flag.StringVar(&config.ResidencyFile, "residency-file",
+		common.LookupEnvOrDefault("RESIDENCY_FILE", config.ResidencyFile),
+		"JSON file binding service ids to the ClickHouse cluster of their data residency region")
+	flag.StringVar(&config.ModuleRulesFile, "module-rules-file",
+		common.LookupEnvOrDefault("MODULE_RULES_FILE", config.ModuleRulesFile),
+		"JSON file of the rules mapping frames to modules, for the group_by=module flame graphs")
+	flag.StringVar(&config.ShareLinkKey, "share-link-key",
+		common.LookupEnvOrDefault("SHARE_LINK_KEY", config.ShareLinkKey),
+		"Key signing the share links of flame graph views, at least 16 characters (default empty, disabled)")
+	flag.IntVar(&config.ShareLinkDefaultTTL, "share-link-default-ttl",
+		common.LookupEnvOrDefault("SHARE_LINK_DEFAULT_TTL", config.ShareLinkDefaultTTL),
+		"Lifetime of the share links in hours, unless their creator asks for another one")
+	flag.IntVar(&config.ShareLinkMaxTTL, "share-link-max-ttl",
+		common.LookupEnvOrDefault("SHARE_LINK_MAX_TTL", config.ShareLinkMaxTTL),
+		"Maximum lifetime of the share links in hours")
+	flag.StringVar(&config.ArtifactsBucket, "artifacts-bucket",
+		common.LookupEnvOrDefault("ARTIFACTS_BUCKET", config.ArtifactsBucket),
+		"S3 bucket of the HTML artifacts served on /api/v1/artifacts/ (default empty, disabled)")
+	flag.StringVar(&config.AWSRegion, "aws-region", common.LookupEnvOrDefault("AWS_REGION", config.AWSRegion),
+		"AWS region of the artifacts bucket")
+	flag.StringVar(&config.AWSEndpoint, "aws-endpoint",
+		common.LookupEnvOrDefault("AWS_ENDPOINT_URL", config.AWSEndpoint),
+		"S3 endpoint override, e.g. for localstack")
+	flag.BoolVar(&check, "check", false, "Run startup dependency checks, print a report and exit")
 	flag.Parse()
 
+	if err := config.ValidateTableSuffix(config.ClickHouseTableSuffix); err != nil {
+		log.Fatal(err)
+	}
+	if err := config.ValidateSelfProfiling(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := config.LoadTableSuffixFile(); err != nil {
+		log.Fatalf("Error loading the table suffix file: %v", err)
+	}
+
+	preflightResults := db.RunPreflight(config.ClickHouseAddr)
+	if check {
+		if !db.PrintPreflightReport(os.Stdout, preflightResults) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	preflightFailed := false
+	for _, result := range preflightResults {
+		if result.Status == db.PreflightFail {
+			log.Printf("preflight check %s failed: %s", result.Name, result.Detail)
+			preflightFailed = true
+		} else if result.Status == db.PreflightWarn {
+			log.Printf("preflight check %s: %s", result.Name, result.Detail)
+		}
+	}
+	if preflightFailed {
+		log.Fatalf("preflight checks failed, run with -check for a full report")
+	}
+
+	hostNames, err := common.NewHostNameCipher(config.HostNameEncryptionKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	handlers.HostNames = hostNames
+	moduleRules, err := config.LoadModuleRules(config.ModuleRulesFile)
+	if err != nil {
+		log.Fatalf("Error loading module rules: %v", err)
+	}
+	if len(moduleRules.Rules) > 0 {
+		handlers.Modules = handlers.NewModuleGrouper(moduleRules)
+	}
+
 	h := handlers.Handlers{
 		ChClient: db.NewClickHouseClient(config.ClickHouseAddr),
 	}
+	regions, err := config.ParseFederationRegions(config.FederationRegions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(regions) > 0 {
+		h.Federation = handlers.NewFederation(regions, time.Duration(config.FederationTimeout)*time.Second)
+	}
+	if config.AuditLogFile != "" {
+		h.AuditLog, err = handlers.NewAuditLog(config.AuditLogFile)
+		if err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+	}
+	residencyRegions, err := config.LoadResidencyRegions(config.ResidencyFile)
+	if err != nil {
+		log.Fatalf("Error loading residency file: %v", err)
+	}
+	if len(residencyRegions) > 0 {
+		h.Residency = handlers.NewResidency(residencyRegions, db.NewClickHouseClient)
+	}
+	h.ShareLinks, err = handlers.NewShareLinks(config.ShareLinkKey,
+		time.Duration(config.ShareLinkDefaultTTL)*time.Hour, time.Duration(config.ShareLinkMaxTTL)*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.ArtifactsBucket != "" {
+		store, err := handlers.NewS3ArtifactStore(config.AWSRegion, config.AWSEndpoint)
+		if err != nil {
+			log.Fatalf("Error creating the artifacts store: %v", err)
+		}
+		h.Artifacts = handlers.NewArtifacts(store, config.ArtifactsBucket, residencyRegions)
+	}
+
+	if config.SelfProfilingEnabled {
+		go handlers.NewSelfProfiler(config.SelfProfilingIndexerURL, config.SelfProfilingIndexerToken,
+			config.SelfProfilingServiceName, time.Duration(config.SelfProfilingInterval)*time.Second,
+			time.Duration(config.SelfProfilingDuration)*time.Second).Run(context.Background())
+	}
+	if config.TableSuffixFile != "" && config.TableSuffixReloadInterval > 0 {
+		go reloadTableSuffix(time.Duration(config.TableSuffixReloadInterval) * time.Second)
+	}
+	if config.IntegrityAuditInterval > 0 {
+		go h.ChClient.RunIntegrityAudit(context.Background())
+	}
+
+	log.Printf("Starting %s version %s (git %s, built %s)", common.ServiceName, config.Version, config.GitSHA,
+		config.BuildTime)
 
 	router := gin.Default()
+	// registered before the auth middleware so it is reachable without credentials
+	router.GET("/version", handlers.GetVersion)
+
+	if h.ShareLinks != nil {
+		// the token authenticates the request, it is checked by the handler
+		shared := []gin.HandlerFunc{handlers.StartTime()}
+		if h.AuditLog != nil {
+			shared = append(shared, h.AuditLog.Middleware())
+		}
+		shared = append(shared, gzip.Gzip(gzip.DefaultCompression), h.GetSharedFlamegraph)
+		router.GET(handlers.SharedFlamegraphPath, shared...)
+	}
 
 	authorizedUsers, err := common.ParseCredentials(config.Credentials)
 	if err != nil {
 		log.Fatalf("Error parsing basic auth credentials: %v", err)
 	}
 	router.Use(gin.BasicAuth(authorizedUsers))
+	if h.AuditLog != nil {
+		router.Use(h.AuditLog.Middleware())
+	}
 
 	cfg := cors.DefaultConfig()
 	// Allow all origins
 	cfg.AllowAllOrigins = true
 	router.Use(cors.New(cfg))
-	router.Use(gzip.Gzip(gzip.DefaultCompression))
+	router.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPaths([]string{"/api/v1/tail", handlers.ArtifactsPath})))
 	router.Use(handlers.StartTime())
 	// Register endpoints
 	router.GET("/api/v1/flamegraph", h.GetFlamegraph)
@@ -93,9 +323,59 @@ func main() {
 	router.GET("/api/v1/metrics/graph", h.GetMetricsGraph)
 	router.GET("/api/v1/metrics/cpu_trend", h.GetMetricsCpuTrends)
 	router.GET("/api/v1/metrics/lasthtml", h.GetLastHTML)
+	router.GET("/api/v1/cpu_attribution", h.GetCpuAttribution)
+	router.GET("/api/v1/symbol_quality", h.GetSymbolQuality)
+	router.GET("/api/v1/quality_score", h.GetQualityScore)
+	router.GET("/api/v1/anomalies", h.GetAnomalies)
+	router.GET("/api/v1/frames/history", h.GetFrameHistory)
+	router.GET("/api/v1/top_movers", h.GetTopMovers)
+	router.GET("/api/v1/recommendations", h.GetRecommendations)
+	router.GET("/api/v1/canary_comparison", h.GetCanaryComparison)
+	router.GET("/api/v1/colocation", h.GetColocation)
+	router.GET("/api/v1/noisy_neighbors", h.GetNoisyNeighbors)
+	router.GET("/api/v1/tail", h.TailSamples)
+	router.GET("/api/v1/export/samples", h.ExportSamples)
+	router.GET("/api/v1/service_matrix", h.GetServiceMatrix)
+	router.GET("/api/v1/services/:id/onboarding-report", h.GetOnboardingReport)
+	router.GET("/api/v1/snapshot", h.GetDashboardSnapshot)
+	if h.ShareLinks != nil {
+		router.POST("/api/v1/share_links", h.CreateShareLink)
+	}
+	if h.Artifacts != nil {
+		// the artifacts are stored gzip encoded, they are streamed as is
+		router.GET(handlers.ArtifactsPath+"*key", h.GetArtifact)
+	}
+	if h.Federation != nil {
+		router.GET("/api/v1/federated/flamegraph", h.GetFederatedFlamegraph)
+		router.GET("/api/v1/federated/query", h.QueryFederatedMeta)
+	}
+	if config.GraphQLEnabled {
+		router.GET("/api/v1/graphql", h.GraphQL)
+		router.POST("/api/v1/graphql", h.GraphQL)
+	}
+	admin := router.Group("/api/v1/admin", handlers.RequireAdmin())
+	admin.GET("/table_suffix", h.GetTableSuffix)
+	admin.POST("/table_suffix", h.SwitchTableSuffix)
+	admin.GET("/integrity", h.GetIntegrityAudit)
+	admin.GET("/pins", h.GetPins)
+	admin.POST("/pins", h.PinTimeWindow)
+	if h.AuditLog != nil {
+		admin.GET("/audit_log", h.GetAuditLog)
+	}
 	if config.UseTLS {
 		router.RunTLS("0.0.0.0:4433", config.CertFilePath, config.KeyFilePath)
 	} else {
 		router.Run("0.0.0.0:8080")
 	}
 }
+
+// reloadTableSuffix picks up the table suffix switched by another replica
+func reloadTableSuffix(interval time.Duration) {
+	for range time.Tick(interval) {
+		if changed, err := config.LoadTableSuffixFile(); err != nil {
+			log.Printf("unable to reload the table suffix file: %v", err)
+		} else if changed {
+			log.Printf("switched table suffix to %q", config.TableSuffix())
+		}
+	}
+}
@@ -0,0 +1,94 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Errorf("unable to encode admin response: %v", err)
+	}
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, GetBuildInfo())
+}
+
+// bearerAuthorized checks the bearer token of the request, no request is authorized by an empty token
+func bearerAuthorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	expected := []byte("Bearer " + token)
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+}
+
+// adminAuth requires the admin token on every endpoint but /version and the ingestion endpoints, which check
+// the ingest token themselves
+type adminAuth struct {
+	token string
+	next  http.Handler
+}
+
+func (a *adminAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/version" && !strings.HasPrefix(r.URL.Path, "/ingest/") && !bearerAuthorized(r, a.token) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+	a.next.ServeHTTP(w, r)
+}
+
+// NewAdminHandler serves the mux and /version, the other endpoints require the admin token
+func NewAdminHandler(token string, mux *http.ServeMux) http.Handler {
+	mux.HandleFunc("/version", versionHandler)
+	return &adminAuth{token: token, next: mux}
+}
+
+// StartAdminServer serves the operational endpoints of the indexer until ctx is done
+func StartAdminServer(ctx context.Context, addr string, token string, mux *http.ServeMux) {
+	if token == "" {
+		logger.Warnf("no admin token set, the admin endpoints of %s other than /version and /ingest/* are disabled",
+			addr)
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           NewAdminHandler(token, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		logger.Infof("admin server listening on %s", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("admin server failed: %v", err)
+		}
+	}()
+}
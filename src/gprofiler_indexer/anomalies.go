@@ -0,0 +1,88 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"time"
+)
+
+// Data quality anomalies detected while writing stacks
+const (
+	// AnomalyWeightExceedsParent is a frame with more samples than its parent frame
+	AnomalyWeightExceedsParent = "weight_exceeds_parent"
+	// AnomalyMissingParent is a frame whose parent frame is not part of the same container stacks
+	AnomalyMissingParent = "missing_parent"
+)
+
+type AnomalyRecord struct {
+	Timestamp     time.Time
+	ServiceId     uint32
+	HostName      string
+	ContainerName string
+	Kind          string
+	Count         uint32
+	Example       string
+}
+
+func (ar AnomalyRecord) getDbAttributes() []interface{} {
+	dbAttributes := []interface{}{
+		ar.Timestamp,
+		ar.ServiceId,
+		ar.HostName,
+		ar.ContainerName,
+		ar.Kind,
+		ar.Count,
+		ar.Example,
+	}
+	return dbAttributes
+}
+
+type anomalyKey struct {
+	containerName string
+	kind          string
+}
+
+// AnomalyCounter counts the anomalies of a single profile file per container and kind,
+// keeping the first frame of each as an example
+type AnomalyCounter struct {
+	anomalies map[anomalyKey]*AnomalyRecord
+}
+
+func NewAnomalyCounter() *AnomalyCounter {
+	return &AnomalyCounter{anomalies: make(map[anomalyKey]*AnomalyRecord)}
+}
+
+func (ac *AnomalyCounter) Add(containerName string, kind string, example string) {
+	key := anomalyKey{containerName: containerName, kind: kind}
+	record, ok := ac.anomalies[key]
+	if !ok {
+		record = &AnomalyRecord{ContainerName: containerName, Kind: kind, Example: example}
+		ac.anomalies[key] = record
+	}
+	record.Count += 1
+}
+
+func (ac *AnomalyCounter) Records(serviceId uint32, hostname string, timestamp time.Time) []AnomalyRecord {
+	records := make([]AnomalyRecord, 0, len(ac.anomalies))
+	for _, record := range ac.anomalies {
+		record.Timestamp = timestamp
+		record.ServiceId = serviceId
+		record.HostName = hostname
+		records = append(records, *record)
+	}
+	return records
+}
@@ -0,0 +1,98 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const MaxAppMetadataValueLen = 256
+
+// AppMetadata holds the application metadata keys promoted to dedicated ClickHouse columns
+type AppMetadata struct {
+	AppVersion string
+	Endpoint   string
+	JobName    string
+}
+
+// Keys are checked in order, the first non-empty value wins
+var (
+	appVersionKeys = []string{"app_version", "application_version", "service_version"}
+	endpointKeys   = []string{"endpoint", "route", "http_route"}
+	jobNameKeys    = []string{"job_name", "job", "task_name"}
+)
+
+func lookupAppMetadataValue(metadata map[string]interface{}, keys []string) string {
+	for _, key := range keys {
+		value, ok := metadata[key]
+		if !ok || value == nil {
+			continue
+		}
+		var str string
+		switch v := value.(type) {
+		case string:
+			str = v
+		case float64:
+			str = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			str = fmt.Sprint(v)
+		}
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		if len(str) > MaxAppMetadataValueLen {
+			str = str[:MaxAppMetadataValueLen]
+		}
+		return str
+	}
+	return ""
+}
+
+func ParseAppMetadata(metadata map[string]interface{}) AppMetadata {
+	if metadata == nil {
+		return AppMetadata{}
+	}
+	return AppMetadata{
+		AppVersion: lookupAppMetadataValue(metadata, appVersionKeys),
+		Endpoint:   lookupAppMetadataValue(metadata, endpointKeys),
+		JobName:    lookupAppMetadataValue(metadata, jobNameKeys),
+	}
+}
+
+// parseAppMetadataList parses the application_metadata header list; the metadata frame
+// of every stack is an index into this list (index 0 is reserved for "no metadata")
+func parseAppMetadataList(list []map[string]interface{}) []AppMetadata {
+	result := make([]AppMetadata, len(list))
+	for idx, metadata := range list {
+		result[idx] = ParseAppMetadata(metadata)
+	}
+	return result
+}
+
+func appMetadataForFrame(list []AppMetadata, metadataFrame string) AppMetadata {
+	if metadataFrame == "" {
+		return AppMetadata{}
+	}
+	idx, err := strconv.Atoi(strings.TrimSpace(metadataFrame))
+	if err != nil || idx < 0 || idx >= len(list) {
+		return AppMetadata{}
+	}
+	return list[idx]
+}
@@ -18,6 +18,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 )
 
 type CLIArgs struct {
@@ -47,6 +48,109 @@ type CLIArgs struct {
 	PostgresUser     string
 	PostgresPassword string
 	PostgresDB       string
+	// Self profiling Configuration
+	SelfProfilingEnabled     bool
+	SelfProfilingServiceName string
+	SelfProfilingInterval    int
+	SelfProfilingDuration    int
+	// Check runs the preflight checks, prints a report and exits
+	Check bool
+	// AdminAddr is the listen address of the admin HTTP server, empty disables it
+	AdminAddr string
+	// AdminToken is the bearer token required by the admin endpoints, empty disables them but /version and the
+	// ingestion endpoints
+	AdminToken string
+	// Schema version suffixes appended to the table names, see TableNames
+	ClickHouseTableSuffix       string
+	ClickHouseShadowTableSuffix string
+	// ClickHouseSymbolQualityTable stores per file symbolization statistics, empty disables them
+	ClickHouseSymbolQualityTable string
+	// ClickHouseAnomaliesTable stores data quality anomalies found while writing stacks, empty disables them
+	ClickHouseAnomaliesTable string
+	// Technology tagging of services from frame names
+	ServiceTaggingEnabled         bool
+	ServiceTaggingRefreshInterval int
+	// ImportFile is an NDJSON samples dump to import instead of listening to the queue
+	ImportFile string
+	// Forwarding of the written batches to a remote (hub) indexer, and ingestion of forwarded batches
+	ForwardURL       string
+	ForwardToken     string
+	ForwardQueueSize int
+	IngestToken      string
+	// Limits of the ingested request bodies in megabytes, as received and once decompressed
+	IngestMaxBodySize         int
+	IngestMaxDecompressedSize int
+	// Convention of the uploaded file names, see FilenameParser
+	FilenamePattern    string
+	FilenameTimeLayout string
+	// Bounds of the profile timestamps around the ingestion time, in seconds (0 disables a bound)
+	TimestampMaxFutureSkew int
+	TimestampMaxPastAge    int
+	TimestampAction        string
+	// LateArrivalThreshold is the delay in seconds after which a profile is recorded as late (0 disables it)
+	LateArrivalThreshold int
+	// RecomputeRollups is a lookback duration, the rollups of the hours with late profiles are recomputed
+	// instead of listening to the queue
+	RecomputeRollups   string
+	RecomputeServiceId int
+	// AdviseIndexes is a lookback duration, the slow queries of the query log within it are analyzed and the
+	// suggested skipping indexes and projections are written as a migration instead of listening to the queue
+	AdviseIndexes            string
+	AdviseIndexesMinDuration int
+	AdviseIndexesOutput      string
+	// ReconcileInterval is the number of seconds between reconciliations of the adhoc flamegraph objects with
+	// their metadata (0 disables the scheduled job, the admin endpoint is still served)
+	ReconcileInterval    int
+	ReconcileGracePeriod int
+	// HostNameEncryptionKey encrypts the hostnames written to ClickHouse, empty stores them as they are
+	HostNameEncryptionKey string
+	// PurgeInterval is the number of seconds between purges of the archived services past their restore
+	// window (0 disables them)
+	PurgeInterval int
+	// ResidencyFile binds services to the ClickHouse cluster and S3 bucket of a region, shared with the REST service
+	ResidencyFile string
+	// Overwrite policies of the HTML blobs and flamegraph HTML files, always, if-changed or never
+	HTMLBlobOverwrite       string
+	FlamegraphHTMLOverwrite string
+	// FlamegraphDedup stores identical adhoc flamegraphs of a service once, in content addressed objects
+	FlamegraphDedup bool
+	// HooksFile configures the commands and webhooks called after the ingestion of every file
+	HooksFile string
+	// Daily export of the per service and function aggregates to a data warehouse, an empty driver disables it
+	WarehouseDriver       string
+	WarehouseDSN          string
+	WarehouseTable        string
+	WarehouseTopFunctions int
+	// WarehouseExportDelay is the number of seconds after midnight UTC the previous day is exported
+	WarehouseExportDelay int
+	// ClickHouseSidecarsTable stores the containers classified as sidecars, empty disables the classification
+	ClickHouseSidecarsTable string
+	// SidecarPatterns are the comma separated substrings of the sidecar container names
+	SidecarPatterns string
+	// ClickHouseFrameAgesTable stores the first and last time the frames of the services are seen, empty disables it
+	ClickHouseFrameAgesTable string
+	// ClickHouseStacksPinnedTable and ClickHousePinsTable store the time windows pinned on the REST admin pins
+	// endpoint, the indexer only purges them
+	ClickHouseStacksPinnedTable string
+	ClickHousePinsTable         string
+	// DemangleFrames demangles the C++, Rust and Go symbols at ingestion, the mangled names are not stored
+	DemangleFrames bool
+	// The SQS polling is paused after BackpressureMaxFailures consecutive failed ClickHouse inserts, or while the
+	// stacks queue is filled to BackpressureQueueSaturation percent (0 disables a condition)
+	BackpressureMaxFailures     int
+	BackpressureQueueSaturation int
+	// DeliveryAuditInterval is the number of seconds between emissions of the delivery audit counters to the
+	// metrics agent (0 disables them, the admin endpoint is still served)
+	DeliveryAuditInterval int
+	// A message failed on a transient error is received up to SQSRetryBudget times (0 disables the retries), its
+	// visibility timeout is SQSRetryDelay seconds after the first failure and doubles on every receive. The failed
+	// messages are then sent to SQSDeadLetterQueue, when set, and deleted.
+	SQSRetryBudget     int
+	SQSRetryDelay      int
+	SQSDeadLetterQueue string
+	// SQSVisibilityTimeout is the number of seconds a received message stays invisible, it must cover the
+	// processing of the file and the flush of its stacks, the message is only deleted once they are written
+	SQSVisibilityTimeout int
 }
 
 func NewCliArgs() *CLIArgs {
@@ -72,6 +176,57 @@ func NewCliArgs() *CLIArgs {
 		PostgresUser:     "gprofiler",
 		PostgresPassword: "",
 		PostgresDB:       "gprofiler_db",
+		// Self profiling defaults
+		SelfProfilingEnabled:     false,
+		SelfProfilingServiceName: "gprofiler-internal",
+		SelfProfilingInterval:    300,
+		SelfProfilingDuration:    30,
+		AdminAddr:                "127.0.0.1:8090",
+		// Data quality defaults
+		ClickHouseSymbolQualityTable: "flamedb.symbol_quality",
+		ClickHouseAnomaliesTable:     "flamedb.anomalies",
+		// Service tagging defaults
+		ServiceTaggingEnabled:         true,
+		ServiceTaggingRefreshInterval: 3600,
+		// Forwarding defaults
+		ForwardQueueSize:          100,
+		IngestMaxBodySize:         25,
+		IngestMaxDecompressedSize: 250,
+		// Uploaded file names defaults
+		FilenamePattern:    DefaultFilenamePattern,
+		FilenameTimeLayout: DefaultFilenameTimeLayout,
+		// Timestamp guard defaults
+		TimestampMaxFutureSkew: 600,
+		TimestampMaxPastAge:    0,
+		TimestampAction:        TimestampActionClamp,
+		LateArrivalThreshold:   3600,
+		// Uploaded artifacts defaults
+		HTMLBlobOverwrite:       OverwriteIfChanged,
+		FlamegraphHTMLOverwrite: OverwriteIfChanged,
+		// Artifacts reconciliation defaults
+		ReconcileInterval:    0,
+		ReconcileGracePeriod: 3600,
+		// Warehouse export defaults
+		WarehouseTable:        "gprofiler_function_daily",
+		WarehouseTopFunctions: 1000,
+		WarehouseExportDelay:  7200,
+		// Sidecar classification defaults
+		ClickHouseSidecarsTable: "flamedb.sidecar_containers",
+		SidecarPatterns:         DefaultSidecarPatterns,
+		// Frame ages defaults
+		ClickHouseFrameAgesTable: "flamedb.frame_ages",
+		// Pinned time windows defaults
+		ClickHouseStacksPinnedTable: "flamedb.samples_pinned",
+		ClickHousePinsTable:         "flamedb.pins",
+		// Backpressure defaults
+		BackpressureMaxFailures:     3,
+		BackpressureQueueSaturation: 90,
+		// Delivery audit defaults
+		DeliveryAuditInterval: 60,
+		// SQS retries defaults
+		SQSRetryBudget:       5,
+		SQSRetryDelay:        30,
+		SQSVisibilityTimeout: 120,
 	}
 }
 
@@ -95,6 +250,17 @@ func (ca *CLIArgs) ParseArgs() {
 		"only for developers)")
 	flag.StringVar(&ca.ClickHouseMetricsTable, "clickhouse-metrics-table", LookupEnvOrString("CLICKHOUSE_METRICS_TABLE",
 		ca.ClickHouseMetricsTable), "ClickHouse metrics table (default metrics)")
+	flag.StringVar(&ca.ClickHouseTableSuffix, "clickhouse-table-suffix", LookupEnvOrString(
+		"CLICKHOUSE_TABLE_SUFFIX", ca.ClickHouseTableSuffix), "Schema version suffix of the ClickHouse tables (default empty)")
+	flag.StringVar(&ca.ClickHouseShadowTableSuffix, "clickhouse-shadow-table-suffix", LookupEnvOrString(
+		"CLICKHOUSE_SHADOW_TABLE_SUFFIX", ca.ClickHouseShadowTableSuffix),
+		"Schema version suffix of tables populated side by side during a migration (default empty)")
+	flag.StringVar(&ca.ClickHouseSymbolQualityTable, "clickhouse-symbol-quality-table", LookupEnvOrString(
+		"CLICKHOUSE_SYMBOL_QUALITY_TABLE", ca.ClickHouseSymbolQualityTable),
+		"ClickHouse symbol quality table, empty to disable (default symbol_quality)")
+	flag.StringVar(&ca.ClickHouseAnomaliesTable, "clickhouse-anomalies-table", LookupEnvOrString(
+		"CLICKHOUSE_ANOMALIES_TABLE", ca.ClickHouseAnomaliesTable),
+		"ClickHouse data quality anomalies table, empty to disable (default anomalies)")
 	flag.IntVar(&ca.Concurrency, "c", LookupEnvOrInt("CONCURRENCY", ca.Concurrency), "Concurrency")
 	flag.IntVar(&ca.ClickHouseStacksBatchSize, "clickhouse-stacks-batch-size",
 		LookupEnvOrInt("CLICKHOUSE_STACKS_BATCH_SIZE", ca.ClickHouseStacksBatchSize),
@@ -125,8 +291,152 @@ func (ca *CLIArgs) ParseArgs() {
 		"PostgreSQL password")
 	flag.StringVar(&ca.PostgresDB, "postgres-db", LookupEnvOrString("GPROFILER_POSTGRES_DB_NAME", ca.PostgresDB),
 		"PostgreSQL database name (default gprofiler_db)")
+	// Self profiling Configuration
+	flag.BoolVar(&ca.SelfProfilingEnabled, "self-profiling-enabled", LookupEnvOrBool("SELF_PROFILING_ENABLED",
+		ca.SelfProfilingEnabled), "Periodically profile the indexer itself (default false)")
+	flag.StringVar(&ca.SelfProfilingServiceName, "self-profiling-service-name", LookupEnvOrString(
+		"SELF_PROFILING_SERVICE_NAME", ca.SelfProfilingServiceName),
+		"Service name to store self profiles under (default gprofiler-internal)")
+	flag.IntVar(&ca.SelfProfilingInterval, "self-profiling-interval", LookupEnvOrInt("SELF_PROFILING_INTERVAL",
+		ca.SelfProfilingInterval), "Seconds between self profiling sessions (default 300)")
+	flag.IntVar(&ca.SelfProfilingDuration, "self-profiling-duration", LookupEnvOrInt("SELF_PROFILING_DURATION",
+		ca.SelfProfilingDuration), "Duration of a self profiling session in seconds (default 30)")
+	flag.BoolVar(&ca.ServiceTaggingEnabled, "service-tagging-enabled", LookupEnvOrBool("SERVICE_TAGGING_ENABLED",
+		ca.ServiceTaggingEnabled), "Tag services with the technologies detected in their frames (default true)")
+	flag.IntVar(&ca.ServiceTaggingRefreshInterval, "service-tagging-refresh-interval", LookupEnvOrInt(
+		"SERVICE_TAGGING_REFRESH_INTERVAL", ca.ServiceTaggingRefreshInterval),
+		"Minimal seconds between two updates of the same service tag (default 3600)")
+	flag.StringVar(&ca.ForwardURL, "forward-url", LookupEnvOrString("FORWARD_URL", ca.ForwardURL),
+		"Admin server URL of a remote indexer to forward the written batches to, e.g. http://hub:8090 (default empty)")
+	flag.StringVar(&ca.ForwardToken, "forward-token", LookupEnvOrString("FORWARD_TOKEN", ca.ForwardToken),
+		"Bearer token sent to the remote indexer, its -ingest-token")
+	flag.IntVar(&ca.ForwardQueueSize, "forward-queue-size", LookupEnvOrInt("FORWARD_QUEUE_SIZE", ca.ForwardQueueSize),
+		"Batches waiting to be forwarded before new ones are dropped (default 100)")
+	flag.StringVar(&ca.IngestToken, "ingest-token", LookupEnvOrString("INGEST_TOKEN", ca.IngestToken),
+		"Bearer token required to ingest batches forwarded by other indexers, empty disables ingestion")
+	flag.IntVar(&ca.IngestMaxBodySize, "ingest-max-body-size", LookupEnvOrInt("INGEST_MAX_BODY_SIZE",
+		ca.IngestMaxBodySize), "Megabytes of an ingested request body, larger ones are rejected (default 25)")
+	flag.IntVar(&ca.IngestMaxDecompressedSize, "ingest-max-decompressed-size", LookupEnvOrInt(
+		"INGEST_MAX_DECOMPRESSED_SIZE", ca.IngestMaxDecompressedSize),
+		"Megabytes of an ingested request body once decompressed, larger ones are rejected (default 250)")
+	flag.StringVar(&ca.FilenamePattern, "filename-pattern", LookupEnvOrString("FILENAME_PATTERN",
+		ca.FilenamePattern), "Regexp of the uploaded file names, with a timestamp named group and optional host "+
+		"and suffix named groups")
+	flag.StringVar(&ca.FilenameTimeLayout, "filename-time-layout", LookupEnvOrString("FILENAME_TIME_LAYOUT",
+		ca.FilenameTimeLayout), "Go time layout of the timestamp group of -filename-pattern (default "+
+		DefaultFilenameTimeLayout+")")
+	flag.IntVar(&ca.TimestampMaxFutureSkew, "timestamp-max-future-skew", LookupEnvOrInt(
+		"TIMESTAMP_MAX_FUTURE_SKEW", ca.TimestampMaxFutureSkew),
+		"Seconds a profile timestamp may be ahead of the ingestion time, 0 to disable (default 600)")
+	flag.IntVar(&ca.TimestampMaxPastAge, "timestamp-max-past-age", LookupEnvOrInt("TIMESTAMP_MAX_PAST_AGE",
+		ca.TimestampMaxPastAge), "Seconds a profile timestamp may be behind the ingestion time, 0 to disable "+
+		"(default 0)")
+	flag.StringVar(&ca.TimestampAction, "timestamp-action", LookupEnvOrString("TIMESTAMP_ACTION",
+		ca.TimestampAction), "Action on profiles with an out of range timestamp, clamp or reject (default clamp)")
+	flag.IntVar(&ca.LateArrivalThreshold, "late-arrival-threshold", LookupEnvOrInt("LATE_ARRIVAL_THRESHOLD",
+		ca.LateArrivalThreshold), "Seconds after which a profile is recorded as a late_arrival anomaly, 0 to "+
+		"disable (default 3600)")
+	flag.StringVar(&ca.RecomputeRollups, "recompute-rollups", "", "Recompute the rollups of the hours with "+
+		"late profiles within this lookback (e.g. 72h) from the stacks table and exit")
+	flag.IntVar(&ca.RecomputeServiceId, "recompute-service", 0, "With -recompute-rollups, recompute every hour "+
+		"of the lookback of this service instead of the hours with late profiles")
+	flag.StringVar(&ca.AdviseIndexes, "advise-indexes", "", "Suggest ClickHouse skipping indexes and "+
+		"projections for the slow queries of the query log within this lookback (e.g. 168h) and exit")
+	flag.IntVar(&ca.AdviseIndexesMinDuration, "advise-indexes-min-duration", 1000, "With -advise-indexes, "+
+		"milliseconds from which a query is slow")
+	flag.StringVar(&ca.AdviseIndexesOutput, "advise-indexes-output", "-", "With -advise-indexes, migration file "+
+		"the suggestions are written to, e.g. sql/migrations/add_advised_indexes.sql (default -, stdout)")
+	flag.IntVar(&ca.ReconcileInterval, "reconcile-interval", LookupEnvOrInt("RECONCILE_INTERVAL",
+		ca.ReconcileInterval), "Seconds between reconciliations of the adhoc flamegraph objects with their "+
+		"metadata, 0 to disable (default 0)")
+	flag.IntVar(&ca.ReconcileGracePeriod, "reconcile-grace-period", LookupEnvOrInt("RECONCILE_GRACE_PERIOD",
+		ca.ReconcileGracePeriod), "Seconds during which new objects and metadata rows are not reported as "+
+		"orphans (default 3600)")
+	flag.StringVar(&ca.HostNameEncryptionKey, "hostname-encryption-key", LookupEnvOrString(
+		"HOSTNAME_ENCRYPTION_KEY", ca.HostNameEncryptionKey), "Key encrypting the hostnames written to ClickHouse, "+
+		"the REST service needs the same key (default empty, hostnames are stored as they are)")
+	flag.IntVar(&ca.PurgeInterval, "purge-interval", LookupEnvOrInt("PURGE_INTERVAL", ca.PurgeInterval),
+		"Seconds between purges of the archived services whose restore window is over, 0 to disable (default 0)")
+	flag.StringVar(&ca.ResidencyFile, "residency-file", LookupEnvOrString("RESIDENCY_FILE", ca.ResidencyFile),
+		"JSON file binding service ids to the ClickHouse cluster and S3 bucket of their data residency region")
+	flag.StringVar(&ca.HTMLBlobOverwrite, "html-blob-overwrite", LookupEnvOrString("HTML_BLOB_OVERWRITE",
+		ca.HTMLBlobOverwrite), "Overwrite policy of the uploaded HTML blobs, always, if-changed or never "+
+		"(default if-changed)")
+	flag.StringVar(&ca.FlamegraphHTMLOverwrite, "flamegraph-html-overwrite", LookupEnvOrString(
+		"FLAMEGRAPH_HTML_OVERWRITE", ca.FlamegraphHTMLOverwrite), "Overwrite policy of the uploaded flamegraph "+
+		"HTML files, always, if-changed or never (default if-changed)")
+	flag.BoolVar(&ca.FlamegraphDedup, "flamegraph-dedup", LookupEnvOrBool("FLAMEGRAPH_DEDUP", ca.FlamegraphDedup),
+		"Store identical adhoc flamegraph HTML files of a service once, in content addressed objects (default false)")
+	flag.StringVar(&ca.HooksFile, "hooks-file", LookupEnvOrString("HOOKS_FILE", ca.HooksFile),
+		"YAML file of the commands and webhooks called with a summary of every ingested file")
+	flag.StringVar(&ca.WarehouseDriver, "warehouse-driver", LookupEnvOrString("WAREHOUSE_DRIVER",
+		ca.WarehouseDriver), "Driver of the daily aggregates export to a data warehouse, redshift or s3 "+
+		"(default empty, disabled)")
+	flag.StringVar(&ca.WarehouseDSN, "warehouse-dsn", LookupEnvOrString("WAREHOUSE_DSN", ca.WarehouseDSN),
+		"Connection string of the redshift driver, s3://bucket/prefix of the s3 driver")
+	flag.StringVar(&ca.WarehouseTable, "warehouse-table", LookupEnvOrString("WAREHOUSE_TABLE", ca.WarehouseTable),
+		"Warehouse table of the redshift driver (default gprofiler_function_daily)")
+	flag.IntVar(&ca.WarehouseTopFunctions, "warehouse-top-functions", LookupEnvOrInt("WAREHOUSE_TOP_FUNCTIONS",
+		ca.WarehouseTopFunctions), "Functions exported per service and day, the ones with the most samples "+
+		"(default 1000)")
+	flag.IntVar(&ca.WarehouseExportDelay, "warehouse-export-delay", LookupEnvOrInt("WAREHOUSE_EXPORT_DELAY",
+		ca.WarehouseExportDelay), "Seconds after midnight UTC the previous day is exported, for the late "+
+		"profiles (default 7200)")
+	flag.StringVar(&ca.ClickHouseSidecarsTable, "clickhouse-sidecars-table", LookupEnvOrString(
+		"CLICKHOUSE_SIDECARS_TABLE", ca.ClickHouseSidecarsTable),
+		"ClickHouse table of the containers classified as sidecars, empty to disable (default sidecar_containers)")
+	flag.StringVar(&ca.SidecarPatterns, "sidecar-patterns", LookupEnvOrString("SIDECAR_PATTERNS", ca.SidecarPatterns),
+		"Comma separated substrings of the sidecar container names, case insensitive (default "+
+			DefaultSidecarPatterns+")")
+	flag.StringVar(&ca.ClickHouseFrameAgesTable, "clickhouse-frame-ages-table", LookupEnvOrString(
+		"CLICKHOUSE_FRAME_AGES_TABLE", ca.ClickHouseFrameAgesTable),
+		"ClickHouse table of the first and last time the frames are seen, empty to disable (default frame_ages)")
+	flag.StringVar(&ca.ClickHouseStacksPinnedTable, "clickhouse-stacks-pinned-table", LookupEnvOrString(
+		"CLICKHOUSE_STACKS_PINNED_TABLE", ca.ClickHouseStacksPinnedTable),
+		"ClickHouse table of the raw stacks of the pinned time windows, purged with the archived services "+
+			"(default samples_pinned)")
+	flag.StringVar(&ca.ClickHousePinsTable, "clickhouse-pins-table", LookupEnvOrString(
+		"CLICKHOUSE_PINS_TABLE", ca.ClickHousePinsTable),
+		"ClickHouse table of the pinned time windows, purged with the archived services (default pins)")
+	flag.BoolVar(&ca.DemangleFrames, "demangle-frames", LookupEnvOrBool("DEMANGLE_FRAMES", ca.DemangleFrames),
+		"Demangle the C++, Rust and Go symbols at ingestion instead of at query time, the mangled names are "+
+			"not stored (default false)")
+	flag.IntVar(&ca.BackpressureMaxFailures, "backpressure-max-failures", LookupEnvOrInt(
+		"BACKPRESSURE_MAX_FAILURES", ca.BackpressureMaxFailures),
+		"Consecutive failed ClickHouse inserts pausing the SQS polling, 0 to disable (default 3)")
+	flag.IntVar(&ca.BackpressureQueueSaturation, "backpressure-queue-saturation", LookupEnvOrInt(
+		"BACKPRESSURE_QUEUE_SATURATION", ca.BackpressureQueueSaturation),
+		"Fill percentage of the stacks queue pausing the SQS polling, 0 to disable (default 90)")
+	flag.IntVar(&ca.DeliveryAuditInterval, "delivery-audit-interval", LookupEnvOrInt("DELIVERY_AUDIT_INTERVAL",
+		ca.DeliveryAuditInterval), "Seconds between emissions of the delivery audit counters to the metrics agent, "+
+		"0 to disable (default 60)")
+	flag.IntVar(&ca.SQSRetryBudget, "sqs-retry-budget", LookupEnvOrInt("SQS_RETRY_BUDGET", ca.SQSRetryBudget),
+		"Receives of a message failed on a transient error before it is dead-lettered, 0 to disable the retries "+
+			"(default 5)")
+	flag.IntVar(&ca.SQSRetryDelay, "sqs-retry-delay", LookupEnvOrInt("SQS_RETRY_DELAY", ca.SQSRetryDelay),
+		"Seconds before a failed message is received again, doubled on every receive (default 30)")
+	flag.StringVar(&ca.SQSDeadLetterQueue, "sqs-dead-letter-queue", LookupEnvOrString("SQS_DEAD_LETTER_QUEUE",
+		ca.SQSDeadLetterQueue), "SQS queue name receiving the failed messages, empty to delete them (default empty)")
+	flag.IntVar(&ca.SQSVisibilityTimeout, "sqs-visibility-timeout", LookupEnvOrInt("SQS_VISIBILITY_TIMEOUT",
+		ca.SQSVisibilityTimeout), "Seconds a received message stays invisible while its stacks are written, "+
+		"0 for the visibility timeout of the queue (default 120)")
+	flag.StringVar(&ca.ImportFile, "import", "", "Import an NDJSON samples dump exported by the REST "+
+		"/api/v1/export/samples endpoint (.gz supported, - for stdin) and exit")
+	flag.BoolVar(&ca.Check, "check", false, "Run startup dependency checks, print a report and exit")
+	flag.StringVar(&ca.AdminAddr, "admin-addr", LookupEnvOrString("ADMIN_ADDR", ca.AdminAddr),
+		"Admin HTTP server address serving /version, empty to disable (default 127.0.0.1:8090)")
+	flag.StringVar(&ca.AdminToken, "admin-token", LookupEnvOrString("ADMIN_TOKEN", ca.AdminToken),
+		"Bearer token required by the admin endpoints other than /version and /ingest/*, empty disables them")
 	flag.Parse()
 
+	if err := ca.validateSelfProfiling(); err != nil {
+		logger.Fatal(err)
+	}
+
+	if ca.ImportFile != "" || ca.RecomputeRollups != "" || ca.AdviseIndexes != "" {
+		return
+	}
+
 	if ca.SQSQueue == "" && ca.InputFolder == "" {
 		logger.Fatal("You must supply the name of a queue (-sqs-queue QUEUE)")
 	}
@@ -135,3 +445,15 @@ func (ca *CLIArgs) ParseArgs() {
 		logger.Fatal("You must supply the name of a bucket (-s3-bucket BUCKET)")
 	}
 }
+
+// validateSelfProfiling rejects the self profiling periods a ticker cannot run with
+func (ca *CLIArgs) validateSelfProfiling() error {
+	if !ca.SelfProfilingEnabled {
+		return nil
+	}
+	if ca.SelfProfilingInterval <= 0 || ca.SelfProfilingDuration <= 0 {
+		return fmt.Errorf("-self-profiling-interval (%d) and -self-profiling-duration (%d) must be positive",
+			ca.SelfProfilingInterval, ca.SelfProfilingDuration)
+	}
+	return nil
+}
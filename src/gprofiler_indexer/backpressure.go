@@ -0,0 +1,176 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	backpressureCheckInterval = 5 * time.Second
+	// backpressureSustainedChecks is the number of consecutive checks the queue must be saturated for
+	backpressureSustainedChecks = 3
+)
+
+// Backpressure pauses the SQS polling while ClickHouse is unhealthy, the messages stay in the queue instead of
+// being pulled, failed and deleted. The polling is paused after maxFailures consecutive failed inserts, or when
+// the stacks queue is filled to the saturation ratio for a few checks in a row. It resumes once ClickHouse answers
+// the health probe again and the queue is drained below half the saturation ratio.
+// The methods of a nil Backpressure are no-ops, it never pauses.
+type Backpressure struct {
+	maxFailures int
+	saturation  float64
+	mutex       sync.Mutex
+	failures    int
+	saturated   int
+	paused      bool
+	// resumed is closed when the polling resumes
+	resumed chan struct{}
+}
+
+// NewBackpressure returns nil when both conditions are disabled (zero)
+func NewBackpressure(maxFailures int, saturationPercent int) *Backpressure {
+	if maxFailures <= 0 && saturationPercent <= 0 {
+		return nil
+	}
+	return &Backpressure{
+		maxFailures: maxFailures,
+		saturation:  float64(saturationPercent) / 100,
+	}
+}
+
+// RecordInsert counts the consecutive failed inserts, a successful insert resets the count
+func (bp *Backpressure) RecordInsert(err error) {
+	if bp == nil {
+		return
+	}
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	if err != nil {
+		bp.failures += 1
+	} else {
+		bp.failures = 0
+	}
+}
+
+// Paused reports whether the polling is paused
+func (bp *Backpressure) Paused() bool {
+	if bp == nil {
+		return false
+	}
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	return bp.paused
+}
+
+// Wait blocks while the polling is paused, until ctx is done
+func (bp *Backpressure) Wait(ctx context.Context) {
+	if bp == nil {
+		return
+	}
+	bp.mutex.Lock()
+	if !bp.paused {
+		bp.mutex.Unlock()
+		return
+	}
+	resumed := bp.resumed
+	bp.mutex.Unlock()
+	select {
+	case <-resumed:
+	case <-ctx.Done():
+	}
+}
+
+// check pauses or resumes the polling from the fill ratio of the queue, the probe is only called while paused.
+// The probe runs without the lock, so that the inserts recording their result never wait for a slow ping.
+func (bp *Backpressure) check(ctx context.Context, fill float64, probe func(ctx context.Context) error) {
+	if !bp.update(fill) {
+		return
+	}
+	bp.mutex.Lock()
+	probing := bp.failures > 0
+	bp.mutex.Unlock()
+	if probing {
+		if err := probe(ctx); err != nil {
+			logger.Debugf("ClickHouse still unhealthy: %v", err)
+			return
+		}
+	}
+
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	if probing {
+		bp.failures = 0
+	}
+	if bp.saturation > 0 && fill >= bp.saturation/2 {
+		return
+	}
+	logger.Infof("SQS polling resumed, queue %.0f%% full", fill*100)
+	bp.paused = false
+	bp.saturated = 0
+	close(bp.resumed)
+}
+
+// update counts the saturated checks and pauses the polling when needed, it reports whether the polling was
+// already paused, i.e. whether it may resume
+func (bp *Backpressure) update(fill float64) bool {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	if bp.saturation > 0 && fill >= bp.saturation {
+		bp.saturated += 1
+	} else {
+		bp.saturated = 0
+	}
+	if bp.paused {
+		return true
+	}
+
+	var reason string
+	if bp.maxFailures > 0 && bp.failures >= bp.maxFailures {
+		reason = "consecutive ClickHouse insert failures"
+	} else if bp.saturated >= backpressureSustainedChecks {
+		reason = "stacks queue saturated"
+	}
+	if reason != "" {
+		logger.Warnf("SQS polling paused: %s (%d failed inserts, queue %.0f%% full)", reason, bp.failures,
+			fill*100)
+		bp.paused = true
+		bp.resumed = make(chan struct{})
+	}
+	return false
+}
+
+// Run checks the health every interval until ctx is done, fill returns the fill ratio of the stacks queue and
+// probe checks ClickHouse answers
+func (bp *Backpressure) Run(ctx context.Context, interval time.Duration, fill func() float64,
+	probe func(ctx context.Context) error) {
+	if bp == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			bp.check(ctx, fill(), probe)
+		}
+	}
+}
@@ -26,7 +26,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/session"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -36,7 +35,13 @@ const (
 	ProfilingTypeContinuous = "continuous"
 )
 
-type FrameValuesMap map[string]map[string]FrameValue
+// StackKey groups stacks of the same container and application metadata frame
+type StackKey struct {
+	ContainerName string
+	MetadataFrame string
+}
+
+type FrameValuesMap map[StackKey]map[string]FrameValue
 
 type FrameValue struct {
 	Weight int
@@ -68,7 +73,8 @@ type FileInfo struct {
 		CPUAvg    float64 `json:"cpu_avg"`
 		MemoryAvg float64 `json:"mem_avg"`
 	} `json:"metrics"`
-	ApplicationMetadataEnabled bool `json:"application_metadata_enabled"`
+	ApplicationMetadata        []map[string]interface{} `json:"application_metadata"`
+	ApplicationMetadataEnabled bool                     `json:"application_metadata_enabled"`
 }
 
 func isSwapper(stack []string) bool {
@@ -78,8 +84,9 @@ func isSwapper(stack []string) bool {
 	return false
 }
 
-func extractStack(line string, withContainer bool, withMetadata bool) (int, string, []string) {
+func extractStack(line string, withContainer bool, withMetadata bool) (int, StackKey, []string) {
 	var rawContainerName string
+	var metadataFrame string
 	var skipIndex int
 
 	line = strings.TrimSpace(line)
@@ -92,6 +99,7 @@ func extractStack(line string, withContainer bool, withMetadata bool) (int, stri
 
 	if withContainer {
 		if withMetadata {
+			metadataFrame = frames[0]
 			rawContainerName = frames[1]
 			skipIndex = 2
 		} else {
@@ -116,7 +124,7 @@ func extractStack(line string, withContainer bool, withMetadata bool) (int, stri
 		}
 	}
 
-	return sampleCount, rawContainerName, stack
+	return sampleCount, StackKey{ContainerName: rawContainerName, MetadataFrame: metadataFrame}, stack
 }
 
 func parseStackFileMeta(line string) (FileInfo, bool, error) {
@@ -131,11 +139,9 @@ func parseStackFileMeta(line string) (FileInfo, bool, error) {
 	return fileInfo, withMetadata, nil
 }
 
-func processStack(stack []string, sampleCount int, rawContainerName string, frameValues FrameValuesMap,
+func processStack(stack []string, sampleCount int, key StackKey, frameValues FrameValuesMap,
 	frames map[string]Frame) {
 
-	key := rawContainerName
-
 	if frameValues[key] == nil {
 		frameValues[key] = make(map[string]FrameValue)
 	}
@@ -164,23 +170,63 @@ func processStack(stack []string, sampleCount int, rawContainerName string, fram
 }
 
 type ProfilesWriter struct {
-	chMutex        sync.Mutex
-	stacksRecords  chan StackRecord
-	metricsRecords chan MetricRecord
+	chMutex              sync.Mutex
+	stacksRecords        chan StackRecord
+	metricsRecords       chan MetricRecord
+	symbolQualityRecords chan SymbolQualityRecord
+	anomalyRecords       chan AnomalyRecord
+	sidecarRecords       chan SidecarRecord
+	frameAgeRecords      chan FrameAgeRecord
+	// tagger is optional, services are not tagged when nil
+	tagger *ServiceTagger
+	// filenames parses the start time out of the uploaded file names
+	filenames *FilenameParser
+	// timestampGuard bounds the profile timestamps, the zero value accepts any timestamp
+	timestampGuard TimestampGuard
+	// lateArrivalThreshold is the delay after which a profile is recorded as late, zero disables it
+	lateArrivalThreshold time.Duration
+	// hostNames encrypts the hostnames of the ClickHouse records, they are stored as they are when nil
+	hostNames *HostNameCipher
+	// residency routes the objects of the services bound to a region to the bucket of the region
+	residency *ResidencyRouter
+	// uploads are the overwrite policies of the HTML artifacts, the zero value always uploads them
+	uploads UploadPolicies
+	// dedupFlamegraphs stores identical adhoc flamegraphs of a service once, in a content addressed object
+	dedupFlamegraphs bool
+	// hooks are called once a file is ingested, nil when no hook is configured
+	hooks *Hooks
+	// sidecars classifies the containers, they are not classified when nil
+	sidecars *SidecarClassifier
+	// frameAges records the first and last time the frames are seen, they are not recorded when nil
+	frameAges *FrameAgeTracker
+	// demangleFrames stores the readable names of the C++, Rust and Go symbols instead of the mangled ones
+	demangleFrames bool
+	// audit counts the files and rows of the services from their reception to their insertion, when set
+	audit *DeliveryAudit
 }
 
 func NewProfilesWriter(channels *RecordChannels) *ProfilesWriter {
 	return &ProfilesWriter{
-		stacksRecords:  channels.StacksRecords,
-		metricsRecords: channels.MetricsRecords,
+		stacksRecords:        channels.StacksRecords,
+		metricsRecords:       channels.MetricsRecords,
+		symbolQualityRecords: channels.SymbolQualityRecords,
+		anomalyRecords:       channels.AnomalyRecords,
+		sidecarRecords:       channels.SidecarRecords,
+		frameAgeRecords:      channels.FrameAgeRecords,
+		filenames:            mustFilenameParser(DefaultFilenamePattern, DefaultFilenameTimeLayout),
 	}
 }
 
 func (pw *ProfilesWriter) writeStacks(weights FrameValuesMap, frames map[string]Frame,
-	serviceId uint32, instanceType string, hostname string, timestamp time.Time) {
+	serviceId uint32, instanceType string, hostname string, timestamp time.Time, appMetadata []AppMetadata,
+	delivery *TaskDelivery) {
 	idx := 0
-	for rawContainerName, containerWeights := range weights {
-		containerName, k8sName, _ := ContainerAndK8sName(rawContainerName)
+	anomalies := NewAnomalyCounter()
+	containerNames := make([]string, 0)
+	for key, containerWeights := range weights {
+		containerName, k8sName, _ := ContainerAndK8sName(key.ContainerName)
+		containerNames = append(containerNames, containerName)
+		metadata := appMetadataForFrame(appMetadata, key.MetadataFrame)
 
 		for hash, weightVal := range containerWeights {
 			frame := frames[hash]
@@ -190,13 +236,16 @@ func (pw *ProfilesWriter) writeStacks(weights FrameValuesMap, frames map[string]
 			}
 			hashAsInt, _ := strconv.ParseUint(hash, 16, 64)
 			if frame.Prev != "" {
-				parentWeightVal := containerWeights[frame.Prev]
-				if weightVal.Weight > parentWeightVal.Weight {
+				parentWeightVal, parentExists := containerWeights[frame.Prev]
+				if !parentExists {
+					anomalies.Add(containerName, AnomalyMissingParent, frame.Name)
+				} else if weightVal.Weight > parentWeightVal.Weight {
 					logger.Debugf("Glitch: %s (%d) > %s (%d)",
 						frame.Name,
 						weightVal.Weight,
 						frame.Prev,
 						parentWeightVal.Weight)
+					anomalies.Add(containerName, AnomalyWeightExceedsParent, frame.Name)
 				}
 			}
 			record := StackRecord{
@@ -211,12 +260,33 @@ func (pw *ProfilesWriter) writeStacks(weights FrameValuesMap, frames map[string]
 				Parent:             prevHashAsInt,
 				Name:               frame.Name,
 				InsertionTimestamp: time.Now().UTC(),
+				AppVersion:         metadata.AppVersion,
+				Endpoint:           metadata.Endpoint,
+				JobName:            metadata.JobName,
+				delivery:           delivery,
 			}
+			delivery.add()
 			pw.stacksRecords <- record
 			idx += 1
 		}
 	}
 	logger.Debugf("write %d records to BufferedClickHouseWrite", idx)
+	pw.audit.RowsQueued(serviceId, idx)
+	if pw.anomalyRecords != nil {
+		for _, record := range anomalies.Records(serviceId, hostname, timestamp) {
+			pw.anomalyRecords <- record
+		}
+	}
+	if pw.sidecarRecords != nil && pw.sidecars != nil {
+		for _, record := range pw.sidecars.Records(serviceId, containerNames, timestamp, time.Now().UTC()) {
+			pw.sidecarRecords <- record
+		}
+	}
+	if pw.frameAgeRecords != nil && pw.frameAges != nil {
+		for _, record := range pw.frameAges.Records(serviceId, frames, timestamp, time.Now().UTC()) {
+			pw.frameAgeRecords <- record
+		}
+	}
 }
 
 func (pw *ProfilesWriter) writeMetrics(serviceId uint32, instanceType string,
@@ -238,8 +308,59 @@ func (pw *ProfilesWriter) writeMetrics(serviceId uint32, instanceType string,
 	log.Infof("DEBUG: Metric record sent to channel successfully")
 }
 
-func (pw *ProfilesWriter) ParseStackFrameFile(sess *session.Session, task SQSMessage, s3bucket string,
-	timestamp time.Time, buf []byte) error {
+func (pw *ProfilesWriter) writeSymbolQuality(quality *SymbolQuality, serviceId uint32, hostname string,
+	timestamp time.Time) {
+	if pw.symbolQualityRecords == nil || quality.TotalFrames == 0 {
+		return
+	}
+	pw.symbolQualityRecords <- quality.Record(serviceId, hostname, timestamp)
+}
+
+// guardTimestamp applies the timestamp guard to a profile, recording an anomaly when its timestamp is out of range
+func (pw *ProfilesWriter) guardTimestamp(timestamp time.Time, serviceId uint32, hostname string) (time.Time, error) {
+	now := time.Now().UTC()
+	bounded, anomaly, err := pw.timestampGuard.Apply(timestamp, now)
+	if anomaly == "" {
+		return bounded, nil
+	}
+	logger.Warnf("timestamp %s of a profile of service %d from %s is out of range (%s)",
+		timestamp.Format(time.RFC3339), serviceId, hostname, anomaly)
+	if pw.anomalyRecords != nil {
+		recordTimestamp := bounded
+		if err != nil {
+			recordTimestamp = now
+		}
+		pw.anomalyRecords <- AnomalyRecord{
+			Timestamp: recordTimestamp,
+			ServiceId: serviceId,
+			HostName:  hostname,
+			Kind:      anomaly,
+			Count:     1,
+			Example:   timestamp.Format(time.RFC3339),
+		}
+	}
+	return bounded, err
+}
+
+// recordLateArrival records an anomaly for a profile written long after its timestamp, its rollup buckets
+// can be recomputed with -recompute-rollups
+func (pw *ProfilesWriter) recordLateArrival(timestamp time.Time, serviceId uint32, hostname string) {
+	delay := LateArrivalDelay(timestamp, time.Now().UTC(), pw.lateArrivalThreshold)
+	if delay == 0 || pw.anomalyRecords == nil {
+		return
+	}
+	logger.Infof("profile of service %d from %s arrived %s late", serviceId, hostname, delay)
+	pw.anomalyRecords <- AnomalyRecord{
+		Timestamp: timestamp,
+		ServiceId: serviceId,
+		HostName:  hostname,
+		Kind:      AnomalyLateArrival,
+		Count:     1,
+		Example:   delay.String(),
+	}
+}
+
+func (pw *ProfilesWriter) ParseStackFrameFile(storage Storage, task Task, timestamp time.Time, buf []byte) error {
 	var fileInfo FileInfo
 	var withMetadata bool
 	var err error
@@ -248,6 +369,17 @@ func (pw *ProfilesWriter) ParseStackFrameFile(sess *session.Session, task SQSMes
 
 	weights := make(FrameValuesMap)
 	mapFrames := make(map[string]Frame)
+	quality := NewSymbolQuality()
+	// leaf frames samples, for the top frames of the hooks
+	var leafSamples map[string]int
+	if pw.hooks != nil {
+		leafSamples = make(map[string]int)
+	}
+	// the frames repeat across the stacks of a file, each of them is demangled once
+	var demangled map[string]string
+	if pw.demangleFrames {
+		demangled = make(map[string]string)
+	}
 	scanner := bufio.NewScanner(strings.NewReader(string(buf)))
 	scannerBuf := make([]byte, 0, ScannerBufSize)
 	scanner.Buffer(scannerBuf, MaxScannerBufSize)
@@ -257,18 +389,32 @@ func (pw *ProfilesWriter) ParseStackFrameFile(sess *session.Session, task SQSMes
 		if strings.HasPrefix(line, "#") {
 			fileInfo, withMetadata, err = parseStackFileMeta(line)
 			if err != nil {
-				return err
+				return Permanent(err)
 			}
 		} else {
 			withContainer := fileInfo.Metadata.RunArguments.ProfileApiVersion != V1Prefix
-			sampleCount, rawContainerName, stack := extractStack(line, withContainer, withMetadata)
+			sampleCount, stackKey, stack := extractStack(line, withContainer, withMetadata)
 			if isSwapper(stack) {
 				continue
 			}
 			if sampleCount == 0 {
 				continue
 			}
-			processStack(stack, sampleCount, rawContainerName, weights, mapFrames)
+			if demangled != nil {
+				for idx, frame := range stack {
+					name, ok := demangled[frame]
+					if !ok {
+						name = DemangleFrame(frame)
+						demangled[frame] = name
+					}
+					stack[idx] = name
+				}
+			}
+			processStack(stack, sampleCount, stackKey, weights, mapFrames)
+			quality.AddStack(stack, sampleCount)
+			if leafSamples != nil && len(stack) > 0 {
+				leafSamples[stack[len(stack)-1]] += sampleCount
+			}
 		}
 	}
 	err = scanner.Err()
@@ -283,10 +429,25 @@ func (pw *ProfilesWriter) ParseStackFrameFile(sess *session.Session, task SQSMes
 
 	logger.Debugf("end processing file %d, record(s) to insert %d, uniq frame(s) %d", serviceId,
 		nRecords, len(mapFrames))
+	// the raw hostname is kept for the S3 objects and PostgreSQL metadata, only the ClickHouse records are encrypted
+	hostname := pw.hostNames.Encrypt(fileInfo.Metadata.Hostname)
+	timestamp, err = pw.guardTimestamp(timestamp, uint32(serviceId), hostname)
+	if err != nil {
+		return err
+	}
+	pw.recordLateArrival(timestamp, uint32(serviceId), hostname)
+	var appMetadata []AppMetadata
+	if withMetadata {
+		appMetadata = parseAppMetadataList(fileInfo.ApplicationMetadata)
+	}
 	pw.chMutex.Lock()
 	pw.writeStacks(weights, mapFrames, uint32(serviceId),
-		fileInfo.Metadata.CloudInfo.InstanceType, fileInfo.Metadata.Hostname, timestamp)
+		fileInfo.Metadata.CloudInfo.InstanceType, hostname, timestamp, appMetadata, task.delivery)
 	pw.chMutex.Unlock()
+	pw.writeSymbolQuality(quality, uint32(serviceId), hostname, timestamp)
+	if pw.tagger != nil {
+		pw.tagger.TagService(serviceId, mapFrames)
+	}
 
 	var htmlBlobPath string
 	if fileInfo.HTMLBlob != "" {
@@ -296,7 +457,7 @@ func (pw *ProfilesWriter) ParseStackFrameFile(sess *session.Session, task SQSMes
 		if err != nil {
 			log.Errorf("failed to decode base64 HTML blob for file %s: %v", task.Filename, err)
 		} else {
-			err = PutFileToS3(sess, s3bucket, htmlBlobPath, decodedBlob)
+			_, err = uploadArtifact(storage, htmlBlobPath, decodedBlob, pw.uploads.HTMLBlob)
 			if err != nil {
 				log.Errorf("failed to upload HTML blob for file %s: %v", task.Filename, err)
 			}
@@ -334,13 +495,24 @@ func (pw *ProfilesWriter) ParseStackFrameFile(sess *session.Session, task SQSMes
 			flamegraphData = decodedFlamegraph
 		}
 		
-		err = PutFileToS3(sess, s3bucket, flamegraphHTMLPath, flamegraphData)
+		// deduplicated flamegraphs are only reachable through their metadata, the continuous ones have none
+		objectPath, contentKey := flamegraphHTMLPath, ""
+		uploadPolicy := pw.uploads.FlamegraphHTML
+		if pw.dedupFlamegraphs && profilingType == ProfilingTypeAdhoc {
+			contentKey = flamegraphContentKey(task.Service, flamegraphData)
+			// the content of a content addressed object never changes
+			objectPath, uploadPolicy = contentKey, OverwriteNever
+		}
+		uploaded, err := uploadArtifact(storage, objectPath, flamegraphData, uploadPolicy)
 		if err != nil {
 			log.Errorf("failed to upload flamegraph HTML for file %s: %v", task.Filename, err)
 		} else {
-			log.Infof("successfully uploaded flamegraph HTML to %s", flamegraphHTMLPath)
-			
-			// Store metadata in PostgreSQL for all adhoc profiles
+			if uploaded {
+				log.Infof("successfully uploaded flamegraph HTML to %s", objectPath)
+			}
+
+			// Store metadata in PostgreSQL for all adhoc profiles, even when the upload is skipped as a
+			// redelivered task may have failed to store it
 			if profilingType == ProfilingTypeAdhoc {
 				// Extract perf_events from profile metadata only if perf_mode is enabled
 				var perfEvents []string
@@ -366,6 +538,7 @@ func (pw *ProfilesWriter) ParseStackFrameFile(sess *session.Session, task SQSMes
 					perfEvents,
 					timestamp,
 					int64(len(flamegraphData)),
+					contentKey,
 				)
 				if err != nil {
 					log.Errorf("failed to store flamegraph metadata for %s: %v", flamegraphHTMLPath, err)
@@ -385,11 +558,25 @@ func (pw *ProfilesWriter) ParseStackFrameFile(sess *session.Session, task SQSMes
 	if htmlBlobPath != "" || (fileInfo.Metrics.CPUAvg != 0 && fileInfo.Metrics.MemoryAvg != 0) {
 		log.Infof("DEBUG: Writing metrics for hostname=%s", fileInfo.Metadata.Hostname)
 		pw.writeMetrics(uint32(serviceId), fileInfo.Metadata.CloudInfo.InstanceType,
-			fileInfo.Metadata.Hostname, timestamp, fileInfo.Metrics.CPUAvg,
+			hostname, timestamp, fileInfo.Metrics.CPUAvg,
 			fileInfo.Metrics.MemoryAvg, htmlBlobPath)
 	} else {
 		log.Infof("DEBUG: SKIPPING metrics write for hostname=%s - condition failed", fileInfo.Metadata.Hostname)
 	}
 
+	if pw.hooks != nil {
+		pw.hooks.FileIngested(IngestionSummary{
+			Service:    task.Service,
+			ServiceId:  serviceId,
+			Filename:   task.Filename,
+			HostName:   fileInfo.Metadata.Hostname,
+			Timestamp:  timestamp,
+			Rows:       nRecords,
+			Samples:    quality.TotalSamples,
+			TopFrames:  topLeafFrames(leafSamples, hookTopFrames),
+			IngestedAt: time.Now().UTC(),
+		})
+	}
+
 	return nil
 }
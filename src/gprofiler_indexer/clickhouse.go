@@ -39,16 +39,21 @@ type StackRecord struct {
 	Name               string
 	Parent             uint64
 	InsertionTimestamp time.Time
+	AppVersion         string
+	Endpoint           string
+	JobName            string
+	// delivery acknowledges the task of the record once written, nil when the record has no task to acknowledge
+	delivery *TaskDelivery
 }
 
 type MetricRecord struct {
-	Timestamp                time.Time
-	ServiceId                uint32
-	InstanceType             string
-	HostName                 string
-	CPUAverageUsedPercent    float64
-	MemoryAverageUsedPercent float64
-	HTMLPath                 string
+	Timestamp                time.Time `json:"timestamp"`
+	ServiceId                uint32    `json:"service_id"`
+	InstanceType             string    `json:"instance_type"`
+	HostName                 string    `json:"hostname"`
+	CPUAverageUsedPercent    float64   `json:"cpu_average_used_percent"`
+	MemoryAverageUsedPercent float64   `json:"memory_average_used_percent"`
+	HTMLPath                 string    `json:"html_path"`
 }
 
 type RecordsAttributesUnpack interface {
@@ -82,6 +87,9 @@ func (sr StackRecord) getDbAttributes() []interface{} {
 		sr.Parent,
 		sr.InsertionTimestamp,
 		uint32(0),
+		sr.AppVersion,
+		sr.Endpoint,
+		sr.JobName,
 	}
 	return dbAttributes
 }
@@ -100,6 +108,17 @@ type ClickHouseSettings struct {
 	ClickHouseMetricsTable string
 }
 
+func NewClickHouseSettings(args *CLIArgs) *ClickHouseSettings {
+	return &ClickHouseSettings{
+		Addr:                   args.ClickHouseAddr,
+		Database:               "flamedb",
+		Username:               args.ClickHouseUser,
+		Password:               args.ClickHousePassword,
+		ClickHouseMetricsTable: args.ClickHouseMetricsTable,
+		ClickHouseStacksTable:  args.ClickHouseStacksTable,
+	}
+}
+
 func NewClickHouseClient(settings *ClickHouseSettings) (*ClickHouseClient, error) {
 	logger.Debugf("Connecting to ClickHouse: %s", settings.Addr)
 	var tlsCfg *tls.Config
@@ -139,15 +158,15 @@ func NewClickHouseClient(settings *ClickHouseSettings) (*ClickHouseClient, error
 	}, nil
 }
 
-func (c *ClickHouseClient) clickHouseWrite(records []RecordsAttributesUnpack, tableName string) {
+func (c *ClickHouseClient) clickHouseWrite(records []RecordsAttributesUnpack, tableName string) error {
 	if len(records) == 0 {
-		return
+		return nil
 	}
 	ctx := context.Background()
 	batch, err := c.conn.PrepareBatch(ctx, fmt.Sprintf("INSERT INTO %s", tableName))
 	if err != nil {
 		logger.Errorf("unable to prepare batch: %v", err)
-		return
+		return err
 	}
 
 	for _, temp := range records {
@@ -157,30 +176,107 @@ func (c *ClickHouseClient) clickHouseWrite(records []RecordsAttributesUnpack, ta
 	}
 	if err = batch.Send(); err != nil {
 		logger.Errorf("unable to send batch: %v", err)
-	} else {
-		logger.Debugf("successfully sent %d records to %s", len(records), tableName)
+		return err
 	}
+	logger.Debugf("successfully sent %d records to %s", len(records), tableName)
+	return nil
 }
 
-func BufferedClickHouseWrite(args *CLIArgs, channels *RecordChannels, wg *sync.WaitGroup) {
+// writeToTables writes records to the active (and shadow) tables of baseTable. The error of the active table is
+// returned, the failures of the shadow table are only reported by the clickhouse_insert_failed metric.
+func (c *ClickHouseClient) writeToTables(records []RecordsAttributesUnpack, baseTable string,
+	metrics MetricsPublisher) error {
+	var activeErr error
+	for idx, tableName := range clickHouseTables.Targets(baseTable) {
+		err := c.clickHouseWrite(records, tableName)
+		if idx == 0 {
+			activeErr = err
+		} else if err != nil {
+			metrics.SendErrorMetric("clickhouse_insert_failed", map[string]string{"table": tableName})
+		}
+	}
+	return activeErr
+}
+
+// clickHouseWriter writes the batches of BufferedClickHouseWrite to the cluster of their residency region. Only
+// the inserts of the stacks and metrics count toward the backpressure, the failures of the optional tables (symbol
+// quality, anomalies, sidecars, frame ages) are reported by the clickhouse_insert_failed metric, so that e.g. the
+// schema drift of an optional table never pauses the polling.
+type clickHouseWriter struct {
+	clients      map[string]*ClickHouseClient
+	residency    *ResidencyRouter
+	backpressure *Backpressure
+	audit        *DeliveryAudit
+	forwarder    *Forwarder
+	metrics      MetricsPublisher
+	stacksTable  string
+	metricsTable string
+}
+
+func (cw *clickHouseWriter) write(records []RecordsAttributesUnpack, baseTable string, forward bool) {
+	for region, regionRecords := range cw.residency.Split(records) {
+		if len(regionRecords) > 0 {
+			err := cw.clients[region].writeToTables(regionRecords, baseTable, cw.metrics)
+			if baseTable == cw.stacksTable || baseTable == cw.metricsTable {
+				cw.backpressure.RecordInsert(err)
+			} else if err != nil {
+				cw.metrics.SendErrorMetric("clickhouse_insert_failed", map[string]string{"table": baseTable})
+			}
+			if baseTable == cw.stacksTable {
+				cw.audit.RowsWritten(regionRecords, err)
+				acknowledgeWritten(regionRecords, err)
+			}
+		}
+		if forward && region == "" {
+			cw.forwarder.Forward(regionRecords)
+		}
+	}
+}
+
+// BufferedClickHouseWrite writes the records of the services bound to a residency region to the cluster
+// of the region, and only forwards the records of the default region
+func BufferedClickHouseWrite(args *CLIArgs, channels *RecordChannels, residency *ResidencyRouter,
+	backpressure *Backpressure, audit *DeliveryAudit, metrics MetricsPublisher, wg *sync.WaitGroup) {
 	defer wg.Done()
 	logger.Debug("BufferedClickHouseWrite started")
-	settings := ClickHouseSettings{
-		Addr:                   args.ClickHouseAddr,
-		Database:               "flamedb",
-		Username:               args.ClickHouseUser,
-		Password:               args.ClickHousePassword,
-		ClickHouseMetricsTable: args.ClickHouseMetricsTable,
-		ClickHouseStacksTable:  args.ClickHouseStacksTable,
-	}
-	clickhouseClient, err := NewClickHouseClient(&settings)
+	clickhouseClients, err := NewClickHouseClients(args, residency)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	writer := &clickHouseWriter{clients: clickhouseClients, residency: residency, backpressure: backpressure,
+		audit: audit, metrics: metrics, stacksTable: args.ClickHouseStacksTable,
+		metricsTable: args.ClickHouseMetricsTable}
+	// forwarder is nil unless a remote indexer is configured, Forward and Close are no-ops then
+	if args.ForwardURL != "" {
+		writer.forwarder = NewForwarder(args.ForwardURL, args.ForwardToken, args.ForwardQueueSize, ListServiceNames)
+		defer writer.forwarder.Close()
+	}
+	write := writer.write
+	writeAndForward := func(records []RecordsAttributesUnpack, baseTable string) {
+		write(records, baseTable, true)
+	}
+	// the stacks channel is set to nil once closed, the health checks keep their own reference
+	stacksRecords := channels.StacksRecords
+	backpressureCtx, stopBackpressure := context.WithCancel(context.Background())
+	defer stopBackpressure()
+	go backpressure.Run(backpressureCtx, backpressureCheckInterval, func() float64 {
+		return float64(len(stacksRecords)) / float64(cap(stacksRecords))
+	}, func(ctx context.Context) error {
+		for _, clickhouseClient := range clickhouseClients {
+			if err := clickhouseClient.conn.Ping(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	stacksTicker := time.NewTicker(time.Second * ClickHouseStacksFlushTimeout)
 	metricsTicker := time.NewTicker(time.Second * ClickHouseMetricsFlushTimeout)
 	buffRecords := make([]RecordsAttributesUnpack, 0)
 	buffMetricsRecords := make([]RecordsAttributesUnpack, 0)
+	buffSymbolQualityRecords := make([]RecordsAttributesUnpack, 0)
+	buffAnomalyRecords := make([]RecordsAttributesUnpack, 0)
+	buffSidecarRecords := make([]RecordsAttributesUnpack, 0)
+	buffFrameAgeRecords := make([]RecordsAttributesUnpack, 0)
 
 	for {
 		select {
@@ -188,7 +284,7 @@ func BufferedClickHouseWrite(args *CLIArgs, channels *RecordChannels, wg *sync.W
 			if ok {
 				buffRecords = append(buffRecords, stackRecord)
 				if len(buffRecords) >= args.ClickHouseStacksBatchSize {
-					clickhouseClient.clickHouseWrite(buffRecords, args.ClickHouseStacksTable)
+					writeAndForward(buffRecords, args.ClickHouseStacksTable)
 					logger.Debugf("Flush %d stacks records to clickhouse", len(buffRecords))
 					buffRecords = make([]RecordsAttributesUnpack, 0)
 					stacksTicker.Reset(time.Second * ClickHouseStacksFlushTimeout)
@@ -197,14 +293,14 @@ func BufferedClickHouseWrite(args *CLIArgs, channels *RecordChannels, wg *sync.W
 				channels.StacksRecords = nil
 			}
 		case <-stacksTicker.C:
-			clickhouseClient.clickHouseWrite(buffRecords, args.ClickHouseStacksTable)
+			writeAndForward(buffRecords, args.ClickHouseStacksTable)
 			logger.Debugf("Flush %d stacks records to clickhouse on timeout %ds", len(buffRecords), ClickHouseStacksFlushTimeout)
 			buffRecords = make([]RecordsAttributesUnpack, 0)
 		case metricRecords, ok := <-channels.MetricsRecords:
 			if ok {
 				buffMetricsRecords = append(buffMetricsRecords, metricRecords)
 				if len(buffMetricsRecords) >= args.ClickHouseMetricsBatchSize {
-					clickhouseClient.clickHouseWrite(buffMetricsRecords, args.ClickHouseMetricsTable)
+					writeAndForward(buffMetricsRecords, args.ClickHouseMetricsTable)
 					logger.Debugf("Flush %d metrics records to clickhouse", len(buffMetricsRecords))
 					buffMetricsRecords = make([]RecordsAttributesUnpack, 0)
 					metricsTicker.Reset(time.Second * ClickHouseMetricsFlushTimeout)
@@ -212,23 +308,61 @@ func BufferedClickHouseWrite(args *CLIArgs, channels *RecordChannels, wg *sync.W
 			} else {
 				channels.MetricsRecords = nil
 			}
+		case symbolQualityRecord, ok := <-channels.SymbolQualityRecords:
+			if ok {
+				buffSymbolQualityRecords = append(buffSymbolQualityRecords, symbolQualityRecord)
+			} else {
+				channels.SymbolQualityRecords = nil
+			}
+		case anomalyRecord, ok := <-channels.AnomalyRecords:
+			if ok {
+				buffAnomalyRecords = append(buffAnomalyRecords, anomalyRecord)
+			} else {
+				channels.AnomalyRecords = nil
+			}
+		case sidecarRecord, ok := <-channels.SidecarRecords:
+			if ok {
+				buffSidecarRecords = append(buffSidecarRecords, sidecarRecord)
+			} else {
+				channels.SidecarRecords = nil
+			}
+		case frameAgeRecord, ok := <-channels.FrameAgeRecords:
+			if ok {
+				buffFrameAgeRecords = append(buffFrameAgeRecords, frameAgeRecord)
+			} else {
+				channels.FrameAgeRecords = nil
+			}
 		case <-metricsTicker.C:
-			clickhouseClient.clickHouseWrite(buffMetricsRecords, args.ClickHouseMetricsTable)
+			writeAndForward(buffMetricsRecords, args.ClickHouseMetricsTable)
 			logger.Debugf("Flush %d metrics records to clickhouse on timeout %ds", len(buffMetricsRecords), ClickHouseMetricsFlushTimeout)
 			buffMetricsRecords = make([]RecordsAttributesUnpack, 0)
+			write(buffSymbolQualityRecords, args.ClickHouseSymbolQualityTable, false)
+			buffSymbolQualityRecords = make([]RecordsAttributesUnpack, 0)
+			write(buffAnomalyRecords, args.ClickHouseAnomaliesTable, false)
+			buffAnomalyRecords = make([]RecordsAttributesUnpack, 0)
+			write(buffSidecarRecords, args.ClickHouseSidecarsTable, false)
+			buffSidecarRecords = make([]RecordsAttributesUnpack, 0)
+			write(buffFrameAgeRecords, args.ClickHouseFrameAgesTable, false)
+			buffFrameAgeRecords = make([]RecordsAttributesUnpack, 0)
 		}
 		if channels.StacksRecords == nil {
 			stacksTicker.Stop()
 		}
-		if channels.MetricsRecords == nil {
+		otherRecordsDone := channels.SymbolQualityRecords == nil && channels.AnomalyRecords == nil &&
+			channels.SidecarRecords == nil && channels.FrameAgeRecords == nil
+		if channels.MetricsRecords == nil && otherRecordsDone {
 			metricsTicker.Stop()
 		}
-		if channels.StacksRecords == nil && channels.MetricsRecords == nil {
+		if channels.StacksRecords == nil && channels.MetricsRecords == nil && otherRecordsDone {
 			break
 		}
 	}
 	// flush buffer on exit
-	clickhouseClient.clickHouseWrite(buffRecords, args.ClickHouseStacksTable)
-	clickhouseClient.clickHouseWrite(buffMetricsRecords, args.ClickHouseMetricsTable)
+	writeAndForward(buffRecords, args.ClickHouseStacksTable)
+	writeAndForward(buffMetricsRecords, args.ClickHouseMetricsTable)
+	write(buffSymbolQualityRecords, args.ClickHouseSymbolQualityTable, false)
+	write(buffAnomalyRecords, args.ClickHouseAnomaliesTable, false)
+	write(buffSidecarRecords, args.ClickHouseSidecarsTable, false)
+	write(buffFrameAgeRecords, args.ClickHouseFrameAgesTable, false)
 	logger.Debug("BufferedClickHouseWrite finished")
 }
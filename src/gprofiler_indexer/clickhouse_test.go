@@ -77,12 +77,13 @@ func ingestData(tb testing.TB, args *CLIArgs, filename string) {
 	callStackWriter := NewProfilesWriter(&channels)
 	tasksWaitGroup.Add(1)
 
-	tasks := make(chan SQSMessage, 1)
-	go Worker(0, args, tasks, callStackWriter, &tasksWaitGroup)
+	tasks := make(chan Task, 1)
+	go Worker(0, tasks, NewFolderTaskSource(""), NewMemoryStorage(), callStackWriter, NoopMetricsPublisher{},
+		&tasksWaitGroup)
 	buffWriterWaitGroup.Add(1)
-	go BufferedClickHouseWrite(args, &channels, &buffWriterWaitGroup)
+	go BufferedClickHouseWrite(args, &channels, nil, nil, nil, NoopMetricsPublisher{}, &buffWriterWaitGroup)
 
-	tasks <- SQSMessage{
+	tasks <- Task{
 		Filename: filename,
 	}
 
@@ -17,8 +17,28 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/google/pprof/profile"
 )
 
 func TestMain(m *testing.M) {
@@ -46,3 +66,2051 @@ func TestFrameReplaceRegexes(t *testing.T) {
 		}
 	}
 }
+
+func TestAppMetadataForFrame(t *testing.T) {
+	list := parseAppMetadataList([]map[string]interface{}{
+		nil,
+		{"app_version": "1.2.3", "route": "/api/users", "job": "  "},
+		{"service_version": 7.0, "task_name": "nightly-export"},
+	})
+	tests := []struct {
+		frame  string
+		output AppMetadata
+	}{
+		{frame: "0", output: AppMetadata{}},
+		{frame: "1", output: AppMetadata{AppVersion: "1.2.3", Endpoint: "/api/users"}},
+		{frame: "2", output: AppMetadata{AppVersion: "7", JobName: "nightly-export"}},
+		{frame: "3", output: AppMetadata{}},
+		{frame: "not-an-index", output: AppMetadata{}},
+	}
+	for _, test := range tests {
+		output := appMetadataForFrame(list, test.frame)
+		if output != test.output {
+			t.Errorf("frame %s: %+v != %+v", test.frame, output, test.output)
+		}
+	}
+}
+
+func TestAddPprofStacks(t *testing.T) {
+	mainFn := &profile.Function{Name: "main.main"}
+	worker := &profile.Function{Name: "main.Worker"}
+	inlined := &profile.Function{Name: "main.processStack"}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		Sample: []*profile.Sample{
+			{
+				// leaf first, inlined function before its caller
+				Location: []*profile.Location{
+					{Line: []profile.Line{{Function: inlined}, {Function: worker}}},
+					{Line: []profile.Line{{Function: mainFn}}},
+				},
+				Value: []int64{3, 30000000},
+			},
+			{
+				Location: []*profile.Location{{Line: []profile.Line{{Function: mainFn}}}},
+				Value:    []int64{2, 20000000},
+			},
+		},
+	}
+	weights := make(FrameValuesMap)
+	frames := make(map[string]Frame)
+	if nStacks := AddPprofStacks(prof, AppName, StackKey{}, weights, frames); nStacks != 2 {
+		t.Fatalf("unexpected number of stacks %d", nStacks)
+	}
+	leafHash := GetHash(AppName + ":main.main:main.Worker:main.processStack")
+	if frames[leafHash].Name != "main.processStack" || weights[StackKey{}][leafHash].Weight != 3 {
+		t.Errorf("unexpected leaf frame %+v", frames[leafHash])
+	}
+	if weight := weights[StackKey{}][GetHash(AppName)].Weight; weight != 5 {
+		t.Errorf("root weight %d != 5", weight)
+	}
+}
+
+func TestIngestPprof(t *testing.T) {
+	channels := RecordChannels{StacksRecords: make(chan StackRecord, 10)}
+	handler := NewIngestHandler("secret", &channels, func(name string) (int, error) {
+		if name != "gprofiler-internal" {
+			return 0, fmt.Errorf("unexpected service %s", name)
+		}
+		return 7, nil
+	})
+	handler.profiles = NewProfilesWriter(&channels)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	mainFn := &profile.Function{ID: 1, Name: "main.main"}
+	location := &profile.Location{ID: 1, Line: []profile.Line{{Function: mainFn}}}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample:     []*profile.Sample{{Location: []*profile.Location{location}, Value: []int64{4}}},
+		Location:   []*profile.Location{location},
+		Function:   []*profile.Function{mainFn},
+	}
+	var body bytes.Buffer
+	if err := prof.Write(&body); err != nil {
+		t.Fatal(err)
+	}
+	post := func(query string, token string) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+IngestPprofPath+query, bytes.NewReader(body.Bytes()))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post("?service=gprofiler-internal&hostname=rest-1&process=restflamedb&timestamp=1700000000",
+		"secret"); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	records := make(map[string]StackRecord)
+	for len(channels.StacksRecords) > 0 {
+		record := <-channels.StacksRecords
+		records[record.Name] = record
+	}
+	leaf, ok := records["main.main"]
+	if len(records) != 2 || !ok || leaf.ServiceId != 7 || leaf.HostName != "rest-1" || leaf.NumSamples != 4 ||
+		leaf.Timestamp != time.Unix(1700000000, 0).UTC() || records["restflamedb"].CallStackHash != leaf.Parent {
+		t.Errorf("unexpected records %+v", records)
+	}
+	if status := post("?hostname=rest-1", "secret"); status != http.StatusBadRequest {
+		t.Errorf("profile without a service accepted with status %d", status)
+	}
+	if status := post("?service=gprofiler-internal&hostname=rest-1", "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("profile with a wrong token accepted with status %d", status)
+	}
+}
+
+func TestValidateSelfProfiling(t *testing.T) {
+	args := NewCliArgs()
+	args.SelfProfilingEnabled = true
+	if err := args.validateSelfProfiling(); err != nil {
+		t.Errorf("default self profiling periods rejected: %v", err)
+	}
+	args.SelfProfilingInterval = 0
+	if err := args.validateSelfProfiling(); err == nil {
+		t.Error("zero self profiling interval accepted")
+	}
+	args.SelfProfilingInterval = 300
+	args.SelfProfilingDuration = -1
+	if err := args.validateSelfProfiling(); err == nil {
+		t.Error("negative self profiling duration accepted")
+	}
+	args.SelfProfilingEnabled = false
+	if err := args.validateSelfProfiling(); err != nil {
+		t.Errorf("periods of disabled self profiling rejected: %v", err)
+	}
+}
+
+func TestSymbolQuality(t *testing.T) {
+	quality := NewSymbolQuality()
+	quality.AddStack([]string{"python", "main", "[unknown]"}, 4)
+	quality.AddStack([]string{"python", "main", "0x7f3a2b1c4d5e"}, 2)
+	quality.AddStack([]string{"python", "main", "do_syscall_64_[k]"}, 10)
+	quality.AddStack([]string{"python", "ffffffffa1b2c3d4_[k]", "handler"}, 1)
+
+	timestamp := time.Unix(1700000000, 0).UTC()
+	expected := SymbolQualityRecord{
+		Timestamp:             timestamp,
+		ServiceId:             3,
+		HostName:              "host",
+		TotalFrames:           7,
+		UnknownFrames:         1,
+		AddressOnlyFrames:     2,
+		TotalSamples:          17,
+		UnresolvedLeafSamples: 6,
+	}
+	if record := quality.Record(3, "host", timestamp); record != expected {
+		t.Errorf("%+v != %+v", record, expected)
+	}
+
+	deepStack := make([]string, truncatedStackDepth)
+	for idx := range deepStack {
+		deepStack[idx] = fmt.Sprintf("frame%d", idx)
+	}
+	quality.AddStack(deepStack, 5)
+	quality.AddStack(deepStack[:truncatedStackDepth-1], 3)
+	if record := quality.Record(3, "host", timestamp); record.TruncatedSamples != 5 {
+		t.Errorf("unexpected truncated samples %d", record.TruncatedSamples)
+	}
+}
+
+func TestDetectTechnologies(t *testing.T) {
+	frames := map[string]Frame{
+		"1": {Name: "java"},
+		"2": {Name: "org.apache.kafka.clients.producer.KafkaProducer.send_[j]"},
+		"3": {Name: "rocksdb::DBImpl::Get"},
+		"4": {Name: "SSL_read"},
+		"5": {Name: "rocksdb::BlockBasedTable::Get"},
+	}
+	tags := DetectTechnologies(frames)
+	expected := []string{"kafka-client", "openssl", "rocksdb"}
+	if strings.Join(tags, ",") != strings.Join(expected, ",") {
+		t.Errorf("%v != %v", tags, expected)
+	}
+
+	tagger := NewServiceTagger(time.Hour)
+	now := time.Now()
+	if due := tagger.dueTags(1, tags, now); len(due) != 3 {
+		t.Errorf("unexpected due tags %v", due)
+	}
+	if due := tagger.dueTags(1, []string{"grpc", "rocksdb"}, now.Add(time.Minute)); len(due) != 1 || due[0] != "grpc" {
+		t.Errorf("unexpected due tags %v", due)
+	}
+	if due := tagger.dueTags(1, tags, now.Add(2*time.Hour)); len(due) != 3 {
+		t.Errorf("unexpected due tags after refresh interval %v", due)
+	}
+}
+
+func TestWriteStacksAnomalies(t *testing.T) {
+	channels := RecordChannels{
+		StacksRecords:  make(chan StackRecord, 10),
+		AnomalyRecords: make(chan AnomalyRecord, 10),
+	}
+	pw := NewProfilesWriter(&channels)
+	frames := map[string]Frame{
+		"a1": {Name: "main"},
+		"b2": {Name: "child", Prev: "a1"},
+		"c3": {Name: "orphan", Prev: "ff"},
+	}
+	weights := FrameValuesMap{
+		StackKey{}: {"a1": {Weight: 2}, "b2": {Weight: 5}, "c3": {Weight: 1}},
+	}
+	pw.writeStacks(weights, frames, 1, "", "host", time.Unix(1700000000, 0).UTC(), nil, nil)
+	close(channels.AnomalyRecords)
+
+	kinds := make(map[string]AnomalyRecord)
+	for record := range channels.AnomalyRecords {
+		kinds[record.Kind] = record
+	}
+	if record := kinds[AnomalyWeightExceedsParent]; record.Count != 1 || record.Example != "child" {
+		t.Errorf("unexpected %s anomaly %+v", AnomalyWeightExceedsParent, record)
+	}
+	if record := kinds[AnomalyMissingParent]; record.Count != 1 || record.Example != "orphan" ||
+		record.HostName != "host" {
+		t.Errorf("unexpected %s anomaly %+v", AnomalyMissingParent, record)
+	}
+	if len(channels.StacksRecords) != 3 {
+		t.Errorf("unexpected number of stack records %d", len(channels.StacksRecords))
+	}
+}
+
+func TestImporter(t *testing.T) {
+	existing := importSlice{serviceId: 1, timestamp: 1700000000, hostname: "host-a"}
+	exists := func(slice importSlice) (bool, error) {
+		return slice == existing, nil
+	}
+	batches := make([]int, 0)
+	write := func(records []RecordsAttributesUnpack) error {
+		batches = append(batches, len(records))
+		return nil
+	}
+	lines := []string{
+		`{"timestamp":"2023-11-14T22:13:20Z","service_id":1,"hostname":"host-a","call_stack_hash":1}`,
+		`{"timestamp":"2023-11-14T22:13:20Z","service_id":1,"hostname":"host-b","call_stack_hash":1}`,
+		`{"timestamp":"2023-11-14T22:13:20Z","service_id":1,"hostname":"host-b","call_stack_hash":2}`,
+		`not json`,
+		`{"timestamp":"2023-11-14T22:14:20Z","service_id":1,"hostname":"host-b","call_stack_hash":1}`,
+	}
+	importer := NewImporter(1, exists, write)
+	if err := importer.Import(context.Background(), strings.NewReader(strings.Join(lines, "\n"))); err != nil {
+		t.Fatal(err)
+	}
+	expected := ImportStats{Lines: 5, InvalidLines: 1, Imported: 3, Skipped: 1, ImportedSlices: 2, SkippedSlices: 1}
+	if importer.Stats() != expected {
+		t.Errorf("%+v != %+v", importer.Stats(), expected)
+	}
+	// batches are only flushed on slice boundaries
+	if fmt.Sprint(batches) != "[2 1]" {
+		t.Errorf("unexpected batches %v", batches)
+	}
+}
+
+func TestForwardToIngestHandler(t *testing.T) {
+	channels := RecordChannels{
+		StacksRecords:  make(chan StackRecord, 10),
+		MetricsRecords: make(chan MetricRecord, 10),
+	}
+	// the spoke and the hub have their own ids for the same service
+	spokeNames := func() (map[int]string, error) {
+		return map[int]string{1: "checkout"}, nil
+	}
+	hubLookups := 0
+	server := httptest.NewServer(NewIngestHandler("secret", &channels, func(name string) (int, error) {
+		hubLookups += 1
+		if name != "checkout" {
+			return 0, fmt.Errorf("unexpected service %s", name)
+		}
+		return 42, nil
+	}))
+	defer server.Close()
+
+	timestamp := time.Unix(1700000000, 0).UTC()
+	stack := StackRecord{Timestamp: timestamp, ServiceId: 1, HostName: "host", NumSamples: 3, CallStackHash: 42,
+		Name: "main", InsertionTimestamp: timestamp, Endpoint: "/api/users"}
+	metric := MetricRecord{Timestamp: timestamp, ServiceId: 1, HostName: "host", CPUAverageUsedPercent: 12.5}
+
+	forwarder := NewForwarder(server.URL+"/", "secret", 10, spokeNames)
+	forwarder.Forward([]RecordsAttributesUnpack{stack})
+	forwarder.Forward([]RecordsAttributesUnpack{metric})
+	// a service unknown to the spoke can not be mapped, its batch is dropped
+	forwarder.Forward([]RecordsAttributesUnpack{StackRecord{ServiceId: 2}})
+	forwarder.Close()
+
+	stack.ServiceId = 42
+	metric.ServiceId = 42
+	if len(channels.StacksRecords) != 1 || <-channels.StacksRecords != stack {
+		t.Error("forwarded stack record was not ingested under the hub service id")
+	}
+	if len(channels.MetricsRecords) != 1 || <-channels.MetricsRecords != metric {
+		t.Error("forwarded metric record was not ingested under the hub service id")
+	}
+	if hubLookups != 1 {
+		t.Errorf("hub service id looked up %d times", hubLookups)
+	}
+
+	// batches of indexers not sending the service names are rejected
+	legacy, _ := json.Marshal(NewExportedSample(stack))
+	req, _ := http.NewRequest(http.MethodPost, server.URL+IngestSamplesPath, bytes.NewReader(legacy))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || len(channels.StacksRecords) != 0 {
+		t.Errorf("batch without service names accepted with status %d", resp.StatusCode)
+	}
+
+	unauthorized := NewForwarder(server.URL, "wrong", 10, spokeNames)
+	if err := unauthorized.send(forwardBatch{path: IngestSamplesPath}); err == nil {
+		t.Error("expected ingestion with a wrong token to fail")
+	}
+	unauthorized.Close()
+}
+
+func TestIngestBodyLimits(t *testing.T) {
+	channels := RecordChannels{StacksRecords: make(chan StackRecord, 10)}
+	handler := NewIngestHandler("secret", &channels, func(name string) (int, error) { return 1, nil })
+	handler.profiles = NewProfilesWriter(&channels)
+	handler.maxBodySize = 1024
+	handler.maxDecompressedSize = 4096
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	gzipped := func(data []byte) []byte {
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		writer.Write(data)
+		writer.Close()
+		return buffer.Bytes()
+	}
+	post := func(path string, body []byte, gzipEncoded bool) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		if gzipEncoded {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// blank lines are skipped, only the size of the bodies matters
+	if status := post(IngestSamplesPath, gzipped(bytes.Repeat([]byte("\n"), 4096)), true); status != http.StatusOK {
+		t.Errorf("body within the limits rejected with status %d", status)
+	}
+	if status := post(IngestSamplesPath, bytes.Repeat([]byte("\n"), 2048), false); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body answered with status %d", status)
+	}
+	bomb := gzipped(bytes.Repeat([]byte("\n"), 100000))
+	if len(bomb) > 1024 {
+		t.Fatalf("compressed body of %d bytes is over the body limit", len(bomb))
+	}
+	if status := post(IngestSamplesPath, bomb, true); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("gzip bomb answered with status %d", status)
+	}
+	pprofBomb := gzipped(make([]byte, 100000))
+	if status := post(IngestPprofPath+"?service=gprofiler-internal&hostname=rest-1", pprofBomb, false); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("pprof gzip bomb answered with status %d", status)
+	}
+	if len(channels.StacksRecords) != 0 {
+		t.Error("records of rejected bodies were queued")
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	newHandler := func(token string) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/orphans", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, map[string]string{})
+		})
+		mux.Handle(IngestSamplesPath, NewIngestHandler("ingest", &RecordChannels{}, GetOrCreateServiceId))
+		return NewAdminHandler(token, mux)
+	}
+	status := func(handler http.Handler, method string, path string, token string) int {
+		request := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	handler := newHandler("admin")
+	for _, test := range []struct {
+		method   string
+		path     string
+		token    string
+		expected int
+	}{
+		{http.MethodGet, "/version", "", http.StatusOK},
+		{http.MethodPost, "/orphans", "", http.StatusUnauthorized},
+		{http.MethodPost, "/orphans", "wrong", http.StatusUnauthorized},
+		{http.MethodPost, "/orphans", "ingest", http.StatusUnauthorized},
+		{http.MethodPost, "/orphans", "admin", http.StatusOK},
+		// the ingestion endpoints check the ingest token, not the admin one
+		{http.MethodPost, IngestSamplesPath, "admin", http.StatusUnauthorized},
+	} {
+		if code := status(handler, test.method, test.path, test.token); code != test.expected {
+			t.Errorf("%s %s with token %q: expected %d, got %d", test.method, test.path, test.token,
+				test.expected, code)
+		}
+	}
+
+	// without an admin token, only /version is served
+	handler = newHandler("")
+	if code := status(handler, http.MethodPost, "/orphans", ""); code != http.StatusUnauthorized {
+		t.Errorf("admin endpoint served without an admin token: %d", code)
+	}
+	if code := status(handler, http.MethodGet, "/version", ""); code != http.StatusOK {
+		t.Errorf("version not served without an admin token: %d", code)
+	}
+}
+
+// recordingMetricsPublisher records the SLI metrics sent, as "<response type>:<error tag>", the names
+// of the error metrics sent, and the counter metrics sent as "<name>:<service tag>=<value>"
+type recordingMetricsPublisher struct {
+	NoopMetricsPublisher
+	mutex    sync.Mutex
+	sli      []string
+	errors   []string
+	counters []string
+}
+
+func (rp *recordingMetricsPublisher) SendSLIMetric(responseType, methodName string, extraTags map[string]string) bool {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	rp.sli = append(rp.sli, responseType+":"+extraTags["error"])
+	return true
+}
+
+func (rp *recordingMetricsPublisher) SendErrorMetric(metricName string, extraTags map[string]string) bool {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	rp.errors = append(rp.errors, metricName)
+	return true
+}
+
+func (rp *recordingMetricsPublisher) SendCounterMetric(metricName string, value int64,
+	extraTags map[string]string) bool {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	rp.counters = append(rp.counters, fmt.Sprintf("%s:%s=%d", metricName, extraTags["service"], value))
+	return true
+}
+
+func TestSQSTaskSourceQueueURLFailure(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	args := NewCliArgs()
+	args.AWSRegion = "us-east-1"
+	args.AWSEndpoint = "http://127.0.0.1:1"
+	args.SQSQueue = "missing"
+	metrics := &recordingMetricsPublisher{}
+
+	NewSQSTaskSource(args, metrics).Fetch(context.Background(), make(chan Task))
+
+	expected := []string{ResponseTypeFailure + ":sqs_queue_url_failed"}
+	if !reflect.DeepEqual(metrics.sli, expected) {
+		t.Errorf("SLI metrics = %v, want %v", metrics.sli, expected)
+	}
+}
+
+// recordingAcknowledger records the outcome of the tasks, as "ack:<filename>", "nack:<filename>" or "retry:<filename>"
+type recordingAcknowledger struct {
+	mutex   sync.Mutex
+	results []string
+}
+
+func (ra *recordingAcknowledger) Ack(task Task) error {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	ra.results = append(ra.results, "ack:"+task.Filename)
+	return nil
+}
+
+func (ra *recordingAcknowledger) Nack(task Task) error {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	ra.results = append(ra.results, "nack:"+task.Filename)
+	return fmt.Errorf("nack failed")
+}
+
+func (ra *recordingAcknowledger) Retry(task Task) error {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	ra.results = append(ra.results, "retry:"+task.Filename)
+	return nil
+}
+
+func TestAcknowledgeWithMetrics(t *testing.T) {
+	acker := &recordingAcknowledger{}
+	metrics := &recordingMetricsPublisher{}
+	acknowledgeWithMetrics(acker, Task{Filename: "a", Service: "svc"}, true, metrics)
+	acknowledgeWithMetrics(acker, Task{Filename: "b", Service: "svc"}, false, metrics)
+
+	if expected := []string{"ack:a", "nack:b"}; !reflect.DeepEqual(acker.results, expected) {
+		t.Errorf("acknowledgements = %v, want %v", acker.results, expected)
+	}
+	if expected := []string{ResponseTypeFailure + ":sqs_delete_failed"}; !reflect.DeepEqual(metrics.sli, expected) {
+		t.Errorf("SLI metrics = %v, want %v", metrics.sli, expected)
+	}
+}
+
+func TestFolderTaskSource(t *testing.T) {
+	tasks := make(chan Task, 10)
+	NewFolderTaskSource("testdata").Fetch(context.Background(), tasks)
+	close(tasks)
+	count := 0
+	for task := range tasks {
+		if !strings.HasPrefix(task.Filename, "testdata/") || task.ServiceId != 1 || task.Service != "" {
+			t.Errorf("unexpected task %+v", task)
+		}
+		count += 1
+	}
+	if count == 0 {
+		t.Error("no task listed")
+	}
+}
+
+func TestParseStackFrameFileHTMLUpload(t *testing.T) {
+	buf, err := os.ReadFile("testdata/test_stackfile_html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameReplacer = NewFrameReplacer()
+	if err = frameReplacer.InitRegexps(NewCliArgs().FrameReplaceFileName); err != nil {
+		t.Fatal(err)
+	}
+	task := Task{Filename: "2023-12-03T16:31:00_abc_hash.gz", Service: "svc", ServiceId: 1}
+	htmlPath := "products/svc/stacks/2023-12-03T16:31:00_abc_hash.html"
+
+	for _, failUpload := range []bool{false, true} {
+		channels := RecordChannels{
+			StacksRecords:  make(chan StackRecord, 100000),
+			MetricsRecords: make(chan MetricRecord, 10),
+		}
+		storage := NewMemoryStorage()
+		if failUpload {
+			storage.FailPut(htmlPath, fmt.Errorf("injected failure"))
+		}
+		pw := NewProfilesWriter(&channels)
+		if err = pw.ParseStackFrameFile(storage, task, time.Unix(1700000000, 0).UTC(), buf); err != nil {
+			t.Fatalf("ParseStackFrameFile() error: %v", err)
+		}
+
+		if _, err = storage.Get(htmlPath); (err == nil) == failUpload {
+			t.Errorf("failUpload=%t: unexpected stored HTML blob, keys %v", failUpload, storage.Keys())
+		}
+		if len(channels.MetricsRecords) != 1 {
+			t.Fatalf("failUpload=%t: unexpected number of metrics records %d", failUpload,
+				len(channels.MetricsRecords))
+		}
+		if record := <-channels.MetricsRecords; record.HTMLPath != htmlPath {
+			t.Errorf("failUpload=%t: unexpected metrics record HTML path %s", failUpload, record.HTMLPath)
+		}
+		if len(channels.StacksRecords) == 0 {
+			t.Errorf("failUpload=%t: no stack records written", failUpload)
+		}
+	}
+}
+
+// fixtureStack is an expected stack record of a fixture, identified by its frames path joined with ";"
+type fixtureStack struct {
+	container    string
+	containerEnv string
+	appVersion   string
+	endpoint     string
+	jobName      string
+	path         string
+	samples      int
+}
+
+func (fs fixtureStack) record(serviceId uint32, instanceType string, hostname string,
+	timestamp time.Time) StackRecord {
+	frames := strings.Split(fs.path, ";")
+	hash := func(frames []string) uint64 {
+		value, _ := strconv.ParseUint(GetHash(strings.Join(frames, ":")), 16, 64)
+		return value
+	}
+	var parent uint64
+	if len(frames) > 1 {
+		parent = hash(frames[:len(frames)-1])
+	}
+	return StackRecord{
+		Timestamp:        timestamp,
+		ServiceId:        serviceId,
+		InstanceType:     instanceType,
+		ContainerEnvName: fs.containerEnv,
+		HostName:         hostname,
+		ContainerName:    fs.container,
+		NumSamples:       fs.samples,
+		CallStackHash:    hash(frames),
+		Parent:           parent,
+		Name:             frames[len(frames)-1],
+		AppVersion:       fs.appVersion,
+		Endpoint:         fs.endpoint,
+		JobName:          fs.jobName,
+	}
+}
+
+func sortStackRecords(records []StackRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].ContainerName != records[j].ContainerName {
+			return records[i].ContainerName < records[j].ContainerName
+		}
+		if records[i].AppVersion+records[i].JobName != records[j].AppVersion+records[j].JobName {
+			return records[i].AppVersion+records[i].JobName < records[j].AppVersion+records[j].JobName
+		}
+		return records[i].CallStackHash < records[j].CallStackHash
+	})
+}
+
+// TestWorkerFixtures runs recorded agent files through the worker, covering the container and
+// application metadata frame layouts of the supported agent versions
+func TestWorkerFixtures(t *testing.T) {
+	frameReplacer = NewFrameReplacer()
+	if err := frameReplacer.InitRegexps(NewCliArgs().FrameReplaceFileName); err != nil {
+		t.Fatal(err)
+	}
+	const filename = "2023-12-03T16:31:00_abc_hash.gz"
+	timestamp := time.Date(2023, 12, 3, 16, 31, 0, 0, time.UTC)
+
+	tests := []struct {
+		fixture      string
+		hostname     string
+		instanceType string
+		stacks       []fixtureStack
+	}{
+		{
+			// metadata frame then container frame, metadata index 0 means no metadata
+			fixture:      "agent_1_35_app_metadata.col",
+			hostname:     "host-a",
+			instanceType: "m5.large",
+			stacks: []fixtureStack{
+				{container: "web_web_default", containerEnv: "web_default", appVersion: "2.1.0",
+					endpoint: "/api/items", path: "python", samples: 7},
+				{container: "web_web_default", containerEnv: "web_default", appVersion: "2.1.0",
+					endpoint: "/api/items", path: "python;main", samples: 7},
+				{container: "web_web_default", containerEnv: "web_default", appVersion: "2.1.0",
+					endpoint: "/api/items", path: "python;main;handle_request", samples: 7},
+				{container: "web_web_default", containerEnv: "web_default", appVersion: "2.1.0",
+					endpoint: "/api/items", path: "python;main;handle_request;json_dumps", samples: 2},
+				{jobName: "nightly", path: "python", samples: 4},
+				{jobName: "nightly", path: "python;main", samples: 4},
+				{jobName: "nightly", path: "python;main;run_job", samples: 4},
+				{path: "python", samples: 1},
+				{path: "python;main", samples: 1},
+				{path: "python;main;handle_request", samples: 1},
+			},
+		},
+		{
+			// container frame only
+			fixture:      "agent_1_20_containers.col",
+			hostname:     "host-b",
+			instanceType: "n2-standard-4",
+			stacks: []fixtureStack{
+				{container: "redis", path: "redis-server", samples: 7},
+				{container: "redis", path: "redis-server;aeMain", samples: 7},
+				{container: "redis", path: "redis-server;aeMain;processCommand", samples: 7},
+				{container: "worker", path: "java", samples: 5},
+				{container: "worker", path: "java;Main.run_[j]", samples: 5},
+				{container: "worker", path: "java;Main.run_[j];Worker.process_[j]", samples: 5},
+				{path: "java", samples: 1},
+				{path: "java;Main.run_[j]", samples: 1},
+			},
+		},
+		{
+			// no container frame at all
+			fixture:      "v1_api.col",
+			hostname:     "host-c",
+			instanceType: "c5.xlarge",
+			stacks: []fixtureStack{
+				{path: "python", samples: 5},
+				{path: "python;main", samples: 5},
+				{path: "python;main;loop", samples: 5},
+				{path: "python;main;loop;sleep", samples: 1},
+			},
+		},
+		{
+			// without a header, files are parsed as the current API version
+			fixture: "no_header.col",
+			stacks: []fixtureStack{
+				{container: "app", path: "python", samples: 8},
+				{container: "app", path: "python;main", samples: 8},
+				{container: "app", path: "python;main;work", samples: 6},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			buf, err := os.ReadFile(filepath.Join("testdata", "fixtures", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			storage := NewMemoryStorage()
+			if err = storage.Put("products/svc/stacks/"+filename, buf); err != nil {
+				t.Fatal(err)
+			}
+			channels := RecordChannels{
+				StacksRecords:  make(chan StackRecord, 1000),
+				MetricsRecords: make(chan MetricRecord, 10),
+			}
+			acker := &recordingAcknowledger{}
+			tasks := make(chan Task, 1)
+			tasks <- Task{Filename: filename, Service: "svc", ServiceId: 7}
+			close(tasks)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			Worker(0, tasks, acker, storage, NewProfilesWriter(&channels), NoopMetricsPublisher{}, &wg)
+			close(channels.StacksRecords)
+
+			// the task is acknowledged once its stacks are written
+			if len(acker.results) != 0 {
+				t.Errorf("task acknowledged before its stacks are written: %v", acker.results)
+			}
+			got := make([]StackRecord, 0)
+			written := make([]RecordsAttributesUnpack, 0)
+			for record := range channels.StacksRecords {
+				written = append(written, record)
+				record.InsertionTimestamp = time.Time{}
+				record.delivery = nil
+				got = append(got, record)
+			}
+			acknowledgeWritten(written, nil)
+			if expected := []string{"ack:" + filename}; !reflect.DeepEqual(acker.results, expected) {
+				t.Errorf("acknowledgements = %v, want %v", acker.results, expected)
+			}
+			want := make([]StackRecord, 0, len(tt.stacks))
+			for _, stack := range tt.stacks {
+				want = append(want, stack.record(7, tt.instanceType, tt.hostname, timestamp))
+			}
+			sortStackRecords(got)
+			sortStackRecords(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("unexpected stack records\n got: %+v\nwant: %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestFilenameParser(t *testing.T) {
+	custom, err := NewFilenameParser(`^(?P<host>[^-]+)-(?P<timestamp>\d+)\.col$`, "20060102150405")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2023, 12, 3, 16, 31, 0, 0, time.UTC)
+	tests := []struct {
+		parser   *FilenameParser
+		filename string
+		expected FilenameInfo
+		fails    bool
+	}{
+		{parser: NewProfilesWriter(&RecordChannels{}).filenames, filename: "2023-12-03T16:31:00_abc_4f2a.gz",
+			expected: FilenameInfo{Timestamp: timestamp, Host: "4f2a", Suffix: "abc"}},
+		{parser: NewProfilesWriter(&RecordChannels{}).filenames, filename: "2023-12-03T16:31:00",
+			expected: FilenameInfo{Timestamp: timestamp}},
+		{parser: NewProfilesWriter(&RecordChannels{}).filenames, filename: "profile_abc_4f2a.gz", fails: true},
+		{parser: folderFilenames, filename: "2023-12-03T16_31_00_abc_4f2a",
+			expected: FilenameInfo{Timestamp: timestamp, Host: "4f2a", Suffix: "abc"}},
+		{parser: folderFilenames, filename: "test_stackfile", fails: true},
+		{parser: custom, filename: "host1-20231203163100.col", expected: FilenameInfo{Timestamp: timestamp, Host: "host1"}},
+		{parser: custom, filename: "2023-12-03T16:31:00_abc_4f2a.gz", fails: true},
+	}
+	for _, tt := range tests {
+		info, err := tt.parser.Parse(tt.filename)
+		if (err != nil) != tt.fails {
+			t.Errorf("Parse(%q) error = %v, fails %t", tt.filename, err, tt.fails)
+			continue
+		}
+		if !tt.fails && info != tt.expected {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.filename, info, tt.expected)
+		}
+	}
+
+	for _, pattern := range []string{`^(?P<time>.*)$`, `^(?P<timestamp>[$`} {
+		if _, err := NewFilenameParser(pattern, ISODateTimeFormat); err == nil {
+			t.Errorf("NewFilenameParser(%q) succeeded, want an error", pattern)
+		}
+	}
+}
+
+func TestFileTimestampFallback(t *testing.T) {
+	pw := NewProfilesWriter(&RecordChannels{})
+	metrics := &recordingMetricsPublisher{}
+	before := time.Now().UTC()
+	timestamp := pw.fileTimestamp(Task{Filename: "profile.gz", Service: "svc"}, metrics)
+	if timestamp.Before(before) {
+		t.Errorf("fallback timestamp %v is before %v", timestamp, before)
+	}
+	if expected := []string{"filename_timestamp_fallback"}; !reflect.DeepEqual(metrics.errors, expected) {
+		t.Errorf("error metrics = %v, want %v", metrics.errors, expected)
+	}
+}
+
+func TestTimestampGuard(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clamp, err := NewTimestampGuard(10*time.Minute, 24*time.Hour, TimestampActionClamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reject, _ := NewTimestampGuard(10*time.Minute, 0, TimestampActionReject)
+	tests := []struct {
+		guard     TimestampGuard
+		timestamp time.Time
+		expected  time.Time
+		anomaly   string
+		rejected  bool
+	}{
+		{clamp, now.Add(5 * time.Minute), now.Add(5 * time.Minute), "", false},
+		{clamp, now.Add(3 * time.Hour), now, AnomalyTimestampClamped, false},
+		{clamp, now.Add(-48 * time.Hour), now.Add(-24 * time.Hour), AnomalyTimestampClamped, false},
+		{reject, now.Add(-48 * time.Hour), now.Add(-48 * time.Hour), "", false},
+		{reject, now.Add(3 * time.Hour), now.Add(3 * time.Hour), AnomalyTimestampRejected, true},
+		{TimestampGuard{}, now.Add(300 * time.Hour), now.Add(300 * time.Hour), "", false},
+	}
+	for _, tt := range tests {
+		timestamp, anomaly, err := tt.guard.Apply(tt.timestamp, now)
+		rejected := errors.Is(err, ErrTimestampOutOfRange)
+		if !timestamp.Equal(tt.expected) || anomaly != tt.anomaly || rejected != tt.rejected {
+			t.Errorf("%+v.Apply(%v) = %v, %q, %v", tt.guard, tt.timestamp, timestamp, anomaly, err)
+		}
+		if rejected && IsTransientError(err) {
+			t.Errorf("%+v.Apply(%v) rejected with a transient error %v", tt.guard, tt.timestamp, err)
+		}
+	}
+	if _, err = NewTimestampGuard(0, 0, "drop"); err == nil {
+		t.Errorf("NewTimestampGuard() accepted an invalid action")
+	}
+}
+
+func TestParseStackFrameFileTimestampRejected(t *testing.T) {
+	buf, err := os.ReadFile(filepath.Join("testdata", "fixtures", "v1_api.col"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameReplacer = NewFrameReplacer()
+	if err = frameReplacer.InitRegexps(NewCliArgs().FrameReplaceFileName); err != nil {
+		t.Fatal(err)
+	}
+	channels := RecordChannels{
+		StacksRecords:  make(chan StackRecord, 100),
+		MetricsRecords: make(chan MetricRecord, 10),
+		AnomalyRecords: make(chan AnomalyRecord, 10),
+	}
+	pw := NewProfilesWriter(&channels)
+	pw.timestampGuard, _ = NewTimestampGuard(10*time.Minute, 0, TimestampActionReject)
+	task := Task{Filename: "2023-12-03T16:31:00_abc_hash.gz", Service: "svc", ServiceId: 1}
+
+	err = pw.ParseStackFrameFile(NewMemoryStorage(), task, time.Now().UTC().Add(24*time.Hour), buf)
+	if !errors.Is(err, ErrTimestampOutOfRange) {
+		t.Fatalf("ParseStackFrameFile() error = %v, want %v", err, ErrTimestampOutOfRange)
+	}
+	if len(channels.StacksRecords) != 0 || len(channels.MetricsRecords) != 0 {
+		t.Errorf("records written for a rejected profile")
+	}
+	if len(channels.AnomalyRecords) != 1 {
+		t.Fatalf("unexpected number of anomaly records %d", len(channels.AnomalyRecords))
+	}
+	if record := <-channels.AnomalyRecords; record.Kind != AnomalyTimestampRejected || record.HostName != "host-c" {
+		t.Errorf("unexpected anomaly record %+v", record)
+	}
+}
+
+func TestLateArrivalDelay(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		timestamp time.Time
+		threshold time.Duration
+		expected  time.Duration
+	}{
+		{now.Add(-30 * time.Minute), time.Hour, 0},
+		{now.Add(-5 * time.Hour), time.Hour, 5 * time.Hour},
+		{now.Add(-5 * time.Hour), 0, 0},
+		{now.Add(time.Hour), time.Hour, 0},
+	}
+	for _, tt := range tests {
+		if delay := LateArrivalDelay(tt.timestamp, now, tt.threshold); delay != tt.expected {
+			t.Errorf("LateArrivalDelay(%v, %v) = %v, want %v", tt.timestamp, tt.threshold, delay, tt.expected)
+		}
+	}
+}
+
+func TestRollupQueries(t *testing.T) {
+	definitions := make(map[string]rollupDefinition)
+	for _, rollup := range rollupDefinitions {
+		definitions[rollup.name] = rollup
+	}
+	expected := "INSERT INTO flamedb.samples_1hour_all_v2 (Timestamp, ServiceId, CallStackHash, CallStackName, " +
+		"CallStackParent, NumSamples, ErrNumSamples, InsertionTimestamp) SELECT toStartOfHour(Timestamp) AS Timestamp, " +
+		"ServiceId, CallStackHash, any(CallStackName) AS CallStackName, any(CallStackParent) AS CallStackParent, " +
+		"sum(NumSamples) AS NumSamples, sum(ErrNumSamples) AS ErrNumSamples, anyLast(InsertionTimestamp) AS " +
+		"InsertionTimestamp FROM flamedb.samples_v2 WHERE ServiceId = ? AND Timestamp >= ? AND Timestamp < ? " +
+		"GROUP BY Timestamp, ServiceId, CallStackHash"
+	if query := definitions["1hour_all"].insertQuery("flamedb.samples", "_v2"); query != expected {
+		t.Errorf("insertQuery() = %s\nwant %s", query, expected)
+	}
+	query := definitions["1min"].insertQuery("flamedb.samples", "")
+	if !strings.Contains(query, "INSERT INTO flamedb.samples_1min (") ||
+		!strings.Contains(query, "AND CallStackParent = 0") || strings.Contains(query, "CallStackName") {
+		t.Errorf("unexpected minute rollup query %s", query)
+	}
+	expected = "ALTER TABLE flamedb.samples_1day DELETE WHERE ServiceId = ? AND Timestamp >= ? AND Timestamp < ? " +
+		"SETTINGS mutations_sync = 2"
+	if query = definitions["1day"].deleteQuery("flamedb.samples", ""); query != expected {
+		t.Errorf("deleteQuery() = %s\nwant %s", query, expected)
+	}
+}
+
+func TestRollupRanges(t *testing.T) {
+	hour := func(day, hour int) time.Time {
+		return time.Date(2024, 3, day, hour, 0, 0, 0, time.UTC)
+	}
+	buckets := []RollupBucket{
+		{ServiceId: 2, Hour: hour(1, 5)},
+		{ServiceId: 1, Hour: hour(1, 23)},
+		{ServiceId: 1, Hour: hour(1, 3)},
+		{ServiceId: 1, Hour: hour(1, 4)},
+		{ServiceId: 1, Hour: hour(2, 0)},
+		{ServiceId: 1, Hour: hour(1, 3)},
+	}
+	expected := []rollupRange{
+		{serviceId: 1, start: hour(1, 3), end: hour(1, 5)},
+		{serviceId: 1, start: hour(1, 23), end: hour(2, 1)},
+		{serviceId: 2, start: hour(1, 5), end: hour(1, 6)},
+	}
+	if ranges := rollupRanges(buckets, time.Hour); !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("hourly rollupRanges() = %v, want %v", ranges, expected)
+	}
+	expected = []rollupRange{
+		{serviceId: 1, start: hour(1, 0), end: hour(3, 0)},
+		{serviceId: 2, start: hour(1, 0), end: hour(2, 0)},
+	}
+	if ranges := rollupRanges(buckets, 24*time.Hour); !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("daily rollupRanges() = %v, want %v", ranges, expected)
+	}
+	if ranges := rollupRanges(nil, time.Hour); len(ranges) != 0 {
+		t.Errorf("rollupRanges(nil) = %v, want none", ranges)
+	}
+}
+
+func TestRecomputeStart(t *testing.T) {
+	createQuery := "CREATE TABLE flamedb.samples (`Timestamp` DateTime('UTC')) ENGINE = MergeTree " +
+		"PARTITION BY toYYYYMMDD(Timestamp) ORDER BY (ServiceId, Timestamp) TTL Timestamp + toIntervalDay(30) " +
+		"SETTINGS index_granularity = 8192"
+	if retention := ttlRetention(createQuery); retention != 30*24*time.Hour {
+		t.Errorf("ttlRetention() = %v, want 720h", retention)
+	}
+	if retention := ttlRetention("... TTL Timestamp + INTERVAL 7 DAY"); retention != 7*24*time.Hour {
+		t.Errorf("ttlRetention() = %v, want 168h", retention)
+	}
+	if retention := ttlRetention("CREATE TABLE flamedb.pins (...) ENGINE = MergeTree ORDER BY ServiceId"); retention != 0 {
+		t.Errorf("ttlRetention() without TTL = %v, want 0", retention)
+	}
+
+	now := time.Date(2024, 3, 31, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		lookback  time.Duration
+		retention time.Duration
+		expected  time.Time
+	}{
+		{72 * time.Hour, 30 * 24 * time.Hour, time.Date(2024, 3, 28, 10, 0, 0, 0, time.UTC)},
+		{72 * time.Hour, 0, time.Date(2024, 3, 28, 10, 0, 0, 0, time.UTC)},
+		// the stacks of March 1st expire during the day, its daily rollups must not be rebuilt
+		{60 * 24 * time.Hour, 30 * 24 * time.Hour, time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if start := recomputeStart(now, tt.lookback, tt.retention); !start.Equal(tt.expected) {
+			t.Errorf("recomputeStart(%v, %v) = %v, want %v", tt.lookback, tt.retention, start, tt.expected)
+		}
+	}
+}
+
+func TestReconciler(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-2 * time.Hour)
+	storage := NewMemoryStorage()
+	keys := map[string]time.Time{
+		"products/svc-a/stacks/flamegraph/1_adhoc_flamegraph.html":      old,
+		"products/svc-a/stacks/flamegraph/2_adhoc_flamegraph.html":      old,
+		"products/svc-a/stacks/flamegraph/3_adhoc_flamegraph.html":      now,
+		"products/svc-b/stacks/flamegraph/4_adhoc_flamegraph.html":      old,
+		"products/svc-b/stacks/flamegraph/5_continuous_flamegraph.html": old,
+		"products/svc-b/stacks/6.gz":                                    old,
+	}
+	for key, modified := range keys {
+		if err := storage.Put(key, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		storage.Touch(key, modified)
+	}
+	metadata := map[string]time.Time{
+		"products/svc-a/stacks/flamegraph/1_adhoc_flamegraph.html": old,
+		"products/svc-b/stacks/flamegraph/7_adhoc_flamegraph.html": old,
+		"products/svc-b/stacks/flamegraph/8_adhoc_flamegraph.html": now,
+	}
+	listMetadata := func() (map[string]time.Time, error) {
+		return metadata, nil
+	}
+	deleteMetadata := func(keys []string) (int64, error) {
+		for _, key := range keys {
+			delete(metadata, key)
+		}
+		return int64(len(keys)), nil
+	}
+	reconciler := NewReconciler(storage, listMetadata, deleteMetadata, time.Hour)
+
+	report := reconciler.Reconcile(now)
+	if report.Error != "" || report.ScannedObjects != 4 || report.MetadataRows != 3 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	orphanedObjects := make([]string, 0)
+	for _, object := range report.OrphanedObjects {
+		orphanedObjects = append(orphanedObjects, object.Key)
+	}
+	sort.Strings(orphanedObjects)
+	expectedObjects := []string{
+		"products/svc-a/stacks/flamegraph/2_adhoc_flamegraph.html",
+		"products/svc-b/stacks/flamegraph/4_adhoc_flamegraph.html",
+	}
+	if !reflect.DeepEqual(orphanedObjects, expectedObjects) {
+		t.Errorf("orphaned objects %v != %v", orphanedObjects, expectedObjects)
+	}
+	expectedMetadata := []string{"products/svc-b/stacks/flamegraph/7_adhoc_flamegraph.html"}
+	if !reflect.DeepEqual(report.OrphanedMetadata, expectedMetadata) {
+		t.Errorf("orphaned metadata %v != %v", report.OrphanedMetadata, expectedMetadata)
+	}
+
+	// deleting takes the admin token and an explicit dry_run=false
+	mux := http.NewServeMux()
+	mux.Handle("/orphans", reconciler)
+	handler := NewAdminHandler("admin", mux)
+	for _, test := range []struct {
+		path     string
+		token    string
+		expected int
+	}{
+		{"/orphans?dry_run=false", "", http.StatusUnauthorized},
+		{"/orphans?dry_run=false", "wrong", http.StatusUnauthorized},
+		{"/orphans", "admin", http.StatusOK},
+	} {
+		request := httptest.NewRequest(http.MethodPost, test.path, nil)
+		if test.token != "" {
+			request.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.expected {
+			t.Errorf("POST %s with token %q: expected %d, got %d", test.path, test.token, test.expected,
+				recorder.Code)
+		}
+		if _, err := storage.Get(expectedObjects[0]); err != nil {
+			t.Fatalf("POST %s with token %q deleted %s", test.path, test.token, expectedObjects[0])
+		}
+		if len(metadata) != 3 {
+			t.Fatalf("POST %s with token %q deleted metadata", test.path, test.token)
+		}
+	}
+
+	clean, _ := reconciler.Clean(now)
+	if clean.DeletedObjects != 2 || clean.DeletedMetadata != 1 || len(clean.Errors) != 0 {
+		t.Errorf("unexpected clean report %+v", clean)
+	}
+	if _, err := storage.Get(expectedObjects[0]); err == nil {
+		t.Errorf("%s was not deleted", expectedObjects[0])
+	}
+	report = reconciler.Reconcile(now)
+	if len(report.OrphanedObjects) != 0 || len(report.OrphanedMetadata) != 0 {
+		t.Errorf("orphans left after clean %+v", report)
+	}
+}
+
+func TestHostNameCipher(t *testing.T) {
+	if _, err := NewHostNameCipher("short"); err == nil {
+		t.Error("short key accepted")
+	}
+	var disabled *HostNameCipher
+	if disabled.Encrypt("host-a") != "host-a" {
+		t.Error("hostname encrypted by a nil cipher")
+	}
+	hostNames, err := NewHostNameCipher("0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the REST service decrypts this value, see TestHostNameEncryption of its handlers
+	encrypted := "enc:LmN2tXmxPuTMHZZAx8Cz6C7gGp53GSSxhEVOkylP_4IT6A"
+	if hostNames.Encrypt("host-a") != encrypted {
+		t.Errorf("%v != %v", hostNames.Encrypt("host-a"), encrypted)
+	}
+	if hostNames.Encrypt(encrypted) != encrypted {
+		t.Error("encrypted hostname encrypted twice")
+	}
+	if hostNames.Encrypt("host-b") == hostNames.Encrypt("host-a") {
+		t.Error("hostnames encrypted to the same value")
+	}
+}
+
+// hostNameCipherVector is a hostname encrypted with a key, the REST service checks the same vectors so that
+// both implementations of the scheme stay in sync
+type hostNameCipherVector struct {
+	Key       string `json:"key"`
+	HostName  string `json:"hostname"`
+	Encrypted string `json:"encrypted"`
+}
+
+func TestHostNameCipherVectors(t *testing.T) {
+	data, err := os.ReadFile("testdata/hostname_cipher_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []hostNameCipherVector
+	if err = json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	for _, vector := range vectors {
+		hostNames, err := NewHostNameCipher(vector.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted := hostNames.Encrypt(vector.HostName); encrypted != vector.Encrypted {
+			t.Errorf("Encrypt(%q) with key %q = %v, want %v", vector.HostName, vector.Key, encrypted, vector.Encrypted)
+		}
+	}
+}
+
+func TestServicePurger(t *testing.T) {
+	args := NewCliArgs()
+	args.ClickHouseAnomaliesTable = ""
+	tableNames, err := NewTableNames("", "_v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := PurgeTables(tableNames, args)
+	for _, expected := range []string{"flamedb.samples", "flamedb.samples_1day_all", "flamedb.metrics",
+		"flamedb.samples_v2", "flamedb.samples_1min_v2", "flamedb.samples_pinned", "flamedb.pins_v2"} {
+		found := false
+		for _, table := range tables {
+			found = found || table == expected
+		}
+		if !found {
+			t.Errorf("%s missing from %v", expected, tables)
+		}
+	}
+
+	deleted := make(map[int][]string)
+	purged := make([]int, 0)
+	failing := errors.New("mutation failed")
+	deleteRecords := func(ctx context.Context, table string, serviceId int) error {
+		if serviceId == 3 && table == "metrics" {
+			return failing
+		}
+		deleted[serviceId] = append(deleted[serviceId], table)
+		return nil
+	}
+	markPurged := func(serviceId int) error {
+		purged = append(purged, serviceId)
+		return nil
+	}
+	listDue := func() ([]int, error) {
+		return []int{1, 3, 2}, nil
+	}
+	purger := NewServicePurger([]string{"samples", "metrics"}, listDue, markPurged, deleteRecords)
+	count, err := purger.Purge(context.Background())
+	if !errors.Is(err, failing) || count != 1 {
+		t.Errorf("unexpected purge result %d, %v", count, err)
+	}
+	// a service is only marked purged once all its tables are cleared
+	if !reflect.DeepEqual(purged, []int{1}) || !reflect.DeepEqual(deleted[1], []string{"samples", "metrics"}) {
+		t.Errorf("unexpected purge %v %v", purged, deleted)
+	}
+}
+
+func TestResidencyRouter(t *testing.T) {
+	for _, invalid := range []string{
+		`{"regions": [{"name": "eu", "service_ids": [1]}]}`,
+		`{"regions": [{"name": "eu", "clickhouse_addr": "a:9000"}, {"name": "eu", "clickhouse_addr": "b:9000"}]}`,
+		`{"regions": [{"name": "eu", "clickhouse_addr": "a:9000", "service_ids": [1]},
+			{"name": "us", "clickhouse_addr": "b:9000", "service_ids": [1]}]}`,
+		`{"regions": [{"name": "eu", "clickhouse": "a:9000"}]}`,
+	} {
+		if _, err := ParseResidencyRegions([]byte(invalid)); err == nil {
+			t.Errorf("ParseResidencyRegions(%s) should fail", invalid)
+		}
+	}
+	regions, err := ParseResidencyRegions([]byte(`{"regions": [{"name": "eu", "clickhouse_addr": "clickhouse-eu:9000",
+		"s3_bucket": "profiles-eu", "service_ids": [12, 34]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := NewResidencyRouter(regions)
+	if rr.Region(12) != "eu" || rr.Region(1) != "" || (*ResidencyRouter)(nil).Region(12) != "" {
+		t.Errorf("unexpected regions")
+	}
+
+	records := []RecordsAttributesUnpack{
+		StackRecord{ServiceId: 1}, StackRecord{ServiceId: 12}, MetricRecord{ServiceId: 34}, AnomalyRecord{ServiceId: 2},
+	}
+	split := rr.Split(records)
+	if len(split[""]) != 2 || len(split["eu"]) != 2 {
+		t.Errorf("unexpected split %v", split)
+	}
+
+	source := NewMemoryStorage()
+	source.Put("products/svc/stacks/profile.gz", []byte("profile"))
+	euBucket := NewMemoryStorage()
+	rr.SetStorages(func(bucket string) BucketStorage {
+		if bucket != "profiles-eu" {
+			t.Errorf("unexpected bucket %s", bucket)
+		}
+		return euBucket
+	})
+	// profiles are read from the upload bucket, the derived objects go to the bucket of the region
+	storage := rr.Storage(12, source)
+	if data, err := storage.Get("products/svc/stacks/profile.gz"); err != nil || string(data) != "profile" {
+		t.Errorf("unexpected get %q, %v", data, err)
+	}
+	storage.Put("products/svc/stacks/flamegraph/graph.html", []byte("html"))
+	if len(euBucket.Keys()) != 1 || len(source.Keys()) != 1 {
+		t.Errorf("unexpected keys %v %v", euBucket.Keys(), source.Keys())
+	}
+	if rr.Storage(1, source) != Storage(source) {
+		t.Errorf("services of the default region should use the default bucket")
+	}
+
+	inventory := rr.Inventory(source)
+	prefixes, err := inventory.ListPrefixes("products/")
+	if err != nil || !reflect.DeepEqual(prefixes, []string{"products/svc/"}) {
+		t.Errorf("unexpected prefixes %v, %v", prefixes, err)
+	}
+	objects, err := inventory.List("products/svc/stacks/")
+	if err != nil || len(objects) != 2 {
+		t.Errorf("unexpected objects %v, %v", objects, err)
+	}
+	inventory.Delete("products/svc/stacks/flamegraph/graph.html")
+	if len(euBucket.Keys()) != 0 {
+		t.Errorf("object not deleted from the region bucket")
+	}
+}
+
+func TestUploadArtifact(t *testing.T) {
+	if _, err := NewUploadPolicies(OverwriteIfChanged, "sometimes"); err == nil {
+		t.Error("invalid overwrite policy accepted")
+	}
+	storage := NewMemoryStorage()
+	key := "products/svc/stacks/profile.html"
+	for _, test := range []struct {
+		policy   string
+		data     string
+		uploaded bool
+	}{
+		{OverwriteIfChanged, "v1", true},
+		{OverwriteIfChanged, "v1", false},
+		{OverwriteAlways, "v1", true},
+		{OverwriteIfChanged, "v2", true},
+		{OverwriteNever, "v3", false},
+		{"", "v2", true},
+	} {
+		uploaded, err := uploadArtifact(storage, key, []byte(test.data), test.policy)
+		if err != nil || uploaded != test.uploaded {
+			t.Errorf("policy %q, data %s: uploaded %t, %v", test.policy, test.data, uploaded, err)
+		}
+	}
+	if data, _ := storage.Get(key); string(data) != "v2" {
+		t.Errorf("unexpected stored data %s", data)
+	}
+
+	// a failed upload is retried by the redelivery
+	storage.FailPut(key, fmt.Errorf("injected failure"))
+	if _, err := uploadArtifact(storage, key, []byte("v4"), OverwriteIfChanged); err == nil {
+		t.Error("upload failure not reported")
+	}
+	storage.FailPut(key, nil)
+	if uploaded, err := uploadArtifact(storage, key, []byte("v4"), OverwriteIfChanged); err != nil || !uploaded {
+		t.Errorf("retried upload skipped: %t, %v", uploaded, err)
+	}
+}
+
+func TestReconcilerContentAddressed(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-2 * time.Hour)
+	shared := flamegraphContentKey("svc", []byte("<html>a</html>"))
+	unreferenced := flamegraphContentKey("svc", []byte("<html>b</html>"))
+	missing := flamegraphContentKey("svc", []byte("<html>c</html>"))
+	if shared != flamegraphContentKey("svc", []byte("<html>a</html>")) || !isFlamegraphContentKey(shared) ||
+		isFlamegraphContentKey("products/svc/stacks/flamegraph/1_adhoc_flamegraph.html") {
+		t.Fatalf("unexpected content key %s", shared)
+	}
+	storage := NewMemoryStorage()
+	for _, key := range []string{shared, unreferenced} {
+		storage.Put(key, []byte("x"))
+		storage.Touch(key, old)
+	}
+	metadata := map[string]time.Time{
+		"products/svc/stacks/flamegraph/1_adhoc_flamegraph.html": old,
+		"products/svc/stacks/flamegraph/2_adhoc_flamegraph.html": old,
+		"products/svc/stacks/flamegraph/3_adhoc_flamegraph.html": old,
+	}
+	contentKeys := map[string]string{
+		"products/svc/stacks/flamegraph/1_adhoc_flamegraph.html": shared,
+		"products/svc/stacks/flamegraph/2_adhoc_flamegraph.html": shared,
+		"products/svc/stacks/flamegraph/3_adhoc_flamegraph.html": missing,
+	}
+	reconciler := NewReconciler(storage, func() (map[string]time.Time, error) {
+		return metadata, nil
+	}, nil, time.Hour)
+
+	// without the content keys the content addressed objects are not scanned
+	report := reconciler.Reconcile(now)
+	if report.ScannedObjects != 0 || len(report.OrphanedMetadata) != 3 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	reconciler.listContentKeys = func() (map[string]string, error) {
+		return contentKeys, nil
+	}
+	report = reconciler.Reconcile(now)
+	if report.ScannedObjects != 2 || len(report.OrphanedObjects) != 1 || report.OrphanedObjects[0].Key != unreferenced {
+		t.Errorf("unexpected orphaned objects %+v", report.OrphanedObjects)
+	}
+	expectedMetadata := []string{"products/svc/stacks/flamegraph/3_adhoc_flamegraph.html"}
+	if !reflect.DeepEqual(report.OrphanedMetadata, expectedMetadata) {
+		t.Errorf("orphaned metadata %v != %v", report.OrphanedMetadata, expectedMetadata)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	for _, invalid := range []string{
+		"hooks:\n  - event: file_deleted\n    url: http://localhost\n",
+		"hooks:\n  - event: file_ingested\n",
+		"hooks:\n  - event: file_ingested\n    url: http://localhost\n    command: [true]\n",
+	} {
+		if _, err := ParseHookConfigs([]byte(invalid)); err == nil {
+			t.Errorf("ParseHookConfigs(%q) should fail", invalid)
+		}
+	}
+	frames := topLeafFrames(map[string]int{"a": 1, "b": 5, "c": 5, "d": 3}, 3)
+	if !reflect.DeepEqual(frames, []HookFrame{{"b", 5}, {"c", 5}, {"d", 3}}) {
+		t.Errorf("unexpected top frames %v", frames)
+	}
+
+	bodies := make(chan IngestionSummary, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var summary IngestionSummary
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("missing hook header")
+		}
+		if err := json.NewDecoder(r.Body).Decode(&summary); err != nil {
+			t.Error(err)
+		}
+		bodies <- summary
+	}))
+	defer server.Close()
+	output := filepath.Join(t.TempDir(), "event.json")
+	configs, err := ParseHookConfigs([]byte(fmt.Sprintf(`hooks:
+  - name: webhook
+    event: file_ingested
+    url: %s
+    headers: {Authorization: Bearer secret}
+  - name: command
+    event: file_ingested
+    command: [sh, -c, 'cat > %s']
+    services: [svc]
+  - name: other-service
+    event: file_ingested
+    url: %s
+    services: [other]
+`, server.URL, output, server.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile("testdata/test_stackfile_html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameReplacer = NewFrameReplacer()
+	if err = frameReplacer.InitRegexps(NewCliArgs().FrameReplaceFileName); err != nil {
+		t.Fatal(err)
+	}
+	channels := RecordChannels{
+		StacksRecords:  make(chan StackRecord, 100000),
+		MetricsRecords: make(chan MetricRecord, 10),
+	}
+	pw := NewProfilesWriter(&channels)
+	pw.hooks = NewHooks(configs, 10)
+	task := Task{Filename: "2023-12-03T16:31:00_abc_hash.gz", Service: "svc", ServiceId: 1}
+	if err = pw.ParseStackFrameFile(NewMemoryStorage(), task, time.Unix(1700000000, 0).UTC(), buf); err != nil {
+		t.Fatal(err)
+	}
+	pw.hooks.Close()
+
+	if len(bodies) != 1 {
+		t.Fatalf("unexpected number of webhook calls %d", len(bodies))
+	}
+	summary := <-bodies
+	if summary.Event != HookEventFileIngested || summary.Service != "svc" || summary.Rows != len(channels.StacksRecords) ||
+		summary.Samples == 0 || len(summary.TopFrames) == 0 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("command hook not run: %v", err)
+	}
+	var fromCommand IngestionSummary
+	if err = json.Unmarshal(data, &fromCommand); err != nil || fromCommand.Filename != task.Filename {
+		t.Errorf("unexpected command hook input %s, %v", data, err)
+	}
+}
+
+type recordingWarehouseDriver struct {
+	days       []time.Time
+	aggregates []WarehouseAggregate
+}
+
+func (rd *recordingWarehouseDriver) Export(ctx context.Context, day time.Time, aggregates []WarehouseAggregate) error {
+	rd.days = append(rd.days, day)
+	rd.aggregates = aggregates
+	return nil
+}
+
+func (rd *recordingWarehouseDriver) Close() error {
+	return nil
+}
+
+func TestWarehouseExporter(t *testing.T) {
+	driver := &recordingWarehouseDriver{}
+	fetch := func(ctx context.Context, day time.Time) ([]WarehouseAggregate, error) {
+		return []WarehouseAggregate{{Day: day, ServiceId: 3, Function: "main", Samples: 5, ServiceSamples: 20}}, nil
+	}
+	serviceNames := func() (map[int]string, error) {
+		return map[int]string{3: "checkout"}, nil
+	}
+	exporter := NewWarehouseExporter(driver, fetch, serviceNames, 2*time.Hour)
+
+	// the previous day is not over by the delay yet at 01:00
+	now := time.Date(2023, 3, 10, 1, 0, 0, 0, time.UTC)
+	if err := exporter.exportDue(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	if len(driver.days) != 1 || !driver.days[0].Equal(time.Date(2023, 3, 8, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected exported days %v", driver.days)
+	}
+	if err := exporter.exportDue(context.Background(), now.Add(30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(driver.days) != 1 {
+		t.Errorf("day exported twice: %v", driver.days)
+	}
+	if err := exporter.exportDue(context.Background(), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(driver.days) != 2 || !driver.days[1].Equal(time.Date(2023, 3, 9, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected exported days %v", driver.days)
+	}
+	expected := WarehouseAggregate{Day: driver.days[1], ServiceId: 3, ServiceName: "checkout", Function: "main",
+		Samples: 5, ServiceSamples: 20, Share: 0.25}
+	if len(driver.aggregates) != 1 || driver.aggregates[0] != expected {
+		t.Errorf("unexpected aggregates %+v", driver.aggregates)
+	}
+
+	storage := NewMemoryStorage()
+	s3Driver := &S3WarehouseDriver{storage: storage, prefix: "profiling"}
+	if err := s3Driver.Export(context.Background(), expected.Day, driver.aggregates); err != nil {
+		t.Fatal(err)
+	}
+	data, err := storage.Get("profiling/day=2023-03-09/function_daily.ndjson.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported WarehouseAggregate
+	if err = json.NewDecoder(gzipReader).Decode(&exported); err != nil {
+		t.Fatal(err)
+	}
+	if exported != expected {
+		t.Errorf("unexpected exported aggregate %+v", exported)
+	}
+	if _, err = NewWarehouseDriver(&CLIArgs{WarehouseDriver: "bigquery"}); err == nil {
+		t.Error("unknown driver accepted")
+	}
+}
+
+func TestSidecarClassifier(t *testing.T) {
+	if NewSidecarClassifier(" , ", time.Hour) != nil {
+		t.Error("classifier without patterns")
+	}
+	classifier := NewSidecarClassifier(DefaultSidecarPatterns, time.Hour)
+	if !classifier.IsSidecar("Envoy") || classifier.IsSidecar("api_web-7d9f_prod") {
+		t.Error("unexpected classification")
+	}
+
+	channels := RecordChannels{
+		StacksRecords:  make(chan StackRecord, 10),
+		SidecarRecords: make(chan SidecarRecord, 10),
+	}
+	pw := NewProfilesWriter(&channels)
+	pw.sidecars = classifier
+	frames := map[string]Frame{"a1": {Name: "main"}}
+	weights := FrameValuesMap{
+		StackKey{ContainerName: "k8s_istio-proxy_web-7d9f5c6b8-x2x4z_prod_uid_0"}: {"a1": {Weight: 2}},
+		StackKey{ContainerName: "k8s_api_web-7d9f5c6b8-x2x4z_prod_uid_0"}:         {"a1": {Weight: 5}},
+	}
+	timestamp := time.Unix(1700000000, 0).UTC()
+	pw.writeStacks(weights, frames, 1, "", "host", timestamp, nil, nil)
+	pw.writeStacks(weights, frames, 1, "", "host", timestamp, nil, nil)
+	close(channels.SidecarRecords)
+
+	records := make([]SidecarRecord, 0)
+	for record := range channels.SidecarRecords {
+		records = append(records, record)
+	}
+	if len(records) != 1 || records[0].ServiceId != 1 || !strings.HasPrefix(records[0].ContainerName, "istio-proxy_") {
+		t.Fatalf("unexpected sidecar records %+v", records)
+	}
+	later := time.Now().Add(2 * time.Hour)
+	if due := classifier.Records(1, []string{records[0].ContainerName}, timestamp, later); len(due) != 1 {
+		t.Errorf("sidecar not recorded again after the refresh interval: %+v", due)
+	}
+}
+
+func TestFrameAgeTracker(t *testing.T) {
+	channels := RecordChannels{
+		StacksRecords:   make(chan StackRecord, 10),
+		FrameAgeRecords: make(chan FrameAgeRecord, 10),
+	}
+	pw := NewProfilesWriter(&channels)
+	pw.frameAges = NewFrameAgeTracker(time.Hour, 2)
+	frames := map[string]Frame{"a1": {Name: "main"}, "b2": {Name: "handle", Prev: "a1"}}
+	weights := FrameValuesMap{StackKey{}: {"a1": {Weight: 5}, "b2": {Weight: 3}}}
+	timestamp := time.Unix(1700000000, 0).UTC()
+	pw.writeStacks(weights, frames, 1, "", "host", timestamp, nil, nil)
+	pw.writeStacks(weights, frames, 1, "", "host", timestamp.Add(time.Minute), nil, nil)
+	close(channels.FrameAgeRecords)
+
+	records := make(map[uint64]FrameAgeRecord)
+	for record := range channels.FrameAgeRecords {
+		records[record.CallStackHash] = record
+	}
+	if len(records) != 2 || records[0xb2].CallStackName != "handle" || records[0xb2].CallStackParent != 0xa1 ||
+		!records[0xa1].Seen.Equal(timestamp) {
+		t.Fatalf("unexpected frame age records %+v", records)
+	}
+	later := time.Now().Add(2 * time.Hour)
+	if due := pw.frameAges.Records(1, frames, timestamp, later); len(due) != 2 {
+		t.Errorf("frames not recorded again after the refresh interval: %+v", due)
+	}
+	// the tracker is full, its frames are forgotten for the frames of another service
+	if due := pw.frameAges.Records(2, frames, timestamp, later); len(due) != 2 || len(pw.frameAges.lastStored) != 2 {
+		t.Errorf("unexpected records of a full tracker: %+v", due)
+	}
+}
+
+func TestDemangleFrame(t *testing.T) {
+	tests := map[string]string{
+		"_ZN3foo3barEv_[k]":               "foo::bar()_[k]",
+		"_RNvCs15kBYyAo9fc_7mycrate4main": "mycrate::main",
+		"type..hash.main.point":           "hash(main.point)",
+		"go.itab.*os.File,io.Reader":      "itab(*os.File, io.Reader)",
+		"[unknown]":                       "[unknown]",
+	}
+	for name, expected := range tests {
+		if demangled := DemangleFrame(name); demangled != expected {
+			t.Errorf("DemangleFrame(%q) = %q, expected %q", name, demangled, expected)
+		}
+	}
+}
+
+func TestAdviseIndexes(t *testing.T) {
+	samples := TableSchema{
+		Engine:     "MergeTree",
+		SortingKey: []string{"ServiceId", "InstanceType", "HostNameHash", "Timestamp"},
+		Columns: map[string]string{"ServiceId": "UInt32", "Timestamp": "DateTime('UTC')",
+			"InstanceType": "LowCardinality(String)", "HostName": "LowCardinality(String)",
+			"ContainerName": "LowCardinality(String)", "CallStackName": "String", "AppVersion": "LowCardinality(String)"},
+		Indexes:        map[string]bool{"idx_appversion_bf": true},
+		Projections:    map[string]bool{},
+		IndexedColumns: map[string]bool{"AppVersion": true},
+	}
+	rollup := samples
+	rollup.Engine = "SummingMergeTree"
+	schemas := map[string]TableSchema{"flamedb.samples": samples, "flamedb.samples_1hour": rollup}
+
+	predicates := queryPredicates("SELECT 1 FROM t WHERE ContainerName NOT IN ('a') AND HostName != 'b' AND "+
+		"CallStackName LIKE '%foo%' AND InstanceType = 'c'", samples.Columns)
+	expected := map[string]predicateKind{"CallStackName": substringPredicate, "InstanceType": equalityPredicate}
+	if !reflect.DeepEqual(predicates, expected) {
+		t.Fatalf("unexpected predicates %v", predicates)
+	}
+
+	queries := []SlowQuery{
+		{Query: "SELECT * FROM flamedb.samples WHERE ServiceId = 1 AND HostName IN ('a') AND AppVersion = 'v'",
+			Tables: []string{"flamedb.samples"}, Count: 10, P99Ms: 4000, TotalMs: 30000},
+		{Query: "SELECT * FROM flamedb.samples WHERE ServiceId = 1 AND CallStackName LIKE '%gc%'",
+			Tables: []string{"flamedb.samples"}, Count: 2, P99Ms: 9000, TotalMs: 10000},
+		{Query: "SELECT * FROM flamedb.samples_1hour WHERE ServiceId = 1 AND ContainerName = 'web'",
+			Tables: []string{"flamedb.samples_1hour"}, Count: 5, P99Ms: 2000, TotalMs: 8000},
+		{Query: "SELECT * FROM system.parts WHERE table = 'samples'", Tables: []string{"system.parts"},
+			Count: 1, P99Ms: 60000, TotalMs: 60000},
+	}
+	suggestions := AdviseIndexes(queries, schemas)
+	names := make([]string, 0, len(suggestions))
+	for _, suggestion := range suggestions {
+		names = append(names, suggestion.Table+" "+suggestion.Name)
+	}
+	expectedNames := []string{"flamedb.samples p_by_hostname", "flamedb.samples idx_callstackname_ngram",
+		"flamedb.samples_1hour idx_containername_bf"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Fatalf("unexpected suggestions %v", names)
+	}
+	if suggestions[0].Definition != "SELECT * ORDER BY (ServiceId, HostName, Timestamp)" ||
+		suggestions[0].Queries != 10 || suggestions[0].P99Ms != 4000 {
+		t.Errorf("unexpected projection %+v", suggestions[0])
+	}
+
+	var migration strings.Builder
+	if err := WriteIndexMigration(&migration, suggestions, time.Unix(1700000000, 0).UTC(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		"ALTER TABLE flamedb.samples ADD PROJECTION IF NOT EXISTS p_by_hostname " +
+			"(SELECT * ORDER BY (ServiceId, HostName, Timestamp));",
+		"ALTER TABLE flamedb.samples ADD INDEX IF NOT EXISTS idx_callstackname_ngram CallStackName " +
+			"TYPE ngrambf_v1(3, 65536, 2, 0) GRANULARITY 4;",
+		"ALTER TABLE flamedb.samples_1hour MATERIALIZE INDEX idx_containername_bf;",
+	} {
+		if !strings.Contains(migration.String(), statement) {
+			t.Errorf("missing %q in migration:\n%s", statement, migration.String())
+		}
+	}
+
+	samples.Projections["p_by_hostname"] = true
+	if suggestions = AdviseIndexes(queries[:1], schemas); len(suggestions) != 0 {
+		t.Errorf("existing projection suggested again: %+v", suggestions)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	if NewBackpressure(0, 0) != nil {
+		t.Fatal("disabled backpressure is not nil")
+	}
+	var disabled *Backpressure
+	disabled.RecordInsert(errors.New("insert failed"))
+	disabled.Wait(context.Background())
+
+	ctx := context.Background()
+	probeErr := errors.New("connection refused")
+	probe := func(ctx context.Context) error {
+		return probeErr
+	}
+
+	bp := NewBackpressure(2, 90)
+	bp.RecordInsert(errors.New("insert failed"))
+	bp.check(ctx, 0, probe)
+	if bp.Paused() {
+		t.Fatal("paused after a single failure")
+	}
+	bp.RecordInsert(errors.New("insert failed"))
+	bp.check(ctx, 0, probe)
+	if !bp.Paused() {
+		t.Fatal("not paused after consecutive failures")
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	bp.Wait(waitCtx)
+	cancel()
+	if waitCtx.Err() == nil {
+		t.Fatal("wait returned while paused")
+	}
+	bp.check(ctx, 0, probe)
+	if !bp.Paused() {
+		t.Fatal("resumed while the probe fails")
+	}
+	// the probe runs without the lock, the inserts and the polling are not blocked by a slow ping
+	probeErr = nil
+	bp.check(ctx, 0.5, func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			bp.RecordInsert(nil)
+			bp.Paused()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("backpressure locked while probing")
+		}
+		return probe(ctx)
+	})
+	if !bp.Paused() {
+		t.Fatal("resumed before the queue is drained")
+	}
+	bp.check(ctx, 0.4, probe)
+	if bp.Paused() {
+		t.Fatal("not resumed once healthy")
+	}
+	bp.Wait(ctx)
+
+	for i := 0; i < backpressureSustainedChecks-1; i++ {
+		bp.check(ctx, 0.95, probe)
+	}
+	bp.check(ctx, 0.5, probe)
+	bp.check(ctx, 0.95, probe)
+	if bp.Paused() {
+		t.Fatal("paused on a transient saturation")
+	}
+	for i := 0; i < backpressureSustainedChecks; i++ {
+		bp.check(ctx, 0.95, probe)
+	}
+	if !bp.Paused() {
+		t.Fatal("not paused on a sustained saturation")
+	}
+	bp.check(ctx, 0.2, probe)
+	if bp.Paused() {
+		t.Fatal("not resumed once the queue is drained")
+	}
+}
+
+// fakeClickHouseConn fails the inserts into the failing tables and counts the rows inserted into the other ones
+type fakeClickHouseConn struct {
+	driver.Conn
+	mutex    sync.Mutex
+	failing  map[string]bool
+	inserted map[string]int
+}
+
+func (c *fakeClickHouseConn) PrepareBatch(ctx context.Context, query string,
+	opts ...driver.PrepareBatchOption) (driver.Batch, error) {
+	return &fakeClickHouseBatch{conn: c, table: strings.TrimPrefix(query, "INSERT INTO ")}, nil
+}
+
+type fakeClickHouseBatch struct {
+	driver.Batch
+	conn  *fakeClickHouseConn
+	table string
+	rows  int
+}
+
+func (b *fakeClickHouseBatch) Append(v ...any) error {
+	b.rows += 1
+	return nil
+}
+
+func (b *fakeClickHouseBatch) Send() error {
+	b.conn.mutex.Lock()
+	defer b.conn.mutex.Unlock()
+	if b.conn.failing[b.table] {
+		return fmt.Errorf("no such column in table %s", b.table)
+	}
+	if b.conn.inserted == nil {
+		b.conn.inserted = make(map[string]int)
+	}
+	b.conn.inserted[b.table] += b.rows
+	return nil
+}
+
+func TestClickHouseWriterBackpressure(t *testing.T) {
+	saved := clickHouseTables
+	defer func() { clickHouseTables = saved }()
+	var err error
+	if clickHouseTables, err = NewTableNames("", "_shadow"); err != nil {
+		t.Fatal(err)
+	}
+	conn := &fakeClickHouseConn{failing: map[string]bool{
+		"flamedb.symbol_quality": true, "flamedb.anomalies": true, "flamedb.samples_shadow": true,
+	}}
+	metrics := &recordingMetricsPublisher{}
+	bp := NewBackpressure(3, 0)
+	writer := &clickHouseWriter{clients: map[string]*ClickHouseClient{"": {conn: conn}}, backpressure: bp,
+		metrics: metrics, stacksTable: "flamedb.samples", metricsTable: "flamedb.metrics"}
+	probe := func(ctx context.Context) error { return nil }
+
+	records := []RecordsAttributesUnpack{StackRecord{ServiceId: 1}}
+	for i := 0; i < 5; i++ {
+		writer.write(records, "flamedb.symbol_quality", false)
+		writer.write(records, "flamedb.anomalies", false)
+		if bp.check(context.Background(), 0, probe); bp.Paused() {
+			t.Fatal("polling paused on the failures of the optional tables")
+		}
+	}
+	// the stacks are written to the active table, only the shadow one fails
+	for i := 0; i < 5; i++ {
+		writer.write(records, "flamedb.samples", false)
+		if bp.check(context.Background(), 0, probe); bp.Paused() {
+			t.Fatal("polling paused on the failures of the shadow table")
+		}
+	}
+	if conn.inserted["flamedb.samples"] != 5 {
+		t.Errorf("%d stacks inserted", conn.inserted["flamedb.samples"])
+	}
+	if len(metrics.errors) != 15 {
+		t.Errorf("unexpected failure metrics %v", metrics.errors)
+	}
+
+	conn.failing["flamedb.metrics"] = true
+	for i := 0; i < 3; i++ {
+		writer.write([]RecordsAttributesUnpack{MetricRecord{ServiceId: 1}}, "flamedb.metrics", false)
+	}
+	bp.check(context.Background(), 0, probe)
+	if !bp.Paused() {
+		t.Error("polling not paused on consecutive metrics insert failures")
+	}
+}
+
+func TestDeliveryAudit(t *testing.T) {
+	var disabled *DeliveryAudit
+	disabled.FileReceived(Task{ServiceId: 1})
+	disabled.RowsWritten([]RecordsAttributesUnpack{StackRecord{ServiceId: 1}}, nil)
+	acker := &recordingAcknowledger{}
+	if disabled.Acknowledger(acker) != Acknowledger(acker) {
+		t.Fatal("disabled audit wraps the acknowledger")
+	}
+
+	audit := NewDeliveryAudit(time.Unix(1700000000, 0).UTC())
+	auditedAcker := audit.Acknowledger(acker)
+	ok := Task{Filename: "ok", Service: "svc", ServiceId: 1}
+	failed := Task{Filename: "failed", Service: "svc", ServiceId: 1}
+	for _, task := range []Task{ok, failed} {
+		audit.FileReceived(task)
+	}
+	audit.FileReceived(Task{Filename: "pending", Service: "other", ServiceId: 2})
+	audit.FileProcessed(ok)
+	auditedAcker.Ack(ok)
+	audit.FileFailed(failed)
+	auditedAcker.Nack(failed)
+	audit.RowsQueued(1, 3)
+	audit.RowsQueued(2, 1)
+	audit.RowsWritten([]RecordsAttributesUnpack{StackRecord{ServiceId: 1}, StackRecord{ServiceId: 1},
+		MetricRecord{ServiceId: 1}}, nil)
+	audit.RowsWritten([]RecordsAttributesUnpack{StackRecord{ServiceId: 1}}, errors.New("insert failed"))
+
+	report := audit.Report(false)
+	if len(report.Services) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	svc := report.Services[0]
+	expected := DeliveryCounters{ServiceId: 1, Service: "svc", FilesReceived: 2, FilesProcessed: 1, FilesFailed: 1,
+		SQSDeletes: 1, SQSDeleteErrors: 1, RowsQueued: 3, RowsInserted: 2, RowsFailed: 1}
+	if svc.DeliveryCounters != expected || svc.PendingFiles != 0 || svc.PendingRows != 0 {
+		t.Errorf("unexpected reconciliation %+v", svc)
+	}
+	if len(svc.Mismatches) != 3 {
+		t.Errorf("unexpected mismatches %v", svc.Mismatches)
+	}
+	if other := report.Services[1]; other.PendingFiles != 1 || other.PendingRows != 1 || len(other.Mismatches) != 0 {
+		t.Errorf("unexpected reconciliation %+v", other)
+	}
+
+	recorder := httptest.NewRecorder()
+	audit.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/delivery_audit?mismatches=true", nil))
+	var served DeliveryAuditReport
+	if err := json.Unmarshal(recorder.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served.Services) != 1 || served.Services[0].ServiceId != 1 {
+		t.Errorf("unexpected mismatches report %+v", served)
+	}
+
+	metrics := &recordingMetricsPublisher{}
+	audit.emit(metrics)
+	audit.RowsQueued(2, 4)
+	audit.emit(metrics)
+	audit.emit(metrics)
+	if len(metrics.counters) != 11 || metrics.counters[len(metrics.counters)-1] != "delivery_audit.rows_queued:other=4" {
+		t.Errorf("unexpected counters %v", metrics.counters)
+	}
+}
+
+func TestWorkerRetries(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Put("products/svc/stacks/malformed", []byte("#{not json\n"))
+	storage.FailGet("products/svc/stacks/throttled", awserr.NewRequestFailure(
+		awserr.New("SlowDown", "please reduce your request rate", nil), http.StatusServiceUnavailable, "id"))
+	storage.FailGet("products/svc/stacks/deleted", awserr.NewRequestFailure(
+		awserr.New("NotFound", "not found", nil), http.StatusNotFound, "id"))
+
+	acker := &recordingAcknowledger{}
+	tasks := make(chan Task, 4)
+	tasks <- Task{Filename: "throttled", Service: "svc", ServiceId: 7, ReceiveCount: 1, Retryable: true}
+	tasks <- Task{Filename: "deleted", Service: "svc", ServiceId: 7, ReceiveCount: 1, Retryable: true}
+	tasks <- Task{Filename: "malformed", Service: "svc", ServiceId: 7, ReceiveCount: 1, Retryable: true}
+	// the retry budget is exhausted
+	tasks <- Task{Filename: "throttled", Service: "svc", ServiceId: 7, ReceiveCount: 5}
+	close(tasks)
+	channels := RecordChannels{StacksRecords: make(chan StackRecord, 10), MetricsRecords: make(chan MetricRecord, 10)}
+	pw := NewProfilesWriter(&channels)
+	pw.audit = NewDeliveryAudit(time.Now())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	Worker(0, tasks, acker, storage, pw, NoopMetricsPublisher{}, &wg)
+
+	expected := []string{"retry:throttled", "nack:deleted", "nack:malformed", "nack:throttled"}
+	if !reflect.DeepEqual(acker.results, expected) {
+		t.Errorf("acknowledgements = %v, want %v", acker.results, expected)
+	}
+	counters := pw.audit.Report(false).Services[0]
+	if counters.FilesRetried != 1 || counters.FilesFailed != 3 || counters.PendingFiles != 0 {
+		t.Errorf("unexpected audit %+v", counters)
+	}
+}
+
+func TestTaskDelivery(t *testing.T) {
+	frameReplacer = NewFrameReplacer()
+	if err := frameReplacer.InitRegexps(NewCliArgs().FrameReplaceFileName); err != nil {
+		t.Fatal(err)
+	}
+	saved := clickHouseTables
+	defer func() { clickHouseTables = saved }()
+	var err error
+	if clickHouseTables, err = NewTableNames("", ""); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(filepath.Join("testdata", "fixtures", "no_header.col"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewMemoryStorage()
+	storage.Put("products/svc/stacks/2023-12-03T16:31:00_abc_a.gz", buf)
+	storage.Put("products/svc/stacks/2023-12-03T16:31:00_abc_b.gz", buf)
+
+	conn := &fakeClickHouseConn{failing: map[string]bool{"flamedb.samples": true}}
+	writer := &clickHouseWriter{clients: map[string]*ClickHouseClient{"": {conn: conn}},
+		metrics: NoopMetricsPublisher{}, stacksTable: "flamedb.samples", metricsTable: "flamedb.metrics"}
+	acker := &recordingAcknowledger{}
+	process := func(filename string) []RecordsAttributesUnpack {
+		channels := RecordChannels{StacksRecords: make(chan StackRecord, 100), MetricsRecords: make(chan MetricRecord, 10)}
+		tasks := make(chan Task, 1)
+		tasks <- Task{Filename: filename, Service: "svc", ServiceId: 7, ReceiveCount: 1, Retryable: true}
+		close(tasks)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		Worker(0, tasks, acker, storage, NewProfilesWriter(&channels), NoopMetricsPublisher{}, &wg)
+		close(channels.StacksRecords)
+		records := make([]RecordsAttributesUnpack, 0)
+		for record := range channels.StacksRecords {
+			records = append(records, record)
+		}
+		if len(records) < 2 || len(acker.results) != 0 {
+			t.Fatalf("%d records queued, acknowledgements %v", len(records), acker.results)
+		}
+		return records
+	}
+
+	// the failed insert returns the task to the queue instead of deleting it
+	writer.write(process("2023-12-03T16:31:00_abc_a.gz"), "flamedb.samples", false)
+	if expected := []string{"retry:2023-12-03T16:31:00_abc_a.gz"}; !reflect.DeepEqual(acker.results, expected) {
+		t.Fatalf("acknowledgements = %v, want %v", acker.results, expected)
+	}
+
+	// the task is acknowledged once the last batch holding its records is written
+	acker.results = nil
+	conn.failing["flamedb.samples"] = false
+	records := process("2023-12-03T16:31:00_abc_b.gz")
+	writer.write(records[:1], "flamedb.samples", false)
+	if len(acker.results) != 0 {
+		t.Fatalf("task acknowledged before all its stacks are written: %v", acker.results)
+	}
+	writer.write(records[1:], "flamedb.samples", false)
+	if expected := []string{"ack:2023-12-03T16:31:00_abc_b.gz"}; !reflect.DeepEqual(acker.results, expected) {
+		t.Errorf("acknowledgements = %v, want %v", acker.results, expected)
+	}
+
+	// a task without stacks is acknowledged once parsed
+	done := 0
+	NewTaskDelivery(func(err error) { done += 1 }).Queued()
+	if done != 1 {
+		t.Error("delivery without records not completed")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, tt := range []struct {
+		receiveCount int
+		expected     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{20, maxRetryDelay},
+	} {
+		if delay := retryDelay(30*time.Second, tt.receiveCount); delay != tt.expected {
+			t.Errorf("retryDelay(%d) = %s, want %s", tt.receiveCount, delay, tt.expected)
+		}
+	}
+	if IsTransientError(fmt.Errorf("parse: %w", Permanent(errors.New("malformed")))) {
+		t.Error("wrapped permanent error is transient")
+	}
+	if !IsTransientError(errors.New("connection reset by peer")) {
+		t.Error("network error is permanent")
+	}
+}
+
+func TestPreflightTables(t *testing.T) {
+	saved := clickHouseTables
+	defer func() { clickHouseTables = saved }()
+	var err error
+	if clickHouseTables, err = NewTableNames("", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	args := NewCliArgs()
+	args.ClickHouseSidecarsTable = ""
+	tables := preflightTables(args)
+	names := make([]string, 0, len(tables))
+	for _, table := range tables {
+		names = append(names, table.name)
+	}
+	expected := []string{"flamedb.samples", "flamedb.metrics", "flamedb.symbol_quality", "flamedb.anomalies",
+		"flamedb.frame_ages"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("unexpected tables %v", names)
+	}
+
+	missing := errors.New("table does not exist")
+	if result := tables[0].result("samples", missing, "hint"); result.Status != PreflightFail {
+		t.Errorf("missing stacks table not failed: %+v", result)
+	}
+	if result := tables[1].result("metrics", nil, "hint"); result.Status != PreflightPass {
+		t.Errorf("existing metrics table not passed: %+v", result)
+	}
+	// a missing table of an optional feature disables it instead of stopping the indexer
+	result := tables[3].result("anomalies", missing, "hint")
+	if result.Status != PreflightWarn || args.ClickHouseAnomaliesTable != "" ||
+		!strings.Contains(result.Detail, `-clickhouse-anomalies-table=""`) {
+		t.Errorf("missing anomalies table not disabled: %+v, %q", result, args.ClickHouseAnomaliesTable)
+	}
+	if args.ClickHouseSymbolQualityTable == "" || args.ClickHouseFrameAgesTable == "" {
+		t.Error("features with existing tables disabled")
+	}
+	if !PrintPreflightReport(&bytes.Buffer{}, []PreflightResult{result}) {
+		t.Error("warnings failed the preflight report")
+	}
+}
@@ -0,0 +1,313 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DeliveryCounters are the paired counters of a service: the files received from SQS with their outcome, the
+// SQS deletes, and the stacks rows queued for ClickHouse with the result of their inserts
+type DeliveryCounters struct {
+	ServiceId       uint32 `json:"service_id"`
+	Service         string `json:"service"`
+	FilesReceived   int64  `json:"files_received"`
+	FilesProcessed  int64  `json:"files_processed"`
+	FilesRejected   int64  `json:"files_rejected"`
+	FilesFailed     int64  `json:"files_failed"`
+	FilesRetried    int64  `json:"files_retried"`
+	SQSDeletes      int64  `json:"sqs_deletes"`
+	SQSDeleteErrors int64  `json:"sqs_delete_errors"`
+	RowsQueued      int64  `json:"rows_queued"`
+	RowsInserted    int64  `json:"rows_inserted"`
+	RowsFailed      int64  `json:"rows_failed"`
+}
+
+// metrics returns the counters by metric name
+func (dc DeliveryCounters) metrics() map[string]int64 {
+	return map[string]int64{
+		"delivery_audit.files_received":    dc.FilesReceived,
+		"delivery_audit.files_processed":   dc.FilesProcessed,
+		"delivery_audit.files_rejected":    dc.FilesRejected,
+		"delivery_audit.files_failed":      dc.FilesFailed,
+		"delivery_audit.files_retried":     dc.FilesRetried,
+		"delivery_audit.sqs_deletes":       dc.SQSDeletes,
+		"delivery_audit.sqs_delete_errors": dc.SQSDeleteErrors,
+		"delivery_audit.rows_queued":       dc.RowsQueued,
+		"delivery_audit.rows_inserted":     dc.RowsInserted,
+		"delivery_audit.rows_failed":       dc.RowsFailed,
+	}
+}
+
+// DeliveryReconciliation compares the counters of a service, the pending files and rows are in flight
+type DeliveryReconciliation struct {
+	DeliveryCounters
+	PendingFiles int64    `json:"pending_files"`
+	PendingRows  int64    `json:"pending_rows"`
+	Mismatches   []string `json:"mismatches"`
+}
+
+func (dc DeliveryCounters) Reconcile() DeliveryReconciliation {
+	reconciliation := DeliveryReconciliation{
+		DeliveryCounters: dc,
+		PendingFiles:     dc.FilesReceived - dc.FilesProcessed - dc.FilesRejected - dc.FilesFailed - dc.FilesRetried,
+		PendingRows:      dc.RowsQueued - dc.RowsInserted - dc.RowsFailed,
+		Mismatches:       make([]string, 0),
+	}
+	if dc.FilesFailed > 0 {
+		reconciliation.Mismatches = append(reconciliation.Mismatches,
+			fmt.Sprintf("%d file(s) dead-lettered or deleted from SQS after a failed fetch, parse or write",
+				dc.FilesFailed))
+	}
+	if dc.RowsFailed > 0 {
+		reconciliation.Mismatches = append(reconciliation.Mismatches,
+			fmt.Sprintf("%d row(s) dropped by failed ClickHouse inserts", dc.RowsFailed))
+	}
+	if dc.SQSDeleteErrors > 0 {
+		reconciliation.Mismatches = append(reconciliation.Mismatches,
+			fmt.Sprintf("%d SQS delete(s) failed, the file(s) will be delivered again", dc.SQSDeleteErrors))
+	}
+	return reconciliation
+}
+
+type DeliveryAuditReport struct {
+	Since    time.Time                `json:"since"`
+	Services []DeliveryReconciliation `json:"services"`
+}
+
+// DeliveryAudit counts the files and rows of every service from their reception to their insertion, so that the
+// silent drops (e.g. a file deleted from SQS after a failed parse) are quantified. The counters are kept since the
+// start of the indexer, and emitted as deltas to the metrics agent. The methods of a nil DeliveryAudit are no-ops.
+type DeliveryAudit struct {
+	mutex    sync.Mutex
+	since    time.Time
+	counters map[uint32]*DeliveryCounters
+	// emitted are the counters last emitted to the metrics agent
+	emitted map[uint32]DeliveryCounters
+}
+
+func NewDeliveryAudit(now time.Time) *DeliveryAudit {
+	return &DeliveryAudit{
+		since:    now,
+		counters: make(map[uint32]*DeliveryCounters),
+		emitted:  make(map[uint32]DeliveryCounters),
+	}
+}
+
+// update applies fn to the counters of a service, under the lock
+func (da *DeliveryAudit) update(serviceId uint32, service string, fn func(counters *DeliveryCounters)) {
+	if da == nil {
+		return
+	}
+	da.mutex.Lock()
+	defer da.mutex.Unlock()
+	counters, ok := da.counters[serviceId]
+	if !ok {
+		counters = &DeliveryCounters{ServiceId: serviceId}
+		da.counters[serviceId] = counters
+	}
+	if service != "" {
+		counters.Service = service
+	}
+	fn(counters)
+}
+
+func (da *DeliveryAudit) FileReceived(task Task) {
+	da.update(uint32(task.ServiceId), task.Service, func(counters *DeliveryCounters) {
+		counters.FilesReceived += 1
+	})
+}
+
+func (da *DeliveryAudit) FileProcessed(task Task) {
+	da.update(uint32(task.ServiceId), task.Service, func(counters *DeliveryCounters) {
+		counters.FilesProcessed += 1
+	})
+}
+
+func (da *DeliveryAudit) FileRejected(task Task) {
+	da.update(uint32(task.ServiceId), task.Service, func(counters *DeliveryCounters) {
+		counters.FilesRejected += 1
+	})
+}
+
+func (da *DeliveryAudit) FileFailed(task Task) {
+	da.update(uint32(task.ServiceId), task.Service, func(counters *DeliveryCounters) {
+		counters.FilesFailed += 1
+	})
+}
+
+// FileRetried counts a file returned to the queue on a transient failure, it is received again
+func (da *DeliveryAudit) FileRetried(task Task) {
+	da.update(uint32(task.ServiceId), task.Service, func(counters *DeliveryCounters) {
+		counters.FilesRetried += 1
+	})
+}
+
+func (da *DeliveryAudit) fileDeleted(task Task, err error) {
+	da.update(uint32(task.ServiceId), task.Service, func(counters *DeliveryCounters) {
+		if err != nil {
+			counters.SQSDeleteErrors += 1
+		} else {
+			counters.SQSDeletes += 1
+		}
+	})
+}
+
+func (da *DeliveryAudit) RowsQueued(serviceId uint32, rows int) {
+	da.update(serviceId, "", func(counters *DeliveryCounters) {
+		counters.RowsQueued += int64(rows)
+	})
+}
+
+// RowsWritten counts the stacks records of an insert by service, as inserted or failed depending on err
+func (da *DeliveryAudit) RowsWritten(records []RecordsAttributesUnpack, err error) {
+	if da == nil {
+		return
+	}
+	rows := make(map[uint32]int64)
+	for _, record := range records {
+		if stackRecord, ok := record.(StackRecord); ok {
+			rows[stackRecord.ServiceId] += 1
+		}
+	}
+	for serviceId, count := range rows {
+		da.update(serviceId, "", func(counters *DeliveryCounters) {
+			if err != nil {
+				counters.RowsFailed += count
+			} else {
+				counters.RowsInserted += count
+			}
+		})
+	}
+}
+
+// auditedAcknowledger counts the SQS deletes, Ack and Nack delete the message while Retry leaves it in the queue
+type auditedAcknowledger struct {
+	Acknowledger
+	audit *DeliveryAudit
+}
+
+func (aa auditedAcknowledger) Ack(task Task) error {
+	err := aa.Acknowledger.Ack(task)
+	aa.audit.fileDeleted(task, err)
+	return err
+}
+
+func (aa auditedAcknowledger) Nack(task Task) error {
+	err := aa.Acknowledger.Nack(task)
+	aa.audit.fileDeleted(task, err)
+	return err
+}
+
+// Acknowledger wraps acker to count the deletes, acker is returned as is on a nil DeliveryAudit
+func (da *DeliveryAudit) Acknowledger(acker Acknowledger) Acknowledger {
+	if da == nil {
+		return acker
+	}
+	return auditedAcknowledger{Acknowledger: acker, audit: da}
+}
+
+// Report reconciles the counters of every service, sorted by service id, only the services with
+// mismatches are listed when mismatchesOnly is set
+func (da *DeliveryAudit) Report(mismatchesOnly bool) DeliveryAuditReport {
+	da.mutex.Lock()
+	defer da.mutex.Unlock()
+	report := DeliveryAuditReport{Since: da.since, Services: make([]DeliveryReconciliation, 0, len(da.counters))}
+	for _, counters := range da.counters {
+		reconciliation := counters.Reconcile()
+		if mismatchesOnly && len(reconciliation.Mismatches) == 0 {
+			continue
+		}
+		report.Services = append(report.Services, reconciliation)
+	}
+	sort.Slice(report.Services, func(i, j int) bool {
+		return report.Services[i].ServiceId < report.Services[j].ServiceId
+	})
+	return report
+}
+
+// ServeHTTP returns the reconciliation report, ?mismatches=true lists only the services with mismatches
+func (da *DeliveryAudit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	mismatchesOnly, _ := strconv.ParseBool(r.URL.Query().Get("mismatches"))
+	writeJSON(w, http.StatusOK, da.Report(mismatchesOnly))
+}
+
+// emit sends the counters which changed since the last emission, as deltas
+func (da *DeliveryAudit) emit(metrics MetricsPublisher) {
+	da.mutex.Lock()
+	deltas := make([]DeliveryCounters, 0)
+	for serviceId, counters := range da.counters {
+		last := da.emitted[serviceId]
+		if *counters == last {
+			continue
+		}
+		deltas = append(deltas, DeliveryCounters{
+			ServiceId:       serviceId,
+			Service:         counters.Service,
+			FilesReceived:   counters.FilesReceived - last.FilesReceived,
+			FilesProcessed:  counters.FilesProcessed - last.FilesProcessed,
+			FilesRejected:   counters.FilesRejected - last.FilesRejected,
+			FilesFailed:     counters.FilesFailed - last.FilesFailed,
+			FilesRetried:    counters.FilesRetried - last.FilesRetried,
+			SQSDeletes:      counters.SQSDeletes - last.SQSDeletes,
+			SQSDeleteErrors: counters.SQSDeleteErrors - last.SQSDeleteErrors,
+			RowsQueued:      counters.RowsQueued - last.RowsQueued,
+			RowsInserted:    counters.RowsInserted - last.RowsInserted,
+			RowsFailed:      counters.RowsFailed - last.RowsFailed,
+		})
+		da.emitted[serviceId] = *counters
+	}
+	da.mutex.Unlock()
+
+	// the metrics are sent outside the lock, every metric is a connection to the agent
+	for _, delta := range deltas {
+		tags := map[string]string{"service": delta.Service, "service_id": strconv.Itoa(int(delta.ServiceId))}
+		for name, value := range delta.metrics() {
+			if value != 0 {
+				metrics.SendCounterMetric(name, value, tags)
+			}
+		}
+	}
+}
+
+// Run emits the counters every interval until ctx is done, and once more on exit
+func (da *DeliveryAudit) Run(ctx context.Context, interval time.Duration, metrics MetricsPublisher) {
+	if da == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			da.emit(metrics)
+			return
+		case <-ticker.C:
+			da.emit(metrics)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Default convention of the uploaded file names: <start time>_<random suffix>_<hostname hash>[.gz]
+const (
+	DefaultFilenamePattern    = `^(?P<timestamp>[^_]+)(?:_(?P<suffix>[^_]*))?(?:_(?P<host>[^.]*))?`
+	DefaultFilenameTimeLayout = ISODateTimeFormat
+)
+
+// Files of an input folder have the ":" of their start time replaced with "_"
+var folderFilenames = mustFilenameParser(`^(?P<timestamp>[^_]+_[^_]+_[^_]+)(?:_(?P<suffix>[^_]*))?(?:_(?P<host>[^.]*))?`,
+	"2006-01-02T15_04_05")
+
+type FilenameInfo struct {
+	Timestamp time.Time
+	Host      string
+	Suffix    string
+}
+
+// FilenameParser extracts the start time of a profile from its file name, with a regexp whose
+// "timestamp" named group is parsed with a time layout. The "host" and "suffix" groups are optional.
+type FilenameParser struct {
+	pattern *regexp.Regexp
+	layout  string
+}
+
+func NewFilenameParser(pattern string, layout string) (*FilenameParser, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename pattern %q: %w", pattern, err)
+	}
+	if re.SubexpIndex("timestamp") < 0 {
+		return nil, fmt.Errorf("filename pattern %q has no timestamp named group", pattern)
+	}
+	if layout == "" {
+		return nil, fmt.Errorf("empty filename time layout")
+	}
+	return &FilenameParser{pattern: re, layout: layout}, nil
+}
+
+func mustFilenameParser(pattern string, layout string) *FilenameParser {
+	parser, err := NewFilenameParser(pattern, layout)
+	if err != nil {
+		panic(err)
+	}
+	return parser
+}
+
+func (fp *FilenameParser) group(match []string, name string) string {
+	idx := fp.pattern.SubexpIndex(name)
+	if idx < 0 {
+		return ""
+	}
+	return match[idx]
+}
+
+// Parse returns an error when the file name does not match the pattern or its timestamp the layout,
+// timestamps without a time zone are taken as UTC
+func (fp *FilenameParser) Parse(filename string) (FilenameInfo, error) {
+	match := fp.pattern.FindStringSubmatch(filename)
+	if match == nil {
+		return FilenameInfo{}, fmt.Errorf("filename %s does not match %s", filename, fp.pattern)
+	}
+	timestamp, err := time.Parse(fp.layout, fp.group(match, "timestamp"))
+	if err != nil {
+		return FilenameInfo{}, err
+	}
+	return FilenameInfo{
+		Timestamp: timestamp.UTC(),
+		Host:      fp.group(match, "host"),
+		Suffix:    fp.group(match, "suffix"),
+	}, nil
+}
@@ -0,0 +1,421 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths of the ingest endpoints served on the admin server of the receiving (hub) indexer
+const (
+	IngestSamplesPath = "/ingest/samples"
+	IngestMetricsPath = "/ingest/metrics"
+	IngestPprofPath   = "/ingest/pprof"
+)
+
+const forwardRetries = 3
+
+// Default limits of the ingested request bodies, as received and once decompressed
+const (
+	defaultIngestMaxBodySize         = 25 * 1024 * 1024
+	defaultIngestMaxDecompressedSize = 250 * 1024 * 1024
+)
+
+var ErrIngestTooLarge = errors.New("request body too large once decompressed")
+
+// forwardedMetric is a metric record with the name of its service, the service ids of the indexers differ
+type forwardedMetric struct {
+	MetricRecord
+	ServiceName string `json:"service_name"`
+}
+
+func NewExportedSample(sr StackRecord) ExportedSample {
+	return ExportedSample{
+		Timestamp:          sr.Timestamp,
+		ServiceId:          sr.ServiceId,
+		InstanceType:       sr.InstanceType,
+		ContainerEnvName:   sr.ContainerEnvName,
+		HostName:           sr.HostName,
+		ContainerName:      sr.ContainerName,
+		NumSamples:         sr.NumSamples,
+		CallStackHash:      sr.CallStackHash,
+		CallStackName:      sr.Name,
+		CallStackParent:    sr.Parent,
+		InsertionTimestamp: sr.InsertionTimestamp,
+		AppVersion:         sr.AppVersion,
+		Endpoint:           sr.Endpoint,
+		JobName:            sr.JobName,
+	}
+}
+
+type forwardBatch struct {
+	path string
+	body []byte
+}
+
+// Forwarder sends the batches written to the local ClickHouse to a remote indexer as well, for hub and spoke
+// deployments. Batches are queued and sent in the background, they are dropped when the queue is full
+// so that a slow or unreachable hub never slows down the local ingestion. The records carry the names of their
+// services, the hub maps them to its own service ids.
+type Forwarder struct {
+	url     string
+	token   string
+	client  *http.Client
+	batches chan forwardBatch
+	wg      sync.WaitGroup
+	dropped int
+	// names caches listServiceNames, it is reloaded when a service is missing
+	names            map[int]string
+	listServiceNames func() (map[int]string, error)
+}
+
+func NewForwarder(url string, token string, queueSize int,
+	listServiceNames func() (map[int]string, error)) *Forwarder {
+	fw := &Forwarder{
+		url:              strings.TrimSuffix(url, "/"),
+		token:            token,
+		client:           &http.Client{Timeout: time.Minute},
+		batches:          make(chan forwardBatch, queueSize),
+		names:            make(map[int]string),
+		listServiceNames: listServiceNames,
+	}
+	fw.wg.Add(1)
+	go fw.run()
+	return fw
+}
+
+// serviceName returns the name of a local service id
+func (fw *Forwarder) serviceName(serviceId uint32) (string, error) {
+	if name, exists := fw.names[int(serviceId)]; exists {
+		return name, nil
+	}
+	names, err := fw.listServiceNames()
+	if err != nil {
+		return "", err
+	}
+	fw.names = names
+	if name, exists := names[int(serviceId)]; exists {
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown service id %d", serviceId)
+}
+
+// Forward queues records of a single type (stacks or metrics), it is a no-op on a nil forwarder. It is not
+// safe for concurrent use.
+func (fw *Forwarder) Forward(records []RecordsAttributesUnpack) {
+	if fw == nil || len(records) == 0 {
+		return
+	}
+	var path string
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(gzipWriter)
+	for _, record := range records {
+		var err error
+		switch r := record.(type) {
+		case StackRecord:
+			path = IngestSamplesPath
+			sample := NewExportedSample(r)
+			if sample.ServiceName, err = fw.serviceName(r.ServiceId); err == nil {
+				err = encoder.Encode(sample)
+			}
+		case MetricRecord:
+			path = IngestMetricsPath
+			metric := forwardedMetric{MetricRecord: r}
+			if metric.ServiceName, err = fw.serviceName(r.ServiceId); err == nil {
+				err = encoder.Encode(metric)
+			}
+		default:
+			return
+		}
+		if err != nil {
+			logger.Errorf("unable to encode forwarded record, %d record(s) dropped: %v", len(records), err)
+			return
+		}
+	}
+	if err := gzipWriter.Close(); err != nil {
+		logger.Errorf("unable to compress forwarded batch: %v", err)
+		return
+	}
+
+	select {
+	case fw.batches <- forwardBatch{path: path, body: buf.Bytes()}:
+	default:
+		fw.dropped += 1
+		logger.Warnf("forward queue is full, %d record(s) dropped (%d batch(es) dropped so far)", len(records),
+			fw.dropped)
+	}
+}
+
+// Close sends the queued batches and stops the forwarder
+func (fw *Forwarder) Close() {
+	if fw == nil {
+		return
+	}
+	close(fw.batches)
+	fw.wg.Wait()
+}
+
+func (fw *Forwarder) run() {
+	defer fw.wg.Done()
+	for batch := range fw.batches {
+		var err error
+		for attempt := 0; attempt < forwardRetries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(1<<attempt) * time.Second)
+			}
+			if err = fw.send(batch); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			logger.Errorf("unable to forward batch to %s%s: %v", fw.url, batch.path, err)
+		}
+	}
+}
+
+func (fw *Forwarder) send(batch forwardBatch) error {
+	req, err := http.NewRequest(http.MethodPost, fw.url+batch.path, bytes.NewReader(batch.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	if fw.token != "" {
+		req.Header.Set("Authorization", "Bearer "+fw.token)
+	}
+	resp, err := fw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// IngestHandler receives the batches forwarded by other indexers and writes them to the local records channels
+type IngestHandler struct {
+	token    string
+	channels *RecordChannels
+	mutex    sync.RWMutex
+	closed   bool
+	// hostNames encrypts the hostnames the forwarding indexer did not encrypt, when set
+	hostNames *HostNameCipher
+	// audit counts the forwarded rows as queued, when set
+	audit *DeliveryAudit
+	// serviceIds returns the local id of a service name, ids caches it
+	serviceIds func(name string) (int, error)
+	ids        map[string]uint32
+	idsMutex   sync.Mutex
+	// profiles writes the pprof profiles, IngestPprofPath is served when it is set
+	profiles *ProfilesWriter
+	// maxBodySize and maxDecompressedSize bound the request bodies, so that a gzip bomb cannot exhaust the memory
+	maxBodySize         int64
+	maxDecompressedSize int64
+}
+
+func NewIngestHandler(token string, channels *RecordChannels, serviceIds func(name string) (int, error)) *IngestHandler {
+	return &IngestHandler{token: token, channels: channels, serviceIds: serviceIds, ids: make(map[string]uint32),
+		maxBodySize: defaultIngestMaxBodySize, maxDecompressedSize: defaultIngestMaxDecompressedSize}
+}
+
+// decompressedReader fails with ErrIngestTooLarge once more than remaining bytes are read
+type decompressedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (dr *decompressedReader) Read(p []byte) (int, error) {
+	if dr.remaining <= 0 {
+		// a byte beyond the limit tells a body of exactly the limit from a larger one
+		if n, err := dr.reader.Read(make([]byte, 1)); n == 0 {
+			return 0, err
+		}
+		return 0, ErrIngestTooLarge
+	}
+	if int64(len(p)) > dr.remaining {
+		p = p[:dr.remaining]
+	}
+	n, err := dr.reader.Read(p)
+	dr.remaining -= int64(n)
+	return n, err
+}
+
+// decompressed returns the body decompressed, bounded by maxDecompressedSize
+func (ih *IngestHandler) decompressed(body io.Reader) (io.ReadCloser, error) {
+	gzipReader, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&decompressedReader{reader: gzipReader, remaining: ih.maxDecompressedSize}, gzipReader}, nil
+}
+
+// writeBodyError answers 413 when the body is over a limit, 400 otherwise
+func writeBodyError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || errors.Is(err, ErrIngestTooLarge) {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+}
+
+// serviceId returns the local id of a service of the forwarding indexer
+func (ih *IngestHandler) serviceId(name string) (uint32, error) {
+	ih.idsMutex.Lock()
+	defer ih.idsMutex.Unlock()
+	if serviceId, exists := ih.ids[name]; exists {
+		return serviceId, nil
+	}
+	serviceId, err := ih.serviceIds(name)
+	if err != nil {
+		return 0, err
+	}
+	ih.ids[name] = uint32(serviceId)
+	return uint32(serviceId), nil
+}
+
+// Close waits for the requests in flight and rejects the next ones, it must be called before
+// the records channels are closed
+func (ih *IngestHandler) Close() {
+	ih.mutex.Lock()
+	defer ih.mutex.Unlock()
+	ih.closed = true
+}
+
+func (ih *IngestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if !bearerAuthorized(r, ih.token) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+	ih.mutex.RLock()
+	defer ih.mutex.RUnlock()
+	if ih.closed {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "shutting down"})
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, ih.maxBodySize)
+	if r.URL.Path == IngestPprofPath {
+		if ih.profiles == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "pprof ingestion is disabled"})
+			return
+		}
+		ih.servePprof(w, r)
+		return
+	}
+
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := ih.decompressed(r.Body)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	}
+
+	// records are decoded first so that a malformed batch is rejected as a whole
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, ScannerBufSize), MaxScannerBufSize)
+	samples := make([]StackRecord, 0)
+	metrics := make([]MetricRecord, 0)
+	serviceNames := make([]string, 0)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var err error
+		var serviceName string
+		switch r.URL.Path {
+		case IngestSamplesPath:
+			var sample ExportedSample
+			if err = json.Unmarshal(line, &sample); err == nil {
+				samples = append(samples, sample.StackRecord())
+				serviceName = sample.ServiceName
+			}
+		case IngestMetricsPath:
+			var metric forwardedMetric
+			if err = json.Unmarshal(line, &metric); err == nil {
+				metrics = append(metrics, metric.MetricRecord)
+				serviceName = metric.ServiceName
+			}
+		}
+		if err == nil && serviceName == "" {
+			err = fmt.Errorf("service_name is missing, upgrade the forwarding indexer")
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		serviceNames = append(serviceNames, serviceName)
+	}
+	if err := scanner.Err(); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	// the service ids of the forwarding indexer are its own, the records are stored under the local ones
+	serviceIds := make([]uint32, len(serviceNames))
+	for idx, serviceName := range serviceNames {
+		serviceId, err := ih.serviceId(serviceName)
+		if err != nil {
+			logger.Errorf("unable to get the id of service %s: %v", serviceName, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to get the service id"})
+			return
+		}
+		serviceIds[idx] = serviceId
+	}
+	for idx := range samples {
+		samples[idx].ServiceId = serviceIds[idx]
+	}
+	for idx := range metrics {
+		metrics[idx].ServiceId = serviceIds[idx]
+	}
+
+	for _, sample := range samples {
+		sample.HostName = ih.hostNames.Encrypt(sample.HostName)
+		ih.channels.StacksRecords <- sample
+		ih.audit.RowsQueued(sample.ServiceId, 1)
+	}
+	for _, metric := range metrics {
+		metric.HostName = ih.hostNames.Encrypt(metric.HostName)
+		ih.channels.MetricsRecords <- metric
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"records": len(samples) + len(metrics)})
+}
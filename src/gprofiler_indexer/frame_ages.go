@@ -0,0 +1,108 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// frameAgeRefreshInterval is the interval a frame is recorded again to move its last seen time,
+// the last seen times of the frame ages table are accurate to this interval
+const frameAgeRefreshInterval = time.Hour
+
+// maxFrameAgeEntries bounds the frames remembered by the tracker, the busiest indexers see millions of frames
+const maxFrameAgeEntries = 1000000
+
+// FrameAgeRecord is both the first and the last time a frame was seen, the table keeps the minimum
+// and the maximum of every frame of a service when merging
+type FrameAgeRecord struct {
+	ServiceId       uint32
+	CallStackHash   uint64
+	CallStackName   string
+	CallStackParent uint64
+	Seen            time.Time
+}
+
+func (fr FrameAgeRecord) getDbAttributes() []interface{} {
+	dbAttributes := []interface{}{
+		fr.ServiceId,
+		fr.CallStackHash,
+		fr.CallStackName,
+		fr.CallStackParent,
+		fr.Seen,
+		fr.Seen,
+	}
+	return dbAttributes
+}
+
+type frameAgeKey struct {
+	serviceId uint32
+	hash      string
+}
+
+// FrameAgeTracker records the frames of the services in the frame ages table. A frame of a service is
+// recorded at most once per refresh interval so that the table gets a handful of rows per frame and hour
+// instead of a row per sample.
+type FrameAgeTracker struct {
+	refreshInterval time.Duration
+	maxEntries      int
+	mutex           sync.Mutex
+	lastStored      map[frameAgeKey]time.Time
+}
+
+func NewFrameAgeTracker(refreshInterval time.Duration, maxEntries int) *FrameAgeTracker {
+	return &FrameAgeTracker{
+		refreshInterval: refreshInterval,
+		maxEntries:      maxEntries,
+		lastStored:      make(map[frameAgeKey]time.Time),
+	}
+}
+
+// Records returns the frames that were not recorded within the refresh interval, and marks them as recorded.
+// The tracker forgets every frame once it holds too many of them, they are then recorded again, which the
+// table merges away.
+func (ft *FrameAgeTracker) Records(serviceId uint32, frames map[string]Frame, timestamp time.Time,
+	now time.Time) []FrameAgeRecord {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	records := make([]FrameAgeRecord, 0)
+	for hash, frame := range frames {
+		key := frameAgeKey{serviceId: serviceId, hash: hash}
+		if last, ok := ft.lastStored[key]; ok && now.Sub(last) < ft.refreshInterval {
+			continue
+		}
+		if len(ft.lastStored) >= ft.maxEntries {
+			ft.lastStored = make(map[frameAgeKey]time.Time)
+		}
+		ft.lastStored[key] = now
+		hashAsInt, _ := strconv.ParseUint(hash, 16, 64)
+		var parentAsInt uint64
+		if frame.Prev != "" {
+			parentAsInt, _ = strconv.ParseUint(frame.Prev, 16, 64)
+		}
+		records = append(records, FrameAgeRecord{
+			ServiceId:       serviceId,
+			CallStackHash:   hashAsInt,
+			CallStackName:   frame.Name,
+			CallStackParent: parentAsInt,
+			Seen:            timestamp,
+		})
+	}
+	return records
+}
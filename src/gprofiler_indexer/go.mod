@@ -1,11 +1,11 @@
 module main
 
-go 1.24
-
-toolchain go1.24.0
+go 1.24.0
 
 require (
 	github.com/aws/aws-sdk-go v1.55.6
+	github.com/google/pprof v0.0.0-20260115054156-294ebfa9ad83
+	github.com/ianlancetaylor/demangle v0.0.0-20250417193237-f615e6bd150b
 	github.com/lib/pq v1.10.9
 	github.com/sirupsen/logrus v1.9.3
 	go.uber.org/zap v1.27.0
@@ -14,6 +14,7 @@ require (
 require (
 	github.com/ClickHouse/ch-go v0.65.1 // indirect
 	github.com/andybalholm/brotli v1.1.1 // indirect
+	github.com/chzyer/readline v1.5.1 // indirect
 	github.com/go-faster/city v1.0.1 // indirect
 	github.com/go-faster/errors v0.7.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
@@ -0,0 +1,257 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HookEventFileIngested is sent once the records of a profile file are written to the records channels
+const HookEventFileIngested = "file_ingested"
+
+const (
+	defaultHookTimeout = 10 // seconds
+	hookTopFrames      = 10
+	hookQueueSize      = 1000
+)
+
+// HookConfig runs a command or calls a webhook on an event. Commands get the event as JSON on stdin,
+// webhooks as the body of a POST request.
+type HookConfig struct {
+	Name    string            `yaml:"name"`
+	Event   string            `yaml:"event"`
+	Command []string          `yaml:"command"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Timeout in seconds, 10 by default
+	Timeout int `yaml:"timeout"`
+	// Services restricts the hook to these service names, all services when empty
+	Services []string `yaml:"services"`
+}
+
+type hooksFile struct {
+	Hooks []HookConfig `yaml:"hooks"`
+}
+
+// ParseHookConfigs parses and validates a YAML hooks file, e.g.
+//
+//	hooks:
+//	  - name: notify
+//	    event: file_ingested
+//	    url: http://automation:8080/profiles
+//	    headers: {Authorization: Bearer secret}
+func ParseHookConfigs(data []byte) ([]HookConfig, error) {
+	var file hooksFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid hooks file: %w", err)
+	}
+	for idx := range file.Hooks {
+		hook := &file.Hooks[idx]
+		if hook.Name == "" {
+			hook.Name = fmt.Sprintf("hook-%d", idx)
+		}
+		if hook.Event != HookEventFileIngested {
+			return nil, fmt.Errorf("hook %s: unsupported event %q, expected %s", hook.Name, hook.Event,
+				HookEventFileIngested)
+		}
+		if (len(hook.Command) == 0) == (hook.URL == "") {
+			return nil, fmt.Errorf("hook %s: exactly one of command and url must be set", hook.Name)
+		}
+		if hook.Timeout <= 0 {
+			hook.Timeout = defaultHookTimeout
+		}
+	}
+	return file.Hooks, nil
+}
+
+// LoadHookConfigs returns no hook when path is empty
+func LoadHookConfigs(path string) ([]HookConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseHookConfigs(data)
+}
+
+func (hc HookConfig) matches(service string) bool {
+	if len(hc.Services) == 0 {
+		return true
+	}
+	for _, name := range hc.Services {
+		if name == service {
+			return true
+		}
+	}
+	return false
+}
+
+type HookFrame struct {
+	Name    string `json:"name"`
+	Samples int    `json:"samples"`
+}
+
+// IngestionSummary is the file_ingested event, top frames are the leaf frames with the most samples
+type IngestionSummary struct {
+	Event      string      `json:"event"`
+	Service    string      `json:"service"`
+	ServiceId  int         `json:"service_id"`
+	Filename   string      `json:"filename"`
+	HostName   string      `json:"hostname"`
+	Timestamp  time.Time   `json:"timestamp"`
+	Rows       int         `json:"rows"`
+	Samples    uint64      `json:"samples"`
+	TopFrames  []HookFrame `json:"top_frames"`
+	IngestedAt time.Time   `json:"ingested_at"`
+}
+
+// topLeafFrames returns the n frames with the most samples, ties sorted by name
+func topLeafFrames(leafSamples map[string]int, n int) []HookFrame {
+	frames := make([]HookFrame, 0, len(leafSamples))
+	for name, samples := range leafSamples {
+		frames = append(frames, HookFrame{Name: name, Samples: samples})
+	}
+	sort.Slice(frames, func(i, j int) bool {
+		if frames[i].Samples != frames[j].Samples {
+			return frames[i].Samples > frames[j].Samples
+		}
+		return frames[i].Name < frames[j].Name
+	})
+	if len(frames) > n {
+		frames = frames[:n]
+	}
+	return frames
+}
+
+type hookCall struct {
+	hook HookConfig
+	body []byte
+}
+
+// Hooks calls the configured hooks in the background, calls are dropped when the queue is full so that
+// a slow hook never slows down the ingestion. A nil Hooks is a no-op.
+type Hooks struct {
+	hooks   []HookConfig
+	client  *http.Client
+	calls   chan hookCall
+	wg      sync.WaitGroup
+	dropped int
+}
+
+// NewHooks returns nil when there is no hook
+func NewHooks(hooks []HookConfig, queueSize int) *Hooks {
+	if len(hooks) == 0 {
+		return nil
+	}
+	hs := &Hooks{
+		hooks:  hooks,
+		client: &http.Client{},
+		calls:  make(chan hookCall, queueSize),
+	}
+	hs.wg.Add(1)
+	go hs.run()
+	return hs
+}
+
+// FileIngested queues the calls of the file_ingested hooks of the service
+func (hs *Hooks) FileIngested(summary IngestionSummary) {
+	if hs == nil {
+		return
+	}
+	summary.Event = HookEventFileIngested
+	body, err := json.Marshal(summary)
+	if err != nil {
+		logger.Errorf("unable to encode hook event: %v", err)
+		return
+	}
+	for _, hook := range hs.hooks {
+		if hook.Event != summary.Event || !hook.matches(summary.Service) {
+			continue
+		}
+		select {
+		case hs.calls <- hookCall{hook: hook, body: body}:
+		default:
+			hs.dropped += 1
+			logger.Warnf("hooks queue is full, call of hook %s dropped (%d call(s) dropped so far)", hook.Name,
+				hs.dropped)
+		}
+	}
+}
+
+// Close runs the queued calls and stops the hooks
+func (hs *Hooks) Close() {
+	if hs == nil {
+		return
+	}
+	close(hs.calls)
+	hs.wg.Wait()
+}
+
+func (hs *Hooks) run() {
+	defer hs.wg.Done()
+	for call := range hs.calls {
+		if err := hs.call(call); err != nil {
+			logger.Errorf("hook %s failed: %v", call.hook.Name, err)
+		}
+	}
+}
+
+func (hs *Hooks) call(call hookCall) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(call.hook.Timeout)*time.Second)
+	defer cancel()
+	if len(call.hook.Command) > 0 {
+		cmd := exec.CommandContext(ctx, call.hook.Command[0], call.hook.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(call.body)
+		cmd.Env = append(os.Environ(), "HOOK_NAME="+call.hook.Name, "HOOK_EVENT="+call.hook.Event)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+		}
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, call.hook.URL, bytes.NewReader(call.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range call.hook.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
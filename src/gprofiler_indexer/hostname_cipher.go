@@ -0,0 +1,77 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// EncryptedHostNamePrefix marks the encrypted hostnames, they are never encrypted twice
+const EncryptedHostNamePrefix = "enc:"
+
+const minHostNameKeyLength = 16
+
+// HostNameCipher encrypts the hostnames written to ClickHouse. The encryption is deterministic (AES-GCM with
+// a nonce derived from the hostname) so that a hostname is always stored as the same value, the REST
+// service encrypts the hostname filters with the same key and decrypts the hostnames for its readers.
+// The REST service implements the same scheme, both check the vectors of testdata/hostname_cipher_vectors.json.
+type HostNameCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+func deriveHostNameKey(key string, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// NewHostNameCipher returns nil when key is empty, a nil cipher leaves the hostnames as they are
+func NewHostNameCipher(key string) (*HostNameCipher, error) {
+	if key == "" {
+		return nil, nil
+	}
+	if len(key) < minHostNameKeyLength {
+		return nil, fmt.Errorf("hostname encryption key must be at least %d characters long", minHostNameKeyLength)
+	}
+	block, err := aes.NewCipher(deriveHostNameKey(key, "hostname-encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &HostNameCipher{aead: aead, nonceKey: deriveHostNameKey(key, "hostname-nonce")}, nil
+}
+
+func (hc *HostNameCipher) Encrypt(hostname string) string {
+	if hc == nil || hostname == "" || strings.HasPrefix(hostname, EncryptedHostNamePrefix) {
+		return hostname
+	}
+	mac := hmac.New(sha256.New, hc.nonceKey)
+	mac.Write([]byte(hostname))
+	nonce := mac.Sum(nil)[:hc.aead.NonceSize()]
+	sealed := hc.aead.Seal(nonce, nonce, []byte(hostname), nil)
+	return EncryptedHostNamePrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
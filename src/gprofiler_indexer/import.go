@@ -0,0 +1,271 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	importProgressEvery   = 100000
+	maxImportCachedSlices = 10000
+)
+
+// ExportedSample is a raw stacks record as exported by the REST /api/v1/export/samples endpoint
+type ExportedSample struct {
+	Timestamp          time.Time `json:"timestamp"`
+	ServiceId          uint32    `json:"service_id"`
+	InstanceType       string    `json:"instance_type"`
+	ContainerEnvName   string    `json:"container_env_name"`
+	HostName           string    `json:"hostname"`
+	ContainerName      string    `json:"container_name"`
+	NumSamples         int       `json:"num_samples"`
+	CallStackHash      uint64    `json:"call_stack_hash"`
+	CallStackName      string    `json:"call_stack_name"`
+	CallStackParent    uint64    `json:"call_stack_parent"`
+	InsertionTimestamp time.Time `json:"insertion_timestamp"`
+	AppVersion         string    `json:"app_version"`
+	Endpoint           string    `json:"endpoint"`
+	JobName            string    `json:"job_name"`
+	// ServiceName is set by the forwarding indexers, the service ids of the hub differ
+	ServiceName string `json:"service_name,omitempty"`
+}
+
+func (es ExportedSample) StackRecord() StackRecord {
+	return StackRecord{
+		Timestamp:          es.Timestamp.UTC(),
+		ServiceId:          es.ServiceId,
+		InstanceType:       es.InstanceType,
+		ContainerEnvName:   es.ContainerEnvName,
+		HostName:           es.HostName,
+		ContainerName:      es.ContainerName,
+		NumSamples:         es.NumSamples,
+		CallStackHash:      es.CallStackHash,
+		Name:               es.CallStackName,
+		Parent:             es.CallStackParent,
+		InsertionTimestamp: es.InsertionTimestamp.UTC(),
+		AppVersion:         es.AppVersion,
+		Endpoint:           es.Endpoint,
+		JobName:            es.JobName,
+	}
+}
+
+// importSlice is the unit of ingestion, the records of a single profile file
+type importSlice struct {
+	serviceId uint32
+	timestamp int64
+	hostname  string
+}
+
+type ImportStats struct {
+	Lines          int
+	InvalidLines   int
+	Imported       int
+	Skipped        int
+	ImportedSlices int
+	SkippedSlices  int
+}
+
+// sliceExistsFunc reports whether the stacks table already holds records of a slice
+type sliceExistsFunc func(slice importSlice) (bool, error)
+
+// Importer restores exported samples. Slices already present in the stacks table are skipped, so an
+// interrupted import can be run again. Batches are only flushed on slice boundaries so that a failed
+// import never leaves a partially written slice behind.
+type Importer struct {
+	batchSize int
+	exists    sliceExistsFunc
+	write     func(records []RecordsAttributesUnpack) error
+	stats     ImportStats
+	decisions map[importSlice]bool
+	current   importSlice
+	buffer    []RecordsAttributesUnpack
+	// hostNames encrypts the hostnames of samples exported in clear, when set
+	hostNames *HostNameCipher
+}
+
+func NewImporter(batchSize int, exists sliceExistsFunc, write func(records []RecordsAttributesUnpack) error) *Importer {
+	return &Importer{
+		batchSize: batchSize,
+		exists:    exists,
+		write:     write,
+		decisions: make(map[importSlice]bool),
+		buffer:    make([]RecordsAttributesUnpack, 0, batchSize),
+	}
+}
+
+func (im *Importer) Stats() ImportStats {
+	return im.stats
+}
+
+func (im *Importer) flush() error {
+	if len(im.buffer) == 0 {
+		return nil
+	}
+	if err := im.write(im.buffer); err != nil {
+		return err
+	}
+	im.stats.Imported += len(im.buffer)
+	im.buffer = make([]RecordsAttributesUnpack, 0, im.batchSize)
+	return nil
+}
+
+func (im *Importer) add(record StackRecord) error {
+	slice := importSlice{serviceId: record.ServiceId, timestamp: record.Timestamp.Unix(), hostname: record.HostName}
+	if slice != im.current && len(im.buffer) >= im.batchSize {
+		if err := im.flush(); err != nil {
+			return err
+		}
+	}
+	im.current = slice
+
+	importIt, decided := im.decisions[slice]
+	if !decided {
+		exists, err := im.exists(slice)
+		if err != nil {
+			return err
+		}
+		importIt = !exists
+		if len(im.decisions) >= maxImportCachedSlices {
+			im.decisions = make(map[importSlice]bool)
+		}
+		im.decisions[slice] = importIt
+		if importIt {
+			im.stats.ImportedSlices += 1
+		} else {
+			im.stats.SkippedSlices += 1
+		}
+	}
+	if !importIt {
+		im.stats.Skipped += 1
+		return nil
+	}
+	im.buffer = append(im.buffer, record)
+	return nil
+}
+
+// Import reads NDJSON exported samples from r until EOF. When ctx is done the buffered records are
+// dropped, as the last buffered slice may be incomplete, and will be imported by the next run.
+func (im *Importer) Import(ctx context.Context, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, ScannerBufSize), MaxScannerBufSize)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		im.stats.Lines += 1
+		var sample ExportedSample
+		if err := json.Unmarshal([]byte(line), &sample); err != nil {
+			logger.Warnf("skip invalid line %d: %v", im.stats.Lines, err)
+			im.stats.InvalidLines += 1
+			continue
+		}
+		record := sample.StackRecord()
+		record.HostName = im.hostNames.Encrypt(record.HostName)
+		if err := im.add(record); err != nil {
+			return err
+		}
+		if im.stats.Lines%importProgressEvery == 0 {
+			logger.Infof("import progress: %+v", im.stats)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return im.flush()
+}
+
+func openImportFile(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gzipReader, file}, nil
+}
+
+// RunImport imports the NDJSON samples dump args.ImportFile into the stacks tables
+func RunImport(ctx context.Context, args *CLIArgs) (ImportStats, error) {
+	reader, err := openImportFile(args.ImportFile)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	defer reader.Close()
+
+	residency, err := LoadResidencyRouter(args.ResidencyFile)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	clickhouseClients, err := NewClickHouseClients(args, residency)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	for _, clickhouseClient := range clickhouseClients {
+		defer clickhouseClient.conn.Close()
+	}
+
+	table := clickHouseTables.Targets(args.ClickHouseStacksTable)[0]
+	exists := func(slice importSlice) (bool, error) {
+		var count uint64
+		clickhouseClient := clickhouseClients[residency.Region(slice.serviceId)]
+		err := clickhouseClient.conn.QueryRow(ctx, fmt.Sprintf(
+			"SELECT count() FROM %s WHERE ServiceId = ? AND Timestamp = ? AND HostName = ?", table),
+			slice.serviceId, time.Unix(slice.timestamp, 0).UTC(), slice.hostname).Scan(&count)
+		return count > 0, err
+	}
+	// the failures of the shadow table are logged, the import only checks the active one
+	write := func(records []RecordsAttributesUnpack) error {
+		for region, regionRecords := range residency.Split(records) {
+			if err := clickhouseClients[region].writeToTables(regionRecords, args.ClickHouseStacksTable,
+				NoopMetricsPublisher{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	importer := NewImporter(args.ClickHouseStacksBatchSize, exists, write)
+	if importer.hostNames, err = NewHostNameCipher(args.HostNameEncryptionKey); err != nil {
+		return ImportStats{}, err
+	}
+	err = importer.Import(ctx, reader)
+	return importer.Stats(), err
+}
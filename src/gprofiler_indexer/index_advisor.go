@@ -0,0 +1,367 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// advisorMaxQueries is the number of slow query patterns analyzed, the ones with the most slow time
+	advisorMaxQueries = 1000
+	// projectionMinShare is the share of the slow time of a table a column filter must account for to suggest
+	// a projection rather than a skipping index, as a projection stores the table a second time
+	projectionMinShare = 0.5
+)
+
+// SlowQuery is a query pattern of the ClickHouse query log, the queries differing only by their literals
+type SlowQuery struct {
+	Query   string
+	Tables  []string
+	Count   uint64
+	P99Ms   float64
+	TotalMs uint64
+}
+
+// TableSchema is the part of a table definition the advisor compares the slow queries with
+type TableSchema struct {
+	Engine     string
+	SortingKey []string
+	// Columns maps the column names to their types
+	Columns map[string]string
+	// Indexes and Projections are the names of the existing skipping indexes and projections
+	Indexes     map[string]bool
+	Projections map[string]bool
+	// IndexedColumns are the expressions of the existing skipping indexes
+	IndexedColumns map[string]bool
+}
+
+type predicateKind int
+
+const (
+	equalityPredicate predicateKind = iota
+	substringPredicate
+)
+
+// IndexSuggestion is a skipping index or a projection of a table, with the slow queries it should speed up
+type IndexSuggestion struct {
+	Table      string
+	Column     string
+	Projection bool
+	Name       string
+	Definition string
+	Queries    uint64
+	P99Ms      float64
+	TotalMs    uint64
+}
+
+// Statements returns the statements creating the index or projection, and building it for the existing parts
+func (is IndexSuggestion) Statements() []string {
+	if is.Projection {
+		return []string{
+			fmt.Sprintf("ALTER TABLE %s ADD PROJECTION IF NOT EXISTS %s (%s);", is.Table, is.Name, is.Definition),
+			fmt.Sprintf("ALTER TABLE %s MATERIALIZE PROJECTION %s;", is.Table, is.Name),
+		}
+	}
+	return []string{
+		fmt.Sprintf("ALTER TABLE %s ADD INDEX IF NOT EXISTS %s %s;", is.Table, is.Name, is.Definition),
+		fmt.Sprintf("ALTER TABLE %s MATERIALIZE INDEX %s;", is.Table, is.Name),
+	}
+}
+
+func isStringColumn(columnType string) bool {
+	return strings.Contains(columnType, "String")
+}
+
+// queryPredicates returns the string columns the query filters on. Equality filters (=, IN) can use a bloom
+// filter index, substring filters (LIKE, startsWith, endsWith, multiSearchAny) a n-gram bloom filter index.
+func queryPredicates(query string, columns map[string]string) map[string]predicateKind {
+	predicates := make(map[string]predicateKind)
+	for column, columnType := range columns {
+		if !isStringColumn(columnType) || !strings.Contains(query, column) {
+			continue
+		}
+		quoted := regexp.QuoteMeta(column)
+		substring := regexp.MustCompile(`(?i)\b` + quoted + `\s+LIKE\b|\b(startsWith|endsWith|multiSearchAny)\(\s*` +
+			quoted + `\s*,`)
+		equality := regexp.MustCompile(`(?i)\b` + quoted + `\s*(=|IN\b)`)
+		if substring.MatchString(query) {
+			predicates[column] = substringPredicate
+		} else if equality.MatchString(query) {
+			predicates[column] = equalityPredicate
+		}
+	}
+	return predicates
+}
+
+func (ts TableSchema) inSortingKey(column string) bool {
+	for _, key := range ts.SortingKey {
+		if key == column {
+			return true
+		}
+	}
+	return false
+}
+
+// projectionOrder returns the sorting key of a projection by column, with the service and the time kept
+// around it so that the queries of a service and time range can still skip the other granules
+func (ts TableSchema) projectionOrder(column string) string {
+	order := make([]string, 0, 3)
+	if _, ok := ts.Columns["ServiceId"]; ok {
+		order = append(order, "ServiceId")
+	}
+	order = append(order, column)
+	if _, ok := ts.Columns["Timestamp"]; ok {
+		order = append(order, "Timestamp")
+	}
+	return strings.Join(order, ", ")
+}
+
+type advisorKey struct {
+	table  string
+	column string
+}
+
+// AdviseIndexes matches the slow queries with the table schemas. Columns of the sorting key or of an existing
+// index are ignored. An equality filter accounting for most of the slow time of a plain MergeTree table gets
+// a projection, the other filters get a skipping index. Suggestions are sorted by slow time.
+func AdviseIndexes(queries []SlowQuery, schemas map[string]TableSchema) []IndexSuggestion {
+	tableTotals := make(map[string]uint64)
+	kinds := make(map[advisorKey]predicateKind)
+	suggestions := make(map[advisorKey]*IndexSuggestion)
+	for _, query := range queries {
+		for _, table := range query.Tables {
+			schema, ok := schemas[table]
+			if !ok {
+				continue
+			}
+			tableTotals[table] += query.TotalMs
+			for column, kind := range queryPredicates(query.Query, schema.Columns) {
+				if schema.inSortingKey(column) || schema.IndexedColumns[column] {
+					continue
+				}
+				key := advisorKey{table: table, column: column}
+				suggestion, ok := suggestions[key]
+				if !ok {
+					suggestion = &IndexSuggestion{Table: table, Column: column}
+					suggestions[key] = suggestion
+					kinds[key] = kind
+				} else if kind == substringPredicate {
+					kinds[key] = kind
+				}
+				suggestion.Queries += query.Count
+				suggestion.TotalMs += query.TotalMs
+				if query.P99Ms > suggestion.P99Ms {
+					suggestion.P99Ms = query.P99Ms
+				}
+			}
+		}
+	}
+
+	result := make([]IndexSuggestion, 0, len(suggestions))
+	for key, suggestion := range suggestions {
+		schema := schemas[key.table]
+		name := strings.ToLower(key.column)
+		share := float64(suggestion.TotalMs) / float64(tableTotals[key.table])
+		switch {
+		case kinds[key] == equalityPredicate && schema.Engine == "MergeTree" && share >= projectionMinShare:
+			suggestion.Projection = true
+			suggestion.Name = "p_by_" + name
+			suggestion.Definition = fmt.Sprintf("SELECT * ORDER BY (%s)", schema.projectionOrder(key.column))
+		case kinds[key] == substringPredicate:
+			suggestion.Name = "idx_" + name + "_ngram"
+			suggestion.Definition = key.column + " TYPE ngrambf_v1(3, 65536, 2, 0) GRANULARITY 4"
+		default:
+			suggestion.Name = "idx_" + name + "_bf"
+			suggestion.Definition = key.column + " TYPE bloom_filter(0.01) GRANULARITY 4"
+		}
+		if schema.Indexes[suggestion.Name] || schema.Projections[suggestion.Name] {
+			continue
+		}
+		result = append(result, *suggestion)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TotalMs != result[j].TotalMs {
+			return result[i].TotalMs > result[j].TotalMs
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// WriteIndexMigration writes the suggestions as a migration of sql/migrations, to be reviewed and applied
+// as the other migrations
+func WriteIndexMigration(w io.Writer, suggestions []IndexSuggestion, since time.Time, minDurationMs int) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- Skipping indexes and projections suggested by the index advisor for the queries slower than\n"+
+		"-- %dms since %s.\n--\n", minDurationMs, since.Format(time.RFC3339))
+	b.WriteString("-- MATERIALIZE rewrites the existing parts, run it off peak. Single node schema only, cluster\n" +
+		"-- installations alter the local tables ON CLUSTER '{cluster}'.\n")
+	if len(suggestions) == 0 {
+		b.WriteString("--\n-- No suggestion, the slow queries are covered by the sorting keys and the existing indexes.\n")
+	}
+	for _, suggestion := range suggestions {
+		fmt.Fprintf(&b, "\n-- %s: %d slow queries filtering on %s, p99 %.0fms, %.0fs in total\n", suggestion.Table,
+			suggestion.Queries, suggestion.Column, suggestion.P99Ms, float64(suggestion.TotalMs)/1000)
+		for _, statement := range suggestion.Statements() {
+			b.WriteString(statement + "\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func listSlowQueries(ctx context.Context, client *ClickHouseClient, database string, since time.Time,
+	minDurationMs int) ([]SlowQuery, error) {
+	rows, err := client.conn.Query(ctx, `
+		SELECT any(query), any(tables), count(), quantile(0.99)(query_duration_ms), sum(query_duration_ms)
+		FROM system.query_log
+		WHERE type = 'QueryFinish' AND query_kind = 'Select' AND event_time >= ? AND query_duration_ms >= ?
+			AND has(databases, ?)
+		GROUP BY normalized_query_hash
+		ORDER BY sum(query_duration_ms) DESC
+		LIMIT ?`, since, minDurationMs, database, advisorMaxQueries)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	queries := make([]SlowQuery, 0)
+	for rows.Next() {
+		var query SlowQuery
+		if err = rows.Scan(&query.Query, &query.Tables, &query.Count, &query.P99Ms, &query.TotalMs); err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+	}
+	return queries, rows.Err()
+}
+
+var projectionNameRegex = regexp.MustCompile(`PROJECTION\s+(\w+)`)
+
+func loadTableSchemas(ctx context.Context, client *ClickHouseClient, database string) (map[string]TableSchema, error) {
+	schemas := make(map[string]TableSchema)
+	rows, err := client.conn.Query(ctx,
+		"SELECT name, engine, sorting_key, create_table_query FROM system.tables WHERE database = ?", database)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, engine, sortingKey, createQuery string
+		if err = rows.Scan(&name, &engine, &sortingKey, &createQuery); err != nil {
+			return nil, err
+		}
+		schema := TableSchema{
+			Engine:         engine,
+			SortingKey:     strings.Split(sortingKey, ", "),
+			Columns:        make(map[string]string),
+			Indexes:        make(map[string]bool),
+			Projections:    make(map[string]bool),
+			IndexedColumns: make(map[string]bool),
+		}
+		for _, match := range projectionNameRegex.FindAllStringSubmatch(createQuery, -1) {
+			schema.Projections[match[1]] = true
+		}
+		schemas[database+"."+name] = schema
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	columns, err := client.conn.Query(ctx, "SELECT table, name, type FROM system.columns WHERE database = ?", database)
+	if err != nil {
+		return nil, err
+	}
+	defer columns.Close()
+	for columns.Next() {
+		var table, name, columnType string
+		if err = columns.Scan(&table, &name, &columnType); err != nil {
+			return nil, err
+		}
+		if schema, ok := schemas[database+"."+table]; ok {
+			schema.Columns[name] = columnType
+		}
+	}
+	if err = columns.Err(); err != nil {
+		return nil, err
+	}
+
+	indexes, err := client.conn.Query(ctx,
+		"SELECT table, name, expr FROM system.data_skipping_indices WHERE database = ?", database)
+	if err != nil {
+		return nil, err
+	}
+	defer indexes.Close()
+	for indexes.Next() {
+		var table, name, expr string
+		if err = indexes.Scan(&table, &name, &expr); err != nil {
+			return nil, err
+		}
+		if schema, ok := schemas[database+"."+table]; ok {
+			schema.Indexes[name] = true
+			schema.IndexedColumns[expr] = true
+		}
+	}
+	return schemas, indexes.Err()
+}
+
+// RunIndexAdvisor reads the slow queries of the query log within the args.AdviseIndexes lookback and writes
+// the suggested skipping indexes and projections as a migration to args.AdviseIndexesOutput
+func RunIndexAdvisor(ctx context.Context, args *CLIArgs) (int, error) {
+	lookback, err := time.ParseDuration(args.AdviseIndexes)
+	if err != nil {
+		return 0, fmt.Errorf("invalid index advisor lookback %q: %w", args.AdviseIndexes, err)
+	}
+	settings := NewClickHouseSettings(args)
+	clickhouseClient, err := NewClickHouseClient(settings)
+	if err != nil {
+		return 0, err
+	}
+	defer clickhouseClient.conn.Close()
+
+	since := time.Now().UTC().Add(-lookback)
+	queries, err := listSlowQueries(ctx, clickhouseClient, settings.Database, since, args.AdviseIndexesMinDuration)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read the query log: %w", err)
+	}
+	schemas, err := loadTableSchemas(ctx, clickhouseClient, settings.Database)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read the table schemas: %w", err)
+	}
+	suggestions := AdviseIndexes(queries, schemas)
+	logger.Infof("%d slow query pattern(s) analyzed, %d suggestion(s)", len(queries), len(suggestions))
+
+	if args.AdviseIndexesOutput == "-" {
+		return len(suggestions), WriteIndexMigration(os.Stdout, suggestions, since, args.AdviseIndexesMinDuration)
+	}
+	file, err := os.Create(args.AdviseIndexesOutput)
+	if err != nil {
+		return 0, err
+	}
+	if err = WriteIndexMigration(file, suggestions, since, args.AdviseIndexesMinDuration); err != nil {
+		file.Close()
+		return 0, err
+	}
+	return len(suggestions), file.Close()
+}
@@ -18,22 +18,28 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"go.uber.org/zap"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 )
 
 var (
-	frameReplacer *FrameReplacer
+	frameReplacer    *FrameReplacer
+	clickHouseTables *TableNames
 	logger        *zap.SugaredLogger
 )
 
 type RecordChannels struct {
-	StacksRecords  chan StackRecord
-	MetricsRecords chan MetricRecord
+	StacksRecords        chan StackRecord
+	MetricsRecords       chan MetricRecord
+	SymbolQualityRecords chan SymbolQualityRecord
+	AnomalyRecords       chan AnomalyRecord
+	SidecarRecords       chan SidecarRecord
+	FrameAgeRecords      chan FrameAgeRecord
 }
 
 func InitLogs() {
@@ -46,7 +52,68 @@ func main() {
 	args := NewCliArgs()
 	args.ParseArgs()
 
-	logger.Infof("Starting %s", AppName)
+	var err error
+	clickHouseTables, err = NewTableNames(args.ClickHouseTableSuffix, args.ClickHouseShadowTableSuffix)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if args.ImportFile != "" {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		stats, err := RunImport(ctx, args)
+		cancel()
+		logger.Infof("import of %s finished: %+v", args.ImportFile, stats)
+		if err != nil {
+			logger.Fatalf("import of %s failed: %v", args.ImportFile, err)
+		}
+		os.Exit(0)
+	}
+
+	if args.RecomputeRollups != "" {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		buckets, err := RecomputeRollups(ctx, args)
+		cancel()
+		logger.Infof("recomputed the rollups of %d late hour(s)", buckets)
+		if err != nil {
+			logger.Fatalf("recompute of the rollups failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if args.AdviseIndexes != "" {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		suggestions, err := RunIndexAdvisor(ctx, args)
+		cancel()
+		if err != nil {
+			logger.Fatalf("index advisor failed: %v", err)
+		}
+		logger.Infof("index advisor wrote %d suggestion(s) to %s", suggestions, args.AdviseIndexesOutput)
+		os.Exit(0)
+	}
+
+	preflightResults := RunPreflight(args)
+	if args.Check {
+		if !PrintPreflightReport(os.Stdout, preflightResults) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	preflightFailed := false
+	for _, result := range preflightResults {
+		if result.Status == PreflightFail {
+			logger.Errorf("preflight check %s failed: %s", result.Name, result.Detail)
+			preflightFailed = true
+		} else if result.Status == PreflightWarn {
+			logger.Warnf("preflight check %s: %s", result.Name, result.Detail)
+		}
+	}
+	if preflightFailed {
+		logger.Fatal("preflight checks failed, run with -check for a full report")
+	}
+
+	buildInfo := GetBuildInfo()
+	logger.Infof("Starting %s version %s (git %s, built %s, %s)", AppName, buildInfo.Version, buildInfo.GitSHA,
+		buildInfo.BuildTime, buildInfo.GoVersion)
 	
 	// Initialize metrics publisher
 	metricsPublisher := NewMetricsPublisher(
@@ -57,34 +124,103 @@ func main() {
 	)
 	
 	// Initialize PostgreSQL connection for adhoc flamegraph metadata storage
-	postgresConnStr := fmt.Sprintf(
-		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		args.PostgresHost,
-		args.PostgresPort,
-		args.PostgresUser,
-		args.PostgresPassword,
-		args.PostgresDB,
-	)
-	err := InitPostgres(postgresConnStr)
+	err = InitPostgres(PostgresConnString(args))
 	if err != nil {
 		logger.Fatalf("Failed to connect to PostgreSQL: %v", err)
 	}
 	logger.Infof("Connected to PostgreSQL at %s:%d", args.PostgresHost, args.PostgresPort)
 	defer ClosePostgres()
 	
-	tasks := make(chan SQSMessage, args.Concurrency)
+	tasks := make(chan Task, args.Concurrency)
 	channels := RecordChannels{
 		StacksRecords:  make(chan StackRecord, args.ClickHouseStacksBatchSize),
 		MetricsRecords: make(chan MetricRecord, args.ClickHouseMetricsBatchSize),
 	}
+	if args.ClickHouseSymbolQualityTable != "" {
+		channels.SymbolQualityRecords = make(chan SymbolQualityRecord, args.ClickHouseMetricsBatchSize)
+	}
+	if args.ClickHouseAnomaliesTable != "" {
+		channels.AnomalyRecords = make(chan AnomalyRecord, args.ClickHouseMetricsBatchSize)
+	}
+	if args.ClickHouseSidecarsTable != "" {
+		channels.SidecarRecords = make(chan SidecarRecord, args.ClickHouseMetricsBatchSize)
+	}
+	if args.ClickHouseFrameAgesTable != "" {
+		channels.FrameAgeRecords = make(chan FrameAgeRecord, args.ClickHouseStacksBatchSize)
+	}
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	var tasksWaitGroup sync.WaitGroup
 	var listenSQSWaitGroup sync.WaitGroup
 	var buffWriterWaitGroup sync.WaitGroup
 
+	hostNames, err := NewHostNameCipher(args.HostNameEncryptionKey)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	deliveryAudit := NewDeliveryAudit(time.Now().UTC())
+	if args.DeliveryAuditInterval > 0 {
+		go deliveryAudit.Run(ctx, time.Duration(args.DeliveryAuditInterval)*time.Second, metricsPublisher)
+	}
+
+	var ingestHandler *IngestHandler
+	var adminMux *http.ServeMux
+	if args.AdminAddr != "" {
+		adminMux = http.NewServeMux()
+		adminMux.HandleFunc("/table_suffix", clickHouseTables.TableSuffixHandler)
+		adminMux.Handle("/delivery_audit", deliveryAudit)
+		if args.IngestToken != "" {
+			ingestHandler = NewIngestHandler(args.IngestToken, &channels, GetOrCreateServiceId)
+			ingestHandler.hostNames = hostNames
+			ingestHandler.audit = deliveryAudit
+			ingestHandler.maxBodySize = int64(args.IngestMaxBodySize) * 1024 * 1024
+			ingestHandler.maxDecompressedSize = int64(args.IngestMaxDecompressedSize) * 1024 * 1024
+			adminMux.Handle(IngestSamplesPath, ingestHandler)
+			adminMux.Handle(IngestMetricsPath, ingestHandler)
+			adminMux.Handle(IngestPprofPath, ingestHandler)
+		}
+		StartAdminServer(ctx, args.AdminAddr, args.AdminToken, adminMux)
+	}
+
 	frameReplacer = NewFrameReplacer()
 	frameReplacer.InitRegexps(args.FrameReplaceFileName)
 	callStackWriter := NewProfilesWriter(&channels)
+	callStackWriter.filenames, err = NewFilenameParser(args.FilenamePattern, args.FilenameTimeLayout)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	callStackWriter.timestampGuard, err = NewTimestampGuard(time.Duration(args.TimestampMaxFutureSkew)*time.Second,
+		time.Duration(args.TimestampMaxPastAge)*time.Second, args.TimestampAction)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	callStackWriter.lateArrivalThreshold = time.Duration(args.LateArrivalThreshold) * time.Second
+	callStackWriter.hostNames = hostNames
+	residency, err := LoadResidencyRouter(args.ResidencyFile)
+	if err != nil {
+		logger.Fatalf("unable to load residency file %s: %v", args.ResidencyFile, err)
+	}
+	callStackWriter.residency = residency
+	callStackWriter.uploads, err = NewUploadPolicies(args.HTMLBlobOverwrite, args.FlamegraphHTMLOverwrite)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	callStackWriter.dedupFlamegraphs = args.FlamegraphDedup
+	hookConfigs, err := LoadHookConfigs(args.HooksFile)
+	if err != nil {
+		logger.Fatalf("unable to load hooks file %s: %v", args.HooksFile, err)
+	}
+	callStackWriter.hooks = NewHooks(hookConfigs, hookQueueSize)
+	if args.ServiceTaggingEnabled {
+		callStackWriter.tagger = NewServiceTagger(time.Duration(args.ServiceTaggingRefreshInterval) * time.Second)
+	}
+	callStackWriter.sidecars = NewSidecarClassifier(args.SidecarPatterns, sidecarRefreshInterval)
+	callStackWriter.frameAges = NewFrameAgeTracker(frameAgeRefreshInterval, maxFrameAgeEntries)
+	callStackWriter.demangleFrames = args.DemangleFrames
+	callStackWriter.audit = deliveryAudit
+	if ingestHandler != nil {
+		ingestHandler.profiles = callStackWriter
+	}
 
 	reloader, watcherErr := NewFileReloader(args)
 	reloader.Start(ctx)
@@ -100,23 +236,99 @@ func main() {
 	} else {
 		logger.Warnf("Unable to create reloader %v", watcherErr)
 	}
+	// nil when disabled, the polling is never paused then
+	backpressure := NewBackpressure(args.BackpressureMaxFailures, args.BackpressureQueueSaturation)
+	var taskSource TaskSource
+	if args.InputFolder == "" {
+		logger.Debugf("start listening SQS queue %s", args.SQSQueue)
+		sqsTaskSource := NewSQSTaskSource(args, metricsPublisher)
+		sqsTaskSource.backpressure = backpressure
+		taskSource = sqsTaskSource
+	} else {
+		taskSource = NewFolderTaskSource(args.InputFolder)
+	}
+	storage := NewS3Storage(args)
+	residency.SetStorages(func(bucket string) BucketStorage {
+		return storage.WithBucket(bucket)
+	})
+	if args.InputFolder == "" && (adminMux != nil || args.ReconcileInterval > 0) {
+		reconciler := NewReconciler(residency.Inventory(storage), ListAdhocFlamegraphMetadata,
+			DeleteAdhocFlamegraphMetadata,
+			time.Duration(args.ReconcileGracePeriod)*time.Second)
+		reconciler.listContentKeys = ListAdhocFlamegraphContentKeys
+		if adminMux != nil {
+			adminMux.Handle("/orphans", reconciler)
+		}
+		if args.ReconcileInterval > 0 {
+			go reconciler.Run(ctx, time.Duration(args.ReconcileInterval)*time.Second)
+		}
+	}
 	// spawn workers
 	for idx := 0; idx < args.Concurrency; idx++ {
 		tasksWaitGroup.Add(1)
-		go Worker(idx, args, tasks, callStackWriter, &tasksWaitGroup)
+		go Worker(idx, tasks, taskSource, storage, callStackWriter, metricsPublisher, &tasksWaitGroup)
 	}
 
-	if args.InputFolder == "" {
-		logger.Debugf("start listening SQS queue %s", args.SQSQueue)
-		listenSQSWaitGroup.Add(1)
-		go ListenSqs(ctx, args, tasks, &listenSQSWaitGroup)
-	} else {
-		listenSQSWaitGroup.Add(1)
-		go ProcessFolder(ctx, tasks, args.InputFolder, &listenSQSWaitGroup)
+	listenSQSWaitGroup.Add(1)
+	go func() {
+		defer listenSQSWaitGroup.Done()
+		taskSource.Fetch(ctx, tasks)
+	}()
+
+	if args.SelfProfilingEnabled {
+		serviceId, err := GetOrCreateServiceId(args.SelfProfilingServiceName)
+		if err != nil {
+			logger.Errorf("self profiling disabled: %v", err)
+		} else {
+			logger.Infof("self profiling enabled, service %s (%d)", args.SelfProfilingServiceName, serviceId)
+			// writes stacks like the workers, so it must stop before the records channels are closed
+			tasksWaitGroup.Add(1)
+			go NewSelfProfiler(args, serviceId, callStackWriter).Run(ctx, &tasksWaitGroup)
+		}
+	}
+
+	if args.PurgeInterval > 0 {
+		purgeClients, err := NewClickHouseClients(args, residency)
+		if err != nil {
+			logger.Fatalf("unable to connect to ClickHouse to purge archived services: %v", err)
+		}
+		for _, purgeClient := range purgeClients {
+			defer purgeClient.conn.Close()
+		}
+		deleteRecords := func(ctx context.Context, table string, serviceId int) error {
+			purgeClient := purgeClients[residency.Region(uint32(serviceId))]
+			return purgeClient.conn.Exec(ctx, purgeQuery(table), uint32(serviceId))
+		}
+		purger := NewServicePurger(PurgeTables(clickHouseTables, args), ListServicesToPurge, MarkServicePurged, deleteRecords)
+		go purger.Run(ctx, time.Duration(args.PurgeInterval)*time.Second)
+	}
+
+	if args.WarehouseDriver != "" {
+		warehouseDriver, err := NewWarehouseDriver(args)
+		if err != nil {
+			logger.Fatalf("unable to create the warehouse driver: %v", err)
+		}
+		defer warehouseDriver.Close()
+		warehouseClients, err := NewClickHouseClients(args, residency)
+		if err != nil {
+			logger.Fatalf("unable to connect to ClickHouse to export the warehouse aggregates: %v", err)
+		}
+		for _, warehouseClient := range warehouseClients {
+			defer warehouseClient.conn.Close()
+		}
+		dailyTable := func() string {
+			return rollupDefinition{name: "1day_all"}.table(args.ClickHouseStacksTable,
+				clickHouseTables.Suffixes().Suffix)
+		}
+		exporter := NewWarehouseExporter(warehouseDriver,
+			FetchWarehouseAggregates(warehouseClients, dailyTable, args.WarehouseTopFunctions), ListServiceNames,
+			time.Duration(args.WarehouseExportDelay)*time.Second)
+		go exporter.Run(ctx, warehouseCheckInterval)
 	}
 
 	buffWriterWaitGroup.Add(1)
-	go BufferedClickHouseWrite(args, &channels, &buffWriterWaitGroup)
+	go BufferedClickHouseWrite(args, &channels, residency, backpressure, deliveryAudit, metricsPublisher,
+		&buffWriterWaitGroup)
 
 	signalChannel := make(chan os.Signal, 2)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
@@ -127,17 +339,32 @@ func main() {
 			listenSQSWaitGroup.Wait()
 			close(tasks)
 			tasksWaitGroup.Wait()
+			if ingestHandler != nil {
+				ingestHandler.Close()
+			}
 			close(channels.StacksRecords)
 			close(channels.MetricsRecords)
+			if channels.SymbolQualityRecords != nil {
+				close(channels.SymbolQualityRecords)
+			}
+			if channels.AnomalyRecords != nil {
+				close(channels.AnomalyRecords)
+			}
+			if channels.SidecarRecords != nil {
+				close(channels.SidecarRecords)
+			}
+			if channels.FrameAgeRecords != nil {
+				close(channels.FrameAgeRecords)
+			}
 		}
 	}()
 
 	buffWriterWaitGroup.Wait()
+	// the workers are done, the queued hook calls are run before exiting
+	callStackWriter.hooks.Close()
 	
 	// Cleanup metrics publisher
-	if metricsPublisher != nil {
-		metricsPublisher.FlushAndClose()
-	}
+	metricsPublisher.FlushAndClose()
 	
 	logger.Info("Graceful shutdown")
 }
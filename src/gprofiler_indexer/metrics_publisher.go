@@ -33,75 +33,84 @@ const (
 	ResponseTypeIgnoredFailure = "ignored_failure"
 )
 
-// MetricsPublisher handles sending metrics to metrics agent via TCP
-type MetricsPublisher struct {
-	host               string
-	port               string
-	serviceName        string
-	sliMetricUUID      string
-	enabled            bool
-	connectionFailed   bool
-	lastErrorLogTime   int64
-	errorLogInterval   int64
-	mutex              sync.Mutex
+// MetricsPublisher sends SLI and operational error metrics, it is passed to the components reporting them
+type MetricsPublisher interface {
+	SendSLIMetric(responseType, methodName string, extraTags map[string]string) bool
+	SendErrorMetric(metricName string, extraTags map[string]string) bool
+	SendCounterMetric(metricName string, value int64, extraTags map[string]string) bool
+	FlushAndClose()
 }
 
-var (
-	metricsInstance *MetricsPublisher
-	metricsOnce     sync.Once
-)
+// NoopMetricsPublisher drops every metric, it is used when metrics are disabled and in tests
+type NoopMetricsPublisher struct{}
 
-// NewMetricsPublisher creates or returns the singleton MetricsPublisher instance
-func NewMetricsPublisher(serverURL, serviceName, sliUUID string, enabled bool) *MetricsPublisher {
-	metricsOnce.Do(func() {
-		instance := &MetricsPublisher{
-			serviceName:      serviceName,
-			sliMetricUUID:    sliUUID,
-			enabled:          enabled,
-			errorLogInterval: 300, // Log errors at most once every 5 minutes
-		}
+func (NoopMetricsPublisher) SendSLIMetric(responseType, methodName string, extraTags map[string]string) bool {
+	return false
+}
 
-		// Parse server URL (tcp://host:port)
-		if strings.HasPrefix(serverURL, "tcp://") {
-			urlParts := strings.Split(serverURL[6:], ":")
-			instance.host = urlParts[0]
-			if len(urlParts) > 1 {
-				instance.port = urlParts[1]
-			} else {
-				instance.port = "18126"
-			}
-		} else {
-			if enabled {
-				log.Fatalf("Unsupported server URL format: %s. Expected tcp://host:port", serverURL)
-			}
-			instance.host = "localhost"
-			instance.port = "18126"
-		}
+func (NoopMetricsPublisher) SendErrorMetric(metricName string, extraTags map[string]string) bool {
+	return false
+}
 
-		if enabled {
-			log.Infof("MetricsPublisher initialized: service=%s, server=%s:%s, sli_enabled=%t",
-				serviceName, instance.host, instance.port, sliUUID != "")
-		} else {
-			log.Info("MetricsPublisher disabled")
-		}
+func (NoopMetricsPublisher) SendCounterMetric(metricName string, value int64, extraTags map[string]string) bool {
+	return false
+}
 
-		metricsInstance = instance
-	})
+func (NoopMetricsPublisher) FlushAndClose() {}
+
+// TCPMetricsPublisher handles sending metrics to metrics agent via TCP
+type TCPMetricsPublisher struct {
+	host             string
+	port             string
+	serviceName      string
+	sliMetricUUID    string
+	enabled          bool
+	connectionFailed bool
+	lastErrorLogTime int64
+	errorLogInterval int64
+	mutex            sync.Mutex
+}
 
-	return metricsInstance
+// NewMetricsPublisher creates the publisher of the metrics agent at serverURL, or a no-op publisher when disabled
+func NewMetricsPublisher(serverURL, serviceName, sliUUID string, enabled bool) MetricsPublisher {
+	if !enabled {
+		log.Info("MetricsPublisher disabled")
+		return NoopMetricsPublisher{}
+	}
+	return NewTCPMetricsPublisher(serverURL, serviceName, sliUUID)
 }
 
-// GetInstance returns the singleton MetricsPublisher instance
-// Returns nil if not initialized
-func GetMetricsPublisher() *MetricsPublisher {
-	return metricsInstance
+func NewTCPMetricsPublisher(serverURL, serviceName, sliUUID string) *TCPMetricsPublisher {
+	instance := &TCPMetricsPublisher{
+		serviceName:      serviceName,
+		sliMetricUUID:    sliUUID,
+		enabled:          true,
+		errorLogInterval: 300, // Log errors at most once every 5 minutes
+	}
+
+	// Parse server URL (tcp://host:port)
+	if strings.HasPrefix(serverURL, "tcp://") {
+		urlParts := strings.Split(serverURL[6:], ":")
+		instance.host = urlParts[0]
+		if len(urlParts) > 1 {
+			instance.port = urlParts[1]
+		} else {
+			instance.port = "18126"
+		}
+	} else {
+		log.Fatalf("Unsupported server URL format: %s. Expected tcp://host:port", serverURL)
+	}
+
+	log.Infof("MetricsPublisher initialized: service=%s, server=%s:%s, sli_enabled=%t",
+		serviceName, instance.host, instance.port, sliUUID != "")
+	return instance
 }
 
 // SendSLIMetric sends an SLI metric for tracking HTTP success rate
 // responseType: success, failure, or ignored_failure
 // methodName: The method/operation being tracked (e.g., "event_processing")
 // extraTags: Additional tags as key-value pairs
-func (m *MetricsPublisher) SendSLIMetric(responseType, methodName string, extraTags map[string]string) bool {
+func (m *TCPMetricsPublisher) SendSLIMetric(responseType, methodName string, extraTags map[string]string) bool {
 	if m == nil || !m.enabled || m.sliMetricUUID == "" {
 		return false
 	}
@@ -136,7 +145,12 @@ func (m *MetricsPublisher) SendSLIMetric(responseType, methodName string, extraT
 }
 
 // SendErrorMetric sends an operational error metric
-func (m *MetricsPublisher) SendErrorMetric(metricName string, extraTags map[string]string) bool {
+func (m *TCPMetricsPublisher) SendErrorMetric(metricName string, extraTags map[string]string) bool {
+	return m.SendCounterMetric(metricName, 1, extraTags)
+}
+
+// SendCounterMetric sends a counter metric of value, e.g. the number of events since the last one sent
+func (m *TCPMetricsPublisher) SendCounterMetric(metricName string, value int64, extraTags map[string]string) bool {
 	if m == nil || !m.enabled {
 		return false
 	}
@@ -150,23 +164,23 @@ func (m *MetricsPublisher) SendErrorMetric(metricName string, extraTags map[stri
 	}
 
 	if extraTags != nil {
-		for key, value := range extraTags {
-			tags = append(tags, fmt.Sprintf("%s=%s", key, value))
+		for key, tagValue := range extraTags {
+			tags = append(tags, fmt.Sprintf("%s=%s", key, tagValue))
 		}
 	}
 
 	tagString := strings.Join(tags, " ")
 
 	// Format: put metric_name timestamp value tag1=value1 tag2=value2 ...
-	metricLine := fmt.Sprintf("put %s %d 1 %s", metricName, timestamp, tagString)
+	metricLine := fmt.Sprintf("put %s %d %d %s", metricName, timestamp, value, tagString)
 
-	log.Debugf("📊 Sending error metric: %s", metricLine)
+	log.Debugf("📊 Sending counter metric: %s", metricLine)
 
 	return m.sendMetric(metricLine)
 }
 
 // sendMetric sends a metric line via TCP socket
-func (m *MetricsPublisher) sendMetric(metricLine string) bool {
+func (m *TCPMetricsPublisher) sendMetric(metricLine string) bool {
 	if m == nil || !m.enabled {
 		return false
 	}
@@ -224,11 +238,10 @@ func (m *MetricsPublisher) sendMetric(metricLine string) bool {
 }
 
 // FlushAndClose flushes any pending metrics and closes the publisher
-func (m *MetricsPublisher) FlushAndClose() {
+func (m *TCPMetricsPublisher) FlushAndClose() {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
 	log.Info("MetricsPublisher closed")
 	m.enabled = false
 }
-
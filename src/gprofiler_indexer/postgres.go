@@ -27,6 +27,18 @@ import (
 
 var db *sql.DB
 
+// PostgresConnString builds the PostgreSQL connection string from the CLI arguments
+func PostgresConnString(args *CLIArgs) string {
+	return fmt.Sprintf(
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		args.PostgresHost,
+		args.PostgresPort,
+		args.PostgresUser,
+		args.PostgresPassword,
+		args.PostgresDB,
+	)
+}
+
 // InitPostgres initializes the PostgreSQL connection pool
 func InitPostgres(connStr string) error {
 	var err error
@@ -51,6 +63,7 @@ func InitPostgres(connStr string) error {
 
 // StoreAdhocFlamegraphMetadata stores metadata for an adhoc flamegraph HTML file in PostgreSQL
 // This is called after successfully uploading the flamegraph HTML to S3
+// contentKey is the content addressed object holding the HTML when it is deduplicated, empty otherwise
 func StoreAdhocFlamegraphMetadata(
 	serviceId int,
 	hostname string,
@@ -58,6 +71,7 @@ func StoreAdhocFlamegraphMetadata(
 	perfEvents []string,
 	timestamp time.Time,
 	fileSize int64,
+	contentKey string,
 ) error {
 	if db == nil {
 		return fmt.Errorf("postgres connection not initialized")
@@ -65,11 +79,12 @@ func StoreAdhocFlamegraphMetadata(
 
 	query := `
 		INSERT INTO AdhocFlamegraphMetadata 
-		(service_id, hostname, s3_key, perf_events, start_time, end_time, file_size)
-		VALUES ($1, $2, $3, $4, $5, $5, $6)
+		(service_id, hostname, s3_key, perf_events, start_time, end_time, file_size, content_key)
+		VALUES ($1, $2, $3, $4, $5, $5, $6, NULLIF($7, ''))
 		ON CONFLICT (s3_key) DO UPDATE SET
 			perf_events = EXCLUDED.perf_events,
-			file_size = EXCLUDED.file_size
+			file_size = EXCLUDED.file_size,
+			content_key = EXCLUDED.content_key
 	`
 
 	_, err := db.Exec(
@@ -80,6 +95,7 @@ func StoreAdhocFlamegraphMetadata(
 		pq.Array(perfEvents),
 		timestamp,
 		fileSize,
+		contentKey,
 	)
 
 	if err != nil {
@@ -89,6 +105,172 @@ func StoreAdhocFlamegraphMetadata(
 	return nil
 }
 
+// ListAdhocFlamegraphMetadata returns the creation time of the adhoc flamegraph metadata rows, by S3 key
+func ListAdhocFlamegraphMetadata() (map[string]time.Time, error) {
+	if db == nil {
+		return nil, fmt.Errorf("postgres connection not initialized")
+	}
+
+	rows, err := db.Query(`SELECT s3_key, COALESCE(created_at, start_time) FROM AdhocFlamegraphMetadata`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list flamegraph metadata: %w", err)
+	}
+	defer rows.Close()
+
+	keys := make(map[string]time.Time)
+	for rows.Next() {
+		var key string
+		var createdAt time.Time
+		if err := rows.Scan(&key, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan flamegraph metadata: %w", err)
+		}
+		keys[key] = createdAt
+	}
+	return keys, rows.Err()
+}
+
+// ListAdhocFlamegraphContentKeys returns the content addressed object of the deduplicated adhoc flamegraphs,
+// by S3 key
+func ListAdhocFlamegraphContentKeys() (map[string]string, error) {
+	if db == nil {
+		return nil, fmt.Errorf("postgres connection not initialized")
+	}
+
+	rows, err := db.Query(`SELECT s3_key, content_key FROM AdhocFlamegraphMetadata WHERE content_key IS NOT NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list flamegraph content keys: %w", err)
+	}
+	defer rows.Close()
+
+	contentKeys := make(map[string]string)
+	for rows.Next() {
+		var key, contentKey string
+		if err := rows.Scan(&key, &contentKey); err != nil {
+			return nil, fmt.Errorf("failed to scan flamegraph content key: %w", err)
+		}
+		contentKeys[key] = contentKey
+	}
+	return contentKeys, rows.Err()
+}
+
+// DeleteAdhocFlamegraphMetadata deletes the adhoc flamegraph metadata rows of the S3 keys
+func DeleteAdhocFlamegraphMetadata(keys []string) (int64, error) {
+	if db == nil {
+		return 0, fmt.Errorf("postgres connection not initialized")
+	}
+
+	result, err := db.Exec(`DELETE FROM AdhocFlamegraphMetadata WHERE s3_key = ANY($1)`, pq.Array(keys))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete flamegraph metadata: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// ListServicesToPurge returns the ids of the archived services whose restore window is over
+func ListServicesToPurge() ([]int, error) {
+	if db == nil {
+		return nil, fmt.Errorf("postgres connection not initialized")
+	}
+
+	rows, err := db.Query(`
+		SELECT ID FROM Services
+		WHERE archived_at IS NOT NULL AND purged_at IS NULL AND purge_after <= CURRENT_TIMESTAMP
+		ORDER BY purge_after
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services to purge: %w", err)
+	}
+	defer rows.Close()
+
+	serviceIds := make([]int, 0)
+	for rows.Next() {
+		var serviceId int
+		if err := rows.Scan(&serviceId); err != nil {
+			return nil, fmt.Errorf("failed to scan service id: %w", err)
+		}
+		serviceIds = append(serviceIds, serviceId)
+	}
+	return serviceIds, rows.Err()
+}
+
+// MarkServicePurged records that the profiling data of an archived service was deleted, it can no longer be restored
+func MarkServicePurged(serviceId int) error {
+	if db == nil {
+		return fmt.Errorf("postgres connection not initialized")
+	}
+
+	_, err := db.Exec(`UPDATE Services SET purged_at = CURRENT_TIMESTAMP WHERE ID = $1`, serviceId)
+	if err != nil {
+		return fmt.Errorf("failed to mark service %d purged: %w", serviceId, err)
+	}
+	return nil
+}
+
+// GetOrCreateServiceId returns the id of the service with the given name, creating it if needed
+func GetOrCreateServiceId(name string) (int, error) {
+	if db == nil {
+		return 0, fmt.Errorf("postgres connection not initialized")
+	}
+
+	query := `
+		INSERT INTO Services (name)
+		VALUES ($1)
+		ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING ID
+	`
+
+	var serviceId int
+	if err := db.QueryRow(query, name).Scan(&serviceId); err != nil {
+		return 0, fmt.Errorf("failed to get service id for %s: %w", name, err)
+	}
+
+	return serviceId, nil
+}
+
+// ListServiceNames returns the names of the services by id
+func ListServiceNames() (map[int]string, error) {
+	if db == nil {
+		return nil, fmt.Errorf("postgres connection not initialized")
+	}
+
+	rows, err := db.Query(`SELECT ID, name FROM Services`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+	defer rows.Close()
+
+	names := make(map[int]string)
+	for rows.Next() {
+		var serviceId int
+		var name string
+		if err := rows.Scan(&serviceId, &name); err != nil {
+			return nil, fmt.Errorf("failed to scan service: %w", err)
+		}
+		names[serviceId] = name
+	}
+	return names, rows.Err()
+}
+
+// UpsertServiceTechnologyTags records the technologies detected in the profiles of a service
+func UpsertServiceTechnologyTags(serviceId int, tags []string, seenAt time.Time) error {
+	if db == nil {
+		return fmt.Errorf("postgres connection not initialized")
+	}
+
+	query := `
+		INSERT INTO ServiceTechnologyTags (service_id, tag, first_seen, last_seen)
+		SELECT $1, tag, $3, $3 FROM unnest($2::text[]) AS tag
+		ON CONFLICT (service_id, tag) DO UPDATE SET
+			last_seen = GREATEST(ServiceTechnologyTags.last_seen, EXCLUDED.last_seen)
+	`
+
+	if _, err := db.Exec(query, serviceId, pq.Array(tags), seenAt); err != nil {
+		return fmt.Errorf("failed to upsert technology tags: %w", err)
+	}
+
+	return nil
+}
+
 // ClosePostgres closes the PostgreSQL connection pool
 func ClosePostgres() error {
 	if db != nil {
@@ -0,0 +1,222 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	PreflightPass = "PASS"
+	PreflightFail = "FAIL"
+	PreflightWarn = "WARN"
+	PreflightSkip = "SKIP"
+
+	preflightTimeout = 10 * time.Second
+)
+
+type PreflightResult struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+func preflightResult(name string, err error, hint string) PreflightResult {
+	if err != nil {
+		return PreflightResult{Name: name, Status: PreflightFail, Detail: fmt.Sprintf("%v (%s)", err, hint)}
+	}
+	return PreflightResult{Name: name, Status: PreflightPass}
+}
+
+// RunPreflight checks every dependency the indexer needs before it starts consuming tasks
+func RunPreflight(args *CLIArgs) []PreflightResult {
+	results := checkClickHouse(args)
+	results = append(results, checkPostgres(args)...)
+	results = append(results, checkAWS(args)...)
+	return results
+}
+
+func checkClickHouse(args *CLIArgs) []PreflightResult {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+
+	clickhouseClient, err := NewClickHouseClient(NewClickHouseSettings(args))
+	if err == nil {
+		err = clickhouseClient.conn.Ping(ctx)
+	}
+	connectivity := preflightResult("clickhouse connectivity", err,
+		fmt.Sprintf("check -clickhouse-addr %s and -clickhouse-user/-clickhouse-password", args.ClickHouseAddr))
+	if err != nil {
+		return []PreflightResult{
+			connectivity,
+			{Name: "clickhouse tables", Status: PreflightSkip, Detail: "no connection"},
+		}
+	}
+	defer clickhouseClient.conn.Close()
+
+	results := []PreflightResult{connectivity}
+	for _, table := range preflightTables(args) {
+		var exists uint8
+		err = clickhouseClient.conn.QueryRow(ctx, fmt.Sprintf("EXISTS TABLE %s", table.name)).Scan(&exists)
+		if err == nil && exists == 0 {
+			err = fmt.Errorf("table does not exist")
+		}
+		results = append(results, table.result(fmt.Sprintf("clickhouse table %s", table.name), err,
+			"load the schema from sql/create_ch_schema.sql"))
+		if err != nil {
+			continue
+		}
+
+		name := fmt.Sprintf("clickhouse insert permission on %s", table.name)
+		var granted uint8
+		if err = clickhouseClient.conn.QueryRow(ctx, fmt.Sprintf("CHECK GRANT INSERT ON %s", table.name)).
+			Scan(&granted); err != nil {
+			// CHECK GRANT is not supported by older ClickHouse versions
+			results = append(results, PreflightResult{Name: name, Status: PreflightWarn,
+				Detail: fmt.Sprintf("unable to verify: %v", err)})
+			continue
+		}
+		if granted == 0 {
+			err = fmt.Errorf("INSERT is not granted to %s", args.ClickHouseUser)
+		}
+		results = append(results, table.result(name, err, fmt.Sprintf("GRANT INSERT ON %s", table.name)))
+	}
+	return results
+}
+
+// preflightTable is a table written by the indexer, the tables of the optional features have a disable function
+type preflightTable struct {
+	name string
+	// disabledBy is the flag disabling the feature of an optional table
+	disabledBy string
+	disable    func()
+}
+
+// result fails the check of a required table. The feature of an optional table is disabled instead, the indexer
+// starts without it.
+func (t preflightTable) result(name string, err error, hint string) PreflightResult {
+	if err == nil || t.disable == nil {
+		return preflightResult(name, err, hint)
+	}
+	t.disable()
+	return PreflightResult{Name: name, Status: PreflightWarn,
+		Detail: fmt.Sprintf("%v, disabled until restarted (%s, or set %s)", err, hint, t.disabledBy)}
+}
+
+func preflightTables(args *CLIArgs) []preflightTable {
+	var tables []preflightTable
+	add := func(table string, flag string, disable func()) {
+		if table == "" {
+			return
+		}
+		disabledBy := ""
+		if disable != nil {
+			disabledBy = fmt.Sprintf("-%s=\"\"", flag)
+		}
+		for _, target := range clickHouseTables.Targets(table) {
+			tables = append(tables, preflightTable{name: target, disabledBy: disabledBy, disable: disable})
+		}
+	}
+	add(args.ClickHouseStacksTable, "clickhouse-stacks-table", nil)
+	add(args.ClickHouseMetricsTable, "clickhouse-metrics-table", nil)
+	add(args.ClickHouseSymbolQualityTable, "clickhouse-symbol-quality-table",
+		func() { args.ClickHouseSymbolQualityTable = "" })
+	add(args.ClickHouseAnomaliesTable, "clickhouse-anomalies-table", func() { args.ClickHouseAnomaliesTable = "" })
+	add(args.ClickHouseSidecarsTable, "clickhouse-sidecars-table", func() { args.ClickHouseSidecarsTable = "" })
+	add(args.ClickHouseFrameAgesTable, "clickhouse-frame-ages-table", func() { args.ClickHouseFrameAgesTable = "" })
+	return tables
+}
+
+func checkPostgres(args *CLIArgs) []PreflightResult {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+
+	conn, err := sql.Open("postgres", PostgresConnString(args))
+	if err == nil {
+		defer conn.Close()
+		err = conn.PingContext(ctx)
+	}
+	results := []PreflightResult{preflightResult("postgres connectivity", err,
+		fmt.Sprintf("check -postgres-host %s:%d, -postgres-user and -postgres-password", args.PostgresHost,
+			args.PostgresPort))}
+	if err != nil || !args.ServiceTaggingEnabled {
+		return results
+	}
+
+	var exists bool
+	err = conn.QueryRowContext(ctx, "SELECT to_regclass('servicetechnologytags') IS NOT NULL").Scan(&exists)
+	if err == nil && !exists {
+		err = fmt.Errorf("table does not exist")
+	}
+	tags := preflightTable{name: "ServiceTechnologyTags", disabledBy: "-service-tagging-enabled=false",
+		disable: func() { args.ServiceTaggingEnabled = false }}
+	return append(results, tags.result("postgres table ServiceTechnologyTags", err,
+		"run scripts/setup/postgres/migrations/create_service_technology_tags.sql"))
+}
+
+func checkAWS(args *CLIArgs) []PreflightResult {
+	if args.InputFolder != "" {
+		return []PreflightResult{{Name: "aws sqs/s3", Status: PreflightSkip, Detail: "input folder mode"}}
+	}
+	sessionOptions := session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if args.AWSEndpoint != "" {
+		sessionOptions.Config = aws.Config{
+			Region:           aws.String(args.AWSRegion),
+			Endpoint:         aws.String(args.AWSEndpoint),
+			S3ForcePathStyle: aws.Bool(true),
+		}
+	}
+	sess, err := session.NewSessionWithOptions(sessionOptions)
+	if err != nil {
+		return []PreflightResult{preflightResult("aws session", err, "check AWS credentials and region")}
+	}
+
+	_, err = getQueueURL(sess, args.SQSQueue)
+	results := []PreflightResult{preflightResult(fmt.Sprintf("sqs queue %s", args.SQSQueue), err,
+		"check -sqs-queue and sqs:GetQueueUrl permission")}
+
+	_, err = s3.New(sess).HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(args.S3Bucket)})
+	results = append(results, preflightResult(fmt.Sprintf("s3 bucket %s", args.S3Bucket), err,
+		"check -s3-bucket and s3:ListBucket permission"))
+	return results
+}
+
+// PrintPreflightReport writes a pass/fail line per check and returns false if any check failed
+func PrintPreflightReport(w io.Writer, results []PreflightResult) bool {
+	passed := true
+	for _, result := range results {
+		if result.Status == PreflightFail {
+			passed = false
+		}
+		if result.Detail != "" {
+			fmt.Fprintf(w, "[%s] %s: %s\n", result.Status, result.Name, result.Detail)
+		} else {
+			fmt.Fprintf(w, "[%s] %s\n", result.Status, result.Name)
+		}
+	}
+	return passed
+}
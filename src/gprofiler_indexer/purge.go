@@ -0,0 +1,104 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ServicePurger deletes the profiling data of the archived services once their restore window is over.
+// Services are archived (hidden and blocked from queries) from the webapp, the purge is the only
+// irreversible step. Single node schema only, as the rollup recompute.
+type ServicePurger struct {
+	tables        []string
+	listDue       func() ([]int, error)
+	markPurged    func(serviceId int) error
+	deleteRecords func(ctx context.Context, table string, serviceId int) error
+}
+
+func NewServicePurger(tables []string, listDue func() ([]int, error), markPurged func(serviceId int) error,
+	deleteRecords func(ctx context.Context, table string, serviceId int) error) *ServicePurger {
+	return &ServicePurger{
+		tables:        tables,
+		listDue:       listDue,
+		markPurged:    markPurged,
+		deleteRecords: deleteRecords,
+	}
+}
+
+// PurgeTables returns the ClickHouse tables holding records of a service, the shadow tables included
+func PurgeTables(tableNames *TableNames, args *CLIArgs) []string {
+	tables := make([]string, 0)
+	for _, stacksTable := range tableNames.Targets(args.ClickHouseStacksTable) {
+		suffix := stacksTable[len(args.ClickHouseStacksTable):]
+		tables = append(tables, stacksTable)
+		for _, rollup := range rollupDefinitions {
+			tables = append(tables, rollup.table(args.ClickHouseStacksTable, suffix))
+		}
+	}
+	for _, baseTable := range []string{args.ClickHouseMetricsTable, args.ClickHouseSymbolQualityTable,
+		args.ClickHouseAnomaliesTable, args.ClickHouseSidecarsTable, args.ClickHouseFrameAgesTable,
+		args.ClickHouseStacksPinnedTable, args.ClickHousePinsTable} {
+		if baseTable != "" {
+			tables = append(tables, tableNames.Targets(baseTable)...)
+		}
+	}
+	return tables
+}
+
+func purgeQuery(table string) string {
+	return fmt.Sprintf("ALTER TABLE %s DELETE WHERE ServiceId = ? SETTINGS mutations_sync = 2", table)
+}
+
+// Purge deletes the records of the due services, a service is only marked purged once all its tables
+// are cleared, so a failed purge is retried by the next run
+func (sp *ServicePurger) Purge(ctx context.Context) (int, error) {
+	serviceIds, err := sp.listDue()
+	if err != nil {
+		return 0, err
+	}
+	for idx, serviceId := range serviceIds {
+		for _, table := range sp.tables {
+			if err = sp.deleteRecords(ctx, table, serviceId); err != nil {
+				return idx, fmt.Errorf("unable to purge service %d from %s: %w", serviceId, table, err)
+			}
+		}
+		if err = sp.markPurged(serviceId); err != nil {
+			return idx, err
+		}
+		logger.Infof("profiling data of archived service %d purged", serviceId)
+	}
+	return len(serviceIds), nil
+}
+
+// Run purges the due services every interval until ctx is done
+func (sp *ServicePurger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := sp.Purge(ctx); err != nil {
+			logger.Errorf("purge of archived services failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -24,15 +24,48 @@ import (
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"io/ioutil"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"time"
 )
 
+// Task is a profile file to ingest. Files of tasks with a service are fetched from the S3 bucket,
+// the other ones are read from the local filesystem.
+type Task struct {
+	Filename  string
+	Service   string
+	ServiceId int
+	// Handle identifies the task within its source to acknowledge it, e.g. the SQS receipt handle
+	Handle string
+	// ReceiveCount is the number of times the task was delivered, including this one
+	ReceiveCount int
+	// Retryable is set when the task can be returned to its source on a transient failure, within its retry budget
+	Retryable bool
+	// delivery acknowledges the task once its stacks are written, nil for the tasks acknowledged when parsed
+	delivery *TaskDelivery
+}
+
+// Acknowledger is told the outcome of every task, once processed
+type Acknowledger interface {
+	// Ack reports a task processed successfully
+	Ack(task Task) error
+	// Nack reports a task that failed to be processed, it is not delivered again
+	Nack(task Task) error
+	// Retry reports a retryable task that failed on a transient error, it is delivered again later
+	Retry(task Task) error
+}
+
+// TaskSource produces the tasks processed by the workers
+type TaskSource interface {
+	Acknowledger
+	// Fetch sends the tasks to ch until ctx is done or the source is exhausted
+	Fetch(ctx context.Context, ch chan<- Task)
+}
+
+// SQSMessage is the body of the messages of the SQS queue, as sent by the webapp on every uploaded profile
 type SQSMessage struct {
-	Filename      string `json:"filename"`
-	Service       string `json:"service"`
-	ServiceId     int    `json:"service_id"`
-	MessageHandle string
-	QueueURL      string
+	Filename  string `json:"filename"`
+	Service   string `json:"service"`
+	ServiceId int    `json:"service_id"`
 }
 
 func getQueueURL(sess *session.Session, queue string) (*sqs.GetQueueUrlOutput, error) {
@@ -48,8 +81,28 @@ func getQueueURL(sess *session.Session, queue string) (*sqs.GetQueueUrlOutput, e
 	return urlResult, nil
 }
 
-func ListenSqs(ctx context.Context, args *CLIArgs, ch chan<- SQSMessage, wg *sync.WaitGroup) {
-	defer wg.Done()
+// SQSTaskSource receives the tasks from the SQS queue. The messages of the tasks failed on a transient error are
+// left in the queue, to be received again after a backoff, until they are received retryBudget times. The failed
+// messages are then sent to the dead letter queue, when configured, and deleted.
+type SQSTaskSource struct {
+	sess     *session.Session
+	queue    string
+	queueURL string
+	metrics  MetricsPublisher
+	// retryBudget is the number of receives of a message, 0 disables the retries
+	retryBudget int
+	// retryDelay is the visibility timeout of a message after its first failure, doubled on every receive
+	retryDelay time.Duration
+	// deadLetterQueue receives the failed messages, they are only deleted when empty
+	deadLetterQueue    string
+	deadLetterQueueURL string
+	// visibilityTimeout of the received messages, zero keeps the one of the queue
+	visibilityTimeout time.Duration
+	// backpressure pauses the polling while ClickHouse is unhealthy, when set
+	backpressure *Backpressure
+}
+
+func NewSQSTaskSource(args *CLIArgs, metrics MetricsPublisher) *SQSTaskSource {
 	sessionOptions := session.Options{
 		SharedConfigState: session.SharedConfigEnable,
 	}
@@ -59,16 +112,27 @@ func ListenSqs(ctx context.Context, args *CLIArgs, ch chan<- SQSMessage, wg *syn
 			Endpoint: aws.String(args.AWSEndpoint),
 		}
 	}
-	sess := session.Must(session.NewSessionWithOptions(sessionOptions))
-	svc := sqs.New(sess)
-	urlResult, err := getQueueURL(sess, args.SQSQueue)
+	return &SQSTaskSource{
+		sess:              session.Must(session.NewSessionWithOptions(sessionOptions)),
+		queue:             args.SQSQueue,
+		metrics:           metrics,
+		retryBudget:       args.SQSRetryBudget,
+		retryDelay:        time.Duration(args.SQSRetryDelay) * time.Second,
+		deadLetterQueue:   args.SQSDeadLetterQueue,
+		visibilityTimeout: time.Duration(args.SQSVisibilityTimeout) * time.Second,
+	}
+}
+
+func (s *SQSTaskSource) Fetch(ctx context.Context, ch chan<- Task) {
+	svc := sqs.New(s.sess)
+	urlResult, err := getQueueURL(s.sess, s.queue)
 
 	if err != nil {
 		logger.Errorf("Got an error getting the queue URL: %v", err)
-		
+
 		// SLI Metric: SQS queue URL resolution failure (infrastructure error - counts against SLO)
 		// This tracks connectivity and configuration issues with SQS
-		GetMetricsPublisher().SendSLIMetric(
+		s.metrics.SendSLIMetric(
 			ResponseTypeFailure,
 			"event_processing",
 			map[string]string{
@@ -78,6 +142,16 @@ func ListenSqs(ctx context.Context, args *CLIArgs, ch chan<- SQSMessage, wg *syn
 		)
 		return
 	}
+	s.queueURL = *urlResult.QueueUrl
+	if s.deadLetterQueue != "" {
+		deadLetterResult, err := getQueueURL(s.sess, s.deadLetterQueue)
+		if err != nil {
+			// the failed messages are deleted as if no dead letter queue was configured
+			logger.Errorf("Got an error getting the dead letter queue URL: %v", err)
+		} else {
+			s.deadLetterQueueURL = *deadLetterResult.QueueUrl
+		}
+	}
 
 	for {
 		select {
@@ -85,17 +159,28 @@ func ListenSqs(ctx context.Context, args *CLIArgs, ch chan<- SQSMessage, wg *syn
 			logger.Debug("ListenSQS finished")
 			return
 		default:
-			output, recvErr := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+			// messages are left in the queue while paused
+			s.backpressure.Wait(ctx)
+			if ctx.Err() != nil {
+				continue
+			}
+			input := &sqs.ReceiveMessageInput{
 				QueueUrl:            urlResult.QueueUrl,
 				MaxNumberOfMessages: aws.Int64(1),
 				WaitTimeSeconds:     aws.Int64(10),
-			})
+				AttributeNames:      []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
+			}
+			// the message is deleted once the stacks of its file are written, it must not be received again meanwhile
+			if s.visibilityTimeout > 0 {
+				input.VisibilityTimeout = aws.Int64(int64(s.visibilityTimeout / time.Second))
+			}
+			output, recvErr := svc.ReceiveMessage(input)
 			if recvErr != nil {
 				logger.Error(recvErr)
-				
+
 				// SLI Metric: SQS message receive failure (infrastructure error - counts against SLO)
 				// This tracks SQS polling failures and network issues
-				GetMetricsPublisher().SendSLIMetric(
+				s.metrics.SendSLIMetric(
 					ResponseTypeFailure,
 					"event_processing",
 					map[string]string{
@@ -111,10 +196,10 @@ func ListenSqs(ctx context.Context, args *CLIArgs, ch chan<- SQSMessage, wg *syn
 				parseErr := json.Unmarshal([]byte(*message.Body), &sqsMessage)
 				if parseErr != nil {
 					logger.Errorf("Error while parsing SQS message body: %v", parseErr)
-					
+
 					// SLI Metric: SQS message parse failure (client error - malformed JSON)
 					// This tracks malformed JSON messages in the SQS queue
-					GetMetricsPublisher().SendSLIMetric(
+					s.metrics.SendSLIMetric(
 						ResponseTypeIgnoredFailure, // Client error - doesn't count against SLO
 						"event_processing",
 						map[string]string{
@@ -122,20 +207,16 @@ func ListenSqs(ctx context.Context, args *CLIArgs, ch chan<- SQSMessage, wg *syn
 							"error":   "sqs_message_parse_failed",
 						},
 					)
-					
+
 					// Delete malformed messages to prevent infinite retry loop
 					// This is a permanent client error that won't be fixed by retrying
-					svc := sqs.New(sess)
-					_, deleteErr := svc.DeleteMessage(&sqs.DeleteMessageInput{
-						QueueUrl:      urlResult.QueueUrl,
-						ReceiptHandle: message.ReceiptHandle,
-					})
+					deleteErr := deleteMessage(s.sess, s.queueURL, *message.ReceiptHandle)
 					if deleteErr != nil {
 						logger.Errorf("Failed to delete malformed message: %v", deleteErr)
 
 						// SLI Metric: SQS message deletion failure (infrastructure error - counts against SLO)
 						// This tracks failures to delete malformed messages from the queue
-						GetMetricsPublisher().SendSLIMetric(
+						s.metrics.SendSLIMetric(
 							ResponseTypeFailure,
 							"event_processing",
 							map[string]string{
@@ -148,14 +229,66 @@ func ListenSqs(ctx context.Context, args *CLIArgs, ch chan<- SQSMessage, wg *syn
 					}
 					continue
 				}
-				sqsMessage.QueueURL = *urlResult.QueueUrl
-				sqsMessage.MessageHandle = *message.ReceiptHandle
-				ch <- sqsMessage
+				receiveCount := 1
+				if count, ok := message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]; ok {
+					receiveCount, _ = strconv.Atoi(*count)
+				}
+				ch <- Task{
+					Filename:     sqsMessage.Filename,
+					Service:      sqsMessage.Service,
+					ServiceId:    sqsMessage.ServiceId,
+					Handle:       *message.ReceiptHandle,
+					ReceiveCount: receiveCount,
+					Retryable:    receiveCount < s.retryBudget,
+				}
 			}
 		}
 	}
 }
 
+func (s *SQSTaskSource) Ack(task Task) error {
+	return deleteMessage(s.sess, s.queueURL, task.Handle)
+}
+
+// Nack sends the message to the dead letter queue, when configured, and deletes it
+func (s *SQSTaskSource) Nack(task Task) error {
+	if s.deadLetterQueueURL != "" {
+		body, err := json.Marshal(SQSMessage{Filename: task.Filename, Service: task.Service, ServiceId: task.ServiceId})
+		if err != nil {
+			return err
+		}
+		svc := sqs.New(s.sess)
+		_, err = svc.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    &s.deadLetterQueueURL,
+			MessageBody: aws.String(string(body)),
+		})
+		if err != nil {
+			// the message is kept, it is received again once visible
+			return err
+		}
+		logger.Warnf("File %s of service %s sent to the dead letter queue after %d receive(s)", task.Filename,
+			task.Service, task.ReceiveCount)
+	}
+	return deleteMessage(s.sess, s.queueURL, task.Handle)
+}
+
+// Retry leaves the message in the queue, it is received again once its visibility timeout expires
+func (s *SQSTaskSource) Retry(task Task) error {
+	delay := retryDelay(s.retryDelay, task.ReceiveCount)
+	svc := sqs.New(s.sess)
+	_, err := svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &s.queueURL,
+		ReceiptHandle:     &task.Handle,
+		VisibilityTimeout: aws.Int64(int64(delay / time.Second)),
+	})
+	if err != nil {
+		return err
+	}
+	logger.Infof("File %s of service %s retried in %s (receive %d of %d)", task.Filename, task.Service, delay,
+		task.ReceiveCount, s.retryBudget)
+	return nil
+}
+
 func deleteMessage(sess *session.Session, queueURL string, messageHandle string) error {
 	svc := sqs.New(sess)
 
@@ -170,20 +303,38 @@ func deleteMessage(sess *session.Session, queueURL string, messageHandle string)
 	return nil
 }
 
-func ProcessFolder(ctx context.Context, ch chan<- SQSMessage, inputFolder string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	files, err := ioutil.ReadDir(inputFolder)
+// FolderTaskSource lists the files of a local folder once, acknowledgements are no-ops
+type FolderTaskSource struct {
+	folder string
+}
+
+func NewFolderTaskSource(folder string) *FolderTaskSource {
+	return &FolderTaskSource{folder: folder}
+}
+
+func (f *FolderTaskSource) Fetch(ctx context.Context, ch chan<- Task) {
+	files, err := ioutil.ReadDir(f.folder)
 	if err != nil {
-		logger.Errorf("unable to open directory %s, err: %v", inputFolder, err)
+		logger.Errorf("unable to open directory %s, err: %v", f.folder, err)
 		return
 	}
 	for _, file := range files {
-		message := SQSMessage{
-			Filename:      filepath.Join(inputFolder, file.Name()),
-			ServiceId:     1,
-			QueueURL:      "",
-			MessageHandle: "",
+		select {
+		case <-ctx.Done():
+			return
+		case ch <- Task{Filename: filepath.Join(f.folder, file.Name()), ServiceId: 1}:
 		}
-		ch <- message
 	}
 }
+
+func (f *FolderTaskSource) Ack(task Task) error {
+	return nil
+}
+
+func (f *FolderTaskSource) Nack(task Task) error {
+	return nil
+}
+
+func (f *FolderTaskSource) Retry(task Task) error {
+	return nil
+}
@@ -0,0 +1,231 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	productsPrefix = "products/"
+	// only the adhoc flamegraphs have metadata, the continuous ones are listed from S3 directly
+	adhocFlamegraphSuffix = "_adhoc_flamegraph.html"
+)
+
+// ReconcileReport lists the adhoc flamegraph HTML objects without metadata in PostgreSQL, and the metadata rows
+// whose object is missing
+type ReconcileReport struct {
+	StartedAt        time.Time    `json:"started_at"`
+	FinishedAt       time.Time    `json:"finished_at"`
+	ScannedObjects   int          `json:"scanned_objects"`
+	MetadataRows     int          `json:"metadata_rows"`
+	OrphanedObjects  []ObjectInfo `json:"orphaned_objects"`
+	OrphanedMetadata []string     `json:"orphaned_metadata"`
+	Error            string       `json:"error,omitempty"`
+}
+
+type CleanReport struct {
+	DeletedObjects  int      `json:"deleted_objects"`
+	DeletedMetadata int64    `json:"deleted_metadata"`
+	Errors          []string `json:"errors,omitempty"`
+}
+
+// Reconciler compares the flamegraph objects stored under products/<service>/stacks/flamegraph/ with their
+// metadata. Objects and rows younger than the grace period are skipped, their counterpart may be in flight.
+type Reconciler struct {
+	storage        InventoryStorage
+	listMetadata   func() (map[string]time.Time, error)
+	deleteMetadata func(keys []string) (int64, error)
+	gracePeriod    time.Duration
+	// listContentKeys returns the content addressed object of the deduplicated flamegraphs by metadata key,
+	// when set the content addressed objects are reconciled as well
+	listContentKeys func() (map[string]string, error)
+	mutex           sync.Mutex
+	last            *ReconcileReport
+}
+
+func NewReconciler(storage InventoryStorage, listMetadata func() (map[string]time.Time, error),
+	deleteMetadata func(keys []string) (int64, error), gracePeriod time.Duration) *Reconciler {
+	return &Reconciler{
+		storage:        storage,
+		listMetadata:   listMetadata,
+		deleteMetadata: deleteMetadata,
+		gracePeriod:    gracePeriod,
+	}
+}
+
+func isAdhocFlamegraphKey(key string) bool {
+	return strings.HasSuffix(key, adhocFlamegraphSuffix) && strings.Contains(key, "/stacks/flamegraph/")
+}
+
+func (rc *Reconciler) listFlamegraphObjects() ([]ObjectInfo, error) {
+	services, err := rc.storage.ListPrefixes(productsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]ObjectInfo, 0)
+	for _, service := range services {
+		serviceObjects, err := rc.storage.List(service + "stacks/flamegraph/")
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range serviceObjects {
+			if isAdhocFlamegraphKey(object.Key) || (rc.listContentKeys != nil && isFlamegraphContentKey(object.Key)) {
+				objects = append(objects, object)
+			}
+		}
+	}
+	return objects, nil
+}
+
+// Reconcile scans the objects and the metadata, the report is kept as the last one
+func (rc *Reconciler) Reconcile(now time.Time) ReconcileReport {
+	report := ReconcileReport{
+		StartedAt:        now,
+		OrphanedObjects:  make([]ObjectInfo, 0),
+		OrphanedMetadata: make([]string, 0),
+	}
+	objects, err := rc.listFlamegraphObjects()
+	contentKeys := make(map[string]string)
+	if err == nil && rc.listContentKeys != nil {
+		contentKeys, err = rc.listContentKeys()
+	}
+	if err == nil {
+		var metadata map[string]time.Time
+		if metadata, err = rc.listMetadata(); err == nil {
+			report.ScannedObjects = len(objects)
+			report.MetadataRows = len(metadata)
+			cutoff := now.Add(-rc.gracePeriod)
+			referenced := make(map[string]bool, len(contentKeys))
+			for _, contentKey := range contentKeys {
+				referenced[contentKey] = true
+			}
+			stored := make(map[string]bool, len(objects))
+			for _, object := range objects {
+				stored[object.Key] = true
+				_, ok := metadata[object.Key]
+				if isFlamegraphContentKey(object.Key) {
+					ok = referenced[object.Key]
+				}
+				if !ok && object.LastModified.Before(cutoff) {
+					report.OrphanedObjects = append(report.OrphanedObjects, object)
+				}
+			}
+			for key, createdAt := range metadata {
+				objectKey := key
+				if contentKey, ok := contentKeys[key]; ok {
+					objectKey = contentKey
+				}
+				if !stored[objectKey] && createdAt.Before(cutoff) {
+					report.OrphanedMetadata = append(report.OrphanedMetadata, key)
+				}
+			}
+			sort.Strings(report.OrphanedMetadata)
+		}
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.FinishedAt = time.Now()
+
+	rc.mutex.Lock()
+	rc.last = &report
+	rc.mutex.Unlock()
+	return report
+}
+
+// Clean deletes the orphans found by a fresh scan, objects without metadata and metadata without object
+func (rc *Reconciler) Clean(now time.Time) (CleanReport, ReconcileReport) {
+	clean := CleanReport{}
+	report := rc.Reconcile(now)
+	if report.Error != "" {
+		clean.Errors = append(clean.Errors, report.Error)
+		return clean, report
+	}
+	for _, object := range report.OrphanedObjects {
+		if err := rc.storage.Delete(object.Key); err != nil {
+			clean.Errors = append(clean.Errors, err.Error())
+			continue
+		}
+		clean.DeletedObjects += 1
+	}
+	if len(report.OrphanedMetadata) > 0 {
+		deleted, err := rc.deleteMetadata(report.OrphanedMetadata)
+		if err != nil {
+			clean.Errors = append(clean.Errors, err.Error())
+		}
+		clean.DeletedMetadata = deleted
+	}
+	logger.Infof("orphans cleaned: %d object(s), %d metadata row(s), %d error(s)", clean.DeletedObjects,
+		clean.DeletedMetadata, len(clean.Errors))
+	return clean, report
+}
+
+// Run reconciles every interval until ctx is done, orphans are only reported
+func (rc *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		report := rc.Reconcile(time.Now())
+		if report.Error != "" {
+			logger.Errorf("artifacts reconciliation failed: %s", report.Error)
+		} else if len(report.OrphanedObjects) > 0 || len(report.OrphanedMetadata) > 0 {
+			logger.Warnf("artifacts reconciliation: %d flamegraph object(s) without metadata, %d metadata row(s) "+
+				"without object", len(report.OrphanedObjects), len(report.OrphanedMetadata))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ServeHTTP lists the orphans of the last reconciliation on GET (a fresh one with ?refresh=true). POST is a dry
+// run listing the orphans found by a fresh reconciliation, they are deleted with ?dry_run=false only.
+func (rc *Reconciler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rc.mutex.Lock()
+		last := rc.last
+		rc.mutex.Unlock()
+		if last == nil || r.URL.Query().Get("refresh") == "true" {
+			report := rc.Reconcile(time.Now())
+			last = &report
+		}
+		writeJSON(w, http.StatusOK, last)
+	case http.MethodPost:
+		if r.URL.Query().Get("dry_run") != "false" {
+			report := rc.Reconcile(time.Now())
+			writeJSON(w, http.StatusOK, map[string]interface{}{"dry_run": true, "report": report})
+			return
+		}
+		clean, report := rc.Clean(time.Now())
+		status := http.StatusOK
+		if len(clean.Errors) > 0 {
+			status = http.StatusInternalServerError
+		}
+		writeJSON(w, status, map[string]interface{}{"clean": clean, "report": report})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
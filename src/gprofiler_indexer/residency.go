@@ -0,0 +1,274 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ResidencyRegion binds services to the ClickHouse cluster and S3 bucket their data must stay in.
+// The REST service reads the same residency file to query the right cluster.
+type ResidencyRegion struct {
+	Name           string `json:"name"`
+	ClickHouseAddr string `json:"clickhouse_addr"`
+	// S3Bucket receives the objects derived from the profiles (HTML flamegraphs), empty keeps the default bucket
+	S3Bucket   string `json:"s3_bucket"`
+	ServiceIds []int  `json:"service_ids"`
+}
+
+type residencyFile struct {
+	Regions []ResidencyRegion `json:"regions"`
+}
+
+// ParseResidencyRegions parses and validates the JSON residency file, e.g.
+// {"regions": [{"name": "eu", "clickhouse_addr": "clickhouse-eu:9000", "s3_bucket": "profiles-eu", "service_ids": [12]}]}
+func ParseResidencyRegions(data []byte) ([]ResidencyRegion, error) {
+	var file residencyFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid residency file: %w", err)
+	}
+	names := make(map[string]bool)
+	services := make(map[int]string)
+	for _, region := range file.Regions {
+		if region.Name == "" || region.ClickHouseAddr == "" {
+			return nil, fmt.Errorf("residency regions must have a name and a clickhouse_addr")
+		}
+		if names[region.Name] {
+			return nil, fmt.Errorf("duplicate residency region %s", region.Name)
+		}
+		names[region.Name] = true
+		for _, serviceId := range region.ServiceIds {
+			if other, ok := services[serviceId]; ok {
+				return nil, fmt.Errorf("service %d is bound to both %s and %s", serviceId, other, region.Name)
+			}
+			services[serviceId] = region.Name
+		}
+	}
+	return file.Regions, nil
+}
+
+// ResidencyRouter routes the records and objects of the services bound to a region, the other services
+// are written to the default cluster and bucket. A nil router routes everything to the defaults.
+type ResidencyRouter struct {
+	regions  []ResidencyRegion
+	regionOf map[uint32]string
+	// storages are the storages of the region buckets, by region name
+	storages map[string]BucketStorage
+}
+
+// BucketStorage is a bucket the indexer both writes to and reconciles
+type BucketStorage interface {
+	Storage
+	InventoryStorage
+}
+
+// LoadResidencyRouter returns nil when path is empty
+func LoadResidencyRouter(path string) (*ResidencyRouter, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	regions, err := ParseResidencyRegions(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewResidencyRouter(regions), nil
+}
+
+func NewResidencyRouter(regions []ResidencyRegion) *ResidencyRouter {
+	rr := &ResidencyRouter{
+		regions:  regions,
+		regionOf: make(map[uint32]string),
+		storages: make(map[string]BucketStorage),
+	}
+	for _, region := range regions {
+		for _, serviceId := range region.ServiceIds {
+			rr.regionOf[uint32(serviceId)] = region.Name
+		}
+	}
+	return rr
+}
+
+// Region returns the region of a service, empty for the default one
+func (rr *ResidencyRouter) Region(serviceId uint32) string {
+	if rr == nil {
+		return ""
+	}
+	return rr.regionOf[serviceId]
+}
+
+// SetStorages creates the storages of the regions with a bucket
+func (rr *ResidencyRouter) SetStorages(newStorage func(bucket string) BucketStorage) {
+	if rr == nil {
+		return
+	}
+	for _, region := range rr.regions {
+		if region.S3Bucket != "" {
+			rr.storages[region.Name] = newStorage(region.S3Bucket)
+		}
+	}
+}
+
+// Inventory returns an inventory of the default bucket and of the region buckets
+func (rr *ResidencyRouter) Inventory(source InventoryStorage) InventoryStorage {
+	if rr == nil || len(rr.storages) == 0 {
+		return source
+	}
+	inventory := multiInventory{source}
+	for _, region := range rr.regions {
+		if storage, ok := rr.storages[region.Name]; ok {
+			inventory = append(inventory, storage)
+		}
+	}
+	return inventory
+}
+
+// multiInventory lists the objects of several buckets as a single one, an object is deleted from all of them
+type multiInventory []InventoryStorage
+
+func (mi multiInventory) List(prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	for _, inventory := range mi {
+		bucketObjects, err := inventory.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, bucketObjects...)
+	}
+	return objects, nil
+}
+
+func (mi multiInventory) ListPrefixes(prefix string) ([]string, error) {
+	seen := make(map[string]bool)
+	prefixes := make([]string, 0)
+	for _, inventory := range mi {
+		bucketPrefixes, err := inventory.ListPrefixes(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, bucketPrefix := range bucketPrefixes {
+			if !seen[bucketPrefix] {
+				seen[bucketPrefix] = true
+				prefixes = append(prefixes, bucketPrefix)
+			}
+		}
+	}
+	return prefixes, nil
+}
+
+func (mi multiInventory) Delete(key string) error {
+	for _, inventory := range mi {
+		if err := inventory.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// regionStorage reads the uploaded profiles from the default bucket, where they are uploaded, and writes the
+// objects derived from them to the bucket of the region
+type regionStorage struct {
+	source Storage
+	target Storage
+}
+
+func (rs regionStorage) Get(key string) ([]byte, error) {
+	return rs.source.Get(key)
+}
+
+func (rs regionStorage) Put(key string, data []byte) error {
+	return rs.target.Put(key, data)
+}
+
+func (rs regionStorage) ContentHash(key string) (string, bool, error) {
+	if hashStorage, ok := rs.target.(ContentHashStorage); ok {
+		return hashStorage.ContentHash(key)
+	}
+	return "", false, nil
+}
+
+// Storage returns the storage the objects of a service are written to
+func (rr *ResidencyRouter) Storage(serviceId int, source Storage) Storage {
+	if rr == nil {
+		return source
+	}
+	if target, ok := rr.storages[rr.Region(uint32(serviceId))]; ok {
+		return regionStorage{source: source, target: target}
+	}
+	return source
+}
+
+func recordServiceId(record RecordsAttributesUnpack) uint32 {
+	switch r := record.(type) {
+	case StackRecord:
+		return r.ServiceId
+	case MetricRecord:
+		return r.ServiceId
+	case SymbolQualityRecord:
+		return r.ServiceId
+	case AnomalyRecord:
+		return r.ServiceId
+	case SidecarRecord:
+		return r.ServiceId
+	case FrameAgeRecord:
+		return r.ServiceId
+	}
+	return 0
+}
+
+// Split groups the records by region, the records of the default region are under the empty name
+func (rr *ResidencyRouter) Split(records []RecordsAttributesUnpack) map[string][]RecordsAttributesUnpack {
+	split := make(map[string][]RecordsAttributesUnpack)
+	if rr == nil || len(rr.regionOf) == 0 {
+		split[""] = records
+		return split
+	}
+	for _, record := range records {
+		region := rr.Region(recordServiceId(record))
+		split[region] = append(split[region], record)
+	}
+	return split
+}
+
+// NewClickHouseClients connects to the default cluster, under the empty name, and to the region clusters
+func NewClickHouseClients(args *CLIArgs, rr *ResidencyRouter) (map[string]*ClickHouseClient, error) {
+	clients := make(map[string]*ClickHouseClient)
+	client, err := NewClickHouseClient(NewClickHouseSettings(args))
+	if err != nil {
+		return nil, err
+	}
+	clients[""] = client
+	if rr == nil {
+		return clients, nil
+	}
+	for _, region := range rr.regions {
+		settings := NewClickHouseSettings(args)
+		settings.Addr = region.ClickHouseAddr
+		if clients[region.Name], err = NewClickHouseClient(settings); err != nil {
+			return nil, fmt.Errorf("unable to connect to the clickhouse of region %s: %w", region.Name, err)
+		}
+	}
+	return clients, nil
+}
@@ -0,0 +1,86 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxRetryDelay is the maximum visibility timeout of an SQS message
+const maxRetryDelay = 12 * time.Hour
+
+// PermanentError marks the failures that retrying would not fix, e.g. a malformed file
+type PermanentError struct {
+	Err error
+}
+
+func (pe PermanentError) Error() string {
+	return pe.Err.Error()
+}
+
+func (pe PermanentError) Unwrap() error {
+	return pe.Err
+}
+
+// Permanent marks err as permanent, nil is returned as is
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return PermanentError{Err: err}
+}
+
+// IsTransientError reports whether the task failed with err may succeed when retried. The errors marked permanent
+// and the missing S3 objects and buckets are permanent, the other ones (network, throttling, 5xx) are transient.
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var permanent PermanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() == http.StatusNotFound {
+		return false
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchBucket, "NotFound":
+			return false
+		}
+	}
+	return true
+}
+
+// retryDelay doubles the base delay on every receive of a message, up to maxRetryDelay
+func retryDelay(base time.Duration, receiveCount int) time.Duration {
+	delay := base
+	for attempt := 1; attempt < receiveCount && delay < maxRetryDelay; attempt++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,278 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AnomalyLateArrival is a profile written long after its timestamp, e.g. by an agent that was offline
+const AnomalyLateArrival = "late_arrival"
+
+// rollupDefinition mirrors a materialized view of the stacks table, see sql/create_ch_schema.sql
+type rollupDefinition struct {
+	name       string
+	bucket     string
+	period     time.Duration
+	dimensions []string
+	where      string
+}
+
+var stackAggregates = []string{
+	"any(CallStackName) AS CallStackName",
+	"any(CallStackParent) AS CallStackParent",
+	"sum(NumSamples) AS NumSamples",
+	"sum(ErrNumSamples) AS ErrNumSamples",
+	"anyLast(InsertionTimestamp) AS InsertionTimestamp",
+}
+
+var rollupDefinitions = []rollupDefinition{
+	{name: "1min", bucket: "toStartOfMinute", period: time.Hour, where: "CallStackParent = 0",
+		dimensions: []string{"ServiceId", "InstanceType", "ContainerEnvName", "HostName", "ContainerName",
+			"HostNameHash", "ContainerNameHash", "AppVersion", "Endpoint", "JobName"}},
+	{name: "1hour_all", bucket: "toStartOfHour", period: time.Hour, dimensions: []string{"ServiceId", "CallStackHash"}},
+	{name: "1hour", bucket: "toStartOfHour", period: time.Hour, dimensions: []string{"ServiceId", "InstanceType",
+		"ContainerEnvName", "HostName", "ContainerName", "CallStackHash", "AppVersion", "Endpoint", "JobName"}},
+	{name: "1day_all", bucket: "toStartOfDay", period: 24 * time.Hour,
+		dimensions: []string{"ServiceId", "CallStackHash"}},
+	{name: "1day", bucket: "toStartOfDay", period: 24 * time.Hour, dimensions: []string{"ServiceId", "InstanceType",
+		"ContainerEnvName", "HostName", "ContainerName", "CallStackHash", "AppVersion", "Endpoint", "JobName"}},
+}
+
+func (rd rollupDefinition) table(stacksTable string, suffix string) string {
+	return fmt.Sprintf("%s_%s%s", stacksTable, rd.name, suffix)
+}
+
+func (rd rollupDefinition) aggregates() []string {
+	if rd.name == "1min" {
+		// the minute rollup only counts the samples of the root frames
+		return []string{"sum(NumSamples) AS NumSamples", "sum(ErrNumSamples) AS ErrNumSamples",
+			"anyLast(InsertionTimestamp) AS InsertionTimestamp"}
+	}
+	return stackAggregates
+}
+
+// insertQuery rebuilds the rollup rows of a service between two bucket boundaries from the stacks table
+func (rd rollupDefinition) insertQuery(stacksTable string, suffix string) string {
+	columns := []string{"Timestamp"}
+	selected := []string{fmt.Sprintf("%s(Timestamp) AS Timestamp", rd.bucket)}
+	for _, dimension := range rd.dimensions {
+		columns = append(columns, dimension)
+		selected = append(selected, dimension)
+	}
+	for _, aggregate := range rd.aggregates() {
+		columns = append(columns, aggregate[strings.LastIndex(aggregate, " ")+1:])
+		selected = append(selected, aggregate)
+	}
+	// the boundaries are whole periods, filtering on the bucket (aliased as Timestamp) or on the raw timestamp is the same
+	where := "ServiceId = ? AND Timestamp >= ? AND Timestamp < ?"
+	if rd.where != "" {
+		where += " AND " + rd.where
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s WHERE %s GROUP BY %s",
+		rd.table(stacksTable, suffix), strings.Join(columns, ", "), strings.Join(selected, ", "),
+		stacksTable+suffix, where, strings.Join(append([]string{"Timestamp"}, rd.dimensions...), ", "))
+}
+
+func (rd rollupDefinition) deleteQuery(stacksTable string, suffix string) string {
+	return fmt.Sprintf("ALTER TABLE %s DELETE WHERE ServiceId = ? AND Timestamp >= ? AND Timestamp < ? "+
+		"SETTINGS mutations_sync = 2", rd.table(stacksTable, suffix))
+}
+
+// RollupBucket is an hour of a service that got late profiles, the coarsest rollups are rebuilt for its whole day
+type RollupBucket struct {
+	ServiceId uint32
+	Hour      time.Time
+}
+
+// rollupRange is a time range of a service whose rows are rebuilt in a rollup
+type rollupRange struct {
+	serviceId uint32
+	start     time.Time
+	end       time.Time
+}
+
+// rollupRanges returns the periods (hours or days) of the buckets, contiguous periods are merged so that each
+// range costs a single delete mutation
+func rollupRanges(buckets []RollupBucket, period time.Duration) []rollupRange {
+	sorted := make([]RollupBucket, len(buckets))
+	copy(sorted, buckets)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ServiceId != sorted[j].ServiceId {
+			return sorted[i].ServiceId < sorted[j].ServiceId
+		}
+		return sorted[i].Hour.Before(sorted[j].Hour)
+	})
+	ranges := make([]rollupRange, 0)
+	for _, bucket := range sorted {
+		start := bucket.Hour.UTC().Truncate(period)
+		last := len(ranges) - 1
+		if last >= 0 && ranges[last].serviceId == bucket.ServiceId && !start.After(ranges[last].end) {
+			if end := start.Add(period); end.After(ranges[last].end) {
+				ranges[last].end = end
+			}
+			continue
+		}
+		ranges = append(ranges, rollupRange{serviceId: bucket.ServiceId, start: start, end: start.Add(period)})
+	}
+	return ranges
+}
+
+var ttlDaysRegex = regexp.MustCompile(`TTL\s+\S*Timestamp\S*\s*\+\s*(?:toIntervalDay\((\d+)\)|INTERVAL\s+(\d+)\s+DAY)`)
+
+// ttlRetention returns the retention of a table from its create query, zero when it has no TTL on Timestamp
+func ttlRetention(createQuery string) time.Duration {
+	match := ttlDaysRegex.FindStringSubmatch(createQuery)
+	if match == nil {
+		return 0
+	}
+	days, err := strconv.Atoi(match[1] + match[2])
+	if err != nil {
+		return 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// recomputeStart returns the start of the lookback, clamped to the first day whose stacks are all within the
+// retention: the daily rollups of older days would be rebuilt from partially expired stacks and lose samples
+func recomputeStart(now time.Time, lookback time.Duration, retention time.Duration) time.Time {
+	start := now.Add(-lookback).Truncate(time.Hour)
+	if retention <= 0 {
+		return start
+	}
+	if oldest := now.Add(-retention).Truncate(24 * time.Hour).Add(24 * time.Hour); start.Before(oldest) {
+		return oldest
+	}
+	return start
+}
+
+// stacksRetention reads the TTL of the stacks table
+func stacksRetention(ctx context.Context, client *ClickHouseClient, table string) (time.Duration, error) {
+	database, name := "currentDatabase()", "?"
+	params := []interface{}{table}
+	if idx := strings.Index(table, "."); idx >= 0 {
+		database = "?"
+		params = []interface{}{table[:idx], table[idx+1:]}
+	}
+	var createQuery string
+	err := client.conn.QueryRow(ctx, fmt.Sprintf("SELECT create_table_query FROM system.tables "+
+		"WHERE database = %s AND name = %s", database, name), params...).Scan(&createQuery)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read the retention of %s: %w", table, err)
+	}
+	return ttlRetention(createQuery), nil
+}
+
+// LateArrivalDelay returns the delay of a profile written at now, zero when it is not late
+func LateArrivalDelay(timestamp time.Time, now time.Time, threshold time.Duration) time.Duration {
+	if threshold <= 0 {
+		return 0
+	}
+	delay := now.Sub(timestamp)
+	if delay <= threshold {
+		return 0
+	}
+	return delay.Round(time.Second)
+}
+
+// lateBuckets returns the hours that got late profiles within the lookback, or every hour of the lookback
+// when serviceId is set
+func lateBuckets(ctx context.Context, client *ClickHouseClient, anomaliesTable string, serviceId uint32,
+	start time.Time) ([]RollupBucket, error) {
+	if serviceId != 0 {
+		buckets := make([]RollupBucket, 0)
+		for hour := start.Truncate(time.Hour); hour.Before(time.Now().UTC()); hour = hour.Add(time.Hour) {
+			buckets = append(buckets, RollupBucket{ServiceId: serviceId, Hour: hour})
+		}
+		return buckets, nil
+	}
+	rows, err := client.conn.Query(ctx, fmt.Sprintf("SELECT DISTINCT ServiceId, toStartOfHour(Timestamp) AS Hour "+
+		"FROM %s WHERE Kind = ? AND Timestamp >= ? ORDER BY Hour, ServiceId", anomaliesTable), AnomalyLateArrival, start)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	buckets := make([]RollupBucket, 0)
+	for rows.Next() {
+		var bucket RollupBucket
+		if err = rows.Scan(&bucket.ServiceId, &bucket.Hour); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, rows.Err()
+}
+
+// RecomputeRollups rebuilds the rollups of the late buckets from the stacks table. Rollups are maintained by
+// materialized views, they only drift from the stacks table when a view missed inserts (e.g. detached during
+// a migration), so this is a repair tool. The minute and hourly rollups are rebuilt for the hours with late
+// profiles, the daily ones for their days. Profiles of a bucket written while it is recomputed may be counted
+// twice, buckets should be recomputed once their late profiles stopped arriving. The lookback is clamped to
+// the days fully within the retention of the stacks table. Single node schema only.
+func RecomputeRollups(ctx context.Context, args *CLIArgs) (int, error) {
+	lookback, err := time.ParseDuration(args.RecomputeRollups)
+	if err != nil {
+		return 0, fmt.Errorf("invalid recompute lookback %q: %w", args.RecomputeRollups, err)
+	}
+	if args.RecomputeServiceId == 0 && args.ClickHouseAnomaliesTable == "" {
+		return 0, fmt.Errorf("the late profiles are read from the anomalies table, which is disabled")
+	}
+	clickhouseClient, err := NewClickHouseClient(NewClickHouseSettings(args))
+	if err != nil {
+		return 0, err
+	}
+	defer clickhouseClient.conn.Close()
+
+	suffix := clickHouseTables.Suffixes().Suffix
+	retention, err := stacksRetention(ctx, clickhouseClient, args.ClickHouseStacksTable+suffix)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	start := recomputeStart(now, lookback, retention)
+	if start.After(now.Add(-lookback)) {
+		logger.Warnf("the stacks are kept for %s, only the rollups since %s are recomputed", retention,
+			start.Format(time.RFC3339))
+	}
+	buckets, err := lateBuckets(ctx, clickhouseClient, args.ClickHouseAnomaliesTable+suffix,
+		uint32(args.RecomputeServiceId), start)
+	if err != nil {
+		return 0, err
+	}
+	for _, rollup := range rollupDefinitions {
+		table := rollup.table(args.ClickHouseStacksTable, suffix)
+		for _, rebuilt := range rollupRanges(buckets, rollup.period) {
+			if err = clickhouseClient.conn.Exec(ctx, rollup.deleteQuery(args.ClickHouseStacksTable, suffix),
+				rebuilt.serviceId, rebuilt.start, rebuilt.end); err != nil {
+				return 0, fmt.Errorf("unable to clear %s: %w", table, err)
+			}
+			if err = clickhouseClient.conn.Exec(ctx, rollup.insertQuery(args.ClickHouseStacksTable, suffix),
+				rebuilt.serviceId, rebuilt.start, rebuilt.end); err != nil {
+				return 0, fmt.Errorf("unable to rebuild %s: %w", table, err)
+			}
+			logger.Infof("recomputed %s of service %d from %s to %s", table, rebuilt.serviceId,
+				rebuilt.start.Format(time.RFC3339), rebuilt.end.Format(time.RFC3339))
+		}
+	}
+	return len(buckets), nil
+}
@@ -24,6 +24,7 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -41,7 +42,7 @@ func GetFileFromS3(sess *session.Session, bucketName string, filename string) ([
 	}
 	fileLength := *head.ContentLength
 	if fileLength > MaxS3FileSize {
-		err = fmt.Errorf("file size %s = %d byte(s) > limit %d byte(s)", filename, fileLength, MaxS3FileSize)
+		err = Permanent(fmt.Errorf("file size %s = %d byte(s) > limit %d byte(s)", filename, fileLength, MaxS3FileSize))
 		log.Errorf("%v", err)
 		return nil, err
 	}
@@ -67,6 +68,9 @@ func GetFileFromS3(sess *session.Session, bucketName string, filename string) ([
 	return buff.Bytes(), nil
 }
 
+// contentHashMetadataKey is the user metadata recording the SHA-256 of the uploaded content
+const contentHashMetadataKey = "Content-Sha256"
+
 func PutFileToS3(sess *session.Session, bucketName string, filename string, data []byte) error {
 	var body io.Reader
 	var contentEncoding *string
@@ -80,6 +84,7 @@ func PutFileToS3(sess *session.Session, bucketName string, filename string, data
 		Key:             aws.String(filename),
 		Body:            body,
 		ContentEncoding: contentEncoding,
+		Metadata:        map[string]*string{contentHashMetadataKey: aws.String(contentHash(data))},
 	})
 	if err != nil {
 		log.Errorf("failed to upload file %s to bucket %s: %v", filename, bucketName, err)
@@ -89,3 +94,66 @@ func PutFileToS3(sess *session.Session, bucketName string, filename string, data
 	log.Debugf("successfully uploaded %s to bucket %s", filename, bucketName)
 	return nil
 }
+
+// ListFilesInS3 lists the objects of the bucket under prefix
+func ListFilesInS3(sess *session.Session, bucketName string, prefix string) ([]ObjectInfo, error) {
+	objects := make([]ObjectInfo, 0)
+	err := s3.New(sess).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	return objects, err
+}
+
+// ListPrefixesInS3 lists the "directories" right under prefix, e.g. the services under "products/"
+func ListPrefixesInS3(sess *session.Session, bucketName string, prefix string) ([]string, error) {
+	prefixes := make([]string, 0)
+	err := s3.New(sess).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucketName),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, commonPrefix := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(commonPrefix.Prefix))
+		}
+		return true
+	})
+	return prefixes, err
+}
+
+// HeadFileInS3 returns the content hash recorded at upload, exists is false when the object is missing
+func HeadFileInS3(sess *session.Session, bucketName string, filename string) (string, bool, error) {
+	output, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(filename),
+	})
+	if err != nil {
+		if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == 404 {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	for key, value := range output.Metadata {
+		if strings.EqualFold(key, contentHashMetadataKey) {
+			return aws.StringValue(value), true, nil
+		}
+	}
+	return "", true, nil
+}
+
+func DeleteFileFromS3(sess *session.Session, bucketName string, filename string) error {
+	_, err := s3.New(sess).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(filename),
+	})
+	return err
+}
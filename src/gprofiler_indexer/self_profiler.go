@@ -0,0 +1,199 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// SelfProfiler periodically collects CPU profiles of the indexer itself and writes them
+// as a regular service, so the indexer hot paths can be inspected in the performance studio
+type SelfProfiler struct {
+	serviceId uint32
+	hostname  string
+	interval  time.Duration
+	duration  time.Duration
+	pw        *ProfilesWriter
+}
+
+func NewSelfProfiler(args *CLIArgs, serviceId int, pw *ProfilesWriter) *SelfProfiler {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = AppName
+	}
+	duration := time.Duration(args.SelfProfilingDuration) * time.Second
+	interval := time.Duration(args.SelfProfilingInterval) * time.Second
+	if duration > interval {
+		duration = interval
+	}
+	return &SelfProfiler{
+		serviceId: uint32(serviceId),
+		hostname:  hostname,
+		interval:  interval,
+		duration:  duration,
+		pw:        pw,
+	}
+}
+
+func (sp *SelfProfiler) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(sp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sp.collect(ctx); err != nil {
+				logger.Warnf("self profiling failed: %v", err)
+			}
+		}
+	}
+}
+
+func (sp *SelfProfiler) collect(ctx context.Context) error {
+	var buf bytes.Buffer
+	timestamp := time.Now().UTC()
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(sp.duration):
+	}
+	pprof.StopCPUProfile()
+
+	prof, err := profile.Parse(&buf)
+	if err != nil {
+		return err
+	}
+	nStacks := sp.pw.writePprof(prof, AppName, sp.serviceId, sp.hostname, timestamp)
+	logger.Debugf("self profiling: wrote %d stack(s)", nStacks)
+	return nil
+}
+
+// writePprof writes the samples of a pprof profile like the stacks of a profile file, returns the number of stacks
+func (pw *ProfilesWriter) writePprof(prof *profile.Profile, rootFrame string, serviceId uint32, hostname string,
+	timestamp time.Time) int {
+	weights := make(FrameValuesMap)
+	frames := make(map[string]Frame)
+	nStacks := AddPprofStacks(prof, rootFrame, StackKey{}, weights, frames)
+	if nStacks == 0 {
+		return 0
+	}
+	pw.chMutex.Lock()
+	defer pw.chMutex.Unlock()
+	pw.writeStacks(weights, frames, serviceId, "", pw.hostNames.Encrypt(hostname), timestamp, nil, nil)
+	return nStacks
+}
+
+// servePprof writes a CPU profile posted in the pprof format by another component of the performance studio
+// (e.g. the self profiles of the REST service) under the service of the given name, created if needed
+func (ih *IngestHandler) servePprof(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	serviceName := query.Get("service")
+	hostname := query.Get("hostname")
+	if serviceName == "" || hostname == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "service and hostname are required"})
+		return
+	}
+	rootFrame := query.Get("process")
+	if rootFrame == "" {
+		rootFrame = serviceName
+	}
+	timestamp := time.Now().UTC()
+	if raw := query.Get("timestamp"); raw != "" {
+		seconds, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid timestamp " + raw})
+			return
+		}
+		timestamp = time.Unix(seconds, 0).UTC()
+	}
+	// pprof profiles are usually gzipped, they are decompressed here rather than by profile.Parse, which does
+	// not bound the decompressed size
+	data, err := io.ReadAll(r.Body)
+	if err == nil && len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		var gzipReader io.ReadCloser
+		if gzipReader, err = ih.decompressed(bytes.NewReader(data)); err == nil {
+			data, err = io.ReadAll(gzipReader)
+			gzipReader.Close()
+		}
+	}
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	prof, err := profile.ParseData(data)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	serviceId, err := ih.serviceId(serviceName)
+	if err != nil {
+		logger.Errorf("unable to get the id of service %s: %v", serviceName, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to get the service id"})
+		return
+	}
+	nStacks := ih.profiles.writePprof(prof, rootFrame, serviceId, hostname, timestamp)
+	writeJSON(w, http.StatusOK, map[string]int{"stacks": nStacks})
+}
+
+// AddPprofStacks converts pprof samples to root-first stacks (prefixed with rootFrame, like the
+// process frame of gProfiler stacks) and accumulates them into weights, returns the number of stacks
+func AddPprofStacks(prof *profile.Profile, rootFrame string, key StackKey, weights FrameValuesMap,
+	frames map[string]Frame) int {
+	valueIdx := 0
+	for idx, sampleType := range prof.SampleType {
+		if sampleType.Type == "samples" {
+			valueIdx = idx
+			break
+		}
+	}
+	nStacks := 0
+	for _, sample := range prof.Sample {
+		if valueIdx >= len(sample.Value) || sample.Value[valueIdx] <= 0 {
+			continue
+		}
+		stack := []string{rootFrame}
+		for locIdx := len(sample.Location) - 1; locIdx >= 0; locIdx-- {
+			lines := sample.Location[locIdx].Line
+			// inlined functions come first in the location lines
+			for lineIdx := len(lines) - 1; lineIdx >= 0; lineIdx-- {
+				if lines[lineIdx].Function != nil {
+					stack = append(stack, lines[lineIdx].Function.Name)
+				}
+			}
+		}
+		if len(stack) == 1 {
+			continue
+		}
+		processStack(stack, int(sample.Value[valueIdx]), key, weights, frames)
+		nStacks += 1
+	}
+	return nStacks
+}
@@ -0,0 +1,131 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TechnologySignature tags a service when any of its frame names contains one of the patterns
+type TechnologySignature struct {
+	Tag      string
+	Patterns []string
+}
+
+// Java frames may come with either "/" or "." package separators depending on the profiler
+var technologySignatures = []TechnologySignature{
+	{Tag: "kafka-client", Patterns: []string{"org/apache/kafka/clients", "org.apache.kafka.clients", "rd_kafka_",
+		"confluent_kafka", "segmentio/kafka-go", "IBM/sarama", "Shopify/sarama"}},
+	{Tag: "grpc", Patterns: []string{"io/grpc/", "io.grpc.", "grpc::", "grpc_core::", "google.golang.org/grpc",
+		"grpc._cython"}},
+	{Tag: "rocksdb", Patterns: []string{"rocksdb::", "org/rocksdb/", "org.rocksdb.", "librocksdb"}},
+	{Tag: "openssl", Patterns: []string{"libssl.so", "libcrypto.so", "SSL_read", "SSL_write", "SSL_do_handshake"}},
+	{Tag: "netty", Patterns: []string{"io/netty/", "io.netty."}},
+	{Tag: "protobuf", Patterns: []string{"google::protobuf::", "com/google/protobuf/", "com.google.protobuf.",
+		"google.golang.org/protobuf", "google/protobuf/"}},
+	{Tag: "thrift", Patterns: []string{"org/apache/thrift/", "org.apache.thrift.", "apache::thrift::"}},
+	{Tag: "zstd", Patterns: []string{"ZSTD_", "libzstd", "klauspost/compress/zstd"}},
+	{Tag: "jemalloc", Patterns: []string{"libjemalloc", "je_malloc", "je_free"}},
+	{Tag: "tcmalloc", Patterns: []string{"tcmalloc::", "libtcmalloc"}},
+	{Tag: "spark", Patterns: []string{"org/apache/spark/", "org.apache.spark."}},
+	{Tag: "flink", Patterns: []string{"org/apache/flink/", "org.apache.flink."}},
+}
+
+// DetectTechnologies returns the sorted tags whose signatures match any of the frames
+func DetectTechnologies(frames map[string]Frame) []string {
+	detected := make(map[string]bool)
+	for _, frame := range frames {
+		for _, signature := range technologySignatures {
+			if detected[signature.Tag] {
+				continue
+			}
+			for _, pattern := range signature.Patterns {
+				if strings.Contains(frame.Name, pattern) {
+					detected[signature.Tag] = true
+					break
+				}
+			}
+		}
+		if len(detected) == len(technologySignatures) {
+			break
+		}
+	}
+	tags := make([]string, 0, len(detected))
+	for tag := range detected {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+type serviceTagKey struct {
+	serviceId int
+	tag       string
+}
+
+// ServiceTagger stores the detected technologies in PostgreSQL, a tag of a service is written
+// at most once per refresh interval so that busy services do not hit the database on every file
+type ServiceTagger struct {
+	mutex           sync.Mutex
+	refreshInterval time.Duration
+	lastStored      map[serviceTagKey]time.Time
+}
+
+func NewServiceTagger(refreshInterval time.Duration) *ServiceTagger {
+	return &ServiceTagger{
+		refreshInterval: refreshInterval,
+		lastStored:      make(map[serviceTagKey]time.Time),
+	}
+}
+
+// dueTags returns the tags that were not stored within the refresh interval and marks them as stored
+func (st *ServiceTagger) dueTags(serviceId int, tags []string, now time.Time) []string {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	due := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		key := serviceTagKey{serviceId: serviceId, tag: tag}
+		if last, ok := st.lastStored[key]; ok && now.Sub(last) < st.refreshInterval {
+			continue
+		}
+		st.lastStored[key] = now
+		due = append(due, tag)
+	}
+	return due
+}
+
+func (st *ServiceTagger) TagService(serviceId int, frames map[string]Frame) {
+	now := time.Now().UTC()
+	tags := st.dueTags(serviceId, DetectTechnologies(frames), now)
+	if len(tags) == 0 {
+		return
+	}
+	if err := UpsertServiceTechnologyTags(serviceId, tags, now); err != nil {
+		logger.Errorf("failed to store technology tags of service %d: %v", serviceId, err)
+		// retry with the next file
+		st.mutex.Lock()
+		for _, tag := range tags {
+			delete(st.lastStored, serviceTagKey{serviceId: serviceId, tag: tag})
+		}
+		st.mutex.Unlock()
+		return
+	}
+	logger.Debugf("service %d tagged with %v", serviceId, tags)
+}
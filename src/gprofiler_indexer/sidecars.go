@@ -0,0 +1,110 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSidecarPatterns match the service mesh proxies and log shippers commonly injected next to the services
+const DefaultSidecarPatterns = "envoy,istio-proxy,linkerd-proxy,fluentd,fluent-bit,filebeat,promtail," +
+	"datadog-agent,otel-collector"
+
+// sidecarRefreshInterval is the interval a sidecar container is recorded again, to keep it in the TTL of the table
+const sidecarRefreshInterval = time.Hour
+
+type SidecarRecord struct {
+	Timestamp     time.Time
+	ServiceId     uint32
+	ContainerName string
+}
+
+func (sr SidecarRecord) getDbAttributes() []interface{} {
+	dbAttributes := []interface{}{
+		sr.Timestamp,
+		sr.ServiceId,
+		sr.ContainerName,
+	}
+	return dbAttributes
+}
+
+type sidecarKey struct {
+	serviceId     uint32
+	containerName string
+}
+
+// SidecarClassifier flags the containers whose name contains one of the sidecar patterns. A sidecar of
+// a service is recorded at most once per refresh interval so that busy services do not flood the table.
+type SidecarClassifier struct {
+	patterns        []string
+	refreshInterval time.Duration
+	mutex           sync.Mutex
+	lastStored      map[sidecarKey]time.Time
+}
+
+// NewSidecarClassifier returns nil when there is no pattern
+func NewSidecarClassifier(patterns string, refreshInterval time.Duration) *SidecarClassifier {
+	parsed := make([]string, 0)
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			parsed = append(parsed, pattern)
+		}
+	}
+	if len(parsed) == 0 {
+		return nil
+	}
+	return &SidecarClassifier{
+		patterns:        parsed,
+		refreshInterval: refreshInterval,
+		lastStored:      make(map[sidecarKey]time.Time),
+	}
+}
+
+// IsSidecar matches the container name, which holds the pod and namespace names of the Kubernetes containers
+// ("istio-proxy_pod_namespace")
+func (sc *SidecarClassifier) IsSidecar(containerName string) bool {
+	containerName = strings.ToLower(containerName)
+	for _, pattern := range sc.patterns {
+		if strings.Contains(containerName, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Records returns the sidecars among the containers that were not recorded within the refresh interval,
+// and marks them as recorded
+func (sc *SidecarClassifier) Records(serviceId uint32, containerNames []string, timestamp time.Time,
+	now time.Time) []SidecarRecord {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	records := make([]SidecarRecord, 0)
+	for _, containerName := range containerNames {
+		if containerName == "" || !sc.IsSidecar(containerName) {
+			continue
+		}
+		key := sidecarKey{serviceId: serviceId, containerName: containerName}
+		if last, ok := sc.lastStored[key]; ok && now.Sub(last) < sc.refreshInterval {
+			continue
+		}
+		sc.lastStored[key] = now
+		records = append(records, SidecarRecord{Timestamp: timestamp, ServiceId: serviceId, ContainerName: containerName})
+	}
+	return records
+}
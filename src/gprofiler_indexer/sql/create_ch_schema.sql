@@ -35,7 +35,10 @@ CREATE TABLE IF NOT EXISTS flamedb.samples
     CallStackName      String CODEC (ZSTD),
     CallStackParent    UInt64,
     InsertionTimestamp DateTime('UTC') CODEC (DoubleDelta),
-    ErrNumSamples      UInt32
+    ErrNumSamples      UInt32,
+    AppVersion         LowCardinality(String),
+    Endpoint           LowCardinality(String),
+    JobName            LowCardinality(String)
 ) engine = MergeTree() PARTITION BY toYYYYMMDD(Timestamp)
       ORDER BY (ServiceId, InstanceType, ContainerEnvName, HostNameHash, ContainerNameHash, Timestamp);
 
@@ -53,6 +56,94 @@ CREATE TABLE IF NOT EXISTS flamedb.metrics
 ) engine = MergeTree() PARTITION BY toYYYYMMDD(Timestamp)
       ORDER BY (ServiceId, InstanceType, HostNameHash, Timestamp);
 
+-- create raw table symbol_quality local
+CREATE TABLE IF NOT EXISTS flamedb.symbol_quality
+(
+    Timestamp             DateTime('UTC') CODEC (DoubleDelta),
+    ServiceId             UInt32,
+    HostName              LowCardinality(String),
+    TotalFrames           UInt32,
+    UnknownFrames         UInt32,
+    AddressOnlyFrames     UInt32,
+    TotalSamples          UInt64,
+    UnresolvedLeafSamples UInt64,
+    TruncatedSamples      UInt64
+) engine = MergeTree() PARTITION BY toYYYYMMDD(Timestamp)
+      ORDER BY (ServiceId, Timestamp)
+      TTL Timestamp + INTERVAL 90 DAY;
+
+-- create raw table anomalies local
+CREATE TABLE IF NOT EXISTS flamedb.anomalies
+(
+    Timestamp     DateTime('UTC') CODEC (DoubleDelta),
+    ServiceId     UInt32,
+    HostName      LowCardinality(String),
+    ContainerName LowCardinality(String),
+    Kind          LowCardinality(String),
+    Count         UInt32,
+    Example       String
+) engine = MergeTree() PARTITION BY toYYYYMMDD(Timestamp)
+      ORDER BY (ServiceId, Kind, Timestamp)
+      TTL Timestamp + INTERVAL 90 DAY;
+
+-- create raw table samples_pinned local, the raw stacks of the pinned time windows are copied to it by
+-- the REST admin pins endpoint, it has no TTL
+CREATE TABLE IF NOT EXISTS flamedb.samples_pinned
+(
+    Timestamp          DateTime('UTC') CODEC (DoubleDelta),
+    ServiceId          UInt32,
+    InstanceType       LowCardinality(String),
+    ContainerEnvName   LowCardinality(String),
+    HostName           LowCardinality(String),
+    ContainerName      LowCardinality(String),
+    NumSamples         UInt32 CODEC (DoubleDelta),
+    CallStackHash      UInt64,
+    HostNameHash       UInt32 MATERIALIZED xxHash32(HostName),
+    ContainerNameHash  UInt32 MATERIALIZED xxHash32(ContainerName),
+    CallStackName      String CODEC (ZSTD),
+    CallStackParent    UInt64,
+    InsertionTimestamp DateTime('UTC') CODEC (DoubleDelta),
+    ErrNumSamples      UInt32,
+    AppVersion         LowCardinality(String),
+    Endpoint           LowCardinality(String),
+    JobName            LowCardinality(String)
+) engine = MergeTree() PARTITION BY toYYYYMMDD(Timestamp)
+      ORDER BY (ServiceId, InstanceType, ContainerEnvName, HostNameHash, ContainerNameHash, Timestamp);
+
+-- create raw table pins local
+CREATE TABLE IF NOT EXISTS flamedb.pins
+(
+    ServiceId UInt32,
+    StartTime DateTime('UTC'),
+    EndTime   DateTime('UTC'),
+    Reason    String,
+    CreatedBy LowCardinality(String),
+    CreatedAt DateTime('UTC')
+) engine = MergeTree()
+      ORDER BY (ServiceId, StartTime);
+
+-- create raw table sidecar_containers local, the containers classified as sidecars by the indexer
+CREATE TABLE IF NOT EXISTS flamedb.sidecar_containers
+(
+    Timestamp     DateTime('UTC') CODEC (DoubleDelta),
+    ServiceId     UInt32,
+    ContainerName LowCardinality(String)
+) engine = ReplacingMergeTree(Timestamp)
+      ORDER BY (ServiceId, ContainerName)
+      TTL Timestamp + INTERVAL 90 DAY;
+
+-- create table frame_ages, the first and last time every frame of a service is seen, written by the indexer
+CREATE TABLE IF NOT EXISTS flamedb.frame_ages
+(
+    ServiceId       UInt32,
+    CallStackHash   UInt64,
+    CallStackName   SimpleAggregateFunction(any, String) CODEC (ZSTD),
+    CallStackParent SimpleAggregateFunction(any, UInt64),
+    FirstSeen       SimpleAggregateFunction(min, DateTime('UTC')),
+    LastSeen        SimpleAggregateFunction(max, DateTime('UTC'))
+) engine = AggregatingMergeTree()
+      ORDER BY (ServiceId, CallStackHash);
+
 
 -- create 60min aggregated table all hostnames and all containers
 CREATE TABLE IF NOT EXISTS flamedb.samples_1hour_all
@@ -100,10 +191,13 @@ CREATE TABLE IF NOT EXISTS flamedb.samples_1hour
     InsertionTimestamp DateTime('UTC') CODEC(DoubleDelta),
     NumSamples UInt64 CODEC(DoubleDelta),
     ErrNumSamples      UInt32,
+    AppVersion        LowCardinality(String),
+    Endpoint          LowCardinality(String),
+    JobName           LowCardinality(String)
 ) ENGINE = SummingMergeTree((NumSamples))
         PARTITION BY toYYYYMMDD(Timestamp)
         ORDER BY (ServiceId, ContainerEnvName, InstanceType, HostName, ContainerName,
-        Timestamp, CallStackHash, CallStackParent);
+        Timestamp, CallStackHash, CallStackParent, AppVersion, Endpoint, JobName);
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS
     flamedb.samples_1hour_mv TO flamedb.samples_1hour
@@ -119,10 +213,13 @@ SELECT toStartOfHour(Timestamp)    AS Timestamp,
        any(CallStackParent)        as CallStackParent,
        sum(NumSamples)             AS NumSamples,
        sum(ErrNumSamples)          AS ErrNumSamples,
-       anyLast(InsertionTimestamp) as InsertionTimestamp
+       anyLast(InsertionTimestamp) as InsertionTimestamp,
+       AppVersion,
+       Endpoint,
+       JobName
 FROM flamedb.samples
 GROUP BY ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName,
-         CallStackHash, Timestamp;
+         CallStackHash, Timestamp, AppVersion, Endpoint, JobName;
 
 
 -- create distributed 24h table all hostnames and all containers
@@ -170,11 +267,14 @@ CREATE TABLE IF NOT EXISTS flamedb.samples_1day
     CallStackParent   UInt64,
     InsertionTimestamp DateTime('UTC') CODEC(DoubleDelta),
     NumSamples UInt64 CODEC(DoubleDelta),
-    ErrNumSamples      UInt32
+    ErrNumSamples      UInt32,
+    AppVersion        LowCardinality(String),
+    Endpoint          LowCardinality(String),
+    JobName           LowCardinality(String)
 ) ENGINE = SummingMergeTree((NumSamples))
     PARTITION BY toYYYYMMDD(Timestamp)
     ORDER BY (ServiceId, ContainerEnvName, InstanceType, HostName, ContainerName,
-    Timestamp, CallStackHash, CallStackParent);
+    Timestamp, CallStackHash, CallStackParent, AppVersion, Endpoint, JobName);
 
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS
@@ -191,10 +291,13 @@ SELECT toStartOfDay(Timestamp)     AS Timestamp,
        any(CallStackParent)        as CallStackParent,
        sum(NumSamples)             AS NumSamples,
        sum(ErrNumSamples)          AS ErrNumSamples,
-       anyLast(InsertionTimestamp) as InsertionTimestamp
+       anyLast(InsertionTimestamp) as InsertionTimestamp,
+       AppVersion,
+       Endpoint,
+       JobName
 FROM flamedb.samples
 GROUP BY ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName,
-         CallStackHash, Timestamp;
+         CallStackHash, Timestamp, AppVersion, Endpoint, JobName;
 
 
 -- create local table
@@ -209,10 +312,14 @@ CREATE TABLE IF NOT EXISTS flamedb.samples_1min (
     ErrNumSamples UInt64,
     HostNameHash UInt32,
     ContainerNameHash UInt32,
-    InsertionTimestamp DateTime('UTC') CODEC(DoubleDelta)
+    InsertionTimestamp DateTime('UTC') CODEC(DoubleDelta),
+    AppVersion LowCardinality(String),
+    Endpoint LowCardinality(String),
+    JobName LowCardinality(String)
 ) ENGINE = SummingMergeTree((NumSamples))
       PARTITION BY toYYYYMMDD(Timestamp)
-      ORDER BY (ServiceId, ContainerEnvName, InstanceType, ContainerNameHash, HostNameHash, Timestamp);
+      ORDER BY (ServiceId, ContainerEnvName, InstanceType, ContainerNameHash, HostNameHash, Timestamp,
+                AppVersion, Endpoint, JobName);
 
 -- create mv
 CREATE MATERIALIZED VIEW IF NOT EXISTS flamedb.samples_1min_mv TO
@@ -228,9 +335,13 @@ AS SELECT toStartOfMinute(Timestamp) AS
           sum(ErrNumSamples) AS ErrNumSamples,
           HostNameHash,
           ContainerNameHash,
-          anyLast(InsertionTimestamp) as InsertionTimestamp
+          anyLast(InsertionTimestamp) as InsertionTimestamp,
+          AppVersion,
+          Endpoint,
+          JobName
    FROM flamedb.samples WHERE CallStackParent = 0
-   GROUP BY ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName, HostNameHash, ContainerNameHash, Timestamp;
+   GROUP BY ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName, HostNameHash, ContainerNameHash, Timestamp,
+            AppVersion, Endpoint, JobName;
 
 ALTER TABLE flamedb.samples
     MODIFY TTL "Timestamp" + INTERVAL 30 DAY;
@@ -36,7 +36,10 @@ CREATE TABLE IF NOT EXISTS flamedb.samples_local ON CLUSTER '{cluster}'
     CallStackName     String CODEC (ZSTD),
     CallStackParent   UInt64,
     InsertionTimestamp DateTime CODEC(DoubleDelta),
-    ErrNumSamples      UInt32
+    ErrNumSamples      UInt32,
+    AppVersion         LowCardinality(String),
+    Endpoint           LowCardinality(String),
+    JobName            LowCardinality(String)
     ) engine = ReplicatedMergeTree('/clickhouse/{installation}/{cluster}/tables/{shard}/{database}/{table}',
                                    '{replica}') PARTITION BY toYYYYMMDD(Timestamp)
     ORDER BY (ServiceId, InstanceType, ContainerEnvName, HostNameHash, ContainerNameHash, Timestamp);
@@ -70,6 +73,136 @@ CREATE TABLE IF NOT EXISTS
     flamedb.metrics_local
     ENGINE = Distributed('{cluster}', flamedb, metrics_local, ServiceId);
 
+-- create raw table symbol_quality local
+CREATE TABLE IF NOT EXISTS flamedb.symbol_quality_local ON CLUSTER '{cluster}'
+(
+    Timestamp             DateTime CODEC (DoubleDelta),
+    ServiceId             UInt32,
+    HostName              LowCardinality(String),
+    TotalFrames           UInt32,
+    UnknownFrames         UInt32,
+    AddressOnlyFrames     UInt32,
+    TotalSamples          UInt64,
+    UnresolvedLeafSamples UInt64,
+    TruncatedSamples      UInt64
+    ) engine = ReplicatedMergeTree('/clickhouse/{installation}/{cluster}/tables/{shard}/{database}/{table}',
+                                   '{replica}') PARTITION BY toYYYYMMDD(Timestamp)
+    ORDER BY (ServiceId, Timestamp)
+    TTL Timestamp + INTERVAL 90 DAY;
+
+CREATE TABLE IF NOT EXISTS
+    flamedb.symbol_quality
+    ON CLUSTER '{cluster}' AS
+    flamedb.symbol_quality_local
+    ENGINE = Distributed('{cluster}', flamedb, symbol_quality_local, ServiceId);
+
+-- create raw table anomalies local
+CREATE TABLE IF NOT EXISTS flamedb.anomalies_local ON CLUSTER '{cluster}'
+(
+    Timestamp     DateTime CODEC (DoubleDelta),
+    ServiceId     UInt32,
+    HostName      LowCardinality(String),
+    ContainerName LowCardinality(String),
+    Kind          LowCardinality(String),
+    Count         UInt32,
+    Example       String
+    ) engine = ReplicatedMergeTree('/clickhouse/{installation}/{cluster}/tables/{shard}/{database}/{table}',
+                                   '{replica}') PARTITION BY toYYYYMMDD(Timestamp)
+    ORDER BY (ServiceId, Kind, Timestamp)
+    TTL Timestamp + INTERVAL 90 DAY;
+
+CREATE TABLE IF NOT EXISTS
+    flamedb.anomalies
+    ON CLUSTER '{cluster}' AS
+    flamedb.anomalies_local
+    ENGINE = Distributed('{cluster}', flamedb, anomalies_local, ServiceId);
+
+-- create raw table samples_pinned local, the raw stacks of the pinned time windows are copied to it by
+-- the REST admin pins endpoint, it has no TTL
+CREATE TABLE IF NOT EXISTS flamedb.samples_pinned_local ON CLUSTER '{cluster}'
+(
+    Timestamp          DateTime CODEC (DoubleDelta),
+    ServiceId          UInt32,
+    InstanceType       LowCardinality(String),
+    ContainerEnvName   LowCardinality(String),
+    HostName           LowCardinality(String),
+    ContainerName      LowCardinality(String),
+    NumSamples         UInt32 CODEC (DoubleDelta),
+    CallStackHash      UInt64,
+    HostNameHash       UInt32 MATERIALIZED xxHash32(HostName),
+    ContainerNameHash  UInt32 MATERIALIZED xxHash32(ContainerName),
+    CallStackName      String CODEC (ZSTD),
+    CallStackParent    UInt64,
+    InsertionTimestamp DateTime CODEC (DoubleDelta),
+    ErrNumSamples      UInt32,
+    AppVersion         LowCardinality(String),
+    Endpoint           LowCardinality(String),
+    JobName            LowCardinality(String)
+    ) engine = ReplicatedMergeTree('/clickhouse/{installation}/{cluster}/tables/{shard}/{database}/{table}',
+                                   '{replica}') PARTITION BY toYYYYMMDD(Timestamp)
+    ORDER BY (ServiceId, InstanceType, ContainerEnvName, HostNameHash, ContainerNameHash, Timestamp);
+
+CREATE TABLE IF NOT EXISTS
+    flamedb.samples_pinned
+    ON CLUSTER '{cluster}' AS
+    flamedb.samples_pinned_local
+    ENGINE = Distributed('{cluster}', flamedb, samples_pinned_local, CallStackHash);
+
+-- create raw table pins local
+CREATE TABLE IF NOT EXISTS flamedb.pins_local ON CLUSTER '{cluster}'
+(
+    ServiceId UInt32,
+    StartTime DateTime,
+    EndTime   DateTime,
+    Reason    String,
+    CreatedBy LowCardinality(String),
+    CreatedAt DateTime
+    ) engine = ReplicatedMergeTree('/clickhouse/{installation}/{cluster}/tables/{shard}/{database}/{table}',
+                                   '{replica}')
+    ORDER BY (ServiceId, StartTime);
+
+CREATE TABLE IF NOT EXISTS
+    flamedb.pins
+    ON CLUSTER '{cluster}' AS
+    flamedb.pins_local
+    ENGINE = Distributed('{cluster}', flamedb, pins_local, ServiceId);
+
+-- create raw table sidecar_containers local, the containers classified as sidecars by the indexer
+CREATE TABLE IF NOT EXISTS flamedb.sidecar_containers_local ON CLUSTER '{cluster}'
+(
+    Timestamp     DateTime CODEC (DoubleDelta),
+    ServiceId     UInt32,
+    ContainerName LowCardinality(String)
+    ) engine = ReplicatedReplacingMergeTree('/clickhouse/{installation}/{cluster}/tables/{shard}/{database}/{table}',
+                                            '{replica}', Timestamp)
+    ORDER BY (ServiceId, ContainerName)
+    TTL Timestamp + INTERVAL 90 DAY;
+
+CREATE TABLE IF NOT EXISTS
+    flamedb.sidecar_containers
+    ON CLUSTER '{cluster}' AS
+    flamedb.sidecar_containers_local
+    ENGINE = Distributed('{cluster}', flamedb, sidecar_containers_local, ServiceId);
+
+-- create table frame_ages local, the first and last time every frame of a service is seen, written by the indexer
+CREATE TABLE IF NOT EXISTS flamedb.frame_ages_local ON CLUSTER '{cluster}'
+(
+    ServiceId       UInt32,
+    CallStackHash   UInt64,
+    CallStackName   SimpleAggregateFunction(any, String) CODEC (ZSTD),
+    CallStackParent SimpleAggregateFunction(any, UInt64),
+    FirstSeen       SimpleAggregateFunction(min, DateTime),
+    LastSeen        SimpleAggregateFunction(max, DateTime)
+    ) engine = ReplicatedAggregatingMergeTree('/clickhouse/{installation}/{cluster}/tables/{shard}/{database}/{table}',
+                                              '{replica}')
+    ORDER BY (ServiceId, CallStackHash);
+
+CREATE TABLE IF NOT EXISTS
+    flamedb.frame_ages
+    ON CLUSTER '{cluster}' AS
+    flamedb.frame_ages_local
+    ENGINE = Distributed('{cluster}', flamedb, frame_ages_local, ServiceId);
+
 
 
 -- 1) create 1hour aggregated table all hostnames and all containers
@@ -121,10 +254,13 @@ CREATE TABLE IF NOT EXISTS flamedb.samples_1hour_local_store ON CLUSTER '{cluste
     CallStackParent   UInt64,
     InsertionTimestamp DateTime CODEC(DoubleDelta),
     NumSamples UInt64 CODEC(DoubleDelta),
-    ErrNumSamples      UInt32
+    ErrNumSamples      UInt32,
+    AppVersion        LowCardinality(String),
+    Endpoint          LowCardinality(String),
+    JobName           LowCardinality(String)
     ) ENGINE = ReplicatedSummingMergeTree('/clickhouse/{installation}/{cluster}/tables/{shard}/{database}/{table}', '{replica}', (NumSamples))
     PARTITION BY toYYYYMMDD(Timestamp)
-    ORDER BY (ServiceId, ContainerEnvName, InstanceType, Timestamp, CallStackHash, CallStackParent);
+    ORDER BY (ServiceId, ContainerEnvName, InstanceType, Timestamp, CallStackHash, CallStackParent, AppVersion, Endpoint, JobName);
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS flamedb.samples_1hour_local ON CLUSTER '{cluster}' TO
     flamedb.samples_1hour_local_store AS
@@ -141,10 +277,13 @@ SELECT toStartOfHour(Timestamp) AS Timestamp,
        any(CallStackParent)        as CallStackParent,
        sum(NumSamples)             as NumSamples,
        sum(ErrNumSamples)          as ErrNumSamples,
-       anyLast(InsertionTimestamp) as InsertionTimestamp
+       anyLast(InsertionTimestamp) as InsertionTimestamp,
+       AppVersion,
+       Endpoint,
+       JobName
 FROM flamedb.samples_local
 GROUP BY ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName, HostNameHash, ContainerNameHash,
-    CallStackHash, Timestamp;
+    CallStackHash, Timestamp, AppVersion, Endpoint, JobName;
 
 CREATE TABLE IF NOT EXISTS
     flamedb.samples_1hour
@@ -168,10 +307,13 @@ CREATE TABLE IF NOT EXISTS flamedb.samples_1day_local_store ON CLUSTER '{cluster
     CallStackParent   UInt64,
     InsertionTimestamp DateTime CODEC(DoubleDelta),
     NumSamples UInt64 CODEC(DoubleDelta),
-    ErrNumSamples      UInt32
+    ErrNumSamples      UInt32,
+    AppVersion        LowCardinality(String),
+    Endpoint          LowCardinality(String),
+    JobName           LowCardinality(String)
     ) ENGINE = ReplicatedSummingMergeTree('/clickhouse/{installation}/{cluster}/tables/{shard}/{database}/{table}', '{replica}', (NumSamples))
     PARTITION BY toYYYYMMDD(Timestamp)
-    ORDER BY (ServiceId, ContainerEnvName, InstanceType, Timestamp, CallStackHash, CallStackParent);
+    ORDER BY (ServiceId, ContainerEnvName, InstanceType, Timestamp, CallStackHash, CallStackParent, AppVersion, Endpoint, JobName);
 
 
 CREATE MATERIALIZED VIEW IF NOT EXISTS flamedb.samples_1day_local ON CLUSTER '{cluster}' TO
@@ -189,10 +331,13 @@ SELECT toStartOfDay(Timestamp) AS Timestamp,
        any(CallStackParent)        as CallStackParent,
        sum(NumSamples)             as NumSamples,
        sum(ErrNumSamples)          as ErrNumSamples,
-       anyLast(InsertionTimestamp) as InsertionTimestamp
+       anyLast(InsertionTimestamp) as InsertionTimestamp,
+       AppVersion,
+       Endpoint,
+       JobName
 FROM flamedb.samples_local
 GROUP BY ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName, HostNameHash, ContainerNameHash,
-    CallStackHash, Timestamp;
+    CallStackHash, Timestamp, AppVersion, Endpoint, JobName;
 
 CREATE TABLE IF NOT EXISTS
     flamedb.samples_1day
@@ -247,10 +392,14 @@ CREATE TABLE IF NOT EXISTS flamedb.samples_1min_local ON CLUSTER '{cluster}' (
     NumSamples UInt64 CODEC(DoubleDelta),
     HostNameHash UInt32,
     ContainerNameHash UInt32,
-    InsertionTimestamp DateTime CODEC(DoubleDelta)
+    InsertionTimestamp DateTime CODEC(DoubleDelta),
+    AppVersion LowCardinality(String),
+    Endpoint LowCardinality(String),
+    JobName LowCardinality(String)
     ) ENGINE = ReplicatedSummingMergeTree('/clickhouse/{installation}/{cluster}/tables/{shard}/{database}/{table}', '{replica}', (NumSamples))
     PARTITION BY toYYYYMMDD(Timestamp)
-    ORDER BY (ServiceId, ContainerEnvName, InstanceType, ContainerNameHash, HostNameHash, Timestamp);
+    ORDER BY (ServiceId, ContainerEnvName, InstanceType, ContainerNameHash, HostNameHash, Timestamp,
+              AppVersion, Endpoint, JobName);
 
 -- create mv
 CREATE MATERIALIZED VIEW IF NOT EXISTS flamedb.samples_1min_mv ON CLUSTER '{cluster}' TO
@@ -265,9 +414,13 @@ AS SELECT toStartOfMinute(Timestamp) AS
           sum(NumSamples) AS NumSamples,
           HostNameHash,
           ContainerNameHash,
-          anyLast(InsertionTimestamp) as InsertionTimestamp
+          anyLast(InsertionTimestamp) as InsertionTimestamp,
+          AppVersion,
+          Endpoint,
+          JobName
    FROM flamedb.samples_local WHERE CallStackParent = 0
-   GROUP BY ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName, HostNameHash, ContainerNameHash, Timestamp;
+   GROUP BY ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName, HostNameHash, ContainerNameHash, Timestamp,
+            AppVersion, Endpoint, JobName;
 
 -- create distributed table
 CREATE TABLE IF NOT EXISTS
@@ -0,0 +1,114 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+-- Promote application metadata (app version, endpoint, job name) to dedicated columns.
+--
+-- Applies to an existing single node installation created from create_ch_schema.sql.
+-- Existing rows get empty values; the per-host rollups are extended so the new
+-- columns can be used as filters, and their materialized views are recreated.
+
+ALTER TABLE flamedb.samples
+    ADD COLUMN IF NOT EXISTS AppVersion LowCardinality(String) AFTER ErrNumSamples,
+    ADD COLUMN IF NOT EXISTS Endpoint   LowCardinality(String) AFTER AppVersion,
+    ADD COLUMN IF NOT EXISTS JobName    LowCardinality(String) AFTER Endpoint;
+
+ALTER TABLE flamedb.samples_1hour
+    ADD COLUMN IF NOT EXISTS AppVersion LowCardinality(String),
+    ADD COLUMN IF NOT EXISTS Endpoint   LowCardinality(String),
+    ADD COLUMN IF NOT EXISTS JobName    LowCardinality(String),
+    MODIFY ORDER BY (ServiceId, ContainerEnvName, InstanceType, HostName, ContainerName,
+                     Timestamp, CallStackHash, CallStackParent, AppVersion, Endpoint, JobName);
+
+ALTER TABLE flamedb.samples_1day
+    ADD COLUMN IF NOT EXISTS AppVersion LowCardinality(String),
+    ADD COLUMN IF NOT EXISTS Endpoint   LowCardinality(String),
+    ADD COLUMN IF NOT EXISTS JobName    LowCardinality(String),
+    MODIFY ORDER BY (ServiceId, ContainerEnvName, InstanceType, HostName, ContainerName,
+                     Timestamp, CallStackHash, CallStackParent, AppVersion, Endpoint, JobName);
+
+ALTER TABLE flamedb.samples_1min
+    ADD COLUMN IF NOT EXISTS AppVersion LowCardinality(String),
+    ADD COLUMN IF NOT EXISTS Endpoint   LowCardinality(String),
+    ADD COLUMN IF NOT EXISTS JobName    LowCardinality(String),
+    MODIFY ORDER BY (ServiceId, ContainerEnvName, InstanceType, ContainerNameHash, HostNameHash, Timestamp,
+                     AppVersion, Endpoint, JobName);
+
+DROP VIEW IF EXISTS flamedb.samples_1hour_mv;
+DROP VIEW IF EXISTS flamedb.samples_1day_mv;
+DROP VIEW IF EXISTS flamedb.samples_1min_mv;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS
+    flamedb.samples_1hour_mv TO flamedb.samples_1hour
+AS
+SELECT toStartOfHour(Timestamp)    AS Timestamp,
+       ServiceId,
+       ContainerEnvName,
+       InstanceType,
+       HostName,
+       ContainerName,
+       CallStackHash,
+       any(CallStackName)          as CallStackName,
+       any(CallStackParent)        as CallStackParent,
+       sum(NumSamples)             AS NumSamples,
+       sum(ErrNumSamples)          AS ErrNumSamples,
+       anyLast(InsertionTimestamp) as InsertionTimestamp,
+       AppVersion,
+       Endpoint,
+       JobName
+FROM flamedb.samples
+GROUP BY ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName,
+         CallStackHash, Timestamp, AppVersion, Endpoint, JobName;
+CREATE MATERIALIZED VIEW IF NOT EXISTS
+    flamedb.samples_1day_mv TO flamedb.samples_1day
+AS
+SELECT toStartOfDay(Timestamp)     AS Timestamp,
+       ServiceId,
+       ContainerEnvName,
+       InstanceType,
+       HostName,
+       ContainerName,
+       CallStackHash,
+       any(CallStackName)          as CallStackName,
+       any(CallStackParent)        as CallStackParent,
+       sum(NumSamples)             AS NumSamples,
+       sum(ErrNumSamples)          AS ErrNumSamples,
+       anyLast(InsertionTimestamp) as InsertionTimestamp,
+       AppVersion,
+       Endpoint,
+       JobName
+FROM flamedb.samples
+GROUP BY ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName,
+         CallStackHash, Timestamp, AppVersion, Endpoint, JobName;
+CREATE MATERIALIZED VIEW IF NOT EXISTS flamedb.samples_1min_mv TO
+    flamedb.samples_1min
+AS SELECT toStartOfMinute(Timestamp) AS
+          Timestamp,
+          ServiceId,
+          InstanceType,
+          ContainerEnvName,
+          HostName,
+          ContainerName,
+          sum(NumSamples) AS NumSamples,
+          sum(ErrNumSamples) AS ErrNumSamples,
+          HostNameHash,
+          ContainerNameHash,
+          anyLast(InsertionTimestamp) as InsertionTimestamp,
+          AppVersion,
+          Endpoint,
+          JobName
+   FROM flamedb.samples WHERE CallStackParent = 0
+   GROUP BY ServiceId, InstanceType, ContainerEnvName, HostName, ContainerName, HostNameHash, ContainerNameHash, Timestamp,
+            AppVersion, Endpoint, JobName;
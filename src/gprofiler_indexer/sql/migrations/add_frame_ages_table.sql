@@ -0,0 +1,38 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+-- The first and last time every frame (call stack node) of a service is seen, written by the indexer
+-- (-clickhouse-frame-ages-table) at most once an hour per frame. The rows of a frame are merged to its
+-- minimum and maximum, so the new code paths of a service are found without scanning the samples:
+--
+--   SELECT CallStackHash, any(CallStackName), min(FirstSeen) AS first_seen
+--   FROM flamedb.frame_ages WHERE ServiceId = 42
+--   GROUP BY CallStackHash HAVING first_seen >= now() - INTERVAL 7 DAY;
+--
+-- Applies to an existing single node installation created from create_ch_schema.sql.
+-- Cluster installations can take the frame_ages_local/frame_ages statements
+-- from create_ch_schema_cluster_mode.sql as is. The table only covers the frames ingested after it was created.
+
+CREATE TABLE IF NOT EXISTS flamedb.frame_ages
+(
+    ServiceId       UInt32,
+    CallStackHash   UInt64,
+    CallStackName   SimpleAggregateFunction(any, String) CODEC (ZSTD),
+    CallStackParent SimpleAggregateFunction(any, UInt64),
+    FirstSeen       SimpleAggregateFunction(min, DateTime('UTC')),
+    LastSeen        SimpleAggregateFunction(max, DateTime('UTC'))
+) engine = AggregatingMergeTree()
+      ORDER BY (ServiceId, CallStackHash);
@@ -0,0 +1,55 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+-- Pinned time windows (REST admin pins endpoint): the raw stacks of a pinned service time window are copied
+-- to samples_pinned, which has no TTL, so they outlive the retention of the samples table.
+--
+-- Applies to an existing single node installation created from create_ch_schema.sql.
+-- Cluster installations can take the samples_pinned_local/samples_pinned and pins_local/pins statements
+-- from create_ch_schema_cluster_mode.sql as is.
+
+CREATE TABLE IF NOT EXISTS flamedb.samples_pinned
+(
+    Timestamp          DateTime('UTC') CODEC (DoubleDelta),
+    ServiceId          UInt32,
+    InstanceType       LowCardinality(String),
+    ContainerEnvName   LowCardinality(String),
+    HostName           LowCardinality(String),
+    ContainerName      LowCardinality(String),
+    NumSamples         UInt32 CODEC (DoubleDelta),
+    CallStackHash      UInt64,
+    HostNameHash       UInt32 MATERIALIZED xxHash32(HostName),
+    ContainerNameHash  UInt32 MATERIALIZED xxHash32(ContainerName),
+    CallStackName      String CODEC (ZSTD),
+    CallStackParent    UInt64,
+    InsertionTimestamp DateTime('UTC') CODEC (DoubleDelta),
+    ErrNumSamples      UInt32,
+    AppVersion         LowCardinality(String),
+    Endpoint           LowCardinality(String),
+    JobName            LowCardinality(String)
+) engine = MergeTree() PARTITION BY toYYYYMMDD(Timestamp)
+      ORDER BY (ServiceId, InstanceType, ContainerEnvName, HostNameHash, ContainerNameHash, Timestamp);
+
+CREATE TABLE IF NOT EXISTS flamedb.pins
+(
+    ServiceId UInt32,
+    StartTime DateTime('UTC'),
+    EndTime   DateTime('UTC'),
+    Reason    String,
+    CreatedBy LowCardinality(String),
+    CreatedAt DateTime('UTC')
+) engine = MergeTree()
+      ORDER BY (ServiceId, StartTime);
@@ -0,0 +1,31 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+-- Containers classified as sidecars by the indexer (-clickhouse-sidecars-table, -sidecar-patterns),
+-- e.g. envoy or istio-proxy. The REST sidecars=exclude parameter removes them from the flame graphs.
+--
+-- Applies to an existing single node installation created from create_ch_schema.sql.
+-- Cluster installations can take the sidecar_containers_local/sidecar_containers statements
+-- from create_ch_schema_cluster_mode.sql as is.
+
+CREATE TABLE IF NOT EXISTS flamedb.sidecar_containers
+(
+    Timestamp     DateTime('UTC') CODEC (DoubleDelta),
+    ServiceId     UInt32,
+    ContainerName LowCardinality(String)
+) engine = ReplacingMergeTree(Timestamp)
+      ORDER BY (ServiceId, ContainerName)
+      TTL Timestamp + INTERVAL 90 DAY;
@@ -0,0 +1,35 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+-- Per file symbolization statistics written by the indexer (-clickhouse-symbol-quality-table).
+--
+-- Applies to an existing single node installation created from create_ch_schema.sql.
+-- Cluster installations can take the symbol_quality_local/symbol_quality statements
+-- from create_ch_schema_cluster_mode.sql as is.
+
+CREATE TABLE IF NOT EXISTS flamedb.symbol_quality
+(
+    Timestamp             DateTime('UTC') CODEC (DoubleDelta),
+    ServiceId             UInt32,
+    HostName              LowCardinality(String),
+    TotalFrames           UInt32,
+    UnknownFrames         UInt32,
+    AddressOnlyFrames     UInt32,
+    TotalSamples          UInt64,
+    UnresolvedLeafSamples UInt64
+) engine = MergeTree() PARTITION BY toYYYYMMDD(Timestamp)
+      ORDER BY (ServiceId, Timestamp)
+      TTL Timestamp + INTERVAL 90 DAY;
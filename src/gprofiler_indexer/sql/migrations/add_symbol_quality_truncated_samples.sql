@@ -0,0 +1,25 @@
+--
+-- Copyright (C) 2023 Intel Corporation
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--    http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+--
+
+-- Samples of the stacks truncated at the maximum stack depth of the profilers, per profile file,
+-- used by the REST quality score.
+--
+-- Applies to an existing installation with the symbol_quality table. Cluster installations alter
+-- symbol_quality_local ON CLUSTER '{cluster}' first, then the symbol_quality distributed table.
+-- Existing rows count no truncated samples.
+
+ALTER TABLE flamedb.symbol_quality
+    ADD COLUMN IF NOT EXISTS TruncatedSamples UInt64 AFTER UnresolvedLeafSamples;
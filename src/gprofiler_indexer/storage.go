@@ -0,0 +1,226 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Storage reads the uploaded profile files and writes their HTML artifacts, keys are object paths
+// like "products/<service>/stacks/<file>"
+type Storage interface {
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+}
+
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// InventoryStorage lists and deletes the stored files, for the reconciliation of the artifacts
+type InventoryStorage interface {
+	List(prefix string) ([]ObjectInfo, error)
+	ListPrefixes(prefix string) ([]string, error)
+	Delete(key string) error
+}
+
+// S3Storage stores the files in an S3 bucket
+type S3Storage struct {
+	sess   *session.Session
+	bucket string
+}
+
+func NewS3Storage(args *CLIArgs) *S3Storage {
+	sessionOptions := session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if args.AWSEndpoint != "" {
+		sessionOptions.Config = aws.Config{
+			Region:           aws.String(args.AWSRegion),
+			Endpoint:         aws.String(args.AWSEndpoint),
+			S3ForcePathStyle: aws.Bool(true),
+		}
+	}
+	return &S3Storage{
+		sess:   session.Must(session.NewSessionWithOptions(sessionOptions)),
+		bucket: args.S3Bucket,
+	}
+}
+
+// WithBucket returns a storage of another bucket sharing the session
+func (s *S3Storage) WithBucket(bucket string) *S3Storage {
+	return &S3Storage{sess: s.sess, bucket: bucket}
+}
+
+func (s *S3Storage) Get(key string) ([]byte, error) {
+	return GetFileFromS3(s.sess, s.bucket, key)
+}
+
+func (s *S3Storage) Put(key string, data []byte) error {
+	return PutFileToS3(s.sess, s.bucket, key, data)
+}
+
+func (s *S3Storage) ContentHash(key string) (string, bool, error) {
+	return HeadFileInS3(s.sess, s.bucket, key)
+}
+
+func (s *S3Storage) List(prefix string) ([]ObjectInfo, error) {
+	return ListFilesInS3(s.sess, s.bucket, prefix)
+}
+
+func (s *S3Storage) ListPrefixes(prefix string) ([]string, error) {
+	return ListPrefixesInS3(s.sess, s.bucket, prefix)
+}
+
+func (s *S3Storage) Delete(key string) error {
+	return DeleteFileFromS3(s.sess, s.bucket, key)
+}
+
+// MemoryStorage keeps the files in memory, for tests. Errors can be injected per key and operation.
+type MemoryStorage struct {
+	mutex     sync.Mutex
+	files     map[string][]byte
+	modified  map[string]time.Time
+	getErrors map[string]error
+	putErrors map[string]error
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		files:     make(map[string][]byte),
+		modified:  make(map[string]time.Time),
+		getErrors: make(map[string]error),
+		putErrors: make(map[string]error),
+	}
+}
+
+// FailGet makes the next reads of key fail with err, a nil err clears the failure
+func (ms *MemoryStorage) FailGet(key string, err error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.getErrors[key] = err
+}
+
+// FailPut makes the next writes of key fail with err, a nil err clears the failure
+func (ms *MemoryStorage) FailPut(key string, err error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.putErrors[key] = err
+}
+
+func (ms *MemoryStorage) Get(key string) ([]byte, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if err := ms.getErrors[key]; err != nil {
+		return nil, err
+	}
+	data, ok := ms.files[key]
+	if !ok {
+		return nil, fmt.Errorf("file %s not found", key)
+	}
+	return data, nil
+}
+
+func (ms *MemoryStorage) Put(key string, data []byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if err := ms.putErrors[key]; err != nil {
+		return err
+	}
+	ms.files[key] = append([]byte(nil), data...)
+	ms.modified[key] = time.Now()
+	return nil
+}
+
+func (ms *MemoryStorage) ContentHash(key string) (string, bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	data, ok := ms.files[key]
+	if !ok {
+		return "", false, nil
+	}
+	return contentHash(data), true, nil
+}
+
+// Touch sets the modification time of a stored file
+func (ms *MemoryStorage) Touch(key string, modified time.Time) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.modified[key] = modified
+}
+
+func (ms *MemoryStorage) List(prefix string) ([]ObjectInfo, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	objects := make([]ObjectInfo, 0)
+	for key, data := range ms.files {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: int64(len(data)), LastModified: ms.modified[key]})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (ms *MemoryStorage) ListPrefixes(prefix string) ([]string, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	unique := make(map[string]bool)
+	for key := range ms.files {
+		if rest, ok := strings.CutPrefix(key, prefix); ok {
+			if idx := strings.Index(rest, "/"); idx >= 0 {
+				unique[prefix+rest[:idx+1]] = true
+			}
+		}
+	}
+	prefixes := make([]string, 0, len(unique))
+	for p := range unique {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+func (ms *MemoryStorage) Delete(key string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	delete(ms.files, key)
+	delete(ms.modified, key)
+	return nil
+}
+
+// Keys returns the keys of the stored files
+func (ms *MemoryStorage) Keys() []string {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	keys := make([]string, 0, len(ms.files))
+	for key := range ms.files {
+		keys = append(keys, key)
+	}
+	return keys
+}
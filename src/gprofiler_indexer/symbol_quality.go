@@ -0,0 +1,124 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+const unknownSymbol = "[unknown]"
+
+// truncatedStackDepth is the default maximum stack depth of perf (kernel.perf_event_max_stack), deeper stacks
+// are cut at this depth by the profilers
+const truncatedStackDepth = 127
+
+// addressOnlyRegex matches frames made of a bare address, optionally with a runtime suffix (e.g. "0x7f12ab34_[k]")
+var addressOnlyRegex = regexp.MustCompile(`^\[?(0x)?[0-9a-fA-F]{6,}\]?(_\[\w+\])?$`)
+
+type SymbolQualityRecord struct {
+	Timestamp             time.Time
+	ServiceId             uint32
+	HostName              string
+	TotalFrames           uint32
+	UnknownFrames         uint32
+	AddressOnlyFrames     uint32
+	TotalSamples          uint64
+	UnresolvedLeafSamples uint64
+	TruncatedSamples      uint64
+}
+
+func (sq SymbolQualityRecord) getDbAttributes() []interface{} {
+	dbAttributes := []interface{}{
+		sq.Timestamp,
+		sq.ServiceId,
+		sq.HostName,
+		sq.TotalFrames,
+		sq.UnknownFrames,
+		sq.AddressOnlyFrames,
+		sq.TotalSamples,
+		sq.UnresolvedLeafSamples,
+		sq.TruncatedSamples,
+	}
+	return dbAttributes
+}
+
+func isUnknownFrame(frame string) bool {
+	return strings.Contains(frame, unknownSymbol)
+}
+
+func isAddressOnlyFrame(frame string) bool {
+	return addressOnlyRegex.MatchString(frame)
+}
+
+// SymbolQuality accumulates symbolization statistics of a single profile file.
+// Frames are counted once per unique frame, samples are counted by their leaf frame. Stacks as deep as
+// truncatedStackDepth are assumed truncated.
+type SymbolQuality struct {
+	seen                  map[string]struct{}
+	TotalFrames           uint32
+	UnknownFrames         uint32
+	AddressOnlyFrames     uint32
+	TotalSamples          uint64
+	UnresolvedLeafSamples uint64
+	TruncatedSamples      uint64
+}
+
+func NewSymbolQuality() *SymbolQuality {
+	return &SymbolQuality{seen: make(map[string]struct{})}
+}
+
+func (sq *SymbolQuality) AddStack(stack []string, sampleCount int) {
+	if len(stack) == 0 {
+		return
+	}
+	for _, frame := range stack {
+		if _, ok := sq.seen[frame]; ok {
+			continue
+		}
+		sq.seen[frame] = struct{}{}
+		sq.TotalFrames += 1
+		if isUnknownFrame(frame) {
+			sq.UnknownFrames += 1
+		} else if isAddressOnlyFrame(frame) {
+			sq.AddressOnlyFrames += 1
+		}
+	}
+	sq.TotalSamples += uint64(sampleCount)
+	leaf := stack[len(stack)-1]
+	if isUnknownFrame(leaf) || isAddressOnlyFrame(leaf) {
+		sq.UnresolvedLeafSamples += uint64(sampleCount)
+	}
+	if len(stack) >= truncatedStackDepth {
+		sq.TruncatedSamples += uint64(sampleCount)
+	}
+}
+
+func (sq *SymbolQuality) Record(serviceId uint32, hostname string, timestamp time.Time) SymbolQualityRecord {
+	return SymbolQualityRecord{
+		Timestamp:             timestamp,
+		ServiceId:             serviceId,
+		HostName:              hostname,
+		TotalFrames:           sq.TotalFrames,
+		UnknownFrames:         sq.UnknownFrames,
+		AddressOnlyFrames:     sq.AddressOnlyFrames,
+		TotalSamples:          sq.TotalSamples,
+		UnresolvedLeafSamples: sq.UnresolvedLeafSamples,
+		TruncatedSamples:      sq.TruncatedSamples,
+	}
+}
@@ -0,0 +1,101 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+var tableSuffixRegexp = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+
+// TableNames resolves the ClickHouse tables to write to. Table names are templated with a schema version
+// suffix, records are written to the active tables and, during a migration, to the shadow tables as well
+type TableNames struct {
+	mutex        sync.RWMutex
+	suffix       string
+	shadowSuffix string
+}
+
+type TableSuffixes struct {
+	Suffix       string `json:"suffix"`
+	ShadowSuffix string `json:"shadow_suffix"`
+}
+
+func NewTableNames(suffix string, shadowSuffix string) (*TableNames, error) {
+	tn := &TableNames{}
+	if err := tn.Switch(TableSuffixes{Suffix: suffix, ShadowSuffix: shadowSuffix}); err != nil {
+		return nil, err
+	}
+	return tn, nil
+}
+
+func (tn *TableNames) Suffixes() TableSuffixes {
+	tn.mutex.RLock()
+	defer tn.mutex.RUnlock()
+	return TableSuffixes{Suffix: tn.suffix, ShadowSuffix: tn.shadowSuffix}
+}
+
+// Switch changes the active and shadow suffixes, new batches are written to the new tables
+func (tn *TableNames) Switch(suffixes TableSuffixes) error {
+	for _, suffix := range []string{suffixes.Suffix, suffixes.ShadowSuffix} {
+		if !tableSuffixRegexp.MatchString(suffix) {
+			return fmt.Errorf("invalid table suffix %q", suffix)
+		}
+	}
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+	tn.suffix = suffixes.Suffix
+	tn.shadowSuffix = suffixes.ShadowSuffix
+	return nil
+}
+
+// Targets returns every table the records of baseTable must be written to
+func (tn *TableNames) Targets(baseTable string) []string {
+	tn.mutex.RLock()
+	defer tn.mutex.RUnlock()
+	targets := []string{baseTable + tn.suffix}
+	if tn.shadowSuffix != "" && tn.shadowSuffix != tn.suffix {
+		targets = append(targets, baseTable+tn.shadowSuffix)
+	}
+	return targets
+}
+
+// TableSuffixHandler returns the current suffixes on GET and switches them over on POST
+func (tn *TableNames) TableSuffixHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, tn.Suffixes())
+	case http.MethodPost:
+		var suffixes TableSuffixes
+		if err := json.NewDecoder(r.Body).Decode(&suffixes); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := tn.Switch(suffixes); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		logger.Infof("switched table suffix to %q (shadow %q)", suffixes.Suffix, suffixes.ShadowSuffix)
+		writeJSON(w, http.StatusOK, tn.Suffixes())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
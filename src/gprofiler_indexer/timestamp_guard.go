@@ -0,0 +1,73 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Actions on profiles whose timestamp is out of the accepted range
+const (
+	TimestampActionClamp  = "clamp"
+	TimestampActionReject = "reject"
+)
+
+// Anomalies recorded for profiles whose timestamp is out of the accepted range
+const (
+	AnomalyTimestampClamped  = "timestamp_clamped"
+	AnomalyTimestampRejected = "timestamp_rejected"
+)
+
+var ErrTimestampOutOfRange = errors.New("timestamp out of range")
+
+// TimestampGuard bounds the profile timestamps around the ingestion time, so that agents with a bad clock
+// do not insert samples far in the future or in the past. A zero bound disables the check on its side.
+type TimestampGuard struct {
+	MaxFutureSkew time.Duration
+	MaxPastAge    time.Duration
+	Action        string
+}
+
+func NewTimestampGuard(maxFutureSkew time.Duration, maxPastAge time.Duration, action string) (TimestampGuard, error) {
+	if action != TimestampActionClamp && action != TimestampActionReject {
+		return TimestampGuard{}, fmt.Errorf("invalid timestamp action %q, expected %s or %s", action,
+			TimestampActionClamp, TimestampActionReject)
+	}
+	return TimestampGuard{MaxFutureSkew: maxFutureSkew, MaxPastAge: maxPastAge, Action: action}, nil
+}
+
+// Apply returns the timestamp to write the profile with. The anomaly kind is empty when the timestamp is
+// in range, ErrTimestampOutOfRange is returned when it is out of range and the action is reject. The error is
+// permanent, the timestamp of the file does not change when it is retried.
+func (tg TimestampGuard) Apply(timestamp time.Time, now time.Time) (time.Time, string, error) {
+	bounded := timestamp
+	if tg.MaxFutureSkew > 0 && timestamp.After(now.Add(tg.MaxFutureSkew)) {
+		bounded = now
+	} else if tg.MaxPastAge > 0 && timestamp.Before(now.Add(-tg.MaxPastAge)) {
+		bounded = now.Add(-tg.MaxPastAge)
+	}
+	if bounded.Equal(timestamp) {
+		return timestamp, "", nil
+	}
+	if tg.Action == TimestampActionReject {
+		return timestamp, AnomalyTimestampRejected, Permanent(fmt.Errorf("%w: %s is %s away from the ingestion time",
+			ErrTimestampOutOfRange, timestamp.Format(time.RFC3339), timestamp.Sub(now).Round(time.Second)))
+	}
+	return bounded, AnomalyTimestampClamped, nil
+}
@@ -0,0 +1,94 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Overwrite policies of the uploaded artifacts, SQS redeliveries upload the same artifacts again
+const (
+	OverwriteAlways    = "always"
+	OverwriteIfChanged = "if-changed"
+	OverwriteNever     = "never"
+)
+
+// ContentHashStorage reports the hash of the stored objects so that unchanged objects are not uploaded
+// again, storages without it always upload
+type ContentHashStorage interface {
+	// ContentHash returns the hex SHA-256 of the object content recorded at upload, exists is false when
+	// the object is missing. The hash is empty for objects uploaded without one.
+	ContentHash(key string) (hash string, exists bool, err error)
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// flamegraphContentDir holds the content addressed adhoc flamegraphs of a service, under its flamegraph prefix
+const flamegraphContentDir = "cas/"
+
+// flamegraphContentKey returns the key of the object holding a deduplicated flamegraph, identical flamegraphs of
+// a service are stored once and referenced by the content_key of all their metadata rows
+func flamegraphContentKey(service string, data []byte) string {
+	return fmt.Sprintf("products/%s/stacks/flamegraph/%s%s.html", service, flamegraphContentDir, contentHash(data))
+}
+
+func isFlamegraphContentKey(key string) bool {
+	return strings.Contains(key, "/stacks/flamegraph/"+flamegraphContentDir) && strings.HasSuffix(key, ".html")
+}
+
+// UploadPolicies are the overwrite policies per artifact type, an empty policy always overwrites
+type UploadPolicies struct {
+	HTMLBlob       string
+	FlamegraphHTML string
+}
+
+func NewUploadPolicies(htmlBlob string, flamegraphHTML string) (UploadPolicies, error) {
+	for _, policy := range []string{htmlBlob, flamegraphHTML} {
+		if policy != OverwriteAlways && policy != OverwriteIfChanged && policy != OverwriteNever {
+			return UploadPolicies{}, fmt.Errorf("invalid overwrite policy %q, expected %s, %s or %s", policy,
+				OverwriteAlways, OverwriteIfChanged, OverwriteNever)
+		}
+	}
+	return UploadPolicies{HTMLBlob: htmlBlob, FlamegraphHTML: flamegraphHTML}, nil
+}
+
+// uploadArtifact puts data to key unless the policy allows to keep the stored object, uploaded is false
+// when the upload is skipped. A failed existence check falls back to the upload.
+func uploadArtifact(storage Storage, key string, data []byte, policy string) (uploaded bool, err error) {
+	hashStorage, ok := storage.(ContentHashStorage)
+	if ok && (policy == OverwriteIfChanged || policy == OverwriteNever) {
+		hash, exists, err := hashStorage.ContentHash(key)
+		if err != nil {
+			log.Warnf("unable to check whether %s is already uploaded: %v", key, err)
+		} else if exists && (policy == OverwriteNever || hash == contentHash(data)) {
+			log.Debugf("skip upload of %s, already stored (overwrite policy %s)", key, policy)
+			return false, nil
+		}
+	}
+	if err = storage.Put(key, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
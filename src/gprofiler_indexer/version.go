@@ -0,0 +1,46 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"runtime"
+)
+
+// Set at build time with -ldflags "-X main.Version=... -X main.GitSHA=... -X main.BuildTime=..."
+var (
+	Version   = "dev"
+	GitSHA    = "unknown"
+	BuildTime = "unknown"
+)
+
+type BuildInfo struct {
+	Service   string `json:"service"`
+	Version   string `json:"version"`
+	GitSHA    string `json:"git_sha"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+func GetBuildInfo() BuildInfo {
+	return BuildInfo{
+		Service:   AppName,
+		Version:   Version,
+		GitSHA:    GitSHA,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+}
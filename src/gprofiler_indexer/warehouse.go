@@ -0,0 +1,307 @@
+//
+// Copyright (C) 2023 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	warehouseCheckInterval = time.Hour
+	// rows inserted per statement by the SQL drivers
+	warehouseInsertBatch = 500
+)
+
+var warehouseTableRegex = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+
+// WarehouseAggregate is the daily number of samples of a function in a service. Samples count the stacks the
+// function is in, so the aggregates of the functions of a service add up to more than the service samples.
+type WarehouseAggregate struct {
+	Day            time.Time `json:"day"`
+	ServiceId      uint32    `json:"service_id"`
+	ServiceName    string    `json:"service_name"`
+	Function       string    `json:"function"`
+	Samples        uint64    `json:"samples"`
+	ServiceSamples uint64    `json:"service_samples"`
+	Share          float64   `json:"share"`
+}
+
+// WarehouseDriver loads the daily aggregates to a data warehouse. Export replaces the aggregates of the day,
+// so that a day exported again is never counted twice.
+type WarehouseDriver interface {
+	Export(ctx context.Context, day time.Time, aggregates []WarehouseAggregate) error
+	Close() error
+}
+
+// warehouseDrivers are the drivers of -warehouse-driver. BigQuery and Snowflake have no Go driver here,
+// they load the NDJSON files of the s3 driver (BigQuery Data Transfer Service, Snowflake external stage).
+var warehouseDrivers = map[string]func(args *CLIArgs) (WarehouseDriver, error){
+	"redshift": NewRedshiftDriver,
+	"s3":       NewS3WarehouseDriver,
+}
+
+func NewWarehouseDriver(args *CLIArgs) (WarehouseDriver, error) {
+	newDriver, ok := warehouseDrivers[args.WarehouseDriver]
+	if !ok {
+		names := make([]string, 0, len(warehouseDrivers))
+		for name := range warehouseDrivers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown warehouse driver %q, expected one of %s", args.WarehouseDriver,
+			strings.Join(names, ", "))
+	}
+	return newDriver(args)
+}
+
+// RedshiftDriver writes the aggregates to a Redshift (or PostgreSQL) table over the PostgreSQL protocol:
+// day DATE, service_id BIGINT, service_name VARCHAR, function VARCHAR(65535), samples BIGINT,
+// service_samples BIGINT, share DOUBLE PRECISION
+type RedshiftDriver struct {
+	db    *sql.DB
+	table string
+}
+
+func NewRedshiftDriver(args *CLIArgs) (WarehouseDriver, error) {
+	if !warehouseTableRegex.MatchString(args.WarehouseTable) {
+		return nil, fmt.Errorf("invalid warehouse table %q", args.WarehouseTable)
+	}
+	db, err := sql.Open("postgres", args.WarehouseDSN)
+	if err != nil {
+		return nil, err
+	}
+	return &RedshiftDriver{db: db, table: args.WarehouseTable}, nil
+}
+
+func (rd *RedshiftDriver) Export(ctx context.Context, day time.Time, aggregates []WarehouseAggregate) error {
+	tx, err := rd.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE day = $1", rd.table),
+		day.Format(time.DateOnly)); err != nil {
+		return err
+	}
+	for start := 0; start < len(aggregates); start += warehouseInsertBatch {
+		batch := aggregates[start:min(start+warehouseInsertBatch, len(aggregates))]
+		values := make([]string, 0, len(batch))
+		params := make([]any, 0, len(batch)*7)
+		for _, aggregate := range batch {
+			n := len(params)
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5,
+				n+6, n+7))
+			params = append(params, aggregate.Day.Format(time.DateOnly), int64(aggregate.ServiceId),
+				aggregate.ServiceName, aggregate.Function, int64(aggregate.Samples), int64(aggregate.ServiceSamples),
+				aggregate.Share)
+		}
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (day, service_id, service_name, function, "+
+			"samples, service_samples, share) VALUES %s", rd.table, strings.Join(values, ", ")), params...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (rd *RedshiftDriver) Close() error {
+	return rd.db.Close()
+}
+
+// S3WarehouseDriver writes the aggregates of every day to a gzipped NDJSON object of a Hive style
+// partition, <prefix>/day=YYYY-MM-DD/function_daily.ndjson.gz, for the warehouses loading from S3
+type S3WarehouseDriver struct {
+	storage Storage
+	prefix  string
+}
+
+func NewS3WarehouseDriver(args *CLIArgs) (WarehouseDriver, error) {
+	location, err := url.Parse(args.WarehouseDSN)
+	if err != nil || location.Scheme != "s3" || location.Host == "" {
+		return nil, fmt.Errorf("invalid warehouse location %q, expected s3://bucket/prefix", args.WarehouseDSN)
+	}
+	return &S3WarehouseDriver{
+		storage: NewS3Storage(args).WithBucket(location.Host),
+		prefix:  strings.Trim(location.Path, "/"),
+	}, nil
+}
+
+func (sd *S3WarehouseDriver) key(day time.Time) string {
+	key := fmt.Sprintf("day=%s/function_daily.ndjson.gz", day.Format(time.DateOnly))
+	if sd.prefix == "" {
+		return key
+	}
+	return sd.prefix + "/" + key
+}
+
+func (sd *S3WarehouseDriver) Export(ctx context.Context, day time.Time, aggregates []WarehouseAggregate) error {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(gzipWriter)
+	for _, aggregate := range aggregates {
+		if err := encoder.Encode(aggregate); err != nil {
+			return err
+		}
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return err
+	}
+	return sd.storage.Put(sd.key(day), buf.Bytes())
+}
+
+func (sd *S3WarehouseDriver) Close() error {
+	return nil
+}
+
+// warehouseQuery returns the samples of the top functions of every service of a day from the daily rollup,
+// the service samples are the samples of the root frames
+func warehouseQuery(dailyTable string, topFunctions int) string {
+	return fmt.Sprintf(`
+		SELECT ServiceId, CallStackName, Samples, ServiceSamples
+		FROM (
+			SELECT ServiceId, CallStackName, sum(NumSamples) AS Samples
+			FROM %[1]s WHERE Timestamp >= ? AND Timestamp < ?
+			GROUP BY ServiceId, CallStackName
+		) ANY LEFT JOIN (
+			SELECT ServiceId, sumIf(NumSamples, CallStackParent = 0) AS ServiceSamples
+			FROM %[1]s WHERE Timestamp >= ? AND Timestamp < ?
+			GROUP BY ServiceId
+		) USING ServiceId
+		ORDER BY ServiceId, Samples DESC
+		LIMIT %[2]d BY ServiceId`, dailyTable, topFunctions)
+}
+
+// FetchWarehouseAggregates reads the aggregates of a day from the daily rollup of every ClickHouse cluster,
+// dailyTable follows the table suffix switches
+func FetchWarehouseAggregates(clients map[string]*ClickHouseClient, dailyTable func() string,
+	topFunctions int) func(ctx context.Context, day time.Time) ([]WarehouseAggregate, error) {
+	return func(ctx context.Context, day time.Time) ([]WarehouseAggregate, error) {
+		end := day.Add(24 * time.Hour)
+		aggregates := make([]WarehouseAggregate, 0)
+		for _, client := range clients {
+			rows, err := client.conn.Query(ctx, warehouseQuery(dailyTable(), topFunctions), day, end, day, end)
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				aggregate := WarehouseAggregate{Day: day}
+				if err = rows.Scan(&aggregate.ServiceId, &aggregate.Function, &aggregate.Samples,
+					&aggregate.ServiceSamples); err != nil {
+					rows.Close()
+					return nil, err
+				}
+				aggregates = append(aggregates, aggregate)
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return aggregates, nil
+	}
+}
+
+// WarehouseExporter pushes the daily per service and function aggregates to a data warehouse, for the
+// organization wide reports joining profiling costs with business metrics. A day is exported once it is
+// over by the export delay, so that the late profiles are counted.
+type WarehouseExporter struct {
+	driver       WarehouseDriver
+	fetch        func(ctx context.Context, day time.Time) ([]WarehouseAggregate, error)
+	serviceNames func() (map[int]string, error)
+	delay        time.Duration
+	lastExported time.Time
+}
+
+func NewWarehouseExporter(driver WarehouseDriver,
+	fetch func(ctx context.Context, day time.Time) ([]WarehouseAggregate, error),
+	serviceNames func() (map[int]string, error), delay time.Duration) *WarehouseExporter {
+	return &WarehouseExporter{
+		driver:       driver,
+		fetch:        fetch,
+		serviceNames: serviceNames,
+		delay:        delay,
+	}
+}
+
+// dueDay returns the last day over by the export delay
+func (we *WarehouseExporter) dueDay(now time.Time) time.Time {
+	return now.Add(-we.delay).UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+}
+
+// ExportDay exports the aggregates of a day, the service names are the current ones
+func (we *WarehouseExporter) ExportDay(ctx context.Context, day time.Time) (int, error) {
+	aggregates, err := we.fetch(ctx, day)
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch the aggregates of %s: %w", day.Format(time.DateOnly), err)
+	}
+	names, err := we.serviceNames()
+	if err != nil {
+		return 0, err
+	}
+	for idx := range aggregates {
+		aggregates[idx].ServiceName = names[int(aggregates[idx].ServiceId)]
+		if aggregates[idx].ServiceSamples > 0 {
+			aggregates[idx].Share = float64(aggregates[idx].Samples) / float64(aggregates[idx].ServiceSamples)
+		}
+	}
+	if err = we.driver.Export(ctx, day, aggregates); err != nil {
+		return 0, fmt.Errorf("unable to export the aggregates of %s: %w", day.Format(time.DateOnly), err)
+	}
+	return len(aggregates), nil
+}
+
+// exportDue exports the due day unless it was exported already. The due day is exported again after a
+// restart, which the drivers make harmless.
+func (we *WarehouseExporter) exportDue(ctx context.Context, now time.Time) error {
+	day := we.dueDay(now)
+	if !day.After(we.lastExported) {
+		return nil
+	}
+	count, err := we.ExportDay(ctx, day)
+	if err != nil {
+		return err
+	}
+	we.lastExported = day
+	logger.Infof("exported %d aggregate(s) of %s to the warehouse", count, day.Format(time.DateOnly))
+	return nil
+}
+
+// Run exports the due days until ctx is done
+func (we *WarehouseExporter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := we.exportDue(ctx, time.Now()); err != nil {
+			logger.Errorf("warehouse export failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -17,28 +17,30 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	log "github.com/sirupsen/logrus"
 )
 
-// deleteMessageWithMetrics handles SQS message deletion and SLI metric tracking for failures
-func deleteMessageWithMetrics(sess *session.Session, task SQSMessage) {
-	errDelete := deleteMessage(sess, task.QueueURL, task.MessageHandle)
-	if errDelete != nil {
-		log.Errorf("Unable to delete message from %s, err %v", task.QueueURL, errDelete)
+// acknowledgeWithMetrics reports the outcome of a task to its source and tracks acknowledgement failures
+func acknowledgeWithMetrics(acker Acknowledger, task Task, success bool, metrics MetricsPublisher) {
+	var errAck error
+	if success {
+		errAck = acker.Ack(task)
+	} else {
+		errAck = acker.Nack(task)
+	}
+	if errAck != nil {
+		log.Errorf("Unable to acknowledge task %s, err %v", task.Filename, errAck)
 
 		// SLI Metric: SQS delete failure (server error - counts against SLO)
 		// The event was processed but we couldn't clean up
-		// SendSLIMetric handles nil/enabled checks internally
-		GetMetricsPublisher().SendSLIMetric(
+		metrics.SendSLIMetric(
 			ResponseTypeFailure,
 			"event_processing",
 			map[string]string{
@@ -50,38 +52,130 @@ func deleteMessageWithMetrics(sess *session.Session, task SQSMessage) {
 	}
 }
 
-func Worker(workerIdx int, args *CLIArgs, tasks <-chan SQSMessage, pw *ProfilesWriter, wg *sync.WaitGroup) {
-	var buf []byte
-	var err error
-	var temp string
+// failTask returns a retryable task failed on a transient error to its source, the other failed tasks are
+// not delivered again
+func failTask(acker Acknowledger, task Task, err error, audit *DeliveryAudit, metrics MetricsPublisher) {
+	if task.Retryable && IsTransientError(err) {
+		audit.FileRetried(task)
+		if errRetry := acker.Retry(task); errRetry != nil {
+			log.Errorf("Unable to retry task %s, err %v", task.Filename, errRetry)
+			metrics.SendSLIMetric(
+				ResponseTypeFailure,
+				"event_processing",
+				map[string]string{
+					"service":  task.Service,
+					"error":    "sqs_retry_failed",
+					"filename": task.Filename,
+				},
+			)
+		}
+		return
+	}
+	audit.FileFailed(task)
+	acknowledgeWithMetrics(acker, task, false, metrics)
+}
 
-	defer wg.Done()
+// TaskDelivery acknowledges a task once the stacks of its file are written to ClickHouse rather than once they are
+// queued, so that a failed insert returns the task to its source instead of losing the profile. The stack records
+// carry the delivery of their task to the writer, which reports the outcome of their insert. The methods of a nil
+// TaskDelivery are no-ops.
+type TaskDelivery struct {
+	mutex sync.Mutex
+	// pending is the number of records queued and not written yet
+	pending int
+	queued  bool
+	err     error
+	done    func(err error)
+}
+
+// NewTaskDelivery calls done once every record of the task is written, with the first insert error
+func NewTaskDelivery(done func(err error)) *TaskDelivery {
+	return &TaskDelivery{done: done}
+}
+
+// add counts a record queued to the writer
+func (td *TaskDelivery) add() {
+	if td == nil {
+		return
+	}
+	td.mutex.Lock()
+	defer td.mutex.Unlock()
+	td.pending += 1
+}
 
-	sessionOptions := session.Options{
-		SharedConfigState: session.SharedConfigEnable,
+// Queued reports that every record of the task is queued
+func (td *TaskDelivery) Queued() {
+	if td == nil {
+		return
 	}
-	if args.AWSEndpoint != "" {
-		sessionOptions.Config = aws.Config{
-			Region:           aws.String(args.AWSRegion),
-			Endpoint:         aws.String(args.AWSEndpoint),
-			S3ForcePathStyle: aws.Bool(true),
+	td.mutex.Lock()
+	td.queued = true
+	td.finish()
+}
+
+// written reports the insert of records of the task, err is nil when it succeeded
+func (td *TaskDelivery) written(records int, err error) {
+	if td == nil {
+		return
+	}
+	td.mutex.Lock()
+	td.pending -= records
+	if err != nil && td.err == nil {
+		td.err = err
+	}
+	td.finish()
+}
+
+// finish calls done once, when every record is written, it is called with the lock held and releases it
+func (td *TaskDelivery) finish() {
+	done := td.done
+	if !td.queued || td.pending > 0 || done == nil {
+		td.mutex.Unlock()
+		return
+	}
+	td.done = nil
+	err := td.err
+	td.mutex.Unlock()
+	done(err)
+}
+
+// acknowledgeWritten reports the insert of the stack records to the deliveries of their tasks
+func acknowledgeWritten(records []RecordsAttributesUnpack, err error) {
+	written := make(map[*TaskDelivery]int)
+	for _, record := range records {
+		if stackRecord, ok := record.(StackRecord); ok && stackRecord.delivery != nil {
+			written[stackRecord.delivery] += 1
 		}
 	}
-	sess := session.Must(session.NewSessionWithOptions(sessionOptions))
+	for delivery, count := range written {
+		delivery.written(count, err)
+	}
+}
+
+func Worker(workerIdx int, tasks <-chan Task, acker Acknowledger, storage Storage, pw *ProfilesWriter,
+	metrics MetricsPublisher, wg *sync.WaitGroup) {
+	var buf []byte
+	var err error
+
+	defer wg.Done()
+	acker = pw.audit.Acknowledger(acker)
 
 	for task := range tasks {
 		useSQS := task.Service != ""
 		serviceName := task.Service
 		log.Debugf("got new file %s from service %s (ID: %d)", task.Filename, serviceName, task.ServiceId)
+		if useSQS {
+			pw.audit.FileReceived(task)
+		}
 
 		if useSQS {
 			fullPath := fmt.Sprintf("products/%s/stacks/%s", task.Service, task.Filename)
-			buf, err = GetFileFromS3(sess, args.S3Bucket, fullPath)
+			buf, err = storage.Get(fullPath)
 			if err != nil {
 				log.Errorf("Error while fetching file from S3: %v", err)
 				// SLI Metric: S3 fetch failure (server error - counts against SLO)
-				// Only tracks SQS events; SendSLIMetric handles nil/enabled checks internally
-				GetMetricsPublisher().SendSLIMetric(
+				// Only tracks SQS events
+				metrics.SendSLIMetric(
 					ResponseTypeFailure,
 					"event_processing",
 					map[string]string{
@@ -91,36 +185,52 @@ func Worker(workerIdx int, args *CLIArgs, tasks <-chan SQSMessage, pw *ProfilesW
 					},
 				)
 
-				// Delete message from SQS after unsuccessful S3 fetch
-				deleteMessageWithMetrics(sess, task)
+				// Retry the message on a transient error, delete it otherwise
+				failTask(acker, task, err, pw.audit, metrics)
 				continue
 			}
-			temp = strings.Split(task.Filename, "_")[0]
 		} else {
 			buf, _ = ioutil.ReadFile(task.Filename)
-			tokens := strings.Split(filepath.Base(task.Filename), "_")
-			if len(tokens) > 2 {
-				temp = strings.Join(tokens[:3], ":")
-			}
 		}
 
-		layout := ISODateTimeFormat
-		timestamp, tsErr := time.Parse(layout, temp)
+		timestamp := pw.fileTimestamp(task, metrics)
 		log.Debugf("parsed timestamp is: %v", timestamp)
-		if tsErr != nil {
-			log.Debugf("Unable to fetch timestamp from filename %s, fallback to the current time", temp)
-			timestamp = time.Now().UTC()
+
+		// The SQS messages are deleted once the stacks are written to ClickHouse
+		if useSQS {
+			task.delivery = NewTaskDelivery(taskWritten(acker, task, pw.audit, metrics))
 		}
 
 		// Parse stack frame file and write to ClickHouse
-		err := pw.ParseStackFrameFile(sess, task, args.S3Bucket, timestamp, buf)
+		err := pw.ParseStackFrameFile(pw.residency.Storage(task.ServiceId, storage), task, timestamp, buf)
+		if errors.Is(err, ErrTimestampOutOfRange) {
+			log.Warnf("Rejected stack frame file %s: %v", task.Filename, err)
+
+			// SLI Metric: Profile of an agent with a bad clock (client error - does not count against SLO)
+			if useSQS {
+				metrics.SendSLIMetric(
+					ResponseTypeIgnoredFailure,
+					"event_processing",
+					map[string]string{
+						"service":  serviceName,
+						"error":    "timestamp_out_of_range",
+						"filename": task.Filename,
+					},
+				)
+
+				// The profile is rejected on purpose, retrying it would not help
+				pw.audit.FileRejected(task)
+				acknowledgeWithMetrics(acker, task, true, metrics)
+			}
+			continue
+		}
 		if err != nil {
 			log.Errorf("Error while parsing stack frame file: %v", err)
 
-			// SLI Metric: Parse event failure or write profile to column DB failure (server error - counts against SLO)
-			// Only tracks SQS events; SendSLIMetric handles nil/enabled checks internally
+			// SLI Metric: Parse event failure (server error - counts against SLO)
+			// Only tracks SQS events
 			if useSQS {
-				GetMetricsPublisher().SendSLIMetric(
+				metrics.SendSLIMetric(
 					ResponseTypeFailure,
 					"event_processing",
 					map[string]string{
@@ -130,27 +240,71 @@ func Worker(workerIdx int, args *CLIArgs, tasks <-chan SQSMessage, pw *ProfilesW
 					},
 				)
 
-				// Delete message from SQS after unsuccessful parse/write into column DB
-				deleteMessageWithMetrics(sess, task)
+				// The parse errors are permanent, the message is deleted and its delivery never completes
+				pw.audit.FileFailed(task)
+				acknowledgeWithMetrics(acker, task, false, metrics)
 			}
 			continue
 		}
 
-		// Delete message from SQS after successful processing
-		if useSQS {
-			deleteMessageWithMetrics(sess, task)
+		// Delete message from SQS once its stacks are written
+		task.delivery.Queued()
+	}
+	log.Debugf("Worker %d finished", workerIdx)
+}
+
+// taskWritten returns the completion of the delivery of an SQS task: the message is deleted once the stacks are
+// written, and retried when their insert failed
+func taskWritten(acker Acknowledger, task Task, audit *DeliveryAudit, metrics MetricsPublisher) func(err error) {
+	return func(err error) {
+		if err != nil {
+			log.Errorf("Error while writing the stacks of %s: %v", task.Filename, err)
 
-			// SLI Metric: Success! Event processed completely
-			// SendSLIMetric handles nil/enabled checks internally
-			GetMetricsPublisher().SendSLIMetric(
-				ResponseTypeSuccess,
+			// SLI Metric: write profile to column DB failure (server error - counts against SLO)
+			metrics.SendSLIMetric(
+				ResponseTypeFailure,
 				"event_processing",
 				map[string]string{
-					"service":  serviceName,
+					"service":  task.Service,
+					"error":    "parse_or_write_failed",
 					"filename": task.Filename,
 				},
 			)
+
+			// Retry the message on a transient error, delete it otherwise
+			failTask(acker, task, err, audit, metrics)
+			return
 		}
+
+		audit.FileProcessed(task)
+		acknowledgeWithMetrics(acker, task, true, metrics)
+
+		// SLI Metric: Success! Event processed completely
+		metrics.SendSLIMetric(
+			ResponseTypeSuccess,
+			"event_processing",
+			map[string]string{
+				"service":  task.Service,
+				"filename": task.Filename,
+			},
+		)
 	}
-	log.Debugf("Worker %d finished", workerIdx)
+}
+
+// fileTimestamp returns the start time of the profile from its file name, or the current time when
+// the file name does not follow the configured convention
+func (pw *ProfilesWriter) fileTimestamp(task Task, metrics MetricsPublisher) time.Time {
+	parser := pw.filenames
+	filename := task.Filename
+	if task.Service == "" {
+		parser = folderFilenames
+		filename = filepath.Base(task.Filename)
+	}
+	info, err := parser.Parse(filename)
+	if err != nil {
+		log.Warnf("Unable to fetch timestamp from filename %s, fallback to the current time: %v", filename, err)
+		metrics.SendErrorMetric("filename_timestamp_fallback", map[string]string{"service": task.Service})
+		return time.Now().UTC()
+	}
+	return info.Timestamp
 }
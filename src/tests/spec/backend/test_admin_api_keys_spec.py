@@ -0,0 +1,106 @@
+#!/usr/bin/env python3
+"""
+Fast acceptance tests for the API keys of the admin API.
+
+These call ``verify_admin_token`` and the API key routes of ``backend.routers.admin_routes`` in-process with a
+patched token and a fake ``DBManager``, with no database or HTTP server. The admin API must be disabled when
+ADMIN_API_TOKEN is not set, and the keys must only be returned in full by the request creating them.
+
+Run:
+    cd src && python -m pytest tests/spec/backend/test_admin_api_keys_spec.py -v
+"""
+
+from datetime import datetime
+
+import pytest
+
+pytest.importorskip("pydantic", reason="pydantic is required for these spec tests")
+pytest.importorskip("fastapi", reason="fastapi is required for these spec tests")
+
+try:
+    from fastapi import HTTPException
+    from fastapi.responses import Response
+    from backend.models.admin_models import AdminApiKey
+    from backend.routers import admin_routes
+except Exception as exc:  # pragma: no cover - environment guard
+    pytest.skip(f"backend modules not importable: {exc}", allow_module_level=True)
+
+
+TOKEN = "k3yT0k3nW1thAL0ngT41l"
+
+
+def _api_key(external_id: str = "team-a") -> dict:
+    return {"external_id": external_id, "api_key": TOKEN, "description": "agents", "created_at": datetime(2024, 1, 1)}
+
+
+class _FakeDBManager:
+    created = True
+
+    def get_admin_api_keys(self):
+        return [_api_key("team-a"), _api_key("team-b")]
+
+    def get_admin_api_key(self, external_id):
+        return _api_key(external_id)
+
+    def upsert_admin_api_key(self, external_id, description):
+        return dict(_api_key(external_id), description=description, created=self.created)
+
+
+@pytest.fixture
+def admin_token(monkeypatch):
+    monkeypatch.setattr(admin_routes, "ADMIN_API_TOKEN", "s3cret")
+    return "s3cret"
+
+
+@pytest.fixture
+def db_manager(monkeypatch):
+    monkeypatch.setattr(admin_routes, "DBManager", _FakeDBManager)
+    return _FakeDBManager
+
+
+class TestAdminApiToken:
+    @pytest.mark.parametrize("header", [None, "", "anything"])
+    def test_admin_api_is_disabled_without_a_token(self, monkeypatch, header):
+        monkeypatch.setattr(admin_routes, "ADMIN_API_TOKEN", "")
+        with pytest.raises(HTTPException) as e:
+            admin_routes.verify_admin_token(header)
+        assert e.value.status_code == 403
+        assert "ADMIN_API_TOKEN is not set" in e.value.detail
+
+    @pytest.mark.parametrize("header", [None, "", "wrong", "s3cret "])
+    def test_invalid_token_is_rejected(self, admin_token, header):
+        with pytest.raises(HTTPException) as e:
+            admin_routes.verify_admin_token(header)
+        assert e.value.status_code == 403
+
+    def test_valid_token_is_accepted(self, admin_token):
+        assert admin_routes.verify_admin_token(admin_token) is None
+
+    def test_every_route_requires_the_token(self):
+        assert any(
+            dependency.dependency is admin_routes.verify_admin_token for dependency in admin_routes.router.dependencies
+        ), "the admin router must depend on verify_admin_token"
+
+
+class TestAdminApiKeys:
+    def test_list_masks_the_keys(self, db_manager):
+        api_keys = [AdminApiKey(**api_key) for api_key in admin_routes.get_api_keys()]
+        assert [api_key.external_id for api_key in api_keys] == ["team-a", "team-b"]
+        for api_key in api_keys:
+            assert api_key.api_key is None
+            assert api_key.api_key_prefix == TOKEN[: admin_routes.API_KEY_PREFIX_LENGTH]
+            assert TOKEN not in api_key.json()
+
+    def test_get_masks_the_key(self, db_manager):
+        api_key = AdminApiKey(**admin_routes.get_api_key("team-a"))
+        assert api_key.api_key is None and TOKEN not in api_key.json()
+
+    def test_key_is_revealed_on_creation_only(self, db_manager, monkeypatch):
+        response = Response()
+        created = AdminApiKey(**admin_routes.put_api_key(admin_routes.AdminApiKeySpec(), response, "team-a"))
+        assert response.status_code == 201
+        assert created.api_key == TOKEN
+
+        monkeypatch.setattr(_FakeDBManager, "created", False)
+        updated = AdminApiKey(**admin_routes.put_api_key(admin_routes.AdminApiKeySpec(), Response(), "team-a"))
+        assert updated.api_key is None and TOKEN not in updated.json()
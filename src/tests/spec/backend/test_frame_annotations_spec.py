@@ -0,0 +1,108 @@
+#!/usr/bin/env python3
+"""
+Fast acceptance tests for the frame annotations returned with flamegraphs.
+
+These exercise ``backend.utils.flamegraph_utils.attach_annotations`` and the ``FrameAnnotation`` model in-process,
+with no database or HTTP server.
+
+Run:
+    cd src && python -m pytest tests/spec/backend/test_frame_annotations_spec.py -v
+"""
+
+from datetime import datetime
+
+import pytest
+
+pytest.importorskip("pydantic", reason="pydantic is required for these spec tests")
+pytest.importorskip("humps", reason="pyhumps is required for these spec tests")
+
+try:
+    from pydantic import ValidationError
+    from backend.models.annotations_models import FrameAnnotation, GetFrameAnnotation
+    from backend.utils.flamegraph_utils import attach_annotations
+except Exception as exc:  # pragma: no cover - environment guard
+    pytest.skip(f"backend modules not importable: {exc}", allow_module_level=True)
+
+
+def _annotation(annotation_id, frame_path, **fields):
+    now = datetime(2024, 3, 1, 12, 0, 0)
+    data = {
+        "id": annotation_id,
+        "frame_path": frame_path,
+        "annotation_type": "note",
+        "content": f"note {annotation_id}",
+        "created_at": now,
+        "updated_at": now,
+    }
+    data.update(fields)
+    return GetFrameAnnotation(**data)
+
+
+def _flamegraph():
+    return {
+        "name": "root",
+        "value": 10,
+        "children": [
+            {
+                "name": "main",
+                "value": 10,
+                "children": [
+                    {"name": "handle", "suffix": "_[j]", "value": 6, "children": []},
+                    {"name": "flush", "value": 4, "children": []},
+                ],
+            }
+        ],
+    }
+
+
+class TestAttachAnnotations:
+    def test_annotation_ids_are_added_to_the_matching_frame(self):
+        flamegraph = attach_annotations(_flamegraph(), [_annotation(1, ["main", "flush"]), _annotation(2, ["main"])])
+        main = flamegraph["children"][0]
+        assert main["annotationIds"] == [2]
+        assert main["children"][1]["annotationIds"] == [1]
+        assert "annotationIds" not in main["children"][0]
+
+    def test_frame_matches_its_name_with_or_without_suffix(self):
+        annotations = [_annotation(1, ["main", "handle"]), _annotation(2, ["main", "handle_[j]"])]
+        flamegraph = attach_annotations(_flamegraph(), annotations)
+        assert flamegraph["children"][0]["children"][0]["annotationIds"] == [1, 2]
+
+    def test_annotations_outside_the_flamegraph_are_still_returned(self):
+        flamegraph = attach_annotations(_flamegraph(), [_annotation(1, ["main", "missing", "flush"])])
+        assert all("annotationIds" not in child for child in flamegraph["children"][0]["children"])
+        assert [annotation["id"] for annotation in flamegraph["annotations"]] == [1]
+
+    def test_annotations_are_serialized_with_camel_case_keys(self):
+        flamegraph = attach_annotations(_flamegraph(), [_annotation(1, ["main"], link="https://jira/PERF-1")])
+        annotation = flamegraph["annotations"][0]
+        assert annotation["framePath"] == ["main"]
+        assert annotation["annotationType"] == "note"
+        assert annotation["includeSubtree"] is True
+        assert annotation["link"] == "https://jira/PERF-1"
+
+    def test_no_annotations(self):
+        flamegraph = attach_annotations(_flamegraph(), [])
+        assert flamegraph["annotations"] == []
+        assert "annotationIds" not in flamegraph["children"][0]
+
+
+class TestFrameAnnotationModel:
+    def test_frame_path_is_required(self):
+        with pytest.raises(ValidationError):
+            FrameAnnotation(frame_path=[], annotation_type="note", content="slow")
+
+    def test_content_is_required(self):
+        with pytest.raises(ValidationError):
+            FrameAnnotation(frame_path=["main"], annotation_type="note", content="")
+
+    def test_unknown_annotation_type_is_rejected(self):
+        with pytest.raises(ValidationError):
+            FrameAnnotation(frame_path=["main"], annotation_type="todo", content="slow")
+
+    def test_camel_case_payload(self):
+        annotation = FrameAnnotation(
+            **{"framePath": ["main"], "annotationType": "jira", "content": "PERF-1", "includeSubtree": False}
+        )
+        assert annotation.frame_path == ["main"]
+        assert annotation.include_subtree is False
@@ -0,0 +1,52 @@
+#!/usr/bin/env python3
+"""
+Fast acceptance tests for the admin token protecting the archive and restore of the services.
+
+These call ``verify_admin_token`` of ``backend.routers.services_routes`` in-process with a patched token,
+with no database or HTTP server. Services must not be archived nor restored when SERVICES_ADMIN_TOKEN is not set.
+
+Run:
+    cd src && python -m pytest tests/spec/backend/test_services_admin_spec.py -v
+"""
+
+import pytest
+
+pytest.importorskip("fastapi", reason="fastapi is required for these spec tests")
+
+try:
+    from fastapi import HTTPException
+    from backend.routers import services_routes
+except Exception as exc:  # pragma: no cover - environment guard
+    pytest.skip(f"backend modules not importable: {exc}", allow_module_level=True)
+
+
+@pytest.fixture
+def admin_token(monkeypatch):
+    monkeypatch.setattr(services_routes, "SERVICES_ADMIN_TOKEN", "s3cret")
+    return "s3cret"
+
+
+class TestServicesAdminToken:
+    @pytest.mark.parametrize("header", [None, "", "anything"])
+    def test_archive_is_disabled_without_a_token(self, monkeypatch, header):
+        monkeypatch.setattr(services_routes, "SERVICES_ADMIN_TOKEN", "")
+        with pytest.raises(HTTPException) as e:
+            services_routes.verify_admin_token(header)
+        assert e.value.status_code == 403
+        assert "SERVICES_ADMIN_TOKEN is not set" in e.value.detail
+
+    @pytest.mark.parametrize("header", [None, "", "wrong", "s3cret "])
+    def test_invalid_token_is_rejected(self, admin_token, header):
+        with pytest.raises(HTTPException) as e:
+            services_routes.verify_admin_token(header)
+        assert e.value.status_code == 403
+
+    def test_valid_token_is_accepted(self, admin_token):
+        assert services_routes.verify_admin_token(admin_token) is None
+
+    @pytest.mark.parametrize("method", ["archive_service", "restore_service"])
+    def test_changes_require_the_token(self, method):
+        route = next(route for route in services_routes.router.routes if getattr(route, "name", None) == method)
+        assert any(
+            dependency.call is services_routes.verify_admin_token for dependency in route.dependant.dependencies
+        ), f"{method} must depend on verify_admin_token"
@@ -0,0 +1,60 @@
+#!/usr/bin/env python3
+"""
+Unit tests for the /api/admin/api_keys endpoints.
+
+This module contains pytest-based unit tests that validate:
+1. Listing, reading, creating or revoking API keys without a valid admin token is rejected
+2. The listed API keys are masked when the admin token is given (GPROFILER_ADMIN_API_TOKEN environment variable)
+"""
+
+import os
+from typing import Any, Dict, Optional
+
+import pytest
+import requests
+
+
+@pytest.fixture
+def api_keys_url(backend_base_url) -> str:
+    """Get the base URL of the API keys endpoints."""
+    return f"{backend_base_url}/api/admin/api_keys"
+
+
+def _headers(credentials: Dict[str, Any], admin_token: Optional[str]) -> Dict[str, Any]:
+    headers = dict(credentials)
+    if admin_token is not None:
+        headers["GPROFILER-ADMIN-TOKEN"] = admin_token
+    return headers
+
+
+class TestAdminApiKeysEndpoints:
+    """Test class for the API keys endpoints of the admin API."""
+
+    @pytest.mark.parametrize("admin_token", [None, "", "invalid-admin-token"])
+    @pytest.mark.parametrize(
+        "method, path", [("get", ""), ("get", "/team-a"), ("put", "/team-a"), ("delete", "/team-a")]
+    )
+    def test_api_keys_require_admin_token(
+        self, api_keys_url: str, credentials: Dict[str, Any], admin_token: str, method: str, path: str
+    ):
+        """Test the API keys endpoints without a valid admin token."""
+        response = requests.request(
+            method,
+            f"{api_keys_url}{path}",
+            headers=_headers(credentials, admin_token),
+            json={},
+            timeout=10,
+            verify=False,
+        )
+        assert response.status_code == 403, f"Expected 403, got {response.status_code}: {response.text}"
+
+    def test_list_api_keys_is_masked(self, api_keys_url: str, credentials: Dict[str, Any]):
+        """Test the listed API keys only show their prefix."""
+        admin_token = os.getenv("GPROFILER_ADMIN_API_TOKEN")
+        if not admin_token:
+            pytest.skip("GPROFILER_ADMIN_API_TOKEN is not set")
+        response = requests.get(api_keys_url, headers=_headers(credentials, admin_token), timeout=10, verify=False)
+        assert response.status_code == 200, f"Expected 200, got {response.status_code}: {response.text}"
+        for api_key in response.json():
+            assert api_key.get("apiKey") is None
+            assert api_key["apiKeyPrefix"]
@@ -0,0 +1,167 @@
+#!/usr/bin/env python3
+"""
+Unit tests for the /api/annotations endpoints.
+
+This module contains pytest-based unit tests that validate:
+1. Creating, listing, editing and deleting frame annotations of a service
+2. Unknown services and annotations
+3. Invalid annotations
+"""
+
+from datetime import datetime
+from typing import Any, Dict
+
+import pytest
+import requests
+
+SERVICE_NAME = "test-service"
+
+
+@pytest.fixture
+def annotations_url(backend_base_url) -> str:
+    """Get the base URL of the annotations endpoints."""
+    return f"{backend_base_url}/api/annotations"
+
+
+@pytest.fixture(autouse=True)
+def registered_service(backend_base_url: str, credentials: Dict[str, Any]):
+    """Make sure the service exists, heartbeats register it."""
+    response = requests.post(
+        f"{backend_base_url}/api/metrics/heartbeat",
+        headers=credentials,
+        json={
+            "hostname": "test-host",
+            "ip_address": "127.0.0.1",
+            "service_name": SERVICE_NAME,
+            "status": "active",
+            "timestamp": datetime.now().isoformat(),
+            "last_command_id": None,
+        },
+        timeout=10,
+        verify=False,
+    )
+    assert response.status_code == 200, f"Expected 200, got {response.status_code}: {response.text}"
+
+
+@pytest.fixture
+def valid_annotation_data() -> Dict[str, Any]:
+    """Provide a valid annotation."""
+    return {
+        "framePath": ["main", "handle_request"],
+        "includeSubtree": True,
+        "annotationType": "jira",
+        "content": "PERF-123 slow request parsing",
+        "link": "https://jira.example.com/browse/PERF-123",
+        "author": "test-user",
+    }
+
+
+def _list_annotations(annotations_url: str, credentials: Dict[str, Any]) -> list:
+    response = requests.get(
+        f"{annotations_url}/service/{SERVICE_NAME}", headers=credentials, timeout=10, verify=False
+    )
+    assert response.status_code == 200, f"Expected 200, got {response.status_code}: {response.text}"
+    return response.json()
+
+
+class TestFrameAnnotationsEndpoints:
+    """Test class for the frame annotations endpoints."""
+
+    def test_annotation_lifecycle(
+        self,
+        annotations_url: str,
+        valid_annotation_data: Dict[str, Any],
+        credentials: Dict[str, Any],
+    ):
+        """Test creating, listing, editing and deleting an annotation."""
+        response = requests.post(
+            f"{annotations_url}/service/{SERVICE_NAME}",
+            headers=credentials,
+            json=valid_annotation_data,
+            timeout=10,
+            verify=False,
+        )
+        assert response.status_code == 201, f"Expected 201, got {response.status_code}: {response.text}"
+        annotation_id = response.json()
+        assert isinstance(annotation_id, int)
+
+        annotations = {annotation["id"]: annotation for annotation in _list_annotations(annotations_url, credentials)}
+        assert annotation_id in annotations, "Created annotation should be listed"
+        annotation = annotations[annotation_id]
+        for field, value in valid_annotation_data.items():
+            assert annotation[field] == value, f"Unexpected {field}: {annotation[field]}"
+
+        edited = {**valid_annotation_data, "annotationType": "note", "content": "fixed in 1.2.3", "link": None}
+        response = requests.put(
+            f"{annotations_url}/{annotation_id}", headers=credentials, json=edited, timeout=10, verify=False
+        )
+        assert response.status_code == 200, f"Expected 200, got {response.status_code}: {response.text}"
+        assert response.json() == annotation_id
+
+        annotations = {annotation["id"]: annotation for annotation in _list_annotations(annotations_url, credentials)}
+        assert annotations[annotation_id]["annotationType"] == "note"
+        assert annotations[annotation_id]["content"] == "fixed in 1.2.3"
+        assert annotations[annotation_id]["link"] is None
+
+        response = requests.delete(f"{annotations_url}/{annotation_id}", headers=credentials, timeout=10, verify=False)
+        assert response.status_code == 204, f"Expected 204, got {response.status_code}: {response.text}"
+
+        annotation_ids = [annotation["id"] for annotation in _list_annotations(annotations_url, credentials)]
+        assert annotation_id not in annotation_ids, "Deleted annotation should not be listed"
+
+    def test_unknown_service(
+        self,
+        annotations_url: str,
+        valid_annotation_data: Dict[str, Any],
+        credentials: Dict[str, Any],
+    ):
+        """Test listing and creating annotations of a service that does not exist."""
+        url = f"{annotations_url}/service/no-such-service-for-annotations"
+        response = requests.get(url, headers=credentials, timeout=10, verify=False)
+        assert response.status_code == 404, f"Expected 404, got {response.status_code}: {response.text}"
+
+        response = requests.post(url, headers=credentials, json=valid_annotation_data, timeout=10, verify=False)
+        assert response.status_code == 404, f"Expected 404, got {response.status_code}: {response.text}"
+
+    def test_edit_unknown_annotation(
+        self,
+        annotations_url: str,
+        valid_annotation_data: Dict[str, Any],
+        credentials: Dict[str, Any],
+    ):
+        """Test editing an annotation that does not exist."""
+        response = requests.put(
+            f"{annotations_url}/2147483647",
+            headers=credentials,
+            json=valid_annotation_data,
+            timeout=10,
+            verify=False,
+        )
+        assert response.status_code == 404, f"Expected 404, got {response.status_code}: {response.text}"
+
+    @pytest.mark.parametrize(
+        "field,value",
+        [
+            ("framePath", []),
+            ("content", ""),
+            ("annotationType", "todo"),
+        ],
+    )
+    def test_invalid_annotation(
+        self,
+        annotations_url: str,
+        valid_annotation_data: Dict[str, Any],
+        credentials: Dict[str, Any],
+        field: str,
+        value: Any,
+    ):
+        """Test creating an invalid annotation."""
+        invalid_annotation = {**valid_annotation_data, field: value}
+        response = requests.post(
+            f"{annotations_url}/service/{SERVICE_NAME}",
+            headers=credentials,
+            json=invalid_annotation,
+            timeout=10,
+            verify=False,
+        )
+        assert response.status_code == 422, f"Expected 422, got {response.status_code}: {response.text}"
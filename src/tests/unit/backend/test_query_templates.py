@@ -0,0 +1,72 @@
+#!/usr/bin/env python3
+"""
+Unit tests for the /api/query_templates endpoints.
+
+This module contains pytest-based unit tests that validate:
+1. Query templates can be listed by every user
+2. Creating, replacing or deleting query templates without a valid admin token is rejected
+"""
+
+from typing import Any, Dict
+
+import pytest
+import requests
+
+
+@pytest.fixture
+def query_templates_url(backend_base_url) -> str:
+    """Get the base URL of the query templates endpoints."""
+    return f"{backend_base_url}/api/query_templates"
+
+
+@pytest.fixture
+def valid_template_data() -> Dict[str, Any]:
+    """Provide a valid query template."""
+    return {"description": "test template", "serviceNames": ["test-service"], "lookbackSeconds": 3600}
+
+
+class TestQueryTemplatesEndpoints:
+    """Test class for the query templates endpoints."""
+
+    def test_list_query_templates(self, query_templates_url: str, credentials: Dict[str, Any]):
+        """Test listing the query templates without an admin token."""
+        response = requests.get(query_templates_url, headers=credentials, timeout=10, verify=False)
+        assert response.status_code == 200, f"Expected 200, got {response.status_code}: {response.text}"
+        assert isinstance(response.json(), list)
+
+    @pytest.mark.parametrize("admin_token", [None, "", "invalid-admin-token"])
+    def test_put_query_template_requires_admin_token(
+        self,
+        query_templates_url: str,
+        valid_template_data: Dict[str, Any],
+        credentials: Dict[str, Any],
+        admin_token: str,
+    ):
+        """Test creating a query template without a valid admin token."""
+        headers = dict(credentials)
+        if admin_token is not None:
+            headers["GPROFILER-ADMIN-TOKEN"] = admin_token
+        response = requests.put(
+            f"{query_templates_url}/unauthorized-template",
+            headers=headers,
+            json=valid_template_data,
+            timeout=10,
+            verify=False,
+        )
+        assert response.status_code == 403, f"Expected 403, got {response.status_code}: {response.text}"
+
+    @pytest.mark.parametrize("admin_token", [None, "invalid-admin-token"])
+    def test_delete_query_template_requires_admin_token(
+        self,
+        query_templates_url: str,
+        credentials: Dict[str, Any],
+        admin_token: str,
+    ):
+        """Test deleting a query template without a valid admin token."""
+        headers = dict(credentials)
+        if admin_token is not None:
+            headers["GPROFILER-ADMIN-TOKEN"] = admin_token
+        response = requests.delete(
+            f"{query_templates_url}/unauthorized-template", headers=headers, timeout=10, verify=False
+        )
+        assert response.status_code == 403, f"Expected 403, got {response.status_code}: {response.text}"